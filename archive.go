@@ -0,0 +1,170 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// runArchive exports the newest snapshot of each disk to GCS, or verifies the
+// archives of a manifest with "archive verify", and returns the exit code.
+func runArchive(args []string) int {
+  if len(args) > 0 && args[0] == "verify" {
+    return runArchiveVerify(args[1:])
+  }
+  flags := flag.NewFlagSet(os.Args[0] + " archive", flag.ContinueOnError)
+  destination := flags.String("destination", "", "GCS prefix of the archives, as gs://<bucket>/<prefix>/, e.g. a Nearline bucket")
+  filter := flags.String("filter", "", "Filter of the disks whose newest snapshot is archived, all the disks if empty")
+  concurrency := flags.Int("concurrency", 2, "Number of exports at the same time")
+  exportTimeout := flags.Duration("export-timeout", 2 * time.Hour, "Maximum duration of the export of a snapshot, no limit if 0")
+  timeout := flags.Duration("timeout", 12 * time.Hour, "Maximum duration of the whole archive, no limit if 0")
+  summaryFile := flags.String("summary-file", "", "Path of a JSON file to write the report of the archive to")
+  project := flags.String("project", envProject(), "Project of the disks (default $GOOGLE_CLOUD_PROJECT, $CLOUDSDK_CORE_PROJECT or the configured one)")
+  dryRun := flags.Bool("dry-run", false, "Find the snapshots to archive but don't export them")
+  backendName := flags.String("backend", "gcloud", "Use the gcloud command (gcloud) or the Compute Engine API (api), the exports need gcloud")
+  maxRetries := flags.Int("max-retries", 3, "Number of retries of the gcloud commands or API calls failing with a transient error")
+  gcloudPath := flags.String("gcloud-path", "gcloud", "Path of the gcloud command, searched in the PATH by default")
+  var credentials backups.Credentials
+  credentialsFlags(flags, &credentials.ImpersonateServiceAccount, &credentials.CredentialsFile, &credentials.BillingProject)
+  skipPreflight := flags.Bool("skip-preflight", false, "Don't check that gcloud is installed and configured before starting")
+  err := flags.Parse(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err != nil {
+    return backups.ExitUsage
+  }
+  if *destination == "" {
+    log.Println("The --destination of the archives is required, as gs://<bucket>/<prefix>/")
+    return backups.ExitUsage
+  }
+  if *concurrency < 1 || *exportTimeout < 0 || *timeout < 0 {
+    log.Println("Invalid --concurrency, --export-timeout or --timeout")
+    return backups.ExitUsage
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+  if *timeout > 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, *timeout)
+    defer cancel()
+  }
+
+  backend, closeBackend, err := newBackend(ctx, *backendName, *gcloudPath, credentials, *maxRetries, false)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  defer closeBackend()
+  if !*skipPreflight {
+    err = preflight(ctx, backend, *project == "")
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+  }
+  if *project != "" {
+    backend = backend.WithProject(*project)
+  }
+
+  report, err := backups.RunArchive(ctx, backups.ArchiveOptions{Destination: *destination, Filter: *filter, Concurrency: *concurrency, ExportTimeout: *exportTimeout, DryRun: *dryRun, Backend: backend})
+  if *summaryFile != "" {
+    writeErr := report.WriteFile(*summaryFile)
+    if writeErr != nil {
+      log.Printf("WARNING: failed to write the report: %s\n", writeErr)
+    }
+  }
+  logArchiveReport(report)
+  if err != nil && len(report.Archives) == 0 {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitPartialFailure
+  }
+  if report.Manifest != "" {
+    fmt.Println(report.Manifest)
+  }
+  if len(report.Failed()) > 0 {
+    return backups.ExitPartialFailure
+  }
+  return backups.ExitOK
+}
+
+// logArchiveReport prints the outcome of each disk.
+func logArchiveReport(report backups.ArchiveReport) {
+  archived := 0
+  for archiveIndex := 0; archiveIndex < len(report.Archives); archiveIndex++ {
+    if report.Archives[archiveIndex].Status == backups.ArchiveArchived {
+      archived++
+    }
+  }
+  log.Println("")
+  log.Println("Summary:")
+  log.Printf("  Disks archived:    %d of %d\n", archived, len(report.Archives))
+  for archiveIndex := 0; archiveIndex < len(report.Archives); archiveIndex++ {
+    archive := report.Archives[archiveIndex]
+    switch archive.Status {
+    case backups.ArchiveArchived:
+      log.Printf("    - %s: %s\n", archive.Disk, archive.Object)
+    case backups.ArchiveSkipped:
+      log.Printf("    - %s: skipped, no READY snapshot\n", archive.Disk)
+    default:
+      log.Printf("    - %s: %s %s\n", archive.Disk, archive.Status, archive.Error)
+    }
+  }
+  if report.Manifest != "" {
+    log.Printf("  Manifest:          %s\n", report.Manifest)
+  }
+}
+
+// runArchiveVerify checks the objects of an archive manifest, and returns the
+// exit code.
+func runArchiveVerify(args []string) int {
+  flags := flag.NewFlagSet(os.Args[0] + " archive verify", flag.ContinueOnError)
+  manifest := flags.String("manifest", "", "Manifest of the archive run to verify, as printed by the archive subcommand (gs://<bucket>/<object> or local path)")
+  err := flags.Parse(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err != nil {
+    return backups.ExitUsage
+  }
+  if *manifest == "" {
+    log.Println("The --manifest to verify is required")
+    return backups.ExitUsage
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  checks, err := backups.VerifyArchives(ctx, *manifest)
+  for checkIndex := 0; checkIndex < len(checks); checkIndex++ {
+    check := checks[checkIndex]
+    if check.Problem != "" {
+      log.Printf("FAILED %s: %s (%s)\n", check.Disk, check.Object, check.Problem)
+    } else {
+      log.Printf("OK     %s: %s (%d bytes)\n", check.Disk, check.Object, check.SizeBytes)
+    }
+  }
+  if errors.Is(err, backups.ErrArchiveMismatch) {
+    log.Println(err)
+    return backups.ExitPartialFailure
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  log.Printf("%d archive(s) verified\n", len(checks))
+  return backups.ExitOK
+}
@@ -1,242 +1,563 @@
 package main
 
 import (
-  "os/exec"
+  "context"
+  "errors"
+  "os"
+  "sync"
   "log"
   "flag"
-  "encoding/json"
+  "fmt"
   "strings"
-  "errors"
   "time"
-  "fmt"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+  "go.opentelemetry.io/otel/attribute"
 )
 
-type Disk struct {
-  Name      string
-  Id        string
-  Zone      string
-  Snapshots []Snapshot
+func main() {
+  if len(os.Args) > 1 {
+    switch os.Args[1] {
+    case "restore":
+      os.Exit(runRestore(os.Args[2:]))
+    case "list":
+      os.Exit(runList(os.Args[2:]))
+    case "inventory":
+      os.Exit(runInventory(os.Args[2:]))
+    case "doctor":
+      os.Exit(runDoctor(os.Args[2:]))
+    case "archive":
+      os.Exit(runArchive(os.Args[2:]))
+    case "policy":
+      os.Exit(runPolicy(os.Args[2:]))
+    case "report":
+      os.Exit(runReport(os.Args[2:]))
+    case "drill":
+      os.Exit(run(os.Args[2:], true))
+    }
+  }
+  os.Exit(run(os.Args[1:], false))
 }
 
-type Snapshot struct {
-  Name string
-  Id   string
+// newBackend creates the backend by name with the credentials, retrying the
+// transient failures, with the function closing it.
+func newBackend(ctx context.Context, name string, gcloudPath string, credentials backups.Credentials, maxRetries int, verbose bool) (backups.Backend, func(), error) {
+  retry := backups.Retry{MaxRetries: maxRetries}
+  if verbose {
+    retry.Verbose = log.Default()
+  }
+  switch name {
+  case "gcloud":
+    gcloud := backups.NewGcloud(backups.RetryRunner{Commands: backups.ExecRunner{Stderr: os.Stderr, Env: credentials.GcloudEnv()}, Retry: retry})
+    return gcloud.WithPath(gcloudPath).WithCredentials(credentials), func() {}, nil
+  case "api":
+    api, err := backups.NewAPI(ctx, retry, credentials)
+    if err != nil {
+      return nil, nil, err
+    }
+    return api, func() { api.Close() }, nil
+  }
+  return nil, nil, fmt.Errorf("Unknown backend '%s', use 'gcloud' or 'api'", name)
 }
 
-func Max(x, y int) int {
-  if x > y {
-    return x
+// run does the backup, or the restore drill, or runs the daemon, and returns
+// the exit code once the deferred calls are done.
+func run(args []string, drill bool) int {
+  config, cli, err := parseConfig(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  config.Drill = drill
+  if err == nil {
+    err = config.Validate()
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitUsage
   }
-  return y
-}
 
-func getCommandResult(command string, args []string) ([]byte, error) {
-  cmd := exec.Command(command, args...)
-  cmdOut, cmdErr := cmd.CombinedOutput()
-  if cmdErr != nil {
-    log.Printf("%s", cmdOut)
-    log.Fatal(cmdErr)
-    return make([]byte, 0), errors.New("Command error: `" + strings.Join(args, " ") + "`")
+  if cli.validateConfig {
+    fmt.Print(config)
+    return backups.ExitOK
+  }
+  if cli.testEmail {
+    return testEmail(config)
   }
 
-  return cmdOut, nil
-}
+  notifiers := make([]backups.Notifier, 0)
+  if config.Notifications.SlackWebhookURL != "" {
+    notifiers = append(notifiers, backups.SlackNotifier{WebhookURL: config.Notifications.SlackWebhookURL})
+  }
+  if config.Notifications.PubSub.Topic != "" {
+    notifiers = append(notifiers, backups.PubSubNotifier{Topic: config.Notifications.PubSub.Topic, PerDisk: config.Notifications.PubSub.PerDisk})
+  }
+  if config.Notifications.Email.Host != "" {
+    notifiers = append(notifiers, emailNotifier(config.Notifications.Email))
+  }
+  alerting := config.Notifications.Alerting
+  if alerting.PagerDutyRoutingKey != "" {
+    notifiers = append(notifiers, backups.PagerDutyNotifier{RoutingKey: alerting.PagerDutyRoutingKey, Conditions: alerting.On})
+  }
+  if alerting.OpsgenieAPIKey != "" {
+    notifiers = append(notifiers, backups.OpsgenieNotifier{APIKey: alerting.OpsgenieAPIKey, Conditions: alerting.On, URL: alerting.OpsgenieURL})
+  }
+  for webhookIndex := 0; webhookIndex < len(config.Notifications.Webhooks); webhookIndex++ {
+    webhook := config.Notifications.Webhooks[webhookIndex]
+    notifiers = append(notifiers, backups.WebhookNotifier{URL: webhook.URL, Template: webhook.Template, Headers: webhook.Headers, Retry: backups.Retry{MaxRetries: 2}})
+  }
 
-func getDisksToSnapshot(filter string) ([]Disk, error) {
-  disks := make([]Disk, 0)
+  // Interrupting stops starting new operations, then cancels the ones in
+  // progress after the grace period
+  ctx, stop := gracefulShutdown(config.GracePeriod)
+  defer stop()
 
-  cmdListDisksOut, err := getCommandResult("gcloud", []string{"beta", "compute", "disks", "list", "--filter", filter, "--format", "json"})
+  shutdownTracing, err := backups.SetupTracing(ctx, config.OTLPEndpoint)
   if err != nil {
-    return disks, err
+    log.Println(err)
+    return backups.ExitListingFailure
   }
-  json.Unmarshal(cmdListDisksOut, &disks)
-
-  return disks, nil
-}
-
-func getDiskSnapshots(disk Disk) ([]Snapshot, error) {
-  snapshots := make([]Snapshot, 0)
+  defer func() {
+    // The spans are flushed even once interrupted
+    flushCtx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    flushErr := shutdownTracing(flushCtx)
+    if flushErr != nil {
+      log.Printf("WARNING: failed to export the traces: %s\n", flushErr)
+    }
+  }()
 
-  cmdSnapshotsOut, err := getCommandResult("gcloud", []string{"beta", "compute", "snapshots", "list", "--sort-by", "~creationTimestamp", "--filter", "sourceDiskId = " + disk.Id, "--format", "json"})
+  backend, closeBackend, err := newBackend(ctx, config.Backend, config.GcloudPath, config.credentials(), config.MaxRetries, config.Verbose)
   if err != nil {
-    return snapshots, err
+    log.Println(err)
+    return backups.ExitListingFailure
   }
-  json.Unmarshal(cmdSnapshotsOut, &snapshots)
+  defer closeBackend()
 
-  return snapshots, nil
+  if config.Daemon {
+    return runDaemon(ctx, config, backend, notifiers)
+  }
+  if config.Serve != "" {
+    return runServer(ctx, config, backend, notifiers)
+  }
+  return backup(ctx, config, backend, notifiers).ExitCode
 }
 
-func createSnapshotForDisk(disk Disk, dryRun bool) (Snapshot, error) {
-  // Asynchronous
-  now := time.Now()
-  timePart := fmt.Sprintf("%04d%02d%02d%02d%02d", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute())
-
-  maxSnapshotName := 55
-  spaceLeft := maxSnapshotName - len(timePart) - len("" + disk.Id)
-
-  namesParts := strings.Split(disk.Name, "-")
-  namesPartsLen := len(namesParts)
-  startPartEnd := 0
-  endPartStart := namesPartsLen
+// backup runs all the plans in all the projects, or applies the plan file,
+// writes their summary and returns their report, with the worst exit code.
+func backup(ctx context.Context, config Config, backend backups.Backend, notifiers []backups.Notifier) (report backups.Report) {
+  // The logs of overlapping runs are told apart by the run id
+  runID := config.RunID
+  if runID == "" {
+    runID = backups.NewRunID(time.Now())
+  }
+  defer log.SetPrefix(log.Prefix())
+  defer log.SetFlags(log.Flags())
+  log.SetPrefix("[" + runID + "] ")
+  log.SetFlags(log.Flags() | log.Lmsgprefix)
+
+  ctx, span := backups.StartSpan(ctx, "backup", attribute.String("run.id", runID))
+  defer func() {
+    span.SetAttributes(attribute.String("run.id", report.RunID), attribute.Int("exit_code", report.ExitCode))
+    var spanErr error
+    if report.Error != "" {
+      spanErr = errors.New(report.Error)
+    } else if report.ExitCode != backups.ExitOK {
+      spanErr = fmt.Errorf("Exit code %d", report.ExitCode)
+    }
+    backups.EndSpan(span, spanErr)
+  }()
+
+  // Until the runs are done
+  report = backups.Report{RunID: runID, Runs: make([]backups.Summary, 0), ExitCode: backups.ExitListingFailure}
+
+  // The lock is held by the whole backup, a locked one is not a failure for
+  // the healthcheck. A verification is read-only and a drill doesn't touch
+  // the snapshots, they are not locked nor pinged
+  if config.LockGCS != "" && config.backsUp() {
+    bucket, object, _ := backups.ParseGCSURI(config.LockGCS)
+    hostname, _ := os.Hostname()
+    lock := &backups.GCSLock{Bucket: bucket, Object: object, TTL: config.LockTTL, Owner: fmt.Sprintf("%s (pid %d)", hostname, os.Getpid())}
+    lockCtx, err := lock.Acquire(ctx)
+    if err != nil {
+      log.Println(err)
+      report.Error = err.Error()
+      if errors.Is(err, backups.ErrLocked) {
+        report.ExitCode = backups.ExitLocked
+      }
+      return report
+    }
+    ctx = lockCtx
+    defer func() {
+      releaseCtx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+      defer cancel()
+      releaseErr := lock.Release(releaseCtx)
+      if releaseErr != nil {
+        log.Printf("WARNING: failed to release the lock: %s\n", releaseErr)
+      }
+    }()
+  }
+  if config.Notifications.Healthcheck.URL != "" && config.backsUp() {
+    healthcheckConfig := config.Notifications.Healthcheck
+    healthcheck := backups.Healthcheck{URL: healthcheckConfig.URL, FailURL: healthcheckConfig.FailURL, Post: healthcheckConfig.Post}
+    if healthcheckConfig.Start {
+      startErr := healthcheck.Start(context.Background())
+      if startErr != nil {
+        log.Printf("WARNING: failed to ping the healthcheck: %s\n", startErr)
+      }
+    }
+    defer func() {
+      finishErr := healthcheck.Finish(context.Background(), report)
+      if finishErr != nil {
+        log.Printf("WARNING: failed to ping the healthcheck: %s\n", finishErr)
+      }
+    }()
+  }
 
-  for namePartIndex := 0; namePartIndex < namesPartsLen; namePartIndex++ {
-    startPartLen := len(namesParts[namePartIndex]);
-    endPartLen := len(namesParts[namesPartsLen - namePartIndex - 1]);
-    if spaceLeft > startPartLen {
-      startPartEnd++
-      spaceLeft -= startPartLen + 1
+  if !config.SkipPreflight {
+    preflightBackend := backend
+    if config.project() != "" {
+      preflightBackend = backend.WithProject(config.project())
     }
-    if spaceLeft > endPartLen {
-      endPartStart--
-      spaceLeft -= endPartLen + 1
+    err := preflight(ctx, preflightBackend, len(config.Projects) == 0 && !config.AllProjects)
+    if err != nil {
+      log.Println(err)
+      report.Error = err.Error()
+      return report
     }
   }
 
-  if startPartEnd >= endPartStart {
-    endPartStart = namesPartsLen
+  // The dry runs read the state to resume, but don't write it
+  var state *backups.StateRecorder
+  if config.StateFile != "" && config.ApplyPlan == "" && config.backsUp() {
+    resumed, err := resumedState(ctx, config, runID)
+    if err != nil {
+      log.Println(err)
+      report.Error = err.Error()
+      return report
+    }
+    if resumed.RunID != runID {
+      runID = resumed.RunID
+      report.RunID = runID
+      log.SetPrefix("[" + runID + "] ")
+    }
+    state = backups.NewStateRecorder(config.StateFile, resumed, config.DryRun, nil)
+    defer func() {
+      state.Complete(report.ExitCode == backups.ExitOK)
+    }()
   }
 
-  name := strings.Join(namesParts[0:startPartEnd], "-") + "-" + strings.Join(namesParts[endPartStart:], "-") + "-" + disk.Id + "-" + timePart
-  name = strings.Replace(name, "--", "-", -1)
+  events, closeEvents, err := eventStream(config)
+  if err != nil {
+    log.Println(err)
+    report.Error = err.Error()
+    return report
+  }
+  defer closeEvents()
+
+  projects := config.Projects
+  if config.AllProjects {
+    projects, err = backend.ListProjects(ctx)
+    if err != nil {
+      log.Println(err)
+      report.Error = err.Error()
+      return report
+    }
+    backups.NewLevels(log.Default(), config.verbosity()).Info.Printf("%d projects found\n", len(projects))
+  }
+  multiProject := config.AllProjects || len(projects) > 0
+  if len(projects) == 0 {
+    // The project of --project or of the environment, else the default one
+    // of the backend
+    projects = []string{config.project()}
+  }
 
-  snapshot := Snapshot{Name: name}
+  // Already checked by config.Validate()
+  plans, _ := config.Plans()
+
+  // Each plan is run for each project, or the runs of the plan file are
+  // applied
+  runs := make([]planRun, 0, len(projects) * len(plans))
+  if config.ApplyPlan != "" {
+    runs, err = applyRuns(config.ApplyPlan, config.MaxPlanAge, plans)
+    if err != nil {
+      log.Println(err)
+      report.Error = err.Error()
+      return report
+    }
+    multiProject = len(runs) > 1
+  } else {
+    for projectIndex := 0; projectIndex < len(projects); projectIndex++ {
+      for planIndex := 0; planIndex < len(plans); planIndex++ {
+        runs = append(runs, planRun{project: projects[projectIndex], plan: plans[planIndex]})
+      }
+    }
+  }
 
-  if dryRun {
-    return snapshot, nil
+  // A failing run doesn't stop the others
+  summaries := make([]backups.Summary, len(runs))
+  runPlans := make([]backups.RunPlan, len(runs))
+  slots := make(chan struct{}, config.PlanConcurrency)
+  var wg sync.WaitGroup
+  for runIndex := 0; runIndex < len(runs); runIndex++ {
+    // Taking the slot before starting keeps the order of the runs
+    slots <- struct{}{}
+    wg.Add(1)
+    go func(runIndex int) {
+      defer wg.Done()
+      defer func() { <-slots }()
+      summaries[runIndex], runPlans[runIndex] = runPlan(ctx, config, runID, runs[runIndex], backend, notifiers, state, events)
+    }(runIndex)
+  }
+  wg.Wait()
+
+  report = backups.NewReport(summaries)
+  report.RunID = runID
+  if config.SummaryFile != "" {
+    var summaryErr error
+    if len(config.PlanConfigs) == 0 && !multiProject {
+      summaryErr = summaries[0].WriteFile(config.SummaryFile)
+    } else {
+      summaryErr = report.WriteFile(config.SummaryFile)
+    }
+    if summaryErr != nil {
+      log.Printf("Failed to write the summary file: %s\n", summaryErr)
+    }
+  }
+  if config.PlanOut != "" {
+    planErr := backups.PlanFile{CreatedAt: time.Now(), RunID: runID, Runs: runPlans}.WriteFile(config.PlanOut)
+    if planErr != nil {
+      log.Printf("Failed to write the plan file: %s\n", planErr)
+    }
   }
 
-  _, err := getCommandResult("gcloud", []string{"beta", "compute", "disks", "snapshot", disk.Name, "--zone", disk.Zone, "--snapshot-names", name})
+  return report
+}
 
-  return snapshot, err
+func emailNotifier(config EmailConfig) backups.EmailNotifier {
+  return backups.EmailNotifier{Host: config.Host, Port: config.Port, TLS: config.TLS, Username: config.Username, Password: config.Password, From: config.From, To: config.To}
 }
 
-func deleteSnapshot(snapshot Snapshot, dryRun bool) error {
-  if dryRun {
-    return nil
+// testEmail sends the summary of a fake run, to check the SMTP settings.
+func testEmail(config Config) int {
+  if config.Notifications.Email.Host == "" {
+    log.Println("--test-email needs --smtp-host")
+    return backups.ExitUsage
   }
-
-  _, err := getCommandResult("gcloud", []string{"beta", "compute", "snapshots", "delete", snapshot.Name})
-
-  return err
+  project := "sample-project"
+  if config.project() != "" {
+    project = config.project()
+  }
+  if len(config.Projects) > 0 {
+    project = config.Projects[0]
+  }
+  errors := backups.Notify([]backups.Notifier{emailNotifier(config.Notifications.Email)}, backups.NotifyAlways, backups.SampleSummary(project), log.Default())
+  if len(errors) > 0 {
+    return backups.ExitListingFailure
+  }
+  log.Printf("Sample email sent to %s\n", strings.Join(config.Notifications.Email.To, ", "))
+  return backups.ExitOK
 }
 
-func main() {
-  var filter string
-  flag.StringVar(&filter, "filter", "labels.env = production", "Filter to use for disks to snapshot")
-  var limit int
-  flag.IntVar(&limit, "limit", 7, "Number of snapshots to keep")
-  var dryRun bool
-  flag.BoolVar(&dryRun, "dry-run", false, "Don't really do backups and deletions but show logs")
-
-  flag.Parse()
+// planRun is a run of a plan in a project.
+type planRun struct {
+  project string
+  plan    Plan
+  // Plan of a dry run to apply instead of a backup, if any
+  apply   *backups.RunPlan
+}
 
-  log.Printf("Backup of GCP disks using filter '%s'\n", filter)
+// applyRuns returns the runs applying the plan file, refusing it when it's
+// older than maxAge.
+func applyRuns(path string, maxAge time.Duration, plans []Plan) ([]planRun, error) {
+  file, err := backups.ReadPlanFile(path)
+  if err != nil {
+    return nil, err
+  }
+  age := time.Since(file.CreatedAt)
+  if maxAge > 0 && age > maxAge {
+    return nil, fmt.Errorf("The plan %s is %s old, more than --max-plan-age %s", path, age.Round(time.Minute), maxAge)
+  }
 
-  if dryRun {
-    log.Println("")
-    log.Println("DRY RUN MODE: nothing is created or deleted", filter)
+  runs := make([]planRun, 0, len(file.Runs))
+  for runIndex := 0; runIndex < len(file.Runs); runIndex++ {
+    runPlan := &file.Runs[runIndex]
+    found := false
+    for planIndex := 0; planIndex < len(plans); planIndex++ {
+      if plans[planIndex].Name == runPlan.Plan {
+        runs = append(runs, planRun{project: runPlan.Project, plan: plans[planIndex], apply: runPlan})
+        found = true
+        break
+      }
+    }
+    if !found {
+      return nil, fmt.Errorf("Plan %s of %s not found in the config", runPlan.Plan, path)
+    }
   }
+  return runs, nil
+}
 
-  log.Println("")
+// resumedState returns the state of the run to resume, or of the new run
+// with the id.
+func resumedState(ctx context.Context, config Config, runID string) (backups.State, error) {
+  if !config.Resume {
+    state := backups.NewState(time.Now())
+    state.RunID = runID
+    return state, nil
+  }
+  state, err := backups.ReadState(ctx, config.StateFile)
+  if err != nil {
+    return state, fmt.Errorf("Failed to read the state to resume: %w", err)
+  }
+  age := time.Since(state.UpdatedAt)
+  if config.ResumeMaxAge > 0 && age > config.ResumeMaxAge {
+    return state, fmt.Errorf("The run %s of %s was updated %s ago, more than --resume-max-age %s", state.RunID, config.StateFile, age.Round(time.Minute), config.ResumeMaxAge)
+  }
+  if !state.CompletedAt.IsZero() {
+    return state, fmt.Errorf("The run %s of %s is complete, there is nothing to resume", state.RunID, config.StateFile)
+  }
+  log.Printf("Resuming the run %s of %s, started at %s\n", state.RunID, config.StateFile, state.StartedAt.Format(time.RFC3339))
+  return state, nil
+}
 
-  disks, disksErr := getDisksToSnapshot(filter)
+// eventStream opens the stream of the progress events of --progress-fd or
+// --progress-file, nil without any. The returned function closes it.
+func eventStream(config Config) (*backups.EventStream, func(), error) {
+  switch {
+  case config.ProgressFD > 0:
+    // The descriptor is the caller's, it's not closed
+    return backups.NewEventStream(os.NewFile(uintptr(config.ProgressFD), "progress"), nil), func() {}, nil
+  case config.ProgressFile != "":
+    file, err := os.OpenFile(config.ProgressFile, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+      return nil, nil, fmt.Errorf("Can't open the progress file: %w", err)
+    }
+    return backups.NewEventStream(file, nil), func() { file.Close() }, nil
+  }
+  return nil, func() {}, nil
+}
 
-  if disksErr != nil {
-    log.Fatal(disksErr)
-    return
+// runPlan runs the backup of the plan in the project, or applies its plan
+// file, then notifies and pushes its metrics. The progress is recorded in the
+// state if not nil. It returns the summary and what was done.
+func runPlan(ctx context.Context, config Config, runID string, run planRun, backend backups.Backend, notifiers []backups.Notifier, state *backups.StateRecorder, events *backups.EventStream) (backups.Summary, backups.RunPlan) {
+  project := run.project
+  plan := run.plan
+  // The logs of the runs at the same time are told apart by their prefix
+  prefix := project
+  if plan.Name != "" && prefix != "" {
+    prefix += "/"
+  }
+  prefix += plan.Name
+  logger := log.Default()
+  if prefix != "" {
+    logger = log.New(os.Stderr, "[" + runID + " " + prefix + "] ", log.LstdFlags | log.Lmsgprefix)
   }
 
-  if len(disks) == 0 {
-    log.Println("No disk to snapshot")
-    return
+  options := plan.Options
+  options.RunID = runID
+  options.Project = project
+  options.Backend = backend
+  options.Logger = logger
+  options.Stop = stopping
+  if !config.Yes {
+    options.Confirm = confirmDeletion(logger)
   }
-  log.Println("Disks and snapshots found:")
-  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
-    disk := &disks[diskIndex]
-    log.Printf("%02d ) %s\n", diskIndex + 1, disk.Name)
-    snapshots, snapshotsErr := getDiskSnapshots(*disk)
-    if snapshotsErr != nil {
-      log.Fatal(disksErr)
-      return
-    }
-    disk.Snapshots = snapshots
-    for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
-      snapshot := snapshots[snapshotIndex]
-      log.Printf("      - %s\n", snapshot.Name)
+  if run.apply != nil {
+    options.Mode = run.apply.Mode
+    options.Filter = run.apply.Filter
+  }
+  if state != nil {
+    options.Resumed = state.State().Created(plan.Name, project)
+    options.Progress = func(progress backups.DiskProgress) {
+      state.Record(plan.Name, project, progress)
     }
   }
-  log.Println("")
-
-  time.Sleep(time.Duration(2) * time.Second)
-
-  log.Println("Creating snapshots...")
-
-  snapshotsCreated := make(chan Snapshot, len(disks))
-  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
-    go func(disk Disk) {
-      log.Printf("Creating snapshot for disk %s\n", disk.Name)
-      snapshot, snapshotErr := createSnapshotForDisk(disk, dryRun)
-      if snapshotErr != nil {
-        log.Fatal(snapshotErr)
-        return
-      }
-      snapshotsCreated <- snapshot
-    }(disks[diskIndex])
-  }
-  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
-    diskBackuped := &disks[diskIndex]
-    snapshotCreated := <-snapshotsCreated
-    newSnapshots := make([]Snapshot, len(diskBackuped.Snapshots) + 1)
-    copy(newSnapshots[1:], diskBackuped.Snapshots)
-    newSnapshots[0] = snapshotCreated
-    diskBackuped.Snapshots = newSnapshots
-    log.Printf("Created snapshot %s\n", snapshotCreated.Name)
-  }
-  log.Printf("Created %d snapshots", len(disks))
-  log.Println("")
-
-  time.Sleep(time.Duration(2) * time.Second)
-
-  log.Printf("Deleting old snapshots (limit: %d)\n", limit)
-
-  oldSnapshotsDeleted := make(chan Disk, len(disks))
-  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
-    diskToClean := &disks[diskIndex]
-    diff := len(diskToClean.Snapshots) - limit
-    if diff <= 0 {
-      oldSnapshotsDeleted <- *diskToClean
-      continue
-    }
-    go func(disk Disk) {
-      diff := len(disk.Snapshots) - limit
-      snapshotsDeletedForDisk := make(chan Snapshot, diff)
-      log.Printf("Deleting %d old snapshot(s) for disk %s\n", diff, disk.Name)
-      for snapshotIndex := limit; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
-        go func(snapshotToDelete Snapshot) {
-          snapshotDeleteErr := deleteSnapshot(snapshotToDelete, dryRun)
-          if snapshotDeleteErr != nil {
-            log.Fatal(snapshotDeleteErr)
-            return
-          }
-          snapshotsDeletedForDisk <- snapshotToDelete
-        }(disk.Snapshots[snapshotIndex])
-      }
-      for snapshotIndex := limit; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
-        snapshotDeleted := <-snapshotsDeletedForDisk
-        log.Printf("Deleted snapshot %s\n", snapshotDeleted.Name)
+  if events != nil {
+    options.Events = func(event backups.Event) {
+      event.Plan = plan.Name
+      if event.Project == "" {
+        event.Project = project
       }
-      oldSnapshotsDeleted <- disk
-    }(*diskToClean)
+      events.Emit(event)
+    }
+  }
+  runner := backups.NewRunner(options)
+
+  var result backups.Result
+  var err error
+  if run.apply != nil {
+    result, err = runner.Apply(ctx, *run.apply)
+  } else if config.VerifyOnly {
+    result, err = runner.Verify(ctx)
+  } else if config.Drill {
+    result, err = runner.Drill(ctx)
+  } else {
+    result, err = runner.Run(ctx)
   }
-  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
-    diskCleaned := <-oldSnapshotsDeleted
-    log.Printf("Cleaned disk %s: %d snapshot(s) deleted\n", diskCleaned.Name, Max(0, len(diskCleaned.Snapshots) - limit))
+  if err != nil {
+    logger.Println(err)
   }
-  log.Println("")
-  log.Printf("Backup complete!")
 
-  if dryRun {
-    log.Println("")
-    log.Println("DRY RUN MODE: nothing has been created or deleted", filter)
+  summary := backups.NewSummary(result, err)
+  summary.Plan = plan.Name
+  if options.Pretty {
+    summary.LogTable(logger, options.Color)
   }
+  summary.Log(logger)
+  runPlan := backups.NewRunPlan(result)
+  runPlan.Plan = plan.Name
+  if result.DryRun && result.Listed && config.backsUp() {
+    runPlan.Log(logger)
+  }
+  summary.NotificationErrors = backups.Notify(notifiers, config.Notifications.NotifyOn, summary, logger)
+  if config.ReportGCS != "" {
+    report := backups.GCSReport{Prefix: config.ReportGCS, CredentialsFile: config.ReportCredentialsFile, Retry: backups.Retry{Logger: logger}}
+    uploadCtx, cancelUpload := context.WithTimeout(context.Background(), 30 * time.Second)
+    uploaded, uploadErr := report.Upload(uploadCtx, summary, runPlan)
+    cancelUpload()
+    for uploadedIndex := 0; uploadedIndex < len(uploaded); uploadedIndex++ {
+      backups.NewLevels(logger, options.Verbosity).Info.Printf("Report uploaded to %s\n", uploaded[uploadedIndex])
+    }
+    if uploadErr != nil {
+      logger.Printf("WARNING: failed to upload the report: %s\n", uploadErr)
+    }
+  }
+  // The metrics are the ones of the backups
+  if !config.backsUp() {
+    return summary, runPlan
+  }
+  if config.Notifications.Pushgateway.URL != "" {
+    pushgatewayConfig := config.Notifications.Pushgateway
+    if pushgatewayConfig.Instance == "" {
+      pushgatewayConfig.Instance, _ = os.Hostname()
+    }
+    pushgateway := backups.Pushgateway{URL: pushgatewayConfig.URL, Job: pushgatewayConfig.Job, Instance: pushgatewayConfig.Instance, PerDisk: pushgatewayConfig.PerDisk, PerProject: project != ""}
+    pushCtx, cancelPush := context.WithTimeout(context.Background(), 10 * time.Second)
+    pushErr := pushgateway.Push(pushCtx, summary)
+    cancelPush()
+    if pushErr != nil {
+      logger.Printf("WARNING: failed to push the metrics: %s\n", pushErr)
+    }
+  }
+  if config.Notifications.Monitoring.Enabled {
+    monitoringConfig := config.Notifications.Monitoring
+    cloudMonitoring := backups.CloudMonitoring{Project: monitoringConfig.Project, Prefix: monitoringConfig.MetricPrefix, Labels: monitoringConfig.Labels}
+    writeCtx, cancelWrite := context.WithTimeout(context.Background(), 10 * time.Second)
+    writeErr := cloudMonitoring.Write(writeCtx, summary)
+    cancelWrite()
+    if writeErr != nil {
+      logger.Printf("WARNING: failed to write the Cloud Monitoring metrics: %s\n", writeErr)
+    }
+  }
+  if config.Notifications.BigQuery.Table != "" {
+    bigQuery := backups.BigQuery{Table: config.Notifications.BigQuery.Table, Retry: backups.Retry{Logger: logger}}
+    insertCtx, cancelInsert := context.WithTimeout(context.Background(), 30 * time.Second)
+    insertErr := bigQuery.Write(insertCtx, summary)
+    cancelInsert()
+    if insertErr != nil {
+      logger.Printf("WARNING: failed to insert the rows into BigQuery: %s\n", insertErr)
+    }
+  }
+
+  return summary, runPlan
 }
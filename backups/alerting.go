@@ -0,0 +1,186 @@
+package backups
+
+import (
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strings"
+)
+
+const (
+  // Conditions of the alerts: any failed run, a run which created and
+  // deleted nothing, or stale disks of a verification or failed restores of
+  // a drill
+  AlertOnFailure = "failure"
+  AlertOnAllFailed = "all-failed"
+  AlertOnStale = "stale"
+)
+
+// Conditions of the alerts when none is configured
+var DefaultAlertConditions = []string{AlertOnAllFailed, AlertOnStale}
+
+// Endpoints of the alerting services, overridden by the notifiers to test them
+const (
+  PagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+  OpsgenieURL = "https://api.opsgenie.com"
+)
+
+// ValidateAlertConditions checks the conditions of the alerts.
+func ValidateAlertConditions(conditions []string) error {
+  for conditionIndex := 0; conditionIndex < len(conditions); conditionIndex++ {
+    switch conditions[conditionIndex] {
+    case AlertOnFailure, AlertOnAllFailed, AlertOnStale:
+    default:
+      return fmt.Errorf("Unknown alert condition '%s', use '%s', '%s' or '%s'", conditions[conditionIndex], AlertOnFailure, AlertOnAllFailed, AlertOnStale)
+    }
+  }
+  return nil
+}
+
+// alertTriggered tells if one of the conditions, DefaultAlertConditions if
+// empty, is met by the run.
+func alertTriggered(summary Summary, conditions []string) bool {
+  if len(conditions) == 0 {
+    conditions = DefaultAlertConditions
+  }
+  failed := summary.ExitCode != ExitOK
+  verify := summary.Mode == ModeVerify || summary.Mode == ModeDrill
+  for conditionIndex := 0; conditionIndex < len(conditions); conditionIndex++ {
+    switch conditions[conditionIndex] {
+    case AlertOnFailure:
+      if failed && !verify {
+        return true
+      }
+    case AlertOnAllFailed:
+      if failed && !verify && summary.SnapshotsCreated == 0 && summary.SnapshotsDeleted == 0 {
+        return true
+      }
+    case AlertOnStale:
+      if failed && verify {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// alertDedupKey returns the key of the alerts of the project and filter, the
+// same for all their runs so a failing run doesn't open a new alert each
+// time. The backups, the verifications and the drills have their own alert.
+func alertDedupKey(summary Summary) string {
+  kind := "backup"
+  if summary.Mode == ModeVerify || summary.Mode == ModeDrill {
+    kind = summary.Mode
+  }
+  filterHash := sha256.Sum256([]byte(summary.Filter))
+  return CreatedByValue + ":" + summary.Project + ":" + kind + ":" + hex.EncodeToString(filterHash[:6])
+}
+
+// alertDetails returns what the alert tells about the failure.
+func alertDetails(summary Summary) map[string]interface{} {
+  details := map[string]interface{}{
+    "runId": summary.RunID,
+    "project": summary.Project,
+    "filter": summary.Filter,
+    "counts": summaryCounts(summary),
+  }
+  if summary.Plan != "" {
+    details["plan"] = summary.Plan
+  }
+  if len(summary.FailedDisks) > 0 {
+    details["failedDisks"] = strings.Join(summary.FailedDisks, ", ")
+  }
+  if summary.Error != "" {
+    details["error"] = summary.Error
+  }
+  return details
+}
+
+// PagerDutyNotifier triggers a PagerDuty Events v2 alert when a condition is
+// met, and resolves it after a successful run.
+type PagerDutyNotifier struct {
+  RoutingKey string
+  // DefaultAlertConditions if empty
+  Conditions []string
+  // PagerDutyEventsURL if empty
+  URL        string
+  // http.DefaultClient if nil
+  Client     *http.Client
+}
+
+func (notifier PagerDutyNotifier) Notify(ctx context.Context, summary Summary) error {
+  eventsURL := notifier.URL
+  if eventsURL == "" {
+    eventsURL = PagerDutyEventsURL
+  }
+  event := map[string]interface{}{
+    "routing_key": notifier.RoutingKey,
+    "dedup_key": alertDedupKey(summary),
+  }
+  switch {
+  case alertTriggered(summary, notifier.Conditions):
+    event["event_action"] = "trigger"
+    event["payload"] = map[string]interface{}{
+      "summary": summaryTitle(summary),
+      "source": CreatedByValue,
+      "severity": "critical",
+      "custom_details": alertDetails(summary),
+    }
+  case summary.ExitCode == ExitOK:
+    event["event_action"] = "resolve"
+  default:
+    // A failure below the conditions neither triggers nor resolves
+    return nil
+  }
+  return postJSON(ctx, notifier.Client, eventsURL, event)
+}
+
+// OpsgenieNotifier creates an Opsgenie alert when a condition is met, and
+// closes it after a successful run.
+type OpsgenieNotifier struct {
+  APIKey     string
+  // DefaultAlertConditions if empty
+  Conditions []string
+  // OpsgenieURL if empty, https://api.eu.opsgenie.com for the EU instance
+  URL        string
+  // http.DefaultClient if nil
+  Client     *http.Client
+}
+
+func (notifier OpsgenieNotifier) Notify(ctx context.Context, summary Summary) error {
+  apiURL := strings.TrimSuffix(notifier.URL, "/")
+  if apiURL == "" {
+    apiURL = OpsgenieURL
+  }
+  headers := map[string]string{"Authorization": "GenieKey " + notifier.APIKey}
+  alias := alertDedupKey(summary)
+  switch {
+  case alertTriggered(summary, notifier.Conditions):
+    alert := map[string]interface{}{
+      "message": summaryTitle(summary),
+      "alias": alias,
+      "description": summaryCounts(summary),
+      "details": alertDetails(summary),
+      "source": CreatedByValue,
+      "priority": "P1",
+    }
+    return postJSONWithHeaders(ctx, notifier.Client, apiURL + "/v2/alerts", alert, headers)
+  case summary.ExitCode == ExitOK:
+    closeURL := apiURL + "/v2/alerts/" + url.PathEscape(alias) + "/close?identifierType=alias"
+    return postJSONWithHeaders(ctx, notifier.Client, closeURL, map[string]interface{}{"source": CreatedByValue, "note": "Run " + summary.RunID + " succeeded"}, headers)
+  }
+  return nil
+}
+
+// isAlertNotifier tells if the notifier resolves its alerts, so it's notified
+// of the successful runs whatever notifyOn.
+func isAlertNotifier(notifier Notifier) bool {
+  switch notifier.(type) {
+  case PagerDutyNotifier, OpsgenieNotifier:
+    return true
+  }
+  return false
+}
@@ -0,0 +1,232 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "sync"
+  "testing"
+)
+
+// alertRecorder records the requests of an alerting service.
+type alertRecorder struct {
+  mutex    sync.Mutex
+  requests []string
+  headers  []http.Header
+  bodies   []map[string]interface{}
+  // Of the responses, 202 if 0
+  status   int
+}
+
+func (recorder *alertRecorder) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+  recorder.mutex.Lock()
+  defer recorder.mutex.Unlock()
+  recorder.requests = append(recorder.requests, request.Method + " " + request.URL.EscapedPath() + "?" + request.URL.RawQuery)
+  recorder.headers = append(recorder.headers, request.Header.Clone())
+  var body map[string]interface{}
+  json.NewDecoder(request.Body).Decode(&body)
+  recorder.bodies = append(recorder.bodies, body)
+  status := recorder.status
+  if status == 0 {
+    status = http.StatusAccepted
+  }
+  writer.WriteHeader(status)
+}
+
+func TestAlertTriggered(t *testing.T) {
+  failed := testSummary()
+  allFailed := testSummary()
+  allFailed.SnapshotsCreated = 0
+  allFailed.SnapshotsDeleted = 0
+  succeeded := testSummary()
+  succeeded.ExitCode = ExitOK
+  stale := testSummary()
+  stale.Mode = ModeVerify
+  tests := []struct {
+    name       string
+    summary    Summary
+    conditions []string
+    expected   bool
+  }{
+    {"partial failure by default", failed, nil, false},
+    {"all failed by default", allFailed, nil, true},
+    {"stale by default", stale, nil, true},
+    {"partial failure", failed, []string{AlertOnFailure}, true},
+    {"success", succeeded, []string{AlertOnFailure, AlertOnAllFailed, AlertOnStale}, false},
+    {"verification on failure", stale, []string{AlertOnFailure}, false},
+    {"backup on stale", allFailed, []string{AlertOnStale}, false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    if alertTriggered(test.summary, test.conditions) != test.expected {
+      t.Errorf("%s: got triggered %t, expected %t", test.name, !test.expected, test.expected)
+    }
+  }
+}
+
+func TestAlertDedupKey(t *testing.T) {
+  backup := testSummary()
+  // The same alert for all the runs
+  nextRun := testSummary()
+  nextRun.RunID = "run-2"
+  nextRun.ExitCode = ExitOK
+  otherFilter := testSummary()
+  otherFilter.Filter = "labels.env = staging"
+  verify := testSummary()
+  verify.Mode = ModeVerify
+  if alertDedupKey(backup) != alertDedupKey(nextRun) {
+    t.Errorf("Got the keys %s and %s for the runs", alertDedupKey(backup), alertDedupKey(nextRun))
+  }
+  if alertDedupKey(backup) == alertDedupKey(otherFilter) || alertDedupKey(backup) == alertDedupKey(verify) {
+    t.Errorf("Got the same key %s for another filter or a verification", alertDedupKey(backup))
+  }
+}
+
+func TestPagerDutyNotify(t *testing.T) {
+  allFailed := testSummary()
+  allFailed.SnapshotsCreated = 0
+  allFailed.SnapshotsDeleted = 0
+  succeeded := testSummary()
+  succeeded.ExitCode = ExitOK
+  tests := []struct {
+    name     string
+    summary  Summary
+    expected string
+  }{
+    {"trigger", allFailed, "trigger"},
+    {"resolve", succeeded, "resolve"},
+    // A failure below the conditions
+    {"none", testSummary(), ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    recorder := &alertRecorder{}
+    server := httptest.NewServer(recorder)
+    notifier := PagerDutyNotifier{RoutingKey: "routing", URL: server.URL + "/v2/enqueue"}
+
+    err := notifier.Notify(context.Background(), test.summary)
+    server.Close()
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if test.expected == "" {
+      if len(recorder.requests) > 0 {
+        t.Errorf("%s: got the requests %v", test.name, recorder.requests)
+      }
+      continue
+    }
+    if len(recorder.requests) != 1 || recorder.requests[0] != "POST /v2/enqueue?" {
+      t.Fatalf("%s: got the requests %v", test.name, recorder.requests)
+    }
+    event := recorder.bodies[0]
+    if event["event_action"] != test.expected || event["routing_key"] != "routing" || event["dedup_key"] != alertDedupKey(test.summary) {
+      t.Errorf("%s: got the event %v", test.name, event)
+    }
+    payload, _ := event["payload"].(map[string]interface{})
+    if test.expected == "trigger" && (payload["summary"] != summaryTitle(test.summary) || payload["severity"] != "critical") {
+      t.Errorf("%s: got the payload %v", test.name, payload)
+    }
+    if test.expected == "resolve" && payload != nil {
+      t.Errorf("%s: got the payload %v to resolve", test.name, payload)
+    }
+  }
+}
+
+func TestOpsgenieNotify(t *testing.T) {
+  allFailed := testSummary()
+  allFailed.SnapshotsCreated = 0
+  allFailed.SnapshotsDeleted = 0
+  succeeded := testSummary()
+  succeeded.ExitCode = ExitOK
+  alias := alertDedupKey(succeeded)
+  tests := []struct {
+    name     string
+    summary  Summary
+    expected string
+  }{
+    {"create", allFailed, "POST /v2/alerts?"},
+    {"close", succeeded, "POST /v2/alerts/" + url.PathEscape(alias) + "/close?identifierType=alias"},
+    {"none", testSummary(), ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    recorder := &alertRecorder{}
+    server := httptest.NewServer(recorder)
+    // The trailing slash of the configured URL
+    notifier := OpsgenieNotifier{APIKey: "key", URL: server.URL + "/"}
+
+    err := notifier.Notify(context.Background(), test.summary)
+    server.Close()
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if test.expected == "" {
+      if len(recorder.requests) > 0 {
+        t.Errorf("%s: got the requests %v", test.name, recorder.requests)
+      }
+      continue
+    }
+    if len(recorder.requests) != 1 || recorder.requests[0] != test.expected {
+      t.Fatalf("%s: got the requests %v, expected %s", test.name, recorder.requests, test.expected)
+    }
+    if recorder.headers[0].Get("Authorization") != "GenieKey key" {
+      t.Errorf("%s: got the authorization '%s'", test.name, recorder.headers[0].Get("Authorization"))
+    }
+    alert := recorder.bodies[0]
+    if test.name == "create" && (alert["alias"] != alias || alert["message"] != summaryTitle(test.summary) || alert["priority"] != "P1") {
+      t.Errorf("%s: got the alert %v", test.name, alert)
+    }
+  }
+}
+
+func TestAlertNotifyError(t *testing.T) {
+  allFailed := testSummary()
+  allFailed.SnapshotsCreated = 0
+  allFailed.SnapshotsDeleted = 0
+  recorder := &alertRecorder{status: http.StatusBadRequest}
+  server := httptest.NewServer(recorder)
+  defer server.Close()
+  notifiers := []Notifier{
+    PagerDutyNotifier{RoutingKey: "routing", URL: server.URL},
+    OpsgenieNotifier{APIKey: "key", URL: server.URL},
+  }
+  for notifierIndex := 0; notifierIndex < len(notifiers); notifierIndex++ {
+    err := notifiers[notifierIndex].Notify(context.Background(), allFailed)
+    var httpErr *HTTPError
+    if !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest {
+      t.Errorf("%T: got the error %v, expected an HTTP error 400", notifiers[notifierIndex], err)
+    }
+    if !isAlertNotifier(notifiers[notifierIndex]) {
+      t.Errorf("%T: not an alert notifier", notifiers[notifierIndex])
+    }
+  }
+}
+
+// countingNotifier counts its notifications.
+type countingNotifier struct {
+  notified *int
+}
+
+func (notifier countingNotifier) Notify(ctx context.Context, summary Summary) error {
+  *notifier.notified++
+  return nil
+}
+
+func TestNotifyResolvesAlerts(t *testing.T) {
+  recorder := &alertRecorder{}
+  server := httptest.NewServer(recorder)
+  defer server.Close()
+  notified := 0
+  notifiers := []Notifier{countingNotifier{notified: &notified}, PagerDutyNotifier{RoutingKey: "routing", URL: server.URL}}
+  succeeded := testSummary()
+  succeeded.ExitCode = ExitOK
+
+  errs := Notify(notifiers, NotifyFailure, succeeded, discardLogger())
+  // Only the alerts are notified of the success, to resolve them
+  if len(errs) > 0 || notified != 0 || len(recorder.requests) != 1 || recorder.bodies[0]["event_action"] != "resolve" {
+    t.Errorf("Got the errors %v, %d notification(s) and the alerts %v", errs, notified, recorder.bodies)
+  }
+}
@@ -0,0 +1,1087 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  compute "cloud.google.com/go/compute/apiv1"
+  "cloud.google.com/go/compute/apiv1/computepb"
+  "github.com/googleapis/gax-go/v2/callctx"
+  cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+  "google.golang.org/api/iterator"
+  "google.golang.org/api/option"
+)
+
+// API manages the disks and snapshots with the Compute Engine client library,
+// authenticated with the Application Default Credentials or the Credentials.
+type API struct {
+  project     string
+  retry       Retry
+  disks       *compute.DisksClient
+  regionDisks *compute.RegionDisksClient
+  snapshots   *compute.SnapshotsClient
+  instances   *compute.InstancesClient
+  credentials Credentials
+  // Options of the clients, from the credentials, for the ones created for a
+  // call
+  clientOptions []option.ClientOption
+}
+
+// NewAPI creates the Compute Engine clients with the credentials, the
+// application default ones if empty, retrying the failed calls with retry.
+// The project is the one of the credentials, or GOOGLE_CLOUD_PROJECT if they
+// don't have any.
+func NewAPI(ctx context.Context, retry Retry, credentials Credentials) (*API, error) {
+  project, err := credentials.project(ctx)
+  if err != nil {
+    return nil, err
+  }
+  options, err := credentials.clientOptions(ctx)
+  if err != nil {
+    return nil, err
+  }
+  if project == "" {
+    project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+  }
+  if project == "" {
+    return nil, errors.New("No project found in the credentials, set GOOGLE_CLOUD_PROJECT")
+  }
+
+  disks, err := compute.NewDisksRESTClient(ctx, options...)
+  if err != nil {
+    return nil, err
+  }
+  snapshots, err := compute.NewSnapshotsRESTClient(ctx, options...)
+  if err != nil {
+    disks.Close()
+    return nil, err
+  }
+  instances, err := compute.NewInstancesRESTClient(ctx, options...)
+  if err != nil {
+    disks.Close()
+    snapshots.Close()
+    return nil, err
+  }
+  regionDisks, err := compute.NewRegionDisksRESTClient(ctx, options...)
+  if err != nil {
+    disks.Close()
+    snapshots.Close()
+    instances.Close()
+    return nil, err
+  }
+
+  return &API{project: project, retry: retry, disks: disks, regionDisks: regionDisks, snapshots: snapshots, instances: instances, credentials: credentials, clientOptions: options}, nil
+}
+
+// WithProject returns an API for the disks of another project, sharing the
+// clients: only the original API must be closed.
+func (api *API) WithProject(project string) Backend {
+  projectAPI := *api
+  projectAPI.project = project
+  return &projectAPI
+}
+
+// Close closes the Compute Engine clients.
+func (api *API) Close() error {
+  disksErr := api.disks.Close()
+  snapshotsErr := api.snapshots.Close()
+  instancesErr := api.instances.Close()
+  regionDisksErr := api.regionDisks.Close()
+  if disksErr != nil {
+    return disksErr
+  }
+  if snapshotsErr != nil {
+    return snapshotsErr
+  }
+  if instancesErr != nil {
+    return instancesErr
+  }
+  return regionDisksErr
+}
+
+// ListProjects lists the active projects with the Resource Manager API.
+func (api *API) ListProjects(ctx context.Context) ([]string, error) {
+  service, err := cloudresourcemanager.NewService(ctx, api.clientOptions...)
+  if err != nil {
+    return nil, err
+  }
+
+  var projects []string
+  err = api.retry.Do(ctx, "projects listing", func() error {
+    projects = make([]string, 0)
+    return service.Projects.List().Filter("lifecycleState:ACTIVE").Pages(ctx, func(response *cloudresourcemanager.ListProjectsResponse) error {
+      for projectIndex := 0; projectIndex < len(response.Projects); projectIndex++ {
+        projects = append(projects, response.Projects[projectIndex].ProjectId)
+      }
+      return nil
+    })
+  })
+  return projects, err
+}
+
+// Project returns the project given to WithProject, or the one of the
+// credentials.
+func (api *API) Project(ctx context.Context) (string, error) {
+  return api.project, nil
+}
+
+// lastPathPart returns the name at the end of a resource URL, like the zone
+// of a disk.
+func lastPathPart(url string) string {
+  return url[strings.LastIndex(url, "/") + 1:]
+}
+
+// GetDisksToSnapshot lists the disks of all the zones and regions matching the
+// filter.
+func (api *API) GetDisksToSnapshot(ctx context.Context, filter string) ([]Disk, error) {
+  var disks []Disk
+
+  err := api.retry.Do(ctx, "disks listing", func() error {
+    disks = make([]Disk, 0)
+    request := &computepb.AggregatedListDisksRequest{Project: api.project}
+    if filter != "" {
+      request.Filter = &filter
+    }
+    pairs := api.disks.AggregatedList(ctx, request)
+    for {
+      pair, err := pairs.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      for _, disk := range pair.Value.GetDisks() {
+        disks = append(disks, apiDisk(disk))
+      }
+    }
+  })
+
+  return disks, err
+}
+
+// StreamDisks lists the disks of all the zones and regions matching the filter
+// by pages of pageSize, handing each page once listed.
+func (api *API) StreamDisks(ctx context.Context, filter string, pageSize int, page func([]Disk) error) error {
+  pager := newDiskPager(pageSize, page)
+  maxResults := uint32(pageSize)
+  err := api.retry.Do(ctx, "disks listing", func() error {
+    pager.restart()
+    request := &computepb.AggregatedListDisksRequest{Project: api.project, MaxResults: &maxResults}
+    if filter != "" {
+      request.Filter = &filter
+    }
+    pairs := api.disks.AggregatedList(ctx, request)
+    for {
+      pair, err := pairs.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      for _, disk := range pair.Value.GetDisks() {
+        // The error of page stops the listing, not retried
+        if pager.add(apiDisk(disk)) != nil {
+          return nil
+        }
+      }
+    }
+  })
+  return pager.finish(err)
+}
+
+// GetZoneDisks lists the disks of the zone matching the filter.
+func (api *API) GetZoneDisks(ctx context.Context, filter string, zone string) ([]Disk, error) {
+  var disks []Disk
+
+  err := api.retry.Do(ctx, "disks listing of zone " + zone, func() error {
+    disks = make([]Disk, 0)
+    request := &computepb.ListDisksRequest{Project: api.project, Zone: zone}
+    if filter != "" {
+      request.Filter = &filter
+    }
+    items := api.disks.List(ctx, request)
+    for {
+      disk, err := items.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      disks = append(disks, apiDisk(disk))
+    }
+  })
+
+  return disks, err
+}
+
+// GetRegionDisks lists the regional disks of the region matching the filter.
+func (api *API) GetRegionDisks(ctx context.Context, filter string, region string) ([]Disk, error) {
+  var disks []Disk
+
+  err := api.retry.Do(ctx, "disks listing of region " + region, func() error {
+    disks = make([]Disk, 0)
+    request := &computepb.ListRegionDisksRequest{Project: api.project, Region: region}
+    if filter != "" {
+      request.Filter = &filter
+    }
+    items := api.regionDisks.List(ctx, request)
+    for {
+      disk, err := items.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      disks = append(disks, apiDisk(disk))
+    }
+  })
+
+  return disks, err
+}
+
+// apiDisk converts a disk of the client library.
+func apiDisk(disk *computepb.Disk) Disk {
+  zoneProject, zone := parseSelfLink(disk.GetZone())
+  regionProject, region := parseSelfLink(disk.GetRegion())
+  if zoneProject == "" {
+    zoneProject = regionProject
+  }
+  _, diskType := parseSelfLink(disk.GetType())
+  return Disk{
+    Name: disk.GetName(),
+    Id: strconv.FormatUint(disk.GetId(), 10),
+    SelfLink: disk.GetSelfLink(),
+    Project: zoneProject,
+    Zone: zone,
+    Region: region,
+    SizeGb: disk.GetSizeGb(),
+    Type: diskType,
+    Labels: disk.GetLabels(),
+    CreationTimestamp: parseTimestamp(disk.GetCreationTimestamp()),
+    Users: instanceNames(disk.GetUsers()),
+    ResourcePolicies: instanceNames(disk.GetResourcePolicies()),
+    Status: disk.GetStatus(),
+  }
+}
+
+// ListAttachedDisks lists the disks of the instances of all the zones matching
+// the filter.
+func (api *API) ListAttachedDisks(ctx context.Context, instanceFilter string) ([]AttachedDisk, error) {
+  var attached []AttachedDisk
+
+  err := api.retry.Do(ctx, "instances listing", func() error {
+    attached = make([]AttachedDisk, 0)
+    request := &computepb.AggregatedListInstancesRequest{Project: api.project}
+    if instanceFilter != "" {
+      request.Filter = &instanceFilter
+    }
+    pairs := api.instances.AggregatedList(ctx, request)
+    for {
+      pair, err := pairs.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      for _, instance := range pair.Value.GetInstances() {
+        for _, disk := range instance.GetDisks() {
+          attached = append(attached, parseAttachedDisk(instance.GetName(), disk.GetSource()))
+        }
+      }
+    }
+  })
+
+  return attached, err
+}
+
+// GetDiskSnapshots lists the snapshots of a disk, newest first.
+func (api *API) GetDiskSnapshots(ctx context.Context, disk Disk) ([]Snapshot, error) {
+  return api.ListSnapshots(ctx, "sourceDiskId = " + disk.Id)
+}
+
+// GetDisksSnapshots lists the snapshots of the disks, newest first, the API
+// filter having no list of values.
+func (api *API) GetDisksSnapshots(ctx context.Context, disks []Disk) ([]Snapshot, error) {
+  terms := make([]string, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    terms = append(terms, "(sourceDiskId = " + disks[diskIndex].Id + ")")
+  }
+  return api.ListSnapshots(ctx, strings.Join(terms, " OR "))
+}
+
+// ListSnapshots lists the snapshots matching the filter, newest first.
+func (api *API) ListSnapshots(ctx context.Context, filter string) ([]Snapshot, error) {
+  return api.listSnapshots(ctx, filter)
+}
+
+// ListSnapshotInventory lists the snapshots matching the filter, newest first,
+// with a field mask on the fields of an inventory.
+func (api *API) ListSnapshotInventory(ctx context.Context, filter string) ([]Snapshot, error) {
+  ctx = callctx.SetHeaders(ctx, "x-goog-fieldmask", "items(" + inventoryFields + "),nextPageToken")
+  return api.listSnapshots(ctx, filter)
+}
+
+func (api *API) listSnapshots(ctx context.Context, filter string) ([]Snapshot, error) {
+  var snapshots []Snapshot
+
+  err := api.retry.Do(ctx, "snapshots listing", func() error {
+    snapshots = make([]Snapshot, 0)
+    orderBy := "creationTimestamp desc"
+    request := &computepb.ListSnapshotsRequest{Project: api.project, OrderBy: &orderBy}
+    if filter != "" {
+      request.Filter = &filter
+    }
+    items := api.snapshots.List(ctx, request)
+    for {
+      snapshot, err := items.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      snapshots = append(snapshots, Snapshot{
+        Name: snapshot.GetName(),
+        Id: strconv.FormatUint(snapshot.GetId(), 10),
+        SelfLink: snapshot.GetSelfLink(),
+        CreationTimestamp: parseTimestamp(snapshot.GetCreationTimestamp()),
+        Status: snapshot.GetStatus(),
+        StorageLocation: firstOrEmpty(snapshot.GetStorageLocations()),
+        SnapshotType: snapshot.GetSnapshotType(),
+        Labels: snapshot.GetLabels(),
+        SourceDisk: lastPathPart(snapshot.GetSourceDisk()),
+        SourceDiskId: snapshot.GetSourceDiskId(),
+        StorageBytes: snapshot.GetStorageBytes(),
+        DiskSizeGb: snapshot.GetDiskSizeGb(),
+        DownloadBytes: snapshot.GetDownloadBytes(),
+        ChainName: snapshot.GetChainName(),
+        Description: snapshot.GetDescription(),
+      })
+    }
+  })
+  sortSnapshots(snapshots)
+
+  return snapshots, err
+}
+
+func firstOrEmpty(values []string) string {
+  if len(values) == 0 {
+    return ""
+  }
+  return values[0]
+}
+
+// GetSnapshotStatus returns the current status of the snapshot.
+func (api *API) GetSnapshotStatus(ctx context.Context, snapshot Snapshot) (string, error) {
+  var status string
+  err := api.retry.Do(ctx, "status of snapshot " + snapshot.Name, func() error {
+    described, getErr := api.snapshots.Get(ctx, &computepb.GetSnapshotRequest{Project: api.project, Snapshot: snapshot.Name})
+    if getErr != nil {
+      return getErr
+    }
+    status = described.GetStatus()
+    return nil
+  })
+
+  return status, err
+}
+
+// CreateSnapshotForDisk snapshots the disk and waits for the operation. In
+// dry-run mode only the name of the snapshot is generated.
+func (api *API) CreateSnapshotForDisk(ctx context.Context, disk Disk, options CreateOptions, dryRun bool) (Snapshot, error) {
+  now := time.Now()
+  name, err := TemplateSnapshotName(options.NameTemplate, disk, now)
+  snapshot := Snapshot{Name: name, CreationTimestamp: now, StorageLocation: options.StorageLocation, SnapshotType: options.SnapshotType, GuestFlush: options.GuestFlush, ChainName: options.ChainName, Description: options.Description}
+  if err != nil || dryRun {
+    return snapshot, err
+  }
+
+  snapshotResource := &computepb.Snapshot{Name: &snapshot.Name, Labels: options.Labels}
+  if options.ChainName != "" {
+    snapshotResource.ChainName = &options.ChainName
+  }
+  if options.Description != "" {
+    snapshotResource.Description = &options.Description
+  }
+  if options.SnapshotType != "" {
+    snapshotResource.SnapshotType = &options.SnapshotType
+  }
+  if options.StorageLocation != "" {
+    snapshotResource.StorageLocations = []string{options.StorageLocation}
+  }
+  if options.KmsKey != "" {
+    snapshotResource.SnapshotEncryptionKey = &computepb.CustomerEncryptionKey{KmsKeyName: &options.KmsKey}
+  }
+  var operation *compute.Operation
+  err = api.retry.Do(ctx, "creation of snapshot " + snapshot.Name, func() error {
+    var createErr error
+    if disk.Region != "" {
+      // The regional disks are snapshotted with their URL
+      sourceDisk := "projects/" + api.project + "/regions/" + disk.Region + "/disks/" + disk.Name
+      snapshotResource.SourceDisk = &sourceDisk
+      snapshotResource.GuestFlush = &options.GuestFlush
+      operation, createErr = api.snapshots.Insert(ctx, &computepb.InsertSnapshotRequest{Project: api.project, SnapshotResource: snapshotResource})
+      return createErr
+    }
+    operation, createErr = api.disks.CreateSnapshot(ctx, &computepb.CreateSnapshotDiskRequest{
+      Project: api.project,
+      Zone: disk.Zone,
+      Disk: disk.Name,
+      SnapshotResource: snapshotResource,
+      GuestFlush: &options.GuestFlush,
+    })
+    return createErr
+  })
+  if err != nil {
+    return snapshot, err
+  }
+
+  return snapshot, operation.Wait(ctx)
+}
+
+// DeleteSnapshot deletes the snapshot and waits for the operation, unless in
+// dry-run mode.
+func (api *API) DeleteSnapshot(ctx context.Context, snapshot Snapshot, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  var operation *compute.Operation
+  err := api.retry.Do(ctx, "deletion of snapshot " + snapshot.Name, func() error {
+    var deleteErr error
+    operation, deleteErr = api.snapshots.Delete(ctx, &computepb.DeleteSnapshotRequest{Project: api.project, Snapshot: snapshot.Name})
+    return deleteErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// ListSnapshotReferences lists the images of the project and the disks of
+// all the zones and regions created from a snapshot, with an images client
+// closed after the call.
+func (api *API) ListSnapshotReferences(ctx context.Context) ([]SnapshotReference, error) {
+  images, err := compute.NewImagesRESTClient(ctx, api.clientOptions...)
+  if err != nil {
+    return nil, err
+  }
+  defer images.Close()
+
+  var references []SnapshotReference
+  err = api.retry.Do(ctx, "listing of the images and disks from snapshots", func() error {
+    references = make([]SnapshotReference, 0)
+    imageItems := images.List(ctx, &computepb.ListImagesRequest{Project: api.project})
+    for {
+      image, err := imageItems.Next()
+      if err == iterator.Done {
+        break
+      }
+      if err != nil {
+        return err
+      }
+      if image.GetSourceSnapshot() != "" || image.GetSourceSnapshotId() != "" {
+        references = append(references, SnapshotReference{SnapshotName: lastPathPart(image.GetSourceSnapshot()), SnapshotId: image.GetSourceSnapshotId(), Resource: "image " + image.GetName()})
+      }
+    }
+    pairs := api.disks.AggregatedList(ctx, &computepb.AggregatedListDisksRequest{Project: api.project})
+    for {
+      pair, err := pairs.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      for _, disk := range pair.Value.GetDisks() {
+        if disk.GetSourceSnapshot() != "" || disk.GetSourceSnapshotId() != "" {
+          references = append(references, SnapshotReference{SnapshotName: lastPathPart(disk.GetSourceSnapshot()), SnapshotId: disk.GetSourceSnapshotId(), Resource: "disk " + disk.GetName()})
+        }
+      }
+    }
+  })
+  return references, err
+}
+
+// GetQuotas returns the quotas of the project, with a client closed after the
+// call.
+func (api *API) GetQuotas(ctx context.Context) ([]Quota, error) {
+  projects, err := compute.NewProjectsRESTClient(ctx, api.clientOptions...)
+  if err != nil {
+    return nil, err
+  }
+  defer projects.Close()
+
+  var quotas []Quota
+  err = api.retry.Do(ctx, "quotas of project " + api.project, func() error {
+    project, getErr := projects.Get(ctx, &computepb.GetProjectRequest{Project: api.project})
+    if getErr != nil {
+      return getErr
+    }
+    quotas = make([]Quota, 0, len(project.GetQuotas()))
+    for _, quota := range project.GetQuotas() {
+      quotas = append(quotas, Quota{Metric: quota.GetMetric(), Limit: int64(quota.GetLimit()), Usage: int64(quota.GetUsage())})
+    }
+    return nil
+  })
+  return quotas, err
+}
+
+// AddSnapshotLabels adds or replaces labels of the snapshot and waits for the
+// operation, unless in dry-run mode.
+func (api *API) AddSnapshotLabels(ctx context.Context, snapshot Snapshot, labels map[string]string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+  return api.updateSnapshotLabels(ctx, snapshot, func(current map[string]string) {
+    for key, value := range labels {
+      current[key] = value
+    }
+  })
+}
+
+// RemoveSnapshotLabels removes labels of the snapshot by key and waits for
+// the operation, unless in dry-run mode.
+func (api *API) RemoveSnapshotLabels(ctx context.Context, snapshot Snapshot, keys []string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+  return api.updateSnapshotLabels(ctx, snapshot, func(current map[string]string) {
+    for keyIndex := 0; keyIndex < len(keys); keyIndex++ {
+      delete(current, keys[keyIndex])
+    }
+  })
+}
+
+// updateSnapshotLabels changes the current labels of the snapshot, with their
+// fingerprint so a concurrent change fails.
+func (api *API) updateSnapshotLabels(ctx context.Context, snapshot Snapshot, update func(labels map[string]string)) error {
+  var operation *compute.Operation
+  err := api.retry.Do(ctx, "labeling of snapshot " + snapshot.Name, func() error {
+    described, getErr := api.snapshots.Get(ctx, &computepb.GetSnapshotRequest{Project: api.project, Snapshot: snapshot.Name})
+    if getErr != nil {
+      return getErr
+    }
+    labels := make(map[string]string)
+    for key, value := range described.GetLabels() {
+      labels[key] = value
+    }
+    update(labels)
+    var setErr error
+    operation, setErr = api.snapshots.SetLabels(ctx, &computepb.SetLabelsSnapshotRequest{
+      Project: api.project,
+      Resource: snapshot.Name,
+      GlobalSetLabelsRequestResource: &computepb.GlobalSetLabelsRequest{Labels: labels, LabelFingerprint: described.LabelFingerprint},
+    })
+    return setErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// AddDiskLabels adds or updates labels of the disk, with their fingerprint so
+// a concurrent change fails, and waits for the operation, unless in dry-run
+// mode.
+func (api *API) AddDiskLabels(ctx context.Context, disk Disk, labels map[string]string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+  var operation *compute.Operation
+  err := api.retry.Do(ctx, "labeling of disk " + disk.Name, func() error {
+    var current map[string]string
+    var fingerprint *string
+    if disk.Region != "" {
+      described, getErr := api.regionDisks.Get(ctx, &computepb.GetRegionDiskRequest{Project: api.project, Region: disk.Region, Disk: disk.Name})
+      if getErr != nil {
+        return getErr
+      }
+      current, fingerprint = described.GetLabels(), described.LabelFingerprint
+    } else {
+      described, getErr := api.disks.Get(ctx, &computepb.GetDiskRequest{Project: api.project, Zone: disk.Zone, Disk: disk.Name})
+      if getErr != nil {
+        return getErr
+      }
+      current, fingerprint = described.GetLabels(), described.LabelFingerprint
+    }
+    updated := make(map[string]string)
+    for key, value := range current {
+      updated[key] = value
+    }
+    for key, value := range labels {
+      updated[key] = value
+    }
+    var setErr error
+    if disk.Region != "" {
+      operation, setErr = api.regionDisks.SetLabels(ctx, &computepb.SetLabelsRegionDiskRequest{
+        Project: api.project,
+        Region: disk.Region,
+        Resource: disk.Name,
+        RegionSetLabelsRequestResource: &computepb.RegionSetLabelsRequest{Labels: updated, LabelFingerprint: fingerprint},
+      })
+    } else {
+      operation, setErr = api.disks.SetLabels(ctx, &computepb.SetLabelsDiskRequest{
+        Project: api.project,
+        Zone: disk.Zone,
+        Resource: disk.Name,
+        ZoneSetLabelsRequestResource: &computepb.ZoneSetLabelsRequest{Labels: updated, LabelFingerprint: fingerprint},
+      })
+    }
+    return setErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// DiskExists gets the disk, which fails if it doesn't exist.
+func (api *API) DiskExists(ctx context.Context, name string, zone string) (bool, error) {
+  err := api.retry.Do(ctx, "description of disk " + name, func() error {
+    _, getErr := api.disks.Get(ctx, &computepb.GetDiskRequest{Project: api.project, Zone: zone, Disk: name})
+    return getErr
+  })
+  if err != nil && IsNotFound(err) {
+    return false, nil
+  }
+  return err == nil, err
+}
+
+// GetDisk gets the disk of the zone.
+func (api *API) GetDisk(ctx context.Context, name string, zone string) (Disk, error) {
+  var disk Disk
+  err := api.retry.Do(ctx, "description of disk " + name, func() error {
+    computeDisk, getErr := api.disks.Get(ctx, &computepb.GetDiskRequest{Project: api.project, Zone: zone, Disk: name})
+    if getErr == nil {
+      disk = apiDisk(computeDisk)
+    }
+    return getErr
+  })
+  return disk, err
+}
+
+// CreateDiskFromSnapshot creates the disk and waits for the operation, unless
+// in dry-run mode.
+func (api *API) CreateDiskFromSnapshot(ctx context.Context, disk NewDisk, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  sourceSnapshot := "projects/" + api.project + "/global/snapshots/" + disk.Snapshot
+  diskResource := &computepb.Disk{Name: &disk.Name, SourceSnapshot: &sourceSnapshot, Labels: disk.Labels}
+  if disk.SizeGb > 0 {
+    diskResource.SizeGb = &disk.SizeGb
+  }
+  if disk.Type != "" {
+    diskType := "projects/" + api.project + "/zones/" + disk.Zone + "/diskTypes/" + disk.Type
+    diskResource.Type = &diskType
+  }
+  var operation *compute.Operation
+  err := api.retry.Do(ctx, "creation of disk " + disk.Name, func() error {
+    var insertErr error
+    operation, insertErr = api.disks.Insert(ctx, &computepb.InsertDiskRequest{Project: api.project, Zone: disk.Zone, DiskResource: diskResource})
+    return insertErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// DeleteDisk deletes the disk of the zone and waits for the operation, unless
+// in dry-run mode.
+func (api *API) DeleteDisk(ctx context.Context, name string, zone string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  var operation *compute.Operation
+  err := api.retry.Do(ctx, "deletion of disk " + name, func() error {
+    var deleteErr error
+    operation, deleteErr = api.disks.Delete(ctx, &computepb.DeleteDiskRequest{Project: api.project, Zone: zone, Disk: name})
+    return deleteErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// CreateImage creates the image from the snapshot and waits for the operation,
+// unless in dry-run mode, with an images client closed after the call.
+func (api *API) CreateImage(ctx context.Context, image NewImage, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+  images, err := compute.NewImagesRESTClient(ctx, api.clientOptions...)
+  if err != nil {
+    return err
+  }
+  defer images.Close()
+
+  sourceSnapshot := "projects/" + api.project + "/global/snapshots/" + image.Snapshot
+  imageResource := &computepb.Image{Name: &image.Name, SourceSnapshot: &sourceSnapshot, Labels: image.Labels}
+  var operation *compute.Operation
+  err = api.retry.Do(ctx, "creation of image " + image.Name, func() error {
+    var insertErr error
+    operation, insertErr = images.Insert(ctx, &computepb.InsertImageRequest{Project: api.project, ImageResource: imageResource})
+    return insertErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// ExportImage fails: the export is a Cloud Build workflow, run by the gcloud
+// command only.
+func (api *API) ExportImage(ctx context.Context, name string, uri string, timeout time.Duration, dryRun bool) error {
+  return errors.New("The export of the images needs the gcloud command, use --backend gcloud")
+}
+
+// DeleteImage deletes the image and waits for the operation, unless in
+// dry-run mode.
+func (api *API) DeleteImage(ctx context.Context, name string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+  images, err := compute.NewImagesRESTClient(ctx, api.clientOptions...)
+  if err != nil {
+    return err
+  }
+  defer images.Close()
+
+  var operation *compute.Operation
+  err = api.retry.Do(ctx, "deletion of image " + name, func() error {
+    var deleteErr error
+    operation, deleteErr = images.Delete(ctx, &computepb.DeleteImageRequest{Project: api.project, Image: name})
+    return deleteErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// GetDiskInstantSnapshots lists the instant snapshots of the zone or region of
+// the disk, newest first, with an instant snapshots client closed after the
+// call.
+func (api *API) GetDiskInstantSnapshots(ctx context.Context, disk Disk) ([]InstantSnapshot, error) {
+  var snapshots []InstantSnapshot
+  filter := "sourceDiskId = " + disk.Id
+
+  err := api.retry.Do(ctx, "instant snapshots listing of disk " + disk.Name, func() error {
+    snapshots = make([]InstantSnapshot, 0)
+    var items *compute.InstantSnapshotIterator
+    if disk.Region != "" {
+      regionSnapshots, err := compute.NewRegionInstantSnapshotsRESTClient(ctx, api.clientOptions...)
+      if err != nil {
+        return err
+      }
+      defer regionSnapshots.Close()
+      items = regionSnapshots.List(ctx, &computepb.ListRegionInstantSnapshotsRequest{Project: api.project, Region: disk.Region, Filter: &filter})
+    } else {
+      zoneSnapshots, err := compute.NewInstantSnapshotsRESTClient(ctx, api.clientOptions...)
+      if err != nil {
+        return err
+      }
+      defer zoneSnapshots.Close()
+      items = zoneSnapshots.List(ctx, &computepb.ListInstantSnapshotsRequest{Project: api.project, Zone: disk.Zone, Filter: &filter})
+    }
+    for {
+      snapshot, err := items.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      snapshots = append(snapshots, apiInstantSnapshot(snapshot))
+    }
+  })
+  sortInstantSnapshots(snapshots)
+
+  return snapshots, err
+}
+
+// ListInstantSnapshots lists the instant snapshots of all the zones and
+// regions matching the filter, newest first, with an instant snapshots client
+// closed after the call.
+func (api *API) ListInstantSnapshots(ctx context.Context, filter string) ([]InstantSnapshot, error) {
+  var snapshots []InstantSnapshot
+  zoneSnapshots, err := compute.NewInstantSnapshotsRESTClient(ctx, api.clientOptions...)
+  if err != nil {
+    return nil, err
+  }
+  defer zoneSnapshots.Close()
+
+  err = api.retry.Do(ctx, "instant snapshots listing", func() error {
+    snapshots = make([]InstantSnapshot, 0)
+    request := &computepb.AggregatedListInstantSnapshotsRequest{Project: api.project}
+    if filter != "" {
+      request.Filter = &filter
+    }
+    pairs := zoneSnapshots.AggregatedList(ctx, request)
+    for {
+      pair, err := pairs.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      for _, snapshot := range pair.Value.GetInstantSnapshots() {
+        snapshots = append(snapshots, apiInstantSnapshot(snapshot))
+      }
+    }
+  })
+  sortInstantSnapshots(snapshots)
+
+  return snapshots, err
+}
+
+// apiInstantSnapshot converts an instant snapshot of the client library.
+func apiInstantSnapshot(snapshot *computepb.InstantSnapshot) InstantSnapshot {
+  return InstantSnapshot{
+    Name: snapshot.GetName(),
+    Id: strconv.FormatUint(snapshot.GetId(), 10),
+    CreationTimestamp: parseTimestamp(snapshot.GetCreationTimestamp()),
+    Status: snapshot.GetStatus(),
+    Zone: lastPathPart(snapshot.GetZone()),
+    Region: lastPathPart(snapshot.GetRegion()),
+    Labels: snapshot.GetLabels(),
+    SourceDisk: lastPathPart(snapshot.GetSourceDisk()),
+    SourceDiskId: snapshot.GetSourceDiskId(),
+    DiskSizeGb: snapshot.GetDiskSizeGb(),
+  }
+}
+
+// CreateInstantSnapshot creates the instant snapshot of the disk and waits for
+// the operation, unless in dry-run mode, with an instant snapshots client
+// closed after the call.
+func (api *API) CreateInstantSnapshot(ctx context.Context, disk Disk, name string, labels map[string]string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  var operation *compute.Operation
+  var err error
+  if disk.Region != "" {
+    regionSnapshots, clientErr := compute.NewRegionInstantSnapshotsRESTClient(ctx, api.clientOptions...)
+    if clientErr != nil {
+      return clientErr
+    }
+    defer regionSnapshots.Close()
+    sourceDisk := "projects/" + api.project + "/regions/" + disk.Region + "/disks/" + disk.Name
+    snapshotResource := &computepb.InstantSnapshot{Name: &name, SourceDisk: &sourceDisk, Labels: labels}
+    err = api.retry.Do(ctx, "creation of instant snapshot " + name, func() error {
+      var insertErr error
+      operation, insertErr = regionSnapshots.Insert(ctx, &computepb.InsertRegionInstantSnapshotRequest{Project: api.project, Region: disk.Region, InstantSnapshotResource: snapshotResource})
+      return insertErr
+    })
+  } else {
+    zoneSnapshots, clientErr := compute.NewInstantSnapshotsRESTClient(ctx, api.clientOptions...)
+    if clientErr != nil {
+      return clientErr
+    }
+    defer zoneSnapshots.Close()
+    sourceDisk := "projects/" + api.project + "/zones/" + disk.Zone + "/disks/" + disk.Name
+    snapshotResource := &computepb.InstantSnapshot{Name: &name, SourceDisk: &sourceDisk, Labels: labels}
+    err = api.retry.Do(ctx, "creation of instant snapshot " + name, func() error {
+      var insertErr error
+      operation, insertErr = zoneSnapshots.Insert(ctx, &computepb.InsertInstantSnapshotRequest{Project: api.project, Zone: disk.Zone, InstantSnapshotResource: snapshotResource})
+      return insertErr
+    })
+  }
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// DeleteInstantSnapshot deletes the instant snapshot and waits for the
+// operation, unless in dry-run mode, with an instant snapshots client closed
+// after the call.
+func (api *API) DeleteInstantSnapshot(ctx context.Context, snapshot InstantSnapshot, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  var operation *compute.Operation
+  var err error
+  if snapshot.Region != "" {
+    regionSnapshots, clientErr := compute.NewRegionInstantSnapshotsRESTClient(ctx, api.clientOptions...)
+    if clientErr != nil {
+      return clientErr
+    }
+    defer regionSnapshots.Close()
+    err = api.retry.Do(ctx, "deletion of instant snapshot " + snapshot.Name, func() error {
+      var deleteErr error
+      operation, deleteErr = regionSnapshots.Delete(ctx, &computepb.DeleteRegionInstantSnapshotRequest{Project: api.project, Region: snapshot.Region, InstantSnapshot: snapshot.Name})
+      return deleteErr
+    })
+  } else {
+    zoneSnapshots, clientErr := compute.NewInstantSnapshotsRESTClient(ctx, api.clientOptions...)
+    if clientErr != nil {
+      return clientErr
+    }
+    defer zoneSnapshots.Close()
+    err = api.retry.Do(ctx, "deletion of instant snapshot " + snapshot.Name, func() error {
+      var deleteErr error
+      operation, deleteErr = zoneSnapshots.Delete(ctx, &computepb.DeleteInstantSnapshotRequest{Project: api.project, Zone: snapshot.Zone, InstantSnapshot: snapshot.Name})
+      return deleteErr
+    })
+  }
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// ListResourcePolicies lists the resource policies of all the regions, with a
+// resource policies client closed after the call.
+func (api *API) ListResourcePolicies(ctx context.Context) ([]ResourcePolicy, error) {
+  var policies []ResourcePolicy
+  resourcePolicies, err := compute.NewResourcePoliciesRESTClient(ctx, api.clientOptions...)
+  if err != nil {
+    return nil, err
+  }
+  defer resourcePolicies.Close()
+
+  err = api.retry.Do(ctx, "resource policies listing", func() error {
+    policies = make([]ResourcePolicy, 0)
+    pairs := resourcePolicies.AggregatedList(ctx, &computepb.AggregatedListResourcePoliciesRequest{Project: api.project})
+    for {
+      pair, err := pairs.Next()
+      if err == iterator.Done {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+      for _, policy := range pair.Value.GetResourcePolicies() {
+        policies = append(policies, ResourcePolicy{Name: policy.GetName(), Region: lastPathPart(policy.GetRegion()), Status: policy.GetStatus(), SnapshotSchedule: policy.GetSnapshotSchedulePolicy() != nil})
+      }
+    }
+  })
+
+  return policies, err
+}
+
+// CreateSnapshotSchedule creates the snapshot schedule resource policy, keeping
+// the snapshots when their disk is deleted, and waits for the operation,
+// unless in dry-run mode, with a resource policies client closed after the
+// call.
+func (api *API) CreateSnapshotSchedule(ctx context.Context, schedule SnapshotSchedule, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+  resourcePolicies, err := compute.NewResourcePoliciesRESTClient(ctx, api.clientOptions...)
+  if err != nil {
+    return err
+  }
+  defer resourcePolicies.Close()
+
+  cycle := &computepb.ResourcePolicySnapshotSchedulePolicySchedule{}
+  hours := int32(schedule.IntervalHours)
+  days := int32(1)
+  if hours > 0 {
+    cycle.HourlySchedule = &computepb.ResourcePolicyHourlyCycle{HoursInCycle: &hours, StartTime: &schedule.StartTime}
+  } else {
+    cycle.DailySchedule = &computepb.ResourcePolicyDailyCycle{DaysInCycle: &days, StartTime: &schedule.StartTime}
+  }
+  retentionDays := int32(schedule.MaxRetentionDays)
+  onDelete := "KEEP_AUTO_SNAPSHOTS"
+  properties := &computepb.ResourcePolicySnapshotSchedulePolicySnapshotProperties{Labels: schedule.Labels}
+  if schedule.StorageLocation != "" {
+    properties.StorageLocations = []string{schedule.StorageLocation}
+  }
+  policy := &computepb.ResourcePolicy{
+    Name: &schedule.Name,
+    SnapshotSchedulePolicy: &computepb.ResourcePolicySnapshotSchedulePolicy{
+      Schedule: cycle,
+      RetentionPolicy: &computepb.ResourcePolicySnapshotSchedulePolicyRetentionPolicy{MaxRetentionDays: &retentionDays, OnSourceDiskDelete: &onDelete},
+      SnapshotProperties: properties,
+    },
+  }
+  var operation *compute.Operation
+  err = api.retry.Do(ctx, "creation of resource policy " + schedule.Name, func() error {
+    var insertErr error
+    operation, insertErr = resourcePolicies.Insert(ctx, &computepb.InsertResourcePolicyRequest{Project: api.project, Region: schedule.Region, ResourcePolicyResource: policy})
+    return insertErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// AttachResourcePolicy attaches the resource policy of the region of the disk
+// to the disk and waits for the operation, unless in dry-run mode.
+func (api *API) AttachResourcePolicy(ctx context.Context, disk Disk, policy string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  policyURL := "projects/" + api.project + "/regions/" + diskRegion(disk) + "/resourcePolicies/" + policy
+  var operation *compute.Operation
+  err := api.retry.Do(ctx, "attachment of resource policy " + policy + " to disk " + disk.Name, func() error {
+    var addErr error
+    if disk.Region != "" {
+      operation, addErr = api.regionDisks.AddResourcePolicies(ctx, &computepb.AddResourcePoliciesRegionDiskRequest{Project: api.project, Region: disk.Region, Disk: disk.Name, RegionDisksAddResourcePoliciesRequestResource: &computepb.RegionDisksAddResourcePoliciesRequest{ResourcePolicies: []string{policyURL}}})
+    } else {
+      operation, addErr = api.disks.AddResourcePolicies(ctx, &computepb.AddResourcePoliciesDiskRequest{Project: api.project, Zone: disk.Zone, Disk: disk.Name, DisksAddResourcePoliciesRequestResource: &computepb.DisksAddResourcePoliciesRequest{ResourcePolicies: []string{policyURL}}})
+    }
+    return addErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
+
+// DetachResourcePolicy detaches the resource policy of the region of the disk
+// from the disk and waits for the operation, unless in dry-run mode.
+func (api *API) DetachResourcePolicy(ctx context.Context, disk Disk, policy string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  policyURL := "projects/" + api.project + "/regions/" + diskRegion(disk) + "/resourcePolicies/" + policy
+  var operation *compute.Operation
+  err := api.retry.Do(ctx, "detachment of resource policy " + policy + " from disk " + disk.Name, func() error {
+    var removeErr error
+    if disk.Region != "" {
+      operation, removeErr = api.regionDisks.RemoveResourcePolicies(ctx, &computepb.RemoveResourcePoliciesRegionDiskRequest{Project: api.project, Region: disk.Region, Disk: disk.Name, RegionDisksRemoveResourcePoliciesRequestResource: &computepb.RegionDisksRemoveResourcePoliciesRequest{ResourcePolicies: []string{policyURL}}})
+    } else {
+      operation, removeErr = api.disks.RemoveResourcePolicies(ctx, &computepb.RemoveResourcePoliciesDiskRequest{Project: api.project, Zone: disk.Zone, Disk: disk.Name, DisksRemoveResourcePoliciesRequestResource: &computepb.DisksRemoveResourcePoliciesRequest{ResourcePolicies: []string{policyURL}}})
+    }
+    return removeErr
+  })
+  if err != nil {
+    return err
+  }
+
+  return operation.Wait(ctx)
+}
@@ -0,0 +1,221 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "sort"
+  "strings"
+  "time"
+)
+
+// Apply creates and deletes exactly the snapshots of the plan of a dry run.
+// The disks which don't exist anymore, or whose snapshots changed since the
+// plan, are skipped with a warning. The deletions go through the safeguards of
+// Run: the held and referenced snapshots, the min keep, the deletion limits,
+// the confirmation and the deletion grace. Like Run, a failing disk doesn't
+// stop the others.
+func (runner *Runner) Apply(ctx context.Context, plan RunPlan) (result Result, err error) {
+  result = Result{
+    Mode: plan.Mode,
+    RunID: runner.options.RunID,
+    Filter: plan.Filter,
+    StartedAt: time.Now(),
+    Created: make([]Snapshot, 0),
+    Ready: make([]Snapshot, 0),
+    Deleted: make([]Snapshot, 0),
+    Failures: make([]Failure, 0),
+    Skipped: make([]Skip, 0),
+  }
+  ctx, endSpan := runner.startRunSpan(ctx, "apply")
+  endEvents := runner.startRunEvents(plan.Mode)
+  defer func() {
+    result.Duration = time.Since(result.StartedAt)
+    endSpan(result, err)
+    endEvents(result, err)
+  }()
+
+  if runner.options.Timeout > 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, runner.options.Timeout)
+    defer cancel()
+  }
+
+  logger := runner.logger
+  project, projectErr := runner.backend.Project(ctx)
+  if projectErr != nil {
+    runner.levels.Warning.Printf("WARNING: unknown project: %s\n", projectErr)
+  } else if project == "" {
+    return result, ErrNoProject
+  }
+  result.Project = project
+
+  logger.Printf("Applying the plan of %s for project '%s' using filter '%s'\n", plan.CreatedAt.Format(time.RFC3339), project, plan.Filter)
+  logger.Println("")
+
+  listed, disksErr := runner.listDisks(ctx, &result)
+  if disksErr != nil {
+    return result, disksErr
+  }
+
+  // Only the disks of the plan which didn't change are applied
+  disks := make([]Disk, 0, len(plan.Disks))
+  diskPlans := make([]DiskPlan, 0, len(plan.Disks))
+  for diskIndex := 0; diskIndex < len(plan.Disks); diskIndex++ {
+    diskPlan := plan.Disks[diskIndex]
+    disk, found := findDisk(listed, diskPlan.Id)
+    reason := ""
+    if !found {
+      reason = "not found anymore"
+    } else if !sameSnapshots(disk.Snapshots, diskPlan.Snapshots) {
+      reason = "snapshots changed since the plan"
+    }
+    if reason != "" {
+      runner.levels.Warning.Printf("WARNING: skipping disk %s: %s\n", diskPlan.Name, reason)
+      result.Skipped = append(result.Skipped, Skip{Disk: diskPlan.Name, Reason: reason})
+      continue
+    }
+    disks = append(disks, disk)
+    diskPlans = append(diskPlans, diskPlan)
+  }
+  result.Disks = disks
+
+  pruneBlocked := make([]bool, len(disks))
+  planned := make(map[string]bool)
+  total := 0
+  for diskIndex := 0; diskIndex < len(disks) && runner.stopped(ctx) == nil; diskIndex++ {
+    pruneBlocked[diskIndex] = !runner.applyDisk(ctx, &disks[diskIndex], diskPlans[diskIndex], &result)
+    for deleteIndex := 0; deleteIndex < len(diskPlans[diskIndex].Delete); deleteIndex++ {
+      planned[diskPlans[diskIndex].Delete[deleteIndex].Name] = true
+    }
+    total += len(disks[diskIndex].Snapshots)
+  }
+  logger.Println("")
+
+  var pruneErr error
+  if len(planned) > 0 && runner.stopped(ctx) == nil {
+    logger.Printf("Deleting the %d snapshot(s) of the plan\n", len(planned))
+    pruneCtx, pruneSpan := StartSpan(ctx, "prune")
+    // The holds added since the listing are honored
+    if !runner.options.NoRefresh {
+      runner.refreshSnapshots(pruneCtx, disks, pruneBlocked, &result)
+    }
+    pruneErr = runner.pruneDisks(pruneCtx, disks, pruneBlocked, &pruneState{total: total, planned: planned}, &result)
+    EndSpan(pruneSpan, pruneErr)
+  }
+
+  failedDisks := result.FailedDisks()
+  if len(failedDisks) == 0 {
+    logger.Printf("Plan applied!")
+  } else {
+    logger.Printf("Plan applied with failures for %d disk(s)\n", len(failedDisks))
+  }
+
+  stopErr := runner.stopped(ctx)
+  if stopErr != nil {
+    return result, fmt.Errorf("%w: %w", ErrInterrupted, stopErr)
+  }
+  if pruneErr != nil {
+    return result, fmt.Errorf("Prune phase aborted: %w", pruneErr)
+  }
+  if len(failedDisks) > 0 {
+    return result, fmt.Errorf("%w for %d disk(s): %s", ErrDisksFailed, len(failedDisks), strings.Join(failedDisks, ", "))
+  }
+  return result, nil
+}
+
+// applyDisk creates the snapshot of the plan of the disk, if any. It tells if
+// the old snapshots can be deleted: not if the new one failed, unless
+// PruneOnCreateFailure.
+func (runner *Runner) applyDisk(ctx context.Context, disk *Disk, diskPlan DiskPlan, result *Result) bool {
+  logger := runner.logger
+  ctx, span := StartSpan(ctx, "apply disk", diskAttributes(*disk)...)
+  defer EndSpan(span, nil)
+
+  if diskPlan.Create != nil {
+    create := diskPlan.Create
+    logger.Printf("Creating snapshot %s for disk %s\n", create.Name, disk.Name)
+    // The name is a template without variable. The snapshot has the id of
+    // this run rather than of the dry run
+    labels := make(map[string]string, len(create.Labels) + 1)
+    for key, value := range create.Labels {
+      labels[key] = value
+    }
+    labels[RunIDLabel] = sanitizeLabel(runner.options.RunID)
+    options := CreateOptions{NameTemplate: create.Name, Description: create.Description, Labels: labels, StorageLocation: create.StorageLocation, GuestFlush: create.GuestFlush, ChainName: create.ChainName, KmsKey: create.KmsKey, SnapshotType: create.SnapshotType}
+    started := time.Now()
+    runner.emit(diskEvent(EventCreateStarted, *disk, create.Name, time.Time{}, nil))
+    operationCtx, cancel := runner.operationContext(ctx)
+    snapshot, err := runner.backend.CreateSnapshotForDisk(operationCtx, *disk, options, false)
+    err = runner.operationError(ctx, operationCtx, err)
+    cancel()
+    operation := Operation{Kind: OperationCreate, Disk: disk.Name, Snapshot: create.Name, Duration: time.Since(started)}
+    if err != nil && IsAlreadyExists(err) {
+      runner.levels.Warning.Printf("WARNING: snapshot %s for disk %s already exists: %s\n", snapshot.Name, disk.Name, err)
+      err = nil
+    }
+    if err == nil && runner.options.Wait {
+      waitStarted := time.Now()
+      snapshot.Status, err = runner.waitForSnapshot(ctx, snapshot)
+      operation.ReadyDuration = time.Since(waitStarted)
+    }
+    operation.Failed = err != nil
+    result.Operations = append(result.Operations, operation)
+    runner.emit(diskEvent(EventCreateFinished, *disk, create.Name, started, err))
+    if err != nil {
+      result.Failures = append(result.Failures, Failure{Disk: disk.Name, Snapshot: create.Name, Err: err})
+      runner.levels.Warning.Printf("Failed to create snapshot %s for disk %s: %s\n", create.Name, disk.Name, err)
+      if !runner.options.PruneOnCreateFailure {
+        runner.levels.Warning.Printf("WARNING: old snapshots of disk %s will NOT be deleted, its new snapshot failed\n", disk.Name)
+        return false
+      }
+    } else {
+      disk.Snapshots = append([]Snapshot{snapshot}, disk.Snapshots...)
+      result.Created = append(result.Created, snapshot)
+      if snapshot.Status == SnapshotReady {
+        result.Ready = append(result.Ready, snapshot)
+      }
+      logger.Printf("Created snapshot %s for disk %s%s\n", snapshot.Name, disk.Name, locationSuffix(snapshot))
+    }
+  }
+  return true
+}
+
+// plannedSnapshots returns the snapshots planned for deletion.
+func plannedSnapshots(snapshots []Snapshot, planned map[string]bool) []Snapshot {
+  kept := make([]Snapshot, 0)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    if planned[snapshots[snapshotIndex].Name] {
+      kept = append(kept, snapshots[snapshotIndex])
+    }
+  }
+  return kept
+}
+
+func findDisk(disks []Disk, id string) (Disk, bool) {
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if disks[diskIndex].Id == id {
+      return disks[diskIndex], true
+    }
+  }
+  return Disk{}, false
+}
+
+// sameSnapshots tells if the snapshots have these names, in any order.
+func sameSnapshots(snapshots []Snapshot, names []string) bool {
+  if len(snapshots) != len(names) {
+    return false
+  }
+  current := make([]string, 0, len(snapshots))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    current = append(current, snapshots[snapshotIndex].Name)
+  }
+  planned := append([]string{}, names...)
+  sort.Strings(current)
+  sort.Strings(planned)
+  for nameIndex := 0; nameIndex < len(current); nameIndex++ {
+    if current[nameIndex] != planned[nameIndex] {
+      return false
+    }
+  }
+  return true
+}
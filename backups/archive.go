@@ -0,0 +1,373 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "strings"
+  "sync"
+  "time"
+
+  "google.golang.org/api/googleapi"
+  storage "google.golang.org/api/storage/v1"
+)
+
+// Label of the temporary images of the archives, the name of the snapshot
+const ArchiveOfLabel = "archive-of"
+
+const (
+  // The snapshot was exported to its object
+  ArchiveArchived = "archived"
+  ArchiveFailed = "failed"
+  // The disk has no READY snapshot created by this program
+  ArchiveSkipped = "skipped"
+)
+
+// Interval of the logs of the exports in progress
+const archiveProgressInterval = 5 * time.Minute
+
+// ErrArchiveMismatch is returned by VerifyArchives when archived objects are
+// missing or don't have their size.
+var ErrArchiveMismatch = errors.New("Archives missing or of the wrong size")
+
+// ArchiveOptions selects the disks whose newest snapshot is archived.
+type ArchiveOptions struct {
+  // As gs://<bucket>/ or gs://<bucket>/<prefix>/, the objects are named after
+  // it
+  Destination   string
+  // Filter of the disks, all the disks if empty
+  Filter        string
+  // Number of exports at the same time, 1 if 0
+  Concurrency   int
+  // Maximum duration of the export of a snapshot, no limit if 0
+  ExportTimeout time.Duration
+  DryRun        bool
+  // Logger used for the progress of the archive, log.Default() if nil
+  Logger        *log.Logger
+  // Backend managing the disks, snapshots and images, the gcloud command if
+  // nil
+  Backend       Backend
+}
+
+// Archive is the export of the newest snapshot of a disk.
+type Archive struct {
+  Disk              string    `json:"disk"`
+  DiskId            string    `json:"diskId"`
+  Snapshot          string    `json:"snapshot,omitempty"`
+  SnapshotCreatedAt time.Time `json:"snapshotCreatedAt,omitzero"`
+  // gs://<bucket>/<object> of the export
+  Object            string    `json:"object,omitempty"`
+  SizeBytes         int64     `json:"sizeBytes,omitempty"`
+  // ArchiveArchived, ArchiveFailed or ArchiveSkipped
+  Status            string    `json:"status"`
+  Error             string    `json:"error,omitempty"`
+  DurationSeconds   float64   `json:"durationSeconds"`
+}
+
+// ArchiveReport is the outcome of an archive run, written as its manifest.
+type ArchiveReport struct {
+  Project     string    `json:"project"`
+  Destination string    `json:"destination"`
+  DryRun      bool      `json:"dryRun"`
+  StartedAt   time.Time `json:"startedAt"`
+  // gs://<bucket>/<object> of the manifest, empty in dry-run mode
+  Manifest    string    `json:"manifest,omitempty"`
+  Archives    []Archive `json:"archives"`
+}
+
+// Failed returns the archives which failed.
+func (report ArchiveReport) Failed() []Archive {
+  failed := make([]Archive, 0)
+  for archiveIndex := 0; archiveIndex < len(report.Archives); archiveIndex++ {
+    if report.Archives[archiveIndex].Status == ArchiveFailed {
+      failed = append(failed, report.Archives[archiveIndex])
+    }
+  }
+  return failed
+}
+
+// WriteFile writes the report as JSON.
+func (report ArchiveReport) WriteFile(path string) error {
+  data, err := json.MarshalIndent(report, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// archivePrefix returns the destination with a trailing slash.
+func archivePrefix(destination string) string {
+  if !strings.HasSuffix(destination, "/") {
+    return destination + "/"
+  }
+  return destination
+}
+
+// archiveObject returns the URI of the archive of a snapshot, grouped by the
+// month of the snapshot for the lifecycle rules, like
+// gs://bucket/archives/2026-10/my-project/my-disk/my-snapshot.tar.gz.
+func archiveObject(destination string, project string, disk Disk, snapshot Snapshot) string {
+  if disk.Project != "" {
+    project = disk.Project
+  }
+  month := snapshot.CreationTimestamp.UTC().Format("2006-01") + "/"
+  if project != "" {
+    month += project + "/"
+  }
+  return archivePrefix(destination) + month + disk.Name + "/" + snapshot.Name + ".tar.gz"
+}
+
+// archiveSnapshotToExport returns the newest READY snapshot created by this
+// program among the snapshots of a disk, newest first, if any.
+func archiveSnapshotToExport(snapshots []Snapshot) (Snapshot, bool) {
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    if snapshot.Labels[CreatedByLabel] == CreatedByValue && snapshot.Status == SnapshotReady && !snapshot.CreationTimestamp.IsZero() {
+      return snapshot, true
+    }
+  }
+  return Snapshot{}, false
+}
+
+// RunArchive exports the newest READY snapshot created by this program of each
+// disk to GCS, through a temporary image deleted after the export, and writes
+// the report as the manifest of the run. A failed disk doesn't stop the other
+// ones: the report tells the outcome of each disk.
+func RunArchive(ctx context.Context, options ArchiveOptions) (ArchiveReport, error) {
+  logger := options.Logger
+  if logger == nil {
+    logger = log.Default()
+  }
+  backend := options.Backend
+  if backend == nil {
+    backend = NewGcloud(nil)
+  }
+  report := ArchiveReport{Destination: archivePrefix(options.Destination), DryRun: options.DryRun, StartedAt: time.Now(), Archives: make([]Archive, 0)}
+  _, _, err := ParseGCSURI(report.Destination + "archive")
+  if err != nil {
+    return report, err
+  }
+  report.Project, err = backend.Project(ctx)
+  if err != nil {
+    return report, err
+  }
+
+  disks, err := backend.GetDisksToSnapshot(ctx, options.Filter)
+  if err != nil {
+    return report, fmt.Errorf("Listing of the disks: %w", err)
+  }
+  logger.Printf("Archiving the newest snapshot of %d disk(s) to %s\n", len(disks), report.Destination)
+  if options.DryRun {
+    logger.Println("DRY RUN MODE: nothing is created nor exported")
+  }
+
+  concurrency := options.Concurrency
+  if concurrency <= 0 {
+    concurrency = 1
+  }
+  slots := make(chan struct{}, concurrency)
+  archives := make([]Archive, len(disks))
+  var exports sync.WaitGroup
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    exports.Add(1)
+    go func(diskIndex int, disk Disk) {
+      defer exports.Done()
+      archives[diskIndex] = Archive{Disk: disk.Name, DiskId: disk.Id}
+      select {
+      case slots <- struct{}{}:
+      case <-ctx.Done():
+        archives[diskIndex].Status = ArchiveFailed
+        archives[diskIndex].Error = ctx.Err().Error()
+        return
+      }
+      defer func() { <-slots }()
+      archives[diskIndex] = archiveDisk(ctx, backend, disk, report, options, logger)
+    }(diskIndex, disks[diskIndex])
+  }
+  exports.Wait()
+  report.Archives = archives
+
+  if options.DryRun {
+    return report, nil
+  }
+  manifest := report.Destination + "manifests/" + report.StartedAt.UTC().Format("20060102T150405Z") + "-" + report.Project + ".json"
+  data, err := json.MarshalIndent(report, "", "  ")
+  if err != nil {
+    return report, err
+  }
+  err = writeGCS(context.WithoutCancel(ctx), manifest, append(data, '\n'), "application/json")
+  if err != nil {
+    return report, fmt.Errorf("Upload of the manifest %s: %w", manifest, err)
+  }
+  report.Manifest = manifest
+  return report, nil
+}
+
+// archiveDisk exports the newest snapshot of the disk, logging the progress of
+// the export.
+func archiveDisk(ctx context.Context, backend Backend, disk Disk, report ArchiveReport, options ArchiveOptions, logger *log.Logger) (archive Archive) {
+  archive = Archive{Disk: disk.Name, DiskId: disk.Id}
+  startedAt := time.Now()
+  defer func() {
+    archive.DurationSeconds = time.Since(startedAt).Seconds()
+  }()
+  fail := func(err error) Archive {
+    logger.Printf("Failed to archive disk %s: %s\n", disk.Name, err)
+    archive.Status = ArchiveFailed
+    archive.Error = err.Error()
+    return archive
+  }
+
+  snapshots, err := backend.GetDiskSnapshots(ctx, disk)
+  if err != nil {
+    return fail(err)
+  }
+  snapshot, found := archiveSnapshotToExport(snapshots)
+  if !found {
+    logger.Printf("Skipping disk %s, it has no READY snapshot created by %s\n", disk.Name, CreatedByValue)
+    archive.Status = ArchiveSkipped
+    return archive
+  }
+  archive.Snapshot = snapshot.Name
+  archive.SnapshotCreatedAt = snapshot.CreationTimestamp
+  archive.Object = archiveObject(report.Destination, report.Project, disk, snapshot)
+  image := NewImage{Name: "archive-" + shortenName(sanitizeName(snapshot.Name), maxSnapshotName - len("archive-")), Snapshot: snapshot.Name, Labels: map[string]string{CreatedByLabel: CreatedByValue, ArchiveOfLabel: sanitizeLabel(snapshot.Name)}}
+  if options.DryRun {
+    logger.Printf("[DRY-RUN] Would export snapshot %s of disk %s to %s, with the temporary image %s\n", snapshot.Name, disk.Name, archive.Object, image.Name)
+    archive.Status = ArchiveArchived
+    return archive
+  }
+
+  logger.Printf("Creating the image %s from snapshot %s of disk %s\n", image.Name, snapshot.Name, disk.Name)
+  err = backend.CreateImage(ctx, image, false)
+  if err != nil {
+    return fail(fmt.Errorf("Creation of the image %s: %w", image.Name, err))
+  }
+  // Deleted even when the export fails
+  defer func() {
+    deleteErr := backend.DeleteImage(context.WithoutCancel(ctx), image.Name, false)
+    if deleteErr != nil {
+      logger.Printf("WARNING: failed to delete the temporary image %s, delete it by hand: %s\n", image.Name, deleteErr)
+    }
+  }()
+
+  exportCtx := ctx
+  if options.ExportTimeout > 0 {
+    var cancel context.CancelFunc
+    exportCtx, cancel = context.WithTimeout(ctx, options.ExportTimeout)
+    defer cancel()
+  }
+  logger.Printf("Exporting snapshot %s of disk %s to %s\n", snapshot.Name, disk.Name, archive.Object)
+  exported := make(chan error, 1)
+  go func() {
+    exported <- backend.ExportImage(exportCtx, image.Name, archive.Object, options.ExportTimeout, false)
+  }()
+  ticker := time.NewTicker(archiveProgressInterval)
+  defer ticker.Stop()
+  var exportErr error
+  exporting := true
+  for exporting {
+    select {
+    case exportErr = <-exported:
+      exporting = false
+    case <-ticker.C:
+      logger.Printf("Still exporting snapshot %s of disk %s, for %s\n", snapshot.Name, disk.Name, time.Since(startedAt).Round(time.Second))
+    }
+  }
+  if exportErr != nil {
+    return fail(fmt.Errorf("Export to %s: %w", archive.Object, exportErr))
+  }
+
+  archive.SizeBytes, err = statGCS(ctx, archive.Object)
+  if err != nil {
+    return fail(fmt.Errorf("Exported object %s: %w", archive.Object, err))
+  }
+  logger.Printf("Archived snapshot %s of disk %s to %s (%.1f GB)\n", snapshot.Name, disk.Name, archive.Object, float64(archive.SizeBytes) / 1e9)
+  archive.Status = ArchiveArchived
+  return archive
+}
+
+// ArchiveCheck is the verification of an archived object.
+type ArchiveCheck struct {
+  Disk          string
+  Object        string
+  ExpectedBytes int64
+  // 0 if the object is missing
+  SizeBytes     int64
+  // Why the archive is wrong, empty if it's right
+  Problem       string
+}
+
+// VerifyArchives checks that the objects of the archives of a manifest, a
+// local file or a gs://bucket/object URI, exist with their size. It returns
+// ErrArchiveMismatch if one doesn't.
+func VerifyArchives(ctx context.Context, manifest string) ([]ArchiveCheck, error) {
+  var data []byte
+  var err error
+  if strings.HasPrefix(manifest, "gs://") {
+    data, err = readGCS(ctx, manifest)
+  } else {
+    data, err = os.ReadFile(manifest)
+  }
+  if err != nil {
+    return nil, err
+  }
+  var report ArchiveReport
+  err = json.Unmarshal(data, &report)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid archive manifest %s: %w", manifest, err)
+  }
+
+  checks := make([]ArchiveCheck, 0, len(report.Archives))
+  mismatch := false
+  for archiveIndex := 0; archiveIndex < len(report.Archives); archiveIndex++ {
+    archive := report.Archives[archiveIndex]
+    if archive.Status != ArchiveArchived {
+      continue
+    }
+    check := ArchiveCheck{Disk: archive.Disk, Object: archive.Object, ExpectedBytes: archive.SizeBytes}
+    check.SizeBytes, err = statGCS(ctx, archive.Object)
+    switch {
+    case isGCSNotFound(err):
+      check.Problem = "missing"
+    case err != nil:
+      return checks, err
+    case check.SizeBytes != check.ExpectedBytes:
+      check.Problem = fmt.Sprintf("%d bytes instead of %d", check.SizeBytes, check.ExpectedBytes)
+    }
+    if check.Problem != "" {
+      mismatch = true
+    }
+    checks = append(checks, check)
+  }
+  if mismatch {
+    return checks, ErrArchiveMismatch
+  }
+  return checks, nil
+}
+
+// statGCS returns the size of a GCS object.
+func statGCS(ctx context.Context, uri string) (int64, error) {
+  bucket, object, err := ParseGCSURI(uri)
+  if err != nil {
+    return 0, err
+  }
+  service, err := storage.NewService(ctx)
+  if err != nil {
+    return 0, err
+  }
+  attributes, err := service.Objects.Get(bucket, object).Context(ctx).Do()
+  if err != nil {
+    return 0, err
+  }
+  return int64(attributes.Size), nil
+}
+
+func isGCSNotFound(err error) bool {
+  var apiErr *googleapi.Error
+  return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
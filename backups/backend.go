@@ -0,0 +1,210 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "regexp"
+  "time"
+)
+
+// Backend lists, creates and deletes the disks snapshots.
+type Backend interface {
+  // Project returns the project of the disks, for the reports
+  Project(ctx context.Context) (string, error)
+  // ListProjects lists the active projects which can be accessed
+  ListProjects(ctx context.Context) ([]string, error)
+  // WithProject returns the same backend for the disks of another project
+  WithProject(project string) Backend
+  GetDisksToSnapshot(ctx context.Context, filter string) ([]Disk, error)
+  // GetZoneDisks and GetRegionDisks list the disks of a single zone or region
+  // matching the filter
+  GetZoneDisks(ctx context.Context, filter string, zone string) ([]Disk, error)
+  GetRegionDisks(ctx context.Context, filter string, region string) ([]Disk, error)
+  // ListAttachedDisks lists the disks attached to the instances matching the
+  // filter, once by instance
+  ListAttachedDisks(ctx context.Context, instanceFilter string) ([]AttachedDisk, error)
+  GetDiskSnapshots(ctx context.Context, disk Disk) ([]Snapshot, error)
+  // GetDisksSnapshots lists the snapshots of several disks in a single call
+  GetDisksSnapshots(ctx context.Context, disks []Disk) ([]Snapshot, error)
+  // ListSnapshots lists the snapshots matching the filter, newest first
+  ListSnapshots(ctx context.Context, filter string) ([]Snapshot, error)
+  // ListSnapshotInventory lists the snapshots matching the filter like
+  // ListSnapshots, with only the fields of an inventory to be faster
+  ListSnapshotInventory(ctx context.Context, filter string) ([]Snapshot, error)
+  GetSnapshotStatus(ctx context.Context, snapshot Snapshot) (string, error)
+  CreateSnapshotForDisk(ctx context.Context, disk Disk, options CreateOptions, dryRun bool) (Snapshot, error)
+  DeleteSnapshot(ctx context.Context, snapshot Snapshot, dryRun bool) error
+  // AddSnapshotLabels sets labels of the snapshot, keeping the other ones
+  AddSnapshotLabels(ctx context.Context, snapshot Snapshot, labels map[string]string, dryRun bool) error
+  RemoveSnapshotLabels(ctx context.Context, snapshot Snapshot, keys []string, dryRun bool) error
+  // AddDiskLabels sets labels of the disk, keeping the other ones
+  AddDiskLabels(ctx context.Context, disk Disk, labels map[string]string, dryRun bool) error
+  // ListSnapshotReferences lists the images and disks of the project created
+  // from a snapshot
+  ListSnapshotReferences(ctx context.Context) ([]SnapshotReference, error)
+  // GetQuotas returns the quotas of the project, like the snapshots one
+  GetQuotas(ctx context.Context) ([]Quota, error)
+  // DiskExists tells if there is a disk with this name in the zone
+  DiskExists(ctx context.Context, name string, zone string) (bool, error)
+  // GetDisk returns the disk of the zone, with its status
+  GetDisk(ctx context.Context, name string, zone string) (Disk, error)
+  CreateDiskFromSnapshot(ctx context.Context, disk NewDisk, dryRun bool) error
+  DeleteDisk(ctx context.Context, name string, zone string, dryRun bool) error
+  // CreateImage creates an image from a snapshot, to export it
+  CreateImage(ctx context.Context, image NewImage, dryRun bool) error
+  // ExportImage exports the image to the GCS object, within the timeout
+  ExportImage(ctx context.Context, name string, uri string, timeout time.Duration, dryRun bool) error
+  DeleteImage(ctx context.Context, name string, dryRun bool) error
+  // GetDiskInstantSnapshots lists the instant snapshots of a disk, newest first
+  GetDiskInstantSnapshots(ctx context.Context, disk Disk) ([]InstantSnapshot, error)
+  // ListInstantSnapshots lists the instant snapshots of all the zones and
+  // regions matching the filter, newest first
+  ListInstantSnapshots(ctx context.Context, filter string) ([]InstantSnapshot, error)
+  // CreateInstantSnapshot creates an instant snapshot of the disk, in its zone
+  // or region
+  CreateInstantSnapshot(ctx context.Context, disk Disk, name string, labels map[string]string, dryRun bool) error
+  DeleteInstantSnapshot(ctx context.Context, snapshot InstantSnapshot, dryRun bool) error
+  // ListResourcePolicies lists the resource policies of all the regions
+  ListResourcePolicies(ctx context.Context) ([]ResourcePolicy, error)
+  // CreateSnapshotSchedule creates a snapshot schedule resource policy in its
+  // region
+  CreateSnapshotSchedule(ctx context.Context, schedule SnapshotSchedule, dryRun bool) error
+  // AttachResourcePolicy attaches the resource policy of the region of the
+  // disk to the disk, and DetachResourcePolicy detaches it
+  AttachResourcePolicy(ctx context.Context, disk Disk, policy string, dryRun bool) error
+  DetachResourcePolicy(ctx context.Context, disk Disk, policy string, dryRun bool) error
+}
+
+// DiskStreamer is a Backend which can also hand the disks page by page as they
+// are listed, so the first ones are used before all of them are listed.
+type DiskStreamer interface {
+  Backend
+  // StreamDisks lists the disks matching the filter like GetDisksToSnapshot,
+  // calling page with each page of up to pageSize disks, once by disk even if
+  // the listing is retried. It stops at the first error of page and returns it
+  StreamDisks(ctx context.Context, filter string, pageSize int, page func([]Disk) error) error
+}
+
+// diskPager hands the disks listed by pages for StreamDisks, skipping the
+// ones handed by a previous attempt of the listing.
+type diskPager struct {
+  pageSize int
+  page     func([]Disk) error
+  handed   map[string]bool
+  pending  []Disk
+  // Of page, which stops the listing
+  err      error
+}
+
+func newDiskPager(pageSize int, page func([]Disk) error) *diskPager {
+  return &diskPager{pageSize: pageSize, page: page, handed: make(map[string]bool), pending: make([]Disk, 0, pageSize)}
+}
+
+// restart drops the disks of the failed attempt not handed yet.
+func (pager *diskPager) restart() {
+  pager.pending = make([]Disk, 0, pager.pageSize)
+}
+
+// add adds the disk listed, handing the page once full.
+func (pager *diskPager) add(disk Disk) error {
+  if pager.err != nil {
+    return pager.err
+  }
+  if pager.handed[disk.Id] {
+    return nil
+  }
+  pager.pending = append(pager.pending, disk)
+  if len(pager.pending) < pager.pageSize {
+    return nil
+  }
+  return pager.flush()
+}
+
+// flush hands the pending disks, if any.
+func (pager *diskPager) flush() error {
+  if len(pager.pending) == 0 {
+    return nil
+  }
+  for diskIndex := 0; diskIndex < len(pager.pending); diskIndex++ {
+    pager.handed[pager.pending[diskIndex].Id] = true
+  }
+  pager.err = pager.page(pager.pending)
+  pager.restart()
+  return pager.err
+}
+
+// finish hands the last page once the listing succeeded, and returns the error
+// of page first, else the one of the listing.
+func (pager *diskPager) finish(err error) error {
+  if pager.err != nil {
+    return pager.err
+  }
+  if err != nil {
+    return err
+  }
+  return pager.flush()
+}
+
+// Fields of the disks listed by the gcloud backend, the ones of Disk
+const diskFields = "name,id,selfLink,zone,region,sizeGb,type,labels,creationTimestamp,users,resourcePolicies"
+
+// Fields of the snapshots listed by ListSnapshotInventory, the ones of
+// Snapshot
+const inventoryFields = "name,id,selfLink,creationTimestamp,status,sourceDisk,sourceDiskId,storageBytes,diskSizeGb,downloadBytes,storageLocations,snapshotType,chainName,labels,description"
+
+// SnapshotReference is an image or a disk created from a snapshot.
+type SnapshotReference struct {
+  SnapshotName string
+  SnapshotId   string
+  // Like "image my-image" or "disk my-disk"
+  Resource     string
+}
+
+// NewDisk is a disk to create from a snapshot.
+type NewDisk struct {
+  Name     string
+  Zone     string
+  Snapshot string
+  // Size of the snapshot if 0
+  SizeGb   int64
+  // e.g. pd-ssd, the default type if empty
+  Type     string
+  Labels   map[string]string
+}
+
+// NewImage is an image to create from a snapshot.
+type NewImage struct {
+  Name     string
+  Snapshot string
+  Labels   map[string]string
+}
+
+// CreateOptions are the settings of the snapshots created.
+type CreateOptions struct {
+  // Template of the name, DefaultNameTemplate if empty
+  NameTemplate string
+  // Description of the snapshot, without description if empty
+  Description  string
+  Labels       map[string]string
+  // Region or multi-region of the snapshot, chosen by GCE if empty
+  StorageLocation string
+  // Application-consistent snapshot, needs the guest agent
+  GuestFlush      bool
+  // Snapshot chain of the snapshot, out of any chain if empty
+  ChainName       string
+  // Cloud KMS key name, Google-managed encryption if empty
+  KmsKey          string
+  // SnapshotStandard or SnapshotArchive, the default type if empty
+  SnapshotType    string
+}
+
+// ValidateKmsKey checks the KMS key is a full key name, which may be in another
+// project.
+func ValidateKmsKey(key string) error {
+  if !kmsKeyRegexp.MatchString(key) {
+    return fmt.Errorf("Invalid KMS key '%s', use projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>", key)
+  }
+  return nil
+}
+
+var kmsKeyRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
@@ -0,0 +1,257 @@
+// Package backups makes snapshots of Google Cloud Platform disks and deletes
+// the old ones.
+package backups
+
+import (
+  "encoding/json"
+  "sort"
+  "strings"
+  "time"
+)
+
+type Disk struct {
+  Name      string
+  Id        string
+  // URL of the disk, if known
+  SelfLink  string
+  // From the zone or region URL, else set by the runner: the names are only
+  // unique in a project
+  Project   string
+  // Short name, empty for the regional disks
+  Zone      string
+  // Short name of the region of the regional (replicated) disks, empty for the
+  // zonal ones
+  Region    string
+  // A string in the JSON of the API
+  SizeGb    int64 `json:",string"`
+  // Short name of the disk type, like pd-ssd
+  Type      string
+  Labels    map[string]string
+  // Zero if unknown
+  CreationTimestamp time.Time
+  // Names of the instances the disk is attached to, read-only or not
+  Users     []string
+  // Short names of the resource policies attached to the disk, its snapshot
+  // schedules
+  ResourcePolicies []string
+  // Like READY or CREATING, only read by Backend.GetDisk
+  Status    string
+  Snapshots []Snapshot
+}
+
+// UnmarshalJSON decodes a disk of the v1 compute API, as output by gcloud. The
+// other fields are ignored.
+func (disk *Disk) UnmarshalJSON(data []byte) error {
+  var raw struct {
+    Name              string            `json:"name"`
+    Id                string            `json:"id"`
+    SelfLink          string            `json:"selfLink"`
+    // Self-links like https://www.googleapis.com/compute/v1/projects/p/zones/z
+    Zone              string            `json:"zone"`
+    Region            string            `json:"region"`
+    // A string in the JSON of the API
+    SizeGb            int64             `json:"sizeGb,string"`
+    // URL of the disk type
+    Type              string            `json:"type"`
+    Labels            map[string]string `json:"labels"`
+    CreationTimestamp string            `json:"creationTimestamp"`
+    // URLs of the instances
+    Users             []string          `json:"users"`
+    // URLs of the resource policies
+    ResourcePolicies  []string          `json:"resourcePolicies"`
+    Status            string            `json:"status"`
+  }
+  err := json.Unmarshal(data, &raw)
+  if err != nil {
+    return err
+  }
+
+  disk.Name = raw.Name
+  disk.Id = raw.Id
+  disk.SelfLink = raw.SelfLink
+  disk.SizeGb = raw.SizeGb
+  _, disk.Type = parseSelfLink(raw.Type)
+  disk.Labels = raw.Labels
+  disk.CreationTimestamp = parseTimestamp(raw.CreationTimestamp)
+  disk.Users = instanceNames(raw.Users)
+  disk.ResourcePolicies = instanceNames(raw.ResourcePolicies)
+  disk.Status = raw.Status
+  var zoneProject, regionProject string
+  zoneProject, disk.Zone = parseSelfLink(raw.Zone)
+  regionProject, disk.Region = parseSelfLink(raw.Region)
+  disk.Project = zoneProject
+  if disk.Project == "" {
+    disk.Project = regionProject
+  }
+
+  return nil
+}
+
+// parseSelfLink returns the project and the name of a resource URL, like
+// https://www.googleapis.com/compute/v1/projects/p/zones/europe-west1-b. The
+// project is empty if the URL has none, like a short name.
+func parseSelfLink(url string) (string, string) {
+  project := ""
+  parts := strings.Split(url, "/")
+  for partIndex := 0; partIndex < len(parts) - 1; partIndex++ {
+    if parts[partIndex] == "projects" {
+      project = parts[partIndex + 1]
+      break
+    }
+  }
+  return project, lastPathPart(url)
+}
+
+// instanceNames returns the names of the instances, or of the other resources,
+// of the URLs.
+func instanceNames(urls []string) []string {
+  names := make([]string, 0, len(urls))
+  for urlIndex := 0; urlIndex < len(urls); urlIndex++ {
+    names = append(names, lastPathPart(urls[urlIndex]))
+  }
+  return names
+}
+
+// AttachedDisk is a disk attached to an instance, from the disks of the
+// instance.
+type AttachedDisk struct {
+  Instance string
+  // Of the disk, empty if its URL has none
+  Project  string
+  // Zone of the disk, or region of a regional disk
+  Location string
+  Name     string
+}
+
+// parseAttachedDisk returns the disk of a source URL, like
+// https://www.googleapis.com/compute/v1/projects/p/zones/z/disks/d.
+func parseAttachedDisk(instance string, url string) AttachedDisk {
+  attached := AttachedDisk{Instance: instance, Name: lastPathPart(url)}
+  parts := strings.Split(url, "/")
+  for partIndex := 0; partIndex < len(parts) - 1; partIndex++ {
+    switch parts[partIndex] {
+    case "projects":
+      attached.Project = parts[partIndex + 1]
+    case "zones", "regions":
+      attached.Location = parts[partIndex + 1]
+    }
+  }
+  return attached
+}
+
+// Location returns the zone of the disk, or its region if it's regional.
+func (disk Disk) Location() string {
+  if disk.Region != "" {
+    return disk.Region
+  }
+  return disk.Zone
+}
+
+const (
+  SnapshotReady = "READY"
+  SnapshotFailed = "FAILED"
+)
+
+type Snapshot struct {
+  Name              string
+  Id                string
+  // URL of the snapshot, if known
+  SelfLink          string
+  // Zero if missing or unparsable
+  CreationTimestamp time.Time
+  // CREATING, UPLOADING, READY, FAILED or DELETING
+  Status            string
+  // Region or multi-region of the snapshot, if known
+  StorageLocation   string
+  // SnapshotStandard or SnapshotArchive, if known
+  SnapshotType      string
+  // Application-consistent, created with a guest flush
+  GuestFlush        bool
+  // Snapshot chain of the snapshot, if any
+  ChainName         string
+  Labels            map[string]string
+  // Cloud KMS key of the created snapshots, empty if Google-managed or not
+  // known
+  KmsKey            string
+  // Name of the disk of the snapshot, if known
+  SourceDisk        string
+  SourceDiskId      string
+  // Bytes stored for the snapshot and size of its disk, if known
+  StorageBytes      int64
+  DiskSizeGb        int64
+  // Bytes downloaded to restore the snapshot, if known
+  DownloadBytes     int64
+  // Provenance of the snapshot, see TemplateSnapshotDescription
+  Description       string
+}
+
+// UnmarshalJSON decodes a snapshot of the v1 compute API, as output by gcloud.
+// The other fields are ignored.
+func (snapshot *Snapshot) UnmarshalJSON(data []byte) error {
+  var raw struct {
+    Name              string            `json:"name"`
+    Id                string            `json:"id"`
+    SelfLink          string            `json:"selfLink"`
+    CreationTimestamp string            `json:"creationTimestamp"`
+    Status            string            `json:"status"`
+    StorageLocations  []string          `json:"storageLocations"`
+    SnapshotType      string            `json:"snapshotType"`
+    ChainName         string            `json:"chainName"`
+    Labels            map[string]string `json:"labels"`
+    // URL of the disk
+    SourceDisk        string            `json:"sourceDisk"`
+    SourceDiskId      string            `json:"sourceDiskId"`
+    Description       string            `json:"description"`
+    // Strings in the JSON of the API
+    StorageBytes      int64             `json:"storageBytes,string"`
+    DiskSizeGb        int64             `json:"diskSizeGb,string"`
+    DownloadBytes     int64             `json:"downloadBytes,string"`
+  }
+  err := json.Unmarshal(data, &raw)
+  if err != nil {
+    return err
+  }
+
+  snapshot.Name = raw.Name
+  snapshot.Id = raw.Id
+  snapshot.SelfLink = raw.SelfLink
+  snapshot.CreationTimestamp = parseTimestamp(raw.CreationTimestamp)
+  snapshot.Status = raw.Status
+  if len(raw.StorageLocations) > 0 {
+    snapshot.StorageLocation = raw.StorageLocations[0]
+  }
+  snapshot.SnapshotType = raw.SnapshotType
+  snapshot.Labels = raw.Labels
+  snapshot.SourceDiskId = raw.SourceDiskId
+  snapshot.StorageBytes = raw.StorageBytes
+  snapshot.DiskSizeGb = raw.DiskSizeGb
+  snapshot.DownloadBytes = raw.DownloadBytes
+  snapshot.ChainName = raw.ChainName
+  snapshot.Description = raw.Description
+  if raw.SourceDisk != "" {
+    snapshot.SourceDisk = lastPathPart(raw.SourceDisk)
+  }
+
+  return nil
+}
+
+// parseTimestamp parses the RFC 3339 timestamps of the API, returning the zero
+// time if it's not valid.
+func parseTimestamp(value string) time.Time {
+  timestamp, err := time.Parse(time.RFC3339, value)
+  if err != nil {
+    return time.Time{}
+  }
+  return timestamp
+}
+
+// sortSnapshots sorts the snapshots newest first by creation timestamp,
+// whatever the order of their listing, the ones without one last.
+func sortSnapshots(snapshots []Snapshot) {
+  sort.SliceStable(snapshots, func(i int, j int) bool {
+    if snapshots[j].CreationTimestamp.IsZero() {
+      return !snapshots[i].CreationTimestamp.IsZero()
+    }
+    return snapshots[i].CreationTimestamp.After(snapshots[j].CreationTimestamp)
+  })
+}
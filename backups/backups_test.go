@@ -0,0 +1,211 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestDiskLocation(t *testing.T) {
+  tests := []struct {
+    disk     Disk
+    expected string
+  }{
+    {Disk{Name: "db-data", Zone: "europe-west1-b"}, "europe-west1-b"},
+    {Disk{Name: "shared-data", Region: "europe-west1"}, "europe-west1"},
+    {Disk{Name: "unknown"}, ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    if test.disk.Location() != test.expected {
+      t.Errorf("%s: got %s, expected %s", test.disk.Name, test.disk.Location(), test.expected)
+    }
+  }
+}
+
+func TestParseSelfLink(t *testing.T) {
+  tests := []struct {
+    url     string
+    project string
+    name    string
+  }{
+    {"https://www.googleapis.com/compute/v1/projects/proj/zones/europe-west1-b", "proj", "europe-west1-b"},
+    {"https://www.googleapis.com/compute/v1/projects/host-proj/regions/europe-west1/disks/db-data", "host-proj", "db-data"},
+    {"projects/proj/zones/europe-west1-b/diskTypes/pd-ssd", "proj", "pd-ssd"},
+    {"europe-west1-b", "", "europe-west1-b"},
+    // Without a project after projects/
+    {"https://www.googleapis.com/compute/v1/projects", "", "projects"},
+    {"", "", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    project, name := parseSelfLink(test.url)
+    if project != test.project || name != test.name {
+      t.Errorf("%s: got %s and %s, expected %s and %s", test.url, project, name, test.project, test.name)
+    }
+  }
+}
+
+func TestDiskSelfLinks(t *testing.T) {
+  fake := newFakeRunner(t)
+  fake.fixtures(t, "selflink_disks.json", "snapshots.json")
+  runner, _ := newTestRunner(fake, Options{Mode: ModeBackup, DryRun: true})
+
+  result, err := runner.Run(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    project  string
+    zone     string
+    region   string
+    diskType string
+  }{
+    {"host-proj", "us-central1-a", "", "pd-standard"},
+    // The project of the run when the zone has none
+    {"proj", "europe-west1-c", "", "pd-balanced"},
+    {"proj", "", "us-east1", "pd-ssd"},
+  }
+  if len(result.Disks) != len(tests) {
+    t.Fatalf("Got %d disks", len(result.Disks))
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    disk := result.Disks[testIndex]
+    if disk.Project != test.project || disk.Zone != test.zone || disk.Region != test.region || disk.Type != test.diskType {
+      t.Errorf("%s: got %s/%s/%s of type %s", disk.Name, disk.Project, disk.Zone, disk.Region, disk.Type)
+    }
+  }
+}
+
+func TestSortSnapshots(t *testing.T) {
+  at := func(value string) time.Time {
+    timestamp, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return timestamp
+  }
+  tests := []struct {
+    name     string
+    created  map[string]string
+    listed   string
+    expected string
+  }{
+    {"shuffled", map[string]string{"a": "2026-10-14T10:00:00Z", "b": "2026-10-13T10:00:00Z", "c": "2026-10-12T10:00:00Z", "d": "2026-10-11T10:00:00Z"}, "c,a,d,b", "a,b,c,d"},
+    // 02:00 in UTC-7 is after 08:00 in UTC
+    {"time zones", map[string]string{"a": "2026-10-12T02:00:00-07:00", "b": "2026-10-12T08:00:00Z"}, "b,a", "a,b"},
+    {"unknown ages last", map[string]string{"a": "2026-10-14T10:00:00Z", "b": "", "c": "2026-10-12T10:00:00Z", "d": ""}, "b,c,d,a", "a,c,b,d"},
+    {"same time in listing order", map[string]string{"a": "2026-10-14T10:00:00Z", "b": "2026-10-14T10:00:00Z", "c": "2026-10-15T10:00:00Z"}, "b,a,c", "c,b,a"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    snapshots := make([]Snapshot, 0)
+    instants := make([]InstantSnapshot, 0)
+    listed := strings.Split(test.listed, ",")
+    for listedIndex := 0; listedIndex < len(listed); listedIndex++ {
+      var createdAt time.Time
+      if test.created[listed[listedIndex]] != "" {
+        createdAt = at(test.created[listed[listedIndex]])
+      }
+      snapshots = append(snapshots, testSnapshot(listed[listedIndex], "1", createdAt))
+      instants = append(instants, InstantSnapshot{Name: listed[listedIndex], CreationTimestamp: createdAt})
+    }
+    sortSnapshots(snapshots)
+    if snapshotNames(snapshots) != test.expected {
+      t.Errorf("%s: got %s, expected %s", test.name, snapshotNames(snapshots), test.expected)
+    }
+    sortInstantSnapshots(instants)
+    instantNames := make([]string, 0, len(instants))
+    for instantIndex := 0; instantIndex < len(instants); instantIndex++ {
+      instantNames = append(instantNames, instants[instantIndex].Name)
+    }
+    if strings.Join(instantNames, ",") != test.expected {
+      t.Errorf("%s: got the instant snapshots %v, expected %s", test.name, instantNames, test.expected)
+    }
+  }
+}
+
+func TestJSONFields(t *testing.T) {
+  var fixture struct {
+    Disk     json.RawMessage `json:"disk"`
+    Snapshot json.RawMessage `json:"snapshot"`
+  }
+  err := json.Unmarshal([]byte(readTestdata(t, "fields.json")), &fixture)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The fixture has all the fields of the projections
+  fields := []struct {
+    name   string
+    raw    json.RawMessage
+    fields string
+  }{
+    {"disk", fixture.Disk, diskFields},
+    {"snapshot", fixture.Snapshot, inventoryFields},
+  }
+  for fieldsIndex := 0; fieldsIndex < len(fields); fieldsIndex++ {
+    var keys map[string]interface{}
+    json.Unmarshal(fields[fieldsIndex].raw, &keys)
+    projected := strings.Split(fields[fieldsIndex].fields, ",")
+    for fieldIndex := 0; fieldIndex < len(projected); fieldIndex++ {
+      // A disk is either zonal or regional
+      if _, found := keys[projected[fieldIndex]]; !found && projected[fieldIndex] != "region" {
+        t.Errorf("The %s of the fixture has no %s", fields[fieldsIndex].name, projected[fieldIndex])
+      }
+    }
+  }
+
+  var disk Disk
+  err = json.Unmarshal(fixture.Disk, &disk)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expectedDisk := Disk{
+    Name: "db-data",
+    Id: "1111111111111111111",
+    SelfLink: "https://www.googleapis.com/compute/v1/projects/host-proj/zones/europe-west1-b/disks/db-data",
+    Project: "host-proj",
+    Zone: "europe-west1-b",
+    SizeGb: 100,
+    Type: "pd-ssd",
+    Labels: map[string]string{"env": "production"},
+    CreationTimestamp: time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC),
+    Users: []string{"db-1"},
+    ResourcePolicies: []string{"nightly"},
+  }
+  disk.CreationTimestamp = disk.CreationTimestamp.UTC()
+  if !reflect.DeepEqual(disk, expectedDisk) {
+    t.Errorf("Got the disk\n%+v\nexpected\n%+v", disk, expectedDisk)
+  }
+
+  var snapshot Snapshot
+  err = json.Unmarshal(fixture.Snapshot, &snapshot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expectedSnapshot := Snapshot{
+    Name: "db-data-3",
+    Id: "9000000000000000003",
+    SelfLink: "https://www.googleapis.com/compute/v1/projects/host-proj/global/snapshots/db-data-3",
+    CreationTimestamp: time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC),
+    Status: SnapshotReady,
+    StorageLocation: "eu",
+    SnapshotType: SnapshotArchive,
+    ChainName: "db-data-hourly",
+    Labels: map[string]string{CreatedByLabel: CreatedByValue},
+    SourceDisk: "db-data",
+    SourceDiskId: "1111111111111111111",
+    StorageBytes: 1200000000,
+    DiskSizeGb: 100,
+    DownloadBytes: 4000000000,
+    Description: "Created by gcp-backups",
+  }
+  snapshot.CreationTimestamp = snapshot.CreationTimestamp.UTC()
+  if !reflect.DeepEqual(snapshot, expectedSnapshot) {
+    t.Errorf("Got the snapshot\n%+v\nexpected\n%+v", snapshot, expectedSnapshot)
+  }
+}
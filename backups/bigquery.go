@@ -0,0 +1,207 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+
+  bigquery "google.golang.org/api/bigquery/v2"
+)
+
+// Maximum number of rows of a streaming insert request
+const bigQueryBatchSize = 500
+
+// Outcomes of the disks in the BigQuery rows
+const (
+  OutcomeSuccess = "success"
+  OutcomeFailure = "failure"
+)
+
+var bigQueryTableRegexp = regexp.MustCompile(`^([a-z][-a-z0-9:.]*[a-z0-9])\.([A-Za-z0-9_]+)\.([A-Za-z0-9_$-]+)$`)
+
+// ParseBigQueryTable returns the project, dataset and table of a table id like
+// project.dataset.table.
+func ParseBigQueryTable(table string) (string, string, string, error) {
+  match := bigQueryTableRegexp.FindStringSubmatch(table)
+  if match == nil {
+    return "", "", "", fmt.Errorf("Invalid BigQuery table '%s', use project.dataset.table", table)
+  }
+  return match[1], match[2], match[3], nil
+}
+
+// BigQuerySchema is the schema of the table of the runs, described in
+// docs/bigquery-schema.json: a row by disk and run.
+var BigQuerySchema = &bigquery.TableSchema{Fields: []*bigquery.TableFieldSchema{
+  {Name: "run_id", Type: "STRING", Mode: "REQUIRED", Description: "Id of the run, starting with its time"},
+  {Name: "timestamp", Type: "TIMESTAMP", Mode: "REQUIRED", Description: "Start of the run"},
+  {Name: "plan", Type: "STRING", Description: "Name of the plan of the config file, if any"},
+  {Name: "project", Type: "STRING", Mode: "REQUIRED"},
+  {Name: "mode", Type: "STRING", Mode: "REQUIRED", Description: "full, backup or prune"},
+  {Name: "disk", Type: "STRING", Mode: "REQUIRED"},
+  {Name: "zone", Type: "STRING", Description: "Zone of the disk, or region of a regional disk"},
+  {Name: "action", Type: "STRING", Mode: "REQUIRED", Description: "created, deleted (only old snapshots were deleted), failed or none"},
+  {Name: "snapshot", Type: "STRING", Description: "Snapshot created, if any"},
+  {Name: "deleted_snapshots", Type: "STRING", Mode: "REPEATED"},
+  {Name: "duration_seconds", Type: "FLOAT", Description: "Duration of the run"},
+  {Name: "outcome", Type: "STRING", Mode: "REQUIRED", Description: "success or failure"},
+  {Name: "error", Type: "STRING", Description: "Errors of the disk, if any"},
+  {Name: "storage_bytes_freed", Type: "INTEGER", Description: "Storage of the deleted snapshots, if known"},
+  {Name: "create_seconds", Type: "FLOAT", Description: "Duration of the creation of the snapshot, if any"},
+  {Name: "ready_seconds", Type: "FLOAT", Description: "Duration of the wait for the snapshot to be READY, with --wait"},
+  {Name: "delete_seconds", Type: "FLOAT", Description: "Sum of the durations of the deletions of the snapshots"},
+}}
+
+// BigQuery inserts the outcome of the disks of a run into a BigQuery table,
+// with the Application Default Credentials. The table is created with
+// BigQuerySchema if it doesn't exist, in an existing dataset, and its schema
+// updated if it lacks columns.
+type BigQuery struct {
+  // As project.dataset.table
+  Table  string
+  // Retries of the failed insertions, 2 if 0
+  Retry  Retry
+}
+
+// Write inserts the rows of the run. The dry runs write nothing.
+func (bigQuery BigQuery) Write(ctx context.Context, summary Summary) error {
+  if summary.DryRun {
+    return nil
+  }
+  project, dataset, table, err := ParseBigQueryTable(bigQuery.Table)
+  if err != nil {
+    return err
+  }
+  service, err := bigquery.NewService(ctx)
+  if err != nil {
+    return err
+  }
+  retry := bigQuery.Retry
+  if retry.MaxRetries == 0 {
+    retry.MaxRetries = 2
+  }
+
+  runID := summary.RunID
+  if runID == "" {
+    runID = NewRunID(summary.StartedAt)
+  }
+  rows := BigQueryRows(summary, runID)
+  created := false
+  patched := false
+  for start := 0; start < len(rows); start += bigQueryBatchSize {
+    end := start + bigQueryBatchSize
+    if end > len(rows) {
+      end = len(rows)
+    }
+    request := &bigquery.TableDataInsertAllRequest{Rows: rows[start:end]}
+    insert := func() error {
+      response, err := service.Tabledata.InsertAll(project, dataset, table, request).Context(ctx).Do()
+      if err != nil {
+        return err
+      }
+      if len(response.InsertErrors) > 0 && len(response.InsertErrors[0].Errors) > 0 {
+        return fmt.Errorf("%d row(s) not inserted into %s: %s", len(response.InsertErrors), bigQuery.Table, response.InsertErrors[0].Errors[0].Message)
+      }
+      return nil
+    }
+    err = retry.Do(ctx, "BigQuery insertion", insert)
+    if err != nil && IsNotFound(err) && !created {
+      created = true
+      _, err = service.Tables.Insert(project, dataset, &bigquery.Table{TableReference: &bigquery.TableReference{ProjectId: project, DatasetId: dataset, TableId: table}, Schema: BigQuerySchema}).Context(ctx).Do()
+      if err != nil && !IsAlreadyExists(err) {
+        return fmt.Errorf("Failed to create the BigQuery table %s: %w", bigQuery.Table, err)
+      }
+      // The streaming inserts into a new table fail for a few seconds
+      err = retry.Do(ctx, "BigQuery insertion", insert)
+      for attempt := 0; attempt < 5 && err != nil && IsNotFound(err); attempt++ {
+        select {
+        case <-ctx.Done():
+          return ctx.Err()
+        case <-time.After(2 * time.Second):
+        }
+        err = retry.Do(ctx, "BigQuery insertion", insert)
+      }
+    }
+    if err != nil && strings.Contains(err.Error(), "no such field") && !patched {
+      // A table created by an older version, the new columns are added
+      patched = true
+      _, err = service.Tables.Patch(project, dataset, table, &bigquery.Table{Schema: BigQuerySchema}).Context(ctx).Do()
+      if err != nil {
+        return fmt.Errorf("Failed to update the schema of the BigQuery table %s: %w", bigQuery.Table, err)
+      }
+      err = retry.Do(ctx, "BigQuery insertion", insert)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+// BigQueryRows returns a row by disk of the run. The insert ids deduplicate
+// the rows of retried insertions.
+func BigQueryRows(summary Summary, runID string) []*bigquery.TableDataInsertAllRequestRows {
+  errorsByDisk := make(map[string][]string)
+  for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+    failure := summary.Failures[failureIndex]
+    errorsByDisk[failure.Disk] = append(errorsByDisk[failure.Disk], failure.Error)
+  }
+
+  rows := make([]*bigquery.TableDataInsertAllRequestRows, 0, len(summary.Disks))
+  for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+    disk := summary.Disks[diskIndex]
+    zone := disk.Zone
+    if disk.Region != "" {
+      zone = disk.Region
+    }
+    action := "none"
+    if disk.Failed {
+      action = ActionFailed
+    } else if disk.Created != "" {
+      action = ActionCreated
+    } else if len(disk.Deleted) > 0 {
+      action = ActionDeleted
+    }
+    outcome := OutcomeSuccess
+    if disk.Failed {
+      outcome = OutcomeFailure
+    }
+    row := map[string]bigquery.JsonValue{
+      "run_id": runID,
+      "timestamp": summary.StartedAt.UTC().Format(time.RFC3339Nano),
+      "project": summary.Project,
+      "mode": summary.Mode,
+      "disk": disk.Name,
+      "zone": zone,
+      "action": action,
+      "deleted_snapshots": disk.Deleted,
+      "duration_seconds": summary.DurationSeconds,
+      "outcome": outcome,
+      // As a string, like the API returns the integers
+      "storage_bytes_freed": strconv.FormatInt(disk.StorageBytesFreed, 10),
+    }
+    if summary.Plan != "" {
+      row["plan"] = summary.Plan
+    }
+    if disk.Created != "" {
+      row["snapshot"] = disk.Created
+    }
+    if disk.CreateSeconds > 0 {
+      row["create_seconds"] = disk.CreateSeconds
+    }
+    if disk.ReadySeconds > 0 {
+      row["ready_seconds"] = disk.ReadySeconds
+    }
+    if disk.DeleteSeconds > 0 {
+      row["delete_seconds"] = disk.DeleteSeconds
+    }
+    if len(errorsByDisk[disk.Name]) > 0 {
+      row["error"] = strings.Join(errorsByDisk[disk.Name], "; ")
+    }
+    rows = append(rows, &bigquery.TableDataInsertAllRequestRows{InsertId: runID + "-" + strconv.Itoa(diskIndex), Json: row})
+  }
+  return rows
+}
@@ -0,0 +1,84 @@
+package backups
+
+import (
+  "fmt"
+  "strings"
+)
+
+// Label of the disks with the chain name of their snapshots, overriding the
+// chain name template
+const ChainNameLabel = "backup-chain-name"
+
+// Rules of the chain names, as the GCE resource names
+const maxChainName = 63
+
+// Variables of the chain name templates, with no time: the snapshots of a disk
+// stay in the same chain
+var chainNameVariables = []string{"disk", "diskId", "zone", "project"}
+
+// ValidateChainNameTemplate checks the variables of the template, and that it
+// makes valid chain names.
+func ValidateChainNameTemplate(template string) error {
+  sample := Disk{Name: "disk", Id: "1234567890123456789", Project: "project", Zone: "europe-west1-b"}
+  _, err := TemplateChainName(template, sample)
+  return err
+}
+
+// TemplateChainName returns the chain name of the snapshots of the disk from
+// the template, without chain if empty. Unlike the snapshot names, the disk
+// name isn't shortened, as the chain of a disk must not change: the name fails
+// if it doesn't follow the GCE rules.
+func TemplateChainName(template string, disk Disk) (string, error) {
+  if template == "" {
+    return "", nil
+  }
+  segments, err := parseTemplate(template, chainNameVariables, "chain name template")
+  if err != nil {
+    return "", err
+  }
+  values := map[string]string{
+    "disk": sanitizeName(disk.Name),
+    "diskId": disk.Id,
+    "zone": disk.Location(),
+    "project": disk.Project,
+  }
+  parts := make([]string, 0, len(segments))
+  for segmentIndex := 0; segmentIndex < len(segments); segmentIndex++ {
+    if segments[segmentIndex].variable == "" {
+      parts = append(parts, segments[segmentIndex].literal)
+    } else {
+      parts = append(parts, values[segments[segmentIndex].variable])
+    }
+  }
+  name := strings.Join(parts, "")
+  return name, validateChainName(name)
+}
+
+// validateChainName checks the chain name against the GCE rules.
+func validateChainName(name string) error {
+  if len(name) > maxChainName {
+    return fmt.Errorf("Invalid chain name %s: more than %d characters", name, maxChainName)
+  }
+  if !snapshotNameRegexp.MatchString(name) {
+    return fmt.Errorf("Invalid chain name %s: only lowercase letters, digits and dashes, starting with a letter and not ending with a dash", name)
+  }
+  return nil
+}
+
+// chainName returns the chain name of the snapshots of the disk, from its
+// ChainNameLabel or the template of the options. An invalid name is dropped,
+// with a warning: the snapshot is created out of any chain.
+func (runner *Runner) chainName(disk Disk) string {
+  name, labeled := disk.Labels[ChainNameLabel]
+  var err error
+  if labeled {
+    err = validateChainName(name)
+  } else {
+    name, err = TemplateChainName(runner.options.ChainNameTemplate, disk)
+  }
+  if err != nil {
+    runner.levels.Warning.Printf("WARNING: %s, the snapshot of disk %s is created without chain\n", err, disk.Name)
+    return ""
+  }
+  return name
+}
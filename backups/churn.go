@@ -0,0 +1,138 @@
+package backups
+
+import (
+  "sort"
+  "strings"
+  "time"
+)
+
+// Number of the most recent deltas of a disk drawn by its sparkline
+const sparklineLength = 14
+
+// Bars of the sparklines, from the lowest to the highest value
+var sparklineBars = []rune("▁▂▃▄▅▆▇█")
+
+// ChurnDelta is the change of a disk between a snapshot and the previous one.
+type ChurnDelta struct {
+  Snapshot           string    `json:"snapshot"`
+  CreationTimestamp  time.Time `json:"creationTimestamp"`
+  // Bytes stored for the snapshot: the blocks changed since the previous one
+  StorageBytes       int64     `json:"storageBytes"`
+  // Change of the bytes downloaded to restore the disk, 0 if unknown
+  DownloadBytesDelta int64     `json:"downloadBytesDelta"`
+  IntervalHours      float64   `json:"intervalHours"`
+  // StorageBytes by day of the interval
+  BytesPerDay        float64   `json:"bytesPerDay"`
+}
+
+// DiskChurn is the change rate of a disk, from the storage of its READY
+// snapshots.
+type DiskChurn struct {
+  Disk               string       `json:"disk"`
+  SourceDiskId       string       `json:"sourceDiskId,omitempty"`
+  DiskSizeGb         int64        `json:"diskSizeGb"`
+  Snapshots          int          `json:"snapshots"`
+  Oldest             time.Time    `json:"oldest"`
+  Newest             time.Time    `json:"newest"`
+  // Bytes stored for all the snapshots of the disk
+  StorageBytes       int64        `json:"storageBytes"`
+  // Bytes stored for the snapshots after the oldest one, by day between the
+  // oldest and the newest one, 0 with less than 2 snapshots
+  DailyGrowthBytes   float64      `json:"dailyGrowthBytes"`
+  // DailyGrowthBytes as a percentage of the size of the disk, 0 if unknown
+  DailyChangePercent float64      `json:"dailyChangePercent"`
+  // Oldest first
+  Deltas             []ChurnDelta `json:"deltas"`
+}
+
+// Churn groups the READY snapshots by source disk, and returns the change
+// rate of each disk, the fastest growing first.
+func Churn(snapshots []Snapshot) []DiskChurn {
+  byDisk := make(map[string][]Snapshot)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    if snapshot.Status != "READY" {
+      continue
+    }
+    // By id, a recreated disk with the same name is another disk
+    key := snapshot.SourceDiskId
+    if key == "" {
+      key = snapshot.SourceDisk
+    }
+    byDisk[key] = append(byDisk[key], snapshot)
+  }
+
+  churns := make([]DiskChurn, 0, len(byDisk))
+  for _, diskSnapshots := range byDisk {
+    churns = append(churns, diskChurn(diskSnapshots))
+  }
+  sort.SliceStable(churns, func(i int, j int) bool {
+    if churns[i].DailyGrowthBytes != churns[j].DailyGrowthBytes {
+      return churns[i].DailyGrowthBytes > churns[j].DailyGrowthBytes
+    }
+    if churns[i].Disk != churns[j].Disk {
+      return churns[i].Disk < churns[j].Disk
+    }
+    return churns[i].SourceDiskId < churns[j].SourceDiskId
+  })
+  return churns
+}
+
+// diskChurn returns the change rate of the disk of the snapshots.
+func diskChurn(snapshots []Snapshot) DiskChurn {
+  sort.SliceStable(snapshots, func(i int, j int) bool {
+    return snapshots[i].CreationTimestamp.Before(snapshots[j].CreationTimestamp)
+  })
+  oldest := snapshots[0]
+  newest := snapshots[len(snapshots) - 1]
+  churn := DiskChurn{Disk: newest.SourceDisk, SourceDiskId: newest.SourceDiskId, DiskSizeGb: newest.DiskSizeGb, Snapshots: len(snapshots), Oldest: oldest.CreationTimestamp, Newest: newest.CreationTimestamp, StorageBytes: oldest.StorageBytes, Deltas: make([]ChurnDelta, 0, len(snapshots) - 1)}
+  var grownBytes int64
+  for snapshotIndex := 1; snapshotIndex < len(snapshots); snapshotIndex++ {
+    previous := snapshots[snapshotIndex - 1]
+    snapshot := snapshots[snapshotIndex]
+    churn.StorageBytes += snapshot.StorageBytes
+    grownBytes += snapshot.StorageBytes
+    delta := ChurnDelta{Snapshot: snapshot.Name, CreationTimestamp: snapshot.CreationTimestamp, StorageBytes: snapshot.StorageBytes}
+    if previous.DownloadBytes > 0 && snapshot.DownloadBytes > 0 {
+      delta.DownloadBytesDelta = snapshot.DownloadBytes - previous.DownloadBytes
+    }
+    interval := snapshot.CreationTimestamp.Sub(previous.CreationTimestamp)
+    delta.IntervalHours = interval.Hours()
+    if interval > 0 {
+      delta.BytesPerDay = float64(snapshot.StorageBytes) / (interval.Hours() / 24)
+    }
+    churn.Deltas = append(churn.Deltas, delta)
+  }
+  days := churn.Newest.Sub(churn.Oldest).Hours() / 24
+  if days > 0 {
+    churn.DailyGrowthBytes = float64(grownBytes) / days
+  }
+  if churn.DiskSizeGb > 0 {
+    churn.DailyChangePercent = churn.DailyGrowthBytes * 100 / (float64(churn.DiskSizeGb) * 1e9)
+  }
+  return churn
+}
+
+// Sparkline draws the bytes by day of the most recent deltas, oldest first,
+// scaled to the highest one.
+func (churn DiskChurn) Sparkline() string {
+  deltas := churn.Deltas
+  if len(deltas) > sparklineLength {
+    deltas = deltas[len(deltas) - sparklineLength:]
+  }
+  highest := 0.0
+  for deltaIndex := 0; deltaIndex < len(deltas); deltaIndex++ {
+    if deltas[deltaIndex].BytesPerDay > highest {
+      highest = deltas[deltaIndex].BytesPerDay
+    }
+  }
+  var line strings.Builder
+  for deltaIndex := 0; deltaIndex < len(deltas); deltaIndex++ {
+    bar := 0
+    if highest > 0 {
+      bar = int(deltas[deltaIndex].BytesPerDay / highest * float64(len(sparklineBars) - 1) + 0.5)
+    }
+    line.WriteRune(sparklineBars[bar])
+  }
+  return line.String()
+}
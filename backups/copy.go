@@ -0,0 +1,338 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "strings"
+  "time"
+)
+
+const (
+  // Label of the copies, the name of the snapshot copied
+  CopyOfLabel = "copy-of"
+  // Label of the copies, the id of the disk of the snapshot copied: the source
+  // disk of a copy is a temporary disk
+  CopyDiskIdLabel = "copy-disk-id"
+)
+
+// SnapshotCopy is the copy of a snapshot created by the run, in the copy
+// location.
+type SnapshotCopy struct {
+  Disk     string `json:"disk"`
+  Snapshot string `json:"snapshot"`
+  Copy     string `json:"copy,omitempty"`
+  Location string `json:"location"`
+  // READY, FAILED, or SnapshotNotCopied for a snapshot which wasn't READY
+  Status   string `json:"status"`
+  Error    string `json:"error,omitempty"`
+}
+
+// Status of the snapshots not copied, as they aren't READY
+const SnapshotNotCopied = "NOT_COPIED"
+
+// copyName returns the name of the copy of a snapshot, and tempDiskName the
+// name of the temporary disk of the copy.
+func copyName(snapshot string) string {
+  return shortenName(sanitizeName(snapshot), maxSnapshotName - len("-copy")) + "-copy"
+}
+
+func tempDiskName(snapshot string) string {
+  return "copy-" + shortenName(sanitizeName(snapshot), maxSnapshotName - len("copy-"))
+}
+
+// copyZone returns the zone of the temporary disks of the copies, in the copy
+// location.
+func (runner *Runner) copyZone() string {
+  if runner.options.CopyZone != "" {
+    return runner.options.CopyZone
+  }
+  return runner.options.CopyLocation + "-b"
+}
+
+// copyRetention returns the retention of the copies of the disk, the one of
+// the disk without a copy limit.
+func (runner *Runner) copyRetention(disk Disk) Retention {
+  if runner.options.CopyLimit == 0 {
+    return runner.retention(disk)
+  }
+  return Retention{Mode: RetentionCount, Limit: runner.options.CopyLimit}
+}
+
+// copyLabels returns the labels of the copy of a snapshot: the labels of the
+// snapshot, without the ones of its own retention.
+func copyLabels(snapshot Snapshot, disk Disk) map[string]string {
+  labels := make(map[string]string)
+  for key, value := range snapshot.Labels {
+    if key == ExpiresLabel || key == PendingDeleteLabel {
+      continue
+    }
+    labels[key] = value
+  }
+  labels[CopyOfLabel] = sanitizeLabel(snapshot.Name)
+  labels[CopyDiskIdLabel] = disk.Id
+  return labels
+}
+
+// copySnapshot copies the snapshot to the copy location: Compute Engine can't
+// copy a snapshot, so a temporary disk is created from it in the copy zone and
+// snapshotted, then deleted. The copy is waited for to be READY before the
+// deletion.
+func (runner *Runner) copySnapshot(ctx context.Context, disk Disk, snapshot Snapshot) (Snapshot, error) {
+  logger := runner.logger
+  backend := runner.backend
+  dryRun := runner.options.DryRun
+  location := runner.options.CopyLocation
+
+  tempDisk := NewDisk{Name: tempDiskName(snapshot.Name), Zone: runner.copyZone(), Snapshot: snapshot.Name}
+  options := CreateOptions{NameTemplate: copyName(snapshot.Name), Description: snapshot.Description, Labels: copyLabels(snapshot, disk), StorageLocation: location, KmsKey: snapshot.KmsKey}
+  copied := Snapshot{Name: options.NameTemplate, StorageLocation: location}
+  if dryRun {
+    logger.Printf("[DRY-RUN] Would copy snapshot %s of disk %s to %s as %s, with the temporary disk %s in %s\n", snapshot.Name, disk.Name, location, copied.Name, tempDisk.Name, tempDisk.Zone)
+    return copied, nil
+  }
+
+  logger.Printf("Copying snapshot %s of disk %s to %s\n", snapshot.Name, disk.Name, location)
+  operationCtx, cancel := runner.operationContext(ctx)
+  err := runner.operationError(ctx, operationCtx, backend.CreateDiskFromSnapshot(operationCtx, tempDisk, false))
+  cancel()
+  if err != nil {
+    return copied, fmt.Errorf("Creation of the temporary disk %s in %s: %w", tempDisk.Name, tempDisk.Zone, err)
+  }
+  // Deleted even when the copy fails
+  defer func() {
+    operationCtx, cancel := runner.operationContext(context.WithoutCancel(ctx))
+    defer cancel()
+    deleteErr := backend.DeleteDisk(operationCtx, tempDisk.Name, tempDisk.Zone, false)
+    if deleteErr != nil {
+      runner.levels.Warning.Printf("WARNING: failed to delete the temporary disk %s in %s, delete it by hand: %s\n", tempDisk.Name, tempDisk.Zone, deleteErr)
+    }
+  }()
+
+  operationCtx, cancel = runner.operationContext(ctx)
+  created, err := backend.CreateSnapshotForDisk(operationCtx, Disk{Name: tempDisk.Name, Project: disk.Project, Zone: tempDisk.Zone}, options, false)
+  err = runner.operationError(ctx, operationCtx, err)
+  cancel()
+  if err != nil && !IsAlreadyExists(err) {
+    return copied, err
+  }
+  copied.CreationTimestamp = created.CreationTimestamp
+  copied.Labels = options.Labels
+  status, err := runner.waitForSnapshot(ctx, copied)
+  copied.Status = status
+  return copied, err
+}
+
+// copySnapshots copies the snapshots created READY by the run to the copy
+// location, with the concurrency of the snapshots. The snapshots not READY are
+// not copied. It returns the disks whose copy failed, which keep their old
+// copies.
+func (runner *Runner) copySnapshots(ctx context.Context, disks []Disk, result *Result) []bool {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+  location := runner.options.CopyLocation
+
+  logger.Printf("Copying the snapshots to %s...\n", location)
+  ready := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Ready); snapshotIndex++ {
+    ready[result.Ready[snapshotIndex].Name] = true
+  }
+  created := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Created); snapshotIndex++ {
+    created[result.Created[snapshotIndex].Name] = true
+  }
+
+  type copyResult struct {
+    diskIndex int
+    copy      Snapshot
+    err       error
+  }
+  copyFailed := make([]bool, len(disks))
+  copies := make(chan copyResult, len(disks))
+  copiesCount := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    // The created snapshot is the first one of the disk
+    if len(disk.Snapshots) == 0 || !created[disk.Snapshots[0].Name] {
+      continue
+    }
+    snapshot := disk.Snapshots[0]
+    if !dryRun && !ready[snapshot.Name] {
+      runner.levels.Warning.Printf("WARNING: not copying snapshot %s of disk %s, it's not READY\n", snapshot.Name, disk.Name)
+      result.Copies = append(result.Copies, SnapshotCopy{Disk: disk.Name, Snapshot: snapshot.Name, Location: location, Status: SnapshotNotCopied, Error: "Snapshot not READY"})
+      copyFailed[diskIndex] = true
+      continue
+    }
+    copiesCount++
+    go func(diskIndex int, disk Disk, snapshot Snapshot) {
+      if !runner.acquire(ctx) {
+        copies <- copyResult{diskIndex: diskIndex, err: runner.stopped(ctx)}
+        return
+      }
+      defer runner.release()
+      copied, err := runner.copySnapshot(ctx, disk, snapshot)
+      copies <- copyResult{diskIndex: diskIndex, copy: copied, err: err}
+    }(diskIndex, disk, snapshot)
+  }
+
+  copied := 0
+  for copyIndex := 0; copyIndex < copiesCount; copyIndex++ {
+    copyDone := <-copies
+    disk := disks[copyDone.diskIndex]
+    snapshotCopy := SnapshotCopy{Disk: disk.Name, Snapshot: disk.Snapshots[0].Name, Copy: copyDone.copy.Name, Location: location, Status: copyDone.copy.Status}
+    if copyDone.err != nil {
+      copyErr := fmt.Errorf("Copy to %s: %w", location, copyDone.err)
+      runner.levels.Warning.Printf("Failed to copy snapshot %s of disk %s: %s\n", snapshotCopy.Snapshot, disk.Name, copyErr)
+      result.Failures = append(result.Failures, Failure{Disk: disk.Name, Snapshot: snapshotCopy.Copy, Err: copyErr})
+      if snapshotCopy.Status == "" {
+        snapshotCopy.Status = SnapshotFailed
+      }
+      snapshotCopy.Error = copyDone.err.Error()
+      copyFailed[copyDone.diskIndex] = true
+    } else if !dryRun {
+      copied++
+      logger.Printf("Copied snapshot %s of disk %s to %s as %s, READY\n", snapshotCopy.Snapshot, disk.Name, location, snapshotCopy.Copy)
+    }
+    result.Copies = append(result.Copies, snapshotCopy)
+  }
+  if dryRun {
+    logger.Printf("[DRY-RUN] %d snapshots would be copied\n", copiesCount)
+  } else {
+    logger.Printf("Copied %d snapshots to %s\n", copied, location)
+  }
+  logger.Println("")
+  return copyFailed
+}
+
+// pruneCopies deletes the copies of the snapshots of the disks beyond their
+// copy retention, except for the blocked disks, as pruneSnapshots.
+func (runner *Runner) pruneCopies(ctx context.Context, disks []Disk, blocked []bool, result *Result) error {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+  location := runner.options.CopyLocation
+
+  logger.Printf("Deleting old copies in %s\n", location)
+  snapshots, err := runner.backend.ListSnapshots(ctx, "labels." + CreatedByLabel + " = " + CreatedByValue)
+  if err != nil {
+    return fmt.Errorf("Failed to list the copies: %w", err)
+  }
+  // Newest first, as listed
+  copiesByDisk := make(map[string][]Snapshot)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    diskId := snapshots[snapshotIndex].Labels[CopyDiskIdLabel]
+    if diskId != "" && snapshots[snapshotIndex].Labels[CopyOfLabel] != "" {
+      copiesByDisk[diskId] = append(copiesByDisk[diskId], snapshots[snapshotIndex])
+    }
+  }
+
+  now := time.Now()
+  candidates := make([][]Snapshot, len(disks))
+  candidatesCount := 0
+  candidateDisks := 0
+  total := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    copies := copiesByDisk[disks[diskIndex].Id]
+    total += len(copies)
+    unheld, _ := withoutHeld(copies, now)
+    if blocked[diskIndex] || len(unheld) == 0 {
+      continue
+    }
+    ready, _, failed := snapshotsByStatus(unheld)
+    toDelete, _ := runner.copyRetention(disks[diskIndex]).SnapshotsToDelete(ready, now)
+    if runner.options.CleanupFailed {
+      toDelete = append(toDelete, failed...)
+    }
+    candidates[diskIndex] = toDelete
+    candidatesCount += len(toDelete)
+    if len(toDelete) > 0 {
+      candidateDisks++
+    }
+  }
+
+  limitsErr := runner.options.DeletionLimits.Check(candidatesCount, total)
+  if limitsErr != nil && runner.options.Force {
+    runner.levels.Warning.Printf("WARNING: %s, deleting the copies anyway (forced)\n", limitsErr)
+  } else if limitsErr != nil {
+    runner.levels.Warning.Printf("WARNING: %s\n", limitsErr)
+    runner.levels.Warning.Printf("WARNING: the old copies are NOT deleted, check the copy limit or force the deletions\n")
+    logger.Println("")
+    return limitsErr
+  }
+
+  if runner.options.Confirm != nil && !dryRun && candidatesCount > 0 {
+    runner.levels.Warning.Printf("Copies to delete in %s:\n", location)
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      for snapshotIndex := 0; snapshotIndex < len(candidates[diskIndex]); snapshotIndex++ {
+        snapshot := candidates[diskIndex][snapshotIndex]
+        runner.levels.Warning.Printf("  - %s: %s, %s old\n", disks[diskIndex].Name, snapshot.Name, FormatAge(snapshot.CreationTimestamp, now))
+      }
+    }
+    if !runner.options.Confirm(candidatesCount, candidateDisks) {
+      logger.Println("Deletion of the old copies cancelled")
+      logger.Println("")
+      return nil
+    }
+  }
+
+  type deletedCopy struct {
+    disk     string
+    snapshot Snapshot
+    err      error
+  }
+  deletions := make(chan deletedCopy, candidatesCount)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    for snapshotIndex := 0; snapshotIndex < len(candidates[diskIndex]); snapshotIndex++ {
+      go func(deletion deletedCopy) {
+        if !runner.acquire(ctx) {
+          deletion.err = runner.stopped(ctx)
+          deletions <- deletion
+          return
+        }
+        defer runner.release()
+        operationCtx, cancel := runner.operationContext(ctx)
+        defer cancel()
+        _, deletion.err = runner.deleteSnapshot(ctx, operationCtx, Disk{Name: deletion.disk}, deletion.snapshot, dryRun)
+        deletions <- deletion
+      }(deletedCopy{disk: disks[diskIndex].Name, snapshot: candidates[diskIndex][snapshotIndex]})
+    }
+  }
+  for deletionIndex := 0; deletionIndex < candidatesCount; deletionIndex++ {
+    deletion := <-deletions
+    if deletion.err != nil {
+      runner.levels.Warning.Printf("Failed to delete copy %s of disk %s: %s\n", deletion.snapshot.Name, deletion.disk, deletion.err)
+      result.Failures = append(result.Failures, Failure{Disk: deletion.disk, Snapshot: deletion.snapshot.Name, Err: deletion.err})
+      continue
+    }
+    result.CopiesDeleted = append(result.CopiesDeleted, deletion.snapshot)
+    if dryRun {
+      logger.Printf("[DRY-RUN] Would delete copy %s of disk %s\n", deletion.snapshot.Name, deletion.disk)
+    } else {
+      logger.Printf("Deleted copy %s of disk %s\n", deletion.snapshot.Name, deletion.disk)
+    }
+  }
+  logger.Printf("Deleted %d old copies of %d\n", len(result.CopiesDeleted), total)
+  logger.Println("")
+  return nil
+}
+
+// copiesSummary returns the copies of a summary for the logs, like
+// "disk-1: disk-1-...-copy (READY)".
+func copiesSummary(copies []SnapshotCopy) []string {
+  lines := make([]string, 0, len(copies))
+  for copyIndex := 0; copyIndex < len(copies); copyIndex++ {
+    snapshotCopy := copies[copyIndex]
+    name := snapshotCopy.Copy
+    if name == "" {
+      name = snapshotCopy.Snapshot
+    }
+    status := strings.ToLower(snapshotCopy.Status)
+    if status == "" {
+      status = "dry run"
+    }
+    line := snapshotCopy.Disk + ": " + name + " (" + status + ")"
+    if snapshotCopy.Error != "" {
+      line += ": " + snapshotCopy.Error
+    }
+    lines = append(lines, line)
+  }
+  return lines
+}
@@ -0,0 +1,136 @@
+package backups
+
+import (
+  "fmt"
+)
+
+// Published price of the standard snapshots, in USD by GB and month
+const DefaultPricePerGbMonth = 0.05
+
+// Published price of the archive snapshots, in USD by GB and month
+const DefaultArchivePricePerGbMonth = 0.019
+
+// Prices are the prices of the snapshot storage by GB and month, by snapshot
+// type.
+type Prices struct {
+  Standard float64
+  // The standard price if 0
+  Archive  float64
+}
+
+// of returns the price of the storage of the snapshot.
+func (prices Prices) of(snapshot Snapshot) float64 {
+  if snapshot.SnapshotType == SnapshotArchive && prices.Archive > 0 {
+    return prices.Archive
+  }
+  return prices.Standard
+}
+
+// StorageCost is the storage of snapshots and its estimated monthly cost.
+type StorageCost struct {
+  Snapshots   int     `json:"snapshots"`
+  // Snapshots without storageBytes yet, e.g. still uploading, not counted
+  UnknownSize int     `json:"unknownSize,omitempty"`
+  StorageGb   float64 `json:"storageGb"`
+  MonthlyCost float64 `json:"monthlyCost"`
+}
+
+// CostReport is the storage of the snapshots of the disks of a run.
+type CostReport struct {
+  PricePerGbMonth float64                `json:"pricePerGbMonth"`
+  ArchivePricePerGbMonth float64         `json:"archivePricePerGbMonth,omitempty"`
+  // The snapshots listed before the run
+  Total           StorageCost            `json:"total"`
+  // The snapshots deleted by the run. Deleting a snapshot moves the data
+  // still needed to the next one, so the storage freed may be less
+  Freed           StorageCost            `json:"freed"`
+  // Label of the snapshots grouping their cost, by value, if any
+  Label           string                 `json:"label,omitempty"`
+  ByLabel         map[string]StorageCost `json:"byLabel,omitempty"`
+}
+
+// Prices returns the prices of the report.
+func (report CostReport) Prices() Prices {
+  return Prices{Standard: report.PricePerGbMonth, Archive: report.ArchivePricePerGbMonth}
+}
+
+// add counts the storage of the snapshot, at the price of its type.
+func (cost *StorageCost) add(snapshot Snapshot, prices Prices) {
+  cost.Snapshots++
+  if snapshot.StorageBytes <= 0 {
+    cost.UnknownSize++
+    return
+  }
+  gb := float64(snapshot.StorageBytes) / 1e9
+  cost.StorageGb += gb
+  cost.MonthlyCost += gb * prices.of(snapshot)
+}
+
+// merge adds the storage and the cost of other.
+func (cost *StorageCost) merge(other StorageCost) {
+  cost.Snapshots += other.Snapshots
+  cost.UnknownSize += other.UnknownSize
+  cost.StorageGb += other.StorageGb
+  cost.MonthlyCost += other.MonthlyCost
+}
+
+// SnapshotsCost returns the storage and the cost of the snapshots.
+func SnapshotsCost(snapshots []Snapshot, prices Prices) StorageCost {
+  var cost StorageCost
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    cost.add(snapshots[snapshotIndex], prices)
+  }
+  return cost
+}
+
+// snapshotsCostByLabel returns the storage and the cost of the snapshots by
+// value of the label.
+func snapshotsCostByLabel(snapshots []Snapshot, prices Prices, label string) map[string]StorageCost {
+  byLabel := make(map[string]StorageCost)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    labelCost := byLabel[snapshots[snapshotIndex].Labels[label]]
+    labelCost.add(snapshots[snapshotIndex], prices)
+    byLabel[snapshots[snapshotIndex].Labels[label]] = labelCost
+  }
+  return byLabel
+}
+
+// newCostReport sums the storage of the snapshots of the disks, by value of the
+// label if not empty, and of the deleted ones. The released disks count their
+// storage counted when released.
+func newCostReport(disks []Disk, released map[string]ReleasedSnapshots, deleted []Snapshot, prices Prices, label string) *CostReport {
+  report := &CostReport{PricePerGbMonth: prices.Standard, ArchivePricePerGbMonth: prices.Archive, Freed: SnapshotsCost(deleted, prices), Label: label}
+  if label != "" {
+    report.ByLabel = make(map[string]StorageCost)
+  }
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    counted, isReleased := released[disks[diskIndex].Id]
+    if isReleased {
+      report.Total.merge(counted.Storage)
+      for value, cost := range counted.ByLabel {
+        labelCost := report.ByLabel[value]
+        labelCost.merge(cost)
+        report.ByLabel[value] = labelCost
+      }
+      continue
+    }
+    for snapshotIndex := 0; snapshotIndex < len(disks[diskIndex].Snapshots); snapshotIndex++ {
+      snapshot := disks[diskIndex].Snapshots[snapshotIndex]
+      report.Total.add(snapshot, prices)
+      if label != "" {
+        labelCost := report.ByLabel[snapshot.Labels[label]]
+        labelCost.add(snapshot, prices)
+        report.ByLabel[snapshot.Labels[label]] = labelCost
+      }
+    }
+  }
+  return report
+}
+
+func (cost StorageCost) String() string {
+  text := fmt.Sprintf("~%.1f GB, ~$%.2f/month", cost.StorageGb, cost.MonthlyCost)
+  if cost.UnknownSize > 0 {
+    text += fmt.Sprintf(" (%d snapshot(s) of unknown size)", cost.UnknownSize)
+  }
+  return text
+}
@@ -0,0 +1,178 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "os"
+  "strings"
+
+  compute "cloud.google.com/go/compute/apiv1"
+  "golang.org/x/oauth2"
+  "golang.org/x/oauth2/google"
+  cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+  "google.golang.org/api/impersonate"
+  "google.golang.org/api/option"
+)
+
+// Permissions checked by the preflight, needed to create and delete the
+// snapshots
+var RequiredPermissions = []string{"compute.disks.createSnapshot", "compute.snapshots.create", "compute.snapshots.delete"}
+
+// Credentials selects the identity of the backends, the configured gcloud
+// account or the application default credentials if empty.
+type Credentials struct {
+  // Email of the service account impersonated, without a key, the identity
+  // needing roles/iam.serviceAccountTokenCreator on it
+  ImpersonateServiceAccount string
+  // Path of a service account key file, instead of the default identity
+  CredentialsFile           string
+  // Project billed for the quota of the API calls, the one of the disks if
+  // empty
+  BillingProject            string
+}
+
+// gcloudArgs returns the global flags of the gcloud commands.
+func (credentials Credentials) gcloudArgs() []string {
+  args := make([]string, 0)
+  if credentials.ImpersonateServiceAccount != "" {
+    args = append(args, "--impersonate-service-account", credentials.ImpersonateServiceAccount)
+  }
+  if credentials.BillingProject != "" {
+    args = append(args, "--billing-project", credentials.BillingProject)
+  }
+  return args
+}
+
+// GcloudEnv returns the environment of the gcloud commands, for ExecRunner:
+// gcloud has no flag for a key file, only a property.
+func (credentials Credentials) GcloudEnv() []string {
+  if credentials.CredentialsFile == "" {
+    return nil
+  }
+  return []string{"CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE=" + credentials.CredentialsFile}
+}
+
+// clientOptions returns the options of the API clients, with the token source
+// of the impersonated service account.
+func (credentials Credentials) clientOptions(ctx context.Context) ([]option.ClientOption, error) {
+  options := make([]option.ClientOption, 0)
+  if credentials.CredentialsFile != "" {
+    options = append(options, option.WithAuthCredentialsFile(option.ServiceAccount, credentials.CredentialsFile))
+  }
+  if credentials.ImpersonateServiceAccount != "" {
+    tokens, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{TargetPrincipal: credentials.ImpersonateServiceAccount, Scopes: compute.DefaultAuthScopes()}, options...)
+    if err != nil {
+      return nil, fmt.Errorf("Impersonation of %s: %w", credentials.ImpersonateServiceAccount, err)
+    }
+    options = []option.ClientOption{option.WithTokenSource(tokens)}
+  }
+  if credentials.BillingProject != "" {
+    options = append(options, option.WithQuotaProject(credentials.BillingProject))
+  }
+  return options, nil
+}
+
+// project returns the project of the key file, else of the default
+// credentials, empty if they have none.
+func (credentials Credentials) project(ctx context.Context) (string, error) {
+  if credentials.CredentialsFile == "" {
+    found, err := google.FindDefaultCredentials(ctx, compute.DefaultAuthScopes()...)
+    if err != nil {
+      return "", err
+    }
+    return found.ProjectID, nil
+  }
+  data, err := os.ReadFile(credentials.CredentialsFile)
+  if err != nil {
+    return "", err
+  }
+  found, err := google.CredentialsFromJSONWithType(ctx, data, google.ServiceAccount, compute.DefaultAuthScopes()...)
+  if err != nil {
+    return "", fmt.Errorf("Credentials file %s: %w", credentials.CredentialsFile, err)
+  }
+  return found.ProjectID, nil
+}
+
+// testPermissions returns the permissions among the ones given that the
+// identity of the client options has on the project, with the Resource
+// Manager API.
+func testPermissions(ctx context.Context, project string, permissions []string, options ...option.ClientOption) ([]string, error) {
+  service, err := cloudresourcemanager.NewService(ctx, options...)
+  if err != nil {
+    return nil, err
+  }
+  response, err := service.Projects.TestIamPermissions(project, &cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+  if err != nil {
+    return nil, err
+  }
+  return response.Permissions, nil
+}
+
+// permissionsCheck checks that the identity has the RequiredPermissions on
+// the project, with the client options.
+func permissionsCheck(ctx context.Context, project string, identity string, options ...option.ClientOption) CheckResult {
+  result := CheckResult{Name: "permissions", Status: CheckFail}
+  if project == "" {
+    result.Status = CheckWarn
+    result.Message = "no project to check"
+    return result
+  }
+  granted, err := testPermissions(ctx, project, RequiredPermissions, options...)
+  // Not a failure, the backups may still work
+  if err != nil {
+    result.Status = CheckWarn
+    result.Message = fmt.Sprintf("testIamPermissions on project %s failed for %s: %s", project, identity, err)
+    result.Hint = "check the credentials, and that the Cloud Resource Manager API is enabled"
+    return result
+  }
+  missing := make([]string, 0)
+  for permissionIndex := 0; permissionIndex < len(RequiredPermissions); permissionIndex++ {
+    if !contains(granted, RequiredPermissions[permissionIndex]) {
+      missing = append(missing, RequiredPermissions[permissionIndex])
+    }
+  }
+  if len(missing) > 0 {
+    result.Message = fmt.Sprintf("%s is missing %s on project %s", identity, strings.Join(missing, ", "), project)
+    result.Hint = "grant it roles/compute.storageAdmin, or a role with these permissions"
+    return result
+  }
+  result.Status = CheckPass
+  result.Message = fmt.Sprintf("%s can create and delete the snapshots of project %s", identity, project)
+  return result
+}
+
+// CheckPermissions checks that the identity of the API has the
+// RequiredPermissions on its project.
+func (api *API) CheckPermissions(ctx context.Context) CheckResult {
+  identity := "the application default credentials"
+  if api.credentials.CredentialsFile != "" {
+    identity = "the key of " + api.credentials.CredentialsFile
+  }
+  if api.credentials.ImpersonateServiceAccount != "" {
+    identity = api.credentials.ImpersonateServiceAccount
+  }
+  return permissionsCheck(ctx, api.project, identity, api.clientOptions...)
+}
+
+// checkPermissions checks that the account, or the impersonated service
+// account, has the RequiredPermissions on the project, with the access token
+// of gcloud.
+func (gcloud *Gcloud) checkPermissions(ctx context.Context, account string, project string) CheckResult {
+  if gcloud.credentials.ImpersonateServiceAccount != "" {
+    account = gcloud.credentials.ImpersonateServiceAccount
+  }
+  cmdTokenOut, err := gcloud.run(ctx, []string{"auth", "print-access-token"})
+  if err != nil {
+    result := CheckResult{Name: "permissions", Status: CheckFail, Message: fmt.Sprintf("No access token for %s: %s", account, err), Hint: "run `gcloud auth login`"}
+    if gcloud.credentials.ImpersonateServiceAccount != "" {
+      result.Hint = "grant roles/iam.serviceAccountTokenCreator on the service account to the gcloud account"
+    }
+    return result
+  }
+  tokens := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: strings.TrimSpace(string(cmdTokenOut))})
+  options := []option.ClientOption{option.WithTokenSource(tokens)}
+  if gcloud.credentials.BillingProject != "" {
+    options = append(options, option.WithQuotaProject(gcloud.credentials.BillingProject))
+  }
+  return permissionsCheck(ctx, project, account, options...)
+}
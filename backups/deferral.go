@@ -0,0 +1,44 @@
+package backups
+
+import (
+  "fmt"
+  "time"
+)
+
+// deferredDisks returns the disks not snapshotted by this run as MaxCreations
+// snapshots are created before them, in the order of the disks (see
+// orderDisks), adding them to the result. By default, the most stale disks get
+// the creations. The deferred disks are not pruned, and are snapshotted by a
+// next run.
+func (runner *Runner) deferredDisks(disks []Disk, notDue []bool, now time.Time, result *Result) []bool {
+  deferred := make([]bool, len(disks))
+  maxCreations := runner.options.MaxCreations
+  if maxCreations <= 0 {
+    return deferred
+  }
+
+  planned := make([]int, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if _, isResumed := runner.options.Resumed[disks[diskIndex].Id]; !isResumed && !notDue[diskIndex] {
+      planned = append(planned, diskIndex)
+    }
+  }
+  if len(planned) <= maxCreations {
+    return deferred
+  }
+  planned = runner.orderDisks(disks, planned)
+
+  runner.levels.Warning.Printf("WARNING: %d snapshot(s) to create, only the first %d disks (order: %s) are snapshotted (--max-creations)\n", len(planned), maxCreations, runner.order())
+  for plannedIndex := maxCreations; plannedIndex < len(planned); plannedIndex++ {
+    diskIndex := planned[plannedIndex]
+    deferred[diskIndex] = true
+    reason := fmt.Sprintf("over --max-creations %d, no snapshot yet", maxCreations)
+    newest, found := newestBackup(disks[diskIndex])
+    if found {
+      reason = fmt.Sprintf("over --max-creations %d, newest snapshot is %s old", maxCreations, FormatAge(newest.CreationTimestamp, now))
+    }
+    result.Deferred = append(result.Deferred, Skip{Disk: disks[diskIndex].Name, Reason: reason})
+    runner.logger.Printf("Deferring disk %s to a next run, neither snapshotted nor pruned: %s\n", disks[diskIndex].Name, reason)
+  }
+  return deferred
+}
@@ -0,0 +1,84 @@
+package backups
+
+import (
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Version of the program, set when building with
+// -ldflags "-X github.com/Mille-Volts/gcp-backups/backups.Version=v1.2.3"
+var Version = "dev"
+
+// DefaultDescriptionTemplate is the template of the snapshot descriptions,
+// telling where each snapshot comes from.
+const DefaultDescriptionTemplate = "Created by {tool} {version} (run {runId}) from disk {disk} ({zone}) attached to {instances}, retention {retention}"
+
+// Length limit of the GCE descriptions
+const maxDescription = 2048
+
+// Variables of the description templates, the ones of the names and the
+// provenance of the snapshots
+var descriptionVariables = append(append([]string{}, nameVariables...), "tool", "version", "runId", "instances", "retention")
+
+// Provenance is what the description tells about a snapshot, beside its disk.
+type Provenance struct {
+  RunID     string
+  // Retention of the snapshots of the disk
+  Retention Retention
+}
+
+// ValidateDescriptionTemplate checks the variables of the template.
+func ValidateDescriptionTemplate(template string) error {
+  _, err := parseTemplate(template, descriptionVariables, "description template")
+  return err
+}
+
+// TemplateSnapshotDescription generates the description of a new snapshot of
+// the disk with the template, DefaultDescriptionTemplate if empty, shortened
+// to the GCE limit. Unlike in the names, the disk name is kept as is.
+func TemplateSnapshotDescription(template string, disk Disk, provenance Provenance, now time.Time) (string, error) {
+  if template == "" {
+    template = DefaultDescriptionTemplate
+  }
+  segments, err := parseTemplate(template, descriptionVariables, "description template")
+  if err != nil {
+    return "", err
+  }
+
+  instances := strings.Join(disk.Users, ", ")
+  if instances == "" {
+    instances = "no instance"
+  }
+  values := map[string]string{
+    "disk": disk.Name,
+    "diskId": disk.Id,
+    "zone": disk.Location(),
+    "project": disk.Project,
+    "unix": strconv.FormatInt(now.Unix(), 10),
+    "random": randomSuffix(),
+    "tool": CreatedByValue,
+    "version": Version,
+    "runId": provenance.RunID,
+    "instances": instances,
+    "retention": provenance.Retention.String(),
+  }
+  parts := make([]string, 0, len(segments))
+  for segmentIndex := 0; segmentIndex < len(segments); segmentIndex++ {
+    segment := segments[segmentIndex]
+    switch segment.variable {
+    case "":
+      parts = append(parts, segment.literal)
+    case "date":
+      parts = append(parts, now.Format(segment.layout))
+    default:
+      parts = append(parts, values[segment.variable])
+    }
+  }
+  description := strings.Join(parts, "")
+  if len(description) > maxDescription {
+    // Without a partial UTF-8 character
+    description = strings.ToValidUTF8(description[:maxDescription], "")
+  }
+  return description, nil
+}
@@ -0,0 +1,82 @@
+package backups
+
+import (
+  "fmt"
+  "strings"
+)
+
+// diskTypeSupport is what the disks of a type support of the snapshot options.
+type diskTypeSupport struct {
+  GuestFlush bool
+  Instant    bool
+}
+
+// Known disk types by short name, the persistent disks and the hyperdisks,
+// which take the same snapshots. The types not listed, like a new one, are
+// assumed to support everything: the API tells otherwise.
+var diskTypes = map[string]diskTypeSupport{
+  "pd-standard": {GuestFlush: true, Instant: true},
+  "pd-balanced": {GuestFlush: true, Instant: true},
+  "pd-ssd": {GuestFlush: true, Instant: true},
+  "pd-extreme": {GuestFlush: true, Instant: true},
+  "hyperdisk-balanced": {GuestFlush: true, Instant: true},
+  "hyperdisk-balanced-high-availability": {GuestFlush: true, Instant: true},
+  "hyperdisk-extreme": {GuestFlush: true, Instant: true},
+  "hyperdisk-throughput": {GuestFlush: true, Instant: false},
+  // Read-only once attached to several instances
+  "hyperdisk-ml": {GuestFlush: false, Instant: false},
+}
+
+// Other names of the disk types, like the abbreviations of the documentation
+var diskTypeAliases = map[string]string{
+  "standard": "pd-standard",
+  "balanced": "pd-balanced",
+  "ssd": "pd-ssd",
+  "extreme": "pd-extreme",
+  "hdb": "hyperdisk-balanced",
+  "hdb-ha": "hyperdisk-balanced-high-availability",
+  "hdx": "hyperdisk-extreme",
+  "hdt": "hyperdisk-throughput",
+  "hdml": "hyperdisk-ml",
+}
+
+// NormalizeDiskType returns the short name of the disk type, in lower case,
+// from an alias or the URL of the type.
+func NormalizeDiskType(diskType string) string {
+  diskType = strings.ToLower(strings.TrimSpace(lastPathPart(diskType)))
+  alias, found := diskTypeAliases[diskType]
+  if found {
+    return alias
+  }
+  return diskType
+}
+
+// NormalizeDiskTypes normalizes the disk types, as NormalizeDiskType.
+func NormalizeDiskTypes(diskTypes []string) []string {
+  normalized := make([]string, 0, len(diskTypes))
+  for typeIndex := 0; typeIndex < len(diskTypes); typeIndex++ {
+    normalized = append(normalized, NormalizeDiskType(diskTypes[typeIndex]))
+  }
+  return normalized
+}
+
+// IsKnownDiskType tells if the disk type, normalized, is a known one.
+func IsKnownDiskType(diskType string) bool {
+  _, found := diskTypes[NormalizeDiskType(diskType)]
+  return found
+}
+
+// supportOf returns what the disk supports, everything if its type is unknown.
+func supportOf(disk Disk) diskTypeSupport {
+  support, found := diskTypes[NormalizeDiskType(disk.Type)]
+  if !found {
+    return diskTypeSupport{GuestFlush: true, Instant: true}
+  }
+  return support
+}
+
+// unsupportedError returns the error of an option of the snapshots not
+// supported by the type of the disk.
+func unsupportedError(disk Disk, option string) error {
+  return fmt.Errorf("%s not supported by disk %s of type %s", option, disk.Name, disk.Type)
+}
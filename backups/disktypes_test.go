@@ -0,0 +1,203 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "sort"
+  "strings"
+  "testing"
+)
+
+func TestNormalizeDiskType(t *testing.T) {
+  tests := []struct {
+    diskType string
+    expected string
+    known    bool
+  }{
+    {"hyperdisk-balanced", "hyperdisk-balanced", true},
+    {"HDB", "hyperdisk-balanced", true},
+    {" hdb-ha ", "hyperdisk-balanced-high-availability", true},
+    {"hdx", "hyperdisk-extreme", true},
+    {"Hyperdisk-Throughput", "hyperdisk-throughput", true},
+    {"https://www.googleapis.com/compute/v1/projects/proj/zones/europe-west1-b/diskTypes/hyperdisk-ml", "hyperdisk-ml", true},
+    {"balanced", "pd-balanced", true},
+    {"pd-ssd", "pd-ssd", true},
+    // Passed as is, supporting everything
+    {"hyperdisk-next", "hyperdisk-next", false},
+    {"", "", false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    normalized := NormalizeDiskType(test.diskType)
+    if normalized != test.expected {
+      t.Errorf("%s: got %s, expected %s", test.diskType, normalized, test.expected)
+    }
+    if IsKnownDiskType(test.diskType) != test.known {
+      t.Errorf("%s: got known %t, expected %t", test.diskType, !test.known, test.known)
+    }
+  }
+  if strings.Join(NormalizeDiskTypes([]string{"hdt", "SSD"}), ",") != "hyperdisk-throughput,pd-ssd" {
+    t.Errorf("Got the types %v", NormalizeDiskTypes([]string{"hdt", "SSD"}))
+  }
+}
+
+func TestSupportOf(t *testing.T) {
+  tests := []struct {
+    diskType   string
+    guestFlush bool
+    instant    bool
+  }{
+    {"pd-balanced", true, true},
+    {"hyperdisk-balanced", true, true},
+    {"hyperdisk-extreme", true, true},
+    {"hyperdisk-throughput", true, false},
+    {"hyperdisk-ml", false, false},
+    {"hyperdisk-next", true, true},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    support := supportOf(Disk{Name: "disk", Type: test.diskType})
+    if support.GuestFlush != test.guestFlush || support.Instant != test.instant {
+      t.Errorf("%s: got %+v", test.diskType, support)
+    }
+  }
+}
+
+// newHyperdiskRunner answers the commands of a run on the hyperdisks of
+// testdata/hyperdisks.json.
+func newHyperdiskRunner(t *testing.T) *fakeRunner {
+  fake := newFakeRunner(t)
+  fake.fixtures(t, "hyperdisks.json", "hyperdisk_snapshots.json")
+  return fake
+}
+
+// snapshottedDisks returns the names of the disks snapshotted, in order, with
+// the guest flush ones followed by a star.
+func snapshottedDisks(fake *fakeRunner) string {
+  commands := fake.ran("compute", "disks", "snapshot")
+  names := make([]string, 0, len(commands))
+  for commandIndex := 0; commandIndex < len(commands); commandIndex++ {
+    name := commands[commandIndex][4]
+    if contains(commands[commandIndex], "--guest-flush") {
+      name += "*"
+    }
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return strings.Join(names, ",")
+}
+
+func TestRunHyperdisks(t *testing.T) {
+  tests := []struct {
+    name        string
+    options     Options
+    snapshotted string
+    deleted     string
+  }{
+    {"all", Options{}, "hd-balanced,hd-ha,hd-ml,hd-throughput", "hd-balanced-1,hd-ha-1,hd-ml-1"},
+    {"selected by alias", Options{DiskTypes: NormalizeDiskTypes([]string{"HDB", "hdb-ha"})}, "hd-balanced,hd-ha", "hd-balanced-1,hd-ha-1"},
+    {"selected by URL", Options{DiskTypes: NormalizeDiskTypes([]string{"projects/proj/zones/europe-west1-b/diskTypes/hyperdisk-ml"})}, "hd-ml", "hd-ml-1"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newHyperdiskRunner(t)
+    runner, _ := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if snapshottedDisks(fake) != test.snapshotted {
+      t.Errorf("%s: got %s snapshotted, expected %s", test.name, snapshottedDisks(fake), test.snapshotted)
+    }
+    if sortedNames(result.Deleted) != test.deleted {
+      t.Errorf("%s: got %s deleted, expected %s", test.name, sortedNames(result.Deleted), test.deleted)
+    }
+    for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+      if !strings.HasPrefix(result.Disks[diskIndex].Type, "hyperdisk-") || !IsKnownDiskType(result.Disks[diskIndex].Type) {
+        t.Errorf("%s: got the type %s of disk %s", test.name, result.Disks[diskIndex].Type, result.Disks[diskIndex].Name)
+      }
+    }
+  }
+}
+
+func TestRunHyperdiskGuestFlush(t *testing.T) {
+  tests := []struct {
+    name        string
+    options     Options
+    snapshotted string
+    failed      string
+    deleted     string
+  }{
+    // Failed before calling GCE, keeping its old snapshots
+    {"unsupported", Options{GuestFlush: true}, "hd-balanced*,hd-ha*,hd-throughput*", "hd-ml", "hd-balanced-1,hd-ha-1"},
+    {"fallback", Options{GuestFlush: true, GuestFlushFallback: true}, "hd-balanced*,hd-ha*,hd-ml,hd-throughput*", "", "hd-balanced-1,hd-ha-1,hd-ml-1"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newHyperdiskRunner(t)
+    runner, logs := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if (err != nil) != (test.failed != "") || (err != nil && !errors.Is(err, ErrDisksFailed)) {
+      t.Fatalf("%s: got the error %v", test.name, err)
+    }
+    if snapshottedDisks(fake) != test.snapshotted {
+      t.Errorf("%s: got %s snapshotted, expected %s", test.name, snapshottedDisks(fake), test.snapshotted)
+    }
+    if strings.Join(result.FailedDisks(), ",") != test.failed {
+      t.Errorf("%s: got the failed disks %v, expected %s", test.name, result.FailedDisks(), test.failed)
+    }
+    if sortedNames(result.Deleted) != test.deleted {
+      t.Errorf("%s: got %s deleted, expected %s", test.name, sortedNames(result.Deleted), test.deleted)
+    }
+    unsupported := "Guest flush not supported by disk hd-ml of type hyperdisk-ml"
+    if test.failed != "" && !strings.HasPrefix(result.Failures[0].Err.Error(), unsupported) {
+      t.Errorf("%s: got the failure %v", test.name, result.Failures[0].Err)
+    }
+    if test.failed == "" && !containsLine(logs.String(), "WARNING: guest flush not supported by disk hd-ml of type hyperdisk-ml, creating a crash-consistent snapshot") {
+      t.Errorf("%s: fallback not logged in:\n%s", test.name, logs)
+    }
+  }
+}
+
+func TestRunHyperdiskInstantSnapshots(t *testing.T) {
+  fake := newHyperdiskRunner(t)
+  fake.answer("[]", "compute", "instant-snapshots", "list")
+  fake.answer("", "compute", "instant-snapshots", "create")
+  runner, logs := newTestRunner(fake, Options{InstantSnapshots: true, InstantLimit: 1})
+
+  result, err := runner.Run(context.Background())
+  // The instant snapshots have their own failures
+  if !errors.Is(err, ErrInstantSnapshotsFailed) {
+    t.Fatalf("Got the error %v, expected %v", err, ErrInstantSnapshotsFailed)
+  }
+  if len(result.Failures) != 0 {
+    t.Errorf("Got the failures %v", result.Failures)
+  }
+  created := fake.ran("compute", "instant-snapshots", "create")
+  names := make([]string, 0, len(created))
+  for commandIndex := 0; commandIndex < len(created); commandIndex++ {
+    names = append(names, argValue(created[commandIndex], "--source-disk"))
+  }
+  sort.Strings(names)
+  if strings.Join(names, ",") != "hd-balanced,hd-ha" {
+    t.Errorf("Got the instant snapshots of %v, expected hd-balanced,hd-ha", names)
+  }
+  failed := make([]string, 0, len(result.InstantFailures))
+  for failureIndex := 0; failureIndex < len(result.InstantFailures); failureIndex++ {
+    failure := result.InstantFailures[failureIndex]
+    if !strings.HasPrefix(failure.Err.Error(), "Instant snapshots not supported by disk " + failure.Disk) {
+      t.Errorf("Got the failure %v of disk %s", failure.Err, failure.Disk)
+    }
+    failed = append(failed, failure.Disk)
+  }
+  sort.Strings(failed)
+  if strings.Join(failed, ",") != "hd-ml,hd-throughput" {
+    t.Errorf("Got the instant failures of %v, expected hd-ml,hd-throughput", failed)
+  }
+  // The snapshots are still created
+  if snapshottedDisks(fake) != "hd-balanced,hd-ha,hd-ml,hd-throughput" || !strings.Contains(logs.String(), "Instant snapshot ") {
+    t.Errorf("Got %s snapshotted and the logs:\n%s", snapshottedDisks(fake), logs)
+  }
+}
@@ -0,0 +1,168 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// URL whose Date header gives the time of Google, to check the local clock
+const clockCheckURL = "https://compute.googleapis.com/"
+
+const (
+  // Skews of the local clock breaking the order of the names of the
+  // snapshots, and the authentication
+  clockWarnSkew = 30 * time.Second
+  clockFailSkew = 5 * time.Minute
+)
+
+// Percentage of the snapshot quota used from which the doctor warns
+const quotaWarnPercent = 90
+
+// CheckComputeAPI checks that the Compute Engine API is enabled and reachable
+// in the project of the backend, by reading its quotas.
+func CheckComputeAPI(ctx context.Context, backend Backend) CheckResult {
+  result := CheckResult{Name: "compute API", Status: CheckFail}
+  project, err := backend.Project(ctx)
+  if err != nil {
+    result.Message = err.Error()
+    result.Hint = "use --project, or set a project with `gcloud config set project <project>`"
+    return result
+  }
+  _, err = backend.GetQuotas(ctx)
+  if err != nil {
+    result.Message = fmt.Sprintf("project %s: %s", project, err)
+    if isServiceDisabled(err) {
+      result.Message = fmt.Sprintf("the Compute Engine API is not enabled in project %s", project)
+      result.Hint = "run `gcloud services enable compute.googleapis.com --project " + project + "`"
+    }
+    return result
+  }
+  result.Status = CheckPass
+  result.Message = fmt.Sprintf("enabled in project %s", project)
+  return result
+}
+
+// isServiceDisabled tells if the error is about an API not enabled in the
+// project.
+func isServiceDisabled(err error) bool {
+  message := err.Error()
+  var commandErr *CommandError
+  if errors.As(err, &commandErr) {
+    message = string(commandErr.Output)
+  }
+  return strings.Contains(message, "SERVICE_DISABLED") || strings.Contains(message, "accessNotConfigured") || strings.Contains(message, "has not been used in project")
+}
+
+// CheckQuota checks the headroom of the snapshot quota of the project of the
+// backend.
+func CheckQuota(ctx context.Context, backend Backend) CheckResult {
+  result := CheckResult{Name: "snapshot quota", Status: CheckWarn}
+  quotas, err := backend.GetQuotas(ctx)
+  if err != nil {
+    result.Message = "not read: " + err.Error()
+    return result
+  }
+  quota, found := findQuota(quotas, snapshotsQuotaMetric)
+  if !found {
+    result.Message = "no " + snapshotsQuotaMetric + " quota in the project"
+    return result
+  }
+  return quotaCheck(quota)
+}
+
+// quotaCheck returns the result of the check of the snapshot quota.
+func quotaCheck(quota Quota) CheckResult {
+  result := CheckResult{Name: "snapshot quota", Status: CheckPass, Message: fmt.Sprintf("%d of %d used", quota.Usage, quota.Limit)}
+  hint := "delete the snapshots no longer needed, or request a higher SNAPSHOTS quota in the console"
+  if quota.Usage >= quota.Limit {
+    result.Status = CheckFail
+    result.Message += ", no snapshot can be created"
+    result.Hint = hint
+  } else if quota.Usage * 100 >= quota.Limit * quotaWarnPercent {
+    result.Status = CheckWarn
+    result.Message += fmt.Sprintf(", only %d snapshot(s) left", quota.Limit - quota.Usage)
+    result.Hint = hint
+  }
+  return result
+}
+
+// CheckFilter checks that the filter matches at least one disk of the
+// project of the backend.
+func CheckFilter(ctx context.Context, backend Backend, filter string) CheckResult {
+  result := CheckResult{Name: "disks", Status: CheckFail}
+  disks, err := backend.GetDisksToSnapshot(ctx, filter)
+  if err != nil {
+    result.Message = err.Error()
+    return result
+  }
+  if len(disks) == 0 {
+    result.Message = fmt.Sprintf("no disk matches the filter '%s'", filter)
+    result.Hint = "check the --filter, e.g. with `gcloud compute disks list --filter '" + filter + "'`"
+    return result
+  }
+  result.Status = CheckPass
+  result.Message = fmt.Sprintf("%d disk(s) match the filter '%s'", len(disks), filter)
+  return result
+}
+
+// CheckClock checks that the local clock is close to the one of Google,
+// from the Date header of a request to the Compute Engine endpoint.
+func CheckClock(ctx context.Context) CheckResult {
+  return checkClock(ctx, clockCheckURL)
+}
+
+// checkClock checks the local clock against the Date header of the URL, a
+// test server in the tests.
+func checkClock(ctx context.Context, url string) CheckResult {
+  result := CheckResult{Name: "clock", Status: CheckWarn}
+  ctx, cancel := context.WithTimeout(ctx, 5 * time.Second)
+  defer cancel()
+  request, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+  if err != nil {
+    result.Message = err.Error()
+    return result
+  }
+  sent := time.Now()
+  response, err := http.DefaultClient.Do(request)
+  if err != nil {
+    result.Message = "not checked: " + err.Error()
+    return result
+  }
+  response.Body.Close()
+  server, err := http.ParseTime(response.Header.Get("Date"))
+  if err != nil {
+    result.Message = "not checked, no Date header: " + err.Error()
+    return result
+  }
+  // The Date header is rounded to the second, and sent during the request
+  local := sent.Add(time.Since(sent) / 2)
+  return clockSkewCheck(local, server)
+}
+
+// clockSkewCheck returns the result of the check of the local time against
+// the time of the server.
+func clockSkewCheck(local time.Time, server time.Time) CheckResult {
+  result := CheckResult{Name: "clock", Status: CheckPass}
+  skew := local.Sub(server)
+  direction := "ahead of"
+  if skew < 0 {
+    skew = -skew
+    direction = "behind"
+  }
+  result.Message = fmt.Sprintf("%s %s Google", skew.Round(time.Second), direction)
+  hint := "synchronize the clock with NTP, e.g. `timedatectl set-ntp true`"
+  if skew > clockFailSkew {
+    result.Status = CheckFail
+    result.Message += ", the credentials and the order of the snapshot names break"
+    result.Hint = hint
+  } else if skew > clockWarnSkew {
+    result.Status = CheckWarn
+    result.Message += ", the snapshot names may not sort by time"
+    result.Hint = hint
+  }
+  return result
+}
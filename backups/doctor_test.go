@@ -0,0 +1,151 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestCheckComputeAPI(t *testing.T) {
+  failure := errors.New("exit status 1")
+  tests := []struct {
+    name    string
+    project string
+    quotas  *fakeRule
+    status  string
+    message string
+    hint    string
+  }{
+    {"enabled", "proj", nil, CheckPass, "enabled in project proj", ""},
+    {"no project", "", nil, CheckFail, "Command error", "use --project"},
+    {"disabled", "proj", &fakeRule{parts: []string{"project-info", "describe"}, answer: func(args []string) ([]byte, error) {
+      return nil, &CommandError{Args: args, Err: failure, Output: []byte("ERROR: (gcloud.compute.project-info.describe) Compute Engine API has not been used in project proj before or it is disabled")}
+    }}, CheckFail, "the Compute Engine API is not enabled in project proj", "gcloud services enable compute.googleapis.com --project proj"},
+    {"other error", "proj", &fakeRule{parts: []string{"project-info", "describe"}, err: failure}, CheckFail, "project proj: Command error", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    if test.project == "" {
+      fake.fail(failure, "config", "get-value", "project")
+    }
+    if test.quotas != nil {
+      fake.add(test.quotas)
+    }
+    result := CheckComputeAPI(context.Background(), NewGcloud(fake))
+    if result.Status != test.status || !strings.HasPrefix(result.Message, test.message) || !strings.Contains(result.Hint, test.hint) || (test.hint == "") != (result.Hint == "") {
+      t.Errorf("%s: got %s", test.name, result)
+    }
+  }
+}
+
+func TestCheckQuota(t *testing.T) {
+  tests := []struct {
+    name    string
+    quotas  string
+    status  string
+    message string
+    hint    bool
+  }{
+    {"headroom", `{"quotas": [{"metric": "SNAPSHOTS", "limit": 1000, "usage": 4}]}`, CheckPass, "4 of 1000 used", false},
+    {"nearly full", `{"quotas": [{"metric": "SNAPSHOTS", "limit": 1000, "usage": 900}]}`, CheckWarn, "900 of 1000 used, only 100 snapshot(s) left", true},
+    {"full", `{"quotas": [{"metric": "SNAPSHOTS", "limit": 1000, "usage": 1000}]}`, CheckFail, "1000 of 1000 used, no snapshot can be created", true},
+    {"missing", `{"quotas": [{"metric": "DISKS_TOTAL_GB", "limit": 1000, "usage": 4}]}`, CheckWarn, "no SNAPSHOTS quota", false},
+    {"unreadable", "not json", CheckWarn, "not read: Invalid JSON output", false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.answer(test.quotas, "compute", "project-info", "describe")
+    result := CheckQuota(context.Background(), NewGcloud(fake))
+    if result.Status != test.status || !strings.HasPrefix(result.Message, test.message) {
+      t.Errorf("%s: got %s, expected %s %s", test.name, result, test.status, test.message)
+    }
+    if (result.Hint != "") != test.hint {
+      t.Errorf("%s: got the hint '%s'", test.name, result.Hint)
+    }
+  }
+}
+
+func TestCheckFilter(t *testing.T) {
+  tests := []struct {
+    name    string
+    output  string
+    err     error
+    status  string
+    message string
+  }{
+    {"matching", "", nil, CheckPass, "2 disk(s) match the filter 'labels.env = production'"},
+    {"none", "[]", nil, CheckFail, "no disk matches the filter 'labels.env = production'"},
+    {"error", "", errors.New("exit status 1"), CheckFail, "Command error"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    if test.output != "" {
+      fake.answer(test.output, "compute", "disks", "list", "--format json(")
+    }
+    if test.err != nil {
+      fake.fail(test.err, "compute", "disks", "list", "--format json(")
+    }
+    result := CheckFilter(context.Background(), NewGcloud(fake), "labels.env = production")
+    if result.Status != test.status || !strings.HasPrefix(result.Message, test.message) {
+      t.Errorf("%s: got %s, expected %s %s", test.name, result, test.status, test.message)
+    }
+  }
+}
+
+func TestClockSkewCheck(t *testing.T) {
+  server := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  tests := []struct {
+    skew    time.Duration
+    status  string
+    message string
+  }{
+    {2 * time.Second, CheckPass, "2s ahead of Google"},
+    {-clockWarnSkew, CheckPass, "30s behind Google"},
+    {-time.Minute, CheckWarn, "1m0s behind Google, the snapshot names may not sort by time"},
+    {10 * time.Minute, CheckFail, "10m0s ahead of Google, the credentials and the order of the snapshot names break"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    result := clockSkewCheck(server.Add(test.skew), server)
+    if result.Status != test.status || result.Message != test.message {
+      t.Errorf("Skew %s: got %s, expected %s %s", test.skew, result, test.status, test.message)
+    }
+  }
+}
+
+func TestCheckClock(t *testing.T) {
+  tests := []struct {
+    name   string
+    date   string
+    status string
+  }{
+    {"synchronized", "", CheckPass},
+    {"skewed", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), CheckFail},
+    {"no date", "none", CheckWarn},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+      switch test.date {
+      case "":
+      case "none":
+        // Not added by the server either
+        writer.Header()["Date"] = nil
+      default:
+        writer.Header().Set("Date", test.date)
+      }
+    }))
+    result := checkClock(context.Background(), server.URL)
+    server.Close()
+    if result.Status != test.status {
+      t.Errorf("%s: got %s, expected %s", test.name, result, test.status)
+    }
+  }
+}
@@ -0,0 +1,258 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "math/rand"
+  "sort"
+  "strings"
+  "time"
+
+  "go.opentelemetry.io/otel/attribute"
+)
+
+const (
+  // Restore the newest snapshots of a sample of disks, with Runner.Drill
+  ModeDrill = "drill"
+)
+
+// Label of the temporary disks of the drills, so the leftovers of a crashed
+// drill are found and deleted
+const DrillLabel = "gcp-backups-drill"
+
+const (
+  // Outcomes of the drill of a disk
+  DrillPassed = "passed"
+  DrillFailed = "failed"
+  // The drill of a dry run, nothing restored
+  DrillPlanned = "planned"
+)
+
+// Age from which the temporary disks of the drills are leftovers, not the
+// ones of a drill in progress
+const drillLeftoverAge = time.Hour
+
+// ErrDrillFailed is returned by Drill when a snapshot couldn't be restored.
+var ErrDrillFailed = errors.New("Restore drill failed")
+
+// DrillResult is the outcome of the restore of the newest snapshot of a disk.
+type DrillResult struct {
+  Disk     string `json:"disk"`
+  Snapshot string `json:"snapshot,omitempty"`
+  // Temporary disk restored from the snapshot, in the scratch zone
+  TempDisk string `json:"tempDisk,omitempty"`
+  Zone     string `json:"zone"`
+  // Size of the restored disk, if READY
+  SizeGb   int64  `json:"sizeGb,omitempty"`
+  // DrillPassed, DrillFailed or DrillPlanned
+  Status   string `json:"status"`
+  Error    string `json:"error,omitempty"`
+  DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// drillDiskName returns the name of the temporary disk of the drill of a
+// snapshot.
+func drillDiskName(snapshot string) string {
+  return "drill-" + shortenName(sanitizeName(snapshot), maxSnapshotName - len("drill-"))
+}
+
+// Drill lists the disks like Run, and restores the newest READY snapshot of a
+// sample of them, Options.DrillSample chosen at random or all the
+// Options.Disks, one after the other: a temporary disk is created from
+// the snapshot in Options.DrillZone, checked to be READY with the size of the
+// snapshot, then deleted. The leftovers of the crashed drills are deleted
+// first. The disks whose restore failed are failures of the result.
+func (runner *Runner) Drill(ctx context.Context) (result Result, err error) {
+  ctx, endSpan := runner.startRunSpan(ctx, "drill")
+  endEvents := runner.startRunEvents(ModeDrill)
+  defer func() {
+    endSpan(result, err)
+    endEvents(result, err)
+  }()
+  runner.cleanupDrills(ctx, &result)
+  leftovers := result.DrillLeftovers
+  result, err = runner.List(ctx)
+  result.Mode = ModeDrill
+  result.DryRun = runner.options.DryRun
+  result.DrillLeftovers = leftovers
+  result.Failures = make([]Failure, 0)
+  if err != nil {
+    return result, err
+  }
+
+  disks := runner.drillSample(result.Disks)
+  runner.logger.Printf("Restoring the newest snapshot of %d disk(s) in %s...\n", len(disks), runner.options.DrillZone)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if ctx.Err() != nil {
+      break
+    }
+    drill, drillErr := runner.drillDisk(ctx, disks[diskIndex])
+    result.Drills = append(result.Drills, drill)
+    if drillErr != nil {
+      runner.logger.Printf("Drill of disk %s failed: %s\n", drill.Disk, drillErr)
+      result.Failures = append(result.Failures, Failure{Disk: drill.Disk, Snapshot: drill.Snapshot, Err: drillErr})
+    } else if drill.Status == DrillPassed {
+      runner.logger.Printf("Drill of disk %s passed: snapshot %s restored, %d GB, in %s\n", drill.Disk, drill.Snapshot, drill.SizeGb, seconds(drill.DurationSeconds))
+    }
+  }
+
+  failedDisks := result.FailedDisks()
+  if ctx.Err() != nil {
+    return result, ctx.Err()
+  }
+  if len(failedDisks) > 0 {
+    return result, fmt.Errorf("%w for %d disk(s): %s", ErrDrillFailed, len(failedDisks), strings.Join(failedDisks, ", "))
+  }
+  return result, nil
+}
+
+// drillSample returns the disks to drill, by name: all the selected disks
+// with Options.Disks, else Options.DrillSample of them at random.
+func (runner *Runner) drillSample(disks []Disk) []Disk {
+  candidates := append([]Disk(nil), disks...)
+  if len(runner.options.Disks) > 0 {
+    return candidates
+  }
+  rand.Shuffle(len(candidates), func(i int, j int) {
+    candidates[i], candidates[j] = candidates[j], candidates[i]
+  })
+  if len(candidates) > runner.options.DrillSample {
+    candidates = candidates[:runner.options.DrillSample]
+  }
+  sort.SliceStable(candidates, func(i int, j int) bool {
+    return candidates[i].Name < candidates[j].Name
+  })
+  return candidates
+}
+
+// drillDisk restores the newest READY snapshot of the disk created by this
+// program as a temporary disk, checks it and deletes it.
+func (runner *Runner) drillDisk(ctx context.Context, disk Disk) (drill DrillResult, err error) {
+  started := time.Now()
+  ctx, span := StartSpan(ctx, "drill disk", diskAttributes(disk)...)
+  drill = DrillResult{Disk: disk.Name, Zone: runner.options.DrillZone, Status: DrillFailed}
+  defer func() {
+    drill.DurationSeconds = time.Since(started).Seconds()
+    if err != nil {
+      drill.Error = err.Error()
+    }
+    span.SetAttributes(attribute.String("snapshot.name", drill.Snapshot), attribute.String("drill.status", drill.Status))
+    EndSpan(span, err)
+  }()
+
+  diskCompliance := compliance(disk, 0, started)
+  if diskCompliance.Status == ComplianceMissing {
+    return drill, errors.New("No READY snapshot created by " + CreatedByValue)
+  }
+  var snapshot Snapshot
+  for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+    if disk.Snapshots[snapshotIndex].Name == diskCompliance.Snapshot {
+      snapshot = disk.Snapshots[snapshotIndex]
+    }
+  }
+  drill.Snapshot = snapshot.Name
+  expectedSizeGb := snapshot.DiskSizeGb
+  if expectedSizeGb == 0 {
+    expectedSizeGb = disk.SizeGb
+  }
+
+  labels := map[string]string{DrillLabel: "true", CreatedByLabel: CreatedByValue, SourceDiskLabel: sanitizeLabel(disk.Name)}
+  if runner.options.RunID != "" {
+    labels[RunIDLabel] = sanitizeLabel(runner.options.RunID)
+  }
+  tempDisk := NewDisk{Name: drillDiskName(snapshot.Name), Zone: runner.options.DrillZone, Snapshot: snapshot.Name, Labels: labels}
+  drill.TempDisk = tempDisk.Name
+  if runner.options.DryRun {
+    runner.logger.Printf("[DRY-RUN] Would restore snapshot %s of disk %s as the temporary disk %s in %s, then delete it\n", snapshot.Name, disk.Name, tempDisk.Name, tempDisk.Zone)
+    drill.Status = DrillPlanned
+    return drill, nil
+  }
+
+  runner.levels.Info.Printf("Restoring snapshot %s of disk %s as %s in %s\n", snapshot.Name, disk.Name, tempDisk.Name, tempDisk.Zone)
+  operationCtx, cancel := runner.operationContext(ctx)
+  err = runner.operationError(ctx, operationCtx, runner.backend.CreateDiskFromSnapshot(operationCtx, tempDisk, false))
+  cancel()
+  // Deleted even when the creation failed, it may still have been created
+  defer func() {
+    operationCtx, cancel := runner.operationContext(context.WithoutCancel(ctx))
+    defer cancel()
+    deleteErr := runner.backend.DeleteDisk(operationCtx, tempDisk.Name, tempDisk.Zone, false)
+    if deleteErr != nil && !IsNotFound(deleteErr) {
+      runner.levels.Warning.Printf("WARNING: failed to delete the temporary disk %s in %s, deleted by the next drill: %s\n", tempDisk.Name, tempDisk.Zone, deleteErr)
+    }
+  }()
+  if err != nil {
+    return drill, fmt.Errorf("Creation of the temporary disk %s in %s: %w", tempDisk.Name, tempDisk.Zone, err)
+  }
+
+  restored, err := runner.waitForDisk(ctx, tempDisk)
+  if err != nil {
+    return drill, err
+  }
+  drill.SizeGb = restored.SizeGb
+  if expectedSizeGb > 0 && restored.SizeGb != expectedSizeGb {
+    return drill, fmt.Errorf("Disk %s restored from snapshot %s is %d GB, expected %d GB", tempDisk.Name, snapshot.Name, restored.SizeGb, expectedSizeGb)
+  }
+  drill.Status = DrillPassed
+  return drill, nil
+}
+
+// waitForDisk waits for the new disk to be READY, within the WaitTimeout.
+func (runner *Runner) waitForDisk(ctx context.Context, newDisk NewDisk) (Disk, error) {
+  if runner.options.WaitTimeout > 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, runner.options.WaitTimeout)
+    defer cancel()
+  }
+
+  for {
+    disk, err := runner.backend.GetDisk(ctx, newDisk.Name, newDisk.Zone)
+    if err != nil {
+      return disk, err
+    }
+    if disk.Status == "READY" {
+      return disk, nil
+    }
+    if disk.Status == "FAILED" {
+      return disk, errors.New("Disk " + newDisk.Name + " restored from snapshot " + newDisk.Snapshot + " is FAILED")
+    }
+    select {
+    case <-ctx.Done():
+      return disk, fmt.Errorf("Disk %s is still %s: %w", newDisk.Name, disk.Status, ctx.Err())
+    case <-time.After(waitInterval):
+    }
+  }
+}
+
+// cleanupDrills deletes the temporary disks of the crashed drills of the
+// project, older than drillLeftoverAge, adding them to the result. A failing
+// listing or deletion is only a warning.
+func (runner *Runner) cleanupDrills(ctx context.Context, result *Result) {
+  disks, err := runner.backend.GetDisksToSnapshot(ctx, "labels." + DrillLabel + " = true")
+  if err != nil {
+    runner.levels.Warning.Printf("WARNING: failed to list the leftover disks of the drills, not deleted: %s\n", err)
+    return
+  }
+  now := time.Now()
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    if disk.Zone == "" || (!disk.CreationTimestamp.IsZero() && now.Sub(disk.CreationTimestamp) < drillLeftoverAge) {
+      continue
+    }
+    if runner.options.DryRun {
+      runner.logger.Printf("[DRY-RUN] Would delete the leftover disk %s of a drill in %s\n", disk.Name, disk.Zone)
+      result.DrillLeftovers = append(result.DrillLeftovers, disk.Name)
+      continue
+    }
+    runner.logger.Printf("Deleting the leftover disk %s of a drill in %s\n", disk.Name, disk.Zone)
+    operationCtx, cancel := runner.operationContext(ctx)
+    deleteErr := runner.operationError(ctx, operationCtx, runner.backend.DeleteDisk(operationCtx, disk.Name, disk.Zone, false))
+    cancel()
+    if deleteErr != nil {
+      runner.levels.Warning.Printf("WARNING: failed to delete the leftover disk %s of a drill in %s: %s\n", disk.Name, disk.Zone, deleteErr)
+      continue
+    }
+    result.DrillLeftovers = append(result.DrillLeftovers, disk.Name)
+  }
+}
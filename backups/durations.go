@@ -0,0 +1,72 @@
+package backups
+
+import (
+  "sort"
+  "time"
+)
+
+const (
+  // Kinds of the timed operations
+  OperationCreate = "create"
+  OperationDelete = "delete"
+)
+
+// Number of the slowest operations logged at the end of a run
+const slowestCount = 5
+
+// Operation is a creation or a deletion of a snapshot of a disk by the run,
+// with its duration.
+type Operation struct {
+  // OperationCreate or OperationDelete
+  Kind          string
+  Disk          string
+  Snapshot      string
+  // Wall time of the gcloud command or API call
+  Duration      time.Duration
+  // From the end of the creation to READY, with Wait
+  ReadyDuration time.Duration
+  Failed        bool
+}
+
+// SummaryOperation is an Operation of the summary.
+type SummaryOperation struct {
+  Kind            string  `json:"kind"`
+  Disk            string  `json:"disk"`
+  Snapshot        string  `json:"snapshot"`
+  DurationSeconds float64 `json:"durationSeconds"`
+  // From the end of the creation to READY, with --wait
+  ReadySeconds    float64 `json:"readySeconds,omitempty"`
+  Failed          bool    `json:"failed,omitempty"`
+}
+
+// Seconds returns the duration of the operation, with the wait for READY.
+func (operation SummaryOperation) Seconds() float64 {
+  return operation.DurationSeconds + operation.ReadySeconds
+}
+
+// summaryOperations returns the operations for the summary.
+func summaryOperations(operations []Operation) []SummaryOperation {
+  summarized := make([]SummaryOperation, 0, len(operations))
+  for operationIndex := 0; operationIndex < len(operations); operationIndex++ {
+    operation := operations[operationIndex]
+    summarized = append(summarized, SummaryOperation{Kind: operation.Kind, Disk: operation.Disk, Snapshot: operation.Snapshot, DurationSeconds: operation.Duration.Seconds(), ReadySeconds: operation.ReadyDuration.Seconds(), Failed: operation.Failed})
+  }
+  return summarized
+}
+
+// slowestOperations returns the count slowest operations, slowest first.
+func slowestOperations(operations []SummaryOperation, count int) []SummaryOperation {
+  slowest := append([]SummaryOperation(nil), operations...)
+  sort.SliceStable(slowest, func(i int, j int) bool {
+    return slowest[i].Seconds() > slowest[j].Seconds()
+  })
+  if len(slowest) > count {
+    slowest = slowest[:count]
+  }
+  return slowest
+}
+
+// seconds returns the seconds as a duration, for the logs.
+func seconds(value float64) time.Duration {
+  return time.Duration(value * float64(time.Second)).Round(100 * time.Millisecond)
+}
@@ -0,0 +1,245 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "crypto/rand"
+  "crypto/tls"
+  "encoding/hex"
+  "fmt"
+  "html"
+  "mime"
+  "net"
+  "net/smtp"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+const (
+  // Connect in clear text, then upgrade to TLS (usually on port 587)
+  SMTPStartTLS = "starttls"
+  // Connect with TLS (usually on port 465)
+  SMTPTLS = "tls"
+  // No encryption, e.g. for a local relay
+  SMTPNone = "none"
+)
+
+// EmailNotifier sends the summary by email, as a table of the disks.
+type EmailNotifier struct {
+  Host     string
+  Port     int
+  // SMTPStartTLS (the default if empty), SMTPTLS or SMTPNone
+  TLS      string
+  // Authenticated with PLAIN if set
+  Username string
+  Password string
+  From     string
+  To       []string
+}
+
+func (notifier EmailNotifier) Notify(ctx context.Context, summary Summary) error {
+  subject := summaryTitle(summary)
+  if summary.ExitCode != ExitOK {
+    subject = "[FAILED] " + subject
+  }
+  message, err := emailMessage(notifier.From, notifier.To, subject, emailText(summary), emailHTML(summary))
+  if err != nil {
+    return err
+  }
+  return notifier.send(ctx, message)
+}
+
+// send sends the message, bounded by the deadline of the context.
+func (notifier EmailNotifier) send(ctx context.Context, message []byte) error {
+  address := net.JoinHostPort(notifier.Host, strconv.Itoa(notifier.Port))
+  tlsConfig := &tls.Config{ServerName: notifier.Host}
+  var dialer net.Dialer
+  conn, err := dialer.DialContext(ctx, "tcp", address)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  deadline, hasDeadline := ctx.Deadline()
+  if hasDeadline {
+    conn.SetDeadline(deadline)
+  }
+  if notifier.TLS == SMTPTLS {
+    conn = tls.Client(conn, tlsConfig)
+  }
+
+  client, err := smtp.NewClient(conn, notifier.Host)
+  if err != nil {
+    return err
+  }
+  defer client.Close()
+  if notifier.TLS == "" || notifier.TLS == SMTPStartTLS {
+    err = client.StartTLS(tlsConfig)
+    if err != nil {
+      return err
+    }
+  }
+  if notifier.Username != "" {
+    err = client.Auth(smtp.PlainAuth("", notifier.Username, notifier.Password, notifier.Host))
+    if err != nil {
+      return err
+    }
+  }
+  err = client.Mail(notifier.From)
+  if err != nil {
+    return err
+  }
+  for toIndex := 0; toIndex < len(notifier.To); toIndex++ {
+    err = client.Rcpt(notifier.To[toIndex])
+    if err != nil {
+      return err
+    }
+  }
+  writer, err := client.Data()
+  if err != nil {
+    return err
+  }
+  _, err = writer.Write(message)
+  if err != nil {
+    return err
+  }
+  err = writer.Close()
+  if err != nil {
+    return err
+  }
+  return client.Quit()
+}
+
+// emailMessage returns the message with its plain text and HTML bodies.
+func emailMessage(from string, to []string, subject string, text string, htmlBody string) ([]byte, error) {
+  randomBytes := make([]byte, 12)
+  _, err := rand.Read(randomBytes)
+  if err != nil {
+    return nil, err
+  }
+  boundary := "gcp-backups-" + hex.EncodeToString(randomBytes)
+
+  var message bytes.Buffer
+  fmt.Fprintf(&message, "From: %s\r\n", from)
+  fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+  fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+  fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+  fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+  fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+  fmt.Fprintf(&message, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, strings.ReplaceAll(text, "\n", "\r\n"))
+  fmt.Fprintf(&message, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", boundary, strings.ReplaceAll(htmlBody, "\n", "\r\n"))
+  fmt.Fprintf(&message, "--%s--\r\n", boundary)
+  return message.Bytes(), nil
+}
+
+// emailText returns the plain text body of the summary.
+func emailText(summary Summary) string {
+  var text bytes.Buffer
+  fmt.Fprintf(&text, "%s\n\n", summaryTitle(summary))
+  fmt.Fprintf(&text, "Filter: %s\nRun: %s\n%s\nDuration: %s\n\n", summary.Filter, summary.RunID, summaryCounts(summary), time.Duration(summary.DurationSeconds * float64(time.Second)).Round(time.Second))
+
+  writer := tabwriter.NewWriter(&text, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(writer, "DISK\tCREATED\tDELETED\tSTATUS")
+  for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+    disk := summary.Disks[diskIndex]
+    fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", disk.Name, emptyDash(disk.Created), emptyDash(strings.Join(disk.Deleted, ", ")), diskStatus(disk))
+  }
+  writer.Flush()
+
+  if len(summary.Failures) > 0 {
+    fmt.Fprintf(&text, "\nFailures:\n")
+    for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+      failure := summary.Failures[failureIndex]
+      fmt.Fprintf(&text, "- %s: %s\n", failure.Disk, failure.Error)
+    }
+  }
+  if len(summary.Violations) > 0 {
+    fmt.Fprintf(&text, "\nDisks neither backed up nor labeled %s=false:\n", BackupLabel)
+    for violationIndex := 0; violationIndex < len(summary.Violations); violationIndex++ {
+      fmt.Fprintf(&text, "- %s\n", summary.Violations[violationIndex])
+    }
+  }
+  if summary.Error != "" && len(summary.Failures) == 0 {
+    fmt.Fprintf(&text, "\nError: %s\n", summary.Error)
+  }
+  return text.String()
+}
+
+// emailHTML returns the HTML body of the summary.
+func emailHTML(summary Summary) string {
+  var body bytes.Buffer
+  fmt.Fprintf(&body, "<html><body>\n<h2>%s</h2>\n", html.EscapeString(summaryTitle(summary)))
+  fmt.Fprintf(&body, "<p>Filter: <code>%s</code><br>\nRun: <code>%s</code><br>\n%s<br>\nDuration: %s</p>\n", html.EscapeString(summary.Filter), html.EscapeString(summary.RunID), html.EscapeString(summaryCounts(summary)), time.Duration(summary.DurationSeconds * float64(time.Second)).Round(time.Second))
+
+  fmt.Fprintf(&body, "<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\">\n<tr><th>Disk</th><th>Created</th><th>Deleted</th><th>Status</th></tr>\n")
+  for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+    disk := summary.Disks[diskIndex]
+    color := "#2e7d32"
+    if disk.Failed {
+      color = "#c62828"
+    }
+    fmt.Fprintf(&body, "<tr><td>%s</td><td>%s</td><td>%s</td><td style=\"color: %s\">%s</td></tr>\n", html.EscapeString(disk.Name), html.EscapeString(emptyDash(disk.Created)), html.EscapeString(emptyDash(strings.Join(disk.Deleted, ", "))), color, diskStatus(disk))
+  }
+  fmt.Fprintf(&body, "</table>\n")
+
+  if len(summary.Failures) > 0 {
+    fmt.Fprintf(&body, "<h3>Failures</h3>\n<ul>\n")
+    for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+      failure := summary.Failures[failureIndex]
+      fmt.Fprintf(&body, "<li><b>%s</b>: %s</li>\n", html.EscapeString(failure.Disk), html.EscapeString(failure.Error))
+    }
+    fmt.Fprintf(&body, "</ul>\n")
+  }
+  if len(summary.Violations) > 0 {
+    fmt.Fprintf(&body, "<h3>Disks neither backed up nor labeled %s=false</h3>\n<ul>\n", BackupLabel)
+    for violationIndex := 0; violationIndex < len(summary.Violations); violationIndex++ {
+      fmt.Fprintf(&body, "<li>%s</li>\n", html.EscapeString(summary.Violations[violationIndex].String()))
+    }
+    fmt.Fprintf(&body, "</ul>\n")
+  }
+  if summary.Error != "" && len(summary.Failures) == 0 {
+    fmt.Fprintf(&body, "<p>Error: %s</p>\n", html.EscapeString(summary.Error))
+  }
+  fmt.Fprintf(&body, "</body></html>\n")
+  return body.String()
+}
+
+func diskStatus(disk DiskSummary) string {
+  if disk.Failed {
+    return "FAILED"
+  }
+  return "OK"
+}
+
+func emptyDash(value string) string {
+  if value == "" {
+    return "-"
+  }
+  return value
+}
+
+// SampleSummary returns the summary of a fake run, to test the notifications.
+func SampleSummary(project string) Summary {
+  now := time.Now()
+  return Summary{
+    Mode: ModeFull,
+    RunID: NewRunID(now),
+    Project: project,
+    Filter: "labels.env = production",
+    DryRun: true,
+    StartedAt: now,
+    DurationSeconds: 42,
+    DisksScanned: 2,
+    SnapshotsCreated: 1,
+    SnapshotsDeleted: 1,
+    Disks: []DiskSummary{
+      {Name: "sample-disk-1", Project: project, Zone: "europe-west1-b", Created: "sample-disk-1-" + now.Format("20060102150405"), Deleted: []string{"sample-disk-1-old"}},
+      {Name: "sample-disk-2", Project: project, Zone: "europe-west1-b", Deleted: make([]string, 0), Failed: true},
+    },
+    FailedDisks: []string{"sample-disk-2"},
+    Failures: []SummaryFailure{{Disk: "sample-disk-2", Error: "Sample failure"}},
+    Skipped: make([]Skip, 0),
+    ExitCode: ExitPartialFailure,
+  }
+}
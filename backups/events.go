@@ -0,0 +1,161 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "io"
+  "log"
+  "sync"
+  "time"
+
+  "go.opentelemetry.io/otel/attribute"
+)
+
+const (
+  // Types of the progress events, in the order of a run
+  EventRunStarted = "run-started"
+  EventDiskDiscovered = "disk-discovered"
+  EventCreateStarted = "create-started"
+  EventCreateFinished = "create-finished"
+  EventDeleteStarted = "delete-started"
+  EventDeleteFinished = "delete-finished"
+  EventRunFinished = "run-finished"
+)
+
+const (
+  // Outcomes of the finished events
+  OutcomeSucceeded = "succeeded"
+  OutcomeFailed = "failed"
+)
+
+// Event is a step of a run, as it happens, for the live progress. See
+// docs/progress-event.schema.json.
+type Event struct {
+  Time       time.Time    `json:"time"`
+  Type       string       `json:"type"`
+  RunID      string       `json:"runId"`
+  Plan       string       `json:"plan,omitempty"`
+  Project    string       `json:"project,omitempty"`
+  // Of the run events
+  Mode       string       `json:"mode,omitempty"`
+  DryRun     bool         `json:"dryRun,omitempty"`
+  // Of the disk events
+  Disk       string       `json:"disk,omitempty"`
+  Zone       string       `json:"zone,omitempty"`
+  Snapshot   string       `json:"snapshot,omitempty"`
+  // Of the finished events
+  Outcome    string       `json:"outcome,omitempty"`
+  DurationMs int64        `json:"durationMs,omitempty"`
+  Error      string       `json:"error,omitempty"`
+  Counts     *EventCounts `json:"counts,omitempty"`
+}
+
+// EventCounts are the counts of a finished run.
+type EventCounts struct {
+  Disks    int `json:"disks"`
+  Created  int `json:"created"`
+  Deleted  int `json:"deleted"`
+  Failures int `json:"failures"`
+}
+
+// emit sends the event of the run, if asked.
+func (runner *Runner) emit(event Event) {
+  if runner.options.Events == nil {
+    return
+  }
+  event.Time = time.Now()
+  event.RunID = runner.options.RunID
+  runner.options.Events(event)
+}
+
+// diskEvent returns the event of the disk, finished with the error if
+// started is not zero.
+func diskEvent(eventType string, disk Disk, snapshot string, started time.Time, err error) Event {
+  event := Event{Type: eventType, Disk: disk.Name, Zone: disk.Location(), Snapshot: snapshot}
+  if started.IsZero() {
+    return event
+  }
+  event.DurationMs = time.Since(started).Milliseconds()
+  event.Outcome = OutcomeSucceeded
+  if err != nil {
+    event.Outcome = OutcomeFailed
+    event.Error = err.Error()
+  }
+  return event
+}
+
+// deleteSnapshot deletes the snapshot of the disk within the operation
+// context, emitting the start and the end of the deletion. It returns the
+// duration of the deletion.
+func (runner *Runner) deleteSnapshot(ctx context.Context, operationCtx context.Context, disk Disk, snapshot Snapshot, dryRun bool) (time.Duration, error) {
+  operationCtx, span := StartSpan(operationCtx, "delete snapshot", append(diskAttributes(disk), attribute.String("snapshot.name", snapshot.Name))...)
+  started := time.Now()
+  runner.emit(diskEvent(EventDeleteStarted, disk, snapshot.Name, time.Time{}, nil))
+  err := runner.operationError(ctx, operationCtx, runner.backend.DeleteSnapshot(operationCtx, snapshot, dryRun))
+  if err != nil && IsNotFound(err) {
+    // Re-run or retried deletion which succeeded
+    runner.levels.Warning.Printf("WARNING: snapshot %s of disk %s already deleted: %s\n", snapshot.Name, disk.Name, err)
+    err = nil
+  }
+  duration := time.Since(started)
+  runner.emit(diskEvent(EventDeleteFinished, disk, snapshot.Name, started, err))
+  span.SetAttributes(attribute.Float64("snapshot.delete_seconds", duration.Seconds()))
+  EndSpan(span, err)
+  return duration, err
+}
+
+// startRunEvents emits the start of the run, and returns the function
+// emitting its end.
+func (runner *Runner) startRunEvents(mode string) func(Result, error) {
+  started := time.Now()
+  if mode == "" {
+    mode = ModeFull
+  }
+  runner.emit(Event{Type: EventRunStarted, Mode: mode, DryRun: runner.options.DryRun})
+  return func(result Result, err error) {
+    event := Event{Type: EventRunFinished, Project: result.Project, Mode: result.Mode, DryRun: result.DryRun, Outcome: OutcomeSucceeded, DurationMs: time.Since(started).Milliseconds()}
+    event.Counts = &EventCounts{Disks: len(result.Disks), Created: len(result.Created), Deleted: len(result.Deleted), Failures: len(result.Failures)}
+    if err != nil {
+      event.Error = err.Error()
+    }
+    if err != nil || len(result.Failures) > 0 {
+      event.Outcome = OutcomeFailed
+    }
+    runner.emit(event)
+  }
+}
+
+// EventStream writes the events as newline-delimited JSON, one write by
+// event so a reader gets each one as it happens.
+type EventStream struct {
+  writer io.Writer
+  logger *log.Logger
+  mutex  sync.Mutex
+  failed bool
+}
+
+// NewEventStream writes the events to the writer, like a pipe or a file.
+func NewEventStream(writer io.Writer, logger *log.Logger) *EventStream {
+  if logger == nil {
+    logger = log.Default()
+  }
+  return &EventStream{writer: writer, logger: logger}
+}
+
+// Emit writes the event. A failing write only logs a warning, and stops the
+// stream, e.g. once its reader is gone.
+func (stream *EventStream) Emit(event Event) {
+  stream.mutex.Lock()
+  defer stream.mutex.Unlock()
+  if stream.failed {
+    return
+  }
+  line, err := json.Marshal(event)
+  if err == nil {
+    _, err = stream.writer.Write(append(line, '\n'))
+  }
+  if err != nil {
+    stream.failed = true
+    stream.logger.Printf("WARNING: failed to write the progress events, no more are written: %s\n", err)
+  }
+}
@@ -0,0 +1,124 @@
+package backups
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "log"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// eventRecorder records the events of a run.
+type eventRecorder struct {
+  mutex  sync.Mutex
+  events []Event
+}
+
+func (recorder *eventRecorder) emit(event Event) {
+  recorder.mutex.Lock()
+  defer recorder.mutex.Unlock()
+  recorder.events = append(recorder.events, event)
+}
+
+// of returns the types of the events of the disk, in order.
+func (recorder *eventRecorder) of(disk string) string {
+  types := make([]string, 0)
+  for eventIndex := 0; eventIndex < len(recorder.events); eventIndex++ {
+    if recorder.events[eventIndex].Disk == disk {
+      types = append(types, recorder.events[eventIndex].Type)
+    }
+  }
+  return strings.Join(types, ",")
+}
+
+func TestRunEvents(t *testing.T) {
+  tests := []struct {
+    name     string
+    err      error
+    dbData   string
+    outcome  string
+    failures int
+  }{
+    {"succeeded", nil, "disk-discovered,create-started,create-finished,delete-started,delete-finished,delete-started,delete-finished", OutcomeSucceeded, 0},
+    // The old snapshots are kept
+    {"failed", errors.New("exit status 1"), "disk-discovered,create-started,create-finished", OutcomeFailed, 1},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    if test.err != nil {
+      fake.fail(test.err, "disks", "snapshot", "db-data")
+    }
+    recorder := &eventRecorder{}
+    // An operation at a time, so the deletions of a disk don't interleave
+    runner, _ := newTestRunner(fake, Options{RunID: "run-1", Events: recorder.emit, Concurrency: 1})
+
+    runner.Run(context.Background())
+    events := recorder.events
+    if len(events) < 2 || events[0].Type != EventRunStarted || events[0].Mode != ModeFull {
+      t.Fatalf("%s: got the events %+v, expected the start of the run first", test.name, events)
+    }
+    if recorder.of("db-data") != test.dbData {
+      t.Errorf("%s: got the events %s for db-data, expected %s", test.name, recorder.of("db-data"), test.dbData)
+    }
+    for eventIndex := 0; eventIndex < len(events); eventIndex++ {
+      event := events[eventIndex]
+      if event.RunID != "run-1" || event.Time.IsZero() {
+        t.Errorf("%s: got the event %+v", test.name, event)
+      }
+      if event.Type == EventCreateFinished && event.Disk == "db-data" && (event.Outcome != test.outcome || (test.err != nil) != (event.Error != "")) {
+        t.Errorf("%s: got the creation %+v", test.name, event)
+      }
+    }
+    finished := events[len(events) - 1]
+    if finished.Type != EventRunFinished || finished.Outcome != test.outcome || finished.Counts == nil || finished.Counts.Disks != 2 || finished.Counts.Failures != test.failures {
+      t.Errorf("%s: got the end of the run %+v, expected %s", test.name, finished, test.outcome)
+    }
+  }
+}
+
+// failingWriter fails all the writes.
+type failingWriter struct {
+  writes int
+}
+
+func (writer *failingWriter) Write(data []byte) (int, error) {
+  writer.writes++
+  return 0, errors.New("broken pipe")
+}
+
+func TestEventStream(t *testing.T) {
+  var output bytes.Buffer
+  stream := NewEventStream(&output, discardLogger())
+  stream.Emit(Event{Type: EventRunStarted, RunID: "run-1"})
+  stream.Emit(Event{Type: EventCreateStarted, RunID: "run-1", Disk: "db-data"})
+
+  // A line by event
+  scanner := bufio.NewScanner(&output)
+  types := make([]string, 0)
+  for scanner.Scan() {
+    var event Event
+    err := json.Unmarshal(scanner.Bytes(), &event)
+    if err != nil {
+      t.Fatalf("Invalid line %s: %s", scanner.Text(), err)
+    }
+    types = append(types, event.Type)
+  }
+  if strings.Join(types, ",") != "run-started,create-started" {
+    t.Errorf("Got the events %v", types)
+  }
+
+  // Stopped at the first failure
+  writer := &failingWriter{}
+  var logs bytes.Buffer
+  failing := NewEventStream(writer, log.New(&logs, "", 0))
+  failing.Emit(Event{Type: EventRunStarted})
+  failing.Emit(Event{Type: EventRunFinished})
+  if writer.writes != 1 || strings.Count(logs.String(), "WARNING") != 1 {
+    t.Errorf("Got %d writes and the logs %s", writer.writes, logs.String())
+  }
+}
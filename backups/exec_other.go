@@ -0,0 +1,12 @@
+//go:build !unix
+
+package backups
+
+import (
+  "os/exec"
+)
+
+// killProcessGroup only kills the command when the context is done, there are
+// no process groups.
+func killProcessGroup(cmd *exec.Cmd) {
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package backups
+
+import (
+  "os/exec"
+  "syscall"
+)
+
+// killProcessGroup starts the command in its own process group, killed with
+// its children when the context is done.
+func killProcessGroup(cmd *exec.Cmd) {
+  cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+  cmd.Cancel = func() error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+  }
+}
@@ -0,0 +1,71 @@
+//go:build unix
+
+package backups
+
+import (
+  "bytes"
+  "context"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// fakeGcloud writes a gcloud script running the shell commands, and returns
+// its path.
+func fakeGcloud(t *testing.T, script string) string {
+  t.Helper()
+  path := filepath.Join(t.TempDir(), "gcloud")
+  err := os.WriteFile(path, []byte("#!/bin/sh\n" + script + "\n"), 0700)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+func TestExecRunnerSeparatesStderr(t *testing.T) {
+  path := fakeGcloud(t, `echo "WARNING: Some requests did not succeed." >&2
+echo '[{"name": "db-data-1", "sourceDiskId": "1", "creationTimestamp": "2026-10-14T02:00:00Z"}]'`)
+  tests := []struct {
+    name   string
+    stream bool
+  }{
+    {"run", false},
+    {"stream", true},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    var stderr bytes.Buffer
+    var commands CommandRunner = ExecRunner{Stderr: &stderr}
+    if !test.stream {
+      commands = runOnly{commands}
+    }
+    // The warning isn't part of the JSON
+    snapshots, err := NewGcloud(commands).WithPath(path).ListSnapshots(context.Background(), "")
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if snapshotNames(snapshots) != "db-data-1" {
+      t.Errorf("%s: got %s", test.name, snapshotNames(snapshots))
+    }
+    if !strings.Contains(stderr.String(), "WARNING: Some requests did not succeed.") {
+      t.Errorf("%s: got the standard error %q", test.name, stderr.String())
+    }
+  }
+}
+
+func TestExecRunnerErrorOutput(t *testing.T) {
+  path := fakeGcloud(t, `echo '[{"name": "db-data-1"},'
+echo "ERROR: (gcloud.beta.compute.snapshots.list) Some requests did not succeed" >&2
+exit 1`)
+  _, err := NewGcloud(ExecRunner{}).WithPath(path).ListSnapshots(context.Background(), "")
+  // The failed command is reported, not the truncated JSON
+  if err == nil || !strings.Contains(err.Error(), "Command error: `beta compute snapshots list") || !strings.Contains(err.Error(), "ERROR: (gcloud.beta.compute.snapshots.list)") {
+    t.Errorf("Got the error %v", err)
+  }
+}
+
+// runOnly hides the Stream method of the runner.
+type runOnly struct {
+  CommandRunner
+}
@@ -0,0 +1,457 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// fakeRunner is a CommandRunner answering the gcloud commands from rules,
+// recording the commands run. The rules added last win, so a test overrides
+// the default answers of newFakeRunner.
+type fakeRunner struct {
+  mutex    sync.Mutex
+  rules    []*fakeRule
+  // Arguments of the commands run, without the command
+  commands [][]string
+}
+
+// fakeRule answers the commands containing all its parts.
+type fakeRule struct {
+  parts  []string
+  output string
+  err    error
+  // Before answering, unless the context is done first
+  delay  time.Duration
+  // Closed before answering, unless the context is done first, if not nil
+  wait   <-chan struct{}
+  // Answers instead of output and err, if not nil
+  answer func(args []string) ([]byte, error)
+}
+
+// newFakeRunner answers the commands of a run on the disks and snapshots of
+// testdata/disks.json and testdata/snapshots.json, in project proj.
+func newFakeRunner(t testing.TB) *fakeRunner {
+  fake := &fakeRunner{}
+  fake.fixtures(t, "disks.json", "snapshots.json")
+  fake.answer("proj\n", "config", "get-value", "project")
+  fake.answer(`{"quotas": [{"metric": "SNAPSHOTS", "limit": 1000, "usage": 4}]}`, "compute", "project-info", "describe")
+  fake.answer("[]", "compute", "images", "list")
+  fake.answer("[]", "compute", "disks", "list", "sourceSnapshotId:*")
+  fake.answer("", "compute", "disks", "snapshot")
+  fake.answer("", "compute", "snapshots", "create")
+  fake.answer("", "compute", "snapshots", "delete")
+  fake.answer("", "compute", "snapshots", "add-labels")
+  fake.answer("", "compute", "snapshots", "remove-labels")
+  fake.answer("", "compute", "disks", "add-labels")
+  fake.answer(`{"status": "READY"}`, "compute", "snapshots", "describe")
+  return fake
+}
+
+// fixtures answers the listings of the disks and snapshots with the files of
+// testdata, the snapshots filtered as by gcloud.
+func (fake *fakeRunner) fixtures(t testing.TB, disksFile string, snapshotsFile string) {
+  fake.answer(readTestdata(t, disksFile), "compute", "disks", "list", "--format json(")
+  snapshots := readTestdata(t, snapshotsFile)
+  fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list"}, answer: func(args []string) ([]byte, error) {
+    return filterSnapshotsJSON(snapshots, argValue(args, "--filter"))
+  }})
+}
+
+// listing answers the listings of the snapshots with the snapshots, filtered
+// as by gcloud, instead of the ones of the fixture.
+func (fake *fakeRunner) listing(snapshots []Snapshot) {
+  listed := snapshotsJSON(snapshots)
+  fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list"}, answer: func(args []string) ([]byte, error) {
+    return filterSnapshotsJSON(listed, argValue(args, "--filter"))
+  }})
+}
+
+// afterCreations answers the snapshot creations, and returns a channel closed
+// once count of them were run.
+func (fake *fakeRunner) afterCreations(count int) <-chan struct{} {
+  created := make(chan struct{})
+  var once sync.Once
+  fake.add(&fakeRule{parts: []string{"compute", "disks", "snapshot"}, answer: func(args []string) ([]byte, error) {
+    if len(fake.ran("compute", "disks", "snapshot")) >= count {
+      once.Do(func() {
+        close(created)
+      })
+    }
+    return []byte(""), nil
+  }})
+  return created
+}
+
+// add adds the rule, over the previous ones.
+func (fake *fakeRunner) add(rule *fakeRule) *fakeRule {
+  fake.mutex.Lock()
+  defer fake.mutex.Unlock()
+  fake.rules = append(fake.rules, rule)
+  return rule
+}
+
+// answer answers the output to the commands containing the parts.
+func (fake *fakeRunner) answer(output string, parts ...string) *fakeRule {
+  return fake.add(&fakeRule{parts: parts, output: output})
+}
+
+// fail fails the commands containing the parts with the error.
+func (fake *fakeRunner) fail(err error, parts ...string) *fakeRule {
+  return fake.add(&fakeRule{parts: parts, err: err})
+}
+
+func (fake *fakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+  fake.mutex.Lock()
+  fake.commands = append(fake.commands, append([]string(nil), args...))
+  var rule *fakeRule
+  command := strings.Join(args, " ")
+  for ruleIndex := len(fake.rules) - 1; ruleIndex >= 0 && rule == nil; ruleIndex-- {
+    if containsAll(command, fake.rules[ruleIndex].parts) {
+      rule = fake.rules[ruleIndex]
+    }
+  }
+  fake.mutex.Unlock()
+
+  if rule == nil {
+    return nil, &CommandError{Args: args, Err: errors.New("exit status 1"), Output: []byte("ERROR: no fake answer")}
+  }
+  if rule.delay > 0 {
+    select {
+    case <-time.After(rule.delay):
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    }
+  }
+  if rule.wait != nil {
+    select {
+    case <-rule.wait:
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    }
+  }
+  if rule.answer != nil {
+    return rule.answer(args)
+  }
+  if rule.err != nil {
+    return nil, &CommandError{Args: args, Err: rule.err}
+  }
+  return []byte(rule.output), nil
+}
+
+// ran returns the commands run containing all the parts, in order.
+func (fake *fakeRunner) ran(parts ...string) [][]string {
+  fake.mutex.Lock()
+  defer fake.mutex.Unlock()
+  matching := make([][]string, 0)
+  for commandIndex := 0; commandIndex < len(fake.commands); commandIndex++ {
+    if containsAll(strings.Join(fake.commands[commandIndex], " "), parts) {
+      matching = append(matching, fake.commands[commandIndex])
+    }
+  }
+  return matching
+}
+
+func containsAll(command string, parts []string) bool {
+  for partIndex := 0; partIndex < len(parts); partIndex++ {
+    if !strings.Contains(command, parts[partIndex]) {
+      return false
+    }
+  }
+  return true
+}
+
+// argValue returns the value of the flag in the arguments, empty if missing.
+func argValue(args []string, flag string) string {
+  for argIndex := 0; argIndex < len(args) - 1; argIndex++ {
+    if args[argIndex] == flag {
+      return args[argIndex + 1]
+    }
+  }
+  return ""
+}
+
+// filterSnapshotsJSON keeps the snapshots of the JSON array matching the
+// filter, a conjunction of terms like `sourceDiskId = 1`, `sourceDiskId =
+// (1 2)` or `labels.key = value`, the subset of the gcloud filters used here.
+func filterSnapshotsJSON(snapshots string, filter string) ([]byte, error) {
+  var items []map[string]interface{}
+  err := json.Unmarshal([]byte(snapshots), &items)
+  if err != nil || filter == "" {
+    return []byte(snapshots), nil
+  }
+  terms := strings.Split(filter, " AND ")
+  kept := make([]map[string]interface{}, 0)
+  for itemIndex := 0; itemIndex < len(items); itemIndex++ {
+    matches := true
+    for termIndex := 0; termIndex < len(terms) && matches; termIndex++ {
+      key, value, found := strings.Cut(terms[termIndex], "=")
+      if !found {
+        return nil, fmt.Errorf("Unsupported fake filter '%s'", filter)
+      }
+      key = strings.TrimSpace(key)
+      values := strings.Fields(strings.Trim(strings.TrimSpace(value), "()"))
+      actual := fmt.Sprint(items[itemIndex][key])
+      if label, isLabel := strings.CutPrefix(key, "labels."); isLabel {
+        labels, _ := items[itemIndex]["labels"].(map[string]interface{})
+        actual = fmt.Sprint(labels[label])
+      }
+      matches = contains(values, actual)
+    }
+    if matches {
+      kept = append(kept, items[itemIndex])
+    }
+  }
+  return json.Marshal(kept)
+}
+
+// readTestdata returns the content of the file of testdata.
+func readTestdata(t testing.TB, name string) string {
+  t.Helper()
+  content, err := os.ReadFile(filepath.Join("testdata", name))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return string(content)
+}
+
+// snapshotsJSON returns the snapshots as output by gcloud, for the fake
+// listings of generated snapshots.
+func snapshotsJSON(snapshots []Snapshot) string {
+  items := make([]map[string]interface{}, 0, len(snapshots))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    item := map[string]interface{}{
+      "name": snapshot.Name,
+      "id": snapshot.Id,
+      "sourceDiskId": snapshot.SourceDiskId,
+      "labels": snapshot.Labels,
+    }
+    if !snapshot.CreationTimestamp.IsZero() {
+      item["creationTimestamp"] = snapshot.CreationTimestamp.Format(time.RFC3339)
+    }
+    if snapshot.Status != "" {
+      item["status"] = snapshot.Status
+    }
+    if snapshot.SourceDisk != "" {
+      item["sourceDisk"] = "https://www.googleapis.com/compute/v1/projects/proj/zones/europe-west1-b/disks/" + snapshot.SourceDisk
+    }
+    items = append(items, item)
+  }
+  output, _ := json.Marshal(items)
+  return string(output)
+}
+
+// disksJSON returns the zonal disks as output by gcloud, for the fake listings
+// of generated disks.
+func disksJSON(disks []Disk) string {
+  items := make([]map[string]interface{}, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    zone := "https://www.googleapis.com/compute/v1/projects/proj/zones/" + disk.Zone
+    items = append(items, map[string]interface{}{
+      "name": disk.Name,
+      "id": disk.Id,
+      "selfLink": zone + "/disks/" + disk.Name,
+      "zone": zone,
+      "sizeGb": "10",
+      "status": "READY",
+      "type": zone + "/diskTypes/pd-balanced",
+    })
+  }
+  output, _ := json.Marshal(items)
+  return string(output)
+}
+
+// newTestRunner returns a runner of the fake gcloud commands in project proj,
+// its logs in the buffer returned.
+func newTestRunner(fake *fakeRunner, options Options) (*Runner, *bytes.Buffer) {
+  logs := &bytes.Buffer{}
+  options.Commands = fake
+  if options.Project == "" {
+    options.Project = "proj"
+  }
+  if options.Logger == nil {
+    options.Logger = log.New(logs, "", 0)
+  }
+  if options.Limit == 0 && options.RetentionMode == "" {
+    options.Limit = 2
+    options.RetentionMode = RetentionCount
+  }
+  return NewRunner(options), logs
+}
+
+// discardLogger is a logger for the tests which don't check the logs.
+func discardLogger() *log.Logger {
+  return log.New(io.Discard, "", 0)
+}
+
+// testSnapshot returns a READY snapshot of the disk created by this program,
+// created at the time.
+func testSnapshot(name string, diskId string, createdAt time.Time) Snapshot {
+  return Snapshot{Name: name, Id: name + "-id", SourceDiskId: diskId, CreationTimestamp: createdAt, Status: SnapshotReady, Labels: map[string]string{CreatedByLabel: CreatedByValue}}
+}
+
+// snapshotNames returns the names of the snapshots, to compare them.
+func snapshotNames(snapshots []Snapshot) string {
+  names := make([]string, 0, len(snapshots))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    names = append(names, snapshots[snapshotIndex].Name)
+  }
+  return strings.Join(names, ",")
+}
+
+// sortedNames returns the names of the snapshots in order, to compare the
+// snapshots handled concurrently.
+func sortedNames(snapshots []Snapshot) string {
+  names := strings.Split(snapshotNames(snapshots), ",")
+  sort.Strings(names)
+  return strings.Join(names, ",")
+}
+
+// containsLine tells if a line of the logs starts with the text.
+func containsLine(logs string, text string) bool {
+  lines := strings.Split(logs, "\n")
+  for lineIndex := 0; lineIndex < len(lines); lineIndex++ {
+    if strings.HasPrefix(lines[lineIndex], text) {
+      return true
+    }
+  }
+  return false
+}
+
+// streamingRunner is a fakeRunner streaming the outputs, like ExecRunner.
+type streamingRunner struct {
+  *fakeRunner
+}
+
+func (runner streamingRunner) Stream(ctx context.Context, read func(io.Reader) error, name string, args ...string) error {
+  output, err := runner.Run(ctx, name, args...)
+  if err != nil {
+    return err
+  }
+  return read(bytes.NewReader(output))
+}
+
+// generatedFleet returns disks with snapshots a day apart each, the newest
+// created at now, and all their snapshots, for the benchmarks of the large
+// projects.
+func generatedFleet(disks int, snapshotsPerDisk int, now time.Time) ([]Disk, []Snapshot) {
+  fleet := make([]Disk, 0, disks)
+  all := make([]Snapshot, 0, disks * snapshotsPerDisk)
+  for diskIndex := 0; diskIndex < disks; diskIndex++ {
+    disk := generatedDisk(diskIndex, snapshotsPerDisk, now)
+    all = append(all, disk.Snapshots...)
+    fleet = append(fleet, disk)
+  }
+  return fleet, all
+}
+
+// generatedDisk returns the disk of this index of generatedFleet.
+func generatedDisk(diskIndex int, snapshotsPerDisk int, now time.Time) Disk {
+  disk := Disk{Name: fmt.Sprintf("disk-%05d", diskIndex), Id: fmt.Sprint(1000000 + diskIndex), Zone: "europe-west1-b"}
+  for snapshotIndex := 0; snapshotIndex < snapshotsPerDisk; snapshotIndex++ {
+    snapshot := testSnapshot(fmt.Sprintf("%s-%d", disk.Name, snapshotIndex), disk.Id, now.Add(-time.Duration(snapshotIndex) * 24 * time.Hour))
+    snapshot.SourceDisk = disk.Name
+    disk.Snapshots = append(disk.Snapshots, snapshot)
+  }
+  return disk
+}
+
+// fleetRunner is a StreamRunner answering the commands of a run on a fleet of
+// generatedFleet, its listings written disk by disk as they are read, so the
+// memory measured is the one of the run, not of the fixture.
+type fleetRunner struct {
+  disks     int
+  snapshots int
+  now       time.Time
+}
+
+func (fleet fleetRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+  output := &bytes.Buffer{}
+  fleet.write(output, args)
+  return output.Bytes(), nil
+}
+
+func (fleet fleetRunner) Stream(ctx context.Context, read func(io.Reader) error, name string, args ...string) error {
+  reader, writer := io.Pipe()
+  go func() {
+    fleet.write(writer, args)
+    writer.Close()
+  }()
+  err := read(reader)
+  // Unblocks the writer if not read to the end
+  reader.Close()
+  return err
+}
+
+// write writes the output of the command, nothing for the creations,
+// deletions and labels.
+func (fleet fleetRunner) write(output io.Writer, args []string) {
+  command := strings.Join(args, " ")
+  switch {
+  case strings.Contains(command, "project-info describe"):
+    io.WriteString(output, `{"quotas": [{"metric": "SNAPSHOTS", "limit": 100000000, "usage": 0}]}`)
+  case strings.Contains(command, "images list") || strings.Contains(command, "sourceSnapshotId:*"):
+    io.WriteString(output, "[]")
+  case strings.Contains(command, "disks list"):
+    diskIndexes := make([]int, 0, fleet.disks)
+    for diskIndex := 0; diskIndex < fleet.disks; diskIndex++ {
+      diskIndexes = append(diskIndexes, diskIndex)
+    }
+    fleet.writeItems(output, diskIndexes, func(disk Disk) string {
+      disk.Snapshots = nil
+      return disksJSON([]Disk{disk})
+    })
+  case strings.Contains(command, "snapshots list"):
+    filter := argValue(args, "--filter")
+    diskIndexes := make([]int, 0)
+    if strings.HasPrefix(filter, "sourceDiskId") {
+      ids := strings.Fields(strings.Trim(strings.TrimPrefix(filter, "sourceDiskId = "), "()"))
+      for idIndex := 0; idIndex < len(ids); idIndex++ {
+        var id int
+        fmt.Sscan(ids[idIndex], &id)
+        diskIndexes = append(diskIndexes, id - 1000000)
+      }
+    } else {
+      for diskIndex := 0; diskIndex < fleet.disks; diskIndex++ {
+        diskIndexes = append(diskIndexes, diskIndex)
+      }
+    }
+    fleet.writeItems(output, diskIndexes, func(disk Disk) string {
+      return snapshotsJSON(disk.Snapshots)
+    })
+  case strings.Contains(command, "snapshots describe"):
+    io.WriteString(output, `{"status": "READY"}`)
+  }
+}
+
+// writeItems writes a JSON array of the items of the disks, generated and
+// written one disk after the other.
+func (fleet fleetRunner) writeItems(output io.Writer, diskIndexes []int, items func(disk Disk) string) {
+  io.WriteString(output, "[")
+  written := false
+  for listIndex := 0; listIndex < len(diskIndexes); listIndex++ {
+    diskItems := strings.TrimSuffix(strings.TrimPrefix(items(generatedDisk(diskIndexes[listIndex], fleet.snapshots, fleet.now)), "["), "]")
+    if diskItems == "" {
+      continue
+    }
+    if written {
+      io.WriteString(output, ",")
+    }
+    io.WriteString(output, diskItems)
+    written = true
+  }
+  io.WriteString(output, "]\n")
+}
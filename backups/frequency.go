@@ -0,0 +1,81 @@
+package backups
+
+import (
+  "fmt"
+  "time"
+)
+
+// Label of the disks with how often they are snapshotted, like "daily"
+const FrequencyLabel = "backup-frequency"
+
+// Frequencies of the FrequencyLabel
+const (
+  // Snapshotted by every run
+  FrequencyAlways = "always"
+  FrequencyHourly = "hourly"
+  FrequencyDaily  = "daily"
+  FrequencyWeekly = "weekly"
+)
+
+var frequencyIntervals = map[string]time.Duration{
+  FrequencyHourly: time.Hour,
+  FrequencyDaily: 24 * time.Hour,
+  FrequencyWeekly: 7 * 24 * time.Hour,
+}
+
+// A snapshot is due a tenth of the interval early, so a run starting a bit
+// earlier than the previous one doesn't skip a day
+const frequencySlackDivisor = 10
+
+// ValidateFrequency checks the frequency is one of the frequencies of the
+// FrequencyLabel.
+func ValidateFrequency(frequency string) error {
+  if _, found := frequencyIntervals[frequency]; !found && frequency != FrequencyAlways {
+    return fmt.Errorf("Unknown frequency '%s', use '%s', '%s', '%s' or '%s'", frequency, FrequencyAlways, FrequencyHourly, FrequencyDaily, FrequencyWeekly)
+  }
+  return nil
+}
+
+// notDueDisks returns the disks not snapshotted by this run, adding them to
+// the result. They are still pruned.
+func (runner *Runner) notDueDisks(disks []Disk, now time.Time, result *Result) []bool {
+  notDue := make([]bool, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    if _, isResumed := runner.options.Resumed[disk.Id]; isResumed {
+      continue
+    }
+    reason := runner.notDueReason(disk, now)
+    if reason == "" {
+      continue
+    }
+    notDue[diskIndex] = true
+    result.NotDue = append(result.NotDue, Skip{Disk: disk.Name, Reason: reason})
+    runner.logger.Printf("Not snapshotting disk %s, no snapshot due: %s\n", disk.Name, reason)
+  }
+  return notDue
+}
+
+// notDueReason returns why the disk isn't snapshotted by this run, from the
+// age of its newest snapshot created by this program and its FrequencyLabel
+// or the default frequency. It's empty when a snapshot is due.
+func (runner *Runner) notDueReason(disk Disk, now time.Time) string {
+  frequency, labeled := disk.Labels[FrequencyLabel]
+  if !labeled {
+    frequency = runner.options.DefaultFrequency
+  }
+  if frequency == "" || frequency == FrequencyAlways {
+    return ""
+  }
+  interval, found := frequencyIntervals[frequency]
+  if !found {
+    runner.levels.Warning.Printf("WARNING: invalid label %s=%s of disk %s, snapshotting it\n", FrequencyLabel, frequency, disk.Name)
+    return ""
+  }
+
+  snapshot, found := newestBackup(disk)
+  if !found || now.Sub(snapshot.CreationTimestamp) >= interval - interval / frequencySlackDivisor {
+    return ""
+  }
+  return fmt.Sprintf("%s, newest snapshot %s is %s old", frequency, snapshot.Name, FormatAge(snapshot.CreationTimestamp, now))
+}
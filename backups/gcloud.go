@@ -0,0 +1,821 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "os"
+  "os/exec"
+  "strconv"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+  "time"
+
+  "go.opentelemetry.io/otel/attribute"
+)
+
+// CommandRunner runs an external command and returns its output.
+type CommandRunner interface {
+  Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// CommandError is the failure of a command, with its error output.
+type CommandError struct {
+  Args   []string
+  Err    error
+  // Standard error of the command
+  Output []byte
+}
+
+func (err *CommandError) Error() string {
+  return "Command error: `" + strings.Join(err.Args, " ") + "`: " + err.Err.Error() + "\n" + string(err.Output)
+}
+
+func (err *CommandError) Unwrap() error {
+  return err.Err
+}
+
+// StreamRunner is a CommandRunner which can also give the standard output of
+// the commands as it comes, so the big listings are decoded without holding
+// their whole output.
+type StreamRunner interface {
+  CommandRunner
+  // Stream runs the command, read consuming its standard output, and returns
+  // the error of read if any, else the one of the command
+  Stream(ctx context.Context, read func(io.Reader) error, name string, args ...string) error
+}
+
+// ExecRunner runs the commands with os/exec, killing them when the context is
+// done. It returns the standard output only, so the warnings can't break the
+// JSON.
+type ExecRunner struct {
+  // Receives the standard error of the successful commands, like the
+  // warnings of gcloud, discarded if nil
+  Stderr io.Writer
+  // Added to the environment of the commands, like Credentials.GcloudEnv()
+  Env    []string
+}
+
+func (runner ExecRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+  cmd := exec.CommandContext(ctx, name, args...)
+  // gcloud is a script starting Python, all its processes are killed
+  killProcessGroup(cmd)
+  // Returns even if a killed child process kept the output open
+  cmd.WaitDelay = 5 * time.Second
+  if len(runner.Env) > 0 {
+    cmd.Env = append(os.Environ(), runner.Env...)
+  }
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  cmdOut, cmdErr := cmd.Output()
+  if cmdErr != nil && ctx.Err() != nil {
+    cmdErr = fmt.Errorf("%w (%s)", ctx.Err(), cmdErr)
+  }
+  if cmdErr != nil {
+    return make([]byte, 0), &CommandError{Args: args, Err: cmdErr, Output: stderr.Bytes()}
+  }
+  if runner.Stderr != nil && stderr.Len() > 0 {
+    runner.Stderr.Write(stderr.Bytes())
+  }
+
+  return cmdOut, nil
+}
+
+func (runner ExecRunner) Stream(ctx context.Context, read func(io.Reader) error, name string, args ...string) error {
+  cmd := exec.CommandContext(ctx, name, args...)
+  killProcessGroup(cmd)
+  cmd.WaitDelay = 5 * time.Second
+  if len(runner.Env) > 0 {
+    cmd.Env = append(os.Environ(), runner.Env...)
+  }
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    return &CommandError{Args: args, Err: err}
+  }
+  err = cmd.Start()
+  if err != nil {
+    return &CommandError{Args: args, Err: err}
+  }
+  readErr := read(stdout)
+  // The rest is still read so the command can end, like the rest of an
+  // invalid output or a newline
+  io.Copy(io.Discard, stdout)
+  cmdErr := cmd.Wait()
+  if cmdErr != nil && ctx.Err() != nil {
+    cmdErr = fmt.Errorf("%w (%s)", ctx.Err(), cmdErr)
+  }
+  // A failing command is the cause of a truncated output
+  if cmdErr != nil {
+    return &CommandError{Args: args, Err: cmdErr, Output: stderr.Bytes()}
+  }
+  if readErr != nil {
+    return readErr
+  }
+  if runner.Stderr != nil && stderr.Len() > 0 {
+    runner.Stderr.Write(stderr.Bytes())
+  }
+  return nil
+}
+
+// decodeJSONArray decodes the JSON array output by the gcloud command item by
+// item, with decode.
+func decodeJSONArray(args []string, reader io.Reader, decode func(*json.Decoder) error) error {
+  decoder := json.NewDecoder(reader)
+  // With the output from the failure on, the part not read by the decoder yet
+  // too
+  invalid := func(err error) error {
+    rest, _ := io.ReadAll(io.LimitReader(io.MultiReader(decoder.Buffered(), reader), excerptLength + 1))
+    return fmt.Errorf("Invalid JSON output of `gcloud %s` at byte %d: %w\n%s", strings.Join(args, " "), decoder.InputOffset(), err, outputExcerpt(rest))
+  }
+  token, err := decoder.Token()
+  if err == io.EOF {
+    // Never the output of a listing, even without any item
+    return invalid(errors.New("empty output, expected a JSON array"))
+  }
+  if err != nil {
+    return invalid(err)
+  }
+  if token != json.Delim('[') {
+    return invalid(fmt.Errorf("expected an array, got %v", token))
+  }
+  for decoder.More() {
+    err = decode(decoder)
+    if err != nil {
+      return invalid(err)
+    }
+  }
+  _, err = decoder.Token()
+  if err != nil {
+    return invalid(err)
+  }
+  return nil
+}
+
+// Length of the excerpts of the invalid outputs in the errors
+const excerptLength = 200
+
+// outputExcerpt returns the start of the output, for an error.
+func outputExcerpt(output []byte) string {
+  excerpt := strings.TrimSpace(string(output))
+  if len(excerpt) > excerptLength {
+    excerpt = excerpt[:excerptLength] + "..."
+  }
+  if excerpt == "" {
+    excerpt = "(no output)"
+  }
+  return excerpt
+}
+
+// parseJSON parses the output of the gcloud command.
+func parseJSON(args []string, output []byte, value interface{}) error {
+  err := json.Unmarshal(output, value)
+  if err != nil {
+    return fmt.Errorf("Invalid JSON output of `gcloud %s`: %w\n%s", strings.Join(args, " "), err, outputExcerpt(output))
+  }
+  return nil
+}
+
+// Gcloud manages the disks and snapshots through the gcloud command.
+type Gcloud struct {
+  commands CommandRunner
+  // Command run, gcloud from the PATH by default
+  path     string
+  // Passed with --project when set, instead of the configured one
+  project  string
+  // Passed to every command
+  credentials Credentials
+}
+
+// NewGcloud uses the given runner for the gcloud commands, ExecRunner if nil.
+func NewGcloud(commands CommandRunner) *Gcloud {
+  if commands == nil {
+    commands = ExecRunner{}
+  }
+
+  return &Gcloud{commands: commands, path: "gcloud"}
+}
+
+// WithPath returns a Gcloud running the gcloud command at this path.
+func (gcloud *Gcloud) WithPath(path string) *Gcloud {
+  pathGcloud := *gcloud
+  pathGcloud.path = path
+  return &pathGcloud
+}
+
+// WithCredentials returns a Gcloud passing the impersonated service account
+// and the billing project to every command. The key file is given to
+// ExecRunner with Credentials.GcloudEnv().
+func (gcloud *Gcloud) WithCredentials(credentials Credentials) *Gcloud {
+  credentialsGcloud := *gcloud
+  credentialsGcloud.credentials = credentials
+  return &credentialsGcloud
+}
+
+func (gcloud *Gcloud) getCommandResult(ctx context.Context, args []string) ([]byte, error) {
+  if gcloud.project != "" {
+    args = append(args, "--project", gcloud.project)
+  }
+  return gcloud.run(ctx, args)
+}
+
+// streamJSONArray runs the gcloud command of a listing, decoding its items as
+// they come with decode if the runner streams, else once the command is done.
+// start is called before decoding each attempt of the command.
+func (gcloud *Gcloud) streamJSONArray(ctx context.Context, args []string, start func(), decode func(*json.Decoder) error) error {
+  streamer, streams := gcloud.commands.(StreamRunner)
+  if !streams {
+    output, err := gcloud.getCommandResult(ctx, args)
+    if err != nil {
+      return err
+    }
+    start()
+    return decodeJSONArray(args, bytes.NewReader(output), decode)
+  }
+
+  if gcloud.project != "" {
+    args = append(args, "--project", gcloud.project)
+  }
+  ctx, span := StartSpan(ctx, "gcloud " + gcloudCommand(args))
+  if span.IsRecording() {
+    span.SetAttributes(attribute.StringSlice("gcloud.args", args))
+  }
+  commandArgs := append(args, gcloud.credentials.gcloudArgs()...)
+  err := streamer.Stream(ctx, func(reader io.Reader) error {
+    start()
+    return decodeJSONArray(args, reader, decode)
+  }, gcloud.path, commandArgs...)
+  EndSpan(span, err)
+  return err
+}
+
+// run runs the gcloud command with the flags of the credentials, in a span
+// of the command.
+func (gcloud *Gcloud) run(ctx context.Context, args []string) ([]byte, error) {
+  ctx, span := StartSpan(ctx, "gcloud " + gcloudCommand(args))
+  if span.IsRecording() {
+    span.SetAttributes(attribute.StringSlice("gcloud.args", args))
+  }
+  args = append(args, gcloud.credentials.gcloudArgs()...)
+  output, err := gcloud.commands.Run(ctx, gcloud.path, args...)
+  EndSpan(span, err)
+  return output, err
+}
+
+// WithProject returns a Gcloud passing --project to every command.
+func (gcloud *Gcloud) WithProject(project string) Backend {
+  projectGcloud := *gcloud
+  projectGcloud.project = project
+  return &projectGcloud
+}
+
+// Project returns the project given to WithProject, or the one configured in
+// gcloud.
+func (gcloud *Gcloud) Project(ctx context.Context) (string, error) {
+  if gcloud.project != "" {
+    return gcloud.project, nil
+  }
+  cmdProjectOut, err := gcloud.getCommandResult(ctx, []string{"config", "get-value", "project"})
+  if err != nil {
+    return "", err
+  }
+
+  return strings.TrimSpace(string(cmdProjectOut)), nil
+}
+
+// ListProjects lists the active projects of the gcloud account.
+func (gcloud *Gcloud) ListProjects(ctx context.Context) ([]string, error) {
+  args := []string{"projects", "list", "--filter", "lifecycleState = ACTIVE", "--format", "json"}
+  cmdProjectsOut, err := gcloud.run(ctx, args)
+  if err != nil {
+    return nil, err
+  }
+  var listed []struct {
+    ProjectId string
+  }
+  err = parseJSON(args, cmdProjectsOut, &listed)
+  if err != nil {
+    return nil, err
+  }
+
+  projects := make([]string, 0, len(listed))
+  for projectIndex := 0; projectIndex < len(listed); projectIndex++ {
+    projects = append(projects, listed[projectIndex].ProjectId)
+  }
+  return projects, nil
+}
+
+// GetDisksToSnapshot lists the disks matching the gcloud filter.
+func (gcloud *Gcloud) GetDisksToSnapshot(ctx context.Context, filter string) ([]Disk, error) {
+  return gcloud.listDisks(ctx, []string{"beta", "compute", "disks", "list", "--filter", filter})
+}
+
+// GetZoneDisks lists the disks of the zone matching the gcloud filter.
+func (gcloud *Gcloud) GetZoneDisks(ctx context.Context, filter string, zone string) ([]Disk, error) {
+  return gcloud.listDisks(ctx, []string{"beta", "compute", "disks", "list", "--filter", filter, "--zones", zone})
+}
+
+// GetRegionDisks lists the regional disks of the region matching the gcloud
+// filter.
+func (gcloud *Gcloud) GetRegionDisks(ctx context.Context, filter string, region string) ([]Disk, error) {
+  return gcloud.listDisks(ctx, []string{"beta", "compute", "disks", "list", "--filter", filter, "--regions", region})
+}
+
+// listDisks lists the disks with a projection on the fields of Disk, decoded
+// one by one.
+func (gcloud *Gcloud) listDisks(ctx context.Context, args []string) ([]Disk, error) {
+  disks := make([]Disk, 0)
+
+  args = append(args, "--format", "json(" + diskFields + ")")
+  err := gcloud.streamJSONArray(ctx, args, func() {
+    disks = make([]Disk, 0)
+  }, func(decoder *json.Decoder) error {
+    var disk Disk
+    err := decoder.Decode(&disk)
+    if err == nil {
+      disks = append(disks, disk)
+    }
+    return err
+  })
+
+  return disks, err
+}
+
+// StreamDisks lists the disks matching the gcloud filter by pages of pageSize,
+// handing each page once decoded.
+func (gcloud *Gcloud) StreamDisks(ctx context.Context, filter string, pageSize int, page func([]Disk) error) error {
+  args := []string{"beta", "compute", "disks", "list", "--filter", filter, "--page-size", strconv.Itoa(pageSize), "--format", "json(" + diskFields + ")"}
+  pager := newDiskPager(pageSize, page)
+  err := gcloud.streamJSONArray(ctx, args, pager.restart, func(decoder *json.Decoder) error {
+    var disk Disk
+    err := decoder.Decode(&disk)
+    if err != nil {
+      return err
+    }
+    return pager.add(disk)
+  })
+  return pager.finish(err)
+}
+
+// ListAttachedDisks lists the disks of the instances matching the gcloud
+// filter.
+func (gcloud *Gcloud) ListAttachedDisks(ctx context.Context, instanceFilter string) ([]AttachedDisk, error) {
+  attached := make([]AttachedDisk, 0)
+
+  args := []string{"compute", "instances", "list", "--filter", instanceFilter, "--format", "json"}
+  cmdListInstancesOut, err := gcloud.getCommandResult(ctx, args)
+  if err != nil {
+    return attached, err
+  }
+  var instances []struct {
+    Name  string
+    Disks []struct {
+      // URL of the disk
+      Source string
+    }
+  }
+  err = parseJSON(args, cmdListInstancesOut, &instances)
+  for instanceIndex := 0; instanceIndex < len(instances); instanceIndex++ {
+    instance := instances[instanceIndex]
+    for diskIndex := 0; diskIndex < len(instance.Disks); diskIndex++ {
+      attached = append(attached, parseAttachedDisk(instance.Name, instance.Disks[diskIndex].Source))
+    }
+  }
+
+  return attached, err
+}
+
+// GetDiskSnapshots lists the snapshots of a disk, newest first.
+func (gcloud *Gcloud) GetDiskSnapshots(ctx context.Context, disk Disk) ([]Snapshot, error) {
+  return gcloud.ListSnapshots(ctx, "sourceDiskId = " + disk.Id)
+}
+
+// GetDisksSnapshots lists the snapshots of the disks, newest first.
+func (gcloud *Gcloud) GetDisksSnapshots(ctx context.Context, disks []Disk) ([]Snapshot, error) {
+  ids := make([]string, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    ids = append(ids, disks[diskIndex].Id)
+  }
+  return gcloud.ListSnapshots(ctx, "sourceDiskId = (" + strings.Join(ids, " ") + ")")
+}
+
+// ListSnapshots lists the snapshots matching the gcloud filter, all of them if
+// empty, newest first, with the fields of Snapshot only.
+func (gcloud *Gcloud) ListSnapshots(ctx context.Context, filter string) ([]Snapshot, error) {
+  return gcloud.ListSnapshotInventory(ctx, filter)
+}
+
+// ListSnapshotInventory lists the snapshots matching the gcloud filter, newest
+// first, with a projection on the fields of an inventory.
+func (gcloud *Gcloud) ListSnapshotInventory(ctx context.Context, filter string) ([]Snapshot, error) {
+  snapshots := make([]Snapshot, 0)
+
+  // Sorted here rather than with --sort-by, which has gcloud buffer the
+  // whole listing
+  args := []string{"beta", "compute", "snapshots", "list", "--format", "json(" + inventoryFields + ")"}
+  if filter != "" {
+    args = append(args, "--filter", filter)
+  }
+  err := gcloud.streamJSONArray(ctx, args, func() {
+    snapshots = make([]Snapshot, 0)
+  }, func(decoder *json.Decoder) error {
+    var snapshot Snapshot
+    err := decoder.Decode(&snapshot)
+    if err == nil {
+      snapshots = append(snapshots, snapshot)
+    }
+    return err
+  })
+  sortSnapshots(snapshots)
+
+  return snapshots, err
+}
+
+// ListSnapshotReferences lists the images of the project and the disks
+// created from a snapshot.
+func (gcloud *Gcloud) ListSnapshotReferences(ctx context.Context) ([]SnapshotReference, error) {
+  references := make([]SnapshotReference, 0)
+  kinds := []string{"image", "disk"}
+  listings := [][]string{
+    {"compute", "images", "list", "--no-standard-images", "--filter", "sourceSnapshotId:*", "--format", "json"},
+    {"beta", "compute", "disks", "list", "--filter", "sourceSnapshotId:*", "--format", "json"},
+  }
+  for listingIndex := 0; listingIndex < len(listings); listingIndex++ {
+    args := listings[listingIndex]
+    cmdListOut, err := gcloud.getCommandResult(ctx, args)
+    if err != nil {
+      return references, err
+    }
+    var sources []struct {
+      Name             string
+      // URL of the snapshot
+      SourceSnapshot   string
+      SourceSnapshotId string
+    }
+    err = parseJSON(args, cmdListOut, &sources)
+    if err != nil {
+      return references, err
+    }
+    for sourceIndex := 0; sourceIndex < len(sources); sourceIndex++ {
+      source := sources[sourceIndex]
+      references = append(references, SnapshotReference{SnapshotName: lastPathPart(source.SourceSnapshot), SnapshotId: source.SourceSnapshotId, Resource: kinds[listingIndex] + " " + source.Name})
+    }
+  }
+
+  return references, nil
+}
+
+// GetQuotas returns the quotas of the project from its description.
+func (gcloud *Gcloud) GetQuotas(ctx context.Context) ([]Quota, error) {
+  args := []string{"compute", "project-info", "describe", "--format", "json"}
+  cmdDescribeOut, err := gcloud.getCommandResult(ctx, args)
+  if err != nil {
+    return nil, err
+  }
+  var described struct {
+    Quotas []struct {
+      Metric string
+      Limit  float64
+      Usage  float64
+    }
+  }
+  err = parseJSON(args, cmdDescribeOut, &described)
+  quotas := make([]Quota, 0, len(described.Quotas))
+  for quotaIndex := 0; quotaIndex < len(described.Quotas); quotaIndex++ {
+    quota := described.Quotas[quotaIndex]
+    quotas = append(quotas, Quota{Metric: quota.Metric, Limit: int64(quota.Limit), Usage: int64(quota.Usage)})
+  }
+
+  return quotas, err
+}
+
+// GetSnapshotStatus returns the current status of the snapshot.
+func (gcloud *Gcloud) GetSnapshotStatus(ctx context.Context, snapshot Snapshot) (string, error) {
+  args := []string{"beta", "compute", "snapshots", "describe", snapshot.Name, "--format", "json"}
+  cmdDescribeOut, err := gcloud.getCommandResult(ctx, args)
+  if err != nil {
+    return "", err
+  }
+  var described Snapshot
+  err = parseJSON(args, cmdDescribeOut, &described)
+
+  return described.Status, err
+}
+
+// CreateSnapshotForDisk snapshots the disk. In dry-run mode only the name of
+// the snapshot is generated.
+func (gcloud *Gcloud) CreateSnapshotForDisk(ctx context.Context, disk Disk, options CreateOptions, dryRun bool) (Snapshot, error) {
+  // Asynchronous
+  now := time.Now()
+  name, err := TemplateSnapshotName(options.NameTemplate, disk, now)
+  snapshot := Snapshot{Name: name, CreationTimestamp: now, StorageLocation: options.StorageLocation, SnapshotType: options.SnapshotType, GuestFlush: options.GuestFlush, ChainName: options.ChainName, Description: options.Description}
+  if err != nil || dryRun {
+    return snapshot, err
+  }
+
+  args := []string{"beta", "compute", "disks", "snapshot", disk.Name, "--zone", disk.Zone, "--snapshot-names", snapshot.Name}
+  if disk.Region != "" {
+    args = []string{"beta", "compute", "disks", "snapshot", disk.Name, "--region", disk.Region, "--snapshot-names", snapshot.Name}
+  }
+  // Only "snapshots create" has a snapshot type and a KMS key
+  if options.SnapshotType != "" || options.KmsKey != "" {
+    args = []string{"beta", "compute", "snapshots", "create", snapshot.Name, "--source-disk", disk.Name, "--source-disk-zone", disk.Zone}
+    if disk.Region != "" {
+      args = []string{"beta", "compute", "snapshots", "create", snapshot.Name, "--source-disk", disk.Name, "--source-disk-region", disk.Region}
+    }
+  }
+  if options.SnapshotType != "" {
+    args = append(args, "--snapshot-type", options.SnapshotType)
+  }
+  if options.Description != "" {
+    args = append(args, "--description", options.Description)
+  }
+  if len(options.Labels) > 0 {
+    args = append(args, "--labels", FormatLabels(options.Labels))
+  }
+  if options.StorageLocation != "" {
+    args = append(args, "--storage-location", options.StorageLocation)
+  }
+  if options.GuestFlush {
+    args = append(args, "--guest-flush")
+  }
+  if options.ChainName != "" {
+    args = append(args, "--chain-name", options.ChainName)
+  }
+  if options.KmsKey != "" {
+    args = append(args, "--kms-key", options.KmsKey)
+  }
+  _, err = gcloud.getCommandResult(ctx, args)
+
+  return snapshot, err
+}
+
+// DeleteSnapshot deletes the snapshot, unless in dry-run mode.
+func (gcloud *Gcloud) DeleteSnapshot(ctx context.Context, snapshot Snapshot, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  _, err := gcloud.getCommandResult(ctx, []string{"beta", "compute", "snapshots", "delete", snapshot.Name})
+
+  return err
+}
+
+// AddSnapshotLabels adds or replaces labels of the snapshot, unless in
+// dry-run mode.
+func (gcloud *Gcloud) AddSnapshotLabels(ctx context.Context, snapshot Snapshot, labels map[string]string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  _, err := gcloud.getCommandResult(ctx, []string{"beta", "compute", "snapshots", "add-labels", snapshot.Name, "--labels", FormatLabels(labels)})
+
+  return err
+}
+
+// RemoveSnapshotLabels removes labels of the snapshot by key, unless in
+// dry-run mode.
+func (gcloud *Gcloud) RemoveSnapshotLabels(ctx context.Context, snapshot Snapshot, keys []string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  _, err := gcloud.getCommandResult(ctx, []string{"beta", "compute", "snapshots", "remove-labels", snapshot.Name, "--labels", strings.Join(keys, ",")})
+
+  return err
+}
+
+// AddDiskLabels adds or updates labels of the disk, unless in dry-run mode.
+func (gcloud *Gcloud) AddDiskLabels(ctx context.Context, disk Disk, labels map[string]string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"beta", "compute", "disks", "update", disk.Name, "--zone", disk.Zone, "--update-labels", FormatLabels(labels)}
+  if disk.Region != "" {
+    args = []string{"beta", "compute", "disks", "update", disk.Name, "--region", disk.Region, "--update-labels", FormatLabels(labels)}
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// DiskExists describes the disk, which fails if it doesn't exist.
+func (gcloud *Gcloud) DiskExists(ctx context.Context, name string, zone string) (bool, error) {
+  _, err := gcloud.getCommandResult(ctx, []string{"beta", "compute", "disks", "describe", name, "--zone", zone, "--format", "json"})
+  if err != nil && IsNotFound(err) {
+    return false, nil
+  }
+  return err == nil, err
+}
+
+// GetDisk describes the disk of the zone.
+func (gcloud *Gcloud) GetDisk(ctx context.Context, name string, zone string) (Disk, error) {
+  args := []string{"beta", "compute", "disks", "describe", name, "--zone", zone, "--format", "json"}
+  cmdDescribeOut, err := gcloud.getCommandResult(ctx, args)
+  var disk Disk
+  if err == nil {
+    err = parseJSON(args, cmdDescribeOut, &disk)
+  }
+  return disk, err
+}
+
+// CreateDiskFromSnapshot creates the disk, unless in dry-run mode.
+func (gcloud *Gcloud) CreateDiskFromSnapshot(ctx context.Context, disk NewDisk, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"beta", "compute", "disks", "create", disk.Name, "--zone", disk.Zone, "--source-snapshot", disk.Snapshot}
+  if disk.SizeGb > 0 {
+    args = append(args, "--size", strconv.FormatInt(disk.SizeGb, 10) + "GB")
+  }
+  if disk.Type != "" {
+    args = append(args, "--type", disk.Type)
+  }
+  if len(disk.Labels) > 0 {
+    args = append(args, "--labels", FormatLabels(disk.Labels))
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// CreateImage creates the image from the snapshot, unless in dry-run mode.
+func (gcloud *Gcloud) CreateImage(ctx context.Context, image NewImage, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"beta", "compute", "images", "create", image.Name, "--source-snapshot", image.Snapshot}
+  if len(image.Labels) > 0 {
+    args = append(args, "--labels", FormatLabels(image.Labels))
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// ExportImage exports the image to the GCS object with a Cloud Build, unless
+// in dry-run mode.
+func (gcloud *Gcloud) ExportImage(ctx context.Context, name string, uri string, timeout time.Duration, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"compute", "images", "export", "--image", name, "--destination-uri", uri}
+  if timeout > 0 {
+    args = append(args, "--timeout", strconv.Itoa(int(timeout.Seconds())) + "s")
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// DeleteImage deletes the image, unless in dry-run mode.
+func (gcloud *Gcloud) DeleteImage(ctx context.Context, name string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  _, err := gcloud.getCommandResult(ctx, []string{"beta", "compute", "images", "delete", name})
+
+  return err
+}
+
+// GetDiskInstantSnapshots lists the instant snapshots of a disk, newest first.
+func (gcloud *Gcloud) GetDiskInstantSnapshots(ctx context.Context, disk Disk) ([]InstantSnapshot, error) {
+  return gcloud.ListInstantSnapshots(ctx, "sourceDiskId = " + disk.Id)
+}
+
+// ListInstantSnapshots lists the instant snapshots matching the gcloud filter,
+// all of them if empty, newest first.
+func (gcloud *Gcloud) ListInstantSnapshots(ctx context.Context, filter string) ([]InstantSnapshot, error) {
+  snapshots := make([]InstantSnapshot, 0)
+
+  args := []string{"beta", "compute", "instant-snapshots", "list", "--format", "json"}
+  if filter != "" {
+    args = append(args, "--filter", filter)
+  }
+  cmdSnapshotsOut, err := gcloud.getCommandResult(ctx, args)
+  if err != nil {
+    return snapshots, err
+  }
+  err = parseJSON(args, cmdSnapshotsOut, &snapshots)
+  sortInstantSnapshots(snapshots)
+
+  return snapshots, err
+}
+
+// CreateInstantSnapshot creates the instant snapshot of the disk, unless in
+// dry-run mode.
+func (gcloud *Gcloud) CreateInstantSnapshot(ctx context.Context, disk Disk, name string, labels map[string]string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"beta", "compute", "instant-snapshots", "create", name, "--zone", disk.Zone, "--source-disk", disk.Name}
+  if disk.Region != "" {
+    args = []string{"beta", "compute", "instant-snapshots", "create", name, "--region", disk.Region, "--source-disk", disk.Name, "--source-disk-region", disk.Region}
+  }
+  if len(labels) > 0 {
+    args = append(args, "--labels", FormatLabels(labels))
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// DeleteInstantSnapshot deletes the instant snapshot, unless in dry-run mode.
+func (gcloud *Gcloud) DeleteInstantSnapshot(ctx context.Context, snapshot InstantSnapshot, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"beta", "compute", "instant-snapshots", "delete", snapshot.Name, "--zone", snapshot.Zone}
+  if snapshot.Region != "" {
+    args = []string{"beta", "compute", "instant-snapshots", "delete", snapshot.Name, "--region", snapshot.Region}
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// ListResourcePolicies lists the resource policies of all the regions.
+func (gcloud *Gcloud) ListResourcePolicies(ctx context.Context) ([]ResourcePolicy, error) {
+  policies := make([]ResourcePolicy, 0)
+
+  args := []string{"beta", "compute", "resource-policies", "list", "--format", "json"}
+  cmdPoliciesOut, err := gcloud.getCommandResult(ctx, args)
+  if err != nil {
+    return policies, err
+  }
+  err = parseJSON(args, cmdPoliciesOut, &policies)
+
+  return policies, err
+}
+
+// CreateSnapshotSchedule creates the snapshot schedule resource policy, keeping
+// the snapshots when their disk is deleted, unless in dry-run mode.
+func (gcloud *Gcloud) CreateSnapshotSchedule(ctx context.Context, schedule SnapshotSchedule, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"beta", "compute", "resource-policies", "create", "snapshot-schedule", schedule.Name, "--region", schedule.Region, "--max-retention-days", strconv.Itoa(schedule.MaxRetentionDays), "--start-time", schedule.StartTime, "--on-source-disk-delete", "keep-auto-snapshots"}
+  if schedule.IntervalHours > 0 {
+    args = append(args, "--hourly-schedule", strconv.Itoa(schedule.IntervalHours))
+  } else {
+    args = append(args, "--daily-schedule")
+  }
+  if schedule.StorageLocation != "" {
+    args = append(args, "--storage-location", schedule.StorageLocation)
+  }
+  if len(schedule.Labels) > 0 {
+    args = append(args, "--snapshot-labels", FormatLabels(schedule.Labels))
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// AttachResourcePolicy attaches the resource policy to the disk, unless in
+// dry-run mode.
+func (gcloud *Gcloud) AttachResourcePolicy(ctx context.Context, disk Disk, policy string, dryRun bool) error {
+  return gcloud.diskResourcePolicies(ctx, "add-resource-policies", disk, policy, dryRun)
+}
+
+// DetachResourcePolicy detaches the resource policy from the disk, unless in
+// dry-run mode.
+func (gcloud *Gcloud) DetachResourcePolicy(ctx context.Context, disk Disk, policy string, dryRun bool) error {
+  return gcloud.diskResourcePolicies(ctx, "remove-resource-policies", disk, policy, dryRun)
+}
+
+// diskResourcePolicies runs the disks command adding or removing the policy.
+func (gcloud *Gcloud) diskResourcePolicies(ctx context.Context, command string, disk Disk, policy string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  args := []string{"beta", "compute", "disks", command, disk.Name, "--zone", disk.Zone, "--resource-policies", policy}
+  if disk.Region != "" {
+    args = []string{"beta", "compute", "disks", command, disk.Name, "--region", disk.Region, "--resource-policies", policy}
+  }
+  _, err := gcloud.getCommandResult(ctx, args)
+
+  return err
+}
+
+// DeleteDisk deletes the disk of the zone, unless in dry-run mode.
+func (gcloud *Gcloud) DeleteDisk(ctx context.Context, name string, zone string, dryRun bool) error {
+  if dryRun {
+    return nil
+  }
+
+  _, err := gcloud.getCommandResult(ctx, []string{"beta", "compute", "disks", "delete", name, "--zone", zone})
+
+  return err
+}
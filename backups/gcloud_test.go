@@ -0,0 +1,489 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestGcloudGetDisksToSnapshot(t *testing.T) {
+  fake := newFakeRunner(t)
+  gcloud := NewGcloud(fake).WithProject("proj")
+
+  disks, err := gcloud.GetDisksToSnapshot(context.Background(), "labels.env = production")
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name    string
+    id      string
+    project string
+    zone    string
+    region  string
+    sizeGb  int64
+    diskType string
+    users   string
+    policies string
+  }{
+    {"db-data", "1111111111111111111", "proj", "europe-west1-b", "", 100, "pd-ssd", "db-1", ""},
+    {"shared-data", "2222222222222222222", "proj", "", "europe-west1", 200, "pd-balanced", "", "nightly"},
+  }
+  if len(disks) != len(tests) {
+    t.Fatalf("Got %d disks, expected %d", len(disks), len(tests))
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    disk := disks[testIndex]
+    if disk.Name != test.name || disk.Id != test.id || disk.Project != test.project || disk.Zone != test.zone || disk.Region != test.region {
+      t.Errorf("Disk %d: got %s %s in %s/%s/%s, expected %s %s in %s/%s/%s", testIndex, disk.Name, disk.Id, disk.Project, disk.Zone, disk.Region, test.name, test.id, test.project, test.zone, test.region)
+    }
+    if disk.SizeGb != test.sizeGb || disk.Type != test.diskType {
+      t.Errorf("Disk %s: got %d GB of %s, expected %d GB of %s", disk.Name, disk.SizeGb, disk.Type, test.sizeGb, test.diskType)
+    }
+    if strings.Join(disk.Users, ",") != test.users || strings.Join(disk.ResourcePolicies, ",") != test.policies {
+      t.Errorf("Disk %s: got users %v and policies %v, expected %s and %s", disk.Name, disk.Users, disk.ResourcePolicies, test.users, test.policies)
+    }
+  }
+
+  commands := fake.ran("disks", "list")
+  if len(commands) != 1 {
+    t.Fatalf("Got %d listings, expected 1", len(commands))
+  }
+  if argValue(commands[0], "--filter") != "labels.env = production" || argValue(commands[0], "--project") != "proj" {
+    t.Errorf("Unexpected listing: %v", commands[0])
+  }
+}
+
+func TestGcloudListSnapshots(t *testing.T) {
+  tests := []struct {
+    filter   string
+    expected string
+  }{
+    {"", "db-data-3,shared-data-1,db-data-2,db-data-1"},
+    {"sourceDiskId = 1111111111111111111", "db-data-3,db-data-2,db-data-1"},
+    {"sourceDiskId = (2222222222222222222 3333333333333333333)", "shared-data-1"},
+    {"sourceDiskId = 3333333333333333333", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    snapshots, err := NewGcloud(fake).ListSnapshots(context.Background(), test.filter)
+    if err != nil {
+      t.Fatal(err)
+    }
+    // Newest first, whatever the order of the listing
+    if snapshotNames(snapshots) != test.expected {
+      t.Errorf("Filter '%s': got %s, expected %s", test.filter, snapshotNames(snapshots), test.expected)
+    }
+    command := fake.ran("snapshots", "list")[0]
+    // Sorted by the program, --sort-by buffers the whole listing
+    if argValue(command, "--filter") != test.filter || argValue(command, "--sort-by") != "" {
+      t.Errorf("Filter '%s': got the command %v", test.filter, command)
+    }
+  }
+}
+
+func TestGcloudSnapshotFields(t *testing.T) {
+  fake := newFakeRunner(t)
+  snapshots, err := NewGcloud(fake).GetDiskSnapshots(context.Background(), Disk{Name: "db-data", Id: "1111111111111111111"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  snapshot := snapshots[0]
+  expectedTime := time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)
+  if snapshot.Name != "db-data-3" || !snapshot.CreationTimestamp.Equal(expectedTime) || snapshot.Status != SnapshotReady {
+    t.Errorf("Got %s created at %s %s, expected db-data-3 created at %s READY", snapshot.Name, snapshot.CreationTimestamp, snapshot.Status, expectedTime)
+  }
+  if snapshot.SourceDisk != "db-data" || snapshot.SourceDiskId != "1111111111111111111" || snapshot.StorageLocation != "eu" || snapshot.SnapshotType != SnapshotStandard {
+    t.Errorf("Got source %s (%s) in %s of type %s", snapshot.SourceDisk, snapshot.SourceDiskId, snapshot.StorageLocation, snapshot.SnapshotType)
+  }
+  if snapshot.StorageBytes != 1200000000 || snapshot.DiskSizeGb != 100 || snapshot.DownloadBytes != 4000000000 {
+    t.Errorf("Got %d bytes stored of %d GB, %d bytes to download", snapshot.StorageBytes, snapshot.DiskSizeGb, snapshot.DownloadBytes)
+  }
+}
+
+func TestGcloudGetDisksSnapshots(t *testing.T) {
+  fake := newFakeRunner(t)
+  disks := []Disk{{Name: "db-data", Id: "1111111111111111111"}, {Name: "shared-data", Id: "2222222222222222222"}}
+  snapshots, err := NewGcloud(fake).GetDisksSnapshots(context.Background(), disks)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // In a single listing, newest first
+  listings := fake.ran("compute", "snapshots", "list")
+  if len(listings) != 1 || argValue(listings[0], "--filter") != "sourceDiskId = (1111111111111111111 2222222222222222222)" {
+    t.Fatalf("Got the listings %v", listings)
+  }
+  if snapshotNames(snapshots) != "db-data-3,shared-data-1,db-data-2,db-data-1" {
+    t.Errorf("Got %s", snapshotNames(snapshots))
+  }
+}
+
+func TestGcloudCreateSnapshotForDisk(t *testing.T) {
+  zonal := Disk{Name: "db-data", Id: "1", Zone: "europe-west1-b"}
+  regional := Disk{Name: "shared-data", Id: "2", Region: "europe-west1"}
+  tests := []struct {
+    name     string
+    disk     Disk
+    options  CreateOptions
+    expected string
+  }{
+    {"zonal", zonal, CreateOptions{NameTemplate: "{disk}-new"},
+      "beta compute disks snapshot db-data --zone europe-west1-b --snapshot-names db-data-new"},
+    {"regional", regional, CreateOptions{NameTemplate: "{disk}-new"},
+      "beta compute disks snapshot shared-data --region europe-west1 --snapshot-names shared-data-new"},
+    {"zonal options", zonal, CreateOptions{NameTemplate: "{disk}-new", Description: "Nightly", Labels: map[string]string{"env": "production"}, StorageLocation: "eu", GuestFlush: true, ChainName: "chain"},
+      "beta compute disks snapshot db-data --zone europe-west1-b --snapshot-names db-data-new --description Nightly --labels env=production --storage-location eu --guest-flush --chain-name chain"},
+    {"zonal archive", zonal, CreateOptions{NameTemplate: "{disk}-new", SnapshotType: SnapshotArchive},
+      "beta compute snapshots create db-data-new --source-disk db-data --source-disk-zone europe-west1-b --snapshot-type ARCHIVE"},
+    {"regional archive", regional, CreateOptions{NameTemplate: "{disk}-new", SnapshotType: SnapshotArchive},
+      "beta compute snapshots create shared-data-new --source-disk shared-data --source-disk-region europe-west1 --snapshot-type ARCHIVE"},
+    // "disks snapshot" has no --kms-key
+    {"zonal KMS key", zonal, CreateOptions{NameTemplate: "{disk}-new", KmsKey: testKmsKey},
+      "beta compute snapshots create db-data-new --source-disk db-data --source-disk-zone europe-west1-b --kms-key " + testKmsKey},
+    {"regional KMS key", regional, CreateOptions{NameTemplate: "{disk}-new", Labels: map[string]string{"env": "production"}, KmsKey: testKmsKey},
+      "beta compute snapshots create shared-data-new --source-disk shared-data --source-disk-region europe-west1 --labels env=production --kms-key " + testKmsKey},
+    {"archive KMS key", zonal, CreateOptions{NameTemplate: "{disk}-new", SnapshotType: SnapshotArchive, KmsKey: testKmsKey},
+      "beta compute snapshots create db-data-new --source-disk db-data --source-disk-zone europe-west1-b --snapshot-type ARCHIVE --kms-key " + testKmsKey},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    snapshot, err := NewGcloud(fake).CreateSnapshotForDisk(context.Background(), test.disk, test.options, false)
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if snapshot.Name != test.disk.Name + "-new" {
+      t.Errorf("%s: got the snapshot %s", test.name, snapshot.Name)
+    }
+    if len(fake.commands) != 1 || strings.Join(fake.commands[0], " ") != test.expected {
+      t.Errorf("%s: got the commands %v, expected %s", test.name, fake.commands, test.expected)
+    }
+  }
+}
+
+const testKmsKey = "projects/keys/locations/europe-west1/keyRings/backups/cryptoKeys/snapshots"
+
+func TestGcloudCreateSnapshotDryRun(t *testing.T) {
+  fake := newFakeRunner(t)
+  snapshot, err := NewGcloud(fake).CreateSnapshotForDisk(context.Background(), Disk{Name: "db-data", Zone: "europe-west1-b"}, CreateOptions{NameTemplate: "{disk}-new"}, true)
+  if err != nil || snapshot.Name != "db-data-new" {
+    t.Errorf("Got %s, %v", snapshot.Name, err)
+  }
+  if len(fake.commands) > 0 {
+    t.Errorf("Got the commands %v in dry-run mode", fake.commands)
+  }
+}
+
+func TestGcloudDeleteSnapshot(t *testing.T) {
+  tests := []struct {
+    dryRun   bool
+    expected int
+  }{
+    {false, 1},
+    {true, 0},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    err := NewGcloud(fake).WithProject("proj").DeleteSnapshot(context.Background(), Snapshot{Name: "db-data-1"}, test.dryRun)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(fake.commands) != test.expected {
+      t.Fatalf("Dry-run %t: got the commands %v", test.dryRun, fake.commands)
+    }
+    if test.expected > 0 && strings.Join(fake.commands[0], " ") != "beta compute snapshots delete db-data-1 --project proj" {
+      t.Errorf("Got the command %v", fake.commands[0])
+    }
+  }
+}
+
+func TestGcloudErrors(t *testing.T) {
+  failure := errors.New("exit status 1")
+  tests := []struct {
+    name     string
+    output   string
+    err      error
+    call     func(gcloud *Gcloud) error
+    expected string
+  }{
+    {"disks command", "", failure, func(gcloud *Gcloud) error {
+      _, err := gcloud.GetDisksToSnapshot(context.Background(), "")
+      return err
+    }, "Command error: `beta compute disks list"},
+    {"invalid disks", "[{\"name\": 1}]", nil, func(gcloud *Gcloud) error {
+      _, err := gcloud.GetDisksToSnapshot(context.Background(), "")
+      return err
+    }, "Invalid JSON output of `gcloud beta compute disks list"},
+    {"empty snapshots", "", nil, func(gcloud *Gcloud) error {
+      _, err := gcloud.ListSnapshots(context.Background(), "")
+      return err
+    }, "empty output, expected a JSON array"},
+    {"snapshots object", "{}", nil, func(gcloud *Gcloud) error {
+      _, err := gcloud.ListSnapshots(context.Background(), "")
+      return err
+    }, "expected an array"},
+    {"create command", "", failure, func(gcloud *Gcloud) error {
+      _, err := gcloud.CreateSnapshotForDisk(context.Background(), Disk{Name: "db-data", Zone: "europe-west1-b"}, CreateOptions{}, false)
+      return err
+    }, "Command error: `beta compute disks snapshot db-data"},
+    {"delete command", "", failure, func(gcloud *Gcloud) error {
+      return gcloud.DeleteSnapshot(context.Background(), Snapshot{Name: "db-data-1"}, false)
+    }, "Command error: `beta compute snapshots delete db-data-1"},
+    {"quotas", "not json", nil, func(gcloud *Gcloud) error {
+      _, err := gcloud.GetQuotas(context.Background())
+      return err
+    }, "Invalid JSON output of `gcloud compute project-info describe"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := &fakeRunner{}
+    fake.add(&fakeRule{output: test.output, err: test.err})
+    err := test.call(NewGcloud(fake))
+    if err == nil || !strings.Contains(err.Error(), test.expected) {
+      t.Errorf("%s: got the error %v, expected %s", test.name, err, test.expected)
+    }
+    if test.err != nil && !errors.Is(err, test.err) {
+      t.Errorf("%s: the error %v doesn't wrap the failure of the command", test.name, err)
+    }
+  }
+}
+
+func TestGcloudStreamedListings(t *testing.T) {
+  fake := newFakeRunner(t)
+  streamed := NewGcloud(streamingRunner{fake}).WithProject("proj")
+  disks, err := streamed.GetDisksToSnapshot(context.Background(), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  snapshots, err := streamed.ListSnapshots(context.Background(), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(disks) != 2 || disks[0].Name != "db-data" || snapshotNames(snapshots) != "db-data-3,shared-data-1,db-data-2,db-data-1" {
+    t.Errorf("Got %d disks and the snapshots %s", len(disks), snapshotNames(snapshots))
+  }
+  // With the projection on the fields, and the project
+  listing := fake.ran("disks", "list")[0]
+  if argValue(listing, "--format") != "json(" + diskFields + ")" || argValue(listing, "--project") != "proj" {
+    t.Errorf("Got the listing %v", listing)
+  }
+}
+
+func TestGcloudStreamRetried(t *testing.T) {
+  fake := newFakeRunner(t)
+  snapshots := readTestdata(t, "snapshots.json")
+  attempts := 0
+  // The first attempt streams a part of the listing, then fails
+  fake.add(&fakeRule{parts: []string{"snapshots", "list"}, answer: func(args []string) ([]byte, error) {
+    attempts++
+    if attempts == 1 {
+      return nil, &CommandError{Args: args, Err: errors.New("exit status 1"), Output: []byte("ERROR: HTTPError 503: Service Unavailable")}
+    }
+    return []byte(snapshots), nil
+  }})
+  retried := &partialStreamer{streamingRunner: streamingRunner{fake}, partial: snapshots[:strings.Index(snapshots, "\n  },") + 4]}
+  gcloud := NewGcloud(RetryRunner{Commands: retried, Retry: Retry{MaxRetries: 1, Backoff: time.Millisecond, Logger: discardLogger()}})
+
+  listed, err := gcloud.ListSnapshots(context.Background(), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The items of the failed attempt are dropped
+  if attempts != 2 || snapshotNames(listed) != "db-data-3,shared-data-1,db-data-2,db-data-1" {
+    t.Errorf("Got %d attempts and the snapshots %s", attempts, snapshotNames(listed))
+  }
+}
+
+func TestGcloudStreamDisks(t *testing.T) {
+  disks, _ := generatedFleet(120, 0, time.Now())
+  pageErr := errors.New("page failed")
+  tests := []struct {
+    name     string
+    // Fails the page of this number
+    failPage int
+    pages    string
+    err      error
+  }{
+    {"pages", 0, "50,50,20", nil},
+    {"page error", 2, "50,50", pageErr},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := &fakeRunner{}
+    fake.answer(disksJSON(disks), "disks", "list")
+    gcloud := NewGcloud(streamingRunner{fake}).WithProject("proj").(*Gcloud)
+    pages := make([]string, 0)
+    names := make([]string, 0)
+
+    err := gcloud.StreamDisks(context.Background(), "labels.env = production", 50, func(page []Disk) error {
+      pages = append(pages, fmt.Sprint(len(page)))
+      if len(pages) == test.failPage {
+        return pageErr
+      }
+      for diskIndex := 0; diskIndex < len(page); diskIndex++ {
+        names = append(names, page[diskIndex].Name)
+      }
+      return nil
+    })
+    if err != test.err {
+      t.Errorf("%s: got the error %v, expected %v", test.name, err, test.err)
+    }
+    if strings.Join(pages, ",") != test.pages {
+      t.Errorf("%s: got the pages %v, expected %s", test.name, pages, test.pages)
+    }
+    if test.err == nil && (len(names) != 120 || names[0] != "disk-00000" || names[119] != "disk-00119") {
+      t.Errorf("%s: got the disks %v", test.name, names)
+    }
+    // With the filter, the projection on the fields and the page size
+    listing := fake.ran("disks", "list")[0]
+    if argValue(listing, "--filter") != "labels.env = production" || argValue(listing, "--page-size") != "50" || argValue(listing, "--format") != "json(" + diskFields + ")" {
+      t.Errorf("%s: got the listing %v", test.name, listing)
+    }
+  }
+}
+
+func TestGcloudStreamDisksRetried(t *testing.T) {
+  fake := newFakeRunner(t)
+  disks := readTestdata(t, "disks.json")
+  attempts := 0
+  fake.add(&fakeRule{parts: []string{"disks", "list"}, answer: func(args []string) ([]byte, error) {
+    attempts++
+    if attempts == 1 {
+      return nil, &CommandError{Args: args, Err: errors.New("exit status 1"), Output: []byte("ERROR: HTTPError 503: Service Unavailable")}
+    }
+    return []byte(disks), nil
+  }})
+  // The first disk is handed before the failure
+  retried := &partialStreamer{streamingRunner: streamingRunner{fake}, partial: disks[:strings.Index(disks, "\n  },") + 4]}
+  gcloud := NewGcloud(RetryRunner{Commands: retried, Retry: Retry{MaxRetries: 1, Backoff: time.Millisecond, Logger: discardLogger()}})
+  names := make([]string, 0)
+
+  err := gcloud.StreamDisks(context.Background(), "", 1, func(page []Disk) error {
+    names = append(names, page[0].Name)
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Once by disk
+  if attempts != 2 || strings.Join(names, ",") != "db-data,shared-data" {
+    t.Errorf("Got %d attempts and the pages %v", attempts, names)
+  }
+}
+
+// partialStreamer streams the partial output before the error of a failing
+// command, like a listing cut by a server error.
+type partialStreamer struct {
+  streamingRunner
+  partial string
+}
+
+func (runner *partialStreamer) Stream(ctx context.Context, read func(io.Reader) error, name string, args ...string) error {
+  output, err := runner.Run(ctx, name, args...)
+  if err != nil {
+    read(strings.NewReader(runner.partial))
+    return err
+  }
+  return read(bytes.NewReader(output))
+}
+
+func BenchmarkStreamDisks(b *testing.B) {
+  disks, _ := generatedFleet(10000, 0, time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+  fake := &fakeRunner{}
+  fake.answer(disksJSON(disks), "disks", "list")
+  gcloud := NewGcloud(streamingRunner{fake})
+  b.ResetTimer()
+  for benchIndex := 0; benchIndex < b.N; benchIndex++ {
+    listed := 0
+    err := gcloud.StreamDisks(context.Background(), "", streamPageSize, func(page []Disk) error {
+      listed += len(page)
+      return nil
+    })
+    if err != nil || listed != len(disks) {
+      b.Fatalf("Got %d disks, %v", listed, err)
+    }
+  }
+}
+
+func BenchmarkListSnapshots(b *testing.B) {
+  _, snapshots := generatedFleet(10000, 3, time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+  fake := &fakeRunner{}
+  fake.answer(snapshotsJSON(snapshots), "snapshots", "list")
+  gcloud := NewGcloud(streamingRunner{fake})
+  b.ResetTimer()
+  for benchIndex := 0; benchIndex < b.N; benchIndex++ {
+    listed, err := gcloud.ListSnapshots(context.Background(), "")
+    if err != nil || len(listed) != len(snapshots) {
+      b.Fatalf("Got %d snapshots, %v", len(listed), err)
+    }
+  }
+}
+
+func TestDecodeJSONArray(t *testing.T) {
+  long := "ERROR: " + strings.Repeat("x", 300)
+  tests := []struct {
+    name     string
+    output   string
+    names    string
+    expected []string
+  }{
+    {"items", `[{"name": "a"}, {"name": "b"}]`, "a,b", nil},
+    {"no item", "[]\n", "", nil},
+    {"empty", "", "", []string{"at byte 0", "empty output, expected a JSON array", "(no output)"}},
+    {"blank", " \n", "", []string{"empty output, expected a JSON array"}},
+    {"truncated", `[{"name": "a"}, {"name": "b`, "a", []string{"at byte 14", "unexpected EOF", `, {"name": "b`}},
+    {"prompt", "Do you want to continue (Y/n)?", "", []string{"invalid character 'D'", "Do you want to continue (Y/n)?"}},
+    {"object", `{"name": "a"}`, "", []string{"expected an array"}},
+    {"unterminated", `[{"name": "a"}`, "a", []string{"at byte 14", "unexpected end of JSON input"}},
+    {"long error", long, "", []string{long[:excerptLength] + "..."}},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    names := make([]string, 0)
+    err := decodeJSONArray([]string{"compute", "disks", "list"}, strings.NewReader(test.output), func(decoder *json.Decoder) error {
+      var item struct{ Name string }
+      err := decoder.Decode(&item)
+      if err == nil {
+        names = append(names, item.Name)
+      }
+      return err
+    })
+    if strings.Join(names, ",") != test.names {
+      t.Errorf("%s: got the items %v, expected %s", test.name, names, test.names)
+    }
+    if len(test.expected) == 0 && err != nil {
+      t.Errorf("%s: got the error %v", test.name, err)
+    }
+    for expectedIndex := 0; expectedIndex < len(test.expected); expectedIndex++ {
+      if err == nil || !strings.Contains(err.Error(), test.expected[expectedIndex]) || !strings.HasPrefix(err.Error(), "Invalid JSON output of `gcloud compute disks list`") {
+        t.Errorf("%s: got the error %v, expected %s", test.name, err, test.expected[expectedIndex])
+      }
+    }
+  }
+}
+
+func TestOutputExcerpt(t *testing.T) {
+  tests := []struct {
+    output   string
+    expected string
+  }{
+    {"  ERROR: denied\n", "ERROR: denied"},
+    {"\n", "(no output)"},
+    {strings.Repeat("a", excerptLength + 1), strings.Repeat("a", excerptLength) + "..."},
+    {strings.Repeat("a", excerptLength), strings.Repeat("a", excerptLength)},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    if outputExcerpt([]byte(test.output)) != test.expected {
+      t.Errorf("Output %q: got %q, expected %q", test.output, outputExcerpt([]byte(test.output)), test.expected)
+    }
+  }
+}
@@ -0,0 +1,73 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "strings"
+
+  "google.golang.org/api/option"
+)
+
+// GCSReport uploads the summary and the plan of each run to GCS, for an
+// audit.
+type GCSReport struct {
+  // As gs://<bucket>/ or gs://<bucket>/<prefix>/, the objects are named after
+  // it
+  Prefix          string
+  // Service account key file, the Application Default Credentials if empty
+  CredentialsFile string
+  // Retries of the failed uploads, 2 if 0
+  Retry           Retry
+}
+
+// reportObjectName returns the name of the objects of the run, from its time,
+// project and plan, like 20261014T020000Z-my-project-nightly.
+func reportObjectName(summary Summary) string {
+  name := summary.StartedAt.UTC().Format("20060102T150405Z") + "-" + summary.Project
+  if summary.Plan != "" {
+    name += "-" + summary.Plan
+  }
+  return name
+}
+
+// Upload uploads the summary as <prefix><name>.json and the plan as
+// <prefix><name>-plan.json, and returns their URIs.
+func (report GCSReport) Upload(ctx context.Context, summary Summary, plan RunPlan) ([]string, error) {
+  retry := report.Retry
+  if retry.MaxRetries == 0 {
+    retry.MaxRetries = 2
+  }
+  options := make([]option.ClientOption, 0)
+  if report.CredentialsFile != "" {
+    options = append(options, option.WithAuthCredentialsFile(option.ServiceAccount, report.CredentialsFile))
+  }
+
+  prefix := report.Prefix
+  if !strings.HasSuffix(prefix, "/") {
+    prefix += "/"
+  }
+  name := reportObjectName(summary)
+  objects := []struct {
+    uri     string
+    content interface{}
+  }{
+    {prefix + name + ".json", summary},
+    {prefix + name + "-plan.json", plan},
+  }
+  uploaded := make([]string, 0, len(objects))
+  for objectIndex := 0; objectIndex < len(objects); objectIndex++ {
+    data, err := json.MarshalIndent(objects[objectIndex].content, "", "  ")
+    if err != nil {
+      return uploaded, err
+    }
+    uri := objects[objectIndex].uri
+    err = retry.Do(ctx, "upload of " + uri, func() error {
+      return writeGCS(ctx, uri, append(data, '\n'), "application/json", options...)
+    })
+    if err != nil {
+      return uploaded, err
+    }
+    uploaded = append(uploaded, uri)
+  }
+  return uploaded, nil
+}
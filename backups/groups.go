@@ -0,0 +1,95 @@
+package backups
+
+import (
+  "strings"
+  "time"
+)
+
+// SnapshotGroup is the set of snapshots of the disks of an instance, created
+// together and sharing the GroupLabel, to restore them as a whole.
+type SnapshotGroup struct {
+  Id        string   `json:"id"`
+  Instance  string   `json:"instance"`
+  Disks     []string `json:"disks"`
+  // Snapshots created, without the ones of the failed disks
+  Snapshots []string `json:"snapshots"`
+}
+
+// diskGroup is a set of disks snapshotted together.
+type diskGroup struct {
+  id          string
+  instance    string
+  diskIndexes []int
+}
+
+// groupDisksByInstance groups the disks by instance, with an id made of the
+// time and the instance. A disk attached to several instances joins the group
+// of the first one having a group. It returns the groups, and the bursts of
+// disks to create together: one by group, then the disks attached to no
+// instance.
+func (runner *Runner) groupDisksByInstance(disks []Disk, now time.Time) ([]diskGroup, [][]int) {
+  groups := make([]diskGroup, 0)
+  groupByInstance := make(map[string]int)
+  ungrouped := make([]int, 0)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    users := disks[diskIndex].Users
+    if len(users) == 0 {
+      ungrouped = append(ungrouped, diskIndex)
+      continue
+    }
+    groupIndex := -1
+    for userIndex := 0; userIndex < len(users) && groupIndex < 0; userIndex++ {
+      found, isFound := groupByInstance[users[userIndex]]
+      if isFound {
+        groupIndex = found
+      }
+    }
+    if groupIndex < 0 {
+      groupIndex = len(groups)
+      groups = append(groups, diskGroup{id: sanitizeLabel(now.UTC().Format("20060102-150405") + "-" + users[0]), instance: users[0]})
+    }
+    for userIndex := 0; userIndex < len(users); userIndex++ {
+      if _, isFound := groupByInstance[users[userIndex]]; !isFound {
+        groupByInstance[users[userIndex]] = groupIndex
+      }
+    }
+    groups[groupIndex].diskIndexes = append(groups[groupIndex].diskIndexes, diskIndex)
+  }
+
+  bursts := make([][]int, 0, len(groups) + 1)
+  for groupIndex := 0; groupIndex < len(groups); groupIndex++ {
+    group := groups[groupIndex]
+    names := make([]string, 0, len(group.diskIndexes))
+    for groupDiskIndex := 0; groupDiskIndex < len(group.diskIndexes); groupDiskIndex++ {
+      names = append(names, disks[group.diskIndexes[groupDiskIndex]].Name)
+    }
+    runner.logger.Printf("Group %s of instance %s: %s\n", group.id, group.instance, strings.Join(names, ", "))
+    if runner.options.Concurrency > 0 && len(group.diskIndexes) > runner.options.Concurrency {
+      runner.levels.Warning.Printf("WARNING: the %d disks of instance %s are more than the concurrency, they are not all snapshotted at once\n", len(group.diskIndexes), group.instance)
+    }
+    bursts = append(bursts, group.diskIndexes)
+  }
+  if len(ungrouped) > 0 {
+    bursts = append(bursts, ungrouped)
+  }
+  return groups, bursts
+}
+
+// snapshotGroups returns the groups with the names of their disks and of
+// their created snapshots, by disk index.
+func snapshotGroups(groups []diskGroup, disks []Disk, createdNames []string) []SnapshotGroup {
+  snapshotGroups := make([]SnapshotGroup, 0, len(groups))
+  for groupIndex := 0; groupIndex < len(groups); groupIndex++ {
+    group := groups[groupIndex]
+    snapshotGroup := SnapshotGroup{Id: group.id, Instance: group.instance, Disks: make([]string, 0), Snapshots: make([]string, 0)}
+    for groupDiskIndex := 0; groupDiskIndex < len(group.diskIndexes); groupDiskIndex++ {
+      diskIndex := group.diskIndexes[groupDiskIndex]
+      snapshotGroup.Disks = append(snapshotGroup.Disks, disks[diskIndex].Name)
+      if createdNames[diskIndex] != "" {
+        snapshotGroup.Snapshots = append(snapshotGroup.Snapshots, createdNames[diskIndex])
+      }
+    }
+    snapshotGroups = append(snapshotGroups, snapshotGroup)
+  }
+  return snapshotGroups
+}
@@ -0,0 +1,62 @@
+package backups
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+)
+
+// ErrTooManyDeletions aborts the prune phase when it would delete more
+// snapshots than the deletion limits.
+var ErrTooManyDeletions = errors.New("Too many snapshots to delete")
+
+// DeletionLimits bounds the deletions of a prune phase, against a wrong
+// retention.
+type DeletionLimits struct {
+  // Number of deletions, no limit if 0
+  MaxDeletions int
+  // Percentage of the snapshots of the disks, no limit if 0
+  MaxPercent   float64
+}
+
+// Check returns ErrTooManyDeletions if deleting these snapshots, among the
+// total of the disks, exceeds a limit.
+func (limits DeletionLimits) Check(deletions int, total int) error {
+  if limits.MaxDeletions > 0 && deletions > limits.MaxDeletions {
+    return fmt.Errorf("%w: %d snapshot(s), more than the maximum of %d", ErrTooManyDeletions, deletions, limits.MaxDeletions)
+  }
+  if limits.MaxPercent > 0 && total > 0 && deletionPercent(deletions, total) > limits.MaxPercent {
+    return fmt.Errorf("%w: %d of the %d snapshot(s) (%.1f%%), more than the maximum of %g%%", ErrTooManyDeletions, deletions, total, deletionPercent(deletions, total), limits.MaxPercent)
+  }
+  return nil
+}
+
+func (limits DeletionLimits) String() string {
+  bounds := make([]string, 0, 2)
+  if limits.MaxDeletions > 0 {
+    bounds = append(bounds, fmt.Sprintf("%d deletion(s)", limits.MaxDeletions))
+  }
+  if limits.MaxPercent > 0 {
+    bounds = append(bounds, fmt.Sprintf("%g%% of the snapshots", limits.MaxPercent))
+  }
+  if len(bounds) == 0 {
+    return "no deletion limit"
+  }
+  return "at most " + strings.Join(bounds, " and ")
+}
+
+func deletionPercent(deletions int, total int) float64 {
+  return float64(deletions) * 100 / float64(total)
+}
+
+// referencingResource returns the first image or disk created from the
+// snapshot, by name or id, or an empty string if there is none.
+func referencingResource(snapshot Snapshot, references []SnapshotReference) string {
+  for referenceIndex := 0; referenceIndex < len(references); referenceIndex++ {
+    reference := references[referenceIndex]
+    if (reference.SnapshotName != "" && reference.SnapshotName == snapshot.Name) || (reference.SnapshotId != "" && reference.SnapshotId == snapshot.Id) {
+      return reference.Resource
+    }
+  }
+  return ""
+}
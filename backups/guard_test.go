@@ -0,0 +1,108 @@
+package backups
+
+import (
+  "context"
+  "strings"
+  "testing"
+)
+
+func TestGcloudListSnapshotReferences(t *testing.T) {
+  fake := newFakeRunner(t)
+  fake.answer(readTestdata(t, "images.json"), "compute", "images", "list")
+  fake.answer(readTestdata(t, "restored_disks.json"), "compute", "disks", "list", "sourceSnapshotId:*")
+
+  references, err := NewGcloud(fake).WithProject("proj").ListSnapshotReferences(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := []SnapshotReference{
+    {SnapshotName: "db-data-1", SnapshotId: "9000000000000000001", Resource: "image db-image"},
+    {SnapshotName: "db-data-2", SnapshotId: "9000000000000000002", Resource: "disk db-restored"},
+  }
+  if len(references) != len(expected) {
+    t.Fatalf("Got the references %+v", references)
+  }
+  for referenceIndex := 0; referenceIndex < len(expected); referenceIndex++ {
+    if references[referenceIndex] != expected[referenceIndex] {
+      t.Errorf("Got the reference %+v, expected %+v", references[referenceIndex], expected[referenceIndex])
+    }
+  }
+  // The public images can't come from the snapshots of the project
+  if len(fake.ran("compute", "images", "list", "--no-standard-images")) != 1 {
+    t.Errorf("Got the listings %v", fake.commands)
+  }
+}
+
+func TestReferencingResource(t *testing.T) {
+  references := []SnapshotReference{
+    {SnapshotName: "db-data-1", SnapshotId: "9000000000000000001", Resource: "image db-image"},
+    {SnapshotId: "9000000000000000002", Resource: "disk db-restored"},
+  }
+  tests := []struct {
+    name     string
+    snapshot Snapshot
+    expected string
+  }{
+    {"by name", Snapshot{Name: "db-data-1"}, "image db-image"},
+    {"by id", Snapshot{Name: "renamed", Id: "9000000000000000002"}, "disk db-restored"},
+    {"not referenced", Snapshot{Name: "db-data-3", Id: "9000000000000000003"}, ""},
+    // The empty names and ids of the references don't match
+    {"without id", Snapshot{Name: "db-data-3"}, ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    resource := referencingResource(test.snapshot, references)
+    if resource != test.expected {
+      t.Errorf("%s: got '%s', expected '%s'", test.name, resource, test.expected)
+    }
+  }
+}
+
+func TestRunReferencedSnapshots(t *testing.T) {
+  tests := []struct {
+    name       string
+    images     string
+    disks      string
+    options    Options
+    deleted    string
+    referenced string
+    warning    string
+  }{
+    {"image", "images.json", "", Options{}, "db-data-2", "db-data-1", "WARNING: keeping snapshot db-data-1 of disk db-data: used by image db-image"},
+    {"disk", "", "restored_disks.json", Options{}, "db-data-1", "db-data-2", "WARNING: keeping snapshot db-data-2 of disk db-data: used by disk db-restored"},
+    {"image and disk", "images.json", "restored_disks.json", Options{}, "", "db-data-1,db-data-2", ""},
+    // Deleted since, so not listed anymore
+    {"deleted resources", "", "", Options{}, "db-data-1,db-data-2", "", ""},
+    {"forced", "images.json", "restored_disks.json", Options{ForceDeleteReferenced: true}, "db-data-1,db-data-2", "", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    if test.images != "" {
+      fake.answer(readTestdata(t, test.images), "compute", "images", "list")
+    }
+    if test.disks != "" {
+      fake.answer(readTestdata(t, test.disks), "compute", "disks", "list", "sourceSnapshotId:*")
+    }
+    runner, logs := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if sortedNames(result.Deleted) != test.deleted || sortedNames(result.Referenced) != test.referenced {
+      t.Errorf("%s: got %s deleted and %s referenced, expected %s and %s", test.name, sortedNames(result.Deleted), sortedNames(result.Referenced), test.deleted, test.referenced)
+    }
+    if test.warning != "" && !containsLine(logs.String(), test.warning) {
+      t.Errorf("%s: expected '%s' in:\n%s", test.name, test.warning, logs)
+    }
+    // Listed once for the run, and not at all when forced
+    listings := len(fake.ran("compute", "images", "list"))
+    if test.options.ForceDeleteReferenced != (listings == 0) || listings > 1 {
+      t.Errorf("%s: got %d listings of the images", test.name, listings)
+    }
+    if strings.Contains(sortedNames(result.Deleted), "db-data-3") {
+      t.Errorf("%s: deleted db-data-3, kept by the retention", test.name)
+    }
+  }
+}
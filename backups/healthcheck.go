@@ -0,0 +1,70 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// Timeout of the pings, so an unreachable service doesn't hang the backup
+const healthcheckTimeout = 5 * time.Second
+
+// Healthcheck pings a dead man's switch like healthchecks.io when the backup
+// starts and ends.
+type Healthcheck struct {
+  // Pinged on success, with the /start suffix on start
+  URL     string
+  // Pinged on failure, URL with the /fail suffix if empty
+  FailURL string
+  // POST the report as JSON on success and failure, instead of a GET
+  Post    bool
+  // http.DefaultClient if nil
+  Client  *http.Client
+}
+
+// Start pings the start URL.
+func (healthcheck Healthcheck) Start(ctx context.Context) error {
+  return healthcheck.get(ctx, strings.TrimSuffix(healthcheck.URL, "/") + "/start")
+}
+
+// Finish pings the success or failure URL, according to the exit code of the
+// report.
+func (healthcheck Healthcheck) Finish(ctx context.Context, report Report) error {
+  url := healthcheck.URL
+  if report.ExitCode != ExitOK {
+    url = healthcheck.FailURL
+    if url == "" {
+      url = strings.TrimSuffix(healthcheck.URL, "/") + "/fail"
+    }
+  }
+  if healthcheck.Post {
+    ctx, cancel := context.WithTimeout(ctx, healthcheckTimeout)
+    defer cancel()
+    return postJSON(ctx, healthcheck.Client, url, report)
+  }
+  return healthcheck.get(ctx, url)
+}
+
+func (healthcheck Healthcheck) get(ctx context.Context, url string) error {
+  ctx, cancel := context.WithTimeout(ctx, healthcheckTimeout)
+  defer cancel()
+  request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+  if err != nil {
+    return err
+  }
+  client := healthcheck.Client
+  if client == nil {
+    client = http.DefaultClient
+  }
+  response, err := client.Do(request)
+  if err != nil {
+    return err
+  }
+  defer response.Body.Close()
+  if response.StatusCode < 200 || response.StatusCode >= 300 {
+    return fmt.Errorf("GET %s: %s", request.URL.Host, response.Status)
+  }
+  return nil
+}
@@ -0,0 +1,87 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// pingRecorder records the pings of a healthcheck server.
+type pingRecorder struct {
+  mutex  sync.Mutex
+  pings  []string
+  bodies []string
+  // Of the responses, 200 if 0
+  status int
+}
+
+func (recorder *pingRecorder) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+  recorder.mutex.Lock()
+  defer recorder.mutex.Unlock()
+  recorder.pings = append(recorder.pings, request.Method + " " + request.URL.Path)
+  body := make([]byte, 0)
+  if request.Body != nil {
+    var decoded map[string]interface{}
+    if json.NewDecoder(request.Body).Decode(&decoded) == nil {
+      body, _ = json.Marshal(decoded["exitCode"])
+    }
+  }
+  recorder.bodies = append(recorder.bodies, string(body))
+  if recorder.status != 0 {
+    writer.WriteHeader(recorder.status)
+  }
+}
+
+func TestHealthcheckPings(t *testing.T) {
+  tests := []struct {
+    name     string
+    failURL  string
+    post     bool
+    exitCode int
+    expected string
+  }{
+    {"success", "", false, ExitOK, "GET /check/start,GET /check"},
+    {"failure", "", false, ExitPartialFailure, "GET /check/start,GET /check/fail"},
+    {"failure URL", "/alert", false, ExitListingFailure, "GET /check/start,GET /alert"},
+    {"post", "", true, ExitPartialFailure, "GET /check/start,POST /check/fail"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    recorder := &pingRecorder{}
+    server := httptest.NewServer(recorder)
+    healthcheck := Healthcheck{URL: server.URL + "/check", Post: test.post}
+    if test.failURL != "" {
+      healthcheck.FailURL = server.URL + test.failURL
+    }
+
+    err := healthcheck.Start(context.Background())
+    if err == nil {
+      err = healthcheck.Finish(context.Background(), Report{ExitCode: test.exitCode})
+    }
+    server.Close()
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if strings.Join(recorder.pings, ",") != test.expected {
+      t.Errorf("%s: got the pings %v, expected %s", test.name, recorder.pings, test.expected)
+    }
+    if test.post && recorder.bodies[1] != "1" {
+      t.Errorf("%s: got the exit code %s in the report", test.name, recorder.bodies[1])
+    }
+  }
+}
+
+func TestHealthcheckError(t *testing.T) {
+  recorder := &pingRecorder{status: http.StatusNotFound}
+  server := httptest.NewServer(recorder)
+  defer server.Close()
+
+  err := Healthcheck{URL: server.URL + "/check"}.Start(context.Background())
+  if err == nil || !strings.Contains(err.Error(), "404") {
+    t.Errorf("Got the error %v", err)
+  }
+}
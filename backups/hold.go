@@ -0,0 +1,51 @@
+package backups
+
+import (
+  "time"
+)
+
+const (
+  // Label of the snapshots to never delete, with the value "true"
+  HoldLabel = "backup-hold"
+  // Label of the snapshots to not delete until a date, like 2026-09-30
+  HoldUntilLabel = "hold-until"
+)
+
+// Layout of the date of the HoldUntilLabel, the last day of the hold
+const holdUntilLayout = "2006-01-02"
+
+// HoldReason returns why the snapshot is held and must not be deleted, or an
+// empty string if it's not. A hold-until date which can't be parsed holds the
+// snapshot, to be safe.
+func HoldReason(snapshot Snapshot, now time.Time) string {
+  if snapshot.Labels[HoldLabel] == "true" {
+    return "label " + HoldLabel + "=true"
+  }
+  value, found := snapshot.Labels[HoldUntilLabel]
+  if !found {
+    return ""
+  }
+  until, err := time.Parse(holdUntilLayout, value)
+  if err != nil {
+    return "invalid label " + HoldUntilLabel + "=" + value
+  }
+  // Held until the end of the day, in UTC
+  if now.Before(until.AddDate(0, 0, 1)) {
+    return "held until " + value
+  }
+  return ""
+}
+
+// withoutHeld returns the snapshots which are not held, and the held ones.
+func withoutHeld(snapshots []Snapshot, now time.Time) ([]Snapshot, []Snapshot) {
+  kept := make([]Snapshot, 0, len(snapshots))
+  held := make([]Snapshot, 0)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    if HoldReason(snapshots[snapshotIndex], now) != "" {
+      held = append(held, snapshots[snapshotIndex])
+      continue
+    }
+    kept = append(kept, snapshots[snapshotIndex])
+  }
+  return kept, held
+}
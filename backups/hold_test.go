@@ -0,0 +1,165 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestHoldReason(t *testing.T) {
+  // The last instant of the hold, and the first one after it
+  lastInstant := time.Date(2026, 9, 30, 23, 59, 59, 999999999, time.UTC)
+  tests := []struct {
+    name     string
+    labels   map[string]string
+    now      time.Time
+    expected string
+  }{
+    {"hold", map[string]string{HoldLabel: "true"}, lastInstant, "label backup-hold=true"},
+    {"hold false", map[string]string{HoldLabel: "false"}, lastInstant, ""},
+    {"no label", map[string]string{CreatedByLabel: CreatedByValue}, lastInstant, ""},
+    {"before the day", map[string]string{HoldUntilLabel: "2026-09-30"}, time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), "held until 2026-09-30"},
+    {"start of the day", map[string]string{HoldUntilLabel: "2026-09-30"}, time.Date(2026, 9, 30, 0, 0, 0, 0, time.UTC), "held until 2026-09-30"},
+    {"end of the day", map[string]string{HoldUntilLabel: "2026-09-30"}, lastInstant, "held until 2026-09-30"},
+    {"day after", map[string]string{HoldUntilLabel: "2026-09-30"}, lastInstant.Add(time.Nanosecond), ""},
+    // Still the 30th in Los Angeles, but the day is in UTC
+    {"day after in UTC", map[string]string{HoldUntilLabel: "2026-09-30"}, time.Date(2026, 9, 30, 18, 0, 0, 0, time.FixedZone("PDT", -7 * 3600)), ""},
+    {"invalid date", map[string]string{HoldUntilLabel: "2026-02-30"}, lastInstant, "invalid label hold-until=2026-02-30"},
+    {"invalid layout", map[string]string{HoldUntilLabel: "30-09-2026"}, lastInstant, "invalid label hold-until=30-09-2026"},
+    {"empty date", map[string]string{HoldUntilLabel: ""}, lastInstant, "invalid label hold-until="},
+    {"both", map[string]string{HoldLabel: "true", HoldUntilLabel: "2026-01-01"}, lastInstant, "label backup-hold=true"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    reason := HoldReason(Snapshot{Name: "snap", Labels: test.labels}, test.now)
+    if reason != test.expected {
+      t.Errorf("%s: got '%s', expected '%s'", test.name, reason, test.expected)
+    }
+  }
+}
+
+func TestWithoutHeld(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  held := testSnapshot("held", "1", now.Add(-3 * 24 * time.Hour))
+  held.Labels[HoldLabel] = "true"
+  until := testSnapshot("until", "1", now.Add(-2 * 24 * time.Hour))
+  until.Labels[HoldUntilLabel] = "2026-10-14"
+  expired := testSnapshot("expired", "1", now.Add(-24 * time.Hour))
+  expired.Labels[HoldUntilLabel] = "2026-10-13"
+  invalid := testSnapshot("invalid", "1", now.Add(-4 * 24 * time.Hour))
+  invalid.Labels[HoldUntilLabel] = "soon"
+  free := testSnapshot("free", "1", now)
+
+  kept, heldSnapshots := withoutHeld([]Snapshot{free, held, until, expired, invalid}, now)
+  if snapshotNames(kept) != "free,expired" || snapshotNames(heldSnapshots) != "held,until,invalid" {
+    t.Errorf("Got %s not held and %s held", snapshotNames(kept), snapshotNames(heldSnapshots))
+  }
+}
+
+func TestRunHeldSnapshots(t *testing.T) {
+  now := time.Now().UTC()
+  tests := []struct {
+    name    string
+    labels  map[string]string
+    deleted string
+    held    string
+  }{
+    {"hold", map[string]string{HoldLabel: "true"}, "db-data-2", "db-data-1"},
+    {"hold until today", map[string]string{HoldUntilLabel: now.Format(holdUntilLayout)}, "db-data-2", "db-data-1"},
+    // The next older one isn't deleted in its place
+    {"hold ended", map[string]string{HoldUntilLabel: now.AddDate(0, 0, -1).Format(holdUntilLayout)}, "db-data-1,db-data-2", ""},
+    {"invalid", map[string]string{HoldUntilLabel: "2026-13-01"}, "db-data-2", "db-data-1"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.answer(heldSnapshotsJSON(t, "db-data-1", test.labels), "compute", "snapshots", "list")
+    runner, logs := newTestRunner(fake, Options{})
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if sortedNames(result.Deleted) != test.deleted || sortedNames(result.Held) != test.held {
+      t.Errorf("%s: got %s deleted and %s held, expected %s and %s", test.name, sortedNames(result.Deleted), sortedNames(result.Held), test.deleted, test.held)
+    }
+    if test.held != "" && !containsLine(logs.String(), "Keeping snapshot db-data-1 of disk db-data: ") {
+      t.Errorf("%s: the hold not logged in:\n%s", test.name, logs)
+    }
+  }
+}
+
+func TestApplyPlanHeld(t *testing.T) {
+  tests := []struct {
+    name    string
+    // Listings of the snapshots after which db-data-1 is held
+    listed  int
+    options Options
+    deleted string
+    held    string
+  }{
+    {"held before the apply", 0, Options{}, "db-data-2", "db-data-1"},
+    // Between the listing of the apply and its deletions
+    {"held during the apply", 1, Options{}, "db-data-2", "db-data-1"},
+    {"held during the apply without refresh", 1, Options{NoRefresh: true}, "db-data-1,db-data-2", ""},
+    {"not held", 10, Options{}, "db-data-1,db-data-2", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    plan := dryRunPlan(t)
+    fake := newFakeRunner(t)
+    snapshots := readTestdata(t, "snapshots.json")
+    heldSnapshots := heldSnapshotsJSON(t, "db-data-1", map[string]string{HoldLabel: "true"})
+    var mutex sync.Mutex
+    listings := 0
+    fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list"}, answer: func(args []string) ([]byte, error) {
+      mutex.Lock()
+      defer mutex.Unlock()
+      listings++
+      if listings > test.listed {
+        return filterSnapshotsJSON(heldSnapshots, argValue(args, "--filter"))
+      }
+      return filterSnapshotsJSON(snapshots, argValue(args, "--filter"))
+    }})
+    runner, _ := newTestRunner(fake, test.options)
+
+    result, err := runner.Apply(context.Background(), plan)
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    // Planned by name, deleted regardless of the retention unless held
+    if sortedNames(result.Deleted) != test.deleted || sortedNames(result.Held) != test.held {
+      t.Errorf("%s: got %s deleted and %s held, expected %s and %s", test.name, sortedNames(result.Deleted), sortedNames(result.Held), test.deleted, test.held)
+    }
+    if len(result.Skipped) != 0 {
+      t.Errorf("%s: got the disks skipped %v", test.name, result.Skipped)
+    }
+    if strings.Contains(sortedNames(result.Deleted), "db-data-3") {
+      t.Errorf("%s: deleted db-data-3, not in the plan", test.name)
+    }
+  }
+}
+
+// heldSnapshotsJSON returns the snapshots of the fixture, the one named with
+// the labels added.
+func heldSnapshotsJSON(t *testing.T, name string, labels map[string]string) string {
+  var items []map[string]interface{}
+  err := json.Unmarshal([]byte(readTestdata(t, "snapshots.json")), &items)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for itemIndex := 0; itemIndex < len(items); itemIndex++ {
+    if items[itemIndex]["name"] != name {
+      continue
+    }
+    itemLabels := items[itemIndex]["labels"].(map[string]interface{})
+    for key, value := range labels {
+      itemLabels[key] = value
+    }
+  }
+  output, _ := json.Marshal(items)
+  return string(output)
+}
@@ -0,0 +1,303 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "sort"
+  "strings"
+  "time"
+)
+
+// DefaultInstantNameTemplate is the template of the instant snapshot names,
+// which never collide with the snapshot names of DefaultNameTemplate.
+const DefaultInstantNameTemplate = "{disk}-{diskId}-instant-{date:20060102150405}-{random}"
+
+// ErrInstantSnapshotsFailed is returned by Run when only instant snapshots
+// failed, after processing all the disks.
+var ErrInstantSnapshotsFailed = errors.New("Instant snapshots failed")
+
+// InstantSnapshot is a point-in-time copy of a disk kept in its zone or
+// region: faster to create and restore than a snapshot, but lost with the
+// zone, and with its own quota.
+type InstantSnapshot struct {
+  Name              string
+  Id                string
+  // Zero if missing or unparsable
+  CreationTimestamp time.Time
+  // CREATING, READY, FAILED, DELETING or UNAVAILABLE
+  Status            string
+  // Short names, the zone is empty for the regional ones
+  Zone              string
+  Region            string
+  Labels            map[string]string
+  SourceDisk        string
+  SourceDiskId      string
+  DiskSizeGb        int64
+}
+
+func (snapshot *InstantSnapshot) UnmarshalJSON(data []byte) error {
+  var raw struct {
+    Name              string            `json:"name"`
+    Id                string            `json:"id"`
+    CreationTimestamp string            `json:"creationTimestamp"`
+    Status            string            `json:"status"`
+    // URLs of the zone, region and disk
+    Zone              string            `json:"zone"`
+    Region            string            `json:"region"`
+    Labels            map[string]string `json:"labels"`
+    SourceDisk        string            `json:"sourceDisk"`
+    SourceDiskId      string            `json:"sourceDiskId"`
+    // A string in the JSON of the API
+    DiskSizeGb        int64             `json:"diskSizeGb,string"`
+  }
+  err := json.Unmarshal(data, &raw)
+  if err != nil {
+    return err
+  }
+
+  snapshot.Name = raw.Name
+  snapshot.Id = raw.Id
+  snapshot.CreationTimestamp = parseTimestamp(raw.CreationTimestamp)
+  snapshot.Status = raw.Status
+  snapshot.Zone = lastPathPart(raw.Zone)
+  snapshot.Region = lastPathPart(raw.Region)
+  snapshot.Labels = raw.Labels
+  snapshot.SourceDisk = lastPathPart(raw.SourceDisk)
+  snapshot.SourceDiskId = raw.SourceDiskId
+  snapshot.DiskSizeGb = raw.DiskSizeGb
+
+  return nil
+}
+
+// Location returns the region of the regional instant snapshots, else their
+// zone.
+func (snapshot InstantSnapshot) Location() string {
+  if snapshot.Region != "" {
+    return snapshot.Region
+  }
+  return snapshot.Zone
+}
+
+// sortInstantSnapshots sorts the instant snapshots newest first, the ones
+// without a creation timestamp last.
+func sortInstantSnapshots(snapshots []InstantSnapshot) {
+  sort.SliceStable(snapshots, func(i int, j int) bool {
+    if snapshots[j].CreationTimestamp.IsZero() {
+      return !snapshots[i].CreationTimestamp.IsZero()
+    }
+    return snapshots[i].CreationTimestamp.After(snapshots[j].CreationTimestamp)
+  })
+}
+
+// instantResult is the outcome of the instant snapshots of a disk.
+type instantResult struct {
+  diskIndex int
+  created   *InstantSnapshot
+  deleted   []InstantSnapshot
+  failures  []Failure
+}
+
+// instantSnapshots creates an instant snapshot of each disk, unless in prune
+// mode, then deletes the instant snapshots created by this program beyond the
+// instant limit of each disk, unless in backup mode. The disks whose instant
+// snapshot failed keep their old ones, and the deferred disks are left alone.
+// The failures are not the ones of the snapshots, as the instant snapshots have
+// their own quota.
+func (runner *Runner) instantSnapshots(ctx context.Context, disks []Disk, deferred []bool, mode string, result *Result) {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+
+  if mode != ModePrune {
+    logger.Println("Creating instant snapshots...")
+  } else {
+    logger.Printf("Deleting old instant snapshots (keeping %d by disk)\n", runner.options.InstantLimit)
+  }
+  results := make(chan instantResult, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    go func(diskIndex int, disk Disk) {
+      diskResult := instantResult{diskIndex: diskIndex}
+      defer func() {
+        results <- diskResult
+      }()
+      // Neither created nor pruned, as the snapshot
+      if deferred[diskIndex] {
+        return
+      }
+      _, isResumed := runner.options.Resumed[disk.Id]
+      if mode != ModePrune && !isResumed && !supportOf(disk).Instant {
+        name, _ := TemplateSnapshotName(DefaultInstantNameTemplate, disk, time.Now())
+        diskResult.failures = append(diskResult.failures, Failure{Disk: disk.Name, Snapshot: name, Err: unsupportedError(disk, "Instant snapshots")})
+        return
+      }
+      if mode != ModePrune && !isResumed {
+        created, err := runner.createInstantSnapshot(ctx, disk)
+        if err != nil {
+          diskResult.failures = append(diskResult.failures, Failure{Disk: disk.Name, Snapshot: created.Name, Err: err})
+          return
+        }
+        diskResult.created = &created
+      }
+      // Once stopped, no deletion is started
+      if mode == ModeBackup || runner.stopped(ctx) != nil {
+        return
+      }
+      diskResult.deleted, diskResult.failures = runner.pruneInstantSnapshots(ctx, disk, diskResult.created)
+    }(diskIndex, disks[diskIndex])
+  }
+
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    // Received in completion order, not in disks order
+    diskResult := <-results
+    disk := disks[diskResult.diskIndex]
+    if diskResult.created != nil {
+      result.InstantCreated = append(result.InstantCreated, *diskResult.created)
+      if dryRun {
+        logger.Printf("[DRY-RUN] Would create instant snapshot %s for disk %s in %s\n", diskResult.created.Name, disk.Name, disk.Location())
+      } else {
+        logger.Printf("Created instant snapshot %s for disk %s in %s\n", diskResult.created.Name, disk.Name, disk.Location())
+      }
+    }
+    for deletedIndex := 0; deletedIndex < len(diskResult.deleted); deletedIndex++ {
+      deleted := diskResult.deleted[deletedIndex]
+      result.InstantDeleted = append(result.InstantDeleted, deleted)
+      if dryRun {
+        logger.Printf("[DRY-RUN] Would delete instant snapshot %s of disk %s\n", deleted.Name, disk.Name)
+      } else {
+        logger.Printf("Deleted instant snapshot %s of disk %s\n", deleted.Name, disk.Name)
+      }
+    }
+    for failureIndex := 0; failureIndex < len(diskResult.failures); failureIndex++ {
+      failure := diskResult.failures[failureIndex]
+      runner.levels.Warning.Printf("Instant snapshot %s of disk %s failed: %s\n", failure.Snapshot, disk.Name, failure.Err)
+      result.InstantFailures = append(result.InstantFailures, failure)
+    }
+  }
+  if dryRun {
+    logger.Printf("[DRY-RUN] %d instant snapshots would be created, %d deleted\n", len(result.InstantCreated), len(result.InstantDeleted))
+  } else {
+    logger.Printf("Created %d instant snapshots, deleted %d\n", len(result.InstantCreated), len(result.InstantDeleted))
+  }
+  logger.Println("")
+}
+
+// createInstantSnapshot creates the instant snapshot of the disk, with the
+// labels of its snapshots.
+func (runner *Runner) createInstantSnapshot(ctx context.Context, disk Disk) (InstantSnapshot, error) {
+  if !runner.acquire(ctx) {
+    return InstantSnapshot{}, runner.stopped(ctx)
+  }
+  defer runner.release()
+  operationCtx, cancel := runner.operationContext(ctx)
+  defer cancel()
+
+  now := time.Now()
+  name, err := TemplateSnapshotName(DefaultInstantNameTemplate, disk, now)
+  labels, _ := SnapshotLabels(disk, runner.options.Labels)
+  snapshot := InstantSnapshot{Name: name, CreationTimestamp: now, Zone: disk.Zone, Region: disk.Region, Labels: labels, SourceDisk: disk.Name, SourceDiskId: disk.Id}
+  if err != nil {
+    return snapshot, err
+  }
+  runner.logger.Printf("Creating instant snapshot for disk %s\n", disk.Name)
+  err = runner.backend.CreateInstantSnapshot(operationCtx, disk, name, labels, runner.options.DryRun)
+  if err != nil && IsAlreadyExists(err) {
+    runner.levels.Warning.Printf("WARNING: instant snapshot %s for disk %s already exists: %s\n", name, disk.Name, err)
+    return snapshot, nil
+  }
+  return snapshot, runner.operationError(ctx, operationCtx, err)
+}
+
+// pruneInstantSnapshots deletes the instant snapshots of the disk created by
+// this program beyond the instant limit, newest first, the created one
+// included. The held ones are kept, and not counted.
+func (runner *Runner) pruneInstantSnapshots(ctx context.Context, disk Disk, created *InstantSnapshot) ([]InstantSnapshot, []Failure) {
+  deleted := make([]InstantSnapshot, 0)
+  failures := make([]Failure, 0)
+
+  listed, err := runner.backend.GetDiskInstantSnapshots(ctx, disk)
+  if err != nil {
+    return deleted, append(failures, Failure{Disk: disk.Name, Err: fmt.Errorf("Listing of the instant snapshots: %w", err)})
+  }
+  snapshots := make([]InstantSnapshot, 0, len(listed) + 1)
+  // Not listed yet in dry-run mode
+  if created != nil {
+    snapshots = append(snapshots, *created)
+  }
+  now := time.Now()
+  for snapshotIndex := 0; snapshotIndex < len(listed); snapshotIndex++ {
+    snapshot := listed[snapshotIndex]
+    if snapshot.Labels[CreatedByLabel] != CreatedByValue || (created != nil && snapshot.Name == created.Name) {
+      continue
+    }
+    reason := HoldReason(Snapshot{Name: snapshot.Name, Labels: snapshot.Labels}, now)
+    if reason != "" {
+      runner.logger.Printf("Keeping instant snapshot %s of disk %s: %s\n", snapshot.Name, disk.Name, reason)
+      continue
+    }
+    snapshots = append(snapshots, snapshot)
+  }
+
+  for snapshotIndex := runner.options.InstantLimit; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    if !runner.acquire(ctx) {
+      failures = append(failures, Failure{Disk: disk.Name, Snapshot: snapshot.Name, Err: runner.stopped(ctx)})
+      break
+    }
+    operationCtx, cancel := runner.operationContext(ctx)
+    deleteErr := runner.backend.DeleteInstantSnapshot(operationCtx, snapshot, runner.options.DryRun)
+    deleteErr = runner.operationError(ctx, operationCtx, deleteErr)
+    cancel()
+    runner.release()
+    if deleteErr != nil {
+      failures = append(failures, Failure{Disk: disk.Name, Snapshot: snapshot.Name, Err: fmt.Errorf("Deletion: %w", deleteErr)})
+      continue
+    }
+    deleted = append(deleted, snapshot)
+  }
+  return deleted, failures
+}
+
+// instantFailedDisks returns the names of the disks having at least one
+// instant snapshot failure.
+func (result Result) instantFailedDisks() []string {
+  names := make([]string, 0)
+  for failureIndex := 0; failureIndex < len(result.InstantFailures); failureIndex++ {
+    name := result.InstantFailures[failureIndex].Disk
+    if !contains(names, name) {
+      names = append(names, name)
+    }
+  }
+  return names
+}
+
+// instantError returns ErrInstantSnapshotsFailed if some instant snapshots
+// failed.
+func (runner *Runner) instantError(result Result) error {
+  failedDisks := result.instantFailedDisks()
+  if len(failedDisks) == 0 {
+    return nil
+  }
+  return fmt.Errorf("%w for %d disk(s): %s", ErrInstantSnapshotsFailed, len(failedDisks), strings.Join(failedDisks, ", "))
+}
+
+// instantCompliance checks the newest READY instant snapshot created by this
+// program of the disk, like compliance.
+func instantCompliance(disk Disk, snapshots []InstantSnapshot, maxStaleness time.Duration, now time.Time) DiskCompliance {
+  diskCompliance := DiskCompliance{Disk: disk.Name, Project: disk.Project, Location: disk.Location(), Instant: true, Status: ComplianceMissing}
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    if snapshot.Status != SnapshotReady || snapshot.Labels[CreatedByLabel] != CreatedByValue || snapshot.CreationTimestamp.IsZero() {
+      continue
+    }
+    diskCompliance.Snapshot = snapshot.Name
+    diskCompliance.CreatedAt = snapshot.CreationTimestamp
+    diskCompliance.Age = FormatAge(snapshot.CreationTimestamp, now)
+    diskCompliance.Status = ComplianceOK
+    if now.Sub(snapshot.CreationTimestamp) > maxStaleness {
+      diskCompliance.Status = ComplianceStale
+    }
+    break
+  }
+  return diskCompliance
+}
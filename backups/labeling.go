@@ -0,0 +1,81 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "time"
+)
+
+const (
+  // The unlabeled disks fail the run
+  LabelingError = "error"
+  // The unlabeled disks are only reported
+  LabelingWarn = "warn"
+)
+
+// ErrUnlabeledDisks is returned by Run with LabelingError when some disks of
+// the project are neither backed up nor opted out.
+var ErrUnlabeledDisks = errors.New("Unlabeled disks")
+
+// Violation is a disk of the project neither matching the filters nor opted
+// out with the backup=false label.
+type Violation struct {
+  Disk      string    `json:"disk"`
+  Zone      string    `json:"zone,omitempty"`
+  Region    string    `json:"region,omitempty"`
+  CreatedAt time.Time `json:"createdAt,omitzero"`
+}
+
+// String returns the disk with its location and creation date, to find its
+// owner.
+func (violation Violation) String() string {
+  location := violation.Zone
+  if location == "" {
+    location = violation.Region
+  }
+  details := []string{location}
+  if !violation.CreatedAt.IsZero() {
+    details = append(details, "created " + violation.CreatedAt.Format("2006-01-02"))
+  }
+  return violation.Disk + " (" + strings.Join(details, ", ") + ")"
+}
+
+// checkLabeling lists all the disks of the project, whatever the filters and
+// zones, and adds the ones which aren't backed up by the run nor opted out to
+// the violations of the result.
+func (runner *Runner) checkLabeling(ctx context.Context, result *Result) error {
+  disks, err := runner.backend.GetDisksToSnapshot(ctx, "")
+  if err != nil {
+    return fmt.Errorf("Failed to list all the disks to check their labels: %w", err)
+  }
+  backedUp := make(map[string]bool)
+  for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+    backedUp[result.Disks[diskIndex].Id] = true
+  }
+
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    if backedUp[disk.Id] || disk.Labels[BackupLabel] == "false" {
+      continue
+    }
+    violation := Violation{Disk: disk.Name, Zone: disk.Zone, Region: disk.Region, CreatedAt: disk.CreationTimestamp}
+    result.Violations = append(result.Violations, violation)
+    runner.levels.Warning.Printf("WARNING: disk %s is not backed up, and not opted out with the %s=false label\n", violation, BackupLabel)
+  }
+  return nil
+}
+
+// labelingError returns the error of the violations with LabelingError, nil
+// if there are none.
+func (runner *Runner) labelingError(result Result) error {
+  if runner.options.EnforceLabeling != LabelingError || len(result.Violations) == 0 {
+    return nil
+  }
+  names := make([]string, 0, len(result.Violations))
+  for violationIndex := 0; violationIndex < len(result.Violations); violationIndex++ {
+    names = append(names, result.Violations[violationIndex].Disk)
+  }
+  return fmt.Errorf("%w: %d disk(s) neither backed up nor labeled %s=false: %s", ErrUnlabeledDisks, len(names), BackupLabel, strings.Join(names, ", "))
+}
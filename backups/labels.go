@@ -0,0 +1,95 @@
+package backups
+
+import (
+  "regexp"
+  "sort"
+  "strings"
+)
+
+const (
+  // Label of the snapshots created by this program, with the value
+  // CreatedByValue
+  CreatedByLabel = "created-by"
+  CreatedByValue = "gcp-backups"
+  // Label of the snapshots with the name of their disk
+  SourceDiskLabel = "source-disk"
+  // Label of the disks overriding the storage location of their snapshots
+  LocationLabel = "backup-location"
+  // Label of the disks enabling ("true") or disabling ("false") the guest
+  // flush of their snapshots
+  GuestFlushLabel = "backup-guest-flush"
+  // Label of the disks with the alias of the KMS key of their snapshots
+  KmsKeyLabel = "backup-kms-key"
+  // Label of the snapshots created together for the disks of an instance,
+  // with the id of their group
+  GroupLabel = "backup-group"
+  // Label of the created snapshots with the id of their run
+  RunIDLabel = "backup-run-id"
+  // Label of the snapshots to delete after the deletion grace period, with
+  // the time they were marked
+  PendingDeleteLabel = "pending-delete"
+  // Labels of the disks with the time and the name of their last snapshot,
+  // with --stamp-disks
+  LastBackupLabel = "last-backup"
+  LastBackupSnapshotLabel = "last-backup-snapshot"
+)
+
+// Layout of the LastBackupLabel, in UTC: the label values can't have colons
+const lastBackupLayout = "200601021504"
+
+// Rules of the GCE labels
+const maxLabelLength = 63
+var labelKeyRegexp = regexp.MustCompile(`^[a-z][-_a-z0-9]*$`)
+var invalidLabelChars = regexp.MustCompile(`[^-_a-z0-9]+`)
+
+// sanitizeLabel lower-cases the key or value, replaces the invalid characters
+// by underscores and truncates it.
+func sanitizeLabel(value string) string {
+  value = invalidLabelChars.ReplaceAllString(strings.ToLower(value), "_")
+  if len(value) > maxLabelLength {
+    value = value[:maxLabelLength]
+  }
+  return value
+}
+
+// SnapshotLabels returns the labels of a new snapshot of the disk: the labels
+// of the disk but its stamps, overridden by the extra ones and the created-by and
+// source-disk labels. The keys which can't be made valid are returned apart.
+func SnapshotLabels(disk Disk, extra map[string]string) (map[string]string, []string) {
+  labels := make(map[string]string)
+  skipped := make([]string, 0)
+  add := func(key string, value string) {
+    sanitizedKey := sanitizeLabel(key)
+    if !labelKeyRegexp.MatchString(sanitizedKey) {
+      skipped = append(skipped, key)
+      return
+    }
+    labels[sanitizedKey] = sanitizeLabel(value)
+  }
+
+  for key, value := range disk.Labels {
+    // The stamps of the disk are not the ones of its snapshots
+    if key == LastBackupLabel || key == LastBackupSnapshotLabel {
+      continue
+    }
+    add(key, value)
+  }
+  for key, value := range extra {
+    add(key, value)
+  }
+  add(CreatedByLabel, CreatedByValue)
+  add(SourceDiskLabel, disk.Name)
+
+  sort.Strings(skipped)
+  return labels, skipped
+}
+
+// FormatLabels formats the labels as key=value pairs sorted by key.
+func FormatLabels(labels map[string]string) string {
+  pairs := make([]string, 0, len(labels))
+  for key, value := range labels {
+    pairs = append(pairs, key + "=" + value)
+  }
+  sort.Strings(pairs)
+  return strings.Join(pairs, ",")
+}
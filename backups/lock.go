@@ -0,0 +1,165 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+
+  "google.golang.org/api/googleapi"
+  "google.golang.org/api/option"
+  storage "google.golang.org/api/storage/v1"
+)
+
+// ErrLocked is returned when another run holds the lock.
+var ErrLocked = errors.New("Locked by another run")
+
+// ParseGCSURI returns the bucket and the object of a gs://bucket/object URI.
+func ParseGCSURI(uri string) (string, string, error) {
+  path, found := strings.CutPrefix(uri, "gs://")
+  bucket, object, _ := strings.Cut(path, "/")
+  if !found || bucket == "" || object == "" {
+    return "", "", fmt.Errorf("Invalid GCS URI '%s', use gs://<bucket>/<object>", uri)
+  }
+  return bucket, object, nil
+}
+
+// GCSLock is a lock shared by the runs, held by creating a GCS object with
+// the Application Default Credentials. The holder refreshes the object: a
+// lock which isn't refreshed for its TTL, e.g. after a crash, can be taken
+// over.
+type GCSLock struct {
+  Bucket  string
+  Object  string
+  TTL     time.Duration
+  // Written in the object, to tell who holds the lock
+  Owner   string
+  Logger  *log.Logger
+  // Options of the client, like the endpoint of the tests
+  clientOptions []option.ClientOption
+
+  service    *storage.Service
+  mutex      sync.Mutex
+  // Of the object written by the holder
+  generation int64
+  acquiredAt string
+  stop       chan struct{}
+  done       chan struct{}
+}
+
+// Acquire takes the lock, or fails with ErrLocked. The lock is refreshed
+// until Release, and the returned context is cancelled if it's lost.
+func (lock *GCSLock) Acquire(ctx context.Context) (context.Context, error) {
+  if lock.Logger == nil {
+    lock.Logger = log.Default()
+  }
+  service, err := storage.NewService(ctx, lock.clientOptions...)
+  if err != nil {
+    return ctx, err
+  }
+  lock.service = service
+
+  // Created if there is no object, or over a stale one
+  err = lock.write(ctx, 0)
+  if isPreconditionFailed(err) {
+    var current *storage.Object
+    current, err = service.Objects.Get(lock.Bucket, lock.Object).Context(ctx).Do()
+    if err != nil {
+      return ctx, err
+    }
+    expiresAt, parseErr := time.Parse(time.RFC3339, current.Metadata["expiresAt"])
+    if parseErr == nil && time.Now().Before(expiresAt) {
+      return ctx, fmt.Errorf("%w: held by %s since %s, until %s", ErrLocked, current.Metadata["owner"], current.Metadata["acquiredAt"], expiresAt.Format(time.RFC3339))
+    }
+    lock.Logger.Printf("WARNING: taking over the stale lock of %s, expired at %s\n", current.Metadata["owner"], current.Metadata["expiresAt"])
+    err = lock.write(ctx, current.Generation)
+    if isPreconditionFailed(err) {
+      return ctx, fmt.Errorf("%w: taken over by another run", ErrLocked)
+    }
+  }
+  if err != nil {
+    return ctx, fmt.Errorf("Failed to acquire the lock gs://%s/%s: %w", lock.Bucket, lock.Object, err)
+  }
+
+  lockCtx, cancel := context.WithCancel(ctx)
+  lock.stop = make(chan struct{})
+  lock.done = make(chan struct{})
+  go lock.refresh(cancel)
+  return lockCtx, nil
+}
+
+// Release stops refreshing the lock and deletes its object, unless another
+// run took it over.
+func (lock *GCSLock) Release(ctx context.Context) error {
+  close(lock.stop)
+  <-lock.done
+
+  lock.mutex.Lock()
+  defer lock.mutex.Unlock()
+  err := lock.service.Objects.Delete(lock.Bucket, lock.Object).IfGenerationMatch(lock.generation).Context(ctx).Do()
+  if isPreconditionFailed(err) {
+    return nil
+  }
+  return err
+}
+
+// refresh rewrites the object every third of the TTL, and cancels the run if
+// the lock was taken over meanwhile.
+func (lock *GCSLock) refresh(cancel context.CancelFunc) {
+  defer close(lock.done)
+  ticker := time.NewTicker(lock.TTL / 3)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-lock.stop:
+      return
+    case <-ticker.C:
+    }
+
+    lock.mutex.Lock()
+    ctx, cancelWrite := context.WithTimeout(context.Background(), lock.TTL / 3)
+    err := lock.write(ctx, lock.generation)
+    cancelWrite()
+    lock.mutex.Unlock()
+    if isPreconditionFailed(err) {
+      lock.Logger.Printf("WARNING: the lock gs://%s/%s was taken over by another run, stopping\n", lock.Bucket, lock.Object)
+      cancel()
+      return
+    }
+    if err != nil {
+      lock.Logger.Printf("WARNING: failed to refresh the lock gs://%s/%s: %s\n", lock.Bucket, lock.Object, err)
+    }
+  }
+}
+
+// write writes the object if its generation matches, 0 for no object, and
+// keeps its new generation.
+func (lock *GCSLock) write(ctx context.Context, generation int64) error {
+  now := time.Now()
+  acquiredAt := now.Format(time.RFC3339)
+  if generation != 0 && lock.generation == generation {
+    acquiredAt = lock.acquiredAt
+  }
+  object := &storage.Object{
+    Name: lock.Object,
+    ContentType: "text/plain",
+    Metadata: map[string]string{"owner": lock.Owner, "acquiredAt": acquiredAt, "expiresAt": now.Add(lock.TTL).Format(time.RFC3339)},
+  }
+  content := fmt.Sprintf("Locked by %s until %s\n", lock.Owner, object.Metadata["expiresAt"])
+  written, err := lock.service.Objects.Insert(lock.Bucket, object).IfGenerationMatch(generation).Media(strings.NewReader(content)).Context(ctx).Do()
+  if err != nil {
+    return err
+  }
+  lock.generation = written.Generation
+  lock.acquiredAt = acquiredAt
+  return nil
+}
+
+func isPreconditionFailed(err error) bool {
+  var apiErr *googleapi.Error
+  return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
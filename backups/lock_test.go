@@ -0,0 +1,218 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "io"
+  "mime"
+  "mime/multipart"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "google.golang.org/api/option"
+)
+
+// fakeGCS is a GCS JSON API keeping the objects in memory, with their
+// generations and the ifGenerationMatch preconditions.
+type fakeGCS struct {
+  mutex      sync.Mutex
+  objects    map[string]*fakeObject
+  generation int64
+}
+
+type fakeObject struct {
+  generation int64
+  metadata   map[string]string
+  content    string
+}
+
+func newFakeGCS(t *testing.T) (*fakeGCS, []option.ClientOption) {
+  fake := &fakeGCS{objects: make(map[string]*fakeObject)}
+  server := httptest.NewServer(fake)
+  t.Cleanup(server.Close)
+  return fake, []option.ClientOption{option.WithEndpoint(server.URL + "/storage/v1/"), option.WithoutAuthentication()}
+}
+
+func (fake *fakeGCS) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+  fake.mutex.Lock()
+  defer fake.mutex.Unlock()
+  if request.Method == http.MethodPost && strings.HasPrefix(request.URL.Path, "/upload/storage/v1/b/") {
+    fake.insert(writer, request)
+    return
+  }
+  _, path, _ := strings.Cut(request.URL.Path, "/storage/v1/b/")
+  bucket, name, _ := strings.Cut(path, "/o/")
+  key := bucket + "/" + name
+  object := fake.objects[key]
+  if object == nil {
+    fake.error(writer, http.StatusNotFound)
+    return
+  }
+  switch request.Method {
+  case http.MethodGet:
+    fake.write(writer, name, object)
+  case http.MethodDelete:
+    if !fake.matches(request, object) {
+      fake.error(writer, http.StatusPreconditionFailed)
+      return
+    }
+    delete(fake.objects, key)
+    writer.WriteHeader(http.StatusNoContent)
+  default:
+    fake.error(writer, http.StatusMethodNotAllowed)
+  }
+}
+
+// insert writes the object of a multipart upload.
+func (fake *fakeGCS) insert(writer http.ResponseWriter, request *http.Request) {
+  bucket := strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, "/upload/storage/v1/b/"), "/o")
+  _, params, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+  parts := multipart.NewReader(request.Body, params["boundary"])
+  var resource struct {
+    Name     string
+    Metadata map[string]string
+  }
+  part, err := parts.NextPart()
+  if err == nil {
+    err = json.NewDecoder(part).Decode(&resource)
+  }
+  if err == nil {
+    part, err = parts.NextPart()
+  }
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+  content, _ := io.ReadAll(part)
+  key := bucket + "/" + resource.Name
+  if !fake.matches(request, fake.objects[key]) {
+    fake.error(writer, http.StatusPreconditionFailed)
+    return
+  }
+  fake.generation++
+  object := &fakeObject{generation: fake.generation, metadata: resource.Metadata, content: string(content)}
+  fake.objects[key] = object
+  fake.write(writer, resource.Name, object)
+}
+
+// matches checks the ifGenerationMatch precondition, 0 for no object.
+func (fake *fakeGCS) matches(request *http.Request, object *fakeObject) bool {
+  value := request.URL.Query().Get("ifGenerationMatch")
+  if value == "" {
+    return true
+  }
+  generation, _ := strconv.ParseInt(value, 10, 64)
+  if object == nil {
+    return generation == 0
+  }
+  return object.generation == generation
+}
+
+func (fake *fakeGCS) write(writer http.ResponseWriter, name string, object *fakeObject) {
+  json.NewEncoder(writer).Encode(map[string]interface{}{"name": name, "generation": strconv.FormatInt(object.generation, 10), "metadata": object.metadata})
+}
+
+func (fake *fakeGCS) error(writer http.ResponseWriter, code int) {
+  writer.WriteHeader(code)
+  json.NewEncoder(writer).Encode(map[string]interface{}{"error": map[string]interface{}{"code": code, "message": http.StatusText(code)}})
+}
+
+// object returns a copy of the object, nil if missing.
+func (fake *fakeGCS) object(key string) *fakeObject {
+  fake.mutex.Lock()
+  defer fake.mutex.Unlock()
+  object := fake.objects[key]
+  if object == nil {
+    return nil
+  }
+  copied := *object
+  return &copied
+}
+
+func newTestLock(options []option.ClientOption, owner string, ttl time.Duration) *GCSLock {
+  return &GCSLock{Bucket: "locks", Object: "backups/proj", TTL: ttl, Owner: owner, Logger: discardLogger(), clientOptions: options}
+}
+
+func TestGCSLockAcquireRelease(t *testing.T) {
+  fake, options := newFakeGCS(t)
+  lock := newTestLock(options, "host-1", time.Minute)
+
+  _, err := lock.Acquire(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  object := fake.object("locks/backups/proj")
+  if object == nil || object.metadata["owner"] != "host-1" || !strings.HasPrefix(object.content, "Locked by host-1 until ") {
+    t.Fatalf("Got the lock object %+v", object)
+  }
+
+  // Another run
+  _, err = newTestLock(options, "host-2", time.Minute).Acquire(context.Background())
+  if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "held by host-1") {
+    t.Errorf("Got the error %v, expected %v", err, ErrLocked)
+  }
+
+  err = lock.Release(context.Background())
+  if err != nil || fake.object("locks/backups/proj") != nil {
+    t.Errorf("Got the error %v, the object deleted: %t", err, fake.object("locks/backups/proj") == nil)
+  }
+  // Free again
+  other := newTestLock(options, "host-2", time.Minute)
+  _, err = other.Acquire(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  other.Release(context.Background())
+}
+
+func TestGCSLockStale(t *testing.T) {
+  fake, options := newFakeGCS(t)
+  fake.generation = 7
+  fake.objects["locks/backups/proj"] = &fakeObject{generation: 7, metadata: map[string]string{"owner": "crashed", "expiresAt": time.Now().Add(-time.Minute).Format(time.RFC3339)}}
+  lock := newTestLock(options, "host-1", time.Minute)
+
+  _, err := lock.Acquire(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer lock.Release(context.Background())
+  if fake.object("locks/backups/proj").metadata["owner"] != "host-1" {
+    t.Errorf("The stale lock wasn't taken over")
+  }
+}
+
+func TestGCSLockLost(t *testing.T) {
+  fake, options := newFakeGCS(t)
+  lock := newTestLock(options, "host-1", 150 * time.Millisecond)
+  lockCtx, err := lock.Acquire(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // Taken over by another run meanwhile
+  fake.mutex.Lock()
+  fake.generation++
+  fake.objects["locks/backups/proj"] = &fakeObject{generation: fake.generation, metadata: map[string]string{"owner": "host-2"}}
+  fake.mutex.Unlock()
+  select {
+  case <-lockCtx.Done():
+  case <-time.After(5 * time.Second):
+    t.Fatal("The run wasn't stopped when its lock was lost")
+  }
+
+  // The lock of the other run is kept
+  err = lock.Release(context.Background())
+  if err != nil || fake.object("locks/backups/proj") == nil {
+    t.Errorf("Got the error %v, the lock of the other run deleted: %t", err, fake.object("locks/backups/proj") == nil)
+  }
+}
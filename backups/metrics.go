@@ -0,0 +1,106 @@
+package backups
+
+import (
+  "context"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Pushgateway pushes the metrics of a run to a Prometheus Pushgateway.
+type Pushgateway struct {
+  URL      string
+  Job      string
+  Instance string
+  // Also push gauges for each disk, labelled by disk name and zone (the region
+  // of the regional disks)
+  PerDisk  bool
+  // Also group the metrics by project, when backing up several projects
+  PerProject bool
+}
+
+// Push adds the metrics of the run to the group of the job and instance. The
+// last success timestamps are only pushed on success, so the previous ones
+// are kept on failure.
+func (pushgateway Pushgateway) Push(ctx context.Context, summary Summary) error {
+  now := float64(time.Now().Unix())
+  pusher := push.New(pushgateway.URL, pushgateway.Job).Grouping("instance", pushgateway.Instance)
+  if pushgateway.PerProject {
+    pusher.Grouping("project", summary.Project)
+  }
+  // Each plan has its own group, not to overwrite the metrics of the others
+  if summary.Plan != "" {
+    pusher.Grouping("plan", summary.Plan)
+  }
+
+  // A prune alone is not a backup
+  if summary.ExitCode == ExitOK && !summary.DryRun && summary.Mode != ModePrune {
+    lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+      Name: "gcp_backups_last_success_timestamp",
+      Help: "Time of the last successful backup run",
+    })
+    lastSuccess.Set(now)
+    pusher.Collector(lastSuccess)
+  }
+
+  created := prometheus.NewCounter(prometheus.CounterOpts{
+    Name: "gcp_backups_snapshots_created_total",
+    Help: "Number of snapshots created by the last backup run",
+  })
+  created.Add(float64(summary.SnapshotsCreated))
+  deleted := prometheus.NewCounter(prometheus.CounterOpts{
+    Name: "gcp_backups_snapshots_deleted_total",
+    Help: "Number of snapshots deleted by the last backup run",
+  })
+  deleted.Add(float64(summary.SnapshotsDeleted))
+  failures := prometheus.NewCounter(prometheus.CounterOpts{
+    Name: "gcp_backups_failures_total",
+    Help: "Number of failures of the last backup run",
+  })
+  failures.Add(float64(len(summary.Failures)))
+  pusher.Collector(created).Collector(deleted).Collector(failures)
+
+  if pushgateway.PerDisk {
+    diskFailed := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+      Name: "gcp_backups_disk_failed",
+      Help: "1 if the last backup of the disk failed",
+    }, []string{"disk", "zone"})
+    diskLastSuccess := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+      Name: "gcp_backups_disk_last_success_timestamp",
+      Help: "Time of the last snapshot successfully created for the disk",
+    }, []string{"disk", "zone"})
+    diskCreateDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+      Name: "gcp_backups_disk_create_duration_seconds",
+      Help: "Duration of the creation of the last snapshot of the disk",
+    }, []string{"disk", "zone"})
+    diskReadyDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+      Name: "gcp_backups_disk_ready_duration_seconds",
+      Help: "Duration of the wait for the last snapshot of the disk to be READY, with --wait",
+    }, []string{"disk", "zone"})
+    for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+      disk := summary.Disks[diskIndex]
+      zone := disk.Zone
+      if disk.Region != "" {
+        zone = disk.Region
+      }
+      if disk.CreateSeconds > 0 {
+        diskCreateDuration.WithLabelValues(disk.Name, zone).Set(disk.CreateSeconds)
+      }
+      if disk.ReadySeconds > 0 {
+        diskReadyDuration.WithLabelValues(disk.Name, zone).Set(disk.ReadySeconds)
+      }
+      if disk.Failed {
+        diskFailed.WithLabelValues(disk.Name, zone).Set(1)
+        continue
+      }
+      diskFailed.WithLabelValues(disk.Name, zone).Set(0)
+      if disk.Created != "" && !summary.DryRun {
+        diskLastSuccess.WithLabelValues(disk.Name, zone).Set(now)
+      }
+    }
+    pusher.Collector(diskFailed).Collector(diskLastSuccess).Collector(diskCreateDuration).Collector(diskReadyDuration)
+  }
+
+  return pusher.AddContext(ctx)
+}
@@ -0,0 +1,59 @@
+package backups
+
+import (
+  "sort"
+)
+
+// ownReady tells if the snapshot is a READY one created by this program, the
+// ones counting in Options.MinKeep.
+func ownReady(snapshot Snapshot) bool {
+  return snapshot.Labels[CreatedByLabel] == CreatedByValue && (snapshot.Status == SnapshotReady || snapshot.Status == "")
+}
+
+// minKept splits the snapshots to delete among the snapshots of a disk between
+// the ones still deleted and the ones kept to leave at least minKeep READY
+// snapshots created by this program, the newest ones. It's applied after all
+// the retention rules, the order of the snapshots to delete is kept.
+func minKept(snapshots []Snapshot, toDelete []Snapshot, minKeep int) ([]Snapshot, []Snapshot) {
+  if minKeep <= 0 || len(toDelete) == 0 {
+    return toDelete, nil
+  }
+  deleted := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(toDelete); snapshotIndex++ {
+    deleted[toDelete[snapshotIndex].Name] = true
+  }
+  remaining := 0
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    if ownReady(snapshots[snapshotIndex]) && !deleted[snapshots[snapshotIndex].Name] {
+      remaining++
+    }
+  }
+  if remaining >= minKeep {
+    return toDelete, nil
+  }
+
+  newestFirst := make([]Snapshot, 0, len(toDelete))
+  for snapshotIndex := 0; snapshotIndex < len(toDelete); snapshotIndex++ {
+    if ownReady(toDelete[snapshotIndex]) {
+      newestFirst = append(newestFirst, toDelete[snapshotIndex])
+    }
+  }
+  sort.SliceStable(newestFirst, func(i int, j int) bool {
+    return newestFirst[i].CreationTimestamp.After(newestFirst[j].CreationTimestamp)
+  })
+  keptNames := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(newestFirst) && remaining < minKeep; snapshotIndex++ {
+    keptNames[newestFirst[snapshotIndex].Name] = true
+    remaining++
+  }
+  stillDeleted := make([]Snapshot, 0, len(toDelete))
+  kept := make([]Snapshot, 0, len(keptNames))
+  for snapshotIndex := 0; snapshotIndex < len(toDelete); snapshotIndex++ {
+    if keptNames[toDelete[snapshotIndex].Name] {
+      kept = append(kept, toDelete[snapshotIndex])
+    } else {
+      stillDeleted = append(stillDeleted, toDelete[snapshotIndex])
+    }
+  }
+  return stillDeleted, kept
+}
@@ -0,0 +1,118 @@
+package backups
+
+import (
+  "context"
+  "testing"
+  "time"
+)
+
+func TestMinKept(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  day := 24 * time.Hour
+  // Not in order, as listed
+  snapshots := []Snapshot{
+    testSnapshot("s2", "1", now.Add(-2 * day)),
+    testSnapshot("s0", "1", now.Add(-time.Hour)),
+    testSnapshot("s9", "1", now.Add(-9 * day)),
+    testSnapshot("s1", "1", now.Add(-day)),
+    testSnapshot("s40", "1", now.Add(-40 * day)),
+  }
+  foreign := testSnapshot("foreign", "1", now.Add(-time.Minute))
+  foreign.Labels = nil
+  failed := testSnapshot("failed", "1", now.Add(-time.Minute))
+  failed.Status = SnapshotFailed
+  expiring := make([]Snapshot, len(snapshots))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    expiring[snapshotIndex] = testSnapshot(snapshots[snapshotIndex].Name, "1", snapshots[snapshotIndex].CreationTimestamp)
+    expiring[snapshotIndex].Labels[ExpiresLabel] = now.Add(-time.Hour).Format(expiresLayout)
+  }
+  // The snapshots to delete by each rule, as pruneDisks gets them
+  // Oldest last
+  byAge, _ := Retention{Mode: RetentionAge, MaxAge: 12 * time.Hour}.SnapshotsToDelete(snapshots, now)
+  byGFS, _ := Retention{Mode: RetentionCount, KeepDaily: 1, KeepMonthly: 2}.SnapshotsToDelete(snapshots, now)
+  byTTL, _ := expiredSnapshots(expiring, now)
+  tests := []struct {
+    name      string
+    snapshots []Snapshot
+    toDelete  []Snapshot
+    minKeep   int
+    deleted   string
+    kept      string
+  }{
+    {"disabled", snapshots, byAge, 0, "s1,s2,s9,s40", ""},
+    {"enough left", snapshots, byAge, 1, "s1,s2,s9,s40", ""},
+    {"age", snapshots, byAge, 3, "s9,s40", "s1,s2"},
+    // s0 and s40 are kept by GFS, the newest of the others by min keep
+    {"GFS", snapshots, byGFS, 3, "s2,s9", "s1"},
+    {"TTL", expiring, byTTL, 2, "s2,s9,s40", "s0,s1"},
+    {"more than the snapshots", snapshots, byAge, 10, "", "s1,s2,s9,s40"},
+    {"all deleted, more than the snapshots", expiring, byTTL, 10, "", "s2,s0,s9,s1,s40"},
+    // Neither counts in the snapshots left
+    {"foreign and failed", append(snapshots, foreign, failed), byAge, 3, "s9,s40", "s1,s2"},
+    {"foreign and failed deleted", append(snapshots, foreign, failed), append(byAge, foreign, failed), 3, "s9,s40,foreign,failed", "s1,s2"},
+    {"none", snapshots, nil, 3, "", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    deleted, kept := minKept(test.snapshots, test.toDelete, test.minKeep)
+    if snapshotNames(deleted) != test.deleted {
+      t.Errorf("%s: got %s deleted, expected %s", test.name, snapshotNames(deleted), test.deleted)
+    }
+    if snapshotNames(kept) != test.kept {
+      t.Errorf("%s: got %s kept, expected %s", test.name, snapshotNames(kept), test.kept)
+    }
+  }
+}
+
+func TestRunMinKeep(t *testing.T) {
+  now := time.Now()
+  day := 24 * time.Hour
+  diskId := "1111111111111111111"
+  snapshots := []Snapshot{
+    testSnapshot("db-1", diskId, now.Add(-day)),
+    testSnapshot("db-2", diskId, now.Add(-2 * day)),
+    testSnapshot("db-3", diskId, now.Add(-4 * day)),
+  }
+  expired := now.Add(-day).UTC().Format(expiresLayout)
+  tests := []struct {
+    name     string
+    options  Options
+    labels   map[string]string
+    deleted  string
+    kept     string
+  }{
+    {"age", Options{RetentionMode: RetentionAge, MaxAge: 12 * time.Hour, MinKeep: 2}, nil, "db-3", "db-1,db-2"},
+    {"GFS", Options{RetentionMode: RetentionCount, KeepDaily: 1, MinKeep: 2}, nil, "db-3", "db-2"},
+    {"TTL", Options{RetentionMode: RetentionCount, Limit: 10, RespectTTLOnly: true, MinKeep: 2}, map[string]string{ExpiresLabel: expired}, "db-3", "db-1,db-2"},
+    {"more than the snapshots", Options{RetentionMode: RetentionAge, MaxAge: 12 * time.Hour, MinKeep: 10}, nil, "", "db-1,db-2,db-3"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    listed := make([]Snapshot, len(snapshots))
+    for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+      listed[snapshotIndex] = testSnapshot(snapshots[snapshotIndex].Name, diskId, snapshots[snapshotIndex].CreationTimestamp)
+      for key, value := range test.labels {
+        listed[snapshotIndex].Labels[key] = value
+      }
+    }
+    fake := newFakeRunner(t)
+    fake.listing(listed)
+    test.options.Mode = ModePrune
+    test.options.Disks = []string{"db-data"}
+    runner, logs := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if sortedNames(result.Deleted) != test.deleted {
+      t.Errorf("%s: got %s deleted, expected %s", test.name, sortedNames(result.Deleted), test.deleted)
+    }
+    if sortedNames(result.MinKept) != test.kept {
+      t.Errorf("%s: got %s kept, expected %s", test.name, sortedNames(result.MinKept), test.kept)
+    }
+    if !containsLine(logs.String(), "Keeping snapshot db-2 of disk db-data: one of its last") {
+      t.Errorf("%s: min keep not logged in:\n%s", test.name, logs)
+    }
+  }
+}
@@ -0,0 +1,119 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "strings"
+  "time"
+
+  monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Default prefix of the Cloud Monitoring metric types
+const DefaultMetricPrefix = "custom.googleapis.com/gcp_backups"
+
+// Maximum number of time series of a write request
+const monitoringBatchSize = 200
+
+// CloudMonitoring writes the metrics of a run to Cloud Monitoring, with the
+// Application Default Credentials:
+//   - <prefix>/last_success: time of the last snapshot successfully created
+//     for each disk, labelled by disk, zone (the region of the regional disks)
+//     and project
+//   - <prefix>/run_success: if the run succeeded, labelled by project, plan
+//     and mode
+type CloudMonitoring struct {
+  // Project of the metrics, the project of the run if empty
+  Project string
+  // DefaultMetricPrefix if empty
+  Prefix  string
+  // Added to the labels of all the metrics, e.g. the environment
+  Labels  map[string]string
+}
+
+// Write writes the metrics of the run. The dry runs write nothing.
+func (cloudMonitoring CloudMonitoring) Write(ctx context.Context, summary Summary) error {
+  if summary.DryRun {
+    return nil
+  }
+  project := cloudMonitoring.Project
+  if project == "" {
+    project = summary.Project
+  }
+  if project == "" {
+    return fmt.Errorf("Unknown project of the metrics")
+  }
+
+  service, err := monitoring.NewService(ctx)
+  if err != nil {
+    return err
+  }
+  timeSeries := CloudMonitoringTimeSeries(summary, project, cloudMonitoring.Prefix, cloudMonitoring.Labels, time.Now())
+  for start := 0; start < len(timeSeries); start += monitoringBatchSize {
+    end := start + monitoringBatchSize
+    if end > len(timeSeries) {
+      end = len(timeSeries)
+    }
+    request := &monitoring.CreateTimeSeriesRequest{TimeSeries: timeSeries[start:end]}
+    _, err = service.Projects.TimeSeries.Create("projects/" + project, request).Context(ctx).Do()
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// CloudMonitoringTimeSeries returns the time series of the run success,
+// followed with the ones of the disks which have a new snapshot.
+func CloudMonitoringTimeSeries(summary Summary, project string, prefix string, labels map[string]string, now time.Time) []*monitoring.TimeSeries {
+  if prefix == "" {
+    prefix = DefaultMetricPrefix
+  }
+  prefix = strings.TrimSuffix(prefix, "/")
+  resource := &monitoring.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": project}}
+  interval := &monitoring.TimeInterval{EndTime: now.UTC().Format(time.RFC3339Nano)}
+  newTimeSeries := func(name string, metricLabels map[string]string, valueType string, value *monitoring.TypedValue) *monitoring.TimeSeries {
+    return &monitoring.TimeSeries{
+      Metric: &monitoring.Metric{Type: prefix + "/" + name, Labels: mergeMetricLabels(labels, metricLabels)},
+      Resource: resource,
+      MetricKind: "GAUGE",
+      ValueType: valueType,
+      Points: []*monitoring.Point{{Interval: interval, Value: value}},
+    }
+  }
+
+  success := summary.ExitCode == ExitOK
+  runLabels := map[string]string{"project": summary.Project, "plan": summary.Plan, "mode": summary.Mode}
+  timeSeries := []*monitoring.TimeSeries{newTimeSeries("run_success", runLabels, "BOOL", &monitoring.TypedValue{BoolValue: &success})}
+
+  for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+    disk := summary.Disks[diskIndex]
+    if disk.Failed || disk.Created == "" {
+      continue
+    }
+    zone := disk.Zone
+    if disk.Region != "" {
+      zone = disk.Region
+    }
+    diskProject := disk.Project
+    if diskProject == "" {
+      diskProject = summary.Project
+    }
+    timestamp := now.Unix()
+    diskLabels := map[string]string{"disk": disk.Name, "zone": zone, "project": diskProject}
+    timeSeries = append(timeSeries, newTimeSeries("last_success", diskLabels, "INT64", &monitoring.TypedValue{Int64Value: &timestamp}))
+  }
+  return timeSeries
+}
+
+// mergeMetricLabels returns the labels of the metric over the common labels.
+func mergeMetricLabels(labels map[string]string, metricLabels map[string]string) map[string]string {
+  merged := make(map[string]string, len(labels) + len(metricLabels))
+  for key, value := range labels {
+    merged[key] = value
+  }
+  for key, value := range metricLabels {
+    merged[key] = value
+  }
+  return merged
+}
@@ -0,0 +1,201 @@
+package backups
+
+import (
+  "fmt"
+  "math/rand"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// DefaultNameTemplate is the template of the snapshot names: the disk name,
+// shortened from the middle if needed, its id, the time and a random suffix,
+// so two runs in the same second don't collide.
+const DefaultNameTemplate = "{disk}-{diskId}-{date:20060102150405}-{random}"
+
+// Characters of the random suffix of the snapshot names
+const suffixChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Rules of the GCE resource names
+const maxSnapshotName = 63
+var snapshotNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Variables of the name templates
+var nameVariables = []string{"disk", "diskId", "zone", "project", "date", "unix", "random"}
+
+// nameSegment is a literal text or a variable of a name template.
+type nameSegment struct {
+  literal  string
+  variable string
+  // Layout of the date variable
+  layout   string
+}
+
+// parseNameTemplate splits the template in literal texts and {variables}.
+func parseNameTemplate(template string) ([]nameSegment, error) {
+  return parseTemplate(template, nameVariables, "name template")
+}
+
+// parseTemplate splits the template in literal texts and {variables}, which
+// must be among the variables given. The kind of template is in the errors.
+func parseTemplate(template string, variables []string, kind string) ([]nameSegment, error) {
+  segments := make([]nameSegment, 0)
+  rest := template
+  for rest != "" {
+    start := strings.Index(rest, "{")
+    if start < 0 {
+      segments = append(segments, nameSegment{literal: rest})
+      break
+    }
+    if start > 0 {
+      segments = append(segments, nameSegment{literal: rest[:start]})
+    }
+    end := strings.Index(rest[start:], "}")
+    if end < 0 {
+      return nil, fmt.Errorf("Unclosed { in %s '%s'", kind, template)
+    }
+    variable, layout, _ := strings.Cut(rest[start + 1:start + end], ":")
+    if !contains(variables, variable) {
+      return nil, fmt.Errorf("Unknown variable {%s} in %s '%s', use {%s}", variable, kind, template, strings.Join(variables, "}, {"))
+    }
+    if layout != "" && variable != "date" {
+      return nil, fmt.Errorf("Only {date} has a layout in %s '%s'", kind, template)
+    }
+    if variable == "date" && layout == "" {
+      layout = "20060102150405"
+    }
+    segments = append(segments, nameSegment{variable: variable, layout: layout})
+    rest = rest[start + end + 1:]
+  }
+  if len(segments) == 0 {
+    return nil, fmt.Errorf("Empty %s", kind)
+  }
+  return segments, nil
+}
+
+// ValidateNameTemplate checks the variables of the template, and that it
+// makes valid names.
+func ValidateNameTemplate(template string) error {
+  sample := Disk{Name: "disk", Id: "1234567890123456789", Project: "project", Zone: "europe-west1-b"}
+  _, err := TemplateSnapshotName(template, sample, time.Now())
+  return err
+}
+
+// sanitizeName lower-cases the name and replaces the invalid characters by
+// single dashes, without leading nor trailing dash.
+func sanitizeName(name string) string {
+  return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// SnapshotName generates the name of a new snapshot of the disk with the
+// default template.
+func SnapshotName(disk Disk, now time.Time) (string, error) {
+  return TemplateSnapshotName(DefaultNameTemplate, disk, now)
+}
+
+// TemplateSnapshotName generates the name of a new snapshot of the disk with
+// the template, DefaultNameTemplate if empty. The disk name is shortened to
+// fit in the GCE limit, and the name fails if it can't follow the GCE rules.
+func TemplateSnapshotName(template string, disk Disk, now time.Time) (string, error) {
+  if template == "" {
+    template = DefaultNameTemplate
+  }
+  segments, err := parseNameTemplate(template)
+  if err != nil {
+    return "", err
+  }
+
+  values := map[string]string{
+    "diskId": disk.Id,
+    "zone": disk.Location(),
+    "project": disk.Project,
+    "unix": strconv.FormatInt(now.Unix(), 10),
+    "random": randomSuffix(),
+  }
+
+  // The disk name gets the space left by the rest
+  expand := func(diskName string) string {
+    parts := make([]string, 0, len(segments))
+    for segmentIndex := 0; segmentIndex < len(segments); segmentIndex++ {
+      segment := segments[segmentIndex]
+      switch segment.variable {
+      case "":
+        parts = append(parts, segment.literal)
+      case "disk":
+        parts = append(parts, diskName)
+      case "date":
+        parts = append(parts, now.Format(segment.layout))
+      default:
+        parts = append(parts, values[segment.variable])
+      }
+    }
+    return sanitizeName(strings.Join(parts, ""))
+  }
+  diskName := sanitizeName(disk.Name)
+  // The names must start with a letter
+  if segments[0].variable == "disk" && (diskName == "" || diskName[0] < 'a' || diskName[0] > 'z') {
+    diskName = strings.Trim("disk-" + diskName, "-")
+  }
+  // With a separator, which sanitizeName may have trimmed
+  name := expand(shortenName(diskName, maxSnapshotName - len(expand("")) - 1))
+
+  if len(name) > maxSnapshotName || !snapshotNameRegexp.MatchString(name) {
+    return name, fmt.Errorf("Invalid snapshot name %s for disk %s", name, disk.Name)
+  }
+  return name, nil
+}
+
+// randomSuffix returns the random suffix of a snapshot name.
+func randomSuffix() string {
+  suffix := make([]byte, 4)
+  for suffixIndex := 0; suffixIndex < len(suffix); suffixIndex++ {
+    suffix[suffixIndex] = suffixChars[rand.Intn(len(suffixChars))]
+  }
+  return string(suffix)
+}
+
+// shortenName keeps the first and last dash-separated parts of the name
+// which fit in maxLength, or the beginning of the name if it's a single long
+// part.
+func shortenName(name string, maxLength int) string {
+  if len(name) <= maxLength {
+    return name
+  }
+  if maxLength <= 0 {
+    return ""
+  }
+
+  namesParts := strings.Split(name, "-")
+  namesPartsLen := len(namesParts)
+  startPartEnd := 0
+  endPartStart := namesPartsLen
+  // One more for the dash between the start and end parts
+  spaceLeft := maxLength + 1
+
+  // Alternately from the start and the end, while they fit
+  for startPartEnd < endPartStart {
+    taken := false
+    if spaceLeft > len(namesParts[startPartEnd]) {
+      spaceLeft -= len(namesParts[startPartEnd]) + 1
+      startPartEnd++
+      taken = true
+    }
+    if startPartEnd < endPartStart && spaceLeft > len(namesParts[endPartStart - 1]) {
+      spaceLeft -= len(namesParts[endPartStart - 1]) + 1
+      endPartStart--
+      taken = true
+    }
+    if !taken {
+      break
+    }
+  }
+
+  if startPartEnd == 0 {
+    // Even the first part is too long
+    return strings.Trim(name[:maxLength], "-")
+  }
+  parts := append(namesParts[0:startPartEnd:startPartEnd], namesParts[endPartStart:]...)
+  return strings.Join(parts, "-")
+}
@@ -0,0 +1,139 @@
+package backups
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestSnapshotNameUnique(t *testing.T) {
+  disk := Disk{Name: "db-data", Id: "1111111111111111111", Zone: "europe-west1-b"}
+  now := time.Date(2026, 10, 14, 9, 30, 15, 0, time.UTC)
+  names := make(map[string]bool)
+  // Several runs in the same second
+  for runIndex := 0; runIndex < 10; runIndex++ {
+    name, err := SnapshotName(disk, now)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !strings.HasPrefix(name, "db-data-1111111111111111111-20261014093015-") {
+      t.Errorf("Got the name %s, without the seconds", name)
+    }
+    if names[name] {
+      t.Errorf("Got the name %s twice", name)
+    }
+    names[name] = true
+  }
+}
+
+func TestSnapshotNameRules(t *testing.T) {
+  now := time.Date(2026, 10, 14, 9, 30, 15, 0, time.UTC)
+  long := "data-" + strings.Repeat("x", 20) + "-middle-part-of-the-name-" + strings.Repeat("y", 20) + "-end"
+  tests := []struct {
+    diskName string
+    prefix   string
+  }{
+    {"db-data", "db-data-"},
+    {"DB_Data.Main", "db-data-main-"},
+    {"1st-disk", "disk-1st-disk-"},
+    {"___", "disk-"},
+    {"-data-", "data-"},
+    // From the middle, in the 22 characters left
+    {long, "data-end-"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    name, err := SnapshotName(Disk{Name: test.diskName, Id: "1111111111111111111"}, now)
+    if err != nil {
+      t.Errorf("%s: %s", test.diskName, err)
+      continue
+    }
+    if len(name) > maxSnapshotName || !snapshotNameRegexp.MatchString(name) {
+      t.Errorf("%s: got the invalid name %s", test.diskName, name)
+    }
+    if !strings.HasPrefix(name, test.prefix) || !strings.Contains(name, "-1111111111111111111-20261014093015-") {
+      t.Errorf("%s: got the name %s, expected the prefix %s", test.diskName, name, test.prefix)
+    }
+  }
+}
+
+func TestShortenName(t *testing.T) {
+  tests := []struct {
+    name      string
+    maxLength int
+    expected  string
+  }{
+    {"db-data", 10, "db-data"},
+    {"prod-db-main-data-disk", 14, "prod-db-disk"},
+    {"prod-db-main-data-disk", 17, "prod-db-data-disk"},
+    {"averyveryverylongname", 8, "averyver"},
+    {"db-data", 0, ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    shortened := shortenName(test.name, test.maxLength)
+    if shortened != test.expected || len(shortened) > test.maxLength {
+      t.Errorf("%s in %d: got %s, expected %s", test.name, test.maxLength, shortened, test.expected)
+    }
+  }
+}
+
+func TestTemplateSnapshotName(t *testing.T) {
+  disk := Disk{Name: "db-data", Id: "1111111111111111111", Project: "proj", Zone: "europe-west1-b"}
+  regional := Disk{Name: "shared-data", Id: "2", Project: "proj", Region: "europe-west1"}
+  now := time.Date(2026, 10, 14, 9, 30, 15, 0, time.UTC)
+  tests := []struct {
+    template string
+    disk     Disk
+    expected string
+  }{
+    {"{disk}", disk, "db-data"},
+    {"{disk}-{diskId}", disk, "db-data-1111111111111111111"},
+    {"{disk}-{zone}", disk, "db-data-europe-west1-b"},
+    {"{disk}-{zone}", regional, "shared-data-europe-west1"},
+    {"{project}-{disk}", disk, "proj-db-data"},
+    {"{disk}-{date}", disk, "db-data-20261014093015"},
+    {"{disk}-{date:2006-01-02}", disk, "db-data-2026-10-14"},
+    {"{disk}-{unix}", disk, "db-data-1791970215"},
+    {"Backup_{disk}", disk, "backup-db-data"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    name, err := TemplateSnapshotName(test.template, test.disk, now)
+    if err != nil || name != test.expected {
+      t.Errorf("%s: got %s, %v, expected %s", test.template, name, err, test.expected)
+    }
+  }
+
+  name, err := TemplateSnapshotName("{disk}-{random}", disk, now)
+  if err != nil || len(name) != len("db-data-") + 4 {
+    t.Errorf("{disk}-{random}: got %s, %v", name, err)
+  }
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+  tests := []struct {
+    template string
+    expected string
+  }{
+    {DefaultNameTemplate, ""},
+    {"backup-{disk}-{unix}", ""},
+    {"{disk}-{host}", "Unknown variable {host}"},
+    {"{disk}-{date", "Unclosed {"},
+    {"{disk:2006}", "Only {date} has a layout"},
+    // The default one
+    {"", ""},
+    // A name must start with a letter
+    {"{unix}-{disk}", "Invalid snapshot name"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    err := ValidateNameTemplate(test.template)
+    if test.expected == "" && err != nil {
+      t.Errorf("%s: got the error %s", test.template, err)
+    }
+    if test.expected != "" && (err == nil || !strings.Contains(err.Error(), test.expected)) {
+      t.Errorf("%s: got the error %v, expected %s", test.template, err, test.expected)
+    }
+  }
+}
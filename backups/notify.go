@@ -0,0 +1,197 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "strings"
+  "time"
+)
+
+const (
+  // Notify at the end of every run
+  NotifyAlways = "always"
+  // Notify only when the run failed
+  NotifyFailure = "failure"
+)
+
+// Notifier sends the summary of a run somewhere.
+type Notifier interface {
+  Notify(ctx context.Context, summary Summary) error
+}
+
+// Timeout of the notifications, so an unreachable service doesn't hang the run
+const notifyTimeout = 10 * time.Second
+
+// Notify sends the summary to all the notifiers, according to notifyOn. The
+// unlabeled disks are notified like failures. The alert notifiers are always
+// notified, to resolve their alerts. The failing notifications are only
+// logged, and their errors returned.
+func Notify(notifiers []Notifier, notifyOn string, summary Summary, logger *log.Logger) []string {
+  errors := make([]string, 0)
+  skipSuccess := notifyOn == NotifyFailure && summary.ExitCode == ExitOK && len(summary.Violations) == 0
+
+  for notifierIndex := 0; notifierIndex < len(notifiers); notifierIndex++ {
+    if skipSuccess && !isAlertNotifier(notifiers[notifierIndex]) {
+      continue
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+    err := notifiers[notifierIndex].Notify(ctx, summary)
+    cancel()
+    if err != nil {
+      logger.Printf("WARNING: notification failed: %s\n", err)
+      errors = append(errors, err.Error())
+    }
+  }
+  return errors
+}
+
+// HTTPError is a non 2xx response, with the beginning of its body.
+type HTTPError struct {
+  Method string
+  Host   string
+  Status string
+  Code   int
+  Body   string
+}
+
+func (err *HTTPError) Error() string {
+  return fmt.Sprintf("%s %s: %s: %s", err.Method, err.Host, err.Status, err.Body)
+}
+
+// postJSON posts the payload and fails on a non 2xx response.
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+  return postJSONWithHeaders(ctx, client, url, payload, nil)
+}
+
+// postJSONWithHeaders posts the payload with the headers, like postJSON.
+func postJSONWithHeaders(ctx context.Context, client *http.Client, url string, payload interface{}, headers map[string]string) error {
+  body, err := json.Marshal(payload)
+  if err != nil {
+    return err
+  }
+  return postBody(ctx, client, url, body, headers)
+}
+
+// postBody posts the JSON body with the headers, and fails with an HTTPError
+// on a non 2xx response.
+func postBody(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+  request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  request.Header.Set("Content-Type", "application/json")
+  for key, value := range headers {
+    request.Header.Set(key, value)
+  }
+
+  if client == nil {
+    client = http.DefaultClient
+  }
+  response, err := client.Do(request)
+  if err != nil {
+    return err
+  }
+  defer response.Body.Close()
+  if response.StatusCode < 200 || response.StatusCode >= 300 {
+    responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+    return &HTTPError{Method: http.MethodPost, Host: request.URL.Host, Status: response.Status, Code: response.StatusCode, Body: strings.TrimSpace(string(responseBody))}
+  }
+  return nil
+}
+
+// summaryCounts returns the counts of the phases which were run.
+func summaryCounts(summary Summary) string {
+  counts := make([]string, 0)
+  if summary.Mode == ModeVerify {
+    return fmt.Sprintf("Disks verified: %d, stale disks: %d", summary.DisksScanned, len(summary.FailedDisks))
+  }
+  if summary.Mode == ModeDrill {
+    return fmt.Sprintf("Disks drilled: %d, failed drills: %d", len(summary.Drills), len(summary.FailedDisks))
+  }
+  if summary.Mode != ModePrune {
+    counts = append(counts, fmt.Sprintf("created: %d", summary.SnapshotsCreated))
+  }
+  if summary.Mode != ModeBackup {
+    counts = append(counts, fmt.Sprintf("deleted: %d", summary.SnapshotsDeleted))
+  }
+  if len(summary.InstantFailures) > 0 {
+    counts = append(counts, fmt.Sprintf("instant failures: %d", len(summary.InstantFailures)))
+  }
+  counts = append(counts, fmt.Sprintf("failed disks: %d", len(summary.FailedDisks)))
+  counts[0] = strings.ToUpper(counts[0][:1]) + counts[0][1:]
+  return strings.Join(counts, ", ")
+}
+
+// SlackNotifier posts the summary to a Slack incoming webhook.
+type SlackNotifier struct {
+  WebhookURL string
+  // http.DefaultClient if nil
+  Client     *http.Client
+}
+
+// summaryTitle returns the outcome of the run in a line.
+func summaryTitle(summary Summary) string {
+  title := "Backup of project " + summary.Project
+  if summary.Mode == ModeVerify {
+    title = "Backup verification of project " + summary.Project
+  } else if summary.Mode == ModeDrill {
+    title = "Restore drill of project " + summary.Project
+  } else if summary.Plan != "" {
+    title = "Backup plan " + summary.Plan + " of project " + summary.Project
+  }
+  if summary.ExitCode == ExitOK {
+    title += " complete"
+  } else {
+    title += " failed"
+  }
+  if summary.DryRun {
+    title += " (dry run)"
+  }
+  if summary.Mode == ModeBackup || summary.Mode == ModePrune {
+    title += " (" + summary.Mode + " only)"
+  }
+  return title
+}
+
+func (notifier SlackNotifier) Notify(ctx context.Context, summary Summary) error {
+  title := ":white_check_mark: " + summaryTitle(summary)
+  color := "good"
+  if summary.ExitCode != ExitOK {
+    title = ":red_circle: " + summaryTitle(summary)
+    color = "danger"
+  }
+
+  lines := []string{
+    fmt.Sprintf("Filter: `%s`", summary.Filter),
+    fmt.Sprintf("Run: `%s`", summary.RunID),
+    summaryCounts(summary),
+    fmt.Sprintf("Duration: %s", time.Duration(summary.DurationSeconds * float64(time.Second)).Round(time.Second)),
+  }
+  for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+    failure := summary.Failures[failureIndex]
+    lines = append(lines, fmt.Sprintf("• %s: %s", failure.Disk, failure.Error))
+  }
+  if len(summary.Violations) > 0 {
+    lines = append(lines, fmt.Sprintf("Disks neither backed up nor labeled `%s=false`:", BackupLabel))
+    for violationIndex := 0; violationIndex < len(summary.Violations); violationIndex++ {
+      lines = append(lines, "• " + summary.Violations[violationIndex].String())
+    }
+  }
+  if summary.Error != "" && len(summary.Failures) == 0 {
+    lines = append(lines, "Error: " + summary.Error)
+  }
+
+  payload := map[string]interface{}{
+    "text": title,
+    "attachments": []map[string]interface{}{
+      {"color": color, "text": strings.Join(lines, "\n")},
+    },
+  }
+
+  return postJSON(ctx, notifier.Client, notifier.WebhookURL, payload)
+}
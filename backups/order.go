@@ -0,0 +1,101 @@
+package backups
+
+import (
+  "fmt"
+  "sort"
+)
+
+const (
+  // Orders of the disks to snapshot: the disks without a snapshot, then the
+  // ones whose newest snapshot is the oldest, by name, or as listed
+  OrderStaleness = "staleness"
+  OrderName = "name"
+  OrderNone = "none"
+)
+
+// ValidateOrder checks the order of the disks to snapshot.
+func ValidateOrder(order string) error {
+  switch order {
+  case OrderStaleness, OrderName, OrderNone:
+    return nil
+  }
+  return fmt.Errorf("Unknown order '%s', use '%s', '%s' or '%s'", order, OrderStaleness, OrderName, OrderNone)
+}
+
+// newestBackup returns the newest snapshot of the disk created by this
+// program, not FAILED and with a creation timestamp, if any.
+func newestBackup(disk Disk) (Snapshot, bool) {
+  // The snapshots are newest first
+  for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+    snapshot := disk.Snapshots[snapshotIndex]
+    if snapshot.Labels[CreatedByLabel] != CreatedByValue || snapshot.Status == SnapshotFailed || snapshot.CreationTimestamp.IsZero() {
+      continue
+    }
+    return snapshot, true
+  }
+  return Snapshot{}, false
+}
+
+// order returns the order of the disks of the options, OrderStaleness if
+// empty.
+func (runner *Runner) order() string {
+  if runner.options.Order == "" {
+    return OrderStaleness
+  }
+  return runner.options.Order
+}
+
+// orderDisks returns the indexes of the disks in the order they are
+// snapshotted: by default the most stale disks first, so an interrupted or
+// capped run protects them first. The ties are by name.
+func (runner *Runner) orderDisks(disks []Disk, indexes []int) []int {
+  ordered := append([]int(nil), indexes...)
+  order := runner.order()
+  if order == OrderNone {
+    return ordered
+  }
+  newest := make(map[int]Snapshot, len(ordered))
+  for orderIndex := 0; orderIndex < len(ordered); orderIndex++ {
+    snapshot, found := newestBackup(disks[ordered[orderIndex]])
+    if found {
+      newest[ordered[orderIndex]] = snapshot
+    }
+  }
+  sort.SliceStable(ordered, func(i int, j int) bool {
+    first, second := newest[ordered[i]].CreationTimestamp, newest[ordered[j]].CreationTimestamp
+    if order == OrderStaleness && !first.Equal(second) {
+      return first.Before(second)
+    }
+    return disks[ordered[i]].Name < disks[ordered[j]].Name
+  })
+  return ordered
+}
+
+// orderBursts orders the disks of each burst, and the bursts by their first
+// disk, as orderDisks.
+func (runner *Runner) orderBursts(disks []Disk, bursts [][]int) [][]int {
+  allDisks := make([]int, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    allDisks = append(allDisks, diskIndex)
+  }
+  ordered := runner.orderDisks(disks, allDisks)
+  rank := make([]int, len(disks))
+  for orderIndex := 0; orderIndex < len(ordered); orderIndex++ {
+    rank[ordered[orderIndex]] = orderIndex
+  }
+
+  orderedBursts := make([][]int, 0, len(bursts))
+  for burstIndex := 0; burstIndex < len(bursts); burstIndex++ {
+    burst := append([]int(nil), bursts[burstIndex]...)
+    sort.SliceStable(burst, func(i int, j int) bool {
+      return rank[burst[i]] < rank[burst[j]]
+    })
+    if len(burst) > 0 {
+      orderedBursts = append(orderedBursts, burst)
+    }
+  }
+  sort.SliceStable(orderedBursts, func(i int, j int) bool {
+    return rank[orderedBursts[i][0]] < rank[orderedBursts[j][0]]
+  })
+  return orderedBursts
+}
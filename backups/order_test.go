@@ -0,0 +1,124 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestOrderDisks(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  day := 24 * time.Hour
+  foreign := testSnapshot("foreign", "4", now)
+  foreign.Labels = nil
+  failed := testSnapshot("failed", "5", now)
+  failed.Status = SnapshotFailed
+  disks := []Disk{
+    {Name: "b-recent", Id: "1", Snapshots: []Snapshot{testSnapshot("b-1", "1", now.Add(-day))}},
+    {Name: "a-stale", Id: "2", Snapshots: []Snapshot{testSnapshot("a-1", "2", now.Add(-5 * day))}},
+    {Name: "d-new", Id: "3"},
+    // Only the snapshots of this program, neither FAILED nor of unknown age
+    {Name: "c-foreign", Id: "4", Snapshots: []Snapshot{foreign}},
+    {Name: "e-failed", Id: "5", Snapshots: []Snapshot{failed, testSnapshot("e-1", "5", now.Add(-2 * day))}},
+    {Name: "f-unknown", Id: "6", Snapshots: []Snapshot{testSnapshot("f-1", "6", time.Time{})}},
+  }
+  tests := []struct {
+    order    string
+    indexes  []int
+    expected string
+  }{
+    // Without snapshot first, by name
+    {"", []int{0, 1, 2, 3, 4, 5}, "c-foreign,d-new,f-unknown,a-stale,e-failed,b-recent"},
+    {OrderStaleness, []int{0, 1, 4}, "a-stale,e-failed,b-recent"},
+    {OrderName, []int{0, 1, 2, 3, 4, 5}, "a-stale,b-recent,c-foreign,d-new,e-failed,f-unknown"},
+    {OrderNone, []int{4, 0, 1}, "e-failed,b-recent,a-stale"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    runner, _ := newTestRunner(newFakeRunner(t), Options{Order: test.order})
+    ordered := runner.orderDisks(disks, test.indexes)
+    names := make([]string, 0, len(ordered))
+    for orderIndex := 0; orderIndex < len(ordered); orderIndex++ {
+      names = append(names, disks[ordered[orderIndex]].Name)
+    }
+    if strings.Join(names, ",") != test.expected {
+      t.Errorf("Order '%s': got %v, expected %s", test.order, names, test.expected)
+    }
+  }
+
+  // The bursts of the groups of disks keep together
+  runner, _ := newTestRunner(newFakeRunner(t), Options{})
+  bursts := runner.orderBursts(disks, [][]int{{0, 4}, {}, {5, 1}, {2}})
+  if fmt.Sprint(bursts) != "[[2] [5 1] [4 0]]" {
+    t.Errorf("Got the bursts %v", bursts)
+  }
+}
+
+func TestValidateOrder(t *testing.T) {
+  tests := []struct {
+    order string
+    valid bool
+  }{
+    {OrderStaleness, true},
+    {OrderName, true},
+    {OrderNone, true},
+    {"size", false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    err := ValidateOrder(test.order)
+    if (err == nil) != test.valid {
+      t.Errorf("Order '%s': got %v", test.order, err)
+    }
+  }
+}
+
+func TestRunMaxCreations(t *testing.T) {
+  tests := []struct {
+    name     string
+    options  Options
+    created  string
+    deferred string
+  }{
+    // shared-data-1 is older than db-data-3
+    {"most stale first", Options{MaxCreations: 1}, "shared-data", "db-data"},
+    {"by name", Options{MaxCreations: 1, Order: OrderName}, "db-data", "shared-data"},
+    {"enough", Options{MaxCreations: 2}, "shared-data,db-data", ""},
+    // The resumed disks don't take a creation
+    {"resumed", Options{MaxCreations: 1, Resumed: map[string]string{"2222222222222222222": "shared-data-resumed"}}, "db-data", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    test.options.Concurrency = 1
+    runner, logs := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    creations := fake.ran("disks", "snapshot")
+    created := make([]string, 0, len(creations))
+    for creationIndex := 0; creationIndex < len(creations); creationIndex++ {
+      created = append(created, creations[creationIndex][4])
+    }
+    deferred := make([]string, 0, len(result.Deferred))
+    for skipIndex := 0; skipIndex < len(result.Deferred); skipIndex++ {
+      deferred = append(deferred, result.Deferred[skipIndex].Disk)
+      if !strings.Contains(result.Deferred[skipIndex].Reason, "newest snapshot is") {
+        t.Errorf("%s: got the reason '%s'", test.name, result.Deferred[skipIndex].Reason)
+      }
+    }
+    if strings.Join(created, ",") != test.created || strings.Join(deferred, ",") != test.deferred {
+      t.Errorf("%s: got %v created and %v deferred, expected %s and %s\n%s", test.name, created, deferred, test.created, test.deferred, logs)
+    }
+    // The deferred disks are not pruned
+    for deletedIndex := 0; deletedIndex < len(result.Deleted); deletedIndex++ {
+      if test.deferred != "" && strings.HasPrefix(result.Deleted[deletedIndex].Name, test.deferred + "-") {
+        t.Errorf("%s: the deferred disk was pruned of %s", test.name, result.Deleted[deletedIndex].Name)
+      }
+    }
+  }
+}
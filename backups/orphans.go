@@ -0,0 +1,267 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "time"
+)
+
+const (
+  // Only list the orphaned snapshots
+  OrphansReport = "report"
+  // Delete the orphaned snapshots older than the maximum age
+  OrphansDelete = "delete"
+)
+
+// Orphan is a snapshot created by this program whose source disk doesn't
+// exist anymore.
+type Orphan struct {
+  Snapshot   string    `json:"snapshot"`
+  SourceDisk string    `json:"sourceDisk,omitempty"`
+  // The disk is matched by id, as the names are reused
+  SourceDiskId string  `json:"sourceDiskId"`
+  CreatedAt  time.Time `json:"createdAt"`
+  Deleted    bool      `json:"deleted"`
+  // Why it's kept with OrphansDelete, like a hold label
+  Kept       string    `json:"kept,omitempty"`
+}
+
+// findOrphans lists the snapshots created by this program whose source disk
+// id matches no disk of the project. All the disks are listed, whatever the
+// filters and zones, so a disk out of them is not taken as deleted. It also
+// returns the number of snapshots created by this program, for the deletion
+// limits.
+func (runner *Runner) findOrphans(ctx context.Context) ([]Snapshot, int, error) {
+  disks, err := runner.backend.GetDisksToSnapshot(ctx, "")
+  if err != nil {
+    return nil, 0, fmt.Errorf("Listing of all the disks: %w", err)
+  }
+  diskIds := make(map[string]bool)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    diskIds[disks[diskIndex].Id] = true
+  }
+  snapshots, err := runner.backend.ListSnapshots(ctx, "labels." + CreatedByLabel + " = " + CreatedByValue)
+  if err != nil {
+    return nil, 0, fmt.Errorf("Listing of the snapshots: %w", err)
+  }
+
+  orphans := make([]Snapshot, 0)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    // Unknown disk, nothing to compare
+    if snapshot.SourceDiskId == "" {
+      continue
+    }
+    // The source disk of a copy is its deleted temporary disk
+    if snapshot.Labels[CopyOfLabel] != "" {
+      continue
+    }
+    if !diskIds[snapshot.SourceDiskId] {
+      orphans = append(orphans, snapshot)
+    }
+  }
+  return orphans, len(snapshots), nil
+}
+
+// orphanDisks groups the orphans by source disk id, as the disks to prune,
+// with the deletable ones as their candidates.
+func orphanDisks(snapshots []Snapshot, deletable []int) ([]Disk, [][]Snapshot) {
+  disks := make([]Disk, 0)
+  diskIndexes := make(map[string]int)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    diskIndex, found := diskIndexes[snapshot.SourceDiskId]
+    if !found {
+      diskIndex = len(disks)
+      diskIndexes[snapshot.SourceDiskId] = diskIndex
+      // The disk of an orphan is gone, only its name is known
+      disks = append(disks, Disk{Name: snapshot.SourceDisk, Id: snapshot.SourceDiskId})
+    }
+    disks[diskIndex].Snapshots = append(disks[diskIndex].Snapshots, snapshot)
+  }
+  candidates := make([][]Snapshot, len(disks))
+  for deletableIndex := 0; deletableIndex < len(deletable); deletableIndex++ {
+    snapshot := snapshots[deletable[deletableIndex]]
+    diskIndex := diskIndexes[snapshot.SourceDiskId]
+    candidates[diskIndex] = append(candidates[diskIndex], snapshot)
+  }
+  return disks, candidates
+}
+
+// minKeptOrphans returns the orphans still deletable once Options.MinKeep
+// snapshots are kept for each deleted disk, as for the existing disks.
+func (runner *Runner) minKeptOrphans(snapshots []Snapshot, deletable []int, orphans []Orphan, result *Result) []int {
+  byDisk := make(map[string][]Snapshot)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    byDisk[snapshots[snapshotIndex].SourceDiskId] = append(byDisk[snapshots[snapshotIndex].SourceDiskId], snapshots[snapshotIndex])
+  }
+  deletableByDisk := make(map[string][]Snapshot)
+  for deletableIndex := 0; deletableIndex < len(deletable); deletableIndex++ {
+    snapshot := snapshots[deletable[deletableIndex]]
+    deletableByDisk[snapshot.SourceDiskId] = append(deletableByDisk[snapshot.SourceDiskId], snapshot)
+  }
+  keptNames := make(map[string]bool)
+  for diskId, toDelete := range deletableByDisk {
+    _, kept := minKept(byDisk[diskId], toDelete, runner.options.MinKeep)
+    for snapshotIndex := 0; snapshotIndex < len(kept); snapshotIndex++ {
+      keptNames[kept[snapshotIndex].Name] = true
+    }
+  }
+  stillDeletable := make([]int, 0, len(deletable))
+  for deletableIndex := 0; deletableIndex < len(deletable); deletableIndex++ {
+    snapshotIndex := deletable[deletableIndex]
+    if keptNames[snapshots[snapshotIndex].Name] {
+      orphans[snapshotIndex].Kept = fmt.Sprintf("one of the last %d of its disk (min keep)", runner.options.MinKeep)
+      result.MinKept = append(result.MinKept, snapshots[snapshotIndex])
+      continue
+    }
+    stillDeletable = append(stillDeletable, snapshotIndex)
+  }
+  return stillDeletable
+}
+
+// pruneOrphans reports the orphaned snapshots, and deletes the ones older than
+// the maximum age with OrphansDelete, except the held ones and the ones used
+// by images or disks. The deletions are checked against the deletion limits,
+// confirmed, and marked first with a deletion grace period, as the ones of the
+// existing disks.
+func (runner *Runner) pruneOrphans(ctx context.Context, result *Result) error {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+  maxAge := runner.options.OrphanMaxAge
+
+  logger.Println("Looking for orphaned snapshots, of deleted disks")
+  snapshots, total, err := runner.findOrphans(ctx)
+  if err != nil {
+    return err
+  }
+  now := time.Now()
+  orphans := make([]Orphan, len(snapshots))
+  deletable := make([]int, 0)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    orphans[snapshotIndex] = Orphan{Snapshot: snapshot.Name, SourceDisk: snapshot.SourceDisk, SourceDiskId: snapshot.SourceDiskId, CreatedAt: snapshot.CreationTimestamp}
+    logger.Printf("Orphaned snapshot %s of deleted disk %s (id %s), %s old\n", snapshot.Name, snapshot.SourceDisk, snapshot.SourceDiskId, FormatAge(snapshot.CreationTimestamp, now))
+    if runner.options.Orphans != OrphansDelete {
+      continue
+    }
+    kept := HoldReason(snapshot, now)
+    if kept == "" && snapshot.CreationTimestamp.IsZero() {
+      kept = "unknown creation timestamp"
+    } else if kept == "" && now.Sub(snapshot.CreationTimestamp) < maxAge {
+      kept = "younger than " + maxAge.String()
+    }
+    orphans[snapshotIndex].Kept = kept
+    if kept == "" {
+      deletable = append(deletable, snapshotIndex)
+    }
+  }
+  result.Orphans = orphans
+  logger.Printf("Found %d orphaned snapshot(s)\n", len(orphans))
+
+  if len(deletable) > 0 && !runner.options.ForceDeleteReferenced {
+    references, err := runner.backend.ListSnapshotReferences(ctx)
+    if err != nil {
+      return fmt.Errorf("Failed to list the images and disks created from the snapshots: %w", err)
+    }
+    unreferenced := make([]int, 0, len(deletable))
+    for deletableIndex := 0; deletableIndex < len(deletable); deletableIndex++ {
+      snapshotIndex := deletable[deletableIndex]
+      resource := referencingResource(snapshots[snapshotIndex], references)
+      if resource != "" {
+        orphans[snapshotIndex].Kept = "used by " + resource
+        continue
+      }
+      unreferenced = append(unreferenced, snapshotIndex)
+    }
+    deletable = unreferenced
+  }
+  if runner.options.MinKeep > 0 && len(deletable) > 0 {
+    deletable = runner.minKeptOrphans(snapshots, deletable, orphans, result)
+  }
+  for orphanIndex := 0; orphanIndex < len(orphans); orphanIndex++ {
+    if orphans[orphanIndex].Kept != "" {
+      logger.Printf("Keeping orphaned snapshot %s: %s\n", orphans[orphanIndex].Snapshot, orphans[orphanIndex].Kept)
+    }
+  }
+  if len(deletable) == 0 {
+    logger.Println("")
+    return nil
+  }
+
+  limitsErr := runner.options.DeletionLimits.Check(len(deletable), total)
+  if limitsErr != nil && runner.options.Force {
+    runner.levels.Warning.Printf("WARNING: %s, deleting the orphaned snapshots anyway (forced)\n", limitsErr)
+  } else if limitsErr != nil {
+    runner.levels.Warning.Printf("WARNING: %s\n", limitsErr)
+    runner.levels.Warning.Printf("WARNING: the orphaned snapshots are NOT deleted, check the orphans maximum age or force the deletions\n")
+    logger.Println("")
+    return limitsErr
+  }
+
+  disks, candidates := orphanDisks(snapshots, deletable)
+  if runner.options.DeletionGrace > 0 {
+    candidates = runner.markSnapshots(ctx, disks, candidates, make([]bool, len(disks)), now, result)
+  }
+  toDelete := make([]Snapshot, 0, len(deletable))
+  candidateDisks := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    toDelete = append(toDelete, candidates[diskIndex]...)
+    if len(candidates[diskIndex]) > 0 {
+      candidateDisks++
+    }
+  }
+  if len(toDelete) == 0 {
+    logger.Println("")
+    return nil
+  }
+  if runner.options.Confirm != nil && !dryRun {
+    // Always logged, even when quiet, what is confirmed must be seen
+    runner.levels.Warning.Println("Orphaned snapshots to delete:")
+    for snapshotIndex := 0; snapshotIndex < len(toDelete); snapshotIndex++ {
+      snapshot := toDelete[snapshotIndex]
+      runner.levels.Warning.Printf("  - %s: %s, %s old\n", snapshot.SourceDisk, snapshot.Name, FormatAge(snapshot.CreationTimestamp, now))
+    }
+    if !runner.options.Confirm(len(toDelete), candidateDisks) {
+      logger.Println("Deletion of the orphaned snapshots cancelled")
+      logger.Println("")
+      return nil
+    }
+  }
+
+  deleted := make(chan snapshotResult, len(toDelete))
+  for snapshotIndex := 0; snapshotIndex < len(toDelete); snapshotIndex++ {
+    go func(snapshot Snapshot) {
+      if !runner.acquire(ctx) {
+        deleted <- snapshotResult{snapshot: snapshot, err: runner.stopped(ctx)}
+        return
+      }
+      defer runner.release()
+      operationCtx, cancel := runner.operationContext(ctx)
+      defer cancel()
+      // The disk of an orphan is gone, only its name is known
+      _, deleteErr := runner.deleteSnapshot(ctx, operationCtx, Disk{Name: snapshot.SourceDisk}, snapshot, dryRun)
+      deleted <- snapshotResult{snapshot: snapshot, err: deleteErr}
+    }(toDelete[snapshotIndex])
+  }
+  deletedNames := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(toDelete); snapshotIndex++ {
+    snapshotDeleted := <-deleted
+    if snapshotDeleted.err != nil {
+      result.Failures = append(result.Failures, Failure{Disk: snapshotDeleted.snapshot.SourceDisk, Snapshot: snapshotDeleted.snapshot.Name, Err: snapshotDeleted.err})
+      runner.levels.Warning.Printf("Failed to delete orphaned snapshot %s: %s\n", snapshotDeleted.snapshot.Name, snapshotDeleted.err)
+      continue
+    }
+    deletedNames[snapshotDeleted.snapshot.Name] = true
+    if dryRun {
+      logger.Printf("[DRY-RUN] Would delete orphaned snapshot %s\n", snapshotDeleted.snapshot.Name)
+    } else {
+      logger.Printf("Deleted orphaned snapshot %s\n", snapshotDeleted.snapshot.Name)
+    }
+  }
+  for orphanIndex := 0; orphanIndex < len(orphans); orphanIndex++ {
+    orphans[orphanIndex].Deleted = deletedNames[orphans[orphanIndex].Snapshot]
+  }
+  logger.Println("")
+  return nil
+}
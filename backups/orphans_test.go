@@ -0,0 +1,150 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+)
+
+// orphanSnapshots returns the snapshots of the existing disk db-data, and the
+// ones of the deleted disk old-data: 60, 45 and 10 days old.
+func orphanSnapshots(now time.Time) []Snapshot {
+  orphan := func(name string, age time.Duration) Snapshot {
+    snapshot := testSnapshot(name, "3333333333333333333", now.Add(-age))
+    snapshot.SourceDisk = "old-data"
+    return snapshot
+  }
+  return []Snapshot{
+    testSnapshot("db-data-1", "1111111111111111111", now.Add(-60 * 24 * time.Hour)),
+    orphan("old-1", 60 * 24 * time.Hour),
+    orphan("old-2", 45 * 24 * time.Hour),
+    orphan("old-3", 10 * 24 * time.Hour),
+  }
+}
+
+// orphansDeleted returns the names of the orphans deleted, in order.
+func orphansDeleted(orphans []Orphan) string {
+  names := make([]string, 0)
+  for orphanIndex := 0; orphanIndex < len(orphans); orphanIndex++ {
+    if orphans[orphanIndex].Deleted {
+      names = append(names, orphans[orphanIndex].Snapshot)
+    }
+  }
+  sort.Strings(names)
+  return strings.Join(names, ",")
+}
+
+func TestFindOrphans(t *testing.T) {
+  now := time.Now()
+  snapshots := orphanSnapshots(now)
+  // The temporary disk of a copy is deleted once copied
+  copied := testSnapshot("old-1-copy", "4444444444444444444", now)
+  copied.Labels[CopyOfLabel] = "old-1"
+  unknown := testSnapshot("unknown-disk", "", now)
+  // Not created by this program
+  manual := Snapshot{Name: "manual", SourceDiskId: "3333333333333333333", CreationTimestamp: now, Labels: map[string]string{}}
+  fake := newFakeRunner(t)
+  fake.listing(append(snapshots, copied, unknown, manual))
+  runner, _ := newTestRunner(fake, Options{})
+
+  orphans, total, err := runner.findOrphans(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if sortedNames(orphans) != "old-1,old-2,old-3" || total != 6 {
+    t.Errorf("Got the orphans %s of %d snapshots, expected old-1,old-2,old-3 of 6", sortedNames(orphans), total)
+  }
+  // All the disks, whatever the filters
+  listings := fake.ran("compute", "disks", "list", "--format json(")
+  if len(listings) != 1 || argValue(listings[0], "--filter") != "" {
+    t.Errorf("Got the listings of the disks %v", listings)
+  }
+}
+
+func TestPruneOrphans(t *testing.T) {
+  maxAge := 30 * 24 * time.Hour
+  tests := []struct {
+    name    string
+    options Options
+    // Confirmation asked, and its answer
+    confirm bool
+    answer  bool
+    deleted string
+    // Deletions run, less than the deleted ones in the dry runs
+    ran     int
+    marked  string
+    log     string
+    err     error
+  }{
+    {"report", Options{Orphans: OrphansReport}, false, false, "", 0, "", "Orphaned snapshot old-1 of deleted disk old-data (id 3333333333333333333), ", nil},
+    {"age limit", Options{}, false, false, "old-1,old-2", 2, "", "Keeping orphaned snapshot old-3: younger than 720h0m0s", nil},
+    {"min keep", Options{MinKeep: 2}, false, false, "old-1", 1, "", "Keeping orphaned snapshot old-2: one of the last 2 of its disk (min keep)", nil},
+    {"min keep of all", Options{MinKeep: 3}, false, false, "", 0, "", "Keeping orphaned snapshot old-1: one of the last 3 of its disk (min keep)", nil},
+    {"dry run", Options{DryRun: true}, false, false, "old-1,old-2", 0, "", "[DRY-RUN] Would delete orphaned snapshot old-1", nil},
+    {"deletion limits", Options{DeletionLimits: DeletionLimits{MaxDeletions: 1}}, false, false, "", 0, "", "WARNING: the orphaned snapshots are NOT deleted", ErrTooManyDeletions},
+    // 2 of the 4 snapshots created by this program
+    {"deletion percent", Options{DeletionLimits: DeletionLimits{MaxPercent: 40}}, false, false, "", 0, "", "WARNING: Too many snapshots to delete: 2 of the 4 snapshot(s)", ErrTooManyDeletions},
+    {"forced", Options{DeletionLimits: DeletionLimits{MaxDeletions: 1}, Force: true}, false, false, "old-1,old-2", 2, "", "WARNING: Too many snapshots to delete: 2 snapshot(s), more than the maximum of 1, deleting the orphaned snapshots anyway (forced)", nil},
+    {"confirmed", Options{}, true, true, "old-1,old-2", 2, "", "  - old-data: old-1, ", nil},
+    {"cancelled", Options{}, true, false, "", 0, "", "Deletion of the orphaned snapshots cancelled", nil},
+    {"deletion grace", Options{DeletionGrace: 72 * time.Hour}, false, false, "", 0, "old-1,old-2", "Marked snapshot old-1 of disk old-data for deletion after 72h0m0s", nil},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.listing(orphanSnapshots(time.Now()))
+    if test.options.Orphans == "" {
+      test.options.Orphans = OrphansDelete
+    }
+    test.options.OrphanMaxAge = maxAge
+    confirmations := 0
+    if test.confirm {
+      test.options.Confirm = func(snapshots int, disks int) bool {
+        confirmations++
+        if snapshots != 2 || disks != 1 {
+          t.Errorf("%s: got %d snapshot(s) of %d disk(s) to confirm", test.name, snapshots, disks)
+        }
+        return test.answer
+      }
+    }
+    runner, logs := newTestRunner(fake, test.options)
+    result := Result{}
+
+    err := runner.pruneOrphans(context.Background(), &result)
+    if !errors.Is(err, test.err) || err != nil && test.err == nil {
+      t.Fatalf("%s: got the error %v, expected %v", test.name, err, test.err)
+    }
+    if len(result.Orphans) != 3 || orphansDeleted(result.Orphans) != test.deleted {
+      t.Errorf("%s: got %s deleted of the orphans %+v, expected %s", test.name, orphansDeleted(result.Orphans), result.Orphans, test.deleted)
+    }
+    if len(fake.ran("compute", "snapshots delete")) != test.ran || len(fake.ran("snapshots delete", "db-data-1")) > 0 {
+      t.Errorf("%s: got the deletions %v", test.name, fake.ran("compute", "snapshots delete"))
+    }
+    if test.marked != "" && sortedNames(result.Marked) != test.marked || test.marked == "" && len(result.Marked) > 0 {
+      t.Errorf("%s: got %s marked, expected %s", test.name, sortedNames(result.Marked), test.marked)
+    }
+    if test.confirm && confirmations != 1 {
+      t.Errorf("%s: got %d confirmations", test.name, confirmations)
+    }
+    if !containsLine(logs.String(), test.log) {
+      t.Errorf("%s: expected '%s' in:\n%s", test.name, test.log, logs)
+    }
+  }
+}
+
+func TestRunOrphansDeleted(t *testing.T) {
+  fake := newFakeRunner(t)
+  fake.listing(orphanSnapshots(time.Now()))
+  runner, _ := newTestRunner(fake, Options{Mode: ModePrune, Orphans: OrphansDelete, OrphanMaxAge: 30 * 24 * time.Hour})
+
+  result, err := runner.Run(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if orphansDeleted(result.Orphans) != "old-1,old-2" {
+    t.Errorf("Got %s deleted of the orphans %+v", orphansDeleted(result.Orphans), result.Orphans)
+  }
+}
@@ -0,0 +1,515 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "sync"
+  "time"
+
+  "go.opentelemetry.io/otel/attribute"
+  "go.opentelemetry.io/otel/trace"
+)
+
+// pruneState is shared by the batches of disks pruned by a run: a single batch
+// of all the disks in phases, a batch by disk in the pipeline.
+type pruneState struct {
+  mutex     sync.Mutex
+  // A batch by disk: the summaries are logged once the pipeline is done
+  pipelined bool
+  // Snapshots of all the disks, and the deletions of the batches so far
+  total     int
+  reserved  int
+  // The limits were exceeded, and logged: forced, or nothing more is deleted
+  forced    bool
+  limitsErr error
+  // Snapshots whose deletion was confirmed by the pipeline once all the
+  // snapshots were created, the other ones are kept. Nil if not confirmed at
+  // once
+  confirmed map[string]bool
+  // The deletions weren't confirmed: the snapshots are still marked with a
+  // deletion grace, but none is deleted
+  cancelled bool
+  // Snapshots to delete of the applied plan, by name, instead of the ones
+  // beyond the retention. Nil out of Apply
+  planned   map[string]bool
+  // Images and disks created from the snapshots, listed once for all the
+  // batches
+  referencesListed bool
+  references       []SnapshotReference
+  referencesErr    error
+}
+
+// checkDeletions checks the deletions of a batch, over the ones of the
+// previous batches, against the deletion limits. The limits are logged once
+// exceeded, and the error is returned without Force.
+func (runner *Runner) checkDeletions(state *pruneState, deletions int) error {
+  if state.limitsErr != nil {
+    return state.limitsErr
+  }
+  limitsErr := runner.options.DeletionLimits.Check(state.reserved + deletions, state.total)
+  if limitsErr == nil {
+    return nil
+  }
+  if runner.options.Force {
+    if !state.forced {
+      runner.levels.Warning.Printf("WARNING: %s, deleting them anyway (forced)\n", limitsErr)
+      state.forced = true
+    }
+    return nil
+  }
+  runner.levels.Warning.Printf("WARNING: %s\n", limitsErr)
+  if state.reserved > 0 {
+    runner.levels.Warning.Printf("WARNING: the old snapshots of the disks not pruned yet are NOT deleted, check the retention or force the deletions\n")
+  } else {
+    runner.levels.Warning.Printf("WARNING: the old snapshots are NOT deleted, check the retention or force the deletions\n")
+  }
+  state.limitsErr = limitsErr
+  return limitsErr
+}
+
+// reserveDeletions adds the deletions of a batch to the state, unless they
+// exceed the deletion limits without Force.
+func (runner *Runner) reserveDeletions(state *pruneState, deletions int) error {
+  state.mutex.Lock()
+  defer state.mutex.Unlock()
+  err := runner.checkDeletions(state, deletions)
+  if err != nil {
+    return err
+  }
+  state.reserved += deletions
+  return nil
+}
+
+// snapshotReferences lists the images and disks created from the snapshots
+// the first time, and returns the same ones to the next batches.
+func (runner *Runner) snapshotReferences(ctx context.Context, state *pruneState) ([]SnapshotReference, error) {
+  state.mutex.Lock()
+  defer state.mutex.Unlock()
+  if !state.referencesListed {
+    state.references, state.referencesErr = runner.backend.ListSnapshotReferences(ctx)
+    if state.referencesErr != nil {
+      state.referencesErr = fmt.Errorf("Failed to list the images and disks created from the snapshots: %w", state.referencesErr)
+    }
+    state.referencesListed = true
+  }
+  return state.references, state.referencesErr
+}
+
+// plannedDeletions returns the snapshots the retention would delete by disk,
+// from the listing and the new snapshots of the disks to snapshot, so the
+// deletion limits are checked before the first creation and the deletions
+// confirmed before the first deletion of the pipeline, as in phases. The snapshots used by images or disks
+// are in: it's an upper bound. The FAILED snapshots to delete are returned
+// apart, as they don't count in the limits. The skipped disks have none.
+func (runner *Runner) plannedDeletions(disks []Disk, creating []bool, skipped []bool, now time.Time) ([][]Snapshot, [][]Snapshot) {
+  planned := make([][]Snapshot, len(disks))
+  failedPlanned := make([][]Snapshot, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if skipped[diskIndex] {
+      continue
+    }
+    snapshots := disks[diskIndex].Snapshots
+    if creating[diskIndex] {
+      created := Snapshot{CreationTimestamp: now, Labels: map[string]string{CreatedByLabel: CreatedByValue}}
+      snapshots = append([]Snapshot{created}, snapshots...)
+    }
+    unheld, _ := withoutHeld(snapshots, now)
+    ready, _, failed := snapshotsByStatus(unheld)
+    toDelete := make([]Snapshot, 0)
+    if !runner.options.RespectTTLOnly {
+      toDelete, _ = runner.retention(disks[diskIndex]).SnapshotsToDelete(ready, now)
+    }
+    expired, invalidExpiry := expiredSnapshots(ready, now)
+    toDelete = withExpired(toDelete, expired, invalidExpiry)
+    planned[diskIndex], _ = minKept(snapshots, toDelete, runner.options.MinKeep)
+    if runner.options.CleanupFailed {
+      failedPlanned[diskIndex] = failed
+    }
+  }
+  return planned, failedPlanned
+}
+
+// Most disks listed again by a single listing of the pipeline, to keep the
+// filter short
+const refreshBatchSize = 50
+
+// prunePipeline prunes each disk as soon as its snapshot is created, while the
+// other disks are still snapshotted, instead of once all the snapshots are
+// created. The deletions take the slots of the same concurrency limit as the
+// creations.
+type prunePipeline struct {
+  runner    *Runner
+  ctx       context.Context
+  span      trace.Span
+  state     *pruneState
+  waitGroup sync.WaitGroup
+  mutex     sync.Mutex
+  // Outcome of the disks pruned so far, added to the result of the run once
+  // they are all pruned, and their snapshots listed again by index
+  result    Result
+  refreshed [][]Snapshot
+  // Disks waiting to be listed again, all at once by the next listing, while
+  // a listing is running
+  pending   []pendingDisk
+  listing   bool
+  // Aborts the prune of the next disks
+  err       error
+  // Closed once the deletions are confirmed, or at once if they aren't asked
+  // for: the disks wait for it before being pruned
+  confirmation chan struct{}
+  // The deletions weren't confirmed: none is pruned, unless to be marked with
+  // a deletion grace
+  cancelled bool
+  // Snapshots listed by disk, by index, when streamDisks released them once
+  // counted: the disks are all listed again, and only the snapshots named by
+  // the summary are kept once pruned, with the others counted. Nil otherwise
+  listed    []int
+  released  map[string]ReleasedSnapshots
+}
+
+// pendingDisk is a disk of the pipeline waiting to be listed again.
+type pendingDisk struct {
+  diskIndex int
+  disk      Disk
+  blocked   bool
+  created   string
+}
+
+// creatingDisks returns the disks to snapshot: the ones neither resumed, not
+// due, deferred nor over the quota.
+func (runner *Runner) creatingDisks(disks []Disk, overQuota []bool, notDue []bool, deferred []bool) []bool {
+  creating := make([]bool, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    _, resumed := runner.options.Resumed[disks[diskIndex].Id]
+    creating[diskIndex] = !resumed && !notDue[diskIndex] && !deferred[diskIndex] && !overQuota[diskIndex]
+  }
+  return creating
+}
+
+// startPipeline checks the deletions planned for the disks against the
+// deletion limits, and returns the pipeline pruning them. The snapshots of the
+// disks creating one are planned with it, and the skipped disks aren't pruned.
+// Beyond the limits, without Force, or if not confirmed by confirm, the disks
+// are still snapshotted but none is pruned.
+func (runner *Runner) startPipeline(ctx context.Context, disks []Disk, creating []bool, skipped []bool) *prunePipeline {
+  total := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    // As in phases, counting the created snapshots
+    total += len(disks[diskIndex].Snapshots)
+    if creating[diskIndex] {
+      total++
+    }
+  }
+  planned, _ := runner.plannedDeletions(disks, creating, skipped, time.Now())
+  plannedCount := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    plannedCount += len(planned[diskIndex])
+  }
+  return runner.newPipeline(ctx, len(disks), total, plannedCount)
+}
+
+// newPipeline returns the pipeline pruning the disks, from the count of their
+// snapshots and of the deletions planned, as startPipeline.
+func (runner *Runner) newPipeline(ctx context.Context, disks int, total int, plannedCount int) *prunePipeline {
+  logger := runner.logger
+  ctx, span := StartSpan(ctx, "pipeline")
+  runner.logPrune()
+  logger.Println("Each disk is pruned once its snapshot is created")
+
+  pipeline := &prunePipeline{runner: runner, ctx: ctx, span: span, state: &pruneState{pipelined: true, total: total}, refreshed: make([][]Snapshot, disks), confirmation: make(chan struct{})}
+  if total > 0 {
+    logger.Printf("Planned deletions: %d of %d snapshot(s) (%.1f%%), %s\n", plannedCount, total, deletionPercent(plannedCount, total), runner.options.DeletionLimits)
+  }
+  pipeline.err = runner.checkDeletions(pipeline.state, plannedCount)
+  if pipeline.err != nil || runner.options.Confirm == nil || runner.options.DryRun {
+    close(pipeline.confirmation)
+  }
+  logger.Println("")
+  return pipeline
+}
+
+// confirm asks for the confirmation of the deletions planned for the disks at
+// once, after all the creations so the list is accurate, then lets the disks
+// be pruned. With a deletion grace, only the snapshots marked for longer than
+// the grace are deleted, so asked for, and the marks don't depend on the
+// answer. The snapshots listed again and not confirmed are kept, and the
+// blocked disks aren't pruned.
+func (pipeline *prunePipeline) confirm(disks []Disk, pruneBlocked []bool) {
+  select {
+  case <-pipeline.confirmation:
+    // Not asked for
+    return
+  default:
+  }
+  defer close(pipeline.confirmation)
+  runner := pipeline.runner
+  // Once stopped, nothing is deleted anyway
+  if runner.stopped(pipeline.ctx) != nil {
+    return
+  }
+  now := time.Now()
+  // The snapshots created are in the disks by now
+  planned, failedPlanned := runner.plannedDeletions(disks, make([]bool, len(disks)), pruneBlocked, now)
+  toConfirm := make([][]Snapshot, len(disks))
+  pipeline.state.confirmed = make(map[string]bool)
+  grace := runner.options.DeletionGrace
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if grace > 0 {
+      // As markSnapshots, the other ones are only marked or left marked
+      expired := make([]Snapshot, 0, len(planned[diskIndex]))
+      for snapshotIndex := 0; snapshotIndex < len(planned[diskIndex]); snapshotIndex++ {
+        since, marked := PendingSince(planned[diskIndex][snapshotIndex])
+        if marked && !now.Before(since.Add(grace)) {
+          expired = append(expired, planned[diskIndex][snapshotIndex])
+        }
+      }
+      planned[diskIndex] = expired
+    }
+    toConfirm[diskIndex] = append(planned[diskIndex], failedPlanned[diskIndex]...)
+    for snapshotIndex := 0; snapshotIndex < len(toConfirm[diskIndex]); snapshotIndex++ {
+      pipeline.state.confirmed[toConfirm[diskIndex][snapshotIndex].Name] = true
+    }
+  }
+  if len(pipeline.state.confirmed) == 0 {
+    return
+  }
+  cancelled := !runner.confirmDeletions(disks, toConfirm, now)
+  runner.logger.Println("")
+  pipeline.state.cancelled = cancelled
+  pipeline.mutex.Lock()
+  // Still marked with a deletion grace
+  pipeline.cancelled = cancelled && grace == 0
+  pipeline.mutex.Unlock()
+}
+
+// prune prunes the disk in the background, once its snapshot is created or
+// failed, with its created snapshot, if any. The disk is a copy: its
+// snapshots listed again are set back by wait. Released, the blocked disks
+// are listed again too, for their held snapshots.
+func (pipeline *prunePipeline) prune(diskIndex int, disk Disk, blocked bool, created string) {
+  runner := pipeline.runner
+  pipeline.waitGroup.Add(1)
+  if (!blocked || pipeline.listed != nil) && !runner.options.NoRefresh {
+    // Listed again with the other disks waiting for it
+    pipeline.mutex.Lock()
+    pipeline.pending = append(pipeline.pending, pendingDisk{diskIndex: diskIndex, disk: disk, blocked: blocked, created: created})
+    listing := pipeline.listing
+    pipeline.listing = true
+    pipeline.mutex.Unlock()
+    if !listing {
+      go pipeline.refresh()
+    }
+    return
+  }
+  go func() {
+    defer pipeline.waitGroup.Done()
+    pipeline.pruneDisk(diskIndex, disk, blocked, nil)
+  }()
+}
+
+// refresh lists the snapshots of the disks waiting for it again, in a single
+// listing for up to refreshBatchSize disks, and prunes them in the background,
+// until no disk is waiting. A disk whose listing fails keeps its old
+// snapshots, as a failure.
+func (pipeline *prunePipeline) refresh() {
+  runner := pipeline.runner
+  for {
+    pipeline.mutex.Lock()
+    batch := pipeline.pending
+    if len(batch) > refreshBatchSize {
+      batch = batch[:refreshBatchSize]
+    }
+    pipeline.pending = pipeline.pending[len(batch):]
+    if len(batch) == 0 {
+      pipeline.listing = false
+      pipeline.mutex.Unlock()
+      return
+    }
+    pipeline.mutex.Unlock()
+
+    batchDisks := make([]Disk, 0, len(batch))
+    for batchIndex := 0; batchIndex < len(batch); batchIndex++ {
+      batchDisks = append(batchDisks, batch[batchIndex].disk)
+    }
+    var snapshots []Snapshot
+    var err error
+    listed := !pipeline.aborted() && runner.acquire(pipeline.ctx)
+    if listed {
+      snapshots, err = runner.disksSnapshots(pipeline.ctx, batchDisks)
+      runner.release()
+    }
+    snapshotsByDisk := groupSnapshotsByDisk(snapshots)
+    for batchIndex := 0; batchIndex < len(batch); batchIndex++ {
+      pending := batch[batchIndex]
+      if !listed {
+        pipeline.waitGroup.Done()
+        continue
+      }
+      if err != nil {
+        runner.levels.Warning.Printf("Failed to list the snapshots of disk %s again, keeping its old snapshots: %s\n", pending.disk.Name, err)
+        runner.progress(DiskProgress{Disk: pending.disk, Phase: PhasePruneFailed, Err: err})
+        pipeline.add(pending.diskIndex, nil, Result{Failures: []Failure{{Disk: pending.disk.Name, Err: fmt.Errorf("Listing of the snapshots before the deletions: %w", err)}}}, nil)
+        pipeline.waitGroup.Done()
+        continue
+      }
+      go func(pending pendingDisk, fresh []Snapshot) {
+        defer pipeline.waitGroup.Done()
+        pipeline.pruneDisk(pending.diskIndex, pending.disk, pending.blocked, func(disk *Disk) {
+          createdNames := make(map[string]bool)
+          if pending.created != "" {
+            createdNames[pending.created] = true
+          }
+          runner.refreshDisk(disk, fresh, createdNames, pipeline.listed != nil)
+        })
+      }(pending, snapshotsByDisk[pending.disk.Id])
+    }
+  }
+}
+
+// aborted tells if the next disks aren't pruned: the prune was aborted, not
+// confirmed or the run stopped.
+func (pipeline *prunePipeline) aborted() bool {
+  pipeline.mutex.Lock()
+  aborted := pipeline.err != nil || pipeline.cancelled
+  pipeline.mutex.Unlock()
+  return aborted || pipeline.runner.stopped(pipeline.ctx) != nil
+}
+
+// pruneDisk prunes the disk, its snapshots replaced by the ones listed again
+// by refresh first, if not nil.
+func (pipeline *prunePipeline) pruneDisk(diskIndex int, disk Disk, blocked bool, refresh func(disk *Disk)) {
+  runner := pipeline.runner
+  // Nothing is deleted before the answer of the confirmation. Once stopped or
+  // cancelled, no deletion is started
+  <-pipeline.confirmation
+  if pipeline.aborted() {
+    return
+  }
+  var pruned Result
+  batch := []Disk{disk}
+  if refresh != nil {
+    refresh(&batch[0])
+    known := len(disk.Snapshots)
+    if pipeline.listed != nil {
+      known += pipeline.listed[diskIndex]
+    }
+    // As in phases, the limits apply to the snapshots listed again
+    pipeline.state.mutex.Lock()
+    pipeline.state.total += len(batch[0].Snapshots) - known
+    pipeline.state.mutex.Unlock()
+  }
+  err := runner.pruneDisks(pipeline.ctx, batch, []bool{blocked}, pipeline.state, &pruned)
+  var refreshed []Snapshot
+  if refresh != nil && pipeline.listed != nil {
+    refreshed = pipeline.release(disk, batch[0].Snapshots, pruned)
+  } else if refresh != nil {
+    refreshed = batch[0].Snapshots
+  }
+  pipeline.add(diskIndex, refreshed, pruned, err)
+}
+
+// release counts the snapshots of the disk pruned by status and their
+// storage, and returns the ones the summary names: the created, deleted,
+// marked and held ones. The others aren't kept until the end of the run.
+func (pipeline *prunePipeline) release(disk Disk, snapshots []Snapshot, pruned Result) []Snapshot {
+  named := make(map[string]bool)
+  // The created snapshot, the only one left of the listing
+  for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+    named[disk.Snapshots[snapshotIndex].Name] = true
+  }
+  for snapshotIndex := 0; snapshotIndex < len(pruned.Deleted); snapshotIndex++ {
+    named[pruned.Deleted[snapshotIndex].Name] = true
+  }
+  for snapshotIndex := 0; snapshotIndex < len(pruned.Marked); snapshotIndex++ {
+    named[pruned.Marked[snapshotIndex].Name] = true
+  }
+  for snapshotIndex := 0; snapshotIndex < len(pruned.Held); snapshotIndex++ {
+    named[pruned.Held[snapshotIndex].Name] = true
+  }
+  kept := make([]Snapshot, 0, len(named))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    if named[snapshots[snapshotIndex].Name] {
+      kept = append(kept, snapshots[snapshotIndex])
+    }
+  }
+  runner := pipeline.runner
+  counted := ReleasedSnapshots{Statuses: countStatuses(snapshots)}
+  if runner.options.PricePerGbMonth > 0 {
+    counted.Storage = SnapshotsCost(snapshots, runner.prices())
+    if runner.options.CostLabel != "" {
+      counted.ByLabel = snapshotsCostByLabel(snapshots, runner.prices(), runner.options.CostLabel)
+    }
+  }
+  pipeline.mutex.Lock()
+  pipeline.released[disk.Id] = counted
+  pipeline.mutex.Unlock()
+  return kept
+}
+
+// add adds the outcome of the prune of a disk to the pipeline.
+func (pipeline *prunePipeline) add(diskIndex int, refreshed []Snapshot, pruned Result, err error) {
+  pipeline.mutex.Lock()
+  defer pipeline.mutex.Unlock()
+  pipeline.refreshed[diskIndex] = refreshed
+  addPruned(&pipeline.result, pruned)
+  if err != nil && pipeline.err == nil {
+    pipeline.err = err
+  }
+}
+
+// addPruned adds the outcome of the prune of disks to the result, the fields
+// set by pruneDisks.
+func addPruned(result *Result, pruned Result) {
+  result.Held = append(result.Held, pruned.Held...)
+  result.InvalidExpiry = append(result.InvalidExpiry, pruned.InvalidExpiry...)
+  result.Referenced = append(result.Referenced, pruned.Referenced...)
+  result.MinKept = append(result.MinKept, pruned.MinKept...)
+  result.Marked = append(result.Marked, pruned.Marked...)
+  result.Unmarked = append(result.Unmarked, pruned.Unmarked...)
+  result.Deleted = append(result.Deleted, pruned.Deleted...)
+  result.Failures = append(result.Failures, pruned.Failures...)
+  result.Operations = append(result.Operations, pruned.Operations...)
+}
+
+// wait waits for the disks being pruned, adds their outcome to the result and
+// logs the summary of the prune phase. It returns the error which aborted the
+// prune of the disks, if any.
+func (pipeline *prunePipeline) wait(disks []Disk, result *Result) error {
+  runner := pipeline.runner
+  logger := runner.logger
+  pipeline.waitGroup.Wait()
+
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if pipeline.refreshed[diskIndex] != nil {
+      disks[diskIndex].Snapshots = pipeline.refreshed[diskIndex]
+    }
+  }
+  pruned := pipeline.result
+  addPruned(result, pruned)
+  if pipeline.listed != nil {
+    result.Released = pipeline.released
+  }
+  // Cancelled as in phases, without summary
+  if pipeline.cancelled {
+    EndSpan(pipeline.span, nil)
+    return nil
+  }
+
+  // Cancelled with a deletion grace, the marks are logged
+  state := pipeline.state
+  if pipeline.err == nil && state.total > 0 {
+    logger.Printf("Deletions: %d of %d snapshot(s) (%.1f%%), %s\n", state.reserved, state.total, deletionPercent(state.reserved, state.total), runner.options.DeletionLimits)
+  }
+  if pipeline.err == nil && runner.options.DeletionGrace > 0 {
+    logger.Printf("Marked %d snapshot(s) for deletion, unmarked %d\n", len(pruned.Marked), len(pruned.Unmarked))
+  }
+  if runner.options.DryRun {
+    logger.Printf("[DRY-RUN] %d snapshot(s) would be deleted\n", len(pruned.Deleted))
+  } else if !state.cancelled {
+    logger.Printf("Deleted %d snapshot(s)\n", len(pruned.Deleted))
+  }
+  logger.Println("")
+  pipeline.span.SetAttributes(attribute.Int("snapshots.deleted", len(pruned.Deleted)))
+  EndSpan(pipeline.span, pipeline.err)
+  return pipeline.err
+}
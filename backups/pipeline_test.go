@@ -0,0 +1,204 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestReserveDeletions(t *testing.T) {
+  tests := []struct {
+    name     string
+    limits   DeletionLimits
+    force    bool
+    total    int
+    batches  []int
+    reserved int
+    // Index of the first batch over the limits, the next ones too, -1 if none
+    failed   int
+    warning  string
+  }{
+    {"within", DeletionLimits{MaxDeletions: 5}, false, 10, []int{2, 2}, 4, -1, ""},
+    {"no limits", DeletionLimits{}, false, 100, []int{100}, 100, -1, ""},
+    {"exceeded", DeletionLimits{MaxDeletions: 3}, false, 10, []int{2, 2, 1}, 2, 1, "WARNING: the old snapshots of the disks not pruned yet are NOT deleted"},
+    {"exceeded at once", DeletionLimits{MaxDeletions: 1}, false, 10, []int{2, 1}, 0, 0, "WARNING: the old snapshots are NOT deleted"},
+    {"percent", DeletionLimits{MaxPercent: 50}, false, 10, []int{3, 3}, 3, 1, "WARNING: Too many snapshots to delete: 6 of the 10 snapshot(s)"},
+    {"forced", DeletionLimits{MaxDeletions: 1}, true, 10, []int{2, 2}, 4, -1, "deleting them anyway (forced)"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    runner, logs := newTestRunner(newFakeRunner(t), Options{DeletionLimits: test.limits, Force: test.force})
+    state := &pruneState{pipelined: true, total: test.total}
+    for batchIndex := 0; batchIndex < len(test.batches); batchIndex++ {
+      err := runner.reserveDeletions(state, test.batches[batchIndex])
+      failed := test.failed >= 0 && batchIndex >= test.failed
+      if failed != errors.Is(err, ErrTooManyDeletions) {
+        t.Errorf("%s: got the error %v for the batch %d", test.name, err, batchIndex)
+      }
+    }
+    if state.reserved != test.reserved {
+      t.Errorf("%s: got %d reserved, expected %d", test.name, state.reserved, test.reserved)
+    }
+    // Logged once
+    if test.warning != "" && strings.Count(logs.String(), test.warning) != 1 {
+      t.Errorf("%s: expected the warning '%s' once in:\n%s", test.name, test.warning, logs)
+    }
+  }
+}
+
+func TestReserveDeletionsConcurrently(t *testing.T) {
+  runner, _ := newTestRunner(newFakeRunner(t), Options{DeletionLimits: DeletionLimits{MaxDeletions: 50}})
+  state := &pruneState{pipelined: true, total: 1000}
+  var waitGroup sync.WaitGroup
+  var mutex sync.Mutex
+  refused := 0
+  for batchIndex := 0; batchIndex < 100; batchIndex++ {
+    waitGroup.Add(1)
+    go func() {
+      defer waitGroup.Done()
+      err := runner.reserveDeletions(state, 1)
+      if err != nil {
+        mutex.Lock()
+        refused++
+        mutex.Unlock()
+      }
+    }()
+  }
+  waitGroup.Wait()
+  // None reserved once a batch was refused
+  if state.reserved != 50 || refused != 50 {
+    t.Errorf("Got %d reserved and %d refused, expected 50 and 50", state.reserved, refused)
+  }
+}
+
+func TestPipelineRefreshBatched(t *testing.T) {
+  disks, snapshots := generatedFleet(120, 3, time.Now().Add(-time.Hour))
+  fake := newFakeRunner(t)
+  fake.answer(disksJSON(disks), "compute", "disks", "list", "--format json(")
+  fake.listing(snapshots)
+  // The disks snapshotted meanwhile wait for the next listing
+  listed := snapshotsJSON(snapshots)
+  fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list", "sourceDiskId = ("}, delay: 100 * time.Millisecond, answer: func(args []string) ([]byte, error) {
+    return filterSnapshotsJSON(listed, argValue(args, "--filter"))
+  }})
+  runner, _ := newTestRunner(fake, Options{Concurrency: 200})
+
+  result, err := runner.Run(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  // With the new snapshot, the limit of 2 leaves one of the 3 old ones
+  if len(result.Created) != 120 || len(result.Deleted) != 240 {
+    t.Fatalf("Got %d created and %d deleted, expected 120 and 240", len(result.Created), len(result.Deleted))
+  }
+  listings := fake.ran("compute", "snapshots", "list", "sourceDiskId = (")
+  // A first listing, and the disks waiting for it in batches
+  if len(listings) > 5 {
+    t.Errorf("Got %d listings of the snapshots again, expected at most 5", len(listings))
+  }
+  listedIds := make(map[string]int)
+  for listingIndex := 0; listingIndex < len(listings); listingIndex++ {
+    ids := strings.Fields(strings.Trim(strings.TrimPrefix(argValue(listings[listingIndex], "--filter"), "sourceDiskId = "), "()"))
+    if len(ids) > refreshBatchSize {
+      t.Errorf("Got %d disks listed at once, more than %d", len(ids), refreshBatchSize)
+    }
+    for idIndex := 0; idIndex < len(ids); idIndex++ {
+      listedIds[ids[idIndex]]++
+    }
+  }
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if listedIds[disks[diskIndex].Id] != 1 {
+      t.Errorf("Disk %s listed %d times again", disks[diskIndex].Name, listedIds[disks[diskIndex].Id])
+    }
+  }
+}
+
+func TestPipelineConfirm(t *testing.T) {
+  extra := testSnapshot("db-data-0", "1111111111111111111", time.Date(2026, 10, 9, 2, 0, 0, 0, time.UTC))
+  tests := []struct {
+    name    string
+    options Options
+    answer  bool
+    // The snapshot appears in the listing before the deletions
+    extra   bool
+    // db-data-1 is marked for deletion for longer than the grace
+    pending bool
+    deleted string
+    marked  string
+    // Expected calls of Confirm, as snapshots/disks, all after the 2
+    // creations and before the first deletion
+    confirmed string
+  }{
+    // The 2 old snapshots of db-data, on 1 disk
+    {"confirmed", Options{}, true, false, false, "db-data-1,db-data-2", "", "2/1"},
+    {"cancelled", Options{}, false, false, false, "", "", "2/1"},
+    // db-data-0 would be deleted too, but wasn't confirmed
+    {"listed after the confirmation", Options{}, true, true, false, "db-data-1,db-data-2", "", "2/1"},
+    {"dry run", Options{DryRun: true}, false, false, false, "db-data-1,db-data-2", "", ""},
+    {"phased", Options{Phased: true}, true, false, false, "db-data-1,db-data-2", "", "2/1"},
+    {"phased cancelled", Options{Phased: true}, false, false, false, "", "", "2/1"},
+    // Only marked, nothing to confirm
+    {"grace", Options{DeletionGrace: 72 * time.Hour}, true, false, false, "", "db-data-1,db-data-2", ""},
+    // Only the snapshot marked for longer than the grace is asked for, the
+    // other one is marked whatever the answer
+    {"grace confirmed", Options{DeletionGrace: 72 * time.Hour}, true, false, true, "db-data-1", "db-data-2", "1/1"},
+    {"grace cancelled", Options{DeletionGrace: 72 * time.Hour}, false, false, true, "", "db-data-2", "1/1"},
+    {"phased grace", Options{Phased: true, DeletionGrace: 72 * time.Hour}, true, false, false, "", "db-data-1,db-data-2", ""},
+    {"phased grace cancelled", Options{Phased: true, DeletionGrace: 72 * time.Hour}, false, false, true, "", "db-data-2", "1/1"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    snapshots := readTestdata(t, "snapshots.json")
+    if test.pending {
+      marked := strings.Replace(snapshots, "\"created-by\": \"gcp-backups\"\n    },\n    \"name\": \"db-data-1\"", "\"created-by\": \"gcp-backups\", \"" + PendingDeleteLabel + "\": \"20200101-000000\"\n    },\n    \"name\": \"db-data-1\"", 1)
+      if marked == snapshots {
+        t.Fatal("db-data-1 not found in the fixture")
+      }
+      snapshots = marked
+      fake.listing(nil)
+      fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list"}, answer: func(args []string) ([]byte, error) {
+        return filterSnapshotsJSON(snapshots, argValue(args, "--filter"))
+      }})
+    }
+    if test.extra {
+      fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list", "sourceDiskId = ("}, answer: func(args []string) ([]byte, error) {
+        return filterSnapshotsJSON(strings.TrimSuffix(strings.TrimSpace(snapshots), "]") + "," + strings.TrimPrefix(snapshotsJSON([]Snapshot{extra}), "["), argValue(args, "--filter"))
+      }})
+    }
+    calls := make([]string, 0)
+    test.options.Confirm = func(snapshots int, disks int) bool {
+      calls = append(calls, fmt.Sprintf("%d/%d/%d/%d", snapshots, disks, len(fake.ran("disks", "snapshot")), len(fake.ran("compute snapshots delete"))))
+      return test.answer
+    }
+    runner, logs := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if len(result.Created) != 2 || sortedNames(result.Deleted) != test.deleted || sortedNames(result.Marked) != test.marked {
+      t.Errorf("%s: got %s created, %s deleted and %s marked, expected %s deleted and %s marked", test.name, snapshotNames(result.Created), sortedNames(result.Deleted), sortedNames(result.Marked), test.deleted, test.marked)
+    }
+    expected := ""
+    if test.confirmed != "" {
+      expected = test.confirmed + "/2/0"
+    }
+    if strings.Join(calls, ",") != expected {
+      t.Errorf("%s: got the confirmations %v, expected %s", test.name, calls, expected)
+    }
+    if test.confirmed != "" && (!containsLine(logs.String(), "Snapshots to delete:") || !containsLine(logs.String(), "  - db-data: db-data-1, ")) {
+      t.Errorf("%s: the snapshots to delete not listed in:\n%s", test.name, logs)
+    }
+    if !test.answer && test.confirmed != "" && !containsLine(logs.String(), "Deletion of the old snapshots cancelled") {
+      t.Errorf("%s: the cancellation not logged in:\n%s", test.name, logs)
+    }
+    if test.extra && !containsLine(logs.String(), "Keeping snapshot db-data-0 of disk db-data: not in the confirmed deletions") {
+      t.Errorf("%s: db-data-0 not kept in:\n%s", test.name, logs)
+    }
+  }
+}
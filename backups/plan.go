@@ -0,0 +1,191 @@
+package backups
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "log"
+  "os"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+// RunPlan is what a dry run would create and delete, to be reviewed.
+type RunPlan struct {
+  // Name of the plan of the config file, if any
+  Plan      string     `json:"plan,omitempty"`
+  // Id of the dry run
+  RunID     string     `json:"runId,omitempty"`
+  Mode      string     `json:"mode"`
+  Project   string     `json:"project"`
+  Filter    string     `json:"filter"`
+  CreatedAt time.Time  `json:"createdAt"`
+  Disks     []DiskPlan `json:"disks"`
+}
+
+// DiskPlan is what a dry run would do for one disk.
+type DiskPlan struct {
+  Name      string            `json:"name"`
+  Id        string            `json:"id"`
+  Project   string            `json:"project"`
+  Zone      string            `json:"zone,omitempty"`
+  Region    string            `json:"region,omitempty"`
+  // Snapshots of the disk when planned, to check they didn't change
+  Snapshots []string          `json:"snapshots"`
+  // Snapshot to create, nil if none
+  Create    *PlannedSnapshot  `json:"create,omitempty"`
+  // Why no snapshot is due for the disk, if none
+  NotDue    string            `json:"notDue,omitempty"`
+  // Why the disk is left to a next run, beyond --max-creations
+  Deferred  string            `json:"deferred,omitempty"`
+  Delete    []PlannedSnapshot `json:"delete"`
+  // Number of snapshots kept, with the created one
+  Keep      int               `json:"keep"`
+  // The dry run failed for the disk, e.g. for an unknown KMS key alias
+  Failed    bool              `json:"failed,omitempty"`
+}
+
+// PlannedSnapshot is a snapshot to create or delete.
+type PlannedSnapshot struct {
+  Name              string            `json:"name"`
+  CreationTimestamp time.Time         `json:"creationTimestamp,omitzero"`
+  // Age of the snapshot to delete when planned
+  Age               string            `json:"age,omitempty"`
+  StorageLocation   string            `json:"storageLocation,omitempty"`
+  GuestFlush        bool              `json:"guestFlush,omitempty"`
+  ChainName         string            `json:"chainName,omitempty"`
+  SnapshotType      string            `json:"snapshotType,omitempty"`
+  Labels            map[string]string `json:"labels,omitempty"`
+  KmsKey            string            `json:"kmsKey,omitempty"`
+  Description       string            `json:"description,omitempty"`
+}
+
+// NewRunPlan returns the snapshots created and deleted by the run, for each
+// disk.
+func NewRunPlan(result Result) RunPlan {
+  plan := RunPlan{Mode: result.Mode, RunID: result.RunID, Project: result.Project, Filter: result.Filter, CreatedAt: result.StartedAt, Disks: make([]DiskPlan, 0, len(result.Disks))}
+
+  created := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Created); snapshotIndex++ {
+    created[result.Created[snapshotIndex].Name] = true
+  }
+  deleted := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Deleted); snapshotIndex++ {
+    deleted[result.Deleted[snapshotIndex].Name] = true
+  }
+  notDue := make(map[string]string)
+  for skipIndex := 0; skipIndex < len(result.NotDue); skipIndex++ {
+    notDue[result.NotDue[skipIndex].Disk] = result.NotDue[skipIndex].Reason
+  }
+  deferred := make(map[string]string)
+  for skipIndex := 0; skipIndex < len(result.Deferred); skipIndex++ {
+    deferred[result.Deferred[skipIndex].Disk] = result.Deferred[skipIndex].Reason
+  }
+  failedDisks := result.FailedDisks()
+  for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+    disk := result.Disks[diskIndex]
+    diskPlan := DiskPlan{Name: disk.Name, Id: disk.Id, Project: disk.Project, Zone: disk.Zone, Region: disk.Region, Snapshots: make([]string, 0), Delete: make([]PlannedSnapshot, 0), NotDue: notDue[disk.Name], Deferred: deferred[disk.Name], Failed: contains(failedDisks, disk.Name)}
+    for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+      snapshot := disk.Snapshots[snapshotIndex]
+      if created[snapshot.Name] {
+        diskPlan.Create = &PlannedSnapshot{Name: snapshot.Name, StorageLocation: snapshot.StorageLocation, GuestFlush: snapshot.GuestFlush, ChainName: snapshot.ChainName, SnapshotType: snapshot.SnapshotType, Labels: snapshot.Labels, KmsKey: snapshot.KmsKey, Description: snapshot.Description}
+      } else {
+        diskPlan.Snapshots = append(diskPlan.Snapshots, snapshot.Name)
+      }
+      if deleted[snapshot.Name] {
+        diskPlan.Delete = append(diskPlan.Delete, PlannedSnapshot{Name: snapshot.Name, CreationTimestamp: snapshot.CreationTimestamp, Age: FormatAge(snapshot.CreationTimestamp, result.StartedAt)})
+      } else {
+        diskPlan.Keep++
+      }
+    }
+    plan.Disks = append(plan.Disks, diskPlan)
+  }
+  return plan
+}
+
+// Log prints the plan as a table.
+func (plan RunPlan) Log(logger *log.Logger) {
+  var table bytes.Buffer
+  writer := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(writer, "DISK\tCREATE\tDELETE\tKEEP")
+  creations := 0
+  deletions := 0
+  for diskIndex := 0; diskIndex < len(plan.Disks); diskIndex++ {
+    disk := plan.Disks[diskIndex]
+    create := "-"
+    if disk.Create != nil {
+      create = disk.Create.Name
+      creations++
+    } else if disk.Failed {
+      create = "FAILED"
+    } else if disk.NotDue != "" {
+      create = "not due (" + disk.NotDue + ")"
+    } else if disk.Deferred != "" {
+      create = "deferred (" + disk.Deferred + ")"
+    }
+    deletions += len(disk.Delete)
+    fmt.Fprintf(writer, "%s\t%s\t%d\t%d\n", disk.Name, create, len(disk.Delete), disk.Keep)
+  }
+  writer.Flush()
+
+  logger.Println("")
+  if plan.Plan != "" {
+    logger.Printf("[DRY-RUN] Plan %s: %d snapshot(s) to create, %d to delete\n", plan.Plan, creations, deletions)
+  } else {
+    logger.Printf("[DRY-RUN] Plan: %d snapshot(s) to create, %d to delete\n", creations, deletions)
+  }
+  lines := strings.Split(strings.TrimRight(table.String(), "\n"), "\n")
+  for lineIndex := 0; lineIndex < len(lines); lineIndex++ {
+    logger.Printf("  %s\n", lines[lineIndex])
+  }
+}
+
+// PlanFile is the file of the plans of a dry run.
+type PlanFile struct {
+  CreatedAt time.Time `json:"createdAt"`
+  RunID     string    `json:"runId,omitempty"`
+  // One plan by plan of the config file and project
+  Runs      []RunPlan `json:"runs"`
+}
+
+// ReadPlanFile reads the plans written by PlanFile.WriteFile.
+func ReadPlanFile(path string) (PlanFile, error) {
+  var file PlanFile
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return file, err
+  }
+  err = json.Unmarshal(data, &file)
+  if err != nil {
+    return file, fmt.Errorf("Invalid plan file %s: %w", path, err)
+  }
+  return file, nil
+}
+
+// WriteFile writes the plans as JSON.
+func (file PlanFile) WriteFile(path string) error {
+  data, err := json.MarshalIndent(file, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// FormatAge formats the age of a snapshot in days and hours, or minutes when
+// recent. It's empty for an unknown creation timestamp.
+func FormatAge(timestamp time.Time, now time.Time) string {
+  if timestamp.IsZero() {
+    return ""
+  }
+  duration := now.Sub(timestamp)
+  if duration < time.Hour {
+    return duration.Round(time.Minute).String()
+  }
+  days := int(duration / (24 * time.Hour))
+  hours := int((duration % (24 * time.Hour)) / time.Hour)
+  if days == 0 {
+    return fmt.Sprintf("%dh", hours)
+  }
+  return fmt.Sprintf("%dd%dh", days, hours)
+}
@@ -0,0 +1,133 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestApplyPlan(t *testing.T) {
+  tests := []struct {
+    name     string
+    options  Options
+    flag     string
+    expected string
+  }{
+    {"snapshot type", Options{SnapshotType: SnapshotArchive}, "--snapshot-type", SnapshotArchive},
+    // With the zonal and regional "disks snapshot"
+    {"chain name", Options{ChainNameTemplate: "{disk}-hourly"}, "--chain-name", "{disk}-hourly"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    options := test.options
+    options.DryRun = true
+    dryRun, _ := newTestRunner(newFakeRunner(t), options)
+    dryResult, err := dryRun.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    plan := NewRunPlan(dryResult)
+
+    // The plan alone has the options of the creations
+    fake := newFakeRunner(t)
+    runner, _ := newTestRunner(fake, Options{})
+    result, err := runner.Apply(context.Background(), plan)
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if len(result.Created) != 2 || len(result.Deleted) != len(dryResult.Deleted) {
+      t.Errorf("%s: got %s created and %s deleted, expected 2 and %s", test.name, snapshotNames(result.Created), snapshotNames(result.Deleted), snapshotNames(dryResult.Deleted))
+    }
+    creations := append(fake.ran("disks", "snapshot"), fake.ran("snapshots", "create")...)
+    if len(creations) != 2 {
+      t.Fatalf("%s: got the creations %v", test.name, fake.ran("snapshot"))
+    }
+    for creationIndex := 0; creationIndex < len(creations); creationIndex++ {
+      creation := creations[creationIndex]
+      disk := argValue(creation, "--source-disk")
+      if creation[3] == "snapshot" {
+        disk = creation[4]
+      }
+      expected := strings.ReplaceAll(test.expected, "{disk}", disk)
+      if argValue(creation, test.flag) != expected {
+        t.Errorf("%s: got the creation %v, expected %s %s", test.name, creation, test.flag, expected)
+      }
+    }
+  }
+}
+
+// dryRunPlan returns the plan of a dry run on the fixtures, deleting
+// db-data-1 and db-data-2.
+func dryRunPlan(t *testing.T) RunPlan {
+  dryRun, _ := newTestRunner(newFakeRunner(t), Options{DryRun: true})
+  dryResult, err := dryRun.Run(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if sortedNames(dryResult.Deleted) != "db-data-1,db-data-2" {
+    t.Fatalf("Got the plan deleting %s", sortedNames(dryResult.Deleted))
+  }
+  return NewRunPlan(dryResult)
+}
+
+func TestApplyPlanSafeguards(t *testing.T) {
+  tests := []struct {
+    name     string
+    options  Options
+    // Of the confirmation, asked if not nil
+    answer   *bool
+    images   bool
+    err      error
+    deleted  string
+    kept     string
+  }{
+    {"none", Options{}, nil, false, nil, "db-data-1,db-data-2", ""},
+    {"deletion limits", Options{DeletionLimits: DeletionLimits{MaxDeletions: 1}}, nil, false, ErrTooManyDeletions, "", ""},
+    {"deletion percent", Options{DeletionLimits: DeletionLimits{MaxPercent: 30}}, nil, false, ErrTooManyDeletions, "", ""},
+    {"forced deletion limits", Options{DeletionLimits: DeletionLimits{MaxDeletions: 1}, Force: true}, nil, false, nil, "db-data-1,db-data-2", ""},
+    {"confirmed", Options{}, &[]bool{true}[0], false, nil, "db-data-1,db-data-2", ""},
+    {"cancelled", Options{}, &[]bool{false}[0], false, nil, "", ""},
+    {"referenced", Options{}, nil, true, nil, "db-data-2", "db-data-1"},
+    // The new snapshot isn't READY yet, not counting
+    {"min keep", Options{MinKeep: 2}, nil, false, nil, "db-data-1", "db-data-2"},
+    {"deletion grace", Options{DeletionGrace: 72 * time.Hour}, nil, false, nil, "", "db-data-1,db-data-2"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    plan := dryRunPlan(t)
+    fake := newFakeRunner(t)
+    if test.images {
+      fake.answer(readTestdata(t, "images.json"), "compute", "images", "list")
+    }
+    confirmations := make([]string, 0)
+    if test.answer != nil {
+      test.options.Confirm = func(snapshots int, disks int) bool {
+        confirmations = append(confirmations, fmt.Sprintf("%d/%d", snapshots, disks))
+        return *test.answer
+      }
+    }
+    runner, _ := newTestRunner(fake, test.options)
+
+    result, err := runner.Apply(context.Background(), plan)
+    if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+      t.Fatalf("%s: got the error %v, expected %v", test.name, err, test.err)
+    }
+    // The snapshots are created anyway
+    if len(result.Created) != 2 || sortedNames(result.Deleted) != test.deleted {
+      t.Errorf("%s: got %s created and %s deleted, expected %s deleted", test.name, snapshotNames(result.Created), sortedNames(result.Deleted), test.deleted)
+    }
+    if len(fake.ran("compute", "snapshots delete")) != len(result.Deleted) {
+      t.Errorf("%s: got the deletions %v", test.name, fake.ran("compute", "snapshots delete"))
+    }
+    kept := sortedNames(append(append(result.Referenced, result.MinKept...), result.Marked...))
+    if kept != test.kept {
+      t.Errorf("%s: got %s kept, expected %s", test.name, kept, test.kept)
+    }
+    if test.answer != nil && strings.Join(confirmations, ",") != "2/1" {
+      t.Errorf("%s: got the confirmations %v, expected 2/1", test.name, confirmations)
+    }
+  }
+}
@@ -0,0 +1,367 @@
+package backups
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "log"
+  "strings"
+  "time"
+)
+
+// Default name of the snapshot schedule resource policy created by RunPolicy
+const DefaultPolicyName = "gcp-backups"
+
+const (
+  // The policy was attached to the disk by the run
+  PolicyAttached = "attached"
+  // The policy was already attached, nothing was done
+  PolicyAlreadyAttached = "already-attached"
+  // The policy was detached from the disk by the run
+  PolicyDetached = "detached"
+  // The policy wasn't attached, nothing was detached
+  PolicyNotAttached = "not-attached"
+  // The disk already has another snapshot schedule, left as it is
+  PolicyOtherSchedule = "other-schedule"
+  PolicyFailed = "failed"
+)
+
+// ResourcePolicy is a resource policy of a region, like a snapshot schedule.
+type ResourcePolicy struct {
+  Name             string
+  // Short name
+  Region           string
+  // READY, CREATING, DELETING, INVALID or EXPIRED
+  Status           string
+  // The policy is a snapshot schedule, not an instance schedule or placement
+  SnapshotSchedule bool
+}
+
+func (policy *ResourcePolicy) UnmarshalJSON(data []byte) error {
+  var raw struct {
+    Name                   string          `json:"name"`
+    // URL of the region
+    Region                 string          `json:"region"`
+    Status                 string          `json:"status"`
+    SnapshotSchedulePolicy json.RawMessage `json:"snapshotSchedulePolicy"`
+  }
+  err := json.Unmarshal(data, &raw)
+  if err != nil {
+    return err
+  }
+
+  policy.Name = raw.Name
+  policy.Region = lastPathPart(raw.Region)
+  policy.Status = raw.Status
+  policy.SnapshotSchedule = len(raw.SnapshotSchedulePolicy) > 0 && string(raw.SnapshotSchedulePolicy) != "null"
+
+  return nil
+}
+
+// SnapshotSchedule is a snapshot schedule resource policy, snapshotting the
+// disks it is attached to without this program.
+type SnapshotSchedule struct {
+  Name             string
+  Region           string
+  // A snapshot every IntervalHours hours, daily if 0
+  IntervalHours    int
+  // Start of the schedule in UTC, as HH:MM
+  StartTime        string
+  MaxRetentionDays int
+  // Storage location of the snapshots, the default one if empty
+  StorageLocation  string
+  // Labels of the snapshots
+  Labels           map[string]string
+}
+
+// ScheduleRetentionDays converts the retention to the maximum retention of a
+// snapshot schedule, in days: the ones covered by its limit given the interval
+// of the snapshots, or by its GFS tiers, the max age if shorter, at least 1.
+func ScheduleRetentionDays(retention Retention, intervalHours int) int {
+  if intervalHours <= 0 {
+    intervalHours = 24
+  }
+  countDays := (retention.Limit * intervalHours + 23) / 24
+  if retention.IsGFS() {
+    countDays = retention.KeepDaily
+    if 7 * retention.KeepWeekly > countDays {
+      countDays = 7 * retention.KeepWeekly
+    }
+    if 31 * retention.KeepMonthly > countDays {
+      countDays = 31 * retention.KeepMonthly
+    }
+  }
+  ageDays := int((retention.MaxAge + 24 * time.Hour - 1) / (24 * time.Hour))
+
+  days := countDays
+  switch retention.Mode {
+  case RetentionAge:
+    days = ageDays
+  case RetentionBoth:
+    if ageDays > 0 && (days == 0 || ageDays < days) {
+      days = ageDays
+    }
+  }
+  if days < 1 {
+    days = 1
+  }
+  return days
+}
+
+// diskRegion returns the region of the disk, the one of its zone for the
+// zonal disks.
+func diskRegion(disk Disk) string {
+  if disk.Region != "" {
+    return disk.Region
+  }
+  separator := strings.LastIndex(disk.Zone, "-")
+  if separator < 0 {
+    return disk.Zone
+  }
+  return disk.Zone[:separator]
+}
+
+// ScheduledDisk is a disk managed by snapshot schedule resource policies,
+// found by Run.
+type ScheduledDisk struct {
+  Disk     string   `json:"disk"`
+  Policies []string `json:"policies"`
+  // Not snapshotted by the run, with Options.SkipScheduledDisks
+  Skipped  bool     `json:"skipped"`
+}
+
+// checkSchedules finds the disks with a snapshot schedule, which are both
+// snapshotted by their policy and by this program: a warning, or a skip with
+// Options.SkipScheduledDisks. The disks only accept snapshot schedule resource
+// policies. The disks to snapshot are returned.
+func (runner *Runner) checkSchedules(disks []Disk, result *Result) []Disk {
+  selected := make([]Disk, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    if len(disk.ResourcePolicies) == 0 {
+      selected = append(selected, disk)
+      continue
+    }
+    policies := strings.Join(disk.ResourcePolicies, ", ")
+    skip := runner.options.SkipScheduledDisks
+    result.Scheduled = append(result.Scheduled, ScheduledDisk{Disk: disk.Name, Policies: disk.ResourcePolicies, Skipped: skip})
+    if skip {
+      reason := "snapshot schedule " + policies
+      runner.logger.Printf("Skipping disk %s: %s\n", disk.Name, reason)
+      result.Skipped = append(result.Skipped, Skip{Disk: disk.Name, Reason: reason})
+      continue
+    }
+    runner.levels.Warning.Printf("WARNING: disk %s already has snapshot schedule %s, it is snapshotted twice\n", disk.Name, policies)
+    selected = append(selected, disk)
+  }
+  return selected
+}
+
+// PolicyOptions selects the disks the snapshot schedule is attached to, or
+// detached from.
+type PolicyOptions struct {
+  // Name of the policy, DefaultPolicyName if empty
+  Name            string
+  // Filter of the disks, all the disks if empty, the ones with the backup=false
+  // label excepted
+  Filter          string
+  // Converted to the max retention of the policy
+  Retention       Retention
+  // A snapshot every IntervalHours hours, daily if 0
+  IntervalHours   int
+  // Start of the schedule in UTC, as HH:MM
+  StartTime       string
+  StorageLocation string
+  // Labels of the snapshots, with the CreatedByLabel
+  Labels          map[string]string
+  // Detach the policy instead of attaching it, the policy is kept
+  Detach          bool
+  DryRun          bool
+  // Logger used for the progress, log.Default() if nil
+  Logger          *log.Logger
+  // Backend managing the disks and the policies, the gcloud command if nil
+  Backend         Backend
+}
+
+// PolicyDisk is the outcome of the policy for a disk.
+type PolicyDisk struct {
+  Disk     string   `json:"disk"`
+  Location string   `json:"location"`
+  // PolicyAttached, PolicyAlreadyAttached, PolicyDetached, PolicyNotAttached,
+  // PolicyOtherSchedule or PolicyFailed
+  Status   string   `json:"status"`
+  // Resource policies of the disk after the run
+  Policies []string `json:"policies"`
+  Error    string   `json:"error,omitempty"`
+}
+
+// PolicyReport tells which disks are managed by the snapshot schedule, and
+// which ones are left to this program.
+type PolicyReport struct {
+  Policy  string       `json:"policy"`
+  DryRun  bool         `json:"dryRun"`
+  // Regions where the policy was created by the run
+  Created []string     `json:"created"`
+  Disks   []PolicyDisk `json:"disks"`
+}
+
+// Failed returns the disks whose attachment or detachment failed.
+func (report PolicyReport) Failed() []PolicyDisk {
+  failed := make([]PolicyDisk, 0)
+  for diskIndex := 0; diskIndex < len(report.Disks); diskIndex++ {
+    if report.Disks[diskIndex].Status == PolicyFailed {
+      failed = append(failed, report.Disks[diskIndex])
+    }
+  }
+  return failed
+}
+
+// RunPolicy creates the snapshot schedule resource policy from the retention
+// in the regions of the disks where it is missing, and attaches it to the
+// disks which don't have it, or detaches it from the disks which have it with
+// Detach. The disks having another snapshot schedule are left as they are. A
+// failed disk doesn't stop the other ones: the report tells the outcome of
+// each disk.
+func RunPolicy(ctx context.Context, options PolicyOptions) (PolicyReport, error) {
+  logger := options.Logger
+  if logger == nil {
+    logger = log.Default()
+  }
+  backend := options.Backend
+  if backend == nil {
+    backend = NewGcloud(nil)
+  }
+  name := options.Name
+  if name == "" {
+    name = DefaultPolicyName
+  }
+  report := PolicyReport{Policy: name, DryRun: options.DryRun, Created: make([]string, 0), Disks: make([]PolicyDisk, 0)}
+  if options.IntervalHours < 0 || options.IntervalHours > 23 {
+    return report, fmt.Errorf("Invalid interval of %d hours, use 1 to 23 or 0 for a daily schedule", options.IntervalHours)
+  }
+  _, err := time.Parse("15:04", options.StartTime)
+  if err != nil {
+    return report, fmt.Errorf("Invalid start time '%s', use HH:MM", options.StartTime)
+  }
+  err = options.Retention.Validate()
+  if err != nil {
+    return report, err
+  }
+
+  disks, err := backend.GetDisksToSnapshot(ctx, options.Filter)
+  if err != nil {
+    return report, fmt.Errorf("Listing of the disks: %w", err)
+  }
+  policies, err := backend.ListResourcePolicies(ctx)
+  if err != nil {
+    return report, fmt.Errorf("Listing of the resource policies: %w", err)
+  }
+  regions := make(map[string]bool)
+  for policyIndex := 0; policyIndex < len(policies); policyIndex++ {
+    if policies[policyIndex].Name == name {
+      regions[policies[policyIndex].Region] = true
+    }
+  }
+  if options.DryRun {
+    logger.Println("DRY RUN MODE: nothing is created, attached nor detached")
+  }
+
+  retentionDays := ScheduleRetentionDays(options.Retention, options.IntervalHours)
+  labels := make(map[string]string)
+  for key, value := range options.Labels {
+    labels[key] = value
+  }
+  labels[CreatedByLabel] = CreatedByValue
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    if disk.Labels[BackupLabel] == "false" {
+      logger.Printf("Skipping disk %s: label %s=false\n", disk.Name, BackupLabel)
+      continue
+    }
+    policyDisk := PolicyDisk{Disk: disk.Name, Location: disk.Location(), Policies: disk.ResourcePolicies}
+    if policyDisk.Policies == nil {
+      policyDisk.Policies = make([]string, 0)
+    }
+    policyDisk.Status, err = applyPolicy(ctx, backend, disk, name, options.Detach, options.DryRun)
+    // Created on the first disk of its region
+    if policyDisk.Status == PolicyAttached && !regions[diskRegion(disk)] {
+      region := diskRegion(disk)
+      schedule := SnapshotSchedule{Name: name, Region: region, IntervalHours: options.IntervalHours, StartTime: options.StartTime, MaxRetentionDays: retentionDays, StorageLocation: options.StorageLocation, Labels: labels}
+      createErr := backend.CreateSnapshotSchedule(ctx, schedule, options.DryRun)
+      if createErr != nil && !IsAlreadyExists(createErr) {
+        policyDisk.Status = PolicyFailed
+        policyDisk.Error = fmt.Sprintf("Creation of the policy in %s: %s", region, createErr)
+        report.Disks = append(report.Disks, policyDisk)
+        continue
+      }
+      regions[region] = true
+      report.Created = append(report.Created, region)
+      if options.DryRun {
+        logger.Printf("[DRY-RUN] Would create snapshot schedule %s in %s, keeping the snapshots %d day(s)\n", name, region, retentionDays)
+      } else {
+        logger.Printf("Created snapshot schedule %s in %s, keeping the snapshots %d day(s)\n", name, region, retentionDays)
+      }
+    }
+    if policyDisk.Status == PolicyAttached {
+      err = backend.AttachResourcePolicy(ctx, disk, name, options.DryRun)
+    }
+    if err != nil {
+      policyDisk.Status = PolicyFailed
+      policyDisk.Error = err.Error()
+    }
+    switch policyDisk.Status {
+    case PolicyAttached:
+      policyDisk.Policies = append(policyDisk.Policies, name)
+      if options.DryRun {
+        logger.Printf("[DRY-RUN] Would attach snapshot schedule %s to disk %s\n", name, disk.Name)
+      } else {
+        logger.Printf("Attached snapshot schedule %s to disk %s\n", name, disk.Name)
+      }
+    case PolicyDetached:
+      policyDisk.Policies = removeString(policyDisk.Policies, name)
+      if options.DryRun {
+        logger.Printf("[DRY-RUN] Would detach snapshot schedule %s from disk %s\n", name, disk.Name)
+      } else {
+        logger.Printf("Detached snapshot schedule %s from disk %s\n", name, disk.Name)
+      }
+    case PolicyOtherSchedule:
+      logger.Printf("WARNING: disk %s already has snapshot schedule %s, left as it is\n", disk.Name, strings.Join(disk.ResourcePolicies, ", "))
+    case PolicyFailed:
+      logger.Printf("WARNING: snapshot schedule %s of disk %s failed: %s\n", name, disk.Name, policyDisk.Error)
+    }
+    report.Disks = append(report.Disks, policyDisk)
+  }
+
+  return report, ctx.Err()
+}
+
+// applyPolicy returns the status of the disk for the policy, detaching it
+// when it is attached with detach. The attachment is left to the caller, as
+// the policy may have to be created first.
+func applyPolicy(ctx context.Context, backend Backend, disk Disk, name string, detach bool, dryRun bool) (string, error) {
+  attached := contains(disk.ResourcePolicies, name)
+  if detach {
+    if !attached {
+      return PolicyNotAttached, nil
+    }
+    return PolicyDetached, backend.DetachResourcePolicy(ctx, disk, name, dryRun)
+  }
+  if attached {
+    return PolicyAlreadyAttached, nil
+  }
+  if len(disk.ResourcePolicies) > 0 {
+    return PolicyOtherSchedule, nil
+  }
+  return PolicyAttached, nil
+}
+
+// removeString returns the values without the value.
+func removeString(values []string, value string) []string {
+  kept := make([]string, 0, len(values))
+  for valueIndex := 0; valueIndex < len(values); valueIndex++ {
+    if values[valueIndex] != value {
+      kept = append(kept, values[valueIndex])
+    }
+  }
+  return kept
+}
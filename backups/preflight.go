@@ -0,0 +1,178 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "os/exec"
+  "strconv"
+  "strings"
+)
+
+// MinGcloudVersion is the oldest version of gcloud supported, with the
+// --storage-location and --guest-flush flags of the snapshots.
+const MinGcloudVersion = "400.0.0"
+
+const (
+  CheckPass = "PASS"
+  CheckWarn = "WARN"
+  CheckFail = "FAIL"
+)
+
+// CheckResult is the result of a preflight check, with a hint to fix it.
+type CheckResult struct {
+  Name    string
+  Status  string
+  Message string
+  Hint    string
+}
+
+func (result CheckResult) String() string {
+  line := result.Status + " " + result.Name + ": " + result.Message
+  if result.Hint != "" {
+    line += "; " + result.Hint
+  }
+  return line
+}
+
+// PreflightError returns an error with the failed checks, nil if none failed.
+func PreflightError(results []CheckResult) error {
+  failed := make([]string, 0)
+  for resultIndex := 0; resultIndex < len(results); resultIndex++ {
+    if results[resultIndex].Status == CheckFail {
+      failed = append(failed, results[resultIndex].String())
+    }
+  }
+  if len(failed) == 0 {
+    return nil
+  }
+  return fmt.Errorf("Preflight failed:\n  %s", strings.Join(failed, "\n  "))
+}
+
+// Preflight checks that gcloud is installed, recent enough, authenticated and,
+// when needsProject, that a project is configured, then that the account can
+// create and delete the snapshots of the project. It stops at the first
+// failure, as the next checks would fail the same way.
+func (gcloud *Gcloud) Preflight(ctx context.Context, needsProject bool) []CheckResult {
+  results := make([]CheckResult, 0)
+
+  binary := CheckResult{Name: "gcloud binary", Status: CheckPass}
+  path, err := exec.LookPath(gcloud.path)
+  if err != nil {
+    binary.Status = CheckFail
+    binary.Message = fmt.Sprintf("%s not found", gcloud.path)
+    binary.Hint = "install the Google Cloud SDK (https://cloud.google.com/sdk/docs/install) or set --gcloud-path"
+    return append(results, binary)
+  }
+  binary.Message = path
+  results = append(results, binary)
+
+  version := gcloud.checkVersion(ctx)
+  results = append(results, version)
+  if version.Status == CheckFail {
+    return results
+  }
+
+  return append(results, gcloud.checkConfig(ctx, needsProject)...)
+}
+
+func (gcloud *Gcloud) checkVersion(ctx context.Context) CheckResult {
+  result := CheckResult{Name: "gcloud version", Status: CheckFail}
+  args := []string{"version", "--format", "json"}
+  cmdVersionOut, err := gcloud.run(ctx, args)
+  var components map[string]string
+  if err == nil {
+    err = parseJSON(args, cmdVersionOut, &components)
+  }
+  if err != nil {
+    result.Message = err.Error()
+    return result
+  }
+
+  result.Message = components["Google Cloud SDK"]
+  if compareVersions(result.Message, MinGcloudVersion) < 0 {
+    result.Message = fmt.Sprintf("%s is older than %s", result.Message, MinGcloudVersion)
+    result.Hint = "run `gcloud components update`"
+    return result
+  }
+  if components["beta"] == "" {
+    result.Message += ", without the beta component"
+    result.Hint = "run `gcloud components install beta`"
+    return result
+  }
+  result.Status = CheckPass
+  return result
+}
+
+func (gcloud *Gcloud) checkConfig(ctx context.Context, needsProject bool) []CheckResult {
+  account := CheckResult{Name: "gcloud account", Status: CheckPass}
+  args := []string{"config", "list", "--format", "json"}
+  cmdConfigOut, err := gcloud.run(ctx, args)
+  var config struct {
+    Core struct {
+      Account string
+      Project string
+    }
+  }
+  if err == nil {
+    err = parseJSON(args, cmdConfigOut, &config)
+  }
+  if err != nil {
+    account.Status = CheckFail
+    account.Message = err.Error()
+    return []CheckResult{account}
+  }
+
+  account.Message = config.Core.Account
+  if config.Core.Account == "" {
+    account.Status = CheckFail
+    account.Message = "no active account"
+    account.Hint = "run `gcloud auth login`, or `gcloud auth activate-service-account --key-file <file>`"
+  }
+  if gcloud.credentials.ImpersonateServiceAccount != "" {
+    account.Message += " impersonating " + gcloud.credentials.ImpersonateServiceAccount
+  }
+
+  project := CheckResult{Name: "gcloud project", Status: CheckPass, Message: config.Core.Project}
+  if gcloud.project != "" {
+    project.Message = gcloud.project
+  } else if config.Core.Project == "" {
+    project.Status = CheckWarn
+    project.Message = "no project configured"
+    project.Hint = "use --project, set GOOGLE_CLOUD_PROJECT or CLOUDSDK_CORE_PROJECT, or set a project with `gcloud config set project <project>`"
+    if needsProject {
+      project.Status = CheckFail
+    }
+  }
+  results := []CheckResult{account, project}
+  if account.Status == CheckFail {
+    return results
+  }
+  projectName := config.Core.Project
+  if gcloud.project != "" {
+    projectName = gcloud.project
+  }
+  return append(results, gcloud.checkPermissions(ctx, config.Core.Account, projectName))
+}
+
+// compareVersions compares two dotted versions like 400.0.0, returning -1, 0
+// or 1. The parts which are not numbers count as 0.
+func compareVersions(version1 string, version2 string) int {
+  parts1 := strings.Split(version1, ".")
+  parts2 := strings.Split(version2, ".")
+  for partIndex := 0; partIndex < len(parts1) || partIndex < len(parts2); partIndex++ {
+    var part1, part2 int
+    if partIndex < len(parts1) {
+      part1, _ = strconv.Atoi(parts1[partIndex])
+    }
+    if partIndex < len(parts2) {
+      part2, _ = strconv.Atoi(parts2[partIndex])
+    }
+    if part1 != part2 {
+      if part1 < part2 {
+        return -1
+      }
+      return 1
+    }
+  }
+  return 0
+}
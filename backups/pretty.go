@@ -0,0 +1,156 @@
+package backups
+
+import (
+  "bytes"
+  "fmt"
+  "log"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+// ANSI colors of the rows of the tables
+const (
+  colorGreen  = "\033[32m"
+  colorYellow = "\033[33m"
+  colorRed    = "\033[31m"
+  colorDim    = "\033[2m"
+  colorReset  = "\033[0m"
+)
+
+// tableRow is a row of a table, colored when the color is enabled.
+type tableRow struct {
+  cells []string
+  // One of the color constants, none if empty
+  color string
+}
+
+// logTable logs the rows as an aligned table below the header. The rows are
+// colored after being aligned, the escape codes would count in the widths.
+func logTable(logger *log.Logger, header []string, rows []tableRow, color bool) {
+  var table bytes.Buffer
+  writer := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(writer, strings.Join(header, "\t"))
+  for rowIndex := 0; rowIndex < len(rows); rowIndex++ {
+    fmt.Fprintln(writer, strings.Join(rows[rowIndex].cells, "\t"))
+  }
+  writer.Flush()
+
+  lines := strings.Split(strings.TrimRight(table.String(), "\n"), "\n")
+  for lineIndex := 0; lineIndex < len(lines); lineIndex++ {
+    line := strings.TrimRight(lines[lineIndex], " ")
+    if lineIndex > 0 && color && rows[lineIndex - 1].color != "" {
+      line = rows[lineIndex - 1].color + line + colorReset
+    }
+    logger.Printf("  %s\n", line)
+  }
+}
+
+// logDisksTable logs the disks found with the number of snapshots and the
+// newest one, instead of a line by snapshot.
+func logDisksTable(logger *log.Logger, disks []Disk, now time.Time, color bool) {
+  rows := make([]tableRow, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    attachedTo := "-"
+    if len(disk.Users) > 0 {
+      attachedTo = strings.Join(disk.Users, ", ")
+    }
+    newest := "-"
+    age := "-"
+    row := tableRow{}
+    if len(disk.Snapshots) > 0 {
+      // The snapshots are listed newest first
+      newest = disk.Snapshots[0].Name
+      age = FormatAge(disk.Snapshots[0].CreationTimestamp, now)
+    } else {
+      row.color = colorYellow
+    }
+    row.cells = []string{disk.Name, attachedTo, fmt.Sprintf("%d", len(disk.Snapshots)), newest, age}
+    rows = append(rows, row)
+  }
+  logger.Printf("Disks and snapshots found: %d disk(s)\n", len(disks))
+  logTable(logger, []string{"DISK", "ATTACHED TO", "SNAPSHOTS", "NEWEST", "AGE"}, rows, color)
+}
+
+// LogTable logs what was done for each disk as a table: green for the
+// snapshots created, yellow for the disks skipped, red for the failures and
+// dim for what a dry run would do.
+func (summary Summary) LogTable(logger *log.Logger, color bool) {
+  failures := make(map[string]string)
+  for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+    failure := summary.Failures[failureIndex]
+    if _, found := failures[failure.Disk]; !found {
+      failures[failure.Disk] = failure.Error
+    }
+  }
+
+  notDue := make(map[string]string)
+  for notDueIndex := 0; notDueIndex < len(summary.NotDue); notDueIndex++ {
+    notDue[summary.NotDue[notDueIndex].Disk] = summary.NotDue[notDueIndex].Reason
+  }
+
+  deferred := make(map[string]string)
+  for deferredIndex := 0; deferredIndex < len(summary.Deferred); deferredIndex++ {
+    deferred[summary.Deferred[deferredIndex].Disk] = summary.Deferred[deferredIndex].Reason
+  }
+
+  rows := make([]tableRow, 0, len(summary.Disks) + len(summary.Skipped))
+  for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+    disk := summary.Disks[diskIndex]
+    created := "-"
+    if disk.Created != "" {
+      created = disk.Created
+    }
+    status := "unchanged"
+    row := tableRow{}
+    if disk.Failed {
+      status = "failed: " + failures[disk.Name]
+      row.color = colorRed
+    } else if summary.DryRun {
+      status = "dry run"
+      row.color = colorDim
+    } else if disk.Created != "" {
+      status = "created"
+      row.color = colorGreen
+    } else if notDue[disk.Name] != "" {
+      status = "not due: " + notDue[disk.Name]
+      row.color = colorYellow
+    } else if deferred[disk.Name] != "" {
+      status = "deferred: " + deferred[disk.Name]
+      row.color = colorYellow
+    } else if len(disk.Deleted) > 0 {
+      status = "pruned"
+      row.color = colorGreen
+    }
+    row.cells = []string{disk.Name, created, fmt.Sprintf("%d", len(disk.Deleted)), fmt.Sprintf("%d", len(disk.Marked))}
+    // With --copy-to-location, the status of the copy
+    if summary.CopyLocation != "" {
+      copyStatus := "-"
+      if disk.Copy != nil {
+        copyStatus = strings.ToLower(disk.Copy.Status)
+      }
+      if copyStatus == "" {
+        copyStatus = "dry run"
+      }
+      row.cells = append(row.cells, copyStatus)
+    }
+    row.cells = append(row.cells, status)
+    rows = append(rows, row)
+  }
+  header := []string{"DISK", "CREATED", "DELETED", "MARKED", "STATUS"}
+  if summary.CopyLocation != "" {
+    header = []string{"DISK", "CREATED", "DELETED", "MARKED", "COPY", "STATUS"}
+  }
+  for skipIndex := 0; skipIndex < len(summary.Skipped); skipIndex++ {
+    skip := summary.Skipped[skipIndex]
+    cells := []string{skip.Disk, "-", "-", "-", "skipped: " + skip.Reason}
+    if summary.CopyLocation != "" {
+      cells = []string{skip.Disk, "-", "-", "-", "-", "skipped: " + skip.Reason}
+    }
+    rows = append(rows, tableRow{cells: cells, color: colorYellow})
+  }
+
+  logger.Println("")
+  logTable(logger, header, rows, color)
+}
@@ -0,0 +1,146 @@
+package backups
+
+import (
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "time"
+
+  "google.golang.org/api/option"
+  pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+  // Event of the outcome of a run
+  EventRun = "run"
+  // Event of a snapshot of a disk
+  EventDisk = "disk"
+
+  ActionCreated = "created"
+  ActionDeleted = "deleted"
+  ActionFailed = "failed"
+)
+
+// Maximum number of messages of a publish request
+const pubSubBatchSize = 1000
+
+// PubSubEvent is the JSON payload of the Pub/Sub messages, described by
+// docs/pubsub-event.schema.json.
+type PubSubEvent struct {
+  // EventRun or EventDisk
+  Type             string    `json:"type"`
+  RunID            string    `json:"runId,omitempty"`
+  Plan             string    `json:"plan,omitempty"`
+  Project          string    `json:"project"`
+  Mode             string    `json:"mode"`
+  DryRun           bool      `json:"dryRun"`
+  // Start of the run
+  StartedAt        time.Time `json:"startedAt"`
+  // Time of the publication
+  Timestamp        time.Time `json:"timestamp"`
+
+  // Of the EventRun events
+  DurationSeconds  float64   `json:"durationSeconds,omitempty"`
+  DisksScanned     int       `json:"disksScanned,omitempty"`
+  SnapshotsCreated int       `json:"snapshotsCreated,omitempty"`
+  SnapshotsDeleted int       `json:"snapshotsDeleted,omitempty"`
+  FailedDisks      []string  `json:"failedDisks,omitempty"`
+  ExitCode         *int      `json:"exitCode,omitempty"`
+
+  // Of the EventDisk events
+  Disk             string    `json:"disk,omitempty"`
+  Snapshot         string    `json:"snapshot,omitempty"`
+  // ActionCreated, ActionDeleted or ActionFailed
+  Action           string    `json:"action,omitempty"`
+  Error            string    `json:"error,omitempty"`
+}
+
+// PubSubNotifier publishes the summary to a Pub/Sub topic, with the
+// Application Default Credentials.
+type PubSubNotifier struct {
+  // As projects/<project>/topics/<topic>
+  Topic   string
+  // Also publish an event for each snapshot created, deleted or failed
+  PerDisk bool
+  // Options of the client, like the endpoint of the tests
+  clientOptions []option.ClientOption
+}
+
+func (notifier PubSubNotifier) Notify(ctx context.Context, summary Summary) error {
+  service, err := pubsub.NewService(ctx, notifier.clientOptions...)
+  if err != nil {
+    return err
+  }
+
+  events := PubSubEvents(summary, notifier.PerDisk, time.Now())
+  messages := make([]*pubsub.PubsubMessage, 0, len(events))
+  for eventIndex := 0; eventIndex < len(events); eventIndex++ {
+    data, err := json.Marshal(events[eventIndex])
+    if err != nil {
+      return err
+    }
+    // The attributes allow to filter the subscriptions
+    attributes := map[string]string{"type": events[eventIndex].Type}
+    if events[eventIndex].Action != "" {
+      attributes["action"] = events[eventIndex].Action
+    }
+    messages = append(messages, &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString(data), Attributes: attributes})
+  }
+
+  for start := 0; start < len(messages); start += pubSubBatchSize {
+    end := start + pubSubBatchSize
+    if end > len(messages) {
+      end = len(messages)
+    }
+    _, err = service.Projects.Topics.Publish(notifier.Topic, &pubsub.PublishRequest{Messages: messages[start:end]}).Context(ctx).Do()
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// PubSubEvents returns the event of the run, followed with the events of the
+// snapshots if perDisk.
+func PubSubEvents(summary Summary, perDisk bool, now time.Time) []PubSubEvent {
+  base := PubSubEvent{RunID: summary.RunID, Plan: summary.Plan, Project: summary.Project, Mode: summary.Mode, DryRun: summary.DryRun, StartedAt: summary.StartedAt, Timestamp: now}
+
+  run := base
+  run.Type = EventRun
+  run.DurationSeconds = summary.DurationSeconds
+  run.DisksScanned = summary.DisksScanned
+  run.SnapshotsCreated = summary.SnapshotsCreated
+  run.SnapshotsDeleted = summary.SnapshotsDeleted
+  run.FailedDisks = summary.FailedDisks
+  run.ExitCode = &summary.ExitCode
+  run.Error = summary.Error
+  events := []PubSubEvent{run}
+  if !perDisk {
+    return events
+  }
+
+  diskEvent := func(disk string, snapshot string, action string) PubSubEvent {
+    event := base
+    event.Type = EventDisk
+    event.Disk = disk
+    event.Snapshot = snapshot
+    event.Action = action
+    return event
+  }
+  for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+    disk := summary.Disks[diskIndex]
+    if disk.Created != "" {
+      events = append(events, diskEvent(disk.Name, disk.Created, ActionCreated))
+    }
+    for deletedIndex := 0; deletedIndex < len(disk.Deleted); deletedIndex++ {
+      events = append(events, diskEvent(disk.Name, disk.Deleted[deletedIndex], ActionDeleted))
+    }
+  }
+  for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+    failure := summary.Failures[failureIndex]
+    event := diskEvent(failure.Disk, failure.Snapshot, ActionFailed)
+    event.Error = failure.Error
+    events = append(events, event)
+  }
+  return events
+}
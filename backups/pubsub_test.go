@@ -0,0 +1,148 @@
+package backups
+
+import (
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+
+  "google.golang.org/api/option"
+)
+
+// fakePubSub is a Pub/Sub API receiving the published messages.
+type fakePubSub struct {
+  mutex      sync.Mutex
+  paths      []string
+  messages   []PubSubEvent
+  attributes []map[string]string
+}
+
+func (fake *fakePubSub) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+  var publish struct {
+    Messages []struct {
+      Data       string
+      Attributes map[string]string
+    }
+  }
+  err := json.NewDecoder(request.Body).Decode(&publish)
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+  fake.mutex.Lock()
+  defer fake.mutex.Unlock()
+  fake.paths = append(fake.paths, request.URL.Path)
+  messageIds := make([]string, 0, len(publish.Messages))
+  for messageIndex := 0; messageIndex < len(publish.Messages); messageIndex++ {
+    data, _ := base64.StdEncoding.DecodeString(publish.Messages[messageIndex].Data)
+    var event PubSubEvent
+    json.Unmarshal(data, &event)
+    fake.messages = append(fake.messages, event)
+    fake.attributes = append(fake.attributes, publish.Messages[messageIndex].Attributes)
+    messageIds = append(messageIds, fmt.Sprint(len(fake.messages)))
+  }
+  json.NewEncoder(writer).Encode(map[string]interface{}{"messageIds": messageIds})
+}
+
+// newFakePubSub returns the fake API and a notifier publishing to it.
+func newFakePubSub(t *testing.T, perDisk bool) (*fakePubSub, PubSubNotifier) {
+  fake := &fakePubSub{}
+  server := httptest.NewServer(fake)
+  t.Cleanup(server.Close)
+  notifier := PubSubNotifier{Topic: "projects/proj/topics/backups", PerDisk: perDisk, clientOptions: []option.ClientOption{option.WithEndpoint(server.URL), option.WithoutAuthentication()}}
+  return fake, notifier
+}
+
+func testSummary() Summary {
+  return Summary{
+    RunID: "run-1",
+    Project: "proj",
+    Mode: ModeFull,
+    StartedAt: time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC),
+    DisksScanned: 2,
+    SnapshotsCreated: 1,
+    SnapshotsDeleted: 2,
+    ExitCode: ExitPartialFailure,
+    FailedDisks: []string{"shared-data"},
+    Disks: []DiskSummary{
+      {Name: "db-data", Created: "db-data-4", Deleted: []string{"db-data-1", "db-data-2"}},
+      {Name: "shared-data", Deleted: []string{}},
+    },
+    Failures: []SummaryFailure{{Disk: "shared-data", Snapshot: "shared-data-2", Error: "Quota exceeded"}},
+  }
+}
+
+func TestPubSubNotify(t *testing.T) {
+  tests := []struct {
+    perDisk  bool
+    expected []string
+  }{
+    {false, []string{EventRun + " "}},
+    {true, []string{EventRun + " ", EventDisk + " " + ActionCreated, EventDisk + " " + ActionDeleted, EventDisk + " " + ActionDeleted, EventDisk + " " + ActionFailed}},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake, notifier := newFakePubSub(t, test.perDisk)
+    err := notifier.Notify(context.Background(), testSummary())
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(fake.paths) != 1 || fake.paths[0] != "/v1/projects/proj/topics/backups:publish" {
+      t.Fatalf("Per disk %t: got the requests %v", test.perDisk, fake.paths)
+    }
+    if len(fake.messages) != len(test.expected) {
+      t.Fatalf("Per disk %t: got %d messages, expected %d", test.perDisk, len(fake.messages), len(test.expected))
+    }
+    for messageIndex := 0; messageIndex < len(fake.messages); messageIndex++ {
+      event := fake.messages[messageIndex]
+      attributes := fake.attributes[messageIndex]
+      if event.Type + " " + event.Action != test.expected[messageIndex] || attributes["type"] != event.Type || attributes["action"] != event.Action {
+        t.Errorf("Per disk %t: got the message %d %+v with the attributes %v", test.perDisk, messageIndex, event, attributes)
+      }
+      if event.RunID != "run-1" || event.Project != "proj" {
+        t.Errorf("Per disk %t: got the message %d %+v", test.perDisk, messageIndex, event)
+      }
+    }
+    run := fake.messages[0]
+    if run.ExitCode == nil || *run.ExitCode != ExitPartialFailure || run.SnapshotsDeleted != 2 || len(run.FailedDisks) != 1 {
+      t.Errorf("Per disk %t: got the run event %+v", test.perDisk, run)
+    }
+  }
+}
+
+func TestPubSubNotifyBatches(t *testing.T) {
+  summary := testSummary()
+  deleted := make([]string, 0)
+  for deletedIndex := 0; deletedIndex < pubSubBatchSize + 10; deletedIndex++ {
+    deleted = append(deleted, fmt.Sprintf("db-data-%d", deletedIndex))
+  }
+  summary.Disks = []DiskSummary{{Name: "db-data", Deleted: deleted}}
+  summary.Failures = nil
+  fake, notifier := newFakePubSub(t, true)
+
+  err := notifier.Notify(context.Background(), summary)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(fake.paths) != 2 || len(fake.messages) != len(deleted) + 1 {
+    t.Errorf("Got %d requests and %d messages", len(fake.paths), len(fake.messages))
+  }
+}
+
+func TestPubSubNotifyError(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    http.Error(writer, `{"error": {"code": 404, "message": "Resource not found"}}`, http.StatusNotFound)
+  }))
+  defer server.Close()
+  notifier := PubSubNotifier{Topic: "projects/proj/topics/missing", clientOptions: []option.ClientOption{option.WithEndpoint(server.URL), option.WithoutAuthentication()}}
+
+  err := notifier.Notify(context.Background(), testSummary())
+  if err == nil {
+    t.Errorf("No error for a missing topic")
+  }
+}
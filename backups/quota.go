@@ -0,0 +1,141 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+)
+
+const (
+  // Create nothing when the snapshots would exceed the quota
+  QuotaAbort = "abort"
+  // Create the snapshots up to the quota, the other disks fail
+  QuotaPartial = "partial"
+  // Don't check the quota
+  QuotaIgnore = "ignore"
+)
+
+// Metric of the quota of the snapshots of a project
+const snapshotsQuotaMetric = "SNAPSHOTS"
+
+// ErrQuotaExceeded is the failure of the disks which can't be snapshotted
+// within the snapshot quota of the project.
+var ErrQuotaExceeded = errors.New("Snapshot quota exceeded")
+
+// Quota is the usage and limit of a quota of the project.
+type Quota struct {
+  Metric string
+  Limit  int64
+  Usage  int64
+}
+
+// QuotaUsage is the snapshot quota of the project around a run.
+type QuotaUsage struct {
+  Limit       int64 `json:"limit"`
+  UsageBefore int64 `json:"usageBefore"`
+  // Not known if the quota couldn't be read again, estimated in dry-run mode
+  UsageAfter  int64 `json:"usageAfter,omitempty"`
+}
+
+// findQuota returns the quota of the metric, if any.
+func findQuota(quotas []Quota, metric string) (Quota, bool) {
+  for quotaIndex := 0; quotaIndex < len(quotas); quotaIndex++ {
+    if quotas[quotaIndex].Metric == metric {
+      return quotas[quotaIndex], true
+    }
+  }
+  return Quota{}, false
+}
+
+// quotaHeadroom returns the number of the planned snapshots which can be
+// created within the quota with the behavior, or ErrQuotaExceeded when the
+// run must be aborted.
+func quotaHeadroom(quota Quota, planned int, behavior string) (int, error) {
+  headroom := quota.Limit - quota.Usage
+  if headroom < 0 {
+    headroom = 0
+  }
+  if behavior == QuotaIgnore || int64(planned) <= headroom {
+    return planned, nil
+  }
+  if behavior == QuotaPartial {
+    return int(headroom), nil
+  }
+  return 0, fmt.Errorf("%w: %d snapshot(s) to create, %d of %d used", ErrQuotaExceeded, planned, quota.Usage, quota.Limit)
+}
+
+// checkQuota reads the snapshot quota of the project before the creations,
+// and returns the disks which can't be snapshotted within it. A quota which
+// can't be read is only a warning. The disks not created, as not due or
+// deferred, are not counted.
+func (runner *Runner) checkQuota(ctx context.Context, disks []Disk, notCreated []bool, result *Result) ([]bool, error) {
+  overQuota := make([]bool, len(disks))
+  behavior := runner.options.QuotaBehavior
+  quota, found := runner.readQuota(ctx, result)
+  if !found {
+    return overQuota, nil
+  }
+
+  planned := make([]int, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if _, isResumed := runner.options.Resumed[disks[diskIndex].Id]; !isResumed && !notCreated[diskIndex] {
+      planned = append(planned, diskIndex)
+    }
+  }
+  // The first disks in the order get the quota
+  planned = runner.orderDisks(disks, planned)
+  runner.logger.Printf("Snapshot quota: %d of %d used, %d snapshot(s) to create\n", quota.Usage, quota.Limit, len(planned))
+  allowed, err := quotaHeadroom(quota, len(planned), behavior)
+  if err != nil {
+    return overQuota, err
+  }
+  if allowed < len(planned) {
+    runner.levels.Warning.Printf("WARNING: only %d of the %d snapshot(s) fit in the snapshot quota, the other disks are not snapshotted\n", allowed, len(planned))
+  }
+  for plannedIndex := allowed; plannedIndex < len(planned); plannedIndex++ {
+    overQuota[planned[plannedIndex]] = true
+  }
+  return overQuota, nil
+}
+
+// readQuota reads the snapshot quota of the project before the creations,
+// unless ignored. A quota which can't be read is only a warning, and not
+// found.
+func (runner *Runner) readQuota(ctx context.Context, result *Result) (Quota, bool) {
+  if runner.options.QuotaBehavior == QuotaIgnore {
+    return Quota{}, false
+  }
+  quotas, err := runner.backend.GetQuotas(ctx)
+  if err != nil {
+    runner.levels.Warning.Printf("WARNING: failed to read the snapshot quota, not checked: %s\n", err)
+    return Quota{}, false
+  }
+  quota, found := findQuota(quotas, snapshotsQuotaMetric)
+  if !found || quota.Limit <= 0 {
+    runner.levels.Warning.Printf("WARNING: no %s quota found, not checked\n", snapshotsQuotaMetric)
+    return Quota{}, false
+  }
+  result.Quota = &QuotaUsage{Limit: quota.Limit, UsageBefore: quota.Usage}
+  return quota, true
+}
+
+// updateQuotaUsage reads the snapshot quota after the run, or estimates it
+// in dry-run mode.
+func (runner *Runner) updateQuotaUsage(ctx context.Context, result *Result) {
+  if result.Quota == nil {
+    return
+  }
+  if runner.options.DryRun {
+    result.Quota.UsageAfter = result.Quota.UsageBefore + int64(len(result.Created)) - int64(len(result.Deleted))
+    return
+  }
+  quotas, err := runner.backend.GetQuotas(ctx)
+  if err != nil {
+    runner.levels.Warning.Printf("WARNING: failed to read the snapshot quota after the run: %s\n", err)
+    return
+  }
+  quota, found := findQuota(quotas, snapshotsQuotaMetric)
+  if found {
+    result.Quota.UsageAfter = quota.Usage
+  }
+}
@@ -0,0 +1,83 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "testing"
+)
+
+func TestQuotaHeadroom(t *testing.T) {
+  tests := []struct {
+    name     string
+    quota    Quota
+    planned  int
+    behavior string
+    allowed  int
+    exceeded bool
+  }{
+    {"within", Quota{Limit: 10, Usage: 5}, 5, QuotaAbort, 5, false},
+    {"abort", Quota{Limit: 10, Usage: 8}, 3, QuotaAbort, 0, true},
+    {"partial", Quota{Limit: 10, Usage: 8}, 3, QuotaPartial, 2, false},
+    {"partial, over the limit already", Quota{Limit: 10, Usage: 12}, 3, QuotaPartial, 0, false},
+    {"ignore", Quota{Limit: 10, Usage: 10}, 3, QuotaIgnore, 3, false},
+    {"nothing planned", Quota{Limit: 10, Usage: 10}, 0, QuotaAbort, 0, false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    allowed, err := quotaHeadroom(test.quota, test.planned, test.behavior)
+    if allowed != test.allowed || errors.Is(err, ErrQuotaExceeded) != test.exceeded {
+      t.Errorf("%s: got %d allowed, %v", test.name, allowed, err)
+    }
+  }
+}
+
+func TestRunQuota(t *testing.T) {
+  tests := []struct {
+    name     string
+    behavior string
+    usage    string
+    created  int
+    failed   int
+    aborted  bool
+  }{
+    {"within", QuotaAbort, "100", 2, 0, false},
+    {"abort", QuotaAbort, "999", 0, 0, true},
+    {"partial", QuotaPartial, "999", 1, 1, false},
+    {"ignore", QuotaIgnore, "1000", 2, 0, false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.answer(`{"quotas": [{"metric": "CPUS", "limit": 24, "usage": 2}, {"metric": "SNAPSHOTS", "limit": 1000, "usage": ` + test.usage + `}]}`, "compute", "project-info", "describe")
+    runner, _ := newTestRunner(fake, Options{Mode: ModeBackup, QuotaBehavior: test.behavior})
+
+    result, err := runner.Run(context.Background())
+    if errors.Is(err, ErrQuotaExceeded) != test.aborted {
+      t.Errorf("%s: got the error %v", test.name, err)
+    }
+    if len(result.Created) != test.created || len(result.Failures) != test.failed {
+      t.Errorf("%s: got %d created and the failures %v", test.name, len(result.Created), result.Failures)
+    }
+    if test.failed > 0 && !errors.Is(result.Failures[0].Err, ErrQuotaExceeded) {
+      t.Errorf("%s: got the failure %v", test.name, result.Failures[0].Err)
+    }
+    if test.behavior != QuotaIgnore && (result.Quota == nil || result.Quota.Limit != 1000) {
+      t.Errorf("%s: got the quota %+v", test.name, result.Quota)
+    }
+  }
+}
+
+func TestRunQuotaUnreadable(t *testing.T) {
+  fake := newFakeRunner(t)
+  fake.fail(errors.New("exit status 1"), "compute", "project-info", "describe")
+  runner, logs := newTestRunner(fake, Options{Mode: ModeBackup})
+
+  // Not checked, with a warning
+  result, err := runner.Run(context.Background())
+  if err != nil || len(result.Created) != 2 || result.Quota != nil {
+    t.Errorf("Got the error %v, %d created and the quota %+v", err, len(result.Created), result.Quota)
+  }
+  if !containsLine(logs.String(), "WARNING: failed to read the snapshot quota, not checked") {
+    t.Errorf("No warning in the logs:\n%s", logs)
+  }
+}
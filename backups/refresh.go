@@ -0,0 +1,87 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "time"
+)
+
+// refreshSnapshots lists the snapshots of the disks again before the prune
+// phase, as people or other tools may have created or deleted some since the
+// listing, so the deletions aren't decided on a stale picture. The disks whose
+// snapshots changed are pruned from the new listing, with a warning. The
+// snapshots created by the run, like the ones of a dry run, are kept even if
+// they aren't listed yet. If the listing fails, the disks are failed and not
+// pruned, as a disk of the pipeline, but the run goes on.
+func (runner *Runner) refreshSnapshots(ctx context.Context, disks []Disk, pruneBlocked []bool, result *Result) {
+  logger := runner.logger
+  listingStart := time.Now()
+  snapshotsFilter := ""
+  if runner.options.OwnSnapshotsOnly {
+    snapshotsFilter = "labels." + CreatedByLabel + " = " + CreatedByValue
+  }
+  allSnapshots, err := runner.backend.ListSnapshots(ctx, snapshotsFilter)
+  if err != nil {
+    runner.levels.Warning.Printf("Failed to list the snapshots again, keeping the old snapshots of the disks: %s\n", err)
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      if pruneBlocked[diskIndex] {
+        continue
+      }
+      pruneBlocked[diskIndex] = true
+      runner.progress(DiskProgress{Disk: disks[diskIndex], Phase: PhasePruneFailed, Err: err})
+      result.Failures = append(result.Failures, Failure{Disk: disks[diskIndex].Name, Err: fmt.Errorf("Listing of the snapshots before the deletions: %w", err)})
+    }
+    return
+  }
+  logger.Printf("Listed %d snapshots again in %s\n", len(allSnapshots), time.Since(listingStart).Round(time.Millisecond))
+  snapshotsByDisk := groupSnapshotsByDisk(allSnapshots)
+  created := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Created); snapshotIndex++ {
+    created[result.Created[snapshotIndex].Name] = true
+  }
+
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if pruneBlocked[diskIndex] {
+      continue
+    }
+    runner.refreshDisk(&disks[diskIndex], snapshotsByDisk[disks[diskIndex].Id], created, false)
+  }
+}
+
+// refreshDisk replaces the snapshots of the disk by the fresh ones, keeping
+// the created ones not listed yet, with a warning if they changed, unless the
+// snapshots listed were released: only the created ones are left.
+func (runner *Runner) refreshDisk(disk *Disk, fresh []Snapshot, created map[string]bool, released bool) {
+  listed := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(fresh); snapshotIndex++ {
+    listed[fresh[snapshotIndex].Name] = true
+  }
+  known := make(map[string]bool)
+  gone := 0
+  for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+    snapshot := disk.Snapshots[snapshotIndex]
+    known[snapshot.Name] = true
+    if listed[snapshot.Name] {
+      continue
+    }
+    if created[snapshot.Name] {
+      fresh = append(fresh, snapshot)
+      continue
+    }
+    gone++
+  }
+  added := 0
+  for snapshotIndex := 0; snapshotIndex < len(fresh); snapshotIndex++ {
+    if !known[fresh[snapshotIndex].Name] {
+      added++
+    }
+  }
+  if (added > 0 || gone > 0) && !released {
+    runner.levels.Warning.Printf("WARNING: the snapshots of disk %s changed since the listing, %d new and %d gone, pruning it from the new listing\n", disk.Name, added, gone)
+  }
+  if fresh == nil {
+    fresh = make([]Snapshot, 0)
+  }
+  sortSnapshots(fresh)
+  disk.Snapshots = fresh
+}
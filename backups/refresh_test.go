@@ -0,0 +1,170 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "sort"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestRefreshDisk(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  day := 24 * time.Hour
+  newest := testSnapshot("new", "1", now)
+  first := testSnapshot("a", "1", now.Add(-day))
+  second := testSnapshot("b", "1", now.Add(-2 * day))
+  other := testSnapshot("c", "1", now.Add(-3 * day))
+  tests := []struct {
+    name      string
+    snapshots []Snapshot
+    fresh     []Snapshot
+    created   string
+    expected  string
+    warning   string
+  }{
+    {"unchanged", []Snapshot{first, second}, []Snapshot{second, first}, "", "a,b", ""},
+    {"added", []Snapshot{first, second}, []Snapshot{other, first, second}, "", "a,b,c", "1 new and 0 gone"},
+    {"gone", []Snapshot{first, second}, []Snapshot{first}, "", "a", "0 new and 1 gone"},
+    {"added and gone", []Snapshot{first, second}, []Snapshot{other, first}, "", "a,c", "1 new and 1 gone"},
+    // Not listed yet, or of a dry run
+    {"created kept", []Snapshot{newest, first, second}, []Snapshot{first, second}, "new", "new,a,b", ""},
+    {"created listed", []Snapshot{newest, first, second}, []Snapshot{first, newest, second}, "new", "new,a,b", ""},
+    {"created gone", []Snapshot{newest, first, second}, []Snapshot{first, second}, "", "a,b", "0 new and 1 gone"},
+    {"all gone", []Snapshot{first, second}, nil, "", "", "0 new and 2 gone"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    runner, logs := newTestRunner(newFakeRunner(t), Options{})
+    disk := Disk{Name: "disk", Id: "1", Snapshots: test.snapshots}
+    created := make(map[string]bool)
+    if test.created != "" {
+      created[test.created] = true
+    }
+
+    runner.refreshDisk(&disk, test.fresh, created, false)
+    if disk.Snapshots == nil || snapshotNames(disk.Snapshots) != test.expected {
+      t.Errorf("%s: got %v, expected %s", test.name, disk.Snapshots, test.expected)
+    }
+    warned := strings.Contains(logs.String(), "WARNING: the snapshots of disk disk changed since the listing")
+    if warned != (test.warning != "") || !strings.Contains(logs.String(), test.warning) {
+      t.Errorf("%s: expected the warning '%s' in:\n%s", test.name, test.warning, logs)
+    }
+  }
+}
+
+func TestRunRefreshFailed(t *testing.T) {
+  tests := []struct {
+    name    string
+    options Options
+  }{
+    {"pipeline", Options{}},
+    {"phased", Options{Phased: true}},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    snapshots := readTestdata(t, "snapshots.json")
+    var mutex sync.Mutex
+    listings := 0
+    fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list"}, answer: func(args []string) ([]byte, error) {
+      mutex.Lock()
+      defer mutex.Unlock()
+      listings++
+      if listings > 1 {
+        return nil, &CommandError{Args: args, Err: errors.New("exit status 1")}
+      }
+      return filterSnapshotsJSON(snapshots, argValue(args, "--filter"))
+    }})
+    runner, logs := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    // Both disks are failed, not the whole run
+    if !errors.Is(err, ErrDisksFailed) {
+      t.Fatalf("%s: got the error %v, expected %v", test.name, err, ErrDisksFailed)
+    }
+    if len(result.Created) != 2 || len(result.Deleted) != 0 {
+      t.Errorf("%s: got %s created and %s deleted", test.name, snapshotNames(result.Created), snapshotNames(result.Deleted))
+    }
+    failed := result.FailedDisks()
+    sort.Strings(failed)
+    if strings.Join(failed, ",") != "db-data,shared-data" {
+      t.Errorf("%s: got the failed disks %v", test.name, failed)
+    }
+    for failureIndex := 0; failureIndex < len(result.Failures); failureIndex++ {
+      if !strings.HasPrefix(result.Failures[failureIndex].Err.Error(), "Listing of the snapshots before the deletions: ") {
+        t.Errorf("%s: got the failure %v", test.name, result.Failures[failureIndex].Err)
+      }
+    }
+    if !strings.Contains(logs.String(), "Failed to list the snapshots") || strings.Contains(logs.String(), "Prune phase aborted") {
+      t.Errorf("%s: got the logs:\n%s", test.name, logs)
+    }
+  }
+}
+
+func TestRunNoRefresh(t *testing.T) {
+  tests := []struct {
+    name     string
+    options  Options
+    listings int
+    // Ids of the disks whose snapshots the pipeline lists again, by listing,
+    // none when all the snapshots are
+    relisted []string
+  }{
+    // Each disk once its snapshot is created, shared-data once db-data is
+    // listed again
+    {"pipeline", Options{}, 3, []string{"1111111111111111111", "2222222222222222222"}},
+    {"pipeline without refresh", Options{NoRefresh: true}, 1, nil},
+    {"phased", Options{Phased: true}, 2, nil},
+    {"phased without refresh", Options{Phased: true, NoRefresh: true}, 1, nil},
+    // Deleting right after its listing
+    {"prune", Options{Mode: ModePrune}, 1, nil},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    if len(test.relisted) > 0 {
+      // The creation of shared-data waits for the listing of db-data again
+      relisting := make(chan struct{})
+      var once sync.Once
+      snapshots := readTestdata(t, "snapshots.json")
+      fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list", "sourceDiskId = ("}, answer: func(args []string) ([]byte, error) {
+        once.Do(func() {
+          close(relisting)
+        })
+        return filterSnapshotsJSON(snapshots, argValue(args, "--filter"))
+      }})
+      fake.add(&fakeRule{parts: []string{"compute", "disks", "snapshot", "shared-data"}, wait: relisting})
+    }
+    runner, logs := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    listings := fake.ran("compute", "snapshots", "list")
+    relisted := make([]string, 0)
+    for listingIndex := 0; listingIndex < len(listings); listingIndex++ {
+      filter := argValue(listings[listingIndex], "--filter")
+      if strings.HasPrefix(filter, "sourceDiskId = (") {
+        relisted = append(relisted, strings.Trim(strings.TrimPrefix(filter, "sourceDiskId = "), "()"))
+      }
+    }
+    if len(listings) != test.listings || strings.Join(relisted, ",") != strings.Join(test.relisted, ",") {
+      t.Errorf("%s: got %d listings of the snapshots and the disks %v listed again, expected %d and %s", test.name, len(listings), relisted, test.listings, test.relisted)
+    }
+    // The prune mode has no new snapshot to keep
+    expected := "db-data-1,db-data-2"
+    if test.options.Mode == ModePrune {
+      expected = "db-data-1"
+    }
+    if sortedNames(result.Deleted) != expected || len(result.Failures) != 0 {
+      t.Errorf("%s: got %s deleted, expected %s, and the failures %v", test.name, sortedNames(result.Deleted), expected, result.Failures)
+    }
+    if strings.Contains(logs.String(), "changed since the listing") {
+      t.Errorf("%s: got a change of the snapshots in:\n%s", test.name, logs)
+    }
+  }
+}
@@ -0,0 +1,200 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log"
+  "time"
+)
+
+// RestoreOptions selects the snapshot to restore and the disk to create.
+type RestoreOptions struct {
+  // Name of the disk whose newest snapshot is restored, unless Snapshot is
+  // set
+  Disk        string
+  // Name of the snapshot to restore
+  Snapshot    string
+  // Newest snapshot created at or before this time, if not zero
+  At          time.Time
+  Zone        string
+  // Name of the disk to create, generated from the disk name if empty
+  NewDiskName string
+  // Size of the snapshot if 0
+  SizeGb      int64
+  DiskType    string
+  // Id of the group whose snapshots are all restored, with RestoreGroup
+  Group       string
+  DryRun      bool
+  // Logger used for the progress of the restore, log.Default() if nil
+  Logger      *log.Logger
+  // Backend managing the disks and snapshots, the gcloud command if nil
+  Backend     Backend
+}
+
+// Restore creates a new disk from a snapshot created by this program, and
+// returns it with the snapshot. It never replaces an existing disk.
+func Restore(ctx context.Context, options RestoreOptions) (NewDisk, Snapshot, error) {
+  logger := options.Logger
+  if logger == nil {
+    logger = log.Default()
+  }
+  backend := options.Backend
+  if backend == nil {
+    backend = NewGcloud(nil)
+  }
+  if options.Zone == "" {
+    return NewDisk{}, Snapshot{}, errors.New("The zone of the new disk is required")
+  }
+
+  snapshot, err := findSnapshotToRestore(ctx, backend, options)
+  if err != nil {
+    return NewDisk{}, snapshot, err
+  }
+  logger.Printf("Restoring snapshot %s created at %s\n", snapshot.Name, snapshot.CreationTimestamp.Format(time.RFC3339))
+  if snapshot.Description != "" {
+    logger.Printf("Description of snapshot %s: %s\n", snapshot.Name, snapshot.Description)
+  }
+
+  newDisk := NewDisk{Name: options.NewDiskName, Zone: options.Zone, Snapshot: snapshot.Name, SizeGb: options.SizeGb, Type: options.DiskType}
+  if newDisk.Name == "" {
+    diskName := options.Disk
+    if diskName == "" {
+      diskName = snapshot.SourceDisk
+    }
+    newDisk.Name, err = restoredDiskName(diskName, time.Now())
+    if err != nil {
+      return newDisk, snapshot, err
+    }
+  }
+
+  exists, err := backend.DiskExists(ctx, newDisk.Name, newDisk.Zone)
+  if err != nil {
+    return newDisk, snapshot, err
+  }
+  if exists {
+    return newDisk, snapshot, fmt.Errorf("Disk %s already exists in zone %s, choose another name", newDisk.Name, newDisk.Zone)
+  }
+
+  if options.DryRun {
+    logger.Printf("DRY RUN MODE: disk %s would be created in zone %s\n", newDisk.Name, newDisk.Zone)
+  } else {
+    logger.Printf("Creating disk %s in zone %s\n", newDisk.Name, newDisk.Zone)
+  }
+  err = backend.CreateDiskFromSnapshot(ctx, newDisk, options.DryRun)
+  return newDisk, snapshot, err
+}
+
+// restoredDiskName returns the default name of a disk restored from a
+// snapshot of the disk.
+func restoredDiskName(diskName string, now time.Time) (string, error) {
+  return TemplateSnapshotName("{disk}-restored-{date:20060102150405}", Disk{Name: diskName}, now)
+}
+
+// RestoreGroup creates a new disk from each snapshot of the group, in the
+// zone. It checks that all the snapshots are READY and that none of the new
+// disks exists before creating them, and stops at the first failure.
+func RestoreGroup(ctx context.Context, options RestoreOptions) ([]NewDisk, error) {
+  logger := options.Logger
+  if logger == nil {
+    logger = log.Default()
+  }
+  backend := options.Backend
+  if backend == nil {
+    backend = NewGcloud(nil)
+  }
+  if options.Zone == "" {
+    return nil, errors.New("The zone of the new disks is required")
+  }
+
+  snapshots, err := backend.ListSnapshots(ctx, "labels." + GroupLabel + " = " + sanitizeLabel(options.Group))
+  if err != nil {
+    return nil, err
+  }
+  if len(snapshots) == 0 {
+    return nil, fmt.Errorf("No snapshot of group %s", options.Group)
+  }
+
+  now := time.Now()
+  newDisks := make([]NewDisk, 0, len(snapshots))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    if snapshot.Status != "" && snapshot.Status != SnapshotReady {
+      return nil, fmt.Errorf("Snapshot %s of group %s is %s, not READY", snapshot.Name, options.Group, snapshot.Status)
+    }
+    diskName := snapshot.SourceDisk
+    if diskName == "" {
+      diskName = snapshot.Name
+    }
+    name, err := restoredDiskName(diskName, now)
+    if err != nil {
+      return nil, err
+    }
+    exists, err := backend.DiskExists(ctx, name, options.Zone)
+    if err != nil {
+      return nil, err
+    }
+    if exists {
+      return nil, fmt.Errorf("Disk %s already exists in zone %s", name, options.Zone)
+    }
+    newDisks = append(newDisks, NewDisk{Name: name, Zone: options.Zone, Snapshot: snapshot.Name, Type: options.DiskType})
+  }
+
+  logger.Printf("Restoring the %d snapshot(s) of group %s\n", len(newDisks), options.Group)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    if snapshots[snapshotIndex].Description != "" {
+      logger.Printf("Description of snapshot %s: %s\n", snapshots[snapshotIndex].Name, snapshots[snapshotIndex].Description)
+    }
+  }
+  for diskIndex := 0; diskIndex < len(newDisks); diskIndex++ {
+    newDisk := newDisks[diskIndex]
+    if options.DryRun {
+      logger.Printf("DRY RUN MODE: disk %s would be created in zone %s from snapshot %s\n", newDisk.Name, newDisk.Zone, newDisk.Snapshot)
+    } else {
+      logger.Printf("Creating disk %s in zone %s from snapshot %s\n", newDisk.Name, newDisk.Zone, newDisk.Snapshot)
+    }
+    err = backend.CreateDiskFromSnapshot(ctx, newDisk, options.DryRun)
+    if err != nil {
+      return newDisks[:diskIndex], err
+    }
+  }
+  return newDisks, nil
+}
+
+// findSnapshotToRestore returns the snapshot given by name, or the newest
+// snapshot of the disk created by this program, at or before the time if set.
+func findSnapshotToRestore(ctx context.Context, backend Backend, options RestoreOptions) (Snapshot, error) {
+  var filter string
+  switch {
+  case options.Snapshot != "":
+    filter = "name = " + options.Snapshot
+  case options.Disk != "":
+    filter = "labels." + CreatedByLabel + " = " + CreatedByValue + " AND labels." + SourceDiskLabel + " = " + sanitizeLabel(options.Disk)
+  default:
+    return Snapshot{}, errors.New("Give the disk or the snapshot to restore")
+  }
+
+  snapshots, err := backend.ListSnapshots(ctx, filter)
+  if err != nil {
+    return Snapshot{}, err
+  }
+  // Newest first
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    if snapshot.Status != "" && snapshot.Status != SnapshotReady {
+      continue
+    }
+    if !options.At.IsZero() && (snapshot.CreationTimestamp.IsZero() || snapshot.CreationTimestamp.After(options.At)) {
+      continue
+    }
+    return snapshot, nil
+  }
+
+  if options.Snapshot != "" {
+    return Snapshot{}, fmt.Errorf("No READY snapshot %s found", options.Snapshot)
+  }
+  if !options.At.IsZero() {
+    return Snapshot{}, fmt.Errorf("No READY snapshot of disk %s created by %s at or before %s", options.Disk, CreatedByValue, options.At.Format(time.RFC3339))
+  }
+  return Snapshot{}, fmt.Errorf("No READY snapshot of disk %s created by %s", options.Disk, CreatedByValue)
+}
@@ -0,0 +1,231 @@
+package backups
+
+import (
+  "fmt"
+  "sort"
+  "time"
+)
+
+const (
+  // Keep the Limit newest snapshots, or the GFS ones
+  RetentionCount = "count"
+  // Keep the snapshots younger than MaxAge
+  RetentionAge = "age"
+  // Keep the Limit newest snapshots, if they are younger than MaxAge
+  RetentionBoth = "both"
+)
+
+// Retention decides which snapshots of a disk are deleted.
+type Retention struct {
+  Mode        string
+  Limit       int
+  // No age limit if 0
+  MaxAge      time.Duration
+  // Grandfather-father-son retention: number of daily, weekly and monthly
+  // snapshots to keep (0 disables a tier). Limit is ignored if any is set.
+  KeepDaily   int
+  KeepWeekly  int
+  KeepMonthly int
+  // Type of the snapshots created as the first of their month, preferred by
+  // the monthly GFS tier, the type of the other snapshots if empty
+  MonthlyType string
+}
+
+// IsGFS tells if the grandfather-father-son retention replaces the limit.
+func (retention Retention) IsGFS() bool {
+  return retention.KeepDaily > 0 || retention.KeepWeekly > 0 || retention.KeepMonthly > 0
+}
+
+func (retention Retention) Validate() error {
+  switch retention.Mode {
+  case RetentionCount, RetentionAge, RetentionBoth:
+  default:
+    return fmt.Errorf("Unknown retention mode '%s', use '%s', '%s' or '%s'", retention.Mode, RetentionCount, RetentionAge, RetentionBoth)
+  }
+  if retention.Limit < 0 {
+    return fmt.Errorf("Invalid limit %d", retention.Limit)
+  }
+  if retention.MaxAge < 0 {
+    return fmt.Errorf("Invalid max age %s", retention.MaxAge)
+  }
+  if retention.KeepDaily < 0 || retention.KeepWeekly < 0 || retention.KeepMonthly < 0 {
+    return fmt.Errorf("Invalid number of daily, weekly or monthly snapshots to keep")
+  }
+  err := ValidateSnapshotType(retention.MonthlyType)
+  if err != nil {
+    return fmt.Errorf("Monthly type: %w", err)
+  }
+  if retention.Mode == RetentionAge && retention.MaxAge == 0 {
+    return fmt.Errorf("A max age is needed with the '%s' retention mode", RetentionAge)
+  }
+  return nil
+}
+
+func (retention Retention) String() string {
+  count := fmt.Sprintf("limit: %d", retention.Limit)
+  if retention.IsGFS() {
+    count = fmt.Sprintf("daily: %d, weekly: %d, monthly: %d", retention.KeepDaily, retention.KeepWeekly, retention.KeepMonthly)
+  }
+  switch {
+  case retention.Mode == RetentionCount || (retention.Mode == RetentionBoth && retention.MaxAge == 0):
+    return count
+  case retention.Mode == RetentionAge:
+    return fmt.Sprintf("max age: %s", retention.MaxAge)
+  }
+  return fmt.Sprintf("%s, max age: %s", count, retention.MaxAge)
+}
+
+// SnapshotStatuses counts the snapshots of a disk by status.
+type SnapshotStatuses struct {
+  Ready    int `json:"ready"`
+  // CREATING, UPLOADING or DELETING
+  Creating int `json:"creating"`
+  Failed   int `json:"failed"`
+}
+
+// snapshotsByStatus splits the snapshots into the READY ones, the only ones
+// counting in the retention, the ones in progress and the FAILED ones. A
+// snapshot of unknown status, like one just created, is ready.
+func snapshotsByStatus(snapshots []Snapshot) ([]Snapshot, []Snapshot, []Snapshot) {
+  ready := make([]Snapshot, 0, len(snapshots))
+  inProgress := make([]Snapshot, 0)
+  failed := make([]Snapshot, 0)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    switch snapshots[snapshotIndex].Status {
+    case SnapshotReady, "":
+      ready = append(ready, snapshots[snapshotIndex])
+    case SnapshotFailed:
+      failed = append(failed, snapshots[snapshotIndex])
+    default:
+      inProgress = append(inProgress, snapshots[snapshotIndex])
+    }
+  }
+  return ready, inProgress, failed
+}
+
+// countStatuses counts the snapshots by status, as snapshotsByStatus.
+func countStatuses(snapshots []Snapshot) SnapshotStatuses {
+  ready, inProgress, failed := snapshotsByStatus(snapshots)
+  return SnapshotStatuses{Ready: len(ready), Creating: len(inProgress), Failed: len(failed)}
+}
+
+// SnapshotsToDelete selects the snapshots to delete among the snapshots of a
+// disk, ranked by creation timestamp whatever their order. The snapshots
+// without a creation timestamp are never deleted, nor count in the limit: they
+// are returned separately to be reported.
+func (retention Retention) SnapshotsToDelete(snapshots []Snapshot, now time.Time) ([]Snapshot, []Snapshot) {
+  snapshots = append([]Snapshot(nil), snapshots...)
+  sortSnapshots(snapshots)
+  toDelete := make([]Snapshot, 0)
+  unknownAge := make([]Snapshot, 0)
+  byCount := retention.Mode == RetentionCount || retention.Mode == RetentionBoth
+  byAge := (retention.Mode == RetentionAge || retention.Mode == RetentionBoth) && retention.MaxAge > 0
+  cutoff := now.Add(-retention.MaxAge)
+  var gfsKept []bool
+  if retention.IsGFS() {
+    gfsKept = gfs(snapshots, retention.KeepDaily, retention.KeepWeekly, retention.KeepMonthly, retention.MonthlyType)
+  }
+
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    tooMany := byCount && snapshotIndex >= retention.Limit
+    if gfsKept != nil {
+      tooMany = byCount && !gfsKept[snapshotIndex]
+    }
+    if snapshot.CreationTimestamp.IsZero() {
+      if tooMany || byAge {
+        unknownAge = append(unknownAge, snapshot)
+      }
+      continue
+    }
+    tooOld := byAge && snapshot.CreationTimestamp.Before(cutoff)
+    if tooMany || tooOld {
+      toDelete = append(toDelete, snapshot)
+    }
+  }
+
+  return toDelete, unknownAge
+}
+
+// GFS tells, for each snapshot, if it's the newest snapshot of one of the
+// last daily, weekly (ISO week) or monthly periods to keep. The periods are in
+// UTC, and only the periods having snapshots count. The snapshots without a
+// creation timestamp are never kept by GFS.
+func GFS(snapshots []Snapshot, daily, weekly, monthly int) []bool {
+  return gfs(snapshots, daily, weekly, monthly, "")
+}
+
+// gfs is GFS where the monthly tier keeps the newest snapshot of the monthly
+// type of each month, if there is one, instead of the newest snapshot.
+func gfs(snapshots []Snapshot, daily, weekly, monthly int, monthlyType string) []bool {
+  kept := make([]bool, len(snapshots))
+
+  newestFirst := make([]int, 0, len(snapshots))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    if !snapshots[snapshotIndex].CreationTimestamp.IsZero() {
+      newestFirst = append(newestFirst, snapshotIndex)
+    }
+  }
+  sort.SliceStable(newestFirst, func(i, j int) bool {
+    return snapshots[newestFirst[i]].CreationTimestamp.After(snapshots[newestFirst[j]].CreationTimestamp)
+  })
+
+  tiers := []struct {
+    keep   int
+    period func(time.Time) string
+  }{
+    {daily, func(timestamp time.Time) string { return timestamp.Format("2006-01-02") }},
+    {weekly, func(timestamp time.Time) string {
+      year, week := timestamp.ISOWeek()
+      return fmt.Sprintf("%04d-W%02d", year, week)
+    }},
+    {monthly, func(timestamp time.Time) string { return timestamp.Format("2006-01") }},
+  }
+  for tierIndex := 0; tierIndex < len(tiers); tierIndex++ {
+    tier := tiers[tierIndex]
+    if tierIndex == len(tiers) - 1 && monthlyType != "" {
+      monthlyKept(snapshots, newestFirst, tier.keep, monthlyType, tier.period, kept)
+      continue
+    }
+    lastPeriod := ""
+    periods := 0
+    for orderIndex := 0; orderIndex < len(newestFirst) && periods < tier.keep; orderIndex++ {
+      snapshotIndex := newestFirst[orderIndex]
+      period := tier.period(snapshots[snapshotIndex].CreationTimestamp.UTC())
+      if period == lastPeriod {
+        continue
+      }
+      kept[snapshotIndex] = true
+      lastPeriod = period
+      periods++
+    }
+  }
+
+  return kept
+}
+
+// monthlyKept keeps the newest snapshot of the type in each of the last
+// periods, else their newest snapshot.
+func monthlyKept(snapshots []Snapshot, newestFirst []int, keep int, snapshotType string, period func(time.Time) string, kept []bool) {
+  periods := make([]string, 0, keep)
+  chosen := make(map[string]int)
+  for orderIndex := 0; orderIndex < len(newestFirst); orderIndex++ {
+    snapshotIndex := newestFirst[orderIndex]
+    snapshotPeriod := period(snapshots[snapshotIndex].CreationTimestamp.UTC())
+    current, found := chosen[snapshotPeriod]
+    if !found {
+      if len(periods) == keep {
+        break
+      }
+      periods = append(periods, snapshotPeriod)
+      chosen[snapshotPeriod] = snapshotIndex
+      continue
+    }
+    if snapshots[current].SnapshotType != snapshotType && snapshots[snapshotIndex].SnapshotType == snapshotType {
+      chosen[snapshotPeriod] = snapshotIndex
+    }
+  }
+  for periodIndex := 0; periodIndex < len(periods); periodIndex++ {
+    kept[chosen[periods[periodIndex]]] = true
+  }
+}
@@ -0,0 +1,255 @@
+package backups
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestSnapshotsToDelete(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  day := 24 * time.Hour
+  // Not in order, as listed
+  snapshots := []Snapshot{
+    testSnapshot("s2", "1", now.Add(-2 * day)),
+    testSnapshot("s0", "1", now.Add(-time.Hour)),
+    testSnapshot("s5", "1", now.Add(-5 * day)),
+    testSnapshot("s1", "1", now.Add(-day - time.Hour)),
+    testSnapshot("s9", "1", now.Add(-9 * day)),
+  }
+  unknown := testSnapshot("unknown", "1", time.Time{})
+  tests := []struct {
+    name       string
+    retention  Retention
+    snapshots  []Snapshot
+    expected   string
+    unknownAge string
+  }{
+    {"count", Retention{Mode: RetentionCount, Limit: 3}, snapshots, "s5,s9", ""},
+    {"count above", Retention{Mode: RetentionCount, Limit: 10}, snapshots, "", ""},
+    {"count zero", Retention{Mode: RetentionCount, Limit: 0}, snapshots, "s0,s1,s2,s5,s9", ""},
+    {"age", Retention{Mode: RetentionAge, MaxAge: 3 * day}, snapshots, "s5,s9", ""},
+    {"age ignores the limit", Retention{Mode: RetentionAge, Limit: 1, MaxAge: 6 * day}, snapshots, "s9", ""},
+    {"both, by count", Retention{Mode: RetentionBoth, Limit: 2, MaxAge: 6 * day}, snapshots, "s2,s5,s9", ""},
+    {"both, by age", Retention{Mode: RetentionBoth, Limit: 4, MaxAge: 3 * day}, snapshots, "s5,s9", ""},
+    {"both without age", Retention{Mode: RetentionBoth, Limit: 4}, snapshots, "s9", ""},
+    {"unknown age by count", Retention{Mode: RetentionCount, Limit: 5}, append(snapshots, unknown), "", "unknown"},
+    {"unknown age kept", Retention{Mode: RetentionCount, Limit: 6}, append(snapshots, unknown), "", ""},
+    {"unknown age by age", Retention{Mode: RetentionAge, MaxAge: day}, append(snapshots, unknown), "s1,s2,s5,s9", "unknown"},
+    {"none", Retention{Mode: RetentionBoth, Limit: 1, MaxAge: day}, nil, "", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    toDelete, unknownAge := test.retention.SnapshotsToDelete(test.snapshots, now)
+    if snapshotNames(toDelete) != test.expected {
+      t.Errorf("%s: got %s to delete, expected %s", test.name, snapshotNames(toDelete), test.expected)
+    }
+    if snapshotNames(unknownAge) != test.unknownAge {
+      t.Errorf("%s: got %s of unknown age, expected %s", test.name, snapshotNames(unknownAge), test.unknownAge)
+    }
+  }
+  // The listing is left in its order
+  if snapshots[0].Name != "s2" {
+    t.Errorf("The snapshots were sorted in place")
+  }
+}
+
+func TestRetentionValidate(t *testing.T) {
+  tests := []struct {
+    retention Retention
+    valid     bool
+  }{
+    {Retention{Mode: RetentionCount, Limit: 3}, true},
+    {Retention{Mode: RetentionBoth, Limit: 3, MaxAge: time.Hour}, true},
+    {Retention{Mode: "newest", Limit: 3}, false},
+    {Retention{Mode: RetentionCount, Limit: -1}, false},
+    {Retention{Mode: RetentionAge}, false},
+    {Retention{Mode: RetentionBoth, MaxAge: -time.Hour}, false},
+    {Retention{Mode: RetentionCount, KeepWeekly: -1}, false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    err := test.retention.Validate()
+    if (err == nil) != test.valid {
+      t.Errorf("%+v: got %v", test.retention, err)
+    }
+  }
+}
+
+func TestGFS(t *testing.T) {
+  at := func(value string) time.Time {
+    timestamp, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return timestamp
+  }
+  tests := []struct {
+    name    string
+    created []string
+    daily   int
+    weekly  int
+    monthly int
+    // The snapshots kept, by index
+    expected string
+  }{
+    {"daily, newest of each day", []string{"2026-10-14T10:00:00Z", "2026-10-14T02:00:00Z", "2026-10-13T23:59:00Z", "2026-10-13T00:00:00Z", "2026-10-12T12:00:00Z"}, 2, 0, 0, "0,2"},
+    {"daily, days without snapshots don't count", []string{"2026-10-14T10:00:00Z", "2026-10-10T10:00:00Z", "2026-10-01T10:00:00Z"}, 2, 0, 0, "0,1"},
+    // 2024-12-30 is in the week 1 of 2025, 2024-12-29 in the week 52 of 2024
+    {"weekly, ISO week over the new year", []string{"2025-01-05T10:00:00Z", "2024-12-30T10:00:00Z", "2024-12-29T10:00:00Z", "2024-12-23T10:00:00Z"}, 0, 2, 0, "0,2"},
+    // The Sunday ends the week of the previous Monday
+    {"weekly, Monday starts the week", []string{"2026-10-12T00:00:00Z", "2026-10-11T23:59:59Z", "2026-10-05T00:00:00Z"}, 0, 3, 0, "0,1"},
+    {"monthly, month rollover", []string{"2026-03-01T00:30:00Z", "2026-02-28T23:30:00Z", "2026-02-01T00:00:00Z", "2026-01-31T23:59:59Z"}, 0, 0, 3, "0,1,3"},
+    // 01:00 in UTC+2 is still February in UTC
+    {"monthly, periods in UTC", []string{"2026-03-01T01:00:00+02:00", "2026-02-20T10:00:00Z", "2026-01-15T10:00:00Z"}, 0, 0, 2, "0,2"},
+    {"tiers combined", []string{"2026-10-14T10:00:00Z", "2026-10-13T10:00:00Z", "2026-10-06T10:00:00Z", "2026-09-30T10:00:00Z", "2026-08-15T10:00:00Z"}, 1, 2, 3, "0,2,3,4"},
+    {"unordered", []string{"2026-10-12T10:00:00Z", "2026-10-14T10:00:00Z", "2026-10-13T10:00:00Z"}, 2, 0, 0, "1,2"},
+    {"unknown age never kept", []string{"", "2026-10-14T10:00:00Z"}, 2, 0, 0, "1"},
+    {"nothing to keep", []string{"2026-10-14T10:00:00Z"}, 0, 0, 0, ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    snapshots := make([]Snapshot, 0, len(test.created))
+    for createdIndex := 0; createdIndex < len(test.created); createdIndex++ {
+      var createdAt time.Time
+      if test.created[createdIndex] != "" {
+        createdAt = at(test.created[createdIndex])
+      }
+      snapshots = append(snapshots, testSnapshot(fmt.Sprint(createdIndex), "1", createdAt))
+    }
+    kept := GFS(snapshots, test.daily, test.weekly, test.monthly)
+    keptIndexes := make([]string, 0)
+    for snapshotIndex := 0; snapshotIndex < len(kept); snapshotIndex++ {
+      if kept[snapshotIndex] {
+        keptIndexes = append(keptIndexes, fmt.Sprint(snapshotIndex))
+      }
+    }
+    if strings.Join(keptIndexes, ",") != test.expected {
+      t.Errorf("%s: got %s kept, expected %s", test.name, strings.Join(keptIndexes, ","), test.expected)
+    }
+  }
+}
+
+func TestSnapshotsToDeleteGFS(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  day := 24 * time.Hour
+  snapshots := make([]Snapshot, 0)
+  for age := 0; age < 40; age++ {
+    snapshots = append(snapshots, testSnapshot(fmt.Sprintf("d%02d", age), "1", now.Add(-time.Duration(age) * day)))
+  }
+  // The limit is ignored, the max age still applies with both
+  tests := []struct {
+    name      string
+    retention Retention
+    kept      int
+  }{
+    {"count", Retention{Mode: RetentionCount, Limit: 1, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 2}, 10},
+    {"both", Retention{Mode: RetentionBoth, Limit: 1, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 2, MaxAge: 10 * day}, 8},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    toDelete, _ := test.retention.SnapshotsToDelete(snapshots, now)
+    if len(snapshots) - len(toDelete) != test.kept {
+      t.Errorf("%s: got %d kept, expected %d", test.name, len(snapshots) - len(toDelete), test.kept)
+    }
+  }
+}
+
+func TestGFSMonthlyType(t *testing.T) {
+  snapshot := func(name string, created string, snapshotType string) Snapshot {
+    createdAt, err := time.Parse(time.RFC3339, created)
+    if err != nil {
+      t.Fatal(err)
+    }
+    snapshot := testSnapshot(name, "1", createdAt)
+    snapshot.SnapshotType = snapshotType
+    return snapshot
+  }
+  tests := []struct {
+    name      string
+    snapshots []Snapshot
+    monthly   int
+    expected  string
+  }{
+    {"archive of the month over the newest", []Snapshot{
+      snapshot("oct-14", "2026-10-14T10:00:00Z", SnapshotStandard),
+      snapshot("oct-01", "2026-10-01T10:00:00Z", SnapshotArchive),
+      snapshot("sep-30", "2026-09-30T10:00:00Z", SnapshotStandard),
+      snapshot("sep-01", "2026-09-01T10:00:00Z", SnapshotArchive),
+    }, 2, "oct-01,sep-01"},
+    {"newest without archive", []Snapshot{
+      snapshot("oct-14", "2026-10-14T10:00:00Z", SnapshotStandard),
+      snapshot("oct-01", "2026-10-01T10:00:00Z", SnapshotStandard),
+      snapshot("sep-30", "2026-09-30T10:00:00Z", SnapshotStandard),
+      snapshot("sep-01", "2026-09-01T10:00:00Z", SnapshotArchive),
+    }, 2, "oct-14,sep-01"},
+    {"newest archive of the month", []Snapshot{
+      snapshot("oct-01", "2026-10-01T10:00:00Z", SnapshotArchive),
+      snapshot("oct-14", "2026-10-14T10:00:00Z", SnapshotArchive),
+    }, 1, "oct-14"},
+    // Over the year, the last months only
+    {"months kept", []Snapshot{
+      snapshot("jan-01", "2027-01-01T10:00:00Z", SnapshotArchive),
+      snapshot("dec-01", "2026-12-01T10:00:00Z", SnapshotArchive),
+      snapshot("nov-01", "2026-11-01T10:00:00Z", SnapshotArchive),
+    }, 2, "jan-01,dec-01"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    kept := gfs(test.snapshots, 0, 0, test.monthly, SnapshotArchive)
+    keptNames := make([]string, 0)
+    for snapshotIndex := 0; snapshotIndex < len(kept); snapshotIndex++ {
+      if kept[snapshotIndex] {
+        keptNames = append(keptNames, test.snapshots[snapshotIndex].Name)
+      }
+    }
+    if strings.Join(keptNames, ",") != test.expected {
+      t.Errorf("%s: got %s kept, expected %s", test.name, strings.Join(keptNames, ","), test.expected)
+    }
+  }
+}
+
+func BenchmarkSnapshotsToDelete(b *testing.B) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  disks, _ := generatedFleet(10000, 3, now)
+  tests := []struct {
+    name      string
+    retention Retention
+  }{
+    {"limit and age", Retention{Mode: RetentionBoth, Limit: 2, MaxAge: 48 * time.Hour}},
+    {"GFS", Retention{Mode: RetentionCount, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 12}},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    retention := tests[testIndex].retention
+    b.Run(tests[testIndex].name, func(b *testing.B) {
+      for benchIndex := 0; benchIndex < b.N; benchIndex++ {
+        for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+          retention.SnapshotsToDelete(disks[diskIndex].Snapshots, now)
+        }
+      }
+    })
+  }
+}
+
+func TestSnapshotsByStatus(t *testing.T) {
+  statuses := []string{SnapshotReady, "", "CREATING", "UPLOADING", SnapshotFailed, "DELETING", SnapshotReady}
+  snapshots := make([]Snapshot, 0, len(statuses))
+  for statusIndex := 0; statusIndex < len(statuses); statusIndex++ {
+    snapshot := testSnapshot(fmt.Sprint(statusIndex), "1", time.Time{})
+    snapshot.Status = statuses[statusIndex]
+    snapshots = append(snapshots, snapshot)
+  }
+  // A snapshot of unknown status, like one just created, is ready
+  ready, inProgress, failed := snapshotsByStatus(snapshots)
+  if snapshotNames(ready) != "0,1,6" || snapshotNames(inProgress) != "2,3,5" || snapshotNames(failed) != "4" {
+    t.Errorf("Got %s ready, %s in progress and %s failed", snapshotNames(ready), snapshotNames(inProgress), snapshotNames(failed))
+  }
+  counts := countStatuses(snapshots)
+  if counts != (SnapshotStatuses{Ready: 3, Creating: 3, Failed: 1}) {
+    t.Errorf("Got the counts %+v", counts)
+  }
+  if countStatuses(nil) != (SnapshotStatuses{}) {
+    t.Errorf("Got the counts %+v without snapshots", countStatuses(nil))
+  }
+}
@@ -0,0 +1,199 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "io"
+  "log"
+  "math/rand"
+  "strings"
+  "time"
+
+  "go.opentelemetry.io/otel/attribute"
+  "go.opentelemetry.io/otel/trace"
+  "google.golang.org/api/googleapi"
+)
+
+// Markers of the errors that will fail again, checked before the retryable
+// ones.
+var permanentErrorMarkers = []string{
+  "not found",
+  "notFound",
+  "invalid argument",
+  "INVALID_ARGUMENT",
+  "invalid value",
+  "already exists",
+  "alreadyExists",
+  "permission",
+  "PERMISSION_DENIED",
+}
+
+// Markers of the transient errors: rate limits and server errors. The
+// exhausted quotas of resources, like the SNAPSHOTS one, aren't retried.
+var retryableErrorMarkers = []string{
+  "rate limit",
+  "Rate Limit",
+  "rateLimitExceeded",
+  "userRateLimitExceeded",
+  "RATE_LIMIT_EXCEEDED",
+  "UNAVAILABLE",
+  "backendError",
+  "internalError",
+  "Internal error",
+  "Service Unavailable",
+  "Backend Error",
+  "ServerError",
+  "HTTPError 500",
+  "HTTPError 502",
+  "HTTPError 503",
+  "HTTPError 504",
+}
+
+// Retry retries the actions failing with a transient error, waiting longer
+// between each attempt.
+type Retry struct {
+  // Number of retries after the first attempt, no retry if 0
+  MaxRetries int
+  // Wait before the first retry, doubled for each retry (1s if 0)
+  Backoff    time.Duration
+  // Logger of the retries, log.Default() if nil
+  Logger     *log.Logger
+  // Logger of each attempt and its duration, not logged if nil
+  Verbose    *log.Logger
+}
+
+// IsRetryable tells if the error is transient.
+func IsRetryable(err error) bool {
+  if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+    return false
+  }
+  var apiErr *googleapi.Error
+  if errors.As(err, &apiErr) {
+    return apiErr.Code == 429 || apiErr.Code >= 500
+  }
+  var httpErr *HTTPError
+  if errors.As(err, &httpErr) {
+    return httpErr.Code == 429 || httpErr.Code >= 500
+  }
+
+  message := err.Error()
+  var commandErr *CommandError
+  if errors.As(err, &commandErr) {
+    // Only the output, the arguments could contain anything
+    message = string(commandErr.Output)
+  }
+  for markerIndex := 0; markerIndex < len(permanentErrorMarkers); markerIndex++ {
+    if strings.Contains(message, permanentErrorMarkers[markerIndex]) {
+      return false
+    }
+  }
+  for markerIndex := 0; markerIndex < len(retryableErrorMarkers); markerIndex++ {
+    if strings.Contains(message, retryableErrorMarkers[markerIndex]) {
+      return true
+    }
+  }
+  // The quotas of requests by minute, e.g. "Quota exceeded for quota metric
+  // 'Queries' and limit 'Queries per minute'"
+  return strings.Contains(message, "Quota exceeded for quota metric") && strings.Contains(message, "per minute")
+}
+
+// IsAlreadyExists tells if the error is about a resource which already
+// exists, e.g. a snapshot created by a previous attempt.
+func IsAlreadyExists(err error) bool {
+  message := err.Error()
+  var commandErr *CommandError
+  if errors.As(err, &commandErr) {
+    message = string(commandErr.Output)
+  }
+  return strings.Contains(message, "already exists") || strings.Contains(message, "alreadyExists")
+}
+
+// IsNotFound tells if the error is about a resource which doesn't exist.
+func IsNotFound(err error) bool {
+  var apiErr *googleapi.Error
+  if errors.As(err, &apiErr) {
+    return apiErr.Code == 404
+  }
+  message := err.Error()
+  var commandErr *CommandError
+  if errors.As(err, &commandErr) {
+    message = string(commandErr.Output)
+  }
+  return strings.Contains(message, "was not found") || strings.Contains(message, "notFound")
+}
+
+// Do runs the action until it succeeds, fails with a permanent error, the
+// retries are exhausted or the context is done.
+func (retry Retry) Do(ctx context.Context, what string, action func() error) error {
+  logger := retry.Logger
+  if logger == nil {
+    logger = log.Default()
+  }
+  backoff := retry.Backoff
+  if backoff == 0 {
+    backoff = time.Second
+  }
+
+  for attempt := 0; ; attempt++ {
+    start := time.Now()
+    err := action()
+    if retry.Verbose != nil {
+      retry.Verbose.Printf("Ran %s in %s\n", what, time.Since(start).Round(time.Millisecond))
+    }
+    // Each attempt is an event of the span of the operation
+    span := trace.SpanFromContext(ctx)
+    if span.IsRecording() {
+      attributes := []attribute.KeyValue{attribute.String("operation", what), attribute.Int("attempt", attempt + 1), attribute.Int64("duration_ms", time.Since(start).Milliseconds())}
+      if err != nil {
+        attributes = append(attributes, attribute.String("error", err.Error()))
+      }
+      span.AddEvent("attempt", trace.WithAttributes(attributes...))
+    }
+    if err == nil || attempt >= retry.MaxRetries || !IsRetryable(err) {
+      return err
+    }
+    // Up to 50% of jitter, so the parallel retries don't all happen at once
+    wait := backoff << uint(attempt)
+    wait += time.Duration(rand.Int63n(int64(wait) / 2 + 1))
+    logger.Printf("Retrying %s in %s (retry %d/%d): %s\n", what, wait.Round(time.Millisecond), attempt + 1, retry.MaxRetries, err)
+    select {
+    case <-ctx.Done():
+      return err
+    case <-time.After(wait):
+    }
+  }
+}
+
+// RetryRunner retries the commands failing with a transient error.
+type RetryRunner struct {
+  Commands CommandRunner
+  Retry    Retry
+}
+
+func (runner RetryRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+  var out []byte
+  err := runner.Retry.Do(ctx, "`" + name + " " + strings.Join(args, " ") + "`", func() error {
+    var runErr error
+    out, runErr = runner.Commands.Run(ctx, name, args...)
+    return runErr
+  })
+  return out, err
+}
+
+// Stream retries the streamed commands failing with a transient error, read
+// starting over at each attempt. The commands are run with Run if Commands
+// doesn't stream.
+func (runner RetryRunner) Stream(ctx context.Context, read func(io.Reader) error, name string, args ...string) error {
+  streamer, streams := runner.Commands.(StreamRunner)
+  return runner.Retry.Do(ctx, "`" + name + " " + strings.Join(args, " ") + "`", func() error {
+    if streams {
+      return streamer.Stream(ctx, read, name, args...)
+    }
+    out, runErr := runner.Commands.Run(ctx, name, args...)
+    if runErr != nil {
+      return runErr
+    }
+    return read(bytes.NewReader(out))
+  })
+}
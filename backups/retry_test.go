@@ -0,0 +1,114 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "sync"
+  "testing"
+  "time"
+
+  "google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+  tests := []struct {
+    name      string
+    err       error
+    retryable bool
+  }{
+    {"rate limit", &CommandError{Err: errors.New("exit status 1"), Output: []byte("ERROR: (gcloud.compute.snapshots.list) rateLimitExceeded")}, true},
+    {"quota by minute", &CommandError{Err: errors.New("exit status 1"), Output: []byte("ERROR: Quota exceeded for quota metric 'Queries' and limit 'Queries per minute' of service 'compute.googleapis.com'")}, true},
+    {"server error", &CommandError{Err: errors.New("exit status 1"), Output: []byte("ERROR: HTTPError 503: Service Unavailable")}, true},
+    // Failing again until a snapshot is deleted
+    {"snapshots quota", &CommandError{Err: errors.New("exit status 1"), Output: []byte("ERROR: (gcloud.compute.disks.snapshot) Quota 'SNAPSHOTS' exceeded. Limit: 1000.0 globally.")}, false},
+    {"exhausted quota", &CommandError{Err: errors.New("exit status 1"), Output: []byte("ERROR: QUOTA_EXCEEDED: Quota 'SSD_TOTAL_GB' exceeded")}, false},
+    {"not found", &CommandError{Err: errors.New("exit status 1"), Output: []byte("ERROR: HTTPError 503: The resource 'snap' was not found")}, false},
+    // The arguments aren't checked
+    {"arguments", &CommandError{Args: []string{"--description", "rate limit"}, Err: errors.New("exit status 1")}, false},
+    {"API rate limit", &googleapi.Error{Code: 429}, true},
+    {"API server error", fmt.Errorf("Deletion: %w", &googleapi.Error{Code: 500}), true},
+    {"API quota", &googleapi.Error{Code: 403, Message: "Quota 'SNAPSHOTS' exceeded"}, false},
+    {"HTTP error", &HTTPError{Code: 502}, true},
+    {"cancelled", context.Canceled, false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    if IsRetryable(test.err) != test.retryable {
+      t.Errorf("%s: got retryable %t, expected %t", test.name, !test.retryable, test.retryable)
+    }
+  }
+}
+
+func TestRetryDo(t *testing.T) {
+  transient := &googleapi.Error{Code: 503}
+  tests := []struct {
+    name       string
+    maxRetries int
+    errs       []error
+    attempts   int
+    failed     bool
+  }{
+    {"succeeded", 3, nil, 1, false},
+    {"retried", 3, []error{transient, transient}, 3, false},
+    {"exhausted", 2, []error{transient, transient, transient, transient}, 3, true},
+    {"permanent", 3, []error{&googleapi.Error{Code: 404}}, 1, true},
+    {"no retry", 0, []error{transient}, 1, true},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    attempts := 0
+    retry := Retry{MaxRetries: test.maxRetries, Backoff: time.Millisecond, Logger: discardLogger()}
+    err := retry.Do(context.Background(), "test", func() error {
+      attempts++
+      if attempts <= len(test.errs) {
+        return test.errs[attempts - 1]
+      }
+      return nil
+    })
+    if attempts != test.attempts || (err != nil) != test.failed {
+      t.Errorf("%s: got %d attempts and the error %v, expected %d attempts", test.name, attempts, err, test.attempts)
+    }
+  }
+}
+
+func TestRunRetriedDeletion(t *testing.T) {
+  tests := []struct {
+    name    string
+    output  string
+    deleted string
+    failed  bool
+  }{
+    // Deleted by the attempt which failed
+    {"deleted", "ERROR: (gcloud.compute.snapshots.delete) Could not fetch resource:\n - The resource 'projects/proj/global/snapshots/db-data-1' was not found", "db-data-1,db-data-2", false},
+    {"failed", "ERROR: (gcloud.compute.snapshots.delete) Could not fetch resource:\n - Required 'compute.snapshots.delete' permission", "db-data-2", true},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    var mutex sync.Mutex
+    attempts := 0
+    fake.add(&fakeRule{parts: []string{"compute", "snapshots", "delete", "db-data-1"}, answer: func(args []string) ([]byte, error) {
+      mutex.Lock()
+      defer mutex.Unlock()
+      attempts++
+      if attempts == 1 {
+        return nil, &CommandError{Args: args, Err: errors.New("exit status 1"), Output: []byte("ERROR: HTTPError 503: Service Unavailable")}
+      }
+      return nil, &CommandError{Args: args, Err: errors.New("exit status 1"), Output: []byte(test.output)}
+    }})
+    retried := RetryRunner{Commands: fake, Retry: Retry{MaxRetries: 2, Backoff: time.Millisecond, Logger: discardLogger()}}
+    runner, logs := newTestRunner(fake, Options{Backend: NewGcloud(retried)})
+
+    result, err := runner.Run(context.Background())
+    if (err != nil) != test.failed || attempts != 2 {
+      t.Fatalf("%s: got the error %v after %d attempts", test.name, err, attempts)
+    }
+    if sortedNames(result.Deleted) != test.deleted {
+      t.Errorf("%s: got %s deleted, expected %s", test.name, sortedNames(result.Deleted), test.deleted)
+    }
+    if !test.failed && !containsLine(logs.String(), "WARNING: snapshot db-data-1 of disk db-data already deleted: ") {
+      t.Errorf("%s: the deletion not logged in:\n%s", test.name, logs)
+    }
+  }
+}
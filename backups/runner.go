@@ -0,0 +1,1689 @@
+package backups
+
+import (
+  "context"
+  "log"
+  "time"
+  "fmt"
+  "strings"
+  "sync"
+  "errors"
+  "regexp"
+
+  "go.opentelemetry.io/otel/attribute"
+)
+
+const (
+  // Create the snapshots and delete the old ones
+  ModeFull = "full"
+  // Only create the snapshots
+  ModeBackup = "backup"
+  // Only delete the old snapshots
+  ModePrune = "prune"
+)
+
+type Options struct {
+  // ModeFull (the default if empty), ModeBackup or ModePrune
+  Mode string
+  // Project of the disks, the one of the backend if empty
+  Project string
+  // Filter to use for disks to snapshot
+  Filter string
+  // Filter of the disks to never snapshot nor prune
+  ExcludeFilter string
+  // Names of the disks of Filter to keep, all if empty, and to remove, as
+  // name or name:zone. With StrictDisks the names matching no disk are an
+  // error rather than a warning
+  Disks        []string
+  ExcludeDisks []string
+  StrictDisks  bool
+  // Regular expressions of the names of the disks of Filter to keep, all if
+  // nil, and to skip
+  NameRegex        *regexp.Regexp
+  NameRegexExclude *regexp.Regexp
+  // Sizes of the disks of Filter to keep, no limit if 0, and their short
+  // types, like pd-ssd, all if empty
+  MinSizeGb int64
+  MaxSizeGb int64
+  DiskTypes []string
+  // Zones and regions of the disks, listed one by one in parallel instead of
+  // a single listing of all the zones and regions
+  Zones   []string
+  Regions []string
+  // Filter of the instances whose attached disks are added to the disks of
+  // Filter, which adds no disks if empty when this one is set
+  InstanceFilter string
+  // Number of snapshots to keep
+  Limit  int
+  // Age of the snapshots to delete, no age limit if 0
+  MaxAge time.Duration
+  // Use the limit (RetentionCount), the max age (RetentionAge) or both
+  // (RetentionBoth, the default) to select the snapshots to delete
+  RetentionMode string
+  // Number of daily, weekly and monthly snapshots to keep instead of Limit
+  KeepDaily   int
+  KeepWeekly  int
+  KeepMonthly int
+  // Type of the snapshots created as the first of their month with
+  // KeepMonthly, preferred by the monthly tier, SnapshotType if empty
+  MonthlyType string
+  // Retention of specific disks by name, instead of the one above
+  DiskRetentions map[string]Retention
+  // Only list and prune the snapshots with the CreatedByLabel
+  OwnSnapshotsOnly bool
+  // Stop when the snapshots can't be listed at once, instead of listing them
+  // disk by disk and skipping the failing disks
+  FailFast bool
+  // Template of the snapshot names, DefaultNameTemplate if empty
+  NameTemplate string
+  // Template of the chain names of the snapshots, overridden by the
+  // ChainNameLabel of the disks, without chain if empty
+  ChainNameTemplate string
+  // Template of the snapshot descriptions, DefaultDescriptionTemplate if
+  // empty
+  DescriptionTemplate string
+  // Identifier of the run in the snapshot descriptions and RunIDLabel, and
+  // in the result, a new one if empty
+  RunID string
+  // SnapshotStandard or SnapshotArchive, unless their disk has the
+  // SnapshotTypeLabel, the default type (standard) if empty
+  SnapshotType string
+  // Labels added to the created snapshots, over the labels of their disk
+  Labels map[string]string
+  // Region or multi-region of the created snapshots, unless their disk has
+  // the LocationLabel, chosen by GCE if empty
+  StorageLocation string
+  // Create application-consistent snapshots (e.g. with VSS on Windows), unless
+  // disabled by the GuestFlushLabel of the disk
+  GuestFlush bool
+  // Create a crash-consistent snapshot when a guest flush snapshot fails
+  GuestFlushFallback bool
+  // QuotaAbort (the default if empty), QuotaPartial or QuotaIgnore: what to
+  // do when the snapshots to create exceed the snapshot quota of the project
+  QuotaBehavior string
+  // Create the snapshots of the disks of each instance together, one
+  // instance after the other, with a shared GroupLabel
+  GroupByInstance bool
+  // Cloud KMS key encrypting the created snapshots, as
+  // projects/.../locations/.../keyRings/.../cryptoKeys/..., unless their disk
+  // has the KmsKeyLabel. Google-managed encryption if empty
+  KmsKey string
+  // KMS keys by alias, for the KmsKeyLabel of the disks: label values can't
+  // contain the slashes of the key names
+  KmsKeys map[string]string
+  // Maximum number of snapshot creations or deletions at the same time, no
+  // limit if 0
+  Concurrency int
+  // Don't really do backups and deletions but show logs
+  DryRun bool
+  // Maximum duration of the whole run, no limit if 0
+  Timeout time.Duration
+  // Maximum duration of each snapshot creation or deletion, no limit if 0
+  OperationTimeout time.Duration
+  // Wait for the created snapshots to be READY before pruning
+  Wait bool
+  // Maximum duration of the wait for each snapshot, no limit if 0
+  WaitTimeout time.Duration
+  // Delete the old snapshots of a disk even when its new snapshot failed
+  PruneOnCreateFailure bool
+  // Limits of the deletions of the prune phase, which is aborted beyond them
+  DeletionLimits DeletionLimits
+  // Delete the snapshots beyond the deletion limits anyway
+  Force bool
+  // Delete the old snapshots used as the source of images or disks too,
+  // instead of keeping them
+  ForceDeleteReferenced bool
+  // OrphansReport or OrphansDelete to look for the snapshots of the deleted
+  // disks after the prune phase, not done if empty
+  Orphans string
+  // Minimum age of the orphaned snapshots to delete
+  OrphanMaxAge time.Duration
+  // Prune from the snapshots of the first listing, without listing them
+  // again before the prune phase
+  NoRefresh bool
+  // Run the phases one after the other, pruning the disks once all the
+  // snapshots are created, instead of pruning each disk once its snapshot is
+  // created
+  Phased bool
+  // List the disks and their snapshots page by page, each disk snapshotted
+  // as soon as its page is listed, instead of once all of them are: the
+  // deletion limits and confirmation of the pipeline apply once all the
+  // disks are listed. In the full mode without Phased only
+  Stream bool
+  // Minimum number of READY snapshots created by this program kept for each
+  // disk, orphans included, whatever the retention, TTL or orphan rules
+  MinKeep int
+  // LabelingError or LabelingWarn to report the disks of the project neither
+  // backed up nor opted out, not checked if empty
+  EnforceLabeling string
+  // Maximum age of the newest snapshot of each disk, checked by Verify
+  MaxStaleness time.Duration
+  // Number of disks whose newest snapshot is restored by Drill, at random
+  DrillSample int
+  // Zone of the temporary disks of Drill
+  DrillZone string
+  // Price of the snapshot storage by GB and month, for the estimated costs,
+  // not estimated if 0
+  PricePerGbMonth float64
+  // Price of the archive snapshots, PricePerGbMonth if 0
+  ArchivePricePerGbMonth float64
+  // Label of the snapshots grouping the estimated costs by value, if any
+  CostLabel string
+  // Mark the snapshots to delete with the PendingDeleteLabel, and only delete
+  // them once marked for this duration. Deleted at once if 0
+  DeletionGrace time.Duration
+  // Asked before deleting the old snapshots, once they are logged: nothing is
+  // deleted if it returns false. Not asked if nil or in dry-run mode
+  Confirm func(snapshots int, disks int) bool
+  // Snapshots created by a resumed run, by disk id: these disks are not
+  // snapshotted again, but their old snapshots are deleted
+  Resumed map[string]string
+  // Label the disks with their last snapshot, see LastBackupLabel
+  StampDisks bool
+  // Only delete the snapshots past their ExpiresLabel, not the ones beyond the
+  // retention
+  RespectTTLOnly bool
+  // Delete the FAILED snapshots at once, whatever the retention
+  CleanupFailed bool
+  // Snapshots created by the run at most, the first disks in Order, no limit
+  // if 0
+  MaxCreations  int
+  // Order of the disks to snapshot, OrderStaleness if empty
+  Order         string
+  // Region to copy the snapshots created READY to, not copied if empty
+  CopyLocation string
+  // Zone of the temporary disks of the copies, the b zone of CopyLocation if
+  // empty
+  CopyZone     string
+  // Number of copies kept by disk, the retention of the disk if 0
+  CopyLimit    int
+  // Create an instant snapshot of each disk too, in its zone or region, and
+  // keep InstantLimit of them by disk (at least 1)
+  InstantSnapshots bool
+  InstantLimit     int
+  // Skip the disks having a snapshot schedule resource policy, instead of
+  // snapshotting them with a warning
+  SkipScheduledDisks bool
+  // Frequency of the disks without a FrequencyLabel, FrequencyAlways if empty
+  DefaultFrequency string
+  // Called when the snapshot of a disk is created or failed, and when its old
+  // snapshots are deleted, if not nil. Without Phased, from several goroutines
+  // at once
+  Progress func(progress DiskProgress)
+  // Called at each step of the run as it happens, like the start and the end
+  // of each creation and deletion, if not nil
+  Events   func(event Event)
+  // Closed to stop starting new operations, the ones in progress go on until
+  // the context is done, if not nil
+  Stop     <-chan struct{}
+  // Logger used for the progress of the backup, log.Default() if nil
+  Logger *log.Logger
+  // VerbosityQuiet only logs the warnings and failures, VerbosityNormal by
+  // default
+  Verbosity int
+  // Log the disks found as a table, colored if Color
+  Pretty    bool
+  Color     bool
+  // Backend managing the disks and snapshots, the gcloud command if nil
+  Backend Backend
+  // Runner of the gcloud commands when Backend is nil, ExecRunner if nil
+  Commands CommandRunner
+}
+
+type Result struct {
+  // The mode which was run
+  Mode      string
+  RunID     string
+  Project   string
+  Filter    string
+  DryRun    bool
+  StartedAt time.Time
+  Duration  time.Duration
+  // The disks to snapshot have been listed
+  Listed    bool
+  Disks    []Disk
+  // By disk id, the disks whose snapshots were released once pruned with
+  // Options.Stream: only the ones named by the summary are left in Disks
+  Released map[string]ReleasedSnapshots
+  Created  []Snapshot
+  // Created snapshots verified READY, when waiting for them
+  Ready    []Snapshot
+  Deleted  []Snapshot
+  // Snapshots marked for deletion, or unmarked as they are kept again, with
+  // DeletionGrace
+  Marked   []Snapshot
+  Unmarked []Snapshot
+  // Old snapshots kept as images or disks were created from them
+  Referenced []Snapshot
+  // Snapshots kept by the HoldLabel or the HoldUntilLabel
+  Held     []Snapshot
+  // Snapshots kept as their ExpiresLabel is invalid
+  InvalidExpiry []Snapshot
+  // Snapshots the retention would delete, kept by Options.MinKeep
+  MinKept  []Snapshot
+  // Copies of the created snapshots, and the old copies deleted, with
+  // Options.CopyLocation
+  Copies        []SnapshotCopy
+  CopiesDeleted []Snapshot
+  // Instant snapshots created and deleted, and their failures, apart from
+  // Failures, with Options.InstantSnapshots
+  InstantCreated  []InstantSnapshot
+  InstantDeleted  []InstantSnapshot
+  InstantFailures []Failure
+  // Snapshots of the deleted disks, with Options.Orphans
+  Orphans  []Orphan
+  // Disks having a snapshot schedule resource policy, skipped with
+  // Options.SkipScheduledDisks
+  Scheduled []ScheduledDisk
+  // Disks neither backed up nor opted out, with Options.EnforceLabeling
+  Violations []Violation
+  // Age of the newest snapshot of each disk, checked by Verify
+  Compliance []DiskCompliance
+  // Restores of the newest snapshots, and the leftover disks of the crashed
+  // drills deleted, by Drill
+  Drills   []DrillResult
+  DrillLeftovers []string
+  // Storage of the snapshots of the disks, with PricePerGbMonth
+  Cost     *CostReport
+  Failures []Failure
+  Skipped  []Skip
+  // Disks not snapshotted as their FrequencyLabel isn't due, still pruned
+  NotDue   []Skip
+  // Disks neither snapshotted nor pruned beyond MaxCreations
+  Deferred []Skip
+  // Creations and deletions of the snapshots of the disks, timed
+  Operations []Operation
+  // Snapshots created together by instance, with GroupByInstance
+  Groups   []SnapshotGroup
+  // Snapshot quota of the project, if checked
+  Quota    *QuotaUsage
+}
+
+// ReleasedSnapshots counts the snapshots of a disk released once pruned, for
+// the summary.
+type ReleasedSnapshots struct {
+  Statuses SnapshotStatuses
+  // With Options.PricePerGbMonth, and by value of Options.CostLabel if any
+  Storage  StorageCost
+  ByLabel  map[string]StorageCost
+}
+
+// Failure is an error that happened while creating or deleting a snapshot of
+// a disk. The other disks are still processed.
+type Failure struct {
+  Disk     string
+  Snapshot string
+  Err      error
+}
+
+// FailedDisks returns the names of the disks having at least one failure.
+func (result Result) FailedDisks() []string {
+  names := make([]string, 0)
+  for failureIndex := 0; failureIndex < len(result.Failures); failureIndex++ {
+    name := result.Failures[failureIndex].Disk
+    if !contains(names, name) {
+      names = append(names, name)
+    }
+  }
+  return names
+}
+
+func contains(values []string, value string) bool {
+  for valueIndex := 0; valueIndex < len(values); valueIndex++ {
+    if values[valueIndex] == value {
+      return true
+    }
+  }
+  return false
+}
+
+// ErrDisksFailed is returned by Run when some disks failed, after processing
+// all the disks.
+var ErrDisksFailed = errors.New("Backup failed")
+
+// ErrInterrupted is returned by Run when the context was done or the run was
+// stopped before processing all the disks.
+var ErrInterrupted = errors.New("Backup interrupted")
+
+// ErrNoProject is returned by Run when the project of the backend is unknown,
+// instead of listing no disk.
+var ErrNoProject = errors.New("No project: use --project, set GOOGLE_CLOUD_PROJECT or CLOUDSDK_CORE_PROJECT, or set a project with `gcloud config set project <project>`")
+
+// ErrStopped is the error of the operations not started once Options.Stop is
+// closed.
+var ErrStopped = errors.New("Stopped")
+
+type Runner struct {
+  options Options
+  // Info level of the levels
+  logger  *log.Logger
+  levels  Levels
+  backend Backend
+  // Limits the concurrent operations, nil if unlimited
+  slots   chan struct{}
+}
+
+type snapshotResult struct {
+  diskIndex int
+  snapshot  Snapshot
+  // The snapshot was created, but it's not READY
+  created   bool
+  // The snapshot was created by the resumed run
+  resumed   bool
+  // No snapshot is due for the disk, see notDueDisks
+  notDue    bool
+  // The disk is left to a next run, see deferredDisks
+  deferred  bool
+  // Of the creation or deletion, and of the wait for READY, zero if not
+  // started
+  duration      time.Duration
+  readyDuration time.Duration
+  err       error
+}
+
+// Interval between the checks of the status of a created snapshot
+const waitInterval = 5 * time.Second
+
+type diskResult struct {
+  disk     Disk
+  // The old snapshots are kept, as the new one failed
+  blocked  bool
+  deleted  []Snapshot
+  failures []Failure
+  // Deletions of the snapshots of the disk
+  operations []Operation
+}
+
+func NewRunner(options Options) *Runner {
+  logger := options.Logger
+  if logger == nil {
+    logger = log.Default()
+  }
+
+  backend := options.Backend
+  if backend == nil {
+    backend = NewGcloud(options.Commands)
+  }
+  if options.Project != "" {
+    backend = backend.WithProject(options.Project)
+  }
+
+  if options.RunID == "" {
+    options.RunID = NewRunID(time.Now())
+  }
+
+  var slots chan struct{}
+  if options.Concurrency > 0 {
+    slots = make(chan struct{}, options.Concurrency)
+  }
+
+  levels := NewLevels(logger, options.Verbosity)
+  return &Runner{options: options, logger: levels.Info, levels: levels, backend: backend, slots: slots}
+}
+
+// progress reports the progress of a disk, if asked.
+func (runner *Runner) progress(progress DiskProgress) {
+  if runner.options.Progress != nil {
+    runner.options.Progress(progress)
+  }
+}
+
+// acquire waits for a free slot before an operation, when the concurrency is
+// limited. It returns false if the context is done first.
+func (runner *Runner) acquire(ctx context.Context) bool {
+  if runner.stopped(ctx) != nil {
+    return false
+  }
+  if runner.slots == nil {
+    return true
+  }
+  select {
+  case runner.slots <- struct{}{}:
+    return true
+  case <-ctx.Done():
+    return false
+  case <-runner.options.Stop:
+    return false
+  }
+}
+
+// stopped returns why no operation can start anymore: the error of the
+// context, or ErrStopped once Options.Stop is closed. It's nil otherwise.
+func (runner *Runner) stopped(ctx context.Context) error {
+  if ctx.Err() != nil {
+    return ctx.Err()
+  }
+  select {
+  case <-runner.options.Stop:
+    return ErrStopped
+  default:
+    return nil
+  }
+}
+
+// release frees the slot of an operation.
+func (runner *Runner) release() {
+  if runner.slots != nil {
+    <-runner.slots
+  }
+}
+
+// defaultRetention returns the retention of the disks without a specific one.
+func (runner *Runner) defaultRetention() Retention {
+  retention := Retention{
+    Mode: runner.options.RetentionMode,
+    Limit: runner.options.Limit,
+    MaxAge: runner.options.MaxAge,
+    KeepDaily: runner.options.KeepDaily,
+    KeepWeekly: runner.options.KeepWeekly,
+    KeepMonthly: runner.options.KeepMonthly,
+    MonthlyType: runner.options.MonthlyType,
+  }
+  if retention.Mode == "" {
+    retention.Mode = RetentionBoth
+  }
+  return retention
+}
+
+// prices returns the prices of the estimated costs.
+func (runner *Runner) prices() Prices {
+  return Prices{Standard: runner.options.PricePerGbMonth, Archive: runner.options.ArchivePricePerGbMonth}
+}
+
+// retention returns the retention of the disk.
+func (runner *Runner) retention(disk Disk) Retention {
+  retention, found := runner.options.DiskRetentions[disk.Name]
+  if !found {
+    return runner.defaultRetention()
+  }
+  if retention.Mode == "" {
+    retention.Mode = RetentionBoth
+  }
+  return retention
+}
+
+// createSnapshot creates the snapshot of the disk with its labels, location
+// and guest flush, falling back to a crash-consistent snapshot if enabled.
+// An existing snapshot with the same name is considered as created.
+func (runner *Runner) createSnapshot(ctx context.Context, disk Disk, group string) (Snapshot, error) {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+
+  location := runner.storageLocation(disk)
+  if location != "" {
+    logger.Printf("Creating snapshot for disk %s in %s\n", disk.Name, location)
+  } else {
+    logger.Printf("Creating snapshot for disk %s\n", disk.Name)
+  }
+  labels, skippedLabels := SnapshotLabels(disk, runner.options.Labels)
+  if len(skippedLabels) > 0 {
+    runner.levels.Warning.Printf("WARNING: invalid labels not copied to the snapshot of disk %s: %s\n", disk.Name, strings.Join(skippedLabels, ", "))
+  }
+  if group != "" {
+    labels[GroupLabel] = group
+  }
+  labels[RunIDLabel] = sanitizeLabel(runner.options.RunID)
+  expires := expiresLabel(runner.retention(disk), time.Now())
+  if expires != "" {
+    labels[ExpiresLabel] = expires
+  }
+  kmsKey, err := runner.kmsKey(disk)
+  if err != nil {
+    return Snapshot{}, err
+  }
+  snapshotType, err := runner.snapshotType(disk, time.Now())
+  if err != nil {
+    return Snapshot{}, err
+  }
+  description, err := TemplateSnapshotDescription(runner.options.DescriptionTemplate, disk, Provenance{RunID: runner.options.RunID, Retention: runner.retention(disk)}, time.Now())
+  if err != nil {
+    return Snapshot{}, err
+  }
+  guestFlush := runner.guestFlush(disk)
+  if guestFlush && !supportOf(disk).GuestFlush {
+    if !runner.options.GuestFlushFallback {
+      return Snapshot{}, fmt.Errorf("%w, label it %s=false or use --guest-flush-fallback", unsupportedError(disk, "Guest flush"), GuestFlushLabel)
+    }
+    runner.levels.Warning.Printf("WARNING: %s, creating a crash-consistent snapshot\n", unsupportedError(disk, "guest flush"))
+    guestFlush = false
+  }
+  options := CreateOptions{NameTemplate: runner.options.NameTemplate, Description: description, Labels: labels, StorageLocation: location, GuestFlush: guestFlush, ChainName: runner.chainName(disk), KmsKey: kmsKey, SnapshotType: snapshotType}
+
+  snapshot, err := runner.backend.CreateSnapshotForDisk(ctx, disk, options, dryRun)
+  if err != nil && options.GuestFlush && runner.options.GuestFlushFallback && !IsAlreadyExists(err) && ctx.Err() == nil {
+    runner.levels.Warning.Printf("WARNING: guest flush snapshot %s for disk %s failed, creating a crash-consistent one: %s\n", snapshot.Name, disk.Name, err)
+    options.GuestFlush = false
+    snapshot, err = runner.backend.CreateSnapshotForDisk(ctx, disk, options, dryRun)
+  }
+  if err != nil && IsAlreadyExists(err) {
+    // Re-run or retried creation which succeeded
+    runner.levels.Warning.Printf("WARNING: snapshot %s for disk %s already exists: %s\n", snapshot.Name, disk.Name, err)
+    return snapshot, nil
+  }
+  if err != nil && location != "" {
+    return snapshot, fmt.Errorf("Storage location %s: %w", location, err)
+  }
+  snapshot.Labels = labels
+  snapshot.KmsKey = kmsKey
+  snapshot.Description = description
+  if err == nil && dryRun {
+    logger.Printf("[DRY-RUN] Snapshot %s for disk %s would have the labels %s\n", snapshot.Name, disk.Name, FormatLabels(labels))
+    logger.Printf("[DRY-RUN] Snapshot %s for disk %s would have the description: %s\n", snapshot.Name, disk.Name, description)
+    if kmsKey != "" {
+      logger.Printf("[DRY-RUN] Snapshot %s for disk %s would be encrypted with the key %s\n", snapshot.Name, disk.Name, kmsKey)
+    }
+    if snapshotType != "" {
+      logger.Printf("[DRY-RUN] Snapshot %s for disk %s would be of type %s\n", snapshot.Name, disk.Name, snapshotType)
+    }
+    if options.ChainName != "" {
+      logger.Printf("[DRY-RUN] Snapshot %s for disk %s would be in the chain %s\n", snapshot.Name, disk.Name, options.ChainName)
+    }
+  }
+  return snapshot, err
+}
+
+// kmsKey returns the KMS key of the snapshots of the disk, from the alias of
+// its KmsKeyLabel or the options.
+func (runner *Runner) kmsKey(disk Disk) (string, error) {
+  alias := disk.Labels[KmsKeyLabel]
+  if alias == "" {
+    return runner.options.KmsKey, nil
+  }
+  key, found := runner.options.KmsKeys[alias]
+  if !found {
+    return "", fmt.Errorf("Unknown KMS key alias '%s' in the %s label of disk %s", alias, KmsKeyLabel, disk.Name)
+  }
+  return key, nil
+}
+
+// guestFlush tells if the snapshots of the disk are application-consistent,
+// from its GuestFlushLabel or the options.
+func (runner *Runner) guestFlush(disk Disk) bool {
+  switch disk.Labels[GuestFlushLabel] {
+  case "true":
+    return true
+  case "false":
+    return false
+  }
+  return runner.options.GuestFlush
+}
+
+// storageLocation returns the storage location of the snapshots of the disk,
+// from its LocationLabel or the options.
+func (runner *Runner) storageLocation(disk Disk) string {
+  location := disk.Labels[LocationLabel]
+  if location != "" {
+    return location
+  }
+  return runner.options.StorageLocation
+}
+
+// locationSuffix returns the storage location of the snapshot for the logs.
+func locationSuffix(snapshot Snapshot) string {
+  if snapshot.StorageLocation == "" {
+    return ""
+  }
+  return " in " + snapshot.StorageLocation
+}
+
+// ErrTimedOut is the error of an operation which didn't complete within the
+// operation timeout.
+var ErrTimedOut = errors.New("Timed out")
+
+// operationContext bounds a snapshot creation or deletion with the operation
+// timeout.
+func (runner *Runner) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+  if runner.options.OperationTimeout > 0 {
+    return context.WithTimeout(ctx, runner.options.OperationTimeout)
+  }
+  return context.WithCancel(ctx)
+}
+
+// operationError marks the error of an operation which reached the operation
+// timeout, while the run goes on.
+func (runner *Runner) operationError(ctx context.Context, operationCtx context.Context, err error) error {
+  if err != nil && ctx.Err() == nil && errors.Is(operationCtx.Err(), context.DeadlineExceeded) {
+    return fmt.Errorf("%w after %s: %w", ErrTimedOut, runner.options.OperationTimeout, err)
+  }
+  return err
+}
+
+// waitForSnapshot polls the status of a created snapshot until it's READY or
+// FAILED.
+func (runner *Runner) waitForSnapshot(ctx context.Context, snapshot Snapshot) (string, error) {
+  if runner.options.WaitTimeout > 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, runner.options.WaitTimeout)
+    defer cancel()
+  }
+
+  for {
+    status, err := runner.backend.GetSnapshotStatus(ctx, snapshot)
+    if err != nil {
+      return status, err
+    }
+    if status == SnapshotReady {
+      return status, nil
+    }
+    if status == SnapshotFailed {
+      return status, errors.New("Snapshot " + snapshot.Name + " is FAILED")
+    }
+    select {
+    case <-ctx.Done():
+      return status, fmt.Errorf("Snapshot %s is still %s: %w", snapshot.Name, status, ctx.Err())
+    case <-time.After(waitInterval):
+    }
+  }
+}
+
+// listDisks lists the disks to snapshot and their snapshots.
+func (runner *Runner) listDisks(ctx context.Context, result *Result) ([]Disk, error) {
+  logger := runner.logger
+  backend := runner.backend
+
+  // A single listing for all the disks, grouped by disk. Without Phased, the
+  // snapshots are listed while the disks are
+  listingStart := time.Now()
+  snapshotsFilter := ""
+  if runner.options.OwnSnapshotsOnly {
+    snapshotsFilter = "labels." + CreatedByLabel + " = " + CreatedByValue
+  }
+  var snapshotsListed chan snapshotListing
+  if !runner.options.Phased {
+    listingCtx, cancelListing := context.WithCancel(ctx)
+    defer cancelListing()
+    snapshotsListed = make(chan snapshotListing, 1)
+    go func() {
+      snapshots, err := backend.ListSnapshots(listingCtx, snapshotsFilter)
+      snapshotsListed <- snapshotListing{snapshots: snapshots, err: err}
+    }()
+  }
+
+  disks, disksErr := runner.getDisks(ctx, result.Project)
+  if disksErr != nil {
+    return nil, disksErr
+  }
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if disks[diskIndex].Project == "" {
+      disks[diskIndex].Project = result.Project
+    }
+  }
+  disks, disksErr = runner.selectDisks(ctx, disks, result)
+  if disksErr != nil {
+    return nil, disksErr
+  }
+  result.Listed = true
+  result.Disks = disks
+
+  if len(disks) == 0 {
+    return disks, nil
+  }
+  var allSnapshots []Snapshot
+  var snapshotsErr error
+  if snapshotsListed != nil {
+    listing := <-snapshotsListed
+    allSnapshots, snapshotsErr = listing.snapshots, listing.err
+  } else {
+    listingStart = time.Now()
+    allSnapshots, snapshotsErr = backend.ListSnapshots(ctx, snapshotsFilter)
+  }
+  var snapshotsByDisk map[string][]Snapshot
+  if snapshotsErr == nil {
+    logger.Printf("Listed %d snapshots in %s\n", len(allSnapshots), time.Since(listingStart).Round(time.Millisecond))
+    snapshotsByDisk = groupSnapshotsByDisk(allSnapshots)
+  } else {
+    if runner.options.FailFast || ctx.Err() != nil {
+      return nil, snapshotsErr
+    }
+    runner.levels.Warning.Printf("WARNING: failed to list all the snapshots, listing them disk by disk: %s\n", snapshotsErr)
+    disks, snapshotsByDisk = runner.listSnapshotsByDisk(ctx, disks, result)
+    result.Disks = disks
+  }
+
+  pretty := runner.options.Pretty
+  if !pretty {
+    logger.Println("Disks and snapshots found:")
+  }
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := &disks[diskIndex]
+    snapshots := snapshotsByDisk[disk.Id]
+    if snapshots == nil {
+      snapshots = make([]Snapshot, 0)
+    }
+    disk.Snapshots = snapshots
+    runner.emit(diskEvent(EventDiskDiscovered, *disk, "", time.Time{}, nil))
+    if !pretty {
+      runner.logListedDisk(diskIndex, *disk)
+    }
+  }
+  if pretty {
+    logDisksTable(logger, disks, time.Now(), runner.options.Color)
+  }
+  logger.Println("")
+
+  return disks, nil
+}
+
+// logListedDisk logs the disk listed and its snapshots.
+func (runner *Runner) logListedDisk(diskIndex int, disk Disk) {
+  logger := runner.logger
+  if len(disk.Users) > 0 {
+    logger.Printf("%02d ) %s (attached to %s)\n", diskIndex + 1, disk.Name, strings.Join(disk.Users, ", "))
+  } else {
+    logger.Printf("%02d ) %s\n", diskIndex + 1, disk.Name)
+  }
+  for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+    logger.Printf("      - %s\n", disk.Snapshots[snapshotIndex].Name)
+  }
+}
+
+// snapshotListing is the outcome of the listing of all the snapshots.
+type snapshotListing struct {
+  snapshots []Snapshot
+  err       error
+}
+
+// listSnapshotsByDisk lists the snapshots of each disk, grouped by disk id.
+// The disks whose listing fails are failures, removed from the disks returned.
+func (runner *Runner) listSnapshotsByDisk(ctx context.Context, disks []Disk, result *Result) ([]Disk, map[string][]Snapshot) {
+  listed := make([]Disk, 0, len(disks))
+  snapshotsByDisk := make(map[string][]Snapshot)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    snapshots, err := runner.diskSnapshots(ctx, disk)
+    if err != nil {
+      runner.levels.Warning.Printf("Failed to list the snapshots of disk %s, skipping it: %s\n", disk.Name, err)
+      result.Failures = append(result.Failures, Failure{Disk: disk.Name, Err: fmt.Errorf("Listing of the snapshots: %w", err)})
+      continue
+    }
+    snapshotsByDisk[disk.Id] = snapshots
+    listed = append(listed, disk)
+  }
+  return listed, snapshotsByDisk
+}
+
+// diskSnapshots lists the snapshots of the disk, only the ones created by this
+// program with OwnSnapshotsOnly.
+func (runner *Runner) diskSnapshots(ctx context.Context, disk Disk) ([]Snapshot, error) {
+  snapshots, err := runner.backend.GetDiskSnapshots(ctx, disk)
+  if err != nil || !runner.options.OwnSnapshotsOnly {
+    return snapshots, err
+  }
+  return ownSnapshots(snapshots), nil
+}
+
+// disksSnapshots lists the snapshots of the disks in a single call, like
+// diskSnapshots.
+func (runner *Runner) disksSnapshots(ctx context.Context, disks []Disk) ([]Snapshot, error) {
+  snapshots, err := runner.backend.GetDisksSnapshots(ctx, disks)
+  if err != nil || !runner.options.OwnSnapshotsOnly {
+    return snapshots, err
+  }
+  return ownSnapshots(snapshots), nil
+}
+
+// ownSnapshots returns the snapshots created by this program.
+func ownSnapshots(snapshots []Snapshot) []Snapshot {
+  own := make([]Snapshot, 0, len(snapshots))
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    if snapshots[snapshotIndex].Labels[CreatedByLabel] == CreatedByValue {
+      own = append(own, snapshots[snapshotIndex])
+    }
+  }
+  return own
+}
+
+// groupSnapshotsByDisk groups the snapshots by source disk id, newest first.
+// The snapshots without a creation timestamp are the last ones.
+func groupSnapshotsByDisk(snapshots []Snapshot) map[string][]Snapshot {
+  snapshotsByDisk := make(map[string][]Snapshot)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    snapshotsByDisk[snapshot.SourceDiskId] = append(snapshotsByDisk[snapshot.SourceDiskId], snapshot)
+  }
+  for _, diskSnapshots := range snapshotsByDisk {
+    sortSnapshots(diskSnapshots)
+  }
+  return snapshotsByDisk
+}
+
+// createSnapshots creates a snapshot of each disk, adding them to the
+// snapshots of the disks. It returns the disks whose old snapshots must be
+// kept, as their new snapshot failed. The disks not due are left alone. With
+// a pipeline, each disk is handed to it once its snapshot is created.
+func (runner *Runner) createSnapshots(ctx context.Context, disks []Disk, overQuota []bool, notDue []bool, deferred []bool, pipeline *prunePipeline, result *Result) []bool {
+  logger := runner.logger
+
+  logger.Println("Creating snapshots...")
+
+  // All the disks at once, or the disks of each instance in a burst
+  allDisks := make([]int, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    allDisks = append(allDisks, diskIndex)
+  }
+  bursts := [][]int{allDisks}
+  diskGroups := make([]string, len(disks))
+  var groups []diskGroup
+  if runner.options.GroupByInstance {
+    groups, bursts = runner.groupDisksByInstance(disks, time.Now())
+    for groupIndex := 0; groupIndex < len(groups); groupIndex++ {
+      group := groups[groupIndex]
+      for groupDiskIndex := 0; groupDiskIndex < len(group.diskIndexes); groupDiskIndex++ {
+        diskGroups[group.diskIndexes[groupDiskIndex]] = group.id
+      }
+    }
+  }
+  bursts = runner.orderBursts(disks, bursts)
+
+  snapshotsCreated := make(chan snapshotResult, len(disks))
+  // In the pipeline, the creations are launched while the snapshots created
+  // are collected, so each disk is pruned as soon as its snapshot is created
+  launch := func() {
+    for burstIndex := 0; burstIndex < len(bursts); burstIndex++ {
+      // The next burst starts once the snapshots of this one are created,
+      // without waiting for them to be READY
+      var burst sync.WaitGroup
+      for burstDiskIndex := 0; burstDiskIndex < len(bursts[burstIndex]); burstDiskIndex++ {
+        diskIndex := bursts[burstIndex][burstDiskIndex]
+        resumed, isResumed := runner.options.Resumed[disks[diskIndex].Id]
+        if isResumed {
+          snapshotsCreated <- snapshotResult{diskIndex: diskIndex, snapshot: Snapshot{Name: resumed}, resumed: true}
+          continue
+        }
+        if notDue[diskIndex] {
+          snapshotsCreated <- snapshotResult{diskIndex: diskIndex, notDue: true}
+          continue
+        }
+        if deferred[diskIndex] {
+          snapshotsCreated <- snapshotResult{diskIndex: diskIndex, deferred: true}
+          continue
+        }
+        if overQuota[diskIndex] {
+          snapshotsCreated <- snapshotResult{diskIndex: diskIndex, err: ErrQuotaExceeded}
+          continue
+        }
+        // The slot is taken here so the creations start in the order of the
+        // disks, even with a concurrency limit
+        acquired := runner.acquire(ctx)
+        burst.Add(1)
+        go runner.createDisk(ctx, diskIndex, disks[diskIndex], diskGroups[diskIndex], acquired, &burst, snapshotsCreated)
+      }
+      burst.Wait()
+    }
+  }
+  if pipeline == nil {
+    launch()
+  } else {
+    go launch()
+  }
+  created := &creations{runner: runner, disks: disks, createdNames: make([]string, len(disks)), pruneBlocked: make([]bool, len(disks)), result: result}
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    // The snapshots are received in completion order, not in disks order
+    snapshotCreated := <-snapshotsCreated
+    created.collect(snapshotCreated)
+    if pipeline != nil {
+      pipeline.prune(snapshotCreated.diskIndex, disks[snapshotCreated.diskIndex], created.pruneBlocked[snapshotCreated.diskIndex], created.createdNames[snapshotCreated.diskIndex])
+    }
+  }
+  created.finish(ctx)
+  result.Groups = snapshotGroups(groups, disks, created.createdNames)
+
+  return created.pruneBlocked
+}
+
+// createDisk creates the snapshot of the disk in the slot acquired, and sends
+// its outcome, the burst being done once the snapshot is created, before it's
+// READY. Only the outcome is sent if the slot wasn't acquired.
+func (runner *Runner) createDisk(ctx context.Context, diskIndex int, disk Disk, group string, acquired bool, burst *sync.WaitGroup, snapshotsCreated chan<- snapshotResult) {
+  ctx, span := StartSpan(ctx, "create disk", diskAttributes(disk)...)
+  var started time.Time
+  send := func(created snapshotResult) {
+    span.SetAttributes(attribute.String("snapshot.name", created.snapshot.Name), attribute.Float64("snapshot.create_seconds", created.duration.Seconds()))
+    if created.readyDuration > 0 {
+      span.SetAttributes(attribute.Float64("snapshot.ready_seconds", created.readyDuration.Seconds()))
+    }
+    EndSpan(span, created.err)
+    if !started.IsZero() {
+      runner.emit(diskEvent(EventCreateFinished, disk, created.snapshot.Name, started, created.err))
+    }
+    snapshotsCreated <- created
+  }
+  if !acquired {
+    burst.Done()
+    send(snapshotResult{diskIndex: diskIndex, err: runner.stopped(ctx)})
+    return
+  }
+  defer runner.release()
+  dryRun := runner.options.DryRun
+  started = time.Now()
+  runner.emit(diskEvent(EventCreateStarted, disk, "", time.Time{}, nil))
+  operationCtx, cancel := runner.operationContext(ctx)
+  defer cancel()
+  snapshot, snapshotErr := runner.createSnapshot(operationCtx, disk, group)
+  snapshotErr = runner.operationError(ctx, operationCtx, snapshotErr)
+  duration := time.Since(started)
+  burst.Done()
+  if snapshotErr != nil || !runner.options.Wait || dryRun {
+    send(snapshotResult{diskIndex: diskIndex, snapshot: snapshot, duration: duration, err: snapshotErr})
+    return
+  }
+  waitStarted := time.Now()
+  status, waitErr := runner.waitForSnapshot(ctx, snapshot)
+  snapshot.Status = status
+  send(snapshotResult{diskIndex: diskIndex, snapshot: snapshot, created: status != SnapshotFailed, duration: duration, readyDuration: time.Since(waitStarted), err: waitErr})
+}
+
+// creations collects the outcome of the creations into the disks and the
+// result, in completion order.
+type creations struct {
+  runner       *Runner
+  disks        []Disk
+  // Name of the snapshot created by disk, if any
+  createdNames []string
+  // The disks whose old snapshots must be kept
+  pruneBlocked []bool
+  result       *Result
+}
+
+// collect adds the outcome of the creation of a disk.
+func (creations *creations) collect(created snapshotResult) {
+  runner := creations.runner
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+  result := creations.result
+  pruneBlocked := creations.pruneBlocked
+  diskBackuped := &creations.disks[created.diskIndex]
+  if created.resumed {
+    logger.Printf("Skipping disk %s, its snapshot %s was created by the resumed run\n", diskBackuped.Name, created.snapshot.Name)
+    return
+  }
+  if created.notDue {
+    return
+  }
+  if created.deferred {
+    pruneBlocked[created.diskIndex] = true
+    return
+  }
+  if created.duration > 0 && !dryRun {
+    result.Operations = append(result.Operations, Operation{Kind: OperationCreate, Disk: diskBackuped.Name, Snapshot: created.snapshot.Name, Duration: created.duration, ReadyDuration: created.readyDuration, Failed: created.err != nil})
+  }
+  if created.err != nil {
+    runner.progress(DiskProgress{Disk: *diskBackuped, Phase: PhaseCreateFailed, Snapshot: created.snapshot.Name, Err: created.err})
+    result.Failures = append(result.Failures, Failure{Disk: diskBackuped.Name, Snapshot: created.snapshot.Name, Err: created.err})
+    if created.created {
+      result.Created = append(result.Created, created.snapshot)
+    }
+    if created.created || created.snapshot.Status == SnapshotFailed {
+      runner.levels.Warning.Printf("Snapshot %s for disk %s not READY: %s\n", created.snapshot.Name, diskBackuped.Name, created.err)
+    } else {
+      runner.levels.Warning.Printf("Failed to create snapshot %s for disk %s: %s\n", created.snapshot.Name, diskBackuped.Name, created.err)
+    }
+    if !runner.options.PruneOnCreateFailure {
+      pruneBlocked[created.diskIndex] = true
+      runner.levels.Warning.Printf("WARNING: old snapshots of disk %s will NOT be deleted, its new snapshot failed\n", diskBackuped.Name)
+    }
+    return
+  }
+  snapshotCreated := created.snapshot
+  newSnapshots := make([]Snapshot, len(diskBackuped.Snapshots) + 1)
+  copy(newSnapshots[1:], diskBackuped.Snapshots)
+  newSnapshots[0] = snapshotCreated
+  diskBackuped.Snapshots = newSnapshots
+  result.Created = append(result.Created, snapshotCreated)
+  creations.createdNames[created.diskIndex] = snapshotCreated.Name
+  runner.progress(DiskProgress{Disk: *diskBackuped, Phase: PhaseCreated, Snapshot: snapshotCreated.Name})
+  if dryRun {
+    logger.Printf("[DRY-RUN] Would create snapshot %s for disk %s%s\n", snapshotCreated.Name, diskBackuped.Name, locationSuffix(snapshotCreated))
+  } else if snapshotCreated.Status == SnapshotReady {
+    result.Ready = append(result.Ready, snapshotCreated)
+    logger.Printf("Created snapshot %s for disk %s%s, READY\n", snapshotCreated.Name, diskBackuped.Name, locationSuffix(snapshotCreated))
+  } else {
+    logger.Printf("Created snapshot %s for disk %s%s\n", snapshotCreated.Name, diskBackuped.Name, locationSuffix(snapshotCreated))
+  }
+}
+
+// finish logs the summary of the creations, and stamps the disks.
+func (creations *creations) finish(ctx context.Context) {
+  runner := creations.runner
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+  result := creations.result
+  if dryRun {
+    logger.Printf("[DRY-RUN] %d snapshots would be created", len(result.Created))
+  } else if runner.options.Wait {
+    logger.Printf("Created %d snapshots, %d verified READY", len(result.Created), len(result.Ready))
+  } else {
+    logger.Printf("Created %d snapshots", len(result.Created))
+  }
+  if runner.options.StampDisks && len(result.Created) > 0 {
+    runner.stampDisks(ctx, creations.disks, creations.createdNames, time.Now())
+  }
+  logger.Println("")
+}
+
+// pruneSnapshots deletes the snapshots of the disks beyond their retention,
+// except for the blocked disks. Nothing is deleted if it exceeds the deletion
+// limits, without Force.
+func (runner *Runner) pruneSnapshots(ctx context.Context, disks []Disk, pruneBlocked []bool, result *Result) error {
+  runner.logPrune()
+  total := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    total += len(disks[diskIndex].Snapshots)
+  }
+  return runner.pruneDisks(ctx, disks, pruneBlocked, &pruneState{total: total}, result)
+}
+
+// logPrune logs the start of the prune phase, with the default retention.
+func (runner *Runner) logPrune() {
+  if runner.options.RespectTTLOnly {
+    runner.logger.Printf("Deleting expired snapshots (label %s)\n", ExpiresLabel)
+  } else {
+    runner.logger.Printf("Deleting old snapshots (%s)\n", runner.defaultRetention())
+  }
+}
+
+// pruneDisks deletes the snapshots of a batch of disks beyond their
+// retention, all the disks in phases or a single one in the pipeline, within
+// the deletion limits of the state.
+func (runner *Runner) pruneDisks(ctx context.Context, disks []Disk, pruneBlocked []bool, state *pruneState, result *Result) error {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+
+  now := time.Now()
+  candidates := make([][]Snapshot, len(disks))
+  failedSnapshots := make([][]Snapshot, len(disks))
+  candidatesCount := 0
+  candidateDisks := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    // The held snapshots don't count in the retention
+    unheld, held := withoutHeld(disks[diskIndex].Snapshots, now)
+    for snapshotIndex := 0; snapshotIndex < len(held); snapshotIndex++ {
+      logger.Printf("Keeping snapshot %s of disk %s: %s\n", held[snapshotIndex].Name, disks[diskIndex].Name, HoldReason(held[snapshotIndex], now))
+    }
+    result.Held = append(result.Held, held...)
+    if pruneBlocked[diskIndex] {
+      continue
+    }
+    // The snapshots being created or failed don't count in the retention, so
+    // they don't push a good snapshot out
+    ready, inProgress, failed := snapshotsByStatus(unheld)
+    if len(inProgress) > 0 || len(failed) > 0 {
+      logger.Printf("Disk %s: %d ready, %d creating and %d failed snapshot(s), only the ready ones count in the retention\n", disks[diskIndex].Name, len(ready), len(inProgress), len(failed))
+    }
+    if state.planned != nil {
+      // The deletions of the applied plan rather than of the retention, going
+      // through the same safeguards
+      candidates[diskIndex] = plannedSnapshots(ready, state.planned)
+      failedSnapshots[diskIndex] = plannedSnapshots(failed, state.planned)
+      candidatesCount += len(candidates[diskIndex])
+      if len(candidates[diskIndex]) > 0 {
+        candidateDisks++
+      }
+      continue
+    }
+    for snapshotIndex := 0; snapshotIndex < len(failed); snapshotIndex++ {
+      if runner.options.CleanupFailed {
+        logger.Printf("Snapshot %s of disk %s is FAILED, deleting it\n", failed[snapshotIndex].Name, disks[diskIndex].Name)
+      } else {
+        logger.Printf("Keeping FAILED snapshot %s of disk %s, without --cleanup-failed\n", failed[snapshotIndex].Name, disks[diskIndex].Name)
+      }
+    }
+    if runner.options.CleanupFailed {
+      failedSnapshots[diskIndex] = failed
+    }
+    snapshotsToDelete := make([]Snapshot, 0)
+    if !runner.options.RespectTTLOnly {
+      var unknownAge []Snapshot
+      snapshotsToDelete, unknownAge = runner.retention(disks[diskIndex]).SnapshotsToDelete(ready, now)
+      for snapshotIndex := 0; snapshotIndex < len(unknownAge); snapshotIndex++ {
+        runner.levels.Warning.Printf("WARNING: keeping snapshot %s of disk %s: unknown creation timestamp\n", unknownAge[snapshotIndex].Name, disks[diskIndex].Name)
+      }
+    }
+    // Deleted once expired whatever the retention, and never if the label is
+    // invalid
+    expired, invalidExpiry := expiredSnapshots(ready, now)
+    for snapshotIndex := 0; snapshotIndex < len(expired); snapshotIndex++ {
+      logger.Printf("Snapshot %s of disk %s expired on %s\n", expired[snapshotIndex].Name, disks[diskIndex].Name, expired[snapshotIndex].Labels[ExpiresLabel])
+    }
+    for snapshotIndex := 0; snapshotIndex < len(invalidExpiry); snapshotIndex++ {
+      runner.levels.Warning.Printf("WARNING: keeping snapshot %s of disk %s: invalid label %s=%s\n", invalidExpiry[snapshotIndex].Name, disks[diskIndex].Name, ExpiresLabel, invalidExpiry[snapshotIndex].Labels[ExpiresLabel])
+    }
+    result.InvalidExpiry = append(result.InvalidExpiry, invalidExpiry...)
+    snapshotsToDelete = withExpired(snapshotsToDelete, expired, invalidExpiry)
+    candidates[diskIndex] = snapshotsToDelete
+    candidatesCount += len(snapshotsToDelete)
+    if len(snapshotsToDelete) > 0 {
+      candidateDisks++
+    }
+  }
+
+  if candidatesCount > 0 && !runner.options.ForceDeleteReferenced {
+    // Listed once for all the disks
+    references, err := runner.snapshotReferences(ctx, state)
+    if err != nil {
+      return err
+    }
+    candidatesCount = 0
+    candidateDisks = 0
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      unreferenced := make([]Snapshot, 0, len(candidates[diskIndex]))
+      for snapshotIndex := 0; snapshotIndex < len(candidates[diskIndex]); snapshotIndex++ {
+        snapshot := candidates[diskIndex][snapshotIndex]
+        resource := referencingResource(snapshot, references)
+        if resource != "" {
+          runner.levels.Warning.Printf("WARNING: keeping snapshot %s of disk %s: used by %s\n", snapshot.Name, disks[diskIndex].Name, resource)
+          result.Referenced = append(result.Referenced, snapshot)
+          continue
+        }
+        unreferenced = append(unreferenced, snapshot)
+      }
+      candidates[diskIndex] = unreferenced
+      candidatesCount += len(unreferenced)
+      if len(unreferenced) > 0 {
+        candidateDisks++
+      }
+    }
+  }
+
+  // Enforced after all the other rules, the kept snapshots counting in the
+  // snapshots left
+  if runner.options.MinKeep > 0 && candidatesCount > 0 {
+    candidatesCount = 0
+    candidateDisks = 0
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      var kept []Snapshot
+      candidates[diskIndex], kept = minKept(disks[diskIndex].Snapshots, candidates[diskIndex], runner.options.MinKeep)
+      for snapshotIndex := 0; snapshotIndex < len(kept); snapshotIndex++ {
+        logger.Printf("Keeping snapshot %s of disk %s: one of its last %d (min keep)\n", kept[snapshotIndex].Name, disks[diskIndex].Name, runner.options.MinKeep)
+      }
+      result.MinKept = append(result.MinKept, kept...)
+      candidatesCount += len(candidates[diskIndex])
+      if len(candidates[diskIndex]) > 0 {
+        candidateDisks++
+      }
+    }
+  }
+
+  // Logged once for the whole pipeline, when it's done
+  if !state.pipelined && state.total > 0 {
+    logger.Printf("Deletions: %d of %d snapshot(s) (%.1f%%), %s\n", candidatesCount, state.total, deletionPercent(candidatesCount, state.total), runner.options.DeletionLimits)
+  }
+  limitsErr := runner.reserveDeletions(state, candidatesCount)
+  if limitsErr != nil {
+    if !state.pipelined {
+      logger.Println("")
+    }
+    return limitsErr
+  }
+
+  if runner.options.DeletionGrace > 0 {
+    candidates = runner.markSnapshots(ctx, disks, candidates, pruneBlocked, now, result)
+    candidatesCount = 0
+    candidateDisks = 0
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      candidatesCount += len(candidates[diskIndex])
+      if len(candidates[diskIndex]) > 0 {
+        candidateDisks++
+      }
+    }
+    if !state.pipelined {
+      logger.Printf("Marked %d snapshot(s) for deletion, unmarked %d, %d marked for more than %s to delete\n", len(result.Marked), len(result.Unmarked), candidatesCount, runner.options.DeletionGrace)
+    }
+  }
+
+  // The failed snapshots are useless: deleted at once, without a grace
+  // period nor counting in the deletion limits
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if len(failedSnapshots[diskIndex]) == 0 {
+      continue
+    }
+    if len(candidates[diskIndex]) == 0 {
+      candidateDisks++
+    }
+    candidates[diskIndex] = append(candidates[diskIndex], failedSnapshots[diskIndex]...)
+    candidatesCount += len(failedSnapshots[diskIndex])
+  }
+
+  prices := runner.prices()
+  if prices.Standard > 0 && candidatesCount > 0 && !state.pipelined {
+    toDelete := make([]Snapshot, 0, candidatesCount)
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      toDelete = append(toDelete, candidates[diskIndex]...)
+    }
+    logger.Printf("Deleting these %d snapshot(s) frees %s\n", candidatesCount, SnapshotsCost(toDelete, prices))
+  }
+
+  if state.confirmed != nil {
+    // Confirmed by the pipeline before the snapshots were listed again
+    if state.cancelled {
+      return nil
+    }
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      confirmed := make([]Snapshot, 0, len(candidates[diskIndex]))
+      for snapshotIndex := 0; snapshotIndex < len(candidates[diskIndex]); snapshotIndex++ {
+        snapshot := candidates[diskIndex][snapshotIndex]
+        if state.confirmed[snapshot.Name] {
+          confirmed = append(confirmed, snapshot)
+        } else {
+          logger.Printf("Keeping snapshot %s of disk %s: not in the confirmed deletions\n", snapshot.Name, disks[diskIndex].Name)
+        }
+      }
+      candidates[diskIndex] = confirmed
+    }
+  } else if runner.options.Confirm != nil && !dryRun && candidatesCount > 0 {
+    if !runner.confirmDeletions(disks, candidates, now) {
+      logger.Println("")
+      return nil
+    }
+  }
+
+  oldSnapshotsDeleted := make(chan diskResult, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    diskToClean := &disks[diskIndex]
+    snapshotsToDelete := candidates[diskIndex]
+    if len(snapshotsToDelete) == 0 {
+      oldSnapshotsDeleted <- diskResult{disk: *diskToClean, blocked: pruneBlocked[diskIndex]}
+      continue
+    }
+    go func(disk Disk, snapshotsToDelete []Snapshot) {
+      ctx, span := StartSpan(ctx, "prune disk", append(diskAttributes(disk), attribute.Int("snapshots.to_delete", len(snapshotsToDelete)))...)
+      snapshotsDeletedForDisk := make(chan snapshotResult, len(snapshotsToDelete))
+      if !dryRun {
+        logger.Printf("Deleting %d old snapshot(s) for disk %s\n", len(snapshotsToDelete), disk.Name)
+      }
+      for snapshotIndex := 0; snapshotIndex < len(snapshotsToDelete); snapshotIndex++ {
+        go func(snapshotToDelete Snapshot) {
+          if !runner.acquire(ctx) {
+            snapshotsDeletedForDisk <- snapshotResult{snapshot: snapshotToDelete, err: runner.stopped(ctx)}
+            return
+          }
+          defer runner.release()
+          operationCtx, cancel := runner.operationContext(ctx)
+          defer cancel()
+          duration, snapshotDeleteErr := runner.deleteSnapshot(ctx, operationCtx, disk, snapshotToDelete, dryRun)
+          snapshotsDeletedForDisk <- snapshotResult{snapshot: snapshotToDelete, duration: duration, err: snapshotDeleteErr}
+        }(snapshotsToDelete[snapshotIndex])
+      }
+      cleaned := diskResult{disk: disk, deleted: make([]Snapshot, 0), failures: make([]Failure, 0)}
+      for snapshotIndex := 0; snapshotIndex < len(snapshotsToDelete); snapshotIndex++ {
+        snapshotDeleted := <-snapshotsDeletedForDisk
+        if snapshotDeleted.duration > 0 && !dryRun {
+          cleaned.operations = append(cleaned.operations, Operation{Kind: OperationDelete, Disk: disk.Name, Snapshot: snapshotDeleted.snapshot.Name, Duration: snapshotDeleted.duration, Failed: snapshotDeleted.err != nil})
+        }
+        if snapshotDeleted.err != nil {
+          cleaned.failures = append(cleaned.failures, Failure{Disk: disk.Name, Snapshot: snapshotDeleted.snapshot.Name, Err: snapshotDeleted.err})
+          runner.levels.Warning.Printf("Failed to delete snapshot %s: %s\n", snapshotDeleted.snapshot.Name, snapshotDeleted.err)
+          continue
+        }
+        cleaned.deleted = append(cleaned.deleted, snapshotDeleted.snapshot)
+        if dryRun {
+          logger.Printf("[DRY-RUN] Would delete snapshot %s of disk %s, %s old\n", snapshotDeleted.snapshot.Name, disk.Name, FormatAge(snapshotDeleted.snapshot.CreationTimestamp, now))
+        } else {
+          logger.Printf("Deleted snapshot %s\n", snapshotDeleted.snapshot.Name)
+        }
+      }
+      span.SetAttributes(attribute.Int("snapshots.deleted", len(cleaned.deleted)))
+      var spanErr error
+      if len(cleaned.failures) > 0 {
+        spanErr = cleaned.failures[0].Err
+      }
+      EndSpan(span, spanErr)
+      oldSnapshotsDeleted <- cleaned
+    }(*diskToClean, snapshotsToDelete)
+  }
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    diskCleaned := <-oldSnapshotsDeleted
+    // The blocked disks are still failed from the creation
+    if !diskCleaned.blocked && len(diskCleaned.failures) > 0 {
+      runner.progress(DiskProgress{Disk: diskCleaned.disk, Phase: PhasePruneFailed, Err: diskCleaned.failures[0].Err})
+    } else if !diskCleaned.blocked {
+      runner.progress(DiskProgress{Disk: diskCleaned.disk, Phase: PhasePruned})
+    }
+    result.Failures = append(result.Failures, diskCleaned.failures...)
+    result.Deleted = append(result.Deleted, diskCleaned.deleted...)
+    result.Operations = append(result.Operations, diskCleaned.operations...)
+    if dryRun {
+      logger.Printf("[DRY-RUN] Disk %s: %d snapshot(s) would be deleted\n", diskCleaned.disk.Name, len(diskCleaned.deleted))
+    } else {
+      logger.Printf("Cleaned disk %s: %d snapshot(s) deleted\n", diskCleaned.disk.Name, len(diskCleaned.deleted))
+    }
+  }
+  if !state.pipelined {
+    logger.Println("")
+  }
+  return nil
+}
+
+// confirmDeletions lists the snapshots to delete of the disks, and asks for the
+// confirmation of their deletion.
+func (runner *Runner) confirmDeletions(disks []Disk, candidates [][]Snapshot, now time.Time) bool {
+  candidatesCount := 0
+  candidateDisks := 0
+  // Always logged, even when quiet, what is confirmed must be seen
+  runner.levels.Warning.Println("Snapshots to delete:")
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if len(candidates[diskIndex]) > 0 {
+      candidateDisks++
+    }
+    for snapshotIndex := 0; snapshotIndex < len(candidates[diskIndex]); snapshotIndex++ {
+      snapshot := candidates[diskIndex][snapshotIndex]
+      runner.levels.Warning.Printf("  - %s: %s, %s old\n", disks[diskIndex].Name, snapshot.Name, FormatAge(snapshot.CreationTimestamp, now))
+      candidatesCount++
+    }
+  }
+  if !runner.options.Confirm(candidatesCount, candidateDisks) {
+    runner.logger.Println("Deletion of the old snapshots cancelled")
+    return false
+  }
+  return true
+}
+
+// List lists the disks and their snapshots like Run, without creating nor
+// deleting anything.
+func (runner *Runner) List(ctx context.Context) (result Result, err error) {
+  result = Result{
+    RunID: runner.options.RunID,
+    Filter: runner.options.Filter,
+    StartedAt: time.Now(),
+    Skipped: make([]Skip, 0),
+  }
+  defer func() {
+    result.Duration = time.Since(result.StartedAt)
+  }()
+
+  project, projectErr := runner.backend.Project(ctx)
+  if projectErr != nil {
+    runner.levels.Warning.Printf("WARNING: unknown project: %s\n", projectErr)
+  } else if project == "" {
+    return result, ErrNoProject
+  }
+  result.Project = project
+
+  _, err = runner.listDisks(ctx, &result)
+  return result, err
+}
+
+// Run lists the disks, creates a snapshot for each of them and deletes the
+// snapshots beyond the limit, or only one of these phases depending on the
+// mode. A failing disk doesn't stop the others: the
+// failures are in the result, and an error is returned once all the disks
+// have been processed. When the context is done or the timeout is reached,
+// the operations in progress are cancelled.
+func (runner *Runner) Run(ctx context.Context) (result Result, err error) {
+  result = Result{
+    RunID: runner.options.RunID,
+    Filter: runner.options.Filter,
+    DryRun: runner.options.DryRun,
+    StartedAt: time.Now(),
+    Created: make([]Snapshot, 0),
+    Ready: make([]Snapshot, 0),
+    Deleted: make([]Snapshot, 0),
+    Failures: make([]Failure, 0),
+    Skipped: make([]Skip, 0),
+  }
+  ctx, endSpan := runner.startRunSpan(ctx, "run")
+  endEvents := runner.startRunEvents(runner.options.Mode)
+  defer func() {
+    result.Duration = time.Since(result.StartedAt)
+    endSpan(result, err)
+    endEvents(result, err)
+  }()
+
+  if runner.options.Timeout > 0 {
+    var cancel context.CancelFunc
+    ctx, cancel = context.WithTimeout(ctx, runner.options.Timeout)
+    defer cancel()
+  }
+
+  logger := runner.logger
+  backend := runner.backend
+  filter := runner.options.Filter
+  dryRun := runner.options.DryRun
+  retention := runner.defaultRetention()
+  mode := runner.options.Mode
+  if mode == "" {
+    mode = ModeFull
+  }
+  result.Mode = mode
+  if mode != ModeFull && mode != ModeBackup && mode != ModePrune {
+    return result, fmt.Errorf("Unknown mode '%s', use '%s', '%s' or '%s'", mode, ModeFull, ModeBackup, ModePrune)
+  }
+  switch runner.options.QuotaBehavior {
+  case "", QuotaAbort, QuotaPartial, QuotaIgnore:
+  default:
+    return result, fmt.Errorf("Unknown quota behavior '%s', use '%s', '%s' or '%s'", runner.options.QuotaBehavior, QuotaAbort, QuotaPartial, QuotaIgnore)
+  }
+  typeErr := ValidateSnapshotType(runner.options.SnapshotType)
+  if typeErr != nil {
+    return result, typeErr
+  }
+  switch runner.options.Orphans {
+  case "", OrphansReport, OrphansDelete:
+  default:
+    return result, fmt.Errorf("Unknown orphans mode '%s', use '%s' or '%s'", runner.options.Orphans, OrphansReport, OrphansDelete)
+  }
+  // The orphans are looked for by the prune phase
+  orphans := runner.options.Orphans != "" && mode != ModeBackup
+
+  retentionErr := retention.Validate()
+  if retentionErr != nil {
+    return result, retentionErr
+  }
+  for diskName := range runner.options.DiskRetentions {
+    retentionErr = runner.retention(Disk{Name: diskName}).Validate()
+    if retentionErr != nil {
+      return result, fmt.Errorf("Retention of disk %s: %w", diskName, retentionErr)
+    }
+  }
+  if runner.options.InstantSnapshots && runner.options.InstantLimit < 1 {
+    return result, fmt.Errorf("Invalid instant limit %d, keep at least 1 instant snapshot by disk", runner.options.InstantLimit)
+  }
+  if runner.options.NameTemplate != "" {
+    templateErr := ValidateNameTemplate(runner.options.NameTemplate)
+    if templateErr != nil {
+      return result, templateErr
+    }
+  }
+  if runner.options.ChainNameTemplate != "" {
+    templateErr := ValidateChainNameTemplate(runner.options.ChainNameTemplate)
+    if templateErr != nil {
+      return result, templateErr
+    }
+  }
+  if runner.options.DescriptionTemplate != "" {
+    templateErr := ValidateDescriptionTemplate(runner.options.DescriptionTemplate)
+    if templateErr != nil {
+      return result, templateErr
+    }
+  }
+  if runner.options.Stream {
+    streamErr := runner.validateStream(mode)
+    if streamErr != nil {
+      return result, streamErr
+    }
+  }
+
+  project, projectErr := backend.Project(ctx)
+  if projectErr != nil {
+    runner.levels.Warning.Printf("WARNING: unknown project: %s\n", projectErr)
+  } else if project == "" {
+    return result, ErrNoProject
+  }
+  result.Project = project
+
+  logger.Printf("Backup of GCP disks of project '%s' using filter '%s'\n", project, filter)
+
+  if dryRun {
+    logger.Println("")
+    logger.Println("DRY RUN MODE: nothing is created or deleted")
+  }
+  if mode != ModeFull {
+    logger.Println("")
+    logger.Printf("%s MODE: only the %s phase is run\n", strings.ToUpper(mode), mode)
+  }
+
+  logger.Println("")
+
+  listCtx, listSpan := StartSpan(ctx, "list")
+  var disks []Disk
+  var disksErr error
+  // Streamed, the disks are snapshotted and their schedules checked as listed
+  var streamedBlocked []bool
+  var streamedPipeline *prunePipeline
+  if runner.options.Stream {
+    disks, streamedBlocked, streamedPipeline, disksErr = runner.streamDisks(listCtx, &result)
+  } else {
+    disks, disksErr = runner.listDisks(listCtx, &result)
+  }
+  listSpan.SetAttributes(attribute.Int("disks", len(disks)))
+  EndSpan(listSpan, disksErr)
+  if disksErr != nil {
+    return result, disksErr
+  }
+  if !runner.options.Stream {
+    disks = runner.checkSchedules(disks, &result)
+  }
+  result.Disks = disks
+  // The backups go on when the check fails
+  if runner.options.EnforceLabeling != "" {
+    labelingErr := runner.checkLabeling(ctx, &result)
+    if labelingErr != nil {
+      runner.levels.Warning.Printf("WARNING: %s\n", labelingErr)
+    }
+  }
+  if len(disks) == 0 {
+    logger.Println("No disk to snapshot")
+    if orphans {
+      logger.Println("")
+      orphansErr := runner.pruneOrphans(ctx, &result)
+      if orphansErr != nil {
+        return result, orphansErr
+      }
+    }
+    return result, runner.labelingError(result)
+  }
+
+  // The disks whose new snapshot failed, is FAILED or not READY in time keep
+  // all their old snapshots
+  pruneBlocked := make([]bool, len(disks))
+  deferred := make([]bool, len(disks))
+  // Unless in phases, each disk is pruned once its snapshot is created. The
+  // deletions to confirm are confirmed at once, after the last creation and
+  // before the first deletion
+  var pipeline *prunePipeline
+  pipelined := mode == ModeFull && !runner.options.Phased
+  if runner.options.Stream {
+    pruneBlocked, pipeline = streamedBlocked, streamedPipeline
+  } else if mode != ModePrune {
+    createCtx, createSpan := StartSpan(ctx, "create")
+    notDue := runner.notDueDisks(disks, time.Now(), &result)
+    deferred = runner.deferredDisks(disks, notDue, time.Now(), &result)
+    notCreated := make([]bool, len(disks))
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      notCreated[diskIndex] = notDue[diskIndex] || deferred[diskIndex]
+    }
+    overQuota, quotaErr := runner.checkQuota(createCtx, disks, notCreated, &result)
+    if quotaErr != nil {
+      EndSpan(createSpan, quotaErr)
+      // Nothing was created nor deleted
+      result.Quota.UsageAfter = result.Quota.UsageBefore
+      return result, quotaErr
+    }
+    if pipelined {
+      pipeline = runner.startPipeline(ctx, disks, runner.creatingDisks(disks, overQuota, notDue, deferred), deferred)
+    }
+    pruneBlocked = runner.createSnapshots(createCtx, disks, overQuota, notDue, deferred, pipeline, &result)
+    createSpan.SetAttributes(attribute.Int("snapshots.created", len(result.Created)))
+    EndSpan(createSpan, nil)
+  }
+  if pipeline != nil {
+    pipeline.confirm(disks, pruneBlocked)
+  }
+  // The disks whose copy failed keep their old copies too
+  copyBlocked := make([]bool, len(disks))
+  copy(copyBlocked, pruneBlocked)
+  if runner.options.CopyLocation != "" && len(result.Created) > 0 {
+    copyCtx, copySpan := StartSpan(ctx, "copy")
+    copyFailed := runner.copySnapshots(copyCtx, disks, &result)
+    EndSpan(copySpan, nil)
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      copyBlocked[diskIndex] = copyBlocked[diskIndex] || copyFailed[diskIndex]
+    }
+  }
+  if runner.options.InstantSnapshots {
+    instantCtx, instantSpan := StartSpan(ctx, "instant")
+    runner.instantSnapshots(instantCtx, disks, deferred, mode, &result)
+    EndSpan(instantSpan, nil)
+  }
+  // Once stopped, no deletion is started. The orphans are only pruned out of
+  // the backup mode.
+  var pruneErr error
+  if mode != ModeBackup {
+    pruneCtx, pruneSpan := StartSpan(ctx, "prune")
+    if pipeline != nil {
+      pruneErr = pipeline.wait(disks, &result)
+    } else {
+      // The prune mode deletes right after its listing
+      if mode != ModePrune && !runner.options.NoRefresh && runner.stopped(ctx) == nil {
+        runner.refreshSnapshots(pruneCtx, disks, pruneBlocked, &result)
+      }
+      if runner.stopped(ctx) == nil {
+        pruneErr = runner.pruneSnapshots(pruneCtx, disks, pruneBlocked, &result)
+      }
+    }
+    if pruneErr == nil && runner.options.CopyLocation != "" && runner.stopped(ctx) == nil {
+      pruneErr = runner.pruneCopies(pruneCtx, disks, copyBlocked, &result)
+    }
+    if pruneErr == nil && orphans && runner.stopped(ctx) == nil {
+      pruneErr = runner.pruneOrphans(pruneCtx, &result)
+    }
+    pruneSpan.SetAttributes(attribute.Int("snapshots.deleted", len(result.Deleted)))
+    EndSpan(pruneSpan, pruneErr)
+  }
+  runner.updateQuotaUsage(ctx, &result)
+  if runner.options.PricePerGbMonth > 0 {
+    result.Cost = newCostReport(disks, result.Released, result.Deleted, runner.prices(), runner.options.CostLabel)
+  }
+  if pruneErr != nil {
+    return result, fmt.Errorf("Prune phase aborted: %w", pruneErr)
+  }
+
+  failedDisks := result.FailedDisks()
+  if len(failedDisks) == 0 && len(result.InstantFailures) > 0 {
+    runner.levels.Warning.Printf("Backup complete with instant snapshot failures for %d disk(s)\n", len(result.instantFailedDisks()))
+  } else if len(failedDisks) == 0 {
+    logger.Printf("Backup complete!")
+  } else {
+    runner.levels.Warning.Printf("Backup complete with failures for %d disk(s)\n", len(failedDisks))
+  }
+
+  if dryRun {
+    logger.Println("")
+    logger.Println("DRY RUN MODE: nothing has been created or deleted")
+  }
+
+  stopErr := runner.stopped(ctx)
+  if stopErr != nil {
+    completedDisks := make([]string, 0)
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      if !contains(failedDisks, disks[diskIndex].Name) {
+        completedDisks = append(completedDisks, disks[diskIndex].Name)
+      }
+    }
+    runner.levels.Warning.Println("")
+    runner.levels.Warning.Printf("Backup interrupted: %s\n", stopErr)
+    runner.levels.Warning.Printf("Completed disks: %s\n", strings.Join(completedDisks, ", "))
+    runner.levels.Warning.Printf("Not completed disks: %s\n", strings.Join(failedDisks, ", "))
+    return result, fmt.Errorf("%w: %w", ErrInterrupted, stopErr)
+  }
+
+  if len(failedDisks) > 0 {
+    return result, fmt.Errorf("%w for %d disk(s): %s", ErrDisksFailed, len(failedDisks), strings.Join(failedDisks, ", "))
+  }
+  instantErr := runner.instantError(result)
+  if instantErr != nil {
+    return result, instantErr
+  }
+
+  return result, runner.labelingError(result)
+}
@@ -0,0 +1,380 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "math/rand"
+  "sort"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestRunFull(t *testing.T) {
+  fake := newFakeRunner(t)
+  runner, _ := newTestRunner(fake, Options{})
+
+  result, err := runner.Run(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(result.Disks) != 2 || len(result.Created) != 2 || len(result.Failures) != 0 {
+    t.Fatalf("Got %d disks, %d snapshots created and the failures %v", len(result.Disks), len(result.Created), result.Failures)
+  }
+  // The limit of 2 with the new snapshot
+  if sortedNames(result.Deleted) != "db-data-1,db-data-2" {
+    t.Errorf("Got %s deleted, expected db-data-1,db-data-2", snapshotNames(result.Deleted))
+  }
+  if len(fake.ran("disks", "snapshot")) != 2 || len(fake.ran("snapshots", "delete")) != 2 {
+    t.Errorf("Got the commands %v", fake.commands)
+  }
+}
+
+func TestRunFailuresAggregated(t *testing.T) {
+  fake := newFakeRunner(t)
+  fake.fail(errors.New("exit status 1"), "disks", "snapshot", "db-data")
+  runner, _ := newTestRunner(fake, Options{})
+
+  result, err := runner.Run(context.Background())
+  // The failure of a disk doesn't stop the others
+  if !errors.Is(err, ErrDisksFailed) {
+    t.Fatalf("Got the error %v, expected %v", err, ErrDisksFailed)
+  }
+  if len(result.Failures) != 1 || result.Failures[0].Disk != "db-data" {
+    t.Fatalf("Got the failures %v", result.Failures)
+  }
+  if strings.Join(result.FailedDisks(), ",") != "db-data" || !strings.Contains(err.Error(), "db-data") {
+    t.Errorf("Got the failed disks %v and the error %v", result.FailedDisks(), err)
+  }
+  if len(result.Created) != 1 || !strings.HasPrefix(result.Created[0].Name, "shared-data-") {
+    t.Errorf("Got %s created, expected the snapshot of shared-data", snapshotNames(result.Created))
+  }
+}
+
+func TestRunListingError(t *testing.T) {
+  fake := newFakeRunner(t)
+  fake.fail(errors.New("exit status 1"), "compute", "disks", "list", "--format json(")
+  runner, _ := newTestRunner(fake, Options{})
+
+  result, err := runner.Run(context.Background())
+  // Returned rather than exiting
+  if err == nil || result.Listed {
+    t.Fatalf("Got the error %v, listed: %t", err, result.Listed)
+  }
+  if len(fake.ran("disks", "snapshot")) > 0 {
+    t.Errorf("Snapshots created without a listing")
+  }
+}
+
+func TestRunCreationsAttributedOutOfOrder(t *testing.T) {
+  tests := []struct {
+    name string
+    err  error
+  }{
+    {"created", nil},
+    {"failed", errors.New("exit status 1")},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    // The first disk is done last
+    fake.add(&fakeRule{parts: []string{"disks", "snapshot", "db-data"}, delay: 50 * time.Millisecond, err: test.err})
+    var mutex sync.Mutex
+    progressed := make(map[string]string)
+    runner, _ := newTestRunner(fake, Options{Mode: ModeBackup, Progress: func(progress DiskProgress) {
+      mutex.Lock()
+      defer mutex.Unlock()
+      progressed[progress.Snapshot] = progress.Disk.Name
+    }})
+
+    result, _ := runner.Run(context.Background())
+    expectedCreated := 2
+    if test.err != nil {
+      expectedCreated = 1
+      if len(result.Failures) != 1 || result.Failures[0].Disk != "db-data" || !strings.HasPrefix(result.Failures[0].Snapshot, "db-data-") {
+        t.Errorf("%s: got the failures %v", test.name, result.Failures)
+      }
+    }
+    if len(result.Created) != expectedCreated || !strings.HasPrefix(result.Created[0].Name, "shared-data-") {
+      t.Fatalf("%s: got %s created, the snapshot of shared-data first", test.name, snapshotNames(result.Created))
+    }
+    for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+      disk := result.Disks[diskIndex]
+      newest := disk.Snapshots[0].Name
+      if test.err == nil && !strings.HasPrefix(newest, disk.Name + "-" + disk.Id) {
+        t.Errorf("%s: disk %s got the snapshot %s", test.name, disk.Name, newest)
+      }
+    }
+    for snapshot, disk := range progressed {
+      if !strings.HasPrefix(snapshot, disk + "-") {
+        t.Errorf("%s: the snapshot %s was reported for disk %s", test.name, snapshot, disk)
+      }
+    }
+  }
+}
+
+func TestRunFailedCreationBlocksPrune(t *testing.T) {
+  tests := []struct {
+    name     string
+    options  Options
+    expected string
+  }{
+    {"pipeline", Options{Limit: 1, RetentionMode: RetentionCount}, "shared-data-1"},
+    {"phased", Options{Limit: 1, RetentionMode: RetentionCount, Phased: true}, "shared-data-1"},
+    {"prune on failure", Options{Limit: 1, RetentionMode: RetentionCount, PruneOnCreateFailure: true}, "db-data-1,db-data-2,shared-data-1"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.fail(errors.New("exit status 1"), "disks", "snapshot", "db-data")
+    runner, _ := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if !errors.Is(err, ErrDisksFailed) {
+      t.Errorf("%s: got the error %v", test.name, err)
+    }
+    if sortedNames(result.Deleted) != test.expected {
+      t.Errorf("%s: got %s deleted, expected %s", test.name, sortedNames(result.Deleted), test.expected)
+    }
+  }
+}
+
+func TestRunRegionalDisk(t *testing.T) {
+  fake := newFakeRunner(t)
+  runner, _ := newTestRunner(fake, Options{Mode: ModeBackup})
+
+  _, err := runner.Run(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  regional := fake.ran("disks", "snapshot", "shared-data")
+  zonal := fake.ran("disks", "snapshot", "db-data")
+  if len(regional) != 1 || argValue(regional[0], "--region") != "europe-west1" || argValue(regional[0], "--zone") != "" {
+    t.Errorf("Got the creations %v for the regional disk", regional)
+  }
+  if len(zonal) != 1 || argValue(zonal[0], "--zone") != "europe-west1-b" || argValue(zonal[0], "--region") != "" {
+    t.Errorf("Got the creations %v for the zonal disk", zonal)
+  }
+}
+
+func TestRunOperationTimeout(t *testing.T) {
+  tests := []struct {
+    name  string
+    parts []string
+    disk  string
+  }{
+    {"creation", []string{"disks", "snapshot", "db-data"}, "db-data"},
+    {"deletion", []string{"snapshots", "delete", "shared-data-1"}, "shared-data"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    // A hung gcloud
+    fake.add(&fakeRule{parts: test.parts, delay: time.Hour})
+    runner, _ := newTestRunner(fake, Options{Limit: 1, RetentionMode: RetentionCount, OperationTimeout: 50 * time.Millisecond})
+
+    started := time.Now()
+    result, err := runner.Run(context.Background())
+    if time.Since(started) > 10 * time.Second {
+      t.Fatalf("%s: the run waited for the hung command", test.name)
+    }
+    if !errors.Is(err, ErrDisksFailed) {
+      t.Errorf("%s: got the error %v", test.name, err)
+    }
+    if len(result.Failures) != 1 || result.Failures[0].Disk != test.disk || !errors.Is(result.Failures[0].Err, ErrTimedOut) {
+      t.Fatalf("%s: got the failures %v", test.name, result.Failures)
+    }
+    // The other disk goes on
+    if len(result.Created) == 0 {
+      t.Errorf("%s: nothing created", test.name)
+    }
+    summary := NewSummary(result, err)
+    if len(summary.Failures) != 1 || !summary.Failures[0].TimedOut {
+      t.Errorf("%s: got the failures %+v in the summary", test.name, summary.Failures)
+    }
+  }
+}
+
+func TestRunStopped(t *testing.T) {
+  tests := []struct {
+    name      string
+    // Closes the stop channel when run
+    parts     []string
+    created   string
+    completed string
+    failed    string
+  }{
+    {"during the listing", []string{"compute", "disks", "list", "--format json("}, "", "", "db-data, shared-data"},
+    // The most stale disk is snapshotted first
+    {"during a creation", []string{"disks", "snapshot", "shared-data"}, "shared-data", "shared-data", "db-data"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    stop := make(chan struct{})
+    output := ""
+    if test.created == "" {
+      output = readTestdata(t, "disks.json")
+    }
+    fake.add(&fakeRule{parts: test.parts, answer: func(args []string) ([]byte, error) {
+      close(stop)
+      return []byte(output), nil
+    }})
+    // A creation at a time, the disks in order
+    runner, logs := newTestRunner(fake, Options{Limit: 1, RetentionMode: RetentionCount, Concurrency: 1, Stop: stop})
+
+    result, err := runner.Run(context.Background())
+    if !errors.Is(err, ErrInterrupted) || !errors.Is(err, ErrStopped) {
+      t.Fatalf("%s: got the error %v, expected %v", test.name, err, ErrInterrupted)
+    }
+    // The operation in progress completes, no other one starts
+    creations := fake.ran("disks", "snapshot")
+    if test.created == "" && len(creations) > 0 || test.created != "" && (len(creations) != 1 || creations[0][4] != test.created) {
+      t.Errorf("%s: got the creations %v", test.name, creations)
+    }
+    if len(fake.ran("snapshots", "delete")) > 0 || len(result.Deleted) > 0 {
+      t.Errorf("%s: got the deletions %v once stopped", test.name, fake.ran("snapshots", "delete"))
+    }
+    if !strings.Contains(logs.String(), "\nCompleted disks: " + test.completed + "\n") {
+      t.Errorf("%s: no completed disks %s in the logs:\n%s", test.name, test.completed, logs)
+    }
+    // In the order of the failures, the stopped creations failing at once
+    notCompleted := ""
+    lines := strings.Split(logs.String(), "\n")
+    for lineIndex := 0; lineIndex < len(lines); lineIndex++ {
+      if names, found := strings.CutPrefix(lines[lineIndex], "Not completed disks: "); found {
+        sorted := strings.Split(names, ", ")
+        sort.Strings(sorted)
+        notCompleted = strings.Join(sorted, ", ")
+      }
+    }
+    if notCompleted != test.failed {
+      t.Errorf("%s: no disks %s not completed in the logs:\n%s", test.name, test.failed, logs)
+    }
+    if NewSummary(result, err).ExitCode != ExitInterrupted {
+      t.Errorf("%s: got the exit code %d, expected %d", test.name, NewSummary(result, err).ExitCode, ExitInterrupted)
+    }
+  }
+}
+
+func TestRunCancelled(t *testing.T) {
+  fake := newFakeRunner(t)
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  // Killed after the grace period
+  fake.add(&fakeRule{parts: []string{"disks", "snapshot", "shared-data"}, answer: func(args []string) ([]byte, error) {
+    cancel()
+    return nil, &CommandError{Args: args, Err: context.Canceled}
+  }})
+  runner, _ := newTestRunner(fake, Options{Concurrency: 1})
+
+  result, err := runner.Run(ctx)
+  if !errors.Is(err, ErrInterrupted) || !errors.Is(err, context.Canceled) {
+    t.Fatalf("Got the error %v, expected %v", err, ErrInterrupted)
+  }
+  if len(result.Created) > 0 || len(fake.ran("snapshots", "delete")) > 0 {
+    t.Errorf("Got %s created and the deletions %v once cancelled", snapshotNames(result.Created), fake.ran("snapshots", "delete"))
+  }
+}
+
+func TestGroupSnapshotsByDisk(t *testing.T) {
+  disks, snapshots := generatedFleet(3, 5, time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+  // As listed, in any order
+  rand.New(rand.NewSource(1)).Shuffle(len(snapshots), func(i int, j int) {
+    snapshots[i], snapshots[j] = snapshots[j], snapshots[i]
+  })
+
+  snapshotsByDisk := groupSnapshotsByDisk(snapshots)
+  if len(snapshotsByDisk) != len(disks) {
+    t.Fatalf("Got %d disks, expected %d", len(snapshotsByDisk), len(disks))
+  }
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    if snapshotNames(snapshotsByDisk[disk.Id]) != snapshotNames(disk.Snapshots) {
+      t.Errorf("Disk %s: got %s, expected %s newest first", disk.Name, snapshotNames(snapshotsByDisk[disk.Id]), snapshotNames(disk.Snapshots))
+    }
+  }
+}
+
+func BenchmarkGroupSnapshotsByDisk(b *testing.B) {
+  _, snapshots := generatedFleet(10000, 3, time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+  b.ResetTimer()
+  for benchIndex := 0; benchIndex < b.N; benchIndex++ {
+    groupSnapshotsByDisk(snapshots)
+  }
+}
+
+func TestRunSnapshotStatuses(t *testing.T) {
+  now := time.Now()
+  day := 24 * time.Hour
+  diskId := "1111111111111111111"
+  snapshots := []Snapshot{
+    testSnapshot("db-creating", diskId, now.Add(-time.Hour)),
+    testSnapshot("db-1", diskId, now.Add(-day)),
+    testSnapshot("db-2", diskId, now.Add(-2 * day)),
+    testSnapshot("db-failed", diskId, now.Add(-3 * day)),
+    testSnapshot("db-3", diskId, now.Add(-4 * day)),
+  }
+  snapshots[0].Status = "CREATING"
+  snapshots[3].Status = SnapshotFailed
+  tests := []struct {
+    name     string
+    options  Options
+    expected string
+  }{
+    // The snapshot being created doesn't push db-2 out
+    {"prune", Options{Mode: ModePrune}, "db-3"},
+    {"prune failed", Options{Mode: ModePrune, CleanupFailed: true}, "db-3,db-failed"},
+    // With the new snapshot
+    {"pipeline", Options{}, "db-2,db-3"},
+    {"pipeline failed", Options{CleanupFailed: true}, "db-2,db-3,db-failed"},
+    {"phased failed", Options{Phased: true, CleanupFailed: true}, "db-2,db-3,db-failed"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.listing(snapshots)
+    test.options.Disks = []string{"db-data"}
+    runner, _ := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if sortedNames(result.Deleted) != test.expected {
+      t.Errorf("%s: got %s deleted, expected %s", test.name, sortedNames(result.Deleted), test.expected)
+    }
+    summary := NewSummary(result, err)
+    statuses := summary.Disks[0].Statuses
+    if statuses == nil || statuses.Creating != 1 {
+      t.Errorf("%s: got the statuses %+v", test.name, statuses)
+    }
+  }
+}
+
+func TestRunInvalidDisksListing(t *testing.T) {
+  tests := []struct {
+    name   string
+    output string
+  }{
+    {"empty", ""},
+    {"truncated", `[{"name": "db-data", "id": "1111111111111111111"}, {"na`},
+    {"prompt", "Do you want to continue (Y/n)?"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.answer(test.output, "compute", "disks", "list", "--format json(")
+    runner, _ := newTestRunner(fake, Options{})
+
+    // Never taken for a project without disks
+    result, err := runner.Run(context.Background())
+    if err == nil || !strings.Contains(err.Error(), "Invalid JSON output") || result.Listed {
+      t.Errorf("%s: got the error %v, listed: %t", test.name, err, result.Listed)
+    }
+    if NewSummary(result, err).ExitCode != ExitListingFailure || len(fake.ran("disks", "snapshot")) > 0 {
+      t.Errorf("%s: got the exit code %d and the creations %v", test.name, NewSummary(result, err).ExitCode, fake.ran("disks", "snapshot"))
+    }
+  }
+}
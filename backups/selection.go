@@ -0,0 +1,362 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "regexp"
+  "strings"
+  "sync"
+)
+
+const (
+  // Label of the disks to never snapshot, with the value "false"
+  BackupLabel = "backup"
+)
+
+// ErrDisksNotFound is the error of the disk names matching no disk, with
+// StrictDisks.
+var ErrDisksNotFound = errors.New("Disks not found")
+
+// Skip is a disk found by the filter but not backed up.
+type Skip struct {
+  Disk   string
+  Reason string
+}
+
+// listDisksMatching lists the disks matching the filter, with a single
+// aggregated listing, or a listing by zone and region given in the options,
+// run in parallel with the concurrency limit.
+func (runner *Runner) listDisksMatching(ctx context.Context, filter string) ([]Disk, error) {
+  zones := runner.options.Zones
+  regions := runner.options.Regions
+  if len(zones) == 0 && len(regions) == 0 {
+    return runner.backend.GetDisksToSnapshot(ctx, filter)
+  }
+
+  type locationDisks struct {
+    location string
+    disks    []Disk
+    err      error
+  }
+  listings := make([]locationDisks, len(zones) + len(regions))
+  var listed sync.WaitGroup
+  list := func(listingIndex int, location string, getDisks func() ([]Disk, error)) {
+    defer listed.Done()
+    listings[listingIndex].location = location
+    if !runner.acquire(ctx) {
+      listings[listingIndex].err = runner.stopped(ctx)
+      return
+    }
+    defer runner.release()
+    listings[listingIndex].disks, listings[listingIndex].err = getDisks()
+  }
+  listed.Add(len(listings))
+  for zoneIndex := 0; zoneIndex < len(zones); zoneIndex++ {
+    zone := zones[zoneIndex]
+    go list(zoneIndex, "zone " + zone, func() ([]Disk, error) {
+      return runner.backend.GetZoneDisks(ctx, filter, zone)
+    })
+  }
+  for regionIndex := 0; regionIndex < len(regions); regionIndex++ {
+    region := regions[regionIndex]
+    go list(len(zones) + regionIndex, "region " + region, func() ([]Disk, error) {
+      return runner.backend.GetRegionDisks(ctx, filter, region)
+    })
+  }
+  listed.Wait()
+
+  // Merged in the order of the zones and regions, once by disk id
+  disks := make([]Disk, 0)
+  listedIds := make(map[string]bool)
+  for listingIndex := 0; listingIndex < len(listings); listingIndex++ {
+    listing := listings[listingIndex]
+    if listing.err != nil {
+      return nil, fmt.Errorf("Listing of the disks of %s: %w", listing.location, listing.err)
+    }
+    runner.logger.Printf("Listed %d disk(s) in %s matching '%s'\n", len(listing.disks), listing.location, filter)
+    for diskIndex := 0; diskIndex < len(listing.disks); diskIndex++ {
+      disk := listing.disks[diskIndex]
+      if !listedIds[disk.Id] {
+        listedIds[disk.Id] = true
+        disks = append(disks, disk)
+      }
+    }
+  }
+  return disks, nil
+}
+
+// getDisks lists the disks matching the filter, and the disks attached to the
+// instances matching the instance filter if any. A disk attached to several
+// instances, or matching both, is listed once.
+func (runner *Runner) getDisks(ctx context.Context, project string) ([]Disk, error) {
+  if runner.options.InstanceFilter == "" {
+    return runner.listDisksMatching(ctx, runner.options.Filter)
+  }
+
+  attached, err := runner.backend.ListAttachedDisks(ctx, runner.options.InstanceFilter)
+  if err != nil {
+    return nil, err
+  }
+  attachedKeys := make(map[string]bool)
+  for attachedIndex := 0; attachedIndex < len(attached); attachedIndex++ {
+    attachedDisk := attached[attachedIndex]
+    if attachedDisk.Project == "" {
+      attachedDisk.Project = project
+    }
+    attachedKeys[attachedDisk.Project + "/" + attachedDisk.Location + "/" + attachedDisk.Name] = true
+  }
+
+  disks := make([]Disk, 0)
+  listedIds := make(map[string]bool)
+  if runner.options.Filter != "" {
+    disks, err = runner.listDisksMatching(ctx, runner.options.Filter)
+    if err != nil {
+      return nil, err
+    }
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      listedIds[disks[diskIndex].Id] = true
+    }
+  }
+  if len(attachedKeys) == 0 {
+    runner.levels.Warning.Printf("WARNING: no disks attached to the instances matching '%s'\n", runner.options.InstanceFilter)
+    return disks, nil
+  }
+
+  // The attached disks are only known by name, their ids and labels are
+  // needed
+  allDisks, err := runner.listDisksMatching(ctx, "")
+  if err != nil {
+    return nil, err
+  }
+  attachedCount := 0
+  for diskIndex := 0; diskIndex < len(allDisks); diskIndex++ {
+    disk := allDisks[diskIndex]
+    diskProject := disk.Project
+    if diskProject == "" {
+      diskProject = project
+    }
+    if !attachedKeys[diskProject + "/" + disk.Location() + "/" + disk.Name] {
+      continue
+    }
+    attachedCount++
+    if !listedIds[disk.Id] {
+      listedIds[disk.Id] = true
+      disks = append(disks, disk)
+    }
+  }
+  runner.logger.Printf("Found %d disk(s) attached to the instances matching '%s'\n", attachedCount, runner.options.InstanceFilter)
+
+  return disks, nil
+}
+
+// ValidateDiskNames checks the disk names, as name or name:zone.
+func ValidateDiskNames(names []string) error {
+  for nameIndex := 0; nameIndex < len(names); nameIndex++ {
+    name, location, _ := strings.Cut(names[nameIndex], ":")
+    if name == "" || strings.Contains(location, ":") {
+      return fmt.Errorf("Invalid disk name '%s', use name or name:zone", names[nameIndex])
+    }
+  }
+  return nil
+}
+
+// matchesDiskName tells if the disk has the name, as name or name:zone (the
+// region of a regional disk).
+func matchesDiskName(disk Disk, name string) bool {
+  diskName, location, found := strings.Cut(name, ":")
+  return disk.Name == diskName && (!found || disk.Location() == location)
+}
+
+// matchDiskNames returns the disks having one of the names, and the names
+// matching none of them.
+func matchDiskNames(disks []Disk, names []string) ([]Disk, []string) {
+  matched := make([]Disk, 0, len(names))
+  matchedNames := make(map[string]bool)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    found := false
+    for nameIndex := 0; nameIndex < len(names); nameIndex++ {
+      if matchesDiskName(disks[diskIndex], names[nameIndex]) {
+        matchedNames[names[nameIndex]] = true
+        found = true
+      }
+    }
+    if found {
+      matched = append(matched, disks[diskIndex])
+    }
+  }
+  notFound := make([]string, 0)
+  for nameIndex := 0; nameIndex < len(names); nameIndex++ {
+    if !matchedNames[names[nameIndex]] {
+      notFound = append(notFound, names[nameIndex])
+    }
+  }
+  return matched, notFound
+}
+
+// checkDiskNames warns about the names matching no disk, or fails with
+// StrictDisks.
+func (runner *Runner) checkDiskNames(kind string, notFound []string) error {
+  if len(notFound) == 0 {
+    return nil
+  }
+  if runner.options.StrictDisks {
+    return fmt.Errorf("%w: %s matching no disk: %s", ErrDisksNotFound, kind, strings.Join(notFound, ", "))
+  }
+  runner.levels.Warning.Printf("WARNING: %s matching no disk: %s\n", kind, strings.Join(notFound, ", "))
+  return nil
+}
+
+// diskIds returns the set of the ids of the disks.
+func diskIds(disks []Disk) map[string]bool {
+  ids := make(map[string]bool, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    ids[disks[diskIndex].Id] = true
+  }
+  return ids
+}
+
+// ValidateNameRegex compiles the regular expression of the disk names, nil
+// if empty.
+func ValidateNameRegex(kind string, expression string) (*regexp.Regexp, error) {
+  if expression == "" {
+    return nil, nil
+  }
+  compiled, err := regexp.Compile(expression)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid %s '%s': %w", kind, expression, err)
+  }
+  return compiled, nil
+}
+
+// notSelected returns why the disk isn't selected by the names, the name
+// regex, the sizes or the types, if it isn't.
+func (runner *Runner) notSelected(disk Disk, namedIds map[string]bool) string {
+  options := runner.options
+  switch {
+  case namedIds != nil && !namedIds[disk.Id]:
+    return "not in the disk names"
+  case options.NameRegex != nil && !options.NameRegex.MatchString(disk.Name):
+    return "name not matching '" + options.NameRegex.String() + "'"
+  case options.MinSizeGb > 0 && disk.SizeGb < options.MinSizeGb:
+    return fmt.Sprintf("%d GB, less than %d GB", disk.SizeGb, options.MinSizeGb)
+  case options.MaxSizeGb > 0 && disk.SizeGb > options.MaxSizeGb:
+    return fmt.Sprintf("%d GB, more than %d GB", disk.SizeGb, options.MaxSizeGb)
+  case len(options.DiskTypes) > 0 && !contains(options.DiskTypes, NormalizeDiskType(disk.Type)):
+    diskType := disk.Type
+    if diskType == "" {
+      diskType = "unknown"
+    }
+    return "type " + diskType + " not in " + strings.Join(options.DiskTypes, ", ")
+  }
+  return ""
+}
+
+// diskDetails returns the size and the type of the disk, if known, like
+// " (100 GB, pd-ssd)".
+func diskDetails(disk Disk) string {
+  details := make([]string, 0, 2)
+  if disk.SizeGb > 0 {
+    details = append(details, fmt.Sprintf("%d GB", disk.SizeGb))
+  }
+  if disk.Type != "" {
+    details = append(details, disk.Type)
+  }
+  if len(details) == 0 {
+    return ""
+  }
+  return " (" + strings.Join(details, ", ") + ")"
+}
+
+// selectDisks keeps the disks of the names, of the name regex, of the sizes
+// and of the types, and skips the disks opted out with the backup=false
+// label, the excluded names, the disks of the exclude name regex and the ones
+// matching the exclude filter. The dry runs, and the verbose ones, log why
+// each disk is selected or not.
+func (runner *Runner) selectDisks(ctx context.Context, disks []Disk, result *Result) ([]Disk, error) {
+  // The names are looked for in the disks of the filter
+  var namedIds map[string]bool
+  if len(runner.options.Disks) > 0 {
+    named, notFound := matchDiskNames(disks, runner.options.Disks)
+    err := runner.checkDiskNames("disk names", notFound)
+    if err != nil {
+      return disks, err
+    }
+    namedIds = diskIds(named)
+  }
+  excludedNames, notFound := matchDiskNames(disks, runner.options.ExcludeDisks)
+  err := runner.checkDiskNames("excluded disk names", notFound)
+  if err != nil {
+    return disks, err
+  }
+  excludedNamed := diskIds(excludedNames)
+
+  excludedIds, err := runner.excludedDisks(ctx)
+  if err != nil {
+    return disks, err
+  }
+  return runner.selectListed(disks, namedIds, excludedNamed, excludedIds, result), nil
+}
+
+// excludedDisks returns the ids of the disks matching the exclude filter, if
+// any.
+func (runner *Runner) excludedDisks(ctx context.Context) (map[string]bool, error) {
+  excludedIds := make(map[string]bool)
+  if runner.options.ExcludeFilter == "" {
+    return excludedIds, nil
+  }
+  excludedDisks, err := runner.listDisksMatching(ctx, runner.options.ExcludeFilter)
+  if err != nil {
+    return nil, err
+  }
+  for diskIndex := 0; diskIndex < len(excludedDisks); diskIndex++ {
+    excludedIds[excludedDisks[diskIndex].Id] = true
+  }
+  return excludedIds, nil
+}
+
+// selectListed returns the disks selected, the ones of the names if namedIds
+// isn't nil, and skips the excluded ones, as selectDisks.
+func (runner *Runner) selectListed(disks []Disk, namedIds map[string]bool, excludedNamed map[string]bool, excludedIds map[string]bool, result *Result) []Disk {
+  logger := runner.logger
+  selection := runner.levels.Debug
+  selectionPrefix := ""
+  if runner.options.DryRun {
+    selection = logger
+    selectionPrefix = "[DRY-RUN] "
+  }
+  nameRegexExclude := runner.options.NameRegexExclude
+
+  selected := make([]Disk, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    // Like the filter, the selectors don't skip the disks
+    notSelected := runner.notSelected(disk, namedIds)
+    if notSelected != "" {
+      selection.Printf("%sDisk %s not selected: %s\n", selectionPrefix, disk.Name, notSelected)
+      continue
+    }
+
+    reason := ""
+    if disk.Labels[BackupLabel] == "false" {
+      reason = "label " + BackupLabel + "=false"
+    } else if excludedNamed[disk.Id] {
+      reason = "excluded by name"
+    } else if nameRegexExclude != nil && nameRegexExclude.MatchString(disk.Name) {
+      reason = "name matched exclude regex '" + nameRegexExclude.String() + "'"
+    } else if excludedIds[disk.Id] {
+      reason = "matched exclude filter"
+    } else if disk.Labels[DrillLabel] != "" {
+      reason = "temporary disk of a restore drill"
+    }
+    if reason != "" {
+      logger.Printf("Skipping disk %s: %s\n", disk.Name, reason)
+      result.Skipped = append(result.Skipped, Skip{Disk: disk.Name, Reason: reason})
+      continue
+    }
+    selection.Printf("%sDisk %s selected%s\n", selectionPrefix, disk.Name, diskDetails(disk))
+    selected = append(selected, disk)
+  }
+
+  return selected
+}
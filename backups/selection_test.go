@@ -0,0 +1,116 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestValidateDiskNames(t *testing.T) {
+  tests := []struct {
+    names []string
+    valid bool
+  }{
+    {nil, true},
+    {[]string{"db-data", "shared-data:europe-west1"}, true},
+    {[]string{":europe-west1-b"}, false},
+    {[]string{"db-data:europe-west1-b:extra"}, false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    err := ValidateDiskNames(test.names)
+    if (err == nil) != test.valid {
+      t.Errorf("%v: got %v", test.names, err)
+    }
+  }
+}
+
+func TestMatchDiskNames(t *testing.T) {
+  disks := []Disk{
+    {Name: "db-data", Id: "1", Zone: "europe-west1-b"},
+    {Name: "db-data", Id: "2", Zone: "europe-west1-c"},
+    {Name: "shared-data", Id: "3", Region: "europe-west1"},
+  }
+  tests := []struct {
+    name     string
+    names    []string
+    matched  string
+    notFound string
+  }{
+    {"name in all the zones", []string{"db-data"}, "1,2", ""},
+    {"name and zone", []string{"db-data:europe-west1-c"}, "2", ""},
+    {"name and region", []string{"shared-data:europe-west1"}, "3", ""},
+    {"other zone", []string{"db-data:us-central1-a", "shared-data"}, "3", "db-data:us-central1-a"},
+    {"unknown", []string{"logs"}, "", "logs"},
+    {"none", nil, "", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    matched, notFound := matchDiskNames(disks, test.names)
+    ids := make([]string, 0, len(matched))
+    for diskIndex := 0; diskIndex < len(matched); diskIndex++ {
+      ids = append(ids, matched[diskIndex].Id)
+    }
+    if strings.Join(ids, ",") != test.matched || strings.Join(notFound, ",") != test.notFound {
+      t.Errorf("%s: got the disks %v and the names %v not found, expected %s and %s", test.name, ids, notFound, test.matched, test.notFound)
+    }
+  }
+}
+
+func TestRunDiskNames(t *testing.T) {
+  tests := []struct {
+    name     string
+    options  Options
+    disks    string
+    skipped  string
+    warning  bool
+    err      error
+  }{
+    {"disks", Options{Disks: []string{"db-data"}}, "db-data", "", false, nil},
+    {"excluded disks", Options{ExcludeDisks: []string{"db-data:europe-west1-b"}}, "shared-data", "db-data", false, nil},
+    {"both", Options{Disks: []string{"db-data", "shared-data"}, ExcludeDisks: []string{"shared-data"}}, "db-data", "shared-data", false, nil},
+    {"unknown disk", Options{Disks: []string{"db-data", "logs"}}, "db-data", "", true, nil},
+    {"unknown excluded disk", Options{ExcludeDisks: []string{"logs"}}, "db-data,shared-data", "", true, nil},
+    {"strict", Options{Disks: []string{"db-data", "logs"}, StrictDisks: true}, "", "", false, ErrDisksNotFound},
+    {"strict excluded", Options{ExcludeDisks: []string{"db-data:europe-west1-c"}, StrictDisks: true}, "", "", false, ErrDisksNotFound},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    options := test.options
+    options.Mode = ModeBackup
+    runner, logs := newTestRunner(fake, options)
+
+    result, err := runner.Run(context.Background())
+    if test.err != nil {
+      if !errors.Is(err, test.err) {
+        t.Errorf("%s: got the error %v, expected %v", test.name, err, test.err)
+      }
+      if len(fake.ran("disks", "snapshot")) > 0 {
+        t.Errorf("%s: got the creations %v", test.name, fake.ran("disks", "snapshot"))
+      }
+      continue
+    }
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    names := make([]string, 0, len(result.Disks))
+    for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+      names = append(names, result.Disks[diskIndex].Name)
+    }
+    skipped := make([]string, 0, len(result.Skipped))
+    for skipIndex := 0; skipIndex < len(result.Skipped); skipIndex++ {
+      skipped = append(skipped, result.Skipped[skipIndex].Disk)
+    }
+    if strings.Join(names, ",") != test.disks || strings.Join(skipped, ",") != test.skipped {
+      t.Errorf("%s: got the disks %v and %v skipped, expected %s and %s", test.name, names, skipped, test.disks, test.skipped)
+    }
+    if len(fake.ran("disks", "snapshot")) != len(names) {
+      t.Errorf("%s: got the creations %v", test.name, fake.ran("disks", "snapshot"))
+    }
+    if strings.Contains(logs.String(), "matching no disk: logs") != test.warning {
+      t.Errorf("%s: got the logs\n%s", test.name, logs)
+    }
+  }
+}
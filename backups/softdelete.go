@@ -0,0 +1,120 @@
+package backups
+
+import (
+  "context"
+  "fmt"
+  "time"
+)
+
+// Layout of the time of the PendingDeleteLabel, in UTC: the label values
+// can't contain colons
+const pendingDeleteLayout = "20060102-150405"
+
+// PendingSince returns the time the snapshot was marked for deletion, if it
+// has a valid PendingDeleteLabel.
+func PendingSince(snapshot Snapshot) (time.Time, bool) {
+  value, found := snapshot.Labels[PendingDeleteLabel]
+  if !found {
+    return time.Time{}, false
+  }
+  since, err := time.Parse(pendingDeleteLayout, value)
+  return since, err == nil
+}
+
+type labelResult struct {
+  diskIndex int
+  snapshot  Snapshot
+  mark      bool
+  err       error
+}
+
+// markSnapshots marks the snapshots to delete of the disks with the
+// PendingDeleteLabel, and unmarks the marked snapshots which are kept by the
+// retention again. It returns the snapshots to delete which were marked for
+// longer than the deletion grace period, to delete now. The snapshots of the
+// blocked disks are left as they are.
+func (runner *Runner) markSnapshots(ctx context.Context, disks []Disk, candidates [][]Snapshot, pruneBlocked []bool, now time.Time, result *Result) [][]Snapshot {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+  grace := runner.options.DeletionGrace
+
+  expired := make([][]Snapshot, len(disks))
+  changes := make([]labelResult, 0)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if pruneBlocked[diskIndex] {
+      continue
+    }
+    toDelete := make(map[string]bool)
+    for candidateIndex := 0; candidateIndex < len(candidates[diskIndex]); candidateIndex++ {
+      candidate := candidates[diskIndex][candidateIndex]
+      toDelete[candidate.Name] = true
+      since, marked := PendingSince(candidate)
+      if !marked {
+        changes = append(changes, labelResult{diskIndex: diskIndex, snapshot: candidate, mark: true})
+      } else if !now.Before(since.Add(grace)) {
+        expired[diskIndex] = append(expired[diskIndex], candidate)
+      } else {
+        logger.Printf("Snapshot %s of disk %s marked for deletion since %s, deleted after %s\n", candidate.Name, disks[diskIndex].Name, since.Format(time.RFC3339), since.Add(grace).Format(time.RFC3339))
+      }
+    }
+    snapshots := disks[diskIndex].Snapshots
+    for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+      _, marked := snapshots[snapshotIndex].Labels[PendingDeleteLabel]
+      if marked && !toDelete[snapshots[snapshotIndex].Name] {
+        changes = append(changes, labelResult{diskIndex: diskIndex, snapshot: snapshots[snapshotIndex]})
+      }
+    }
+  }
+  if len(changes) == 0 {
+    return expired
+  }
+
+  mark := map[string]string{PendingDeleteLabel: now.UTC().Format(pendingDeleteLayout)}
+  labeled := make(chan labelResult, len(changes))
+  for changeIndex := 0; changeIndex < len(changes); changeIndex++ {
+    go func(change labelResult) {
+      if !runner.acquire(ctx) {
+        change.err = runner.stopped(ctx)
+        labeled <- change
+        return
+      }
+      defer runner.release()
+      operationCtx, cancel := runner.operationContext(ctx)
+      defer cancel()
+      if change.mark {
+        change.err = runner.backend.AddSnapshotLabels(operationCtx, change.snapshot, mark, dryRun)
+      } else {
+        change.err = runner.backend.RemoveSnapshotLabels(operationCtx, change.snapshot, []string{PendingDeleteLabel}, dryRun)
+      }
+      change.err = runner.operationError(ctx, operationCtx, change.err)
+      labeled <- change
+    }(changes[changeIndex])
+  }
+  for changeIndex := 0; changeIndex < len(changes); changeIndex++ {
+    change := <-labeled
+    disk := disks[change.diskIndex]
+    switch {
+    case change.err != nil && change.mark:
+      runner.levels.Warning.Printf("Failed to mark snapshot %s for deletion: %s\n", change.snapshot.Name, change.err)
+      result.Failures = append(result.Failures, Failure{Disk: disk.Name, Snapshot: change.snapshot.Name, Err: fmt.Errorf("Marking for deletion: %w", change.err)})
+    case change.err != nil:
+      runner.levels.Warning.Printf("Failed to unmark snapshot %s: %s\n", change.snapshot.Name, change.err)
+      result.Failures = append(result.Failures, Failure{Disk: disk.Name, Snapshot: change.snapshot.Name, Err: fmt.Errorf("Unmarking for deletion: %w", change.err)})
+    case change.mark:
+      result.Marked = append(result.Marked, change.snapshot)
+      if dryRun {
+        logger.Printf("[DRY-RUN] Would mark snapshot %s of disk %s for deletion after %s\n", change.snapshot.Name, disk.Name, grace)
+      } else {
+        logger.Printf("Marked snapshot %s of disk %s for deletion after %s\n", change.snapshot.Name, disk.Name, grace)
+      }
+    default:
+      result.Unmarked = append(result.Unmarked, change.snapshot)
+      if dryRun {
+        logger.Printf("[DRY-RUN] Would unmark snapshot %s of disk %s, kept by the retention again\n", change.snapshot.Name, disk.Name)
+      } else {
+        logger.Printf("Unmarked snapshot %s of disk %s, kept by the retention again\n", change.snapshot.Name, disk.Name)
+      }
+    }
+  }
+  return expired
+}
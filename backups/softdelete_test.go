@@ -0,0 +1,138 @@
+package backups
+
+import (
+  "context"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestPendingSince(t *testing.T) {
+  tests := []struct {
+    name     string
+    labels   map[string]string
+    since    time.Time
+    marked   bool
+  }{
+    {"marked", map[string]string{PendingDeleteLabel: "20261011-093000"}, time.Date(2026, 10, 11, 9, 30, 0, 0, time.UTC), true},
+    {"not marked", map[string]string{CreatedByLabel: CreatedByValue}, time.Time{}, false},
+    {"invalid", map[string]string{PendingDeleteLabel: "2026-10-11"}, time.Time{}, false},
+    {"empty", map[string]string{PendingDeleteLabel: ""}, time.Time{}, false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    since, marked := PendingSince(Snapshot{Name: "snap", Labels: test.labels})
+    if marked != test.marked || !since.Equal(test.since) {
+      t.Errorf("%s: got %s, marked %t", test.name, since, marked)
+    }
+  }
+}
+
+func TestMarkSnapshots(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  grace := 72 * time.Hour
+  marked := func(name string, since time.Time) Snapshot {
+    snapshot := testSnapshot(name, "1", now.Add(-10 * 24 * time.Hour))
+    snapshot.Labels[PendingDeleteLabel] = since.Format(pendingDeleteLayout)
+    return snapshot
+  }
+  unmarked := testSnapshot("unmarked", "1", now.Add(-10 * 24 * time.Hour))
+  invalid := testSnapshot("invalid", "1", now.Add(-10 * 24 * time.Hour))
+  invalid.Labels[PendingDeleteLabel] = "yesterday"
+  tests := []struct {
+    name       string
+    snapshots  []Snapshot
+    candidates []Snapshot
+    blocked    bool
+    dryRun     bool
+    // Returned to delete now
+    expired    string
+    marked     string
+    unmarked   string
+    log        string
+  }{
+    {"marked", []Snapshot{unmarked}, []Snapshot{unmarked}, false, false, "", "unmarked", "", "Marked snapshot unmarked of disk disk for deletion after 72h0m0s"},
+    {"within the grace", []Snapshot{marked("recent", now.Add(-grace + time.Second))}, []Snapshot{marked("recent", now.Add(-grace + time.Second))}, false, false, "", "", "", "Snapshot recent of disk disk marked for deletion since 2026-10-11T12:00:01Z, deleted after 2026-10-14T12:00:01Z"},
+    {"at the end of the grace", []Snapshot{marked("due", now.Add(-grace))}, []Snapshot{marked("due", now.Add(-grace))}, false, false, "due", "", "", ""},
+    {"after the grace", []Snapshot{marked("old", now.Add(-2 * grace))}, []Snapshot{marked("old", now.Add(-2 * grace))}, false, false, "old", "", "", ""},
+    // Marked again from now on
+    {"invalid mark", []Snapshot{invalid}, []Snapshot{invalid}, false, false, "", "invalid", "", "Marked snapshot invalid of disk disk"},
+    {"kept again", []Snapshot{marked("rescued", now.Add(-2 * grace))}, nil, false, false, "", "", "rescued", "Unmarked snapshot rescued of disk disk, kept by the retention again"},
+    {"blocked", []Snapshot{unmarked, marked("rescued", now.Add(-2 * grace))}, []Snapshot{unmarked}, true, false, "", "", "", ""},
+    {"dry run", []Snapshot{unmarked, marked("rescued", now.Add(-2 * grace))}, []Snapshot{unmarked}, false, true, "", "unmarked", "rescued", "[DRY-RUN] Would mark snapshot unmarked of disk disk for deletion after 72h0m0s"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    runner, logs := newTestRunner(fake, Options{DeletionGrace: grace, DryRun: test.dryRun})
+    disks := []Disk{{Name: "disk", Id: "1", Snapshots: test.snapshots}}
+    result := Result{}
+
+    expired := runner.markSnapshots(context.Background(), disks, [][]Snapshot{test.candidates}, []bool{test.blocked}, now, &result)
+    if snapshotNames(expired[0]) != test.expired {
+      t.Errorf("%s: got %s to delete, expected %s", test.name, snapshotNames(expired[0]), test.expired)
+    }
+    if snapshotNames(result.Marked) != test.marked || snapshotNames(result.Unmarked) != test.unmarked {
+      t.Errorf("%s: got %s marked and %s unmarked, expected %s and %s", test.name, snapshotNames(result.Marked), snapshotNames(result.Unmarked), test.marked, test.unmarked)
+    }
+    if test.log != "" && !containsLine(logs.String(), test.log) {
+      t.Errorf("%s: expected '%s' in:\n%s", test.name, test.log, logs)
+    }
+    // The labels are only changed out of the dry runs
+    labeled := fake.ran("compute", "snapshots", "add-labels", PendingDeleteLabel + "=" + now.Format(pendingDeleteLayout))
+    removed := fake.ran("compute", "snapshots", "remove-labels", PendingDeleteLabel)
+    if test.dryRun && len(labeled) + len(removed) > 0 || !test.dryRun && (len(labeled) != len(result.Marked) || len(removed) != len(result.Unmarked)) {
+      t.Errorf("%s: got the label commands %v and %v", test.name, labeled, removed)
+    }
+  }
+}
+
+func TestRunDeletionGrace(t *testing.T) {
+  now := time.Now()
+  diskId := "1111111111111111111"
+  tests := []struct {
+    name     string
+    // Of db-1 and db-2, the 2 oldest, none if zero
+    markedAt time.Time
+    options  Options
+    deleted  string
+    marked   string
+  }{
+    // Like the first run after an upgrade
+    {"first run", time.Time{}, Options{DeletionGrace: 72 * time.Hour}, "", "db-1,db-2"},
+    {"within the grace", now.Add(-time.Hour), Options{DeletionGrace: 72 * time.Hour}, "", ""},
+    {"after the grace", now.Add(-73 * time.Hour), Options{DeletionGrace: 72 * time.Hour}, "db-1,db-2", ""},
+    {"hard delete", time.Time{}, Options{}, "db-1,db-2", ""},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    snapshots := []Snapshot{
+      testSnapshot("db-1", diskId, now.Add(-3 * 24 * time.Hour)),
+      testSnapshot("db-2", diskId, now.Add(-4 * 24 * time.Hour)),
+      testSnapshot("db-3", diskId, now.Add(-24 * time.Hour)),
+    }
+    if !test.markedAt.IsZero() {
+      snapshots[0].Labels[PendingDeleteLabel] = test.markedAt.UTC().Format(pendingDeleteLayout)
+      snapshots[1].Labels[PendingDeleteLabel] = test.markedAt.UTC().Format(pendingDeleteLayout)
+    }
+    fake := newFakeRunner(t)
+    fake.listing(snapshots)
+    test.options.Disks = []string{"db-data"}
+    runner, _ := newTestRunner(fake, test.options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    if sortedNames(result.Deleted) != test.deleted || sortedNames(result.Marked) != test.marked {
+      t.Errorf("%s: got %s deleted and %s marked, expected %s and %s", test.name, sortedNames(result.Deleted), sortedNames(result.Marked), test.deleted, test.marked)
+    }
+    deletions := fake.ran("compute", "snapshots delete")
+    if len(deletions) != len(result.Deleted) || test.deleted == "" && len(deletions) > 0 {
+      t.Errorf("%s: got the deletions %v", test.name, deletions)
+    }
+    if len(result.Unmarked) != 0 || strings.Contains(sortedNames(result.Deleted), "db-3") {
+      t.Errorf("%s: got %s unmarked", test.name, snapshotNames(result.Unmarked))
+    }
+  }
+}
@@ -0,0 +1,54 @@
+package backups
+
+import (
+  "context"
+  "time"
+)
+
+// stampedDisk is the labeling of a disk with its last snapshot.
+type stampedDisk struct {
+  disk     Disk
+  snapshot string
+  err      error
+}
+
+// stampDisks labels the disks with the time and the name of the snapshot
+// created for them, with the concurrency of the snapshots. The disks without
+// a new snapshot are left alone. A failed labeling is only a warning, the
+// snapshot is there.
+func (runner *Runner) stampDisks(ctx context.Context, disks []Disk, createdNames []string, now time.Time) {
+  logger := runner.logger
+  dryRun := runner.options.DryRun
+
+  stamped := make(chan stampedDisk, len(disks))
+  stamps := 0
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    if createdNames[diskIndex] == "" {
+      continue
+    }
+    stamps++
+    go func(stamp stampedDisk) {
+      if !runner.acquire(ctx) {
+        stamp.err = runner.stopped(ctx)
+        stamped <- stamp
+        return
+      }
+      defer runner.release()
+      operationCtx, cancel := runner.operationContext(ctx)
+      defer cancel()
+      labels := map[string]string{LastBackupLabel: now.UTC().Format(lastBackupLayout), LastBackupSnapshotLabel: sanitizeLabel(stamp.snapshot)}
+      stamp.err = runner.operationError(ctx, operationCtx, runner.backend.AddDiskLabels(operationCtx, stamp.disk, labels, dryRun))
+      stamped <- stamp
+    }(stampedDisk{disk: disks[diskIndex], snapshot: createdNames[diskIndex]})
+  }
+  for stampIndex := 0; stampIndex < stamps; stampIndex++ {
+    stamp := <-stamped
+    if stamp.err != nil {
+      runner.levels.Warning.Printf("WARNING: failed to label disk %s with its last snapshot %s: %s\n", stamp.disk.Name, stamp.snapshot, stamp.err)
+    } else if dryRun {
+      logger.Printf("[DRY-RUN] Would label disk %s with its last snapshot %s\n", stamp.disk.Name, stamp.snapshot)
+    } else {
+      logger.Printf("Labeled disk %s with its last snapshot %s\n", stamp.disk.Name, stamp.snapshot)
+    }
+  }
+}
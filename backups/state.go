@@ -0,0 +1,264 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "sync"
+  "time"
+
+  "google.golang.org/api/option"
+  storage "google.golang.org/api/storage/v1"
+)
+
+const (
+  // The snapshot of the disk was created
+  PhaseCreated = "created"
+  PhaseCreateFailed = "create-failed"
+  // The old snapshots of the disk were deleted
+  PhasePruned = "pruned"
+  PhasePruneFailed = "prune-failed"
+)
+
+// DiskProgress is the outcome of a phase of a disk, reported by the runner.
+type DiskProgress struct {
+  Disk     Disk
+  Phase    string
+  Snapshot string
+  Err      error
+}
+
+// State is the progress of the runs of an invocation, to resume them.
+type State struct {
+  RunID       string      `json:"runId"`
+  StartedAt   time.Time   `json:"startedAt"`
+  UpdatedAt   time.Time   `json:"updatedAt"`
+  // Set when all the runs succeeded: there is nothing to resume
+  CompletedAt time.Time   `json:"completedAt,omitzero"`
+  Disks       []DiskState `json:"disks"`
+}
+
+// DiskState is the last phase of a disk in a run.
+type DiskState struct {
+  Plan     string `json:"plan,omitempty"`
+  Project  string `json:"project,omitempty"`
+  Id       string `json:"id"`
+  Name     string `json:"name"`
+  Phase    string `json:"phase"`
+  // Snapshot created by the run, kept by the next phases
+  Snapshot string `json:"snapshot,omitempty"`
+  Error    string `json:"error,omitempty"`
+}
+
+// NewRunID returns a new identifier of a run, starting with its time.
+func NewRunID(now time.Time) string {
+  randomBytes := make([]byte, 4)
+  rand.Read(randomBytes)
+  return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(randomBytes)
+}
+
+// Characters of the run ids given with --run-id, kept in a label
+var runIDRegexp = regexp.MustCompile(`^[-_a-zA-Z0-9]{1,63}$`)
+
+// ValidateRunID checks a run id which isn't generated by NewRunID.
+func ValidateRunID(runID string) error {
+  if !runIDRegexp.MatchString(runID) {
+    return fmt.Errorf("Invalid run id '%s', use up to 63 letters, digits, dashes and underscores", runID)
+  }
+  return nil
+}
+
+// NewState returns the state of a new run.
+func NewState(now time.Time) State {
+  return State{RunID: NewRunID(now), StartedAt: now, UpdatedAt: now, Disks: make([]DiskState, 0)}
+}
+
+// update sets the phase of the disk of the plan and project.
+func (state *State) update(plan string, project string, progress DiskProgress) {
+  diskState := DiskState{Plan: plan, Project: project, Id: progress.Disk.Id, Name: progress.Disk.Name, Phase: progress.Phase, Snapshot: progress.Snapshot}
+  if progress.Err != nil {
+    diskState.Error = progress.Err.Error()
+  }
+  for diskIndex := 0; diskIndex < len(state.Disks); diskIndex++ {
+    current := &state.Disks[diskIndex]
+    if current.Plan == plan && current.Project == project && current.Id == diskState.Id {
+      if diskState.Snapshot == "" {
+        diskState.Snapshot = current.Snapshot
+      }
+      *current = diskState
+      return
+    }
+  }
+  state.Disks = append(state.Disks, diskState)
+}
+
+// Created returns the snapshots created by the run for the plan and project,
+// by disk id.
+func (state State) Created(plan string, project string) map[string]string {
+  created := make(map[string]string)
+  for diskIndex := 0; diskIndex < len(state.Disks); diskIndex++ {
+    diskState := state.Disks[diskIndex]
+    if diskState.Plan == plan && diskState.Project == project && diskState.Phase != PhaseCreateFailed && diskState.Snapshot != "" {
+      created[diskState.Id] = diskState.Snapshot
+    }
+  }
+  return created
+}
+
+// ReadState reads the state from a local file or a gs://bucket/object URI.
+func ReadState(ctx context.Context, uri string) (State, error) {
+  var state State
+  var data []byte
+  var err error
+  if strings.HasPrefix(uri, "gs://") {
+    data, err = readGCS(ctx, uri)
+  } else {
+    data, err = os.ReadFile(uri)
+  }
+  if err != nil {
+    return state, err
+  }
+  err = json.Unmarshal(data, &state)
+  if err != nil {
+    return state, fmt.Errorf("Invalid state file %s: %w", uri, err)
+  }
+  if state.RunID == "" {
+    return state, fmt.Errorf("Invalid state file %s: no run id", uri)
+  }
+  return state, nil
+}
+
+// write writes the state to a local file, replaced at once, or to a
+// gs://bucket/object URI.
+func (state State) write(ctx context.Context, uri string) error {
+  data, err := json.MarshalIndent(state, "", "  ")
+  if err != nil {
+    return err
+  }
+  data = append(data, '\n')
+  if strings.HasPrefix(uri, "gs://") {
+    return writeGCS(ctx, uri, data, "application/json")
+  }
+  temporary, err := os.CreateTemp(filepath.Dir(uri), filepath.Base(uri) + ".*.tmp")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(temporary.Name())
+  _, err = temporary.Write(data)
+  if closeErr := temporary.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return err
+  }
+  return os.Rename(temporary.Name(), uri)
+}
+
+func readGCS(ctx context.Context, uri string) ([]byte, error) {
+  bucket, object, err := ParseGCSURI(uri)
+  if err != nil {
+    return nil, err
+  }
+  service, err := storage.NewService(ctx)
+  if err != nil {
+    return nil, err
+  }
+  response, err := service.Objects.Get(bucket, object).Context(ctx).Download()
+  if err != nil {
+    return nil, err
+  }
+  defer response.Body.Close()
+  var data bytes.Buffer
+  _, err = data.ReadFrom(response.Body)
+  return data.Bytes(), err
+}
+
+func writeGCS(ctx context.Context, uri string, data []byte, contentType string, options ...option.ClientOption) error {
+  bucket, object, err := ParseGCSURI(uri)
+  if err != nil {
+    return err
+  }
+  service, err := storage.NewService(ctx, options...)
+  if err != nil {
+    return err
+  }
+  _, err = service.Objects.Insert(bucket, &storage.Object{Name: object, ContentType: contentType}).Media(bytes.NewReader(data)).Context(ctx).Do()
+  return err
+}
+
+// Minimum interval between the writes of a state to GCS, which limits the
+// writes of an object to about one per second
+const gcsStateInterval = 2 * time.Second
+
+// StateRecorder writes the progress of the runs to the state file, as they
+// go. The writes to GCS are throttled, the last progress is written by
+// Complete.
+type StateRecorder struct {
+  uri       string
+  // Nothing is written, e.g. for a dry run
+  readOnly  bool
+  logger    *log.Logger
+  mutex     sync.Mutex
+  state     State
+  written   time.Time
+}
+
+// NewStateRecorder records the progress over the state.
+func NewStateRecorder(uri string, state State, readOnly bool, logger *log.Logger) *StateRecorder {
+  if logger == nil {
+    logger = log.Default()
+  }
+  return &StateRecorder{uri: uri, state: state, readOnly: readOnly, logger: logger}
+}
+
+// State returns the current state.
+func (recorder *StateRecorder) State() State {
+  recorder.mutex.Lock()
+  defer recorder.mutex.Unlock()
+  return recorder.state
+}
+
+// Record sets the phase of the disk of the plan and project, and writes the
+// state. A failing write only logs a warning.
+func (recorder *StateRecorder) Record(plan string, project string, progress DiskProgress) {
+  recorder.mutex.Lock()
+  defer recorder.mutex.Unlock()
+  recorder.state.update(plan, project, progress)
+  if strings.HasPrefix(recorder.uri, "gs://") && time.Since(recorder.written) < gcsStateInterval {
+    return
+  }
+  recorder.write()
+}
+
+// Complete writes the last progress, marking the runs as completed if they
+// succeeded.
+func (recorder *StateRecorder) Complete(succeeded bool) {
+  recorder.mutex.Lock()
+  defer recorder.mutex.Unlock()
+  if succeeded {
+    recorder.state.CompletedAt = time.Now()
+  }
+  recorder.write()
+}
+
+func (recorder *StateRecorder) write() {
+  if recorder.readOnly {
+    return
+  }
+  recorder.state.UpdatedAt = time.Now()
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+  defer cancel()
+  err := recorder.state.write(ctx, recorder.uri)
+  recorder.written = time.Now()
+  if err != nil {
+    recorder.logger.Printf("WARNING: failed to write the state file: %s\n", err)
+  }
+}
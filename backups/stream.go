@@ -0,0 +1,401 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "sync"
+  "time"
+)
+
+// Disks listed by page with Options.Stream, the snapshots of each page being
+// listed at once
+const streamPageSize = refreshBatchSize
+
+// streamedPage is a page of the disks listed with Options.Stream, with their
+// snapshots once listed.
+type streamedPage struct {
+  disks    []Disk
+  // Of the disks whose snapshots couldn't be listed, removed from the page
+  failures []Failure
+  // The listing failed, the disks listed so far are the last ones
+  err      error
+}
+
+// diskLaunch is a disk handed to the creations, with its index.
+type diskLaunch struct {
+  diskIndex int
+  disk      Disk
+}
+
+// streamNames matches the disk names page by page: the names matching no
+// disk are only known once all the pages are listed.
+type streamNames struct {
+  names    []string
+  notFound []string
+}
+
+func newStreamNames(names []string) *streamNames {
+  return &streamNames{names: names, notFound: names}
+}
+
+// match returns the ids of the disks of the page having one of the names.
+func (streamNames *streamNames) match(disks []Disk) map[string]bool {
+  matched, _ := matchDiskNames(disks, streamNames.names)
+  _, streamNames.notFound = matchDiskNames(disks, streamNames.notFound)
+  return diskIds(matched)
+}
+
+// validateStream checks the options can be used with Stream: the ones which
+// need all the disks before the first creation can't.
+func (runner *Runner) validateStream(mode string) error {
+  options := runner.options
+  if mode != ModeFull || options.Phased {
+    return errors.New("The streamed listing is only for the full mode, without phases")
+  }
+  incompatible := ""
+  switch {
+  case options.GroupByInstance:
+    incompatible = "the groups by instance"
+  case options.MaxCreations > 0:
+    incompatible = "the max creations"
+  case options.StrictDisks:
+    incompatible = "the strict disk names"
+  case options.QuotaBehavior == "" || options.QuotaBehavior == QuotaAbort:
+    incompatible = "the abort quota behavior"
+  }
+  if incompatible != "" {
+    return fmt.Errorf("The streamed listing can't be used with %s: all the disks are needed before the first creation", incompatible)
+  }
+  return nil
+}
+
+// releasesSnapshots tells if streamDisks releases the snapshots listed of each
+// page once counted, so the memory doesn't grow with the snapshots of the
+// fleet: the disks are listed again before their prune anyway, unless
+// NoRefresh, and the confirmation doesn't list them all at the end.
+func (runner *Runner) releasesSnapshots() bool {
+  options := runner.options
+  return options.Stream && !options.NoRefresh && (options.Confirm == nil || options.DryRun)
+}
+
+// releaseSnapshots drops the snapshots listed of the disk, but the one which
+// tells the type of its new snapshot, if any, and returns the count of the
+// ones dropped.
+func (runner *Runner) releaseSnapshots(disk *Disk, now time.Time) int {
+  released := len(disk.Snapshots)
+  retention := runner.retention(*disk)
+  monthly := -1
+  if retention.MonthlyType != "" && retention.KeepMonthly > 0 {
+    monthly = monthlySnapshot(disk.Snapshots, retention.MonthlyType, now)
+  }
+  if monthly < 0 {
+    disk.Snapshots = nil
+    return released
+  }
+  disk.Snapshots = []Snapshot{disk.Snapshots[monthly]}
+  return released - 1
+}
+
+// streamDisks lists the disks by page, then the snapshots of each page in a
+// single listing, and snapshots each disk as soon as its page is listed, with
+// Options.Stream. The order and the snapshot quota apply page by page. Once
+// all the disks are listed, the pipeline is started with the deletions
+// planned for all the disks, counted page by page, and prunes the disks
+// snapshotted so far, then the next ones once snapshotted. If
+// releasesSnapshots, the snapshots listed are released once counted, and the
+// ones listed again once pruned. It returns the disks, the ones whose old
+// snapshots must be kept and the pipeline, nil without disks. When the
+// listing fails, the creations started are waited for, none is pruned and the
+// error is returned.
+func (runner *Runner) streamDisks(ctx context.Context, result *Result) ([]Disk, []bool, *prunePipeline, error) {
+  logger := runner.logger
+  options := runner.options
+  pretty := options.Pretty
+  started := time.Now()
+  listingCtx, cancelListing := context.WithCancel(ctx)
+  defer cancelListing()
+
+  excludedIds, err := runner.excludedDisks(ctx)
+  if err != nil {
+    return nil, nil, nil, err
+  }
+  var named *streamNames
+  if len(options.Disks) > 0 {
+    named = newStreamNames(options.Disks)
+  }
+  excluded := newStreamNames(options.ExcludeDisks)
+  quota, quotaFound := runner.readQuota(ctx, result)
+  quotaLeft := quota.Limit - quota.Usage
+  if quotaFound {
+    logger.Printf("Snapshot quota: %d of %d used, checked as the disks are listed\n", quota.Usage, quota.Limit)
+  }
+
+  logger.Println("Each disk is snapshotted once its snapshots are listed")
+  if !pretty {
+    logger.Println("Disks and snapshots found:")
+  }
+  listed := make(chan streamedPage)
+  go func() {
+    defer close(listed)
+    // By the pages of the backend, unless the disks come from several listings
+    streamer, streams := runner.backend.(DiskStreamer)
+    if streams && len(options.Zones) == 0 && len(options.Regions) == 0 && options.InstanceFilter == "" {
+      err := streamer.StreamDisks(listingCtx, options.Filter, streamPageSize, func(disks []Disk) error {
+        select {
+        case listed <- streamedPage{disks: disks}:
+          return nil
+        case <-listingCtx.Done():
+          return listingCtx.Err()
+        }
+      })
+      if err != nil {
+        listed <- streamedPage{err: err}
+      }
+      return
+    }
+    disks, err := runner.getDisks(listingCtx, result.Project)
+    if err != nil {
+      listed <- streamedPage{err: err}
+      return
+    }
+    for start := 0; start < len(disks); start += streamPageSize {
+      listed <- streamedPage{disks: disks[start:min(start + streamPageSize, len(disks))]}
+    }
+  }()
+  snapshotsListed := make(chan streamedPage)
+  listSnapshots := func(disks []Disk) {
+    page := streamedPage{disks: disks}
+    if !runner.acquire(listingCtx) {
+      for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+        page.failures = append(page.failures, Failure{Disk: disks[diskIndex].Name, Err: fmt.Errorf("Listing of the snapshots: %w", runner.stopped(ctx))})
+      }
+      page.disks = nil
+      snapshotsListed <- page
+      return
+    }
+    snapshots, err := runner.disksSnapshots(listingCtx, disks)
+    runner.release()
+    snapshotsByDisk := groupSnapshotsByDisk(snapshots)
+    if err != nil && (options.FailFast || listingCtx.Err() != nil) {
+      page.err = err
+    } else if err != nil {
+      runner.levels.Warning.Printf("WARNING: failed to list the snapshots of %d disk(s), listing them disk by disk: %s\n", len(disks), err)
+      var pageResult Result
+      page.disks, snapshotsByDisk = runner.listSnapshotsByDisk(listingCtx, disks, &pageResult)
+      page.failures = pageResult.Failures
+    }
+    for diskIndex := 0; diskIndex < len(page.disks); diskIndex++ {
+      page.disks[diskIndex].Snapshots = snapshotsByDisk[page.disks[diskIndex].Id]
+      if page.disks[diskIndex].Snapshots == nil {
+        page.disks[diskIndex].Snapshots = make([]Snapshot, 0)
+      }
+    }
+    snapshotsListed <- page
+  }
+
+  logger.Println("Creating snapshots...")
+  launches := make(chan diskLaunch)
+  snapshotsCreated := make(chan snapshotResult, streamPageSize)
+  go func() {
+    // Nothing waits for the creations of a burst here
+    var burst sync.WaitGroup
+    for launch := range launches {
+      acquired := runner.acquire(ctx)
+      burst.Add(1)
+      go runner.createDisk(ctx, launch.diskIndex, launch.disk, "", acquired, &burst, snapshotsCreated)
+    }
+  }()
+
+  created := &creations{runner: runner, disks: make([]Disk, 0), createdNames: make([]string, 0), pruneBlocked: make([]bool, 0), result: result}
+  // Disks to snapshot, and the ones whose creation is collected
+  toCreate := make([]bool, 0)
+  collected := make([]bool, 0)
+  snapshots := 0
+  // By disk, for the deletion limits of the pipeline: the snapshots released
+  // and the deletions planned
+  release := runner.releasesSnapshots()
+  released := make([]int, 0)
+  planned := make([]int, 0)
+  var pipeline *prunePipeline
+  // Collected before the pipeline is started, pruned once started
+  waiting := make([]int, 0)
+  collect := func(snapshotCreated snapshotResult) {
+    diskIndex := snapshotCreated.diskIndex
+    created.collect(snapshotCreated)
+    collected[diskIndex] = true
+    if pipeline != nil {
+      pipeline.prune(diskIndex, created.disks[diskIndex], created.pruneBlocked[diskIndex], created.createdNames[diskIndex])
+    } else {
+      waiting = append(waiting, diskIndex)
+    }
+  }
+  quotaReached := false
+  schedule := func(disks []Disk) {
+    first := len(created.disks)
+    for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+      disk := disks[diskIndex]
+      snapshots += len(disk.Snapshots)
+      created.disks = append(created.disks, disk)
+      created.createdNames = append(created.createdNames, "")
+      created.pruneBlocked = append(created.pruneBlocked, false)
+      toCreate = append(toCreate, false)
+      collected = append(collected, false)
+      runner.emit(diskEvent(EventDiskDiscovered, disk, "", time.Time{}, nil))
+      if !pretty {
+        runner.logListedDisk(first + diskIndex, disk)
+      }
+    }
+    if pretty {
+      logDisksTable(logger, created.disks[first:], time.Now(), options.Color)
+    }
+    notDue := runner.notDueDisks(created.disks[first:], time.Now(), result)
+    page := make([]int, 0, len(disks))
+    for diskIndex := first; diskIndex < len(created.disks); diskIndex++ {
+      page = append(page, diskIndex)
+    }
+    page = runner.orderDisks(created.disks, page)
+    for pageIndex := 0; pageIndex < len(page); pageIndex++ {
+      diskIndex := page[pageIndex]
+      resumed, isResumed := options.Resumed[created.disks[diskIndex].Id]
+      switch {
+      case isResumed:
+        collect(snapshotResult{diskIndex: diskIndex, snapshot: Snapshot{Name: resumed}, resumed: true})
+      case notDue[diskIndex - first]:
+        collect(snapshotResult{diskIndex: diskIndex, notDue: true})
+      case quotaFound && quotaLeft <= 0:
+        if !quotaReached {
+          runner.levels.Warning.Printf("WARNING: the snapshot quota is reached, the next disks are not snapshotted\n")
+          quotaReached = true
+        }
+        collect(snapshotResult{diskIndex: diskIndex, err: ErrQuotaExceeded})
+      default:
+        quotaLeft--
+        toCreate[diskIndex] = true
+      }
+    }
+    now := time.Now()
+    plannedPage, _ := runner.plannedDeletions(created.disks[first:], toCreate[first:], make([]bool, len(disks)), now)
+    for diskIndex := first; diskIndex < len(created.disks); diskIndex++ {
+      planned = append(planned, len(plannedPage[diskIndex - first]))
+      released = append(released, 0)
+      if release {
+        released[diskIndex] = runner.releaseSnapshots(&created.disks[diskIndex], now)
+      }
+    }
+  }
+  startPipeline := func() {
+    result.Listed = true
+    if named != nil {
+      runner.checkDiskNames("disk names", named.notFound)
+    }
+    runner.checkDiskNames("excluded disk names", excluded.notFound)
+    logger.Printf("Listed %d disk(s) and %d snapshot(s) in %s\n", len(created.disks), snapshots, time.Since(started).Round(time.Millisecond))
+    if len(created.disks) == 0 {
+      return
+    }
+    // As startPipeline, without the snapshots released
+    total := 0
+    plannedCount := 0
+    for diskIndex := 0; diskIndex < len(created.disks); diskIndex++ {
+      total += released[diskIndex] + len(created.disks[diskIndex].Snapshots)
+      if toCreate[diskIndex] && !collected[diskIndex] {
+        total++
+      }
+      if !created.pruneBlocked[diskIndex] {
+        plannedCount += planned[diskIndex]
+      }
+    }
+    pipeline = runner.newPipeline(ctx, len(created.disks), total, plannedCount)
+    if release {
+      pipeline.listed = released
+      pipeline.released = make(map[string]ReleasedSnapshots)
+    }
+    for waitingIndex := 0; waitingIndex < len(waiting); waitingIndex++ {
+      diskIndex := waiting[waitingIndex]
+      pipeline.prune(diskIndex, created.disks[diskIndex], created.pruneBlocked[diskIndex], created.createdNames[diskIndex])
+    }
+  }
+
+  // In the order of the pages, then of the disks of each page
+  queue := make([]int, 0)
+  listings := 0
+  creating := 0
+  listingDone := false
+  var streamErr error
+  fail := func(err error) {
+    if streamErr == nil {
+      streamErr = err
+      cancelListing()
+    }
+    // The disks not launched yet are not snapshotted
+    queue = queue[:0]
+  }
+  for !listingDone || listings > 0 || len(queue) > 0 || creating > 0 {
+    var launch chan<- diskLaunch
+    var next diskLaunch
+    if len(queue) > 0 {
+      launch = launches
+      next = diskLaunch{diskIndex: queue[0], disk: created.disks[queue[0]]}
+    }
+    select {
+    case page, open := <-listed:
+      if !open {
+        listed = nil
+        listingDone = true
+        if listings == 0 && streamErr == nil {
+          startPipeline()
+        }
+        continue
+      }
+      if page.err != nil {
+        fail(page.err)
+      }
+      if streamErr != nil {
+        continue
+      }
+      for diskIndex := 0; diskIndex < len(page.disks); diskIndex++ {
+        if page.disks[diskIndex].Project == "" {
+          page.disks[diskIndex].Project = result.Project
+        }
+      }
+      var namedIds map[string]bool
+      if named != nil {
+        namedIds = named.match(page.disks)
+      }
+      disks := runner.checkSchedules(runner.selectListed(page.disks, namedIds, excluded.match(page.disks), excludedIds, result), result)
+      if len(disks) > 0 {
+        listings++
+        go listSnapshots(disks)
+      }
+    case page := <-snapshotsListed:
+      listings--
+      result.Failures = append(result.Failures, page.failures...)
+      if page.err != nil {
+        fail(page.err)
+      }
+      if streamErr == nil {
+        first := len(created.disks)
+        schedule(page.disks)
+        for diskIndex := first; diskIndex < len(created.disks); diskIndex++ {
+          if toCreate[diskIndex] {
+            queue = append(queue, diskIndex)
+          }
+        }
+      }
+      if listingDone && listings == 0 && streamErr == nil {
+        startPipeline()
+      }
+    case launch <- next:
+      queue = queue[1:]
+      creating++
+    case snapshotCreated := <-snapshotsCreated:
+      creating--
+      collect(snapshotCreated)
+    }
+  }
+  close(launches)
+  result.Disks = created.disks
+  created.finish(ctx)
+  return created.disks, created.pruneBlocked, pipeline, streamErr
+}
@@ -0,0 +1,318 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "runtime"
+  "sort"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestRunStream(t *testing.T) {
+  tests := []struct {
+    name    string
+    options Options
+    created string
+    deleted string
+  }{
+    {"all", Options{}, "db-data,shared-data", "db-data-1,db-data-2"},
+    {"disk names", Options{Disks: []string{"db-data", "missing"}}, "db-data", "db-data-1,db-data-2"},
+    {"excluded names", Options{ExcludeDisks: []string{"db-data"}}, "shared-data", ""},
+    {"dry run", Options{DryRun: true}, "db-data,shared-data", "db-data-1,db-data-2"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    // The same outcome as without Stream
+    for _, stream := range []bool{false, true} {
+      fake := newFakeRunner(t)
+      test.options.Stream = stream
+      test.options.QuotaBehavior = QuotaPartial
+      runner, logs := newTestRunner(fake, test.options)
+
+      result, err := runner.Run(context.Background())
+      if err != nil {
+        t.Fatalf("%s: %s", test.name, err)
+      }
+      created := make([]string, 0)
+      for createdIndex := 0; createdIndex < len(result.Created); createdIndex++ {
+        // As disk-id-timestamp
+        prefix := strings.SplitN(result.Created[createdIndex].Name, "-20", 2)[0]
+        created = append(created, prefix[:strings.LastIndex(prefix, "-")])
+      }
+      sort.Strings(created)
+      if strings.Join(created, ",") != test.created || sortedNames(result.Deleted) != test.deleted {
+        t.Errorf("%s, stream %t: got %v created and %s deleted, expected %s and %s", test.name, stream, created, sortedNames(result.Deleted), test.created, test.deleted)
+      }
+      if !result.Listed || len(result.Disks) != len(strings.Split(test.created, ",")) {
+        t.Errorf("%s, stream %t: got the disks %+v", test.name, stream, result.Disks)
+      }
+      if len(test.options.Disks) > 1 && !containsLine(logs.String(), "WARNING: disk names matching no disk: missing") {
+        t.Errorf("%s, stream %t: the missing name not logged in:\n%s", test.name, stream, logs)
+      }
+    }
+  }
+}
+
+func TestRunStreamCreatesWhileListing(t *testing.T) {
+  disks, snapshots := generatedFleet(120, 3, time.Now().Add(-time.Hour))
+  last := disks[len(disks) - 1].Id
+  fake := newFakeRunner(t)
+  fake.answer(disksJSON(disks), "compute", "disks", "list", "--format json(")
+  fake.listing(snapshots)
+  listed := snapshotsJSON(snapshots)
+  // The snapshots of the last page are listed once the other disks are
+  // snapshotted
+  var mutex sync.Mutex
+  creationsBefore := -1
+  fake.add(&fakeRule{parts: []string{"compute", "snapshots", "list", last}, wait: fake.afterCreations(100), answer: func(args []string) ([]byte, error) {
+    mutex.Lock()
+    defer mutex.Unlock()
+    if creationsBefore < 0 {
+      creationsBefore = len(fake.ran("compute", "disks", "snapshot"))
+    }
+    return filterSnapshotsJSON(listed, argValue(args, "--filter"))
+  }})
+  runner, _ := newTestRunner(fake, Options{Stream: true, QuotaBehavior: QuotaPartial, Concurrency: 200})
+
+  result, err := runner.Run(context.Background())
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The 100 disks of the first 2 pages
+  if creationsBefore != 100 {
+    t.Errorf("Got %d creations before the last page was listed, expected 100", creationsBefore)
+  }
+  if len(result.Created) != 120 || len(result.Deleted) != 240 {
+    t.Errorf("Got %d created and %d deleted, expected 120 and 240", len(result.Created), len(result.Deleted))
+  }
+  listings := fake.ran("compute", "snapshots", "list", "sourceDiskId = (")
+  for listingIndex := 0; listingIndex < len(listings); listingIndex++ {
+    ids := strings.Fields(strings.Trim(strings.TrimPrefix(argValue(listings[listingIndex], "--filter"), "sourceDiskId = "), "()"))
+    if len(ids) > streamPageSize {
+      t.Errorf("Got %d disks listed at once, more than %d", len(ids), streamPageSize)
+    }
+  }
+}
+
+func TestRunStreamReleased(t *testing.T) {
+  summaries := make([]Summary, 0)
+  costs := make([]CostReport, 0)
+  for _, stream := range []bool{false, true} {
+    fake := newFakeRunner(t)
+    runner, _ := newTestRunner(fake, Options{Stream: stream, QuotaBehavior: QuotaPartial, PricePerGbMonth: DefaultPricePerGbMonth, CostLabel: CreatedByLabel})
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatal(err)
+    }
+    costs = append(costs, *result.Cost)
+    if !stream {
+      summaries = append(summaries, NewSummary(result, err))
+      continue
+    }
+    // Only the created and deleted snapshots are left, the other ones counted
+    for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+      disk := result.Disks[diskIndex]
+      expected := 1
+      if disk.Name == "db-data" {
+        expected = 3
+      }
+      if len(disk.Snapshots) != expected {
+        t.Errorf("Disk %s: got the snapshots %s, expected %d", disk.Name, snapshotNames(disk.Snapshots), expected)
+      }
+    }
+    if len(result.Released) != 2 {
+      t.Errorf("Got the released disks %v", result.Released)
+    }
+    summaries = append(summaries, NewSummary(result, err))
+  }
+  // The same summary as without Stream
+  for diskIndex := 0; diskIndex < len(summaries[0].Disks); diskIndex++ {
+    expected := summaries[0].Disks[diskIndex]
+    got := summaries[1].Disks[diskIndex]
+    if got.Name != expected.Name || (got.Created == "") != (expected.Created == "") || strings.Join(got.Deleted, ",") != strings.Join(expected.Deleted, ",") || got.Statuses == nil || *got.Statuses != *expected.Statuses || got.Storage == nil || *got.Storage != *expected.Storage {
+      t.Errorf("Got the disk %+v, expected %+v", got, expected)
+    }
+  }
+  if costs[1].Total != costs[0].Total || fmt.Sprint(costs[1].ByLabel) != fmt.Sprint(costs[0].ByLabel) {
+    t.Errorf("Got the cost %+v, expected %+v", costs[1], costs[0])
+  }
+}
+
+func TestRunStreamConfirm(t *testing.T) {
+  for _, answer := range []bool{true, false} {
+    fake := newFakeRunner(t)
+    confirmed := make([]string, 0)
+    options := Options{Stream: true, QuotaBehavior: QuotaPartial, Confirm: func(snapshots int, disks int) bool {
+      confirmed = append(confirmed, fmt.Sprintf("%d/%d/%d", snapshots, len(fake.ran("disks", "snapshot")), len(fake.ran("snapshots", "delete"))))
+      return answer
+    }}
+    runner, _ := newTestRunner(fake, options)
+
+    result, err := runner.Run(context.Background())
+    if err != nil {
+      t.Fatal(err)
+    }
+    // Once all the disks are snapshotted, before any deletion
+    deleted := ""
+    if answer {
+      deleted = "db-data-1,db-data-2"
+    }
+    if strings.Join(confirmed, ",") != "2/2/0" || len(result.Created) != 2 || sortedNames(result.Deleted) != deleted {
+      t.Errorf("Answer %t: got the confirmations %v, %d created and %s deleted", answer, confirmed, len(result.Created), sortedNames(result.Deleted))
+    }
+  }
+}
+
+func TestRunStreamRejected(t *testing.T) {
+  tests := []struct {
+    name    string
+    options Options
+  }{
+    {"phased", Options{Phased: true, QuotaBehavior: QuotaPartial}},
+    {"backup mode", Options{Mode: ModeBackup, QuotaBehavior: QuotaPartial}},
+    {"prune mode", Options{Mode: ModePrune, QuotaBehavior: QuotaPartial}},
+    {"group by instance", Options{GroupByInstance: true, QuotaBehavior: QuotaPartial}},
+    {"max creations", Options{MaxCreations: 1, QuotaBehavior: QuotaPartial}},
+    {"strict disks", Options{StrictDisks: true, QuotaBehavior: QuotaPartial}},
+    {"quota abort", Options{QuotaBehavior: QuotaAbort}},
+    {"default quota behavior", Options{}},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    test.options.Stream = true
+    runner, _ := newTestRunner(fake, test.options)
+
+    _, err := runner.Run(context.Background())
+    if err == nil || !strings.HasPrefix(err.Error(), "The streamed listing") {
+      t.Errorf("%s: got the error %v", test.name, err)
+    }
+    if len(fake.commands) > 0 {
+      t.Errorf("%s: got the commands %v", test.name, fake.commands)
+    }
+  }
+}
+
+func TestRunStreamListingFailure(t *testing.T) {
+  listingErr := errors.New("listing failed")
+  disks, snapshots := generatedFleet(120, 3, time.Now().Add(-time.Hour))
+  tests := []struct {
+    name    string
+    // Fails the parts, and FailFast
+    parts   []string
+    failFast bool
+    created int
+  }{
+    {"disks", []string{"compute", "disks", "list", "--format json("}, false, 0},
+    // Once the disks of the first 2 pages are snapshotted
+    {"snapshots of a page", []string{"compute", "snapshots", "list", disks[len(disks) - 1].Id}, true, 100},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    fake := newFakeRunner(t)
+    fake.answer(disksJSON(disks), "compute", "disks", "list", "--format json(")
+    fake.listing(snapshots)
+    rule := &fakeRule{parts: test.parts, err: listingErr}
+    if test.created > 0 {
+      rule.wait = fake.afterCreations(test.created)
+    }
+    fake.add(rule)
+    runner, _ := newTestRunner(fake, Options{Stream: true, QuotaBehavior: QuotaPartial, Concurrency: 200, FailFast: test.failFast})
+
+    result, err := runner.Run(context.Background())
+    if !errors.Is(err, listingErr) {
+      t.Errorf("%s: got the error %v", test.name, err)
+    }
+    if len(result.Created) != test.created || len(fake.ran("compute", "snapshots delete")) > 0 {
+      t.Errorf("%s: got %d created, expected %d, and the deletions %v", test.name, len(result.Created), test.created, fake.ran("compute", "snapshots delete"))
+    }
+  }
+}
+
+// BenchmarkRunStream runs a dry run on 10000 disks of 3 snapshots, reporting
+// the time to the first creation: without Stream, once all the disks and
+// snapshots are decoded and planned, with Stream once the first page is.
+func BenchmarkRunStream(b *testing.B) {
+  disks, snapshots := generatedFleet(10000, 3, time.Now().Add(-time.Hour))
+  for _, stream := range []bool{false, true} {
+    b.Run(fmt.Sprintf("stream %t", stream), func(b *testing.B) {
+      fake := newFakeRunner(b)
+      fake.answer(disksJSON(disks), "compute", "disks", "list", "--format json(")
+      fake.listing(snapshots)
+      var firstCreation time.Duration
+      for benchIndex := 0; benchIndex < b.N; benchIndex++ {
+        var once sync.Once
+        started := time.Now()
+        events := func(event Event) {
+          if event.Type == EventCreateStarted {
+            once.Do(func() {
+              firstCreation += time.Since(started)
+            })
+          }
+        }
+        runner, _ := newTestRunner(fake, Options{Stream: stream, QuotaBehavior: QuotaPartial, DryRun: true, Concurrency: 100, Logger: discardLogger(), Events: events})
+        result, err := runner.Run(context.Background())
+        if err != nil || len(result.Created) != len(disks) {
+          b.Fatalf("Got %d created, %v", len(result.Created), err)
+        }
+      }
+      b.ReportMetric(float64(firstCreation.Milliseconds()) / float64(b.N), "first-creation-ms/op")
+    })
+  }
+}
+
+// BenchmarkRunStreamMemory runs on generated fleets of 30 snapshots per disk,
+// a snapshot created and one deleted by disk, reporting the peak of the heap
+// during the run. Without Stream, all the snapshots are held until the end;
+// with Stream, they are released once counted, then once pruned. Run it with
+// -bench RunStreamMemory -benchtime 1x.
+func BenchmarkRunStreamMemory(b *testing.B) {
+  for _, disks := range []int{1000, 10000} {
+    for _, stream := range []bool{false, true} {
+      b.Run(fmt.Sprintf("%d disks, stream %t", disks, stream), func(b *testing.B) {
+        fleet := fleetRunner{disks: disks, snapshots: 30, now: time.Now().Add(-time.Hour)}
+        var peak uint64
+        for benchIndex := 0; benchIndex < b.N; benchIndex++ {
+          runtime.GC()
+          var stats runtime.MemStats
+          runtime.ReadMemStats(&stats)
+          baseline := stats.HeapAlloc
+          done := make(chan struct{})
+          sampled := make(chan uint64)
+          go func() {
+            var highest uint64
+            ticker := time.NewTicker(5 * time.Millisecond)
+            defer ticker.Stop()
+            for {
+              var stats runtime.MemStats
+              runtime.ReadMemStats(&stats)
+              highest = max(highest, stats.HeapAlloc)
+              select {
+              case <-done:
+                sampled <- highest
+                return
+              case <-ticker.C:
+              }
+            }
+          }()
+          runner := NewRunner(Options{Commands: fleet, Project: "proj", Stream: stream, QuotaBehavior: QuotaPartial, Concurrency: 100, Limit: 30, RetentionMode: RetentionCount, PricePerGbMonth: DefaultPricePerGbMonth, Logger: discardLogger()})
+          result, err := runner.Run(context.Background())
+          close(done)
+          highest := <-sampled
+          if err != nil || len(result.Created) != disks || len(result.Deleted) != disks {
+            b.Fatalf("Got %d created and %d deleted, %v", len(result.Created), len(result.Deleted), err)
+          }
+          if highest > baseline {
+            peak += highest - baseline
+          }
+        }
+        b.ReportMetric(float64(peak) / float64(b.N) / 1e6, "peak-heap-MB")
+      })
+    }
+  }
+}
@@ -0,0 +1,636 @@
+package backups
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+const (
+  // Everything went well
+  ExitOK = 0
+  // Some disks failed
+  ExitPartialFailure = 1
+  // Nothing could be listed, e.g. not authenticated
+  ExitListingFailure = 2
+  // Another run holds the lock
+  ExitLocked = 3
+  // Stopped by SIGINT or SIGTERM before the end
+  ExitInterrupted = 4
+  // Invalid flags or config file, nothing was run
+  ExitUsage = 6
+)
+
+const (
+  // Snapshot created with a guest flush
+  ConsistencyApplication = "application"
+  ConsistencyCrash = "crash"
+)
+
+// Summary is the outcome of a run, for the logs and the wrapper scripts.
+type Summary struct {
+  // Name of the plan of the config file, if any
+  Plan             string           `json:"plan,omitempty"`
+  // Id of the run, shared by the plans and projects of an invocation
+  RunID            string           `json:"runId,omitempty"`
+  // ModeFull, ModeBackup, ModePrune, ModeVerify or ModeDrill
+  Mode             string           `json:"mode"`
+  Project          string           `json:"project"`
+  Filter           string           `json:"filter"`
+  DryRun           bool             `json:"dryRun"`
+  StartedAt        time.Time        `json:"startedAt"`
+  DurationSeconds  float64          `json:"durationSeconds"`
+  DisksScanned     int              `json:"disksScanned"`
+  SnapshotsCreated int              `json:"snapshotsCreated"`
+  SnapshotsReady   int              `json:"snapshotsReady"`
+  // Total size of the disks snapshotted
+  SizeGbSnapshotted int64           `json:"sizeGbSnapshotted"`
+  SnapshotsDeleted int              `json:"snapshotsDeleted"`
+  // Marked for a deletion after the grace period, or unmarked as they are
+  // kept again
+  SnapshotsMarked  int              `json:"snapshotsMarked"`
+  SnapshotsUnmarked int             `json:"snapshotsUnmarked"`
+  // Old snapshots kept as images or disks were created from them
+  SnapshotsReferenced int           `json:"snapshotsReferenced"`
+  // Kept by the backup-hold or hold-until label
+  SnapshotsHeld    int              `json:"snapshotsHeld"`
+  // Kept as their expires label is invalid
+  InvalidExpiry    []string         `json:"invalidExpiry,omitempty"`
+  // Kept by --min-keep, the retention would delete them
+  SnapshotsMinKept int              `json:"snapshotsMinKept"`
+  MinKept          []string         `json:"minKept,omitempty"`
+  // Copies of the created snapshots and old copies deleted, with
+  // --copy-to-location
+  CopyLocation     string           `json:"copyLocation,omitempty"`
+  SnapshotsCopied  int              `json:"snapshotsCopied,omitempty"`
+  CopiesDeleted    int              `json:"copiesDeleted,omitempty"`
+  // Instant snapshots created and deleted, and their failures, which are not
+  // failures of the disks, with --instant-snapshots
+  InstantCreated   int              `json:"instantCreated,omitempty"`
+  InstantDeleted   int              `json:"instantDeleted,omitempty"`
+  InstantFailures  []SummaryFailure `json:"instantFailures,omitempty"`
+  // Snapshots of the deleted disks, with --orphans
+  Orphans          []Orphan         `json:"orphans,omitempty"`
+  // Disks managed by a snapshot schedule resource policy, the other ones are
+  // managed by this program
+  Scheduled        []ScheduledDisk  `json:"scheduled,omitempty"`
+  // Age of the newest snapshot of each disk, with the verify subcommand
+  Compliance       []DiskCompliance `json:"compliance,omitempty"`
+  // Restores of the newest snapshots, and the leftover disks of the crashed
+  // drills deleted, with the drill subcommand
+  Drills           []DrillResult    `json:"drills,omitempty"`
+  DrillLeftovers   []string         `json:"drillLeftovers,omitempty"`
+  // Storage of the snapshots and its estimated cost, with a price
+  Cost             *CostReport      `json:"cost,omitempty"`
+  Disks            []DiskSummary    `json:"disks"`
+  FailedDisks      []string         `json:"failedDisks"`
+  Failures         []SummaryFailure `json:"failures"`
+  Skipped          []Skip           `json:"skipped"`
+  // Disks not snapshotted as no snapshot was due, with the backup-frequency
+  // label
+  NotDue           []Skip           `json:"notDue,omitempty"`
+  // Disks neither snapshotted nor pruned beyond --max-creations, left to a
+  // next run
+  Deferred         []Skip           `json:"deferred,omitempty"`
+  // Disks neither backed up nor opted out, with --enforce-labeling
+  Violations       []Violation      `json:"violations,omitempty"`
+  // Snapshots created together by instance, with --group-by-instance
+  Groups           []SnapshotGroup  `json:"groups,omitempty"`
+  // Snapshot quota of the project before and after the run, if checked
+  Quota            *QuotaUsage      `json:"quota,omitempty"`
+  // Creations and deletions of the snapshots, with their durations
+  Operations       []SummaryOperation `json:"operations,omitempty"`
+  Error            string           `json:"error,omitempty"`
+  ExitCode         int              `json:"exitCode"`
+  // Errors of the failing notifications, which don't change the exit code
+  NotificationErrors []string       `json:"notificationErrors,omitempty"`
+}
+
+// DiskSummary is the outcome of a run for one disk.
+type DiskSummary struct {
+  Name     string   `json:"name"`
+  Project  string   `json:"project"`
+  Zone     string   `json:"zone"`
+  Region   string   `json:"region,omitempty"`
+  SizeGb   int64    `json:"sizeGb,omitempty"`
+  Type     string   `json:"type,omitempty"`
+  // Instances the disk is attached to
+  Instances []string `json:"instances,omitempty"`
+  // Name of the snapshot created, if any
+  Created  string   `json:"created,omitempty"`
+  // Storage location of the snapshot created, if known
+  StorageLocation string `json:"storageLocation,omitempty"`
+  // ConsistencyApplication or ConsistencyCrash, if a snapshot was created
+  Consistency     string `json:"consistency,omitempty"`
+  // SnapshotStandard or SnapshotArchive, if the type of the snapshot created
+  // was set
+  SnapshotType    string `json:"snapshotType,omitempty"`
+  Deleted  []string `json:"deleted"`
+  // Snapshots marked for deletion by the run
+  Marked   []string `json:"marked,omitempty"`
+  // Snapshots kept by the backup-hold or hold-until label
+  Held     []string `json:"held,omitempty"`
+  // Snapshots of the disk by status, only the ready ones count in the
+  // retention
+  Statuses *SnapshotStatuses `json:"snapshotStatuses,omitempty"`
+  // Copy of the snapshot created, with --copy-to-location
+  Copy     *SnapshotCopy `json:"copy,omitempty"`
+  // Name of the instant snapshot created, with --instant-snapshots
+  Instant  string   `json:"instant,omitempty"`
+  // Snapshot schedule resource policies of the disk, also snapshotting it
+  Policies []string `json:"policies,omitempty"`
+  // Storage of the snapshots of the disk, with a price
+  Storage  *StorageCost `json:"storage,omitempty"`
+  // Sum of the storage of the snapshots deleted, if known
+  StorageBytesFreed int64 `json:"storageBytesFreed,omitempty"`
+  // Durations of the creation of the snapshot, of the wait for READY with
+  // --wait, and of the deletions of the snapshots
+  CreateSeconds   float64 `json:"createSeconds,omitempty"`
+  ReadySeconds    float64 `json:"readySeconds,omitempty"`
+  DeleteSeconds   float64 `json:"deleteSeconds,omitempty"`
+  Failed   bool     `json:"failed"`
+}
+
+type SummaryFailure struct {
+  Disk     string `json:"disk"`
+  Snapshot string `json:"snapshot,omitempty"`
+  Error    string `json:"error"`
+  // The operation reached the operation timeout
+  TimedOut bool   `json:"timedOut,omitempty"`
+}
+
+// NewSummary summarizes the result and the error returned by Runner.Run.
+func NewSummary(result Result, err error) Summary {
+  summary := Summary{
+    Mode: result.Mode,
+    RunID: result.RunID,
+    Project: result.Project,
+    Filter: result.Filter,
+    DryRun: result.DryRun,
+    StartedAt: result.StartedAt,
+    DurationSeconds: result.Duration.Seconds(),
+    DisksScanned: len(result.Disks),
+    SnapshotsCreated: len(result.Created),
+    SnapshotsReady: len(result.Ready),
+    SnapshotsDeleted: len(result.Deleted),
+    SnapshotsMarked: len(result.Marked),
+    SnapshotsUnmarked: len(result.Unmarked),
+    SnapshotsReferenced: len(result.Referenced),
+    SnapshotsHeld: len(result.Held),
+    InvalidExpiry: make([]string, 0, len(result.InvalidExpiry)),
+    SnapshotsMinKept: len(result.MinKept),
+    CopiesDeleted: len(result.CopiesDeleted),
+    InstantCreated: len(result.InstantCreated),
+    InstantDeleted: len(result.InstantDeleted),
+    Orphans: result.Orphans,
+    Scheduled: result.Scheduled,
+    Compliance: result.Compliance,
+    Drills: result.Drills,
+    DrillLeftovers: result.DrillLeftovers,
+    Cost: result.Cost,
+    FailedDisks: result.FailedDisks(),
+    Failures: make([]SummaryFailure, 0, len(result.Failures)),
+    Skipped: result.Skipped,
+    NotDue: result.NotDue,
+    Deferred: result.Deferred,
+    Violations: result.Violations,
+    Groups: result.Groups,
+    Quota: result.Quota,
+    ExitCode: ExitOK,
+  }
+  if len(result.Operations) > 0 {
+    summary.Operations = summaryOperations(result.Operations)
+  }
+  if summary.Skipped == nil {
+    summary.Skipped = make([]Skip, 0)
+  }
+  for failureIndex := 0; failureIndex < len(result.Failures); failureIndex++ {
+    failure := result.Failures[failureIndex]
+    summary.Failures = append(summary.Failures, SummaryFailure{Disk: failure.Disk, Snapshot: failure.Snapshot, Error: failure.Err.Error(), TimedOut: errors.Is(failure.Err, ErrTimedOut)})
+  }
+  for failureIndex := 0; failureIndex < len(result.InstantFailures); failureIndex++ {
+    failure := result.InstantFailures[failureIndex]
+    summary.InstantFailures = append(summary.InstantFailures, SummaryFailure{Disk: failure.Disk, Snapshot: failure.Snapshot, Error: failure.Err.Error(), TimedOut: errors.Is(failure.Err, ErrTimedOut)})
+  }
+  instants := make(map[string]string)
+  for snapshotIndex := 0; snapshotIndex < len(result.InstantCreated); snapshotIndex++ {
+    instants[result.InstantCreated[snapshotIndex].SourceDiskId] = result.InstantCreated[snapshotIndex].Name
+  }
+  copies := make(map[string]*SnapshotCopy)
+  for copyIndex := 0; copyIndex < len(result.Copies); copyIndex++ {
+    snapshotCopy := result.Copies[copyIndex]
+    copies[snapshotCopy.Disk] = &snapshotCopy
+    summary.CopyLocation = snapshotCopy.Location
+    if snapshotCopy.Status == SnapshotReady {
+      summary.SnapshotsCopied++
+    }
+  }
+  for snapshotIndex := 0; snapshotIndex < len(result.InvalidExpiry); snapshotIndex++ {
+    snapshot := result.InvalidExpiry[snapshotIndex]
+    summary.InvalidExpiry = append(summary.InvalidExpiry, snapshot.Name + " (" + ExpiresLabel + "=" + snapshot.Labels[ExpiresLabel] + ")")
+  }
+  for snapshotIndex := 0; snapshotIndex < len(result.MinKept); snapshotIndex++ {
+    snapshot := result.MinKept[snapshotIndex]
+    if snapshot.SourceDisk == "" {
+      summary.MinKept = append(summary.MinKept, snapshot.Name)
+    } else {
+      summary.MinKept = append(summary.MinKept, snapshot.Name + " (" + snapshot.SourceDisk + ")")
+    }
+  }
+
+  // The created snapshots are added to the snapshots of their disk, and the
+  // deleted ones are still there
+  created := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Created); snapshotIndex++ {
+    created[result.Created[snapshotIndex].Name] = true
+  }
+  deleted := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Deleted); snapshotIndex++ {
+    deleted[result.Deleted[snapshotIndex].Name] = true
+  }
+  marked := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Marked); snapshotIndex++ {
+    marked[result.Marked[snapshotIndex].Name] = true
+  }
+  held := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(result.Held); snapshotIndex++ {
+    held[result.Held[snapshotIndex].Name] = true
+  }
+  operations := make(map[string][]SummaryOperation)
+  for operationIndex := 0; operationIndex < len(summary.Operations); operationIndex++ {
+    operation := summary.Operations[operationIndex]
+    operations[operation.Disk] = append(operations[operation.Disk], operation)
+  }
+  summary.Disks = make([]DiskSummary, 0, len(result.Disks))
+  for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+    disk := result.Disks[diskIndex]
+    diskSummary := DiskSummary{Name: disk.Name, Project: disk.Project, Zone: disk.Zone, Region: disk.Region, SizeGb: disk.SizeGb, Type: disk.Type, Instances: disk.Users, Deleted: make([]string, 0), Copy: copies[disk.Name], Instant: instants[disk.Id], Policies: disk.ResourcePolicies, Failed: contains(summary.FailedDisks, disk.Name)}
+    for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+      name := disk.Snapshots[snapshotIndex].Name
+      if created[name] {
+        diskSummary.Created = name
+        diskSummary.StorageLocation = disk.Snapshots[snapshotIndex].StorageLocation
+        diskSummary.SnapshotType = disk.Snapshots[snapshotIndex].SnapshotType
+        diskSummary.Consistency = ConsistencyCrash
+        if disk.Snapshots[snapshotIndex].GuestFlush {
+          diskSummary.Consistency = ConsistencyApplication
+        }
+      }
+      if deleted[name] {
+        diskSummary.Deleted = append(diskSummary.Deleted, name)
+        diskSummary.StorageBytesFreed += disk.Snapshots[snapshotIndex].StorageBytes
+      }
+      if marked[name] {
+        diskSummary.Marked = append(diskSummary.Marked, name)
+      }
+      if held[name] {
+        diskSummary.Held = append(diskSummary.Held, name)
+      }
+    }
+    counted, released := result.Released[disk.Id]
+    if released && counted.Statuses != (SnapshotStatuses{}) {
+      diskSummary.Statuses = &counted.Statuses
+    } else if len(disk.Snapshots) > 0 {
+      statuses := countStatuses(disk.Snapshots)
+      diskSummary.Statuses = &statuses
+    }
+    diskOperations := operations[disk.Name]
+    for operationIndex := 0; operationIndex < len(diskOperations); operationIndex++ {
+      if diskOperations[operationIndex].Kind == OperationCreate {
+        diskSummary.CreateSeconds = diskOperations[operationIndex].DurationSeconds
+        diskSummary.ReadySeconds = diskOperations[operationIndex].ReadySeconds
+      } else {
+        diskSummary.DeleteSeconds += diskOperations[operationIndex].DurationSeconds
+      }
+    }
+    if diskSummary.Created != "" {
+      summary.SizeGbSnapshotted += disk.SizeGb
+    }
+    if result.Cost != nil && released {
+      diskSummary.Storage = &counted.Storage
+    } else if result.Cost != nil {
+      storage := SnapshotsCost(disk.Snapshots, result.Cost.Prices())
+      diskSummary.Storage = &storage
+    }
+    summary.Disks = append(summary.Disks, diskSummary)
+  }
+
+  if err != nil {
+    summary.Error = err.Error()
+    summary.ExitCode = ExitPartialFailure
+    if !result.Listed {
+      summary.ExitCode = ExitListingFailure
+    }
+    if errors.Is(err, ErrInterrupted) {
+      summary.ExitCode = ExitInterrupted
+    }
+  }
+
+  return summary
+}
+
+// Log prints the summary.
+func (summary Summary) Log(logger *log.Logger) {
+  logger.Println("")
+  if summary.Plan != "" {
+    logger.Printf("Summary of plan %s:\n", summary.Plan)
+  } else {
+    logger.Println("Summary:")
+  }
+  logger.Printf("  Disks scanned:     %d\n", summary.DisksScanned)
+  if summary.Mode == ModeVerify {
+    summary.logCompliance(logger)
+    return
+  }
+  if summary.Mode == ModeDrill {
+    summary.logDrills(logger)
+    return
+  }
+  logger.Printf("  Disks skipped:     %d\n", len(summary.Skipped))
+  for skipIndex := 0; skipIndex < len(summary.Skipped); skipIndex++ {
+    logger.Printf("    - %s: %s\n", summary.Skipped[skipIndex].Disk, summary.Skipped[skipIndex].Reason)
+  }
+  if len(summary.NotDue) > 0 {
+    logger.Printf("  Disks not due:     %d\n", len(summary.NotDue))
+    for notDueIndex := 0; notDueIndex < len(summary.NotDue); notDueIndex++ {
+      logger.Printf("    - %s: %s\n", summary.NotDue[notDueIndex].Disk, summary.NotDue[notDueIndex].Reason)
+    }
+  }
+  if len(summary.Deferred) > 0 {
+    logger.Printf("  Disks deferred:    %d\n", len(summary.Deferred))
+    for deferredIndex := 0; deferredIndex < len(summary.Deferred); deferredIndex++ {
+      logger.Printf("    - %s: %s\n", summary.Deferred[deferredIndex].Disk, summary.Deferred[deferredIndex].Reason)
+    }
+  }
+  if len(summary.Scheduled) > 0 {
+    toolManaged := summary.DisksScanned
+    logger.Printf("  Policy-managed:    %d\n", len(summary.Scheduled))
+    for scheduledIndex := 0; scheduledIndex < len(summary.Scheduled); scheduledIndex++ {
+      scheduled := summary.Scheduled[scheduledIndex]
+      if scheduled.Skipped {
+        logger.Printf("    - %s: %s (skipped)\n", scheduled.Disk, strings.Join(scheduled.Policies, ", "))
+      } else {
+        toolManaged--
+        logger.Printf("    - %s: %s (also snapshotted)\n", scheduled.Disk, strings.Join(scheduled.Policies, ", "))
+      }
+    }
+    logger.Printf("  Tool-managed:      %d\n", toolManaged)
+  }
+  if summary.Mode != ModePrune {
+    logger.Printf("  Snapshots created: %d (%d verified READY)\n", summary.SnapshotsCreated, summary.SnapshotsReady)
+    logger.Printf("  Size snapshotted:  %d GB\n", summary.SizeGbSnapshotted)
+  }
+  if summary.InstantCreated > 0 {
+    logger.Printf("  Instant created:   %d\n", summary.InstantCreated)
+  }
+  if summary.CopyLocation != "" {
+    logger.Printf("  Snapshots copied:  %d to %s\n", summary.SnapshotsCopied, summary.CopyLocation)
+    copies := make([]SnapshotCopy, 0)
+    for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+      if summary.Disks[diskIndex].Copy != nil {
+        copies = append(copies, *summary.Disks[diskIndex].Copy)
+      }
+    }
+    lines := copiesSummary(copies)
+    for lineIndex := 0; lineIndex < len(lines); lineIndex++ {
+      logger.Printf("    - %s\n", lines[lineIndex])
+    }
+  }
+  if summary.Mode != ModeBackup {
+    logger.Printf("  Snapshots deleted: %d\n", summary.SnapshotsDeleted)
+    if summary.SnapshotsMarked > 0 || summary.SnapshotsUnmarked > 0 {
+      logger.Printf("  Snapshots marked:  %d (%d unmarked)\n", summary.SnapshotsMarked, summary.SnapshotsUnmarked)
+    }
+    if summary.SnapshotsReferenced > 0 {
+      logger.Printf("  Snapshots in use:  %d (kept)\n", summary.SnapshotsReferenced)
+    }
+    if summary.SnapshotsMinKept > 0 {
+      logger.Printf("  Kept (min keep):   %d, deletions prevented\n", summary.SnapshotsMinKept)
+      for snapshotIndex := 0; snapshotIndex < len(summary.MinKept); snapshotIndex++ {
+        logger.Printf("    - %s\n", summary.MinKept[snapshotIndex])
+      }
+    }
+    if summary.SnapshotsHeld > 0 {
+      logger.Printf("  Snapshots held:    %d\n", summary.SnapshotsHeld)
+      for diskIndex := 0; diskIndex < len(summary.Disks); diskIndex++ {
+        if len(summary.Disks[diskIndex].Held) > 0 {
+          logger.Printf("    - %s: %s\n", summary.Disks[diskIndex].Name, strings.Join(summary.Disks[diskIndex].Held, ", "))
+        }
+      }
+    }
+    if summary.CopiesDeleted > 0 {
+      logger.Printf("  Copies deleted:    %d\n", summary.CopiesDeleted)
+    }
+    if summary.InstantDeleted > 0 {
+      logger.Printf("  Instant deleted:   %d\n", summary.InstantDeleted)
+    }
+    if len(summary.InvalidExpiry) > 0 {
+      logger.Printf("  Invalid expiry:    %d (kept)\n", len(summary.InvalidExpiry))
+      for snapshotIndex := 0; snapshotIndex < len(summary.InvalidExpiry); snapshotIndex++ {
+        logger.Printf("    - %s\n", summary.InvalidExpiry[snapshotIndex])
+      }
+    }
+  }
+  if len(summary.Orphans) > 0 {
+    orphansDeleted := 0
+    for orphanIndex := 0; orphanIndex < len(summary.Orphans); orphanIndex++ {
+      if summary.Orphans[orphanIndex].Deleted {
+        orphansDeleted++
+      }
+    }
+    logger.Printf("  Orphans:           %d (%d deleted)\n", len(summary.Orphans), orphansDeleted)
+    for orphanIndex := 0; orphanIndex < len(summary.Orphans); orphanIndex++ {
+      orphan := summary.Orphans[orphanIndex]
+      if !orphan.Deleted {
+        logger.Printf("    - %s: %s\n", orphan.SourceDisk, orphan.Snapshot)
+      }
+    }
+  }
+  if len(summary.Violations) > 0 {
+    logger.Printf("  Unlabeled disks:   %d\n", len(summary.Violations))
+    for violationIndex := 0; violationIndex < len(summary.Violations); violationIndex++ {
+      logger.Printf("    - %s\n", summary.Violations[violationIndex])
+    }
+  }
+  logger.Printf("  Failed disks:      %d\n", len(summary.FailedDisks))
+  timedOut := 0
+  for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+    failure := summary.Failures[failureIndex]
+    logger.Printf("    - %s: snapshot %s: %s\n", failure.Disk, failure.Snapshot, failure.Error)
+    if failure.TimedOut {
+      timedOut++
+    }
+  }
+  if len(summary.InstantFailures) > 0 {
+    logger.Printf("  Instant failures:  %d\n", len(summary.InstantFailures))
+    for failureIndex := 0; failureIndex < len(summary.InstantFailures); failureIndex++ {
+      failure := summary.InstantFailures[failureIndex]
+      logger.Printf("    - %s: instant snapshot %s: %s\n", failure.Disk, failure.Snapshot, failure.Error)
+      if failure.TimedOut {
+        timedOut++
+      }
+    }
+  }
+  if timedOut > 0 {
+    logger.Printf("  Timed out:         %d operation(s)\n", timedOut)
+  }
+  if len(summary.Groups) > 0 {
+    logger.Printf("  Groups:            %d\n", len(summary.Groups))
+    for groupIndex := 0; groupIndex < len(summary.Groups); groupIndex++ {
+      group := summary.Groups[groupIndex]
+      logger.Printf("    - %s (%s): %d/%d snapshot(s)\n", group.Id, group.Instance, len(group.Snapshots), len(group.Disks))
+    }
+  }
+  if summary.Quota != nil {
+    usageAfter := "unknown"
+    if summary.Quota.UsageAfter > 0 {
+      usageAfter = strconv.FormatInt(summary.Quota.UsageAfter, 10)
+    }
+    logger.Printf("  Snapshot quota:    %d of %d used before, %s after\n", summary.Quota.UsageBefore, summary.Quota.Limit, usageAfter)
+  }
+  if summary.Cost != nil {
+    logger.Printf("  Storage:           %s\n", summary.Cost.Total)
+    if summary.Mode != ModeBackup {
+      logger.Printf("  Storage freed:     %s\n", summary.Cost.Freed)
+    }
+    values := make([]string, 0, len(summary.Cost.ByLabel))
+    for value := range summary.Cost.ByLabel {
+      values = append(values, value)
+    }
+    sort.Strings(values)
+    for valueIndex := 0; valueIndex < len(values); valueIndex++ {
+      value := values[valueIndex]
+      if value == "" {
+        logger.Printf("    - no %s: %s\n", summary.Cost.Label, summary.Cost.ByLabel[value])
+      } else {
+        logger.Printf("    - %s=%s: %s\n", summary.Cost.Label, value, summary.Cost.ByLabel[value])
+      }
+    }
+  }
+  if len(summary.Operations) > 0 {
+    slowest := slowestOperations(summary.Operations, slowestCount)
+    logger.Printf("  Slowest operations:\n")
+    for operationIndex := 0; operationIndex < len(slowest); operationIndex++ {
+      operation := slowest[operationIndex]
+      name := operation.Disk
+      if operation.Snapshot != "" {
+        name += " (" + operation.Snapshot + ")"
+      }
+      outcome := ""
+      if operation.ReadySeconds > 0 {
+        outcome = fmt.Sprintf(", READY after %s", seconds(operation.ReadySeconds))
+      }
+      if operation.Failed {
+        outcome += ", failed"
+      }
+      logger.Printf("    - %s %s: %s%s\n", operation.Kind, name, seconds(operation.DurationSeconds), outcome)
+    }
+  }
+  logger.Printf("  Duration:          %s\n", time.Duration(summary.DurationSeconds * float64(time.Second)).Round(time.Second))
+  if summary.Error != "" {
+    logger.Printf("  Error:             %s\n", summary.Error)
+  }
+}
+
+// logCompliance prints the age of the newest snapshot of each disk.
+func (summary Summary) logCompliance(logger *log.Logger) {
+  var table strings.Builder
+  writer := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(writer, "DISK\tLOCATION\tNEWEST SNAPSHOT\tAGE\tSTATUS")
+  for diskIndex := 0; diskIndex < len(summary.Compliance); diskIndex++ {
+    disk := summary.Compliance[diskIndex]
+    name := disk.Disk
+    if disk.Instant {
+      name += " (instant)"
+    }
+    fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", name, disk.Location, disk.Snapshot, disk.Age, strings.ToUpper(disk.Status))
+  }
+  writer.Flush()
+  lines := strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")
+  for lineIndex := 0; lineIndex < len(lines); lineIndex++ {
+    logger.Printf("    %s\n", lines[lineIndex])
+  }
+  logger.Printf("  Stale disks:       %d\n", len(summary.FailedDisks))
+  logger.Printf("  Duration:          %s\n", time.Duration(summary.DurationSeconds * float64(time.Second)).Round(time.Second))
+  if summary.Error != "" {
+    logger.Printf("  Error:             %s\n", summary.Error)
+  }
+}
+
+// logDrills prints the outcome of the restore of each disk.
+func (summary Summary) logDrills(logger *log.Logger) {
+  var table strings.Builder
+  writer := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(writer, "DISK\tSNAPSHOT\tTEMPORARY DISK\tDURATION\tSTATUS")
+  for drillIndex := 0; drillIndex < len(summary.Drills); drillIndex++ {
+    drill := summary.Drills[drillIndex]
+    fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", drill.Disk, drill.Snapshot, drill.TempDisk, seconds(drill.DurationSeconds).Round(time.Second), strings.ToUpper(drill.Status))
+  }
+  writer.Flush()
+  lines := strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")
+  for lineIndex := 0; lineIndex < len(lines); lineIndex++ {
+    logger.Printf("    %s\n", lines[lineIndex])
+  }
+  if len(summary.DrillLeftovers) > 0 {
+    logger.Printf("  Leftovers deleted: %d\n", len(summary.DrillLeftovers))
+  }
+  logger.Printf("  Failed drills:     %d\n", len(summary.FailedDisks))
+  for failureIndex := 0; failureIndex < len(summary.Failures); failureIndex++ {
+    failure := summary.Failures[failureIndex]
+    logger.Printf("    - %s: %s\n", failure.Disk, failure.Error)
+  }
+  logger.Printf("  Duration:          %s\n", time.Duration(summary.DurationSeconds * float64(time.Second)).Round(time.Second))
+  if summary.Error != "" {
+    logger.Printf("  Error:             %s\n", summary.Error)
+  }
+}
+
+// WriteFile writes the summary as JSON.
+func (summary Summary) WriteFile(path string) error {
+  data, err := json.MarshalIndent(summary, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Report is the outcome of a run of several plans or projects.
+type Report struct {
+  RunID    string    `json:"runId,omitempty"`
+  // One summary by plan and project
+  Runs     []Summary `json:"runs"`
+  // The worst exit code of the runs
+  ExitCode int       `json:"exitCode"`
+  // Error stopping the backup before the runs, e.g. a failed preflight check
+  Error    string    `json:"error,omitempty"`
+}
+
+// NewReport groups the summaries of the plans and projects.
+func NewReport(summaries []Summary) Report {
+  report := Report{Runs: summaries, ExitCode: ExitOK}
+  for summaryIndex := 0; summaryIndex < len(summaries); summaryIndex++ {
+    if report.RunID == "" {
+      report.RunID = summaries[summaryIndex].RunID
+    }
+    if summaries[summaryIndex].ExitCode > report.ExitCode {
+      report.ExitCode = summaries[summaryIndex].ExitCode
+    }
+  }
+  return report
+}
+
+// WriteFile writes the report as JSON.
+func (report Report) WriteFile(path string) error {
+  data, err := json.MarshalIndent(report, "", "  ")
+  if err != nil {
+    return err
+  }
+  return os.WriteFile(path, append(data, '\n'), 0644)
+}
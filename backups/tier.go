@@ -0,0 +1,63 @@
+package backups
+
+import (
+  "fmt"
+  "strings"
+  "time"
+)
+
+const (
+  // Types of the snapshots, STANDARD when created without a type
+  SnapshotStandard = "STANDARD"
+  // Cheaper storage for the long retentions, with a minimum retention and a
+  // retrieval cost
+  SnapshotArchive = "ARCHIVE"
+)
+
+// Label of the disks overriding the type of their snapshots, standard or
+// archive
+const SnapshotTypeLabel = "backup-snapshot-type"
+
+// ValidateSnapshotType checks the snapshot type, which may be empty for the
+// default one.
+func ValidateSnapshotType(snapshotType string) error {
+  switch snapshotType {
+  case "", SnapshotStandard, SnapshotArchive:
+    return nil
+  }
+  return fmt.Errorf("Unknown snapshot type '%s', use '%s' or '%s'", snapshotType, SnapshotStandard, SnapshotArchive)
+}
+
+// snapshotType returns the type of the new snapshot of the disk: the one of
+// its SnapshotTypeLabel, else the monthly type of its GFS retention if it has
+// no snapshot of this type yet this month (in UTC), else the one of the
+// options.
+func (runner *Runner) snapshotType(disk Disk, now time.Time) (string, error) {
+  label := disk.Labels[SnapshotTypeLabel]
+  if label != "" {
+    snapshotType := strings.ToUpper(label)
+    err := ValidateSnapshotType(snapshotType)
+    if err != nil {
+      return "", fmt.Errorf("Label %s of disk %s: %w", SnapshotTypeLabel, disk.Name, err)
+    }
+    return snapshotType, nil
+  }
+  retention := runner.retention(disk)
+  if retention.MonthlyType != "" && retention.KeepMonthly > 0 && monthlySnapshot(disk.Snapshots, retention.MonthlyType, now) < 0 {
+    return retention.MonthlyType, nil
+  }
+  return runner.options.SnapshotType, nil
+}
+
+// monthlySnapshot returns the index of a snapshot of the type created in the
+// month of now, in UTC, -1 if none.
+func monthlySnapshot(snapshots []Snapshot, snapshotType string, now time.Time) int {
+  month := now.UTC().Format("2006-01")
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    if snapshot.SnapshotType == snapshotType && !snapshot.CreationTimestamp.IsZero() && snapshot.CreationTimestamp.UTC().Format("2006-01") == month {
+      return snapshotIndex
+    }
+  }
+  return -1
+}
@@ -0,0 +1,95 @@
+package backups
+
+import (
+  "testing"
+  "time"
+)
+
+func TestSnapshotType(t *testing.T) {
+  now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+  archived := testSnapshot("archived", "1", time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC))
+  archived.SnapshotType = SnapshotArchive
+  // In September in UTC, in October in UTC+2
+  lastMonth := testSnapshot("last-month", "1", time.Date(2026, 9, 30, 23, 0, 0, 0, time.UTC))
+  lastMonth.SnapshotType = SnapshotArchive
+  standard := testSnapshot("standard", "1", now.Add(-time.Hour))
+  monthly := Options{KeepDaily: 7, KeepMonthly: 12, MonthlyType: SnapshotArchive}
+  tests := []struct {
+    name      string
+    options   Options
+    labels    map[string]string
+    snapshots []Snapshot
+    expected  string
+    valid     bool
+  }{
+    {"default", Options{}, nil, nil, "", true},
+    {"option", Options{SnapshotType: SnapshotArchive}, nil, nil, SnapshotArchive, true},
+    {"label over the option", Options{SnapshotType: SnapshotArchive}, map[string]string{SnapshotTypeLabel: "standard"}, nil, SnapshotStandard, true},
+    {"invalid label", Options{}, map[string]string{SnapshotTypeLabel: "cold"}, nil, "", false},
+    {"first of the month", monthly, nil, []Snapshot{standard, lastMonth}, SnapshotArchive, true},
+    {"monthly done", monthly, nil, []Snapshot{standard, archived}, "", true},
+    {"monthly without the monthly tier", Options{KeepDaily: 7, MonthlyType: SnapshotArchive}, nil, nil, "", true},
+    {"label over the monthly type", monthly, map[string]string{SnapshotTypeLabel: "standard"}, nil, SnapshotStandard, true},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    runner, _ := newTestRunner(newFakeRunner(t), test.options)
+    disk := Disk{Name: "db-data", Id: "1", Labels: test.labels, Snapshots: test.snapshots}
+    snapshotType, err := runner.snapshotType(disk, now)
+    if (err == nil) != test.valid {
+      t.Errorf("%s: got the error %v", test.name, err)
+    }
+    if snapshotType != test.expected {
+      t.Errorf("%s: got the type '%s', expected '%s'", test.name, snapshotType, test.expected)
+    }
+    // The same once the snapshots are released by a streamed run
+    released := disk
+    released.Snapshots = append([]Snapshot(nil), test.snapshots...)
+    count := runner.releaseSnapshots(&released, now)
+    releasedType, _ := runner.snapshotType(released, now)
+    if releasedType != snapshotType || count + len(released.Snapshots) != len(test.snapshots) {
+      t.Errorf("%s: got the type '%s' once %d snapshot(s) released, %v left", test.name, releasedType, count, released.Snapshots)
+    }
+  }
+}
+
+func TestValidateSnapshotType(t *testing.T) {
+  tests := []struct {
+    snapshotType string
+    valid        bool
+  }{
+    {"", true},
+    {SnapshotStandard, true},
+    {SnapshotArchive, true},
+    {"archive", false},
+    {"COLD", false},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    err := ValidateSnapshotType(test.snapshotType)
+    if (err == nil) != test.valid {
+      t.Errorf("Type '%s': got %v", test.snapshotType, err)
+    }
+  }
+}
+
+func TestSnapshotsCostByType(t *testing.T) {
+  standard := Snapshot{StorageBytes: 10e9, SnapshotType: SnapshotStandard}
+  archive := Snapshot{StorageBytes: 10e9, SnapshotType: SnapshotArchive}
+  tests := []struct {
+    name     string
+    prices   Prices
+    expected float64
+  }{
+    {"archive price", Prices{Standard: 0.05, Archive: 0.01}, 0.6},
+    // The standard price without an archive price
+    {"standard price", Prices{Standard: 0.05}, 1},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    cost := SnapshotsCost([]Snapshot{standard, archive}, test.prices)
+    if cost.Snapshots != 2 || cost.StorageGb != 20 || cost.MonthlyCost < test.expected - 1e-9 || cost.MonthlyCost > test.expected + 1e-9 {
+      t.Errorf("%s: got %d snapshot(s) of %f GB for %f, expected 2 of 20 GB for %f", test.name, cost.Snapshots, cost.StorageGb, cost.MonthlyCost, test.expected)
+    }
+  }
+}
@@ -0,0 +1,107 @@
+package backups
+
+import (
+  "context"
+  "net/http"
+  "os"
+  "strings"
+
+  "go.opentelemetry.io/otel"
+  "go.opentelemetry.io/otel/attribute"
+  "go.opentelemetry.io/otel/codes"
+  "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+  "go.opentelemetry.io/otel/propagation"
+  "go.opentelemetry.io/otel/sdk/resource"
+  sdktrace "go.opentelemetry.io/otel/sdk/trace"
+  "go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer of the spans of this package
+const tracerName = "github.com/Mille-Volts/gcp-backups/backups"
+
+// SetupTracing exports the spans with OTLP over HTTP to the endpoint, e.g.
+// http://localhost:4318, or to the one of the standard OTEL_EXPORTER_OTLP_*
+// variables if empty. Without any endpoint, or with OTEL_SDK_DISABLED=true,
+// the spans are no-ops. The returned function flushes the spans.
+func SetupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+  noop := func(context.Context) error { return nil }
+  if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+    return noop, nil
+  }
+  if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+    return noop, nil
+  }
+
+  options := make([]otlptracehttp.Option, 0)
+  if endpoint != "" {
+    options = append(options, otlptracehttp.WithEndpointURL(endpoint))
+  }
+  exporter, err := otlptracehttp.New(ctx, options...)
+  if err != nil {
+    return noop, err
+  }
+  // $OTEL_SERVICE_NAME and $OTEL_RESOURCE_ATTRIBUTES override the defaults
+  traceResource, err := resource.New(ctx, resource.WithTelemetrySDK(), resource.WithHost(), resource.WithAttributes(attribute.String("service.name", CreatedByValue), attribute.String("service.version", Version)), resource.WithFromEnv())
+  if err != nil {
+    return noop, err
+  }
+  provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(traceResource))
+  otel.SetTracerProvider(provider)
+  // A run triggered with a traceparent header joins its trace
+  otel.SetTextMapPropagator(propagation.TraceContext{})
+  return provider.Shutdown, nil
+}
+
+// ExtractTraceContext returns the context in the trace of the traceparent
+// header, if any, so a triggered run joins the trace of its trigger.
+func ExtractTraceContext(ctx context.Context, headers http.Header) context.Context {
+  return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(headers))
+}
+
+// StartSpan starts a span of the operation, a no-op unless SetupTracing
+// exported the spans.
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+  return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan records the error of the operation, if any, and ends its span.
+func EndSpan(span trace.Span, err error) {
+  if err != nil {
+    span.RecordError(err)
+    span.SetStatus(codes.Error, err.Error())
+  }
+  span.End()
+}
+
+// startRunSpan starts the span of a run of the runner, ended with the
+// outcome of the run by the returned function.
+func (runner *Runner) startRunSpan(ctx context.Context, name string) (context.Context, func(Result, error)) {
+  ctx, span := StartSpan(ctx, name, attribute.String("run.id", runner.options.RunID), attribute.Bool("dry_run", runner.options.DryRun))
+  return ctx, func(result Result, err error) {
+    if span.IsRecording() {
+      span.SetAttributes(attribute.String("project", result.Project), attribute.String("mode", result.Mode), attribute.Int("disks", len(result.Disks)), attribute.Int("snapshots.created", len(result.Created)), attribute.Int("snapshots.deleted", len(result.Deleted)), attribute.Int("failures", len(result.Failures)))
+    }
+    EndSpan(span, err)
+  }
+}
+
+// diskAttributes returns the attributes of the spans of the disk.
+func diskAttributes(disk Disk) []attribute.KeyValue {
+  return []attribute.KeyValue{attribute.String("disk.name", disk.Name), attribute.String("disk.id", disk.Id), attribute.String("disk.location", disk.Location())}
+}
+
+// gcloudCommand returns the command of the gcloud arguments without the
+// release track, e.g. "compute disks snapshot", to name its span.
+func gcloudCommand(args []string) string {
+  words := make([]string, 0, 3)
+  for argIndex := 0; argIndex < len(args) && len(words) < 3; argIndex++ {
+    if strings.HasPrefix(args[argIndex], "-") {
+      break
+    }
+    if argIndex == 0 && (args[argIndex] == "beta" || args[argIndex] == "alpha") {
+      continue
+    }
+    words = append(words, args[argIndex])
+  }
+  return strings.Join(words, " ")
+}
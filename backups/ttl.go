@@ -0,0 +1,79 @@
+package backups
+
+import (
+  "time"
+)
+
+// Label of the snapshots created with a max age, the day they expire on, in
+// UTC, like 20261031
+const ExpiresLabel = "expires"
+
+// Layout of the date of the ExpiresLabel
+const expiresLayout = "20060102"
+
+// expiresLabel returns the value of the ExpiresLabel of a snapshot created at
+// this time, or an empty string if the retention has no max age.
+func expiresLabel(retention Retention, createdAt time.Time) string {
+  if retention.Mode == RetentionCount || retention.MaxAge <= 0 {
+    return ""
+  }
+  return createdAt.Add(retention.MaxAge).UTC().Format(expiresLayout)
+}
+
+// expiresOn returns the expiry day of a snapshot created by the tool, if it
+// has an ExpiresLabel. The label is invalid if it can't be parsed.
+func expiresOn(snapshot Snapshot) (time.Time, bool, bool) {
+  if snapshot.Labels[CreatedByLabel] != CreatedByValue {
+    return time.Time{}, false, false
+  }
+  value, found := snapshot.Labels[ExpiresLabel]
+  if !found {
+    return time.Time{}, false, false
+  }
+  day, err := time.Parse(expiresLayout, value)
+  if err != nil {
+    return time.Time{}, false, true
+  }
+  return day, true, false
+}
+
+// expiredSnapshots splits the snapshots created by the tool with an
+// ExpiresLabel between the expired ones, from the start of their expiry day,
+// and the ones with an invalid label, which are never deleted. The order of the
+// snapshots is kept.
+func expiredSnapshots(snapshots []Snapshot, now time.Time) ([]Snapshot, []Snapshot) {
+  expired := make([]Snapshot, 0)
+  invalid := make([]Snapshot, 0)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    day, found, isInvalid := expiresOn(snapshots[snapshotIndex])
+    if isInvalid {
+      invalid = append(invalid, snapshots[snapshotIndex])
+    } else if found && !now.Before(day) {
+      expired = append(expired, snapshots[snapshotIndex])
+    }
+  }
+  return expired, invalid
+}
+
+// withExpired merges the snapshots to delete by the retention with the expired
+// ones, without the ones with an invalid ExpiresLabel.
+func withExpired(toDelete []Snapshot, expired []Snapshot, invalid []Snapshot) []Snapshot {
+  excluded := make(map[string]bool)
+  for snapshotIndex := 0; snapshotIndex < len(invalid); snapshotIndex++ {
+    excluded[invalid[snapshotIndex].Name] = true
+  }
+  merged := make([]Snapshot, 0, len(toDelete) + len(expired))
+  for snapshotIndex := 0; snapshotIndex < len(toDelete); snapshotIndex++ {
+    if !excluded[toDelete[snapshotIndex].Name] {
+      excluded[toDelete[snapshotIndex].Name] = true
+      merged = append(merged, toDelete[snapshotIndex])
+    }
+  }
+  for snapshotIndex := 0; snapshotIndex < len(expired); snapshotIndex++ {
+    if !excluded[expired[snapshotIndex].Name] {
+      excluded[expired[snapshotIndex].Name] = true
+      merged = append(merged, expired[snapshotIndex])
+    }
+  }
+  return merged
+}
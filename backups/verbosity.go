@@ -0,0 +1,37 @@
+package backups
+
+import (
+  "io"
+  "log"
+)
+
+// Verbosity levels of the logs
+const (
+  // Only the warnings, the errors and the summary
+  VerbosityQuiet   = -1
+  VerbosityNormal  = 0
+  // Also the commands run and their duration
+  VerbosityVerbose = 1
+)
+
+// Levels are the loggers of each level, discarding the messages below the
+// verbosity.
+type Levels struct {
+  Debug   *log.Logger
+  Info    *log.Logger
+  // Always logged, even with VerbosityQuiet
+  Warning *log.Logger
+}
+
+// NewLevels returns the loggers of the verbosity writing to the logger.
+func NewLevels(logger *log.Logger, verbosity int) Levels {
+  discard := log.New(io.Discard, "", 0)
+  levels := Levels{Debug: discard, Info: discard, Warning: logger}
+  if verbosity >= VerbosityNormal {
+    levels.Info = logger
+  }
+  if verbosity >= VerbosityVerbose {
+    levels.Debug = logger
+  }
+  return levels
+}
@@ -0,0 +1,117 @@
+package backups
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "time"
+)
+
+const (
+  // Only check the age of the newest snapshots, with Runner.Verify
+  ModeVerify = "verify"
+)
+
+const (
+  // The newest snapshot is recent enough
+  ComplianceOK = "ok"
+  ComplianceStale = "stale"
+  // No READY snapshot created by this program
+  ComplianceMissing = "missing"
+)
+
+// ErrStaleDisks is returned by Verify when some disks have no recent snapshot.
+var ErrStaleDisks = errors.New("Stale backups")
+
+// DiskCompliance is the age of the newest snapshot of a disk.
+type DiskCompliance struct {
+  Disk     string    `json:"disk"`
+  Project  string    `json:"project"`
+  Location string    `json:"location"`
+  // ComplianceOK, ComplianceStale or ComplianceMissing
+  Status   string    `json:"status"`
+  // Newest READY snapshot created by this program, if any
+  Snapshot string    `json:"snapshot,omitempty"`
+  CreatedAt time.Time `json:"createdAt,omitempty"`
+  Age      string    `json:"age,omitempty"`
+  // Age of the newest instant snapshot, with Options.InstantSnapshots
+  Instant  bool      `json:"instant,omitempty"`
+}
+
+// compliance checks the newest READY snapshot created by this program of the
+// disk, whose snapshots are newest first.
+func compliance(disk Disk, maxStaleness time.Duration, now time.Time) DiskCompliance {
+  diskCompliance := DiskCompliance{Disk: disk.Name, Project: disk.Project, Location: disk.Location(), Status: ComplianceMissing}
+  for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+    snapshot := disk.Snapshots[snapshotIndex]
+    if snapshot.Status != SnapshotReady || snapshot.Labels[CreatedByLabel] != CreatedByValue || snapshot.CreationTimestamp.IsZero() {
+      continue
+    }
+    diskCompliance.Snapshot = snapshot.Name
+    diskCompliance.CreatedAt = snapshot.CreationTimestamp
+    diskCompliance.Age = FormatAge(snapshot.CreationTimestamp, now)
+    diskCompliance.Status = ComplianceOK
+    if now.Sub(snapshot.CreationTimestamp) > maxStaleness {
+      diskCompliance.Status = ComplianceStale
+    }
+    break
+  }
+  return diskCompliance
+}
+
+// Verify lists the disks like Run, and checks that the newest snapshot of
+// each disk created by this program is READY and not older than the maximum
+// staleness. The stale disks, and the ones with no snapshot, are failures of
+// the result. With Options.InstantSnapshots, the newest instant snapshot of
+// each disk is checked too. Nothing is created nor deleted.
+func (runner *Runner) Verify(ctx context.Context) (result Result, err error) {
+  maxStaleness := runner.options.MaxStaleness
+  ctx, endSpan := runner.startRunSpan(ctx, "verify")
+  endEvents := runner.startRunEvents(ModeVerify)
+  defer func() {
+    endSpan(result, err)
+    endEvents(result, err)
+  }()
+  result, err = runner.List(ctx)
+  result.Mode = ModeVerify
+  result.Failures = make([]Failure, 0)
+  if err != nil {
+    return result, err
+  }
+
+  now := time.Now()
+  result.Compliance = make([]DiskCompliance, 0, len(result.Disks))
+  for diskIndex := 0; diskIndex < len(result.Disks); diskIndex++ {
+    diskCompliance := compliance(result.Disks[diskIndex], maxStaleness, now)
+    result.Compliance = append(result.Compliance, diskCompliance)
+    switch diskCompliance.Status {
+    case ComplianceStale:
+      result.Failures = append(result.Failures, Failure{Disk: diskCompliance.Disk, Snapshot: diskCompliance.Snapshot, Err: fmt.Errorf("Newest snapshot %s old, more than %s", diskCompliance.Age, maxStaleness)})
+    case ComplianceMissing:
+      result.Failures = append(result.Failures, Failure{Disk: diskCompliance.Disk, Err: errors.New("No READY snapshot created by " + CreatedByValue)})
+    }
+    if !runner.options.InstantSnapshots {
+      continue
+    }
+    instantSnapshots, listErr := runner.backend.GetDiskInstantSnapshots(ctx, result.Disks[diskIndex])
+    if listErr != nil {
+      result.Failures = append(result.Failures, Failure{Disk: diskCompliance.Disk, Err: fmt.Errorf("Listing of the instant snapshots: %w", listErr)})
+      continue
+    }
+    instantCompliance := instantCompliance(result.Disks[diskIndex], instantSnapshots, maxStaleness, now)
+    result.Compliance = append(result.Compliance, instantCompliance)
+    switch instantCompliance.Status {
+    case ComplianceStale:
+      result.Failures = append(result.Failures, Failure{Disk: instantCompliance.Disk, Snapshot: instantCompliance.Snapshot, Err: fmt.Errorf("Newest instant snapshot %s old, more than %s", instantCompliance.Age, maxStaleness)})
+    case ComplianceMissing:
+      result.Failures = append(result.Failures, Failure{Disk: instantCompliance.Disk, Err: errors.New("No READY instant snapshot created by " + CreatedByValue)})
+    }
+  }
+
+  staleDisks := result.FailedDisks()
+  if len(staleDisks) > 0 {
+    return result, fmt.Errorf("%w for %d disk(s): %s", ErrStaleDisks, len(staleDisks), strings.Join(staleDisks, ", "))
+  }
+  return result, nil
+}
@@ -0,0 +1,85 @@
+package backups
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/url"
+  "text/template"
+)
+
+// DefaultWebhookTemplate is the body of the webhooks without a template: the
+// outcome of the run, its counts and its failures as JSON.
+const DefaultWebhookTemplate = `{"runId": {{json .RunID}}, "plan": {{json .Plan}}, "project": {{json .Project}}, "filter": {{json .Filter}}, "mode": {{json .Mode}}, "dryRun": {{.DryRun}}, "exitCode": {{.ExitCode}}, "disksScanned": {{.DisksScanned}}, "snapshotsCreated": {{.SnapshotsCreated}}, "snapshotsDeleted": {{.SnapshotsDeleted}}, "failedDisks": {{json .FailedDisks}}, "failures": {{json .Failures}}, "error": {{json .Error}}}`
+
+// Functions of the webhook templates
+var webhookFuncs = template.FuncMap{
+  // Encodes a value as JSON, e.g. a string with its quotes
+  "json": func(value interface{}) (string, error) {
+    data, err := json.Marshal(value)
+    return string(data), err
+  },
+}
+
+// WebhookNotifier posts the summary rendered by a template to a URL.
+type WebhookNotifier struct {
+  URL      string
+  // Go text/template of the body over the Summary, DefaultWebhookTemplate if
+  // empty
+  Template string
+  // Headers of the request, with Content-Type application/json unless set
+  Headers  map[string]string
+  // Retries of the server errors, within the timeout of the notifications
+  Retry    Retry
+  // http.DefaultClient if nil
+  Client   *http.Client
+}
+
+// parseWebhookTemplate parses the template, DefaultWebhookTemplate if empty.
+func parseWebhookTemplate(text string) (*template.Template, error) {
+  if text == "" {
+    text = DefaultWebhookTemplate
+  }
+  parsed, err := template.New("webhook").Funcs(webhookFuncs).Option("missingkey=error").Parse(text)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid webhook template: %w", err)
+  }
+  return parsed, nil
+}
+
+// ValidateWebhookTemplate checks the template renders a sample summary.
+func ValidateWebhookTemplate(text string) error {
+  parsed, err := parseWebhookTemplate(text)
+  if err != nil {
+    return err
+  }
+  var body bytes.Buffer
+  err = parsed.Execute(&body, SampleSummary("project"))
+  if err != nil {
+    return fmt.Errorf("Invalid webhook template: %w", err)
+  }
+  return nil
+}
+
+func (notifier WebhookNotifier) Notify(ctx context.Context, summary Summary) error {
+  parsed, err := parseWebhookTemplate(notifier.Template)
+  if err != nil {
+    return err
+  }
+  var body bytes.Buffer
+  err = parsed.Execute(&body, summary)
+  if err != nil {
+    return fmt.Errorf("Webhook template: %w", err)
+  }
+
+  host := notifier.URL
+  parsedURL, err := url.Parse(notifier.URL)
+  if err == nil {
+    host = parsedURL.Host
+  }
+  return notifier.Retry.Do(ctx, "webhook " + host, func() error {
+    return postBody(ctx, notifier.Client, notifier.URL, body.Bytes(), notifier.Headers)
+  })
+}
@@ -0,0 +1,1411 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "net/url"
+  "os"
+  "regexp"
+  "sort"
+  "strings"
+  "time"
+
+  "golang.org/x/term"
+  "gopkg.in/yaml.v3"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// Outputs of the logs
+const (
+  // Tables on a terminal, log lines otherwise
+  outputAuto   = "auto"
+  outputLog    = "log"
+  outputPretty = "pretty"
+)
+
+// Config is the configuration of a run, from the --config file and the flags
+// overriding it.
+type Config struct {
+  // Project of the disks, instead of the default one of the backend
+  Project              string                `yaml:"project"`
+  // Projects of the disks, the default one if empty
+  Projects             []string              `yaml:"projects,omitempty"`
+  // Back up all the active projects instead
+  AllProjects          bool                  `yaml:"allProjects"`
+  Mode                 string                `yaml:"mode"`
+  Filter               string                `yaml:"filter"`
+  ExcludeFilter        string                `yaml:"excludeFilter"`
+  // Names of the disks of the filter to back up, all if empty, and to skip,
+  // as name or name:zone
+  DiskNames            []string              `yaml:"diskNames,omitempty"`
+  ExcludeDisks         []string              `yaml:"excludeDisks,omitempty"`
+  // Fail when a disk name matches no disk, instead of a warning
+  StrictDisks          bool                  `yaml:"strictDisks"`
+  // Regular expressions of the names of the disks of the filter to back up,
+  // and to skip
+  NameRegex            string                `yaml:"nameRegex"`
+  NameRegexExclude     string                `yaml:"nameRegexExclude"`
+  // Sizes of the disks of the filter to back up, no limit if 0, and their
+  // types, all if empty
+  MinSizeGb            int64                 `yaml:"minSizeGb"`
+  MaxSizeGb            int64                 `yaml:"maxSizeGb"`
+  DiskTypes            []string              `yaml:"diskTypes,omitempty"`
+  // Filter of the instances whose attached disks are backed up too
+  InstanceFilter       string                `yaml:"instanceFilter"`
+  // Zones and regions of the disks, listed in parallel, all if empty
+  Zones                []string              `yaml:"zones,omitempty"`
+  Regions              []string              `yaml:"regions,omitempty"`
+  Retention            RetentionConfig       `yaml:"retention"`
+  OwnSnapshotsOnly     bool                  `yaml:"ownSnapshotsOnly"`
+  FailFast             bool                  `yaml:"failFast"`
+  Concurrency          int                   `yaml:"concurrency"`
+  DryRun               bool                  `yaml:"dryRun"`
+  // Delete without asking for a confirmation
+  Yes                  bool                  `yaml:"yes"`
+  // Also log the commands run and their duration
+  Verbose              bool                  `yaml:"verbose"`
+  // Only log the warnings, the failures and the summary
+  Quiet                bool                  `yaml:"quiet"`
+  // outputAuto, outputLog or outputPretty
+  Output               string                `yaml:"output"`
+  // Also disabled by $NO_COLOR
+  NoColor              bool                  `yaml:"noColor"`
+  Wait                 bool                  `yaml:"wait"`
+  WaitTimeout          time.Duration         `yaml:"waitTimeout"`
+  PruneOnCreateFailure bool                  `yaml:"pruneOnCreateFailure"`
+  // Limits of the deletions of a run, no limit if 0
+  MaxDeletionsPerRun   int                   `yaml:"maxDeletionsPerRun"`
+  MaxDeletionPercent   float64               `yaml:"maxDeletionPercent"`
+  // Snapshots created by a run at most, the first disks in the order
+  MaxCreations         int                   `yaml:"maxCreations"`
+  // Order of the disks to snapshot: staleness, name or none
+  Order                string                `yaml:"order"`
+  // Delete beyond the limits of the deletions
+  Force                bool                  `yaml:"force"`
+  // The snapshots to delete are marked, and deleted once marked for this
+  // duration
+  DeletionGrace        time.Duration         `yaml:"deletionGrace"`
+  // Delete the snapshots at once, without the grace period
+  HardDelete           bool                  `yaml:"hardDelete"`
+  // Delete the snapshots used by images or disks too
+  ForceDeleteReferenced bool                 `yaml:"forceDeleteReferenced"`
+  // Only delete the snapshots past their expires label
+  RespectTTLOnly       bool                  `yaml:"respectTtlOnly"`
+  // Delete the FAILED snapshots, which don't count in the retention
+  CleanupFailed        bool                  `yaml:"cleanupFailed"`
+  // Prune from the first listing, without listing the snapshots again
+  NoRefresh            bool                  `yaml:"noRefresh"`
+  // Prune the disks once all the snapshots are created, instead of each disk
+  // once its snapshot is created
+  Phased               bool                  `yaml:"phased"`
+  // Snapshot each disk as soon as its page of disks is listed
+  Stream               bool                  `yaml:"stream"`
+  // Report or delete the snapshots of the deleted disks, not looked for if
+  // empty
+  Orphans              string                `yaml:"orphans"`
+  OrphanMaxAge         time.Duration         `yaml:"orphanMaxAge"`
+  // READY snapshots created by this program kept for each disk whatever the
+  // retention, the TTL or the orphans
+  MinKeep              int                   `yaml:"minKeep"`
+  // Report the disks neither backed up nor opted out as failures (error) or
+  // warnings (warn), not checked if empty
+  EnforceLabeling      string                `yaml:"enforceLabeling"`
+  // Of the estimated storage costs, not estimated if 0
+  PricePerGbMonth      float64               `yaml:"pricePerGbMonth"`
+  ArchivePricePerGbMonth float64             `yaml:"archivePricePerGbMonth"`
+  // Label of the snapshots grouping the costs, like a team
+  CostLabel            string                `yaml:"costLabel"`
+  // What to do when the snapshots would exceed the snapshot quota
+  QuotaBehavior        string                `yaml:"quotaBehavior"`
+  NameTemplate         string                `yaml:"nameTemplate"`
+  // Chain of the snapshots of each disk, without chain if empty
+  ChainNameTemplate    string                `yaml:"chainNameTemplate"`
+  DescriptionTemplate  string                `yaml:"descriptionTemplate"`
+  // STANDARD or ARCHIVE, the default type if empty
+  SnapshotType         string                `yaml:"snapshotType"`
+  StorageLocation      string                `yaml:"storageLocation"`
+  // Region of the copies of the snapshots, not copied if empty, the zone of
+  // their temporary disks and the number kept by disk
+  CopyToLocation       string                `yaml:"copyToLocation"`
+  CopyZone             string                `yaml:"copyZone"`
+  CopyLimit            int                   `yaml:"copyLimit"`
+  // Instant snapshots of the disks too, and the number kept by disk
+  InstantSnapshots     bool                  `yaml:"instantSnapshots"`
+  InstantLimit         int                   `yaml:"instantLimit"`
+  // Don't snapshot the disks having a snapshot schedule resource policy
+  SkipScheduledDisks   bool                  `yaml:"skipScheduledDisks"`
+  GuestFlush           bool                  `yaml:"guestFlush"`
+  GuestFlushFallback   bool                  `yaml:"guestFlushFallback"`
+  GroupByInstance      bool                  `yaml:"groupByInstance"`
+  // Frequency of the disks without a backup-frequency label
+  DefaultFrequency     string                `yaml:"defaultFrequency"`
+  // Label the disks with their last snapshot
+  StampDisks           bool                  `yaml:"stampDisks"`
+  KmsKey               string                `yaml:"kmsKey"`
+  // KMS keys by alias, for the backup-kms-key label of the disks
+  KmsKeys              map[string]string     `yaml:"kmsKeys,omitempty"`
+  // Labels added to the created snapshots, over the labels of their disk
+  Labels               map[string]string     `yaml:"labels,omitempty"`
+  Timeout              time.Duration         `yaml:"timeout"`
+  // OTLP/HTTP endpoint of the traces, the OTEL_EXPORTER_OTLP_* variables if
+  // empty
+  OTLPEndpoint         string                `yaml:"otlpEndpoint"`
+  OperationTimeout     time.Duration         `yaml:"operationTimeout"`
+  // Time given to the operations in progress on SIGINT or SIGTERM
+  GracePeriod          time.Duration         `yaml:"gracePeriod"`
+  MaxRetries           int                   `yaml:"maxRetries"`
+  Backend              string                `yaml:"backend"`
+  // gcloud command of the gcloud backend
+  GcloudPath           string                `yaml:"gcloudPath"`
+  // Identity of the backend, the default one if empty
+  ImpersonateServiceAccount string           `yaml:"impersonateServiceAccount"`
+  CredentialsFile      string                `yaml:"credentialsFile"`
+  BillingProject       string                `yaml:"billingProject"`
+  SkipPreflight        bool                  `yaml:"skipPreflight"`
+  SummaryFile          string                `yaml:"summaryFile"`
+  // JSON file of the plan of the dry run
+  PlanOut              string                `yaml:"planOut"`
+  // JSON file of a plan to apply, instead of a backup
+  ApplyPlan            string                `yaml:"applyPlan"`
+  // Only check the age of the newest snapshots, instead of a backup
+  VerifyOnly           bool                  `yaml:"verifyOnly"`
+  MaxStaleness         time.Duration         `yaml:"maxStaleness"`
+  // Restore the newest snapshots of a sample of disks instead of a backup,
+  // set by the drill subcommand
+  Drill                bool                  `yaml:"-"`
+  DrillSample          int                   `yaml:"drillSample"`
+  DrillZone            string                `yaml:"drillZone"`
+  MaxPlanAge           time.Duration         `yaml:"maxPlanAge"`
+  // Folder of the summaries and plans of the runs, as gs://bucket/prefix/
+  ReportGCS            string                `yaml:"reportGcs"`
+  // Service account key of the uploads, the Application Default Credentials
+  // if empty
+  ReportCredentialsFile string               `yaml:"reportCredentialsFile"`
+  // Progress of the runs, as a local path or gs://bucket/object
+  StateFile            string                `yaml:"stateFile"`
+  // Newline-delimited JSON events of the progress of the runs, appended to
+  // the file or written to the open file descriptor
+  ProgressFile         string                `yaml:"progressFile"`
+  ProgressFD           int                   `yaml:"-"`
+  // Skip the disks already snapshotted by the run of the state file
+  Resume               bool                  `yaml:"resume"`
+  ResumeMaxAge         time.Duration         `yaml:"resumeMaxAge"`
+  // Id of the run given by a scheduler, generated if empty
+  RunID                string                `yaml:"runId"`
+  Notifications        NotificationsConfig   `yaml:"notifications"`
+  // Overrides by disk name
+  Disks                map[string]DiskConfig `yaml:"disks"`
+  PlanConfigs          []PlanConfig          `yaml:"plans,omitempty"`
+  // Number of plans or projects run at the same time
+  PlanConcurrency      int                   `yaml:"planConcurrency"`
+  // Loop forever, running the backup on schedule
+  Daemon               bool                  `yaml:"daemon"`
+  Interval             time.Duration         `yaml:"interval"`
+  // Local time of the day of the runs of the daemon, as HH:MM
+  At                   string                `yaml:"at"`
+  // Cron expressions of the runs of the daemon, instead of the interval
+  Schedules            []string              `yaml:"schedules,omitempty"`
+  // Time zone of the schedules, the local one if empty
+  ScheduleTZ           string                `yaml:"scheduleTz"`
+  // Maximum random delay of the runs of the daemon
+  Jitter               time.Duration         `yaml:"jitter"`
+  // GCS object locking the runs, as gs://bucket/object
+  LockGCS              string                `yaml:"lockGcs"`
+  // A lock not refreshed for this long is stale
+  LockTTL              time.Duration         `yaml:"lockTtl"`
+  // Address to serve the HTTP triggers of the backup on, e.g. :8080
+  Serve                string                `yaml:"serve"`
+  // Shared secret of the HTTP triggers, only read from $BACKUP_SERVE_SECRET
+  ServeSecret          string                `yaml:"-"`
+}
+
+type RetentionConfig struct {
+  Mode        string        `yaml:"mode"`
+  Limit       int           `yaml:"limit"`
+  MaxAge      time.Duration `yaml:"maxAge"`
+  MaxAgeDays  int           `yaml:"maxAgeDays"`
+  KeepDaily   int           `yaml:"keepDaily"`
+  KeepWeekly  int           `yaml:"keepWeekly"`
+  KeepMonthly int           `yaml:"keepMonthly"`
+  // Type of the first snapshot of each month, STANDARD or ARCHIVE
+  MonthlyType string        `yaml:"monthlyType"`
+}
+
+type NotificationsConfig struct {
+  NotifyOn        string            `yaml:"notifyOn"`
+  SlackWebhookURL string            `yaml:"slackWebhookUrl"`
+  PubSub          PubSubConfig      `yaml:"pubsub"`
+  Pushgateway     PushgatewayConfig `yaml:"pushgateway"`
+  Monitoring      MonitoringConfig  `yaml:"monitoring"`
+  Email           EmailConfig       `yaml:"email"`
+  Healthcheck     HealthcheckConfig `yaml:"healthcheck"`
+  BigQuery        BigQueryConfig    `yaml:"bigquery"`
+  Webhooks        []WebhookConfig   `yaml:"webhooks,omitempty"`
+  Alerting        AlertingConfig    `yaml:"alerting"`
+}
+
+// AlertingConfig pages on the failed runs, and resolves the alerts after a
+// successful run.
+type AlertingConfig struct {
+  PagerDutyRoutingKey string   `yaml:"pagerdutyRoutingKey"`
+  OpsgenieAPIKey      string   `yaml:"opsgenieApiKey"`
+  // backups.OpsgenieURL if empty
+  OpsgenieURL         string   `yaml:"opsgenieUrl"`
+  // backups.DefaultAlertConditions if empty
+  On                  []string `yaml:"on,omitempty"`
+}
+
+// WebhookConfig is a URL the summary of the runs is posted to.
+type WebhookConfig struct {
+  URL      string            `yaml:"url"`
+  // Go text/template over the summary, backups.DefaultWebhookTemplate if
+  // empty
+  Template string            `yaml:"template"`
+  Headers  map[string]string `yaml:"headers,omitempty"`
+}
+
+// BigQueryConfig is the table of the outcome of the disks of the runs.
+type BigQueryConfig struct {
+  // As project.dataset.table
+  Table string `yaml:"table"`
+}
+
+type PubSubConfig struct {
+  Topic   string `yaml:"topic"`
+  PerDisk bool   `yaml:"perDisk"`
+}
+
+// MonitoringConfig is the Cloud Monitoring custom metrics of the runs.
+type MonitoringConfig struct {
+  Enabled      bool              `yaml:"enabled"`
+  // Project of the metrics, the project of the run if empty
+  Project      string            `yaml:"project"`
+  MetricPrefix string            `yaml:"metricPrefix"`
+  // Added to the labels of all the metrics
+  Labels       map[string]string `yaml:"labels,omitempty"`
+}
+
+// HealthcheckConfig is the dead man's switch pinged by the backup.
+type HealthcheckConfig struct {
+  URL     string `yaml:"url"`
+  // The /fail suffix of the URL if empty
+  FailURL string `yaml:"failUrl"`
+  Post    bool   `yaml:"post"`
+  Start   bool   `yaml:"start"`
+}
+
+// EmailConfig is the SMTP server to send the summary by email with. The
+// credentials are only read from $SMTP_USERNAME and $SMTP_PASSWORD.
+type EmailConfig struct {
+  Host     string   `yaml:"host"`
+  Port     int      `yaml:"port"`
+  TLS      string   `yaml:"tls"`
+  From     string   `yaml:"from"`
+  To       []string `yaml:"to,omitempty"`
+  Username string   `yaml:"-"`
+  Password string   `yaml:"-"`
+}
+
+type PushgatewayConfig struct {
+  URL      string `yaml:"url"`
+  Job      string `yaml:"job"`
+  Instance string `yaml:"instance"`
+  PerDisk  bool   `yaml:"perDisk"`
+}
+
+// PlanConfig is a named set of disks with their own retention, run in the
+// same invocation as the other plans. The fields which are not set keep the
+// global values.
+type PlanConfig struct {
+  Name          string                `yaml:"name"`
+  Filter        *string               `yaml:"filter,omitempty"`
+  ExcludeFilter *string               `yaml:"excludeFilter,omitempty"`
+  InstanceFilter *string              `yaml:"instanceFilter,omitempty"`
+  Retention     RetentionOverride     `yaml:"retention,omitempty"`
+  // Added to the global labels
+  Labels        map[string]string     `yaml:"labels,omitempty"`
+  // Added to the global overrides by disk name
+  Disks         map[string]DiskConfig `yaml:"disks,omitempty"`
+}
+
+// DiskConfig overrides the configuration for a disk. The retention fields
+// which are not set keep the global values.
+type DiskConfig struct {
+  Retention RetentionOverride `yaml:"retention"`
+}
+
+type RetentionOverride struct {
+  Mode        *string        `yaml:"mode,omitempty"`
+  Limit       *int           `yaml:"limit,omitempty"`
+  MaxAge      *time.Duration `yaml:"maxAge,omitempty"`
+  MaxAgeDays  *int           `yaml:"maxAgeDays,omitempty"`
+  KeepDaily   *int           `yaml:"keepDaily,omitempty"`
+  KeepWeekly  *int           `yaml:"keepWeekly,omitempty"`
+  KeepMonthly *int           `yaml:"keepMonthly,omitempty"`
+  MonthlyType *string        `yaml:"monthlyType,omitempty"`
+}
+
+func defaultConfig() Config {
+  return Config{
+    Mode: backups.ModeFull,
+    Output: outputAuto,
+    DefaultFrequency: backups.FrequencyAlways,
+    QuotaBehavior: backups.QuotaAbort,
+    MaxDeletionPercent: 50,
+    CleanupFailed: true,
+    Order: backups.OrderStaleness,
+    DeletionGrace: 72 * time.Hour,
+    OrphanMaxAge: 30 * 24 * time.Hour,
+    MinKeep: 1,
+    MaxStaleness: 26 * time.Hour,
+    DrillSample: 1,
+    PricePerGbMonth: backups.DefaultPricePerGbMonth,
+    ArchivePricePerGbMonth: backups.DefaultArchivePricePerGbMonth,
+    Filter: "labels.env = production",
+    Retention: RetentionConfig{Mode: backups.RetentionBoth, Limit: 7},
+    InstantLimit: 3,
+    WaitTimeout: 30 * time.Minute,
+    GracePeriod: 20 * time.Second,
+    MaxRetries: 3,
+    PlanConcurrency: 1,
+    MaxPlanAge: 24 * time.Hour,
+    OperationTimeout: 15 * time.Minute,
+    ResumeMaxAge: 24 * time.Hour,
+    Interval: 24 * time.Hour,
+    LockTTL: 10 * time.Minute,
+    ServeSecret: os.Getenv("BACKUP_SERVE_SECRET"),
+    NameTemplate: backups.DefaultNameTemplate,
+    DescriptionTemplate: backups.DefaultDescriptionTemplate,
+    Backend: "gcloud",
+    GcloudPath: "gcloud",
+    Notifications: NotificationsConfig{
+      NotifyOn: backups.NotifyAlways,
+      SlackWebhookURL: os.Getenv("SLACK_WEBHOOK_URL"),
+      Alerting: AlertingConfig{PagerDutyRoutingKey: os.Getenv("PAGERDUTY_ROUTING_KEY"), OpsgenieAPIKey: os.Getenv("OPSGENIE_API_KEY")},
+      Pushgateway: PushgatewayConfig{Job: "gcp_backups"},
+      Monitoring: MonitoringConfig{MetricPrefix: backups.DefaultMetricPrefix},
+      Email: EmailConfig{Port: 587, TLS: backups.SMTPStartTLS, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD")},
+    },
+  }
+}
+
+// loadConfig reads the YAML file over the config. Unknown keys are errors.
+func loadConfig(path string, config *Config) error {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return err
+  }
+
+  decoder := yaml.NewDecoder(bytes.NewReader(data))
+  decoder.KnownFields(true)
+  err = decoder.Decode(config)
+  if err != nil && !errors.Is(err, io.EOF) {
+    return fmt.Errorf("Invalid config file %s: %w", path, err)
+  }
+  return nil
+}
+
+// Flags which are not part of the config
+type cliFlags struct {
+  configFile     string
+  validateConfig bool
+  testEmail      bool
+  // Webhooks added to the ones of the config file
+  webhookURLs     []string
+  webhookTemplate string
+  webhookHeaders  map[string]string
+}
+
+// newFlagSet binds the flags to the config, with its current values as
+// defaults: parsing only overrides the values of the given flags.
+func newFlagSet(config *Config, cli *cliFlags) *flag.FlagSet {
+  flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+  flags.StringVar(&cli.configFile, "config", "", "YAML config file, overridden by the flags")
+  flags.BoolVar(&cli.validateConfig, "validate-config", false, "Print the effective config and exit")
+  flags.BoolVar(&cli.testEmail, "test-email", false, "Send a sample summary by email and exit")
+
+  flags.StringVar(&config.Project, "project", config.Project, "Project of the disks, passed to every gcloud command or API call (default $GOOGLE_CLOUD_PROJECT, $CLOUDSDK_CORE_PROJECT or the configured one)")
+  flags.Var((*stringList)(&config.Projects), "projects", "Comma-separated projects of the disks, the default project if empty")
+  flags.BoolVar(&config.AllProjects, "all-projects", config.AllProjects, "Back up all the active projects, instead of --projects")
+  flags.StringVar(&config.Mode, "mode", config.Mode, "Create the snapshots and delete the old ones (full), only create them (backup) or only delete the old ones (prune)")
+  flags.StringVar(&config.Filter, "filter", config.Filter, "Filter to use for disks to snapshot")
+  flags.StringVar(&config.ExcludeFilter, "exclude-filter", config.ExcludeFilter, "Filter to use for disks to never snapshot")
+  flags.Var((*stringList)(&config.DiskNames), "disks", "Comma-separated names of the disks to back up among the ones of --filter, as name or name:zone, use --filter \"\" to pick them among all the disks")
+  flags.Var((*stringList)(&config.ExcludeDisks), "exclude-disks", "Comma-separated names of the disks to skip, as name or name:zone")
+  flags.StringVar(&config.NameRegex, "name-regex", config.NameRegex, "Regular expression of the names of the disks of --filter to back up, e.g. \"-data$\"")
+  flags.StringVar(&config.NameRegexExclude, "name-regex-exclude", config.NameRegexExclude, "Regular expression of the names of the disks to skip, e.g. \"-tmp$\"")
+  flags.Int64Var(&config.MinSizeGb, "min-size-gb", config.MinSizeGb, "Only back up the disks of at least this size in GB")
+  flags.Int64Var(&config.MaxSizeGb, "max-size-gb", config.MaxSizeGb, "Only back up the disks of at most this size in GB, e.g. to skip the big scratch disks")
+  flags.Var((*stringList)(&config.DiskTypes), "disk-types", "Comma-separated types of the disks to back up, e.g. pd-ssd,hyperdisk-balanced (or hdb), all by default")
+  flags.BoolVar(&config.StrictDisks, "strict-disks", config.StrictDisks, "Fail when a name of --disks or --exclude-disks matches no disk, instead of a warning")
+  flags.Var((*stringList)(&config.Zones), "zones", "Comma-separated zones of the disks, listed in parallel, instead of all the zones and regions")
+  flags.Var((*stringList)(&config.Regions), "regions", "Comma-separated regions of the regional disks, listed in parallel, instead of all the zones and regions")
+  flags.StringVar(&config.InstanceFilter, "instance-filter", config.InstanceFilter, "Filter of the instances whose attached disks are snapshotted too, use --filter \"\" to only snapshot them")
+  flags.IntVar(&config.Retention.Limit, "limit", config.Retention.Limit, "Number of snapshots to keep")
+  flags.DurationVar(&config.Retention.MaxAge, "max-age", config.Retention.MaxAge, "Age of the snapshots to delete (e.g. 720h), no age limit if 0")
+  flags.IntVar(&config.Retention.MaxAgeDays, "max-age-days", config.Retention.MaxAgeDays, "Age in days of the snapshots to delete, instead of --max-age")
+  flags.StringVar(&config.Retention.Mode, "retention-mode", config.Retention.Mode, "Delete the snapshots beyond the limit (count), older than the max age (age) or both")
+  flags.IntVar(&config.Retention.KeepDaily, "keep-daily", config.Retention.KeepDaily, "Number of daily snapshots to keep, replaces --limit (0 to disable)")
+  flags.IntVar(&config.Retention.KeepWeekly, "keep-weekly", config.Retention.KeepWeekly, "Number of weekly snapshots to keep, replaces --limit (0 to disable)")
+  flags.IntVar(&config.Retention.KeepMonthly, "keep-monthly", config.Retention.KeepMonthly, "Number of monthly snapshots to keep, replaces --limit (0 to disable)")
+  flags.StringVar(&config.Retention.MonthlyType, "monthly-type", config.Retention.MonthlyType, "Type of the first snapshot of each month with --keep-monthly, STANDARD or ARCHIVE, kept as the monthly snapshot (default --snapshot-type)")
+  flags.BoolVar(&config.OwnSnapshotsOnly, "own-snapshots-only", config.OwnSnapshotsOnly, "Only list and prune the snapshots with the created-by=gcp-backups label")
+  flags.BoolVar(&config.FailFast, "fail-fast", config.FailFast, "Stop when the snapshots can't be listed at once, instead of listing them disk by disk and skipping the failing disks")
+  flags.IntVar(&config.Concurrency, "concurrency", config.Concurrency, "Maximum number of snapshot creations or deletions at the same time, no limit if 0")
+  flags.IntVar(&config.PlanConcurrency, "plan-concurrency", config.PlanConcurrency, "Number of plans or projects run at the same time")
+  flags.StringVar(&config.NameTemplate, "name-template", config.NameTemplate, "Template of the snapshot names, with {disk}, {diskId}, {zone}, {project}, {date:<Go layout>}, {unix} and {random}, e.g. bk-{disk}-{date:20060102}")
+  flags.StringVar(&config.ChainNameTemplate, "chain-name-template", config.ChainNameTemplate, "Template of the snapshot chain of each disk, with {disk}, {diskId}, {zone} and {project}, e.g. {disk}-hourly, overridden by the " + backups.ChainNameLabel + " label of the disks, without chain if empty")
+  flags.StringVar(&config.DescriptionTemplate, "description-template", config.DescriptionTemplate, "Template of the snapshot descriptions, with the variables of --name-template and {tool}, {version}, {runId}, {instances} and {retention}")
+  flags.StringVar(&config.SnapshotType, "snapshot-type", config.SnapshotType, "Type of the snapshots, STANDARD or ARCHIVE (cheaper for long retentions), overridden by the " + backups.SnapshotTypeLabel + " label of the disks")
+  flags.Var((*labelsFlag)(&config.Labels), "extra-labels", "Comma-separated key=value labels added to the created snapshots, over the labels of their disk")
+  flags.StringVar(&config.StorageLocation, "storage-location", config.StorageLocation, "Region or multi-region of the snapshots (e.g. europe-west1), overridden by the backup-location label of the disks, chosen by GCE if empty")
+  flags.StringVar(&config.CopyToLocation, "copy-to-location", config.CopyToLocation, "Region where the snapshots are copied once READY, for a disaster recovery, through a temporary disk")
+  flags.StringVar(&config.CopyZone, "copy-zone", config.CopyZone, "Zone of the temporary disks of the copies, the b zone of --copy-to-location by default")
+  flags.IntVar(&config.CopyLimit, "copy-limit", config.CopyLimit, "Number of copies kept by disk, 0 for the retention of the disk")
+  flags.BoolVar(&config.InstantSnapshots, "instant-snapshots", config.InstantSnapshots, "Create an instant snapshot of each disk too, in its zone or region, for fast restores")
+  flags.IntVar(&config.InstantLimit, "instant-limit", config.InstantLimit, "Number of instant snapshots kept by disk, whatever the retention of the snapshots")
+  flags.BoolVar(&config.SkipScheduledDisks, "skip-scheduled-disks", config.SkipScheduledDisks, "Skip the disks having a snapshot schedule resource policy, instead of snapshotting them with a warning")
+  flags.BoolVar(&config.GuestFlush, "guest-flush", config.GuestFlush, "Create application-consistent snapshots, needs the guest agent (the backup-guest-flush=true/false label of the disks overrides it)")
+  flags.BoolVar(&config.GuestFlushFallback, "guest-flush-fallback", config.GuestFlushFallback, "Create a crash-consistent snapshot when a guest flush snapshot fails")
+  flags.BoolVar(&config.StampDisks, "stamp-disks", config.StampDisks, "Label the disks with the time (" + backups.LastBackupLabel + "=YYYYMMDDHHMM, UTC) and the name (" + backups.LastBackupSnapshotLabel + ") of their new snapshot")
+  flags.StringVar(&config.DefaultFrequency, "default-frequency", config.DefaultFrequency, "How often the disks without a " + backups.FrequencyLabel + " label are snapshotted: always (every run), hourly, daily or weekly, from the age of their newest snapshot")
+  flags.BoolVar(&config.GroupByInstance, "group-by-instance", config.GroupByInstance, "Snapshot the disks of each instance together, with a shared " + backups.GroupLabel + " label")
+  flags.StringVar(&config.KmsKey, "snapshot-kms-key", config.KmsKey, "Cloud KMS key encrypting the snapshots, as projects/.../locations/.../keyRings/.../cryptoKeys/... (the backup-kms-key label of the disks overrides it with an alias of the kmsKeys of the config file)")
+  flags.BoolVar(&config.DryRun, "dry-run", config.DryRun, "Don't really do backups and deletions but show logs")
+  flags.BoolVar(&config.Yes, "yes", config.Yes, "Delete the old snapshots without asking for a confirmation, needed without a terminal")
+  flags.BoolVar(&config.Verbose, "verbose", config.Verbose, "Also log the gcloud commands or API calls run and their duration")
+  flags.BoolVar(&config.Verbose, "v", config.Verbose, "Shorthand of --verbose")
+  flags.BoolVar(&config.Quiet, "quiet", config.Quiet, "Only log the warnings, the failures and the summary of the run")
+  flags.StringVar(&config.Output, "output", config.Output, "Log the disks found and the summary as tables (pretty), as log lines (log), or as tables on a terminal only (auto)")
+  flags.BoolVar(&config.NoColor, "no-color", config.NoColor, "Don't color the tables of --output pretty (default $NO_COLOR)")
+  flags.IntVar(&config.MaxRetries, "max-retries", config.MaxRetries, "Number of retries of the gcloud commands or API calls failing with a transient error")
+  flags.DurationVar(&config.Timeout, "timeout", config.Timeout, "Maximum duration of the whole run (e.g. 1h), no limit if 0")
+  flags.DurationVar(&config.GracePeriod, "grace-period", config.GracePeriod, "On SIGINT or SIGTERM, time given to the operations in progress to complete before killing them, no new operation being started")
+  flags.DurationVar(&config.OperationTimeout, "operation-timeout", config.OperationTimeout, "Maximum duration of each snapshot creation or deletion, its command is killed on expiry, no limit if 0")
+  flags.DurationVar(&config.OperationTimeout, "per-operation-timeout", config.OperationTimeout, "Deprecated alias of --operation-timeout")
+  flags.BoolVar(&config.Wait, "wait", config.Wait, "Wait for the created snapshots to be READY before deleting old snapshots")
+  flags.DurationVar(&config.WaitTimeout, "wait-timeout", config.WaitTimeout, "Maximum duration of the wait for each snapshot to be READY, no limit if 0")
+  flags.BoolVar(&config.PruneOnCreateFailure, "prune-on-create-failure", config.PruneOnCreateFailure, "Delete the old snapshots of a disk even when its new snapshot failed")
+  flags.IntVar(&config.MaxDeletionsPerRun, "max-deletions-per-run", config.MaxDeletionsPerRun, "Abort the prune phase if it would delete more snapshots, 0 for no limit")
+  flags.IntVar(&config.MaxCreations, "max-creations", config.MaxCreations, "Create this many snapshots at most, for the first disks in --order, deferring the other disks to a next run without pruning them, 0 for no limit")
+  flags.StringVar(&config.Order, "order", config.Order, "Order of the disks to snapshot: the disks without a snapshot then the ones with the oldest snapshot first (staleness), by name (name) or as listed (none)")
+  flags.Float64Var(&config.MaxDeletionPercent, "max-deletion-percent", config.MaxDeletionPercent, "Abort the prune phase if it would delete a larger percentage of the snapshots of the disks, 0 for no limit")
+  flags.BoolVar(&config.Force, "force", config.Force, "Delete the old snapshots even beyond --max-deletions-per-run and --max-deletion-percent")
+  flags.DurationVar(&config.DeletionGrace, "deletion-grace", config.DeletionGrace, "Mark the old snapshots with the " + backups.PendingDeleteLabel + " label, and only delete them once marked for this duration")
+  flags.BoolVar(&config.HardDelete, "hard-delete", config.HardDelete, "Delete the old snapshots at once, without --deletion-grace")
+  flags.BoolVar(&config.ForceDeleteReferenced, "force-delete-referenced", config.ForceDeleteReferenced, "Delete the old snapshots even when images or disks were created from them")
+  flags.BoolVar(&config.RespectTTLOnly, "respect-ttl-only", config.RespectTTLOnly, "Only delete the snapshots past the date of their " + backups.ExpiresLabel + " label, not the ones beyond the retention limit")
+  flags.BoolVar(&config.CleanupFailed, "cleanup-failed", config.CleanupFailed, "Delete the FAILED snapshots at once, whatever the retention (only the READY snapshots count in it)")
+  flags.BoolVar(&config.NoRefresh, "no-refresh", config.NoRefresh, "Prune from the first listing, without listing the snapshots again before the prune phase")
+  flags.BoolVar(&config.Phased, "phased", config.Phased, "Run the phases one after the other, pruning the disks once all the snapshots are created, instead of pruning each disk once its snapshot is created")
+  flags.BoolVar(&config.Stream, "stream", config.Stream, "List the disks and their snapshots page by page, snapshotting each disk as soon as its page is listed, instead of once all of them are")
+  flags.Var((*labelingFlag)(&config.EnforceLabeling), "enforce-labeling", "Fail the run when disks of the project are neither backed up nor opted out with the " + backups.BackupLabel + "=false label, or only report them with --enforce-labeling=warn")
+  flags.StringVar(&config.Orphans, "orphans", config.Orphans, "Look for the snapshots created by this program of the deleted disks, and list them (report) or delete them (delete)")
+  flags.DurationVar(&config.OrphanMaxAge, "orphan-max-age", config.OrphanMaxAge, "Minimum age of the orphaned snapshots deleted by --orphans=delete")
+  flags.IntVar(&config.MinKeep, "min-keep", config.MinKeep, "Number of READY snapshots created by this program always kept for each disk, orphans included, whatever the retention (0 to disable)")
+  flags.Float64Var(&config.PricePerGbMonth, "price-per-gb-month", config.PricePerGbMonth, "Price of the snapshot storage by GB and month, for the estimated costs of the summary, 0 to not estimate them")
+  flags.StringVar(&config.CostLabel, "cost-label", config.CostLabel, "Label of the snapshots grouping the estimated costs by value, like team")
+  flags.StringVar(&config.QuotaBehavior, "quota-behavior", config.QuotaBehavior, "When the snapshots to create exceed the snapshot quota of the project: create nothing (abort), create them up to the quota (partial) or don't check it (ignore)")
+  flags.StringVar(&config.SummaryFile, "summary-file", config.SummaryFile, "Path of a JSON file to write the summary of the run to")
+  flags.StringVar(&config.PlanOut, "plan-out", config.PlanOut, "Path of a JSON file to write the snapshots the dry run would create and delete to")
+  flags.StringVar(&config.ApplyPlan, "apply-plan", config.ApplyPlan, "Create and delete exactly the snapshots of this plan file of --plan-out")
+  flags.StringVar(&config.ReportGCS, "report-gcs", config.ReportGCS, "GCS folder to upload the JSON summary and plan of each run to, as gs://bucket/prefix/")
+  flags.StringVar(&config.ReportCredentialsFile, "report-credentials-file", config.ReportCredentialsFile, "Service account key file of the --report-gcs uploads, the Application Default Credentials by default")
+  flags.BoolVar(&config.VerifyOnly, "verify-only", config.VerifyOnly, "Only check that the newest snapshot of each disk created by this program is READY and recent, and fail otherwise, without creating nor deleting anything")
+  flags.DurationVar(&config.MaxStaleness, "max-staleness", config.MaxStaleness, "Maximum age of the newest snapshot of each disk with --verify-only")
+  flags.IntVar(&config.DrillSample, "sample", config.DrillSample, "Number of disks, chosen at random, whose newest snapshot is restored by the drill subcommand, all the --disks if given")
+  flags.StringVar(&config.DrillZone, "scratch-zone", config.DrillZone, "Zone of the temporary disks of the drill subcommand")
+  flags.DurationVar(&config.MaxPlanAge, "max-plan-age", config.MaxPlanAge, "Refuse to apply a plan older than this, no limit if 0")
+  flags.StringVar(&config.ProgressFile, "progress-file", config.ProgressFile, "File to append the progress events of the runs to as they happen, as newline-delimited JSON")
+  flags.IntVar(&config.ProgressFD, "progress-fd", config.ProgressFD, "Open file descriptor to write the progress events of the runs to as they happen, e.g. 3, instead of --progress-file")
+  flags.StringVar(&config.StateFile, "state-file", config.StateFile, "Local path or gs://bucket/object to write the progress of the run to, as it goes")
+  flags.BoolVar(&config.Resume, "resume", config.Resume, "Resume the run of the --state-file, without snapshotting again its disks")
+  flags.DurationVar(&config.ResumeMaxAge, "resume-max-age", config.ResumeMaxAge, "Refuse to resume a state file not updated for this long, no limit if 0")
+  flags.StringVar(&config.RunID, "run-id", config.RunID, "Id of the run in the logs, the labels of the snapshots and the reports, generated from the time if empty")
+  flags.Var((*stringList)(&cli.webhookURLs), "webhook-url", "Comma-separated URLs to POST the summary of the run to, with --webhook-template and --webhook-header")
+  flags.StringVar(&cli.webhookTemplate, "webhook-template", cli.webhookTemplate, "Go text/template of the body of the webhooks over the summary, with a json function (default project, filter, counts, failures and run id as JSON)")
+  flags.Var((*headersFlag)(&cli.webhookHeaders), "webhook-header", "Header of the webhooks as key:value, can be repeated")
+  flags.StringVar(&config.Notifications.Alerting.PagerDutyRoutingKey, "pagerduty-routing-key", config.Notifications.Alerting.PagerDutyRoutingKey, "Routing key of a PagerDuty Events v2 integration to alert on the failed runs (default $PAGERDUTY_ROUTING_KEY)")
+  flags.StringVar(&config.Notifications.Alerting.OpsgenieAPIKey, "opsgenie-api-key", config.Notifications.Alerting.OpsgenieAPIKey, "API key of an Opsgenie integration to alert on the failed runs (default $OPSGENIE_API_KEY)")
+  flags.StringVar(&config.Notifications.Alerting.OpsgenieURL, "opsgenie-url", config.Notifications.Alerting.OpsgenieURL, "Opsgenie API, e.g. https://api.eu.opsgenie.com (default " + backups.OpsgenieURL + ")")
+  flags.Var((*stringList)(&config.Notifications.Alerting.On), "alert-on", "Comma-separated conditions of the alerts: failure, all-failed (nothing created nor deleted) or stale (of --verify-only) (default all-failed,stale)")
+  flags.StringVar(&config.Notifications.SlackWebhookURL, "slack-webhook-url", config.Notifications.SlackWebhookURL, "Slack incoming webhook to notify at the end of the run (default $SLACK_WEBHOOK_URL)")
+  flags.StringVar(&config.Notifications.NotifyOn, "notify-on", config.Notifications.NotifyOn, "Notify at the end of every run (always) or only on failure (failure)")
+  flags.StringVar(&config.Notifications.PubSub.Topic, "pubsub-topic", config.Notifications.PubSub.Topic, "Pub/Sub topic to publish the summary of the run to, as projects/<project>/topics/<topic>")
+  flags.BoolVar(&config.Notifications.PubSub.PerDisk, "pubsub-per-disk", config.Notifications.PubSub.PerDisk, "Also publish a message for each snapshot created, deleted or failed")
+  flags.StringVar(&config.Notifications.BigQuery.Table, "bigquery-table", config.Notifications.BigQuery.Table, "BigQuery table to insert a row by disk and run into, as project.dataset.table, created if needed")
+  flags.StringVar(&config.Notifications.Email.Host, "smtp-host", config.Notifications.Email.Host, "SMTP server to send the summary of the run by email with, authenticated with $SMTP_USERNAME and $SMTP_PASSWORD if set")
+  flags.IntVar(&config.Notifications.Email.Port, "smtp-port", config.Notifications.Email.Port, "Port of the SMTP server")
+  flags.StringVar(&config.Notifications.Email.TLS, "smtp-tls", config.Notifications.Email.TLS, "Upgrade the SMTP connection to TLS (starttls), connect with TLS (tls) or don't encrypt it (none)")
+  flags.StringVar(&config.Notifications.Email.From, "email-from", config.Notifications.Email.From, "Sender of the emails")
+  flags.Var((*stringList)(&config.Notifications.Email.To), "email-to", "Comma-separated recipients of the emails")
+  flags.StringVar(&config.Notifications.Pushgateway.URL, "pushgateway-url", config.Notifications.Pushgateway.URL, "Prometheus Pushgateway to push the metrics of the run to")
+  flags.StringVar(&config.Notifications.Pushgateway.Job, "pushgateway-job", config.Notifications.Pushgateway.Job, "Job label of the pushed metrics")
+  flags.StringVar(&config.Notifications.Pushgateway.Instance, "pushgateway-instance", config.Notifications.Pushgateway.Instance, "Instance label of the pushed metrics (default the hostname)")
+  flags.BoolVar(&config.Notifications.Pushgateway.PerDisk, "per-disk-metrics", config.Notifications.Pushgateway.PerDisk, "Also push metrics for each disk")
+  flags.StringVar(&config.Notifications.Healthcheck.URL, "healthcheck-url", config.Notifications.Healthcheck.URL, "URL to ping when the backup succeeds, e.g. https://hc-ping.com/<uuid>")
+  flags.StringVar(&config.Notifications.Healthcheck.FailURL, "healthcheck-url-fail", config.Notifications.Healthcheck.FailURL, "URL to ping when the backup fails, the healthcheck URL with the /fail suffix by default")
+  flags.BoolVar(&config.Notifications.Healthcheck.Post, "healthcheck-post", config.Notifications.Healthcheck.Post, "POST the JSON report to the healthcheck URLs, instead of a GET")
+  flags.BoolVar(&config.Notifications.Healthcheck.Start, "healthcheck-start", config.Notifications.Healthcheck.Start, "Also ping the healthcheck URL with the /start suffix when the backup starts")
+  flags.StringVar(&config.OTLPEndpoint, "otlp-endpoint", config.OTLPEndpoint, "OTLP/HTTP endpoint to export the traces of the runs to, e.g. http://localhost:4318, $OTEL_EXPORTER_OTLP_ENDPOINT by default")
+  flags.BoolVar(&config.Notifications.Monitoring.Enabled, "cloud-monitoring", config.Notifications.Monitoring.Enabled, "Write the last success of each disk and the success of the run to Cloud Monitoring")
+  flags.StringVar(&config.Notifications.Monitoring.Project, "monitoring-project", config.Notifications.Monitoring.Project, "Project of the Cloud Monitoring metrics, the project of the run by default")
+  flags.StringVar(&config.Notifications.Monitoring.MetricPrefix, "monitoring-metric-prefix", config.Notifications.Monitoring.MetricPrefix, "Prefix of the Cloud Monitoring metric types, e.g. custom.googleapis.com/gcp_backups_staging")
+  flags.Var((*labelsFlag)(&config.Notifications.Monitoring.Labels), "monitoring-labels", "Comma-separated key=value labels added to the Cloud Monitoring metrics, e.g. env=staging")
+  flags.BoolVar(&config.Daemon, "daemon", config.Daemon, "Loop forever, running the backup every --interval instead of once")
+  flags.DurationVar(&config.Interval, "interval", config.Interval, "Interval between the starts of the runs of the daemon")
+  flags.StringVar(&config.At, "at", config.At, "Local time of the day of the runs of the daemon (e.g. 02:00), the first run starts at once if empty")
+  flags.Var(&repeatedFlag{list: &config.Schedules}, "schedule", "5-field cron expression of the runs of the daemon (e.g. \"30 2 * * 1-5\"), instead of --interval and --at, can be repeated")
+  flags.StringVar(&config.ScheduleTZ, "schedule-tz", config.ScheduleTZ, "Time zone of the schedules (e.g. Europe/Paris), the local one by default")
+  flags.DurationVar(&config.Jitter, "jitter", config.Jitter, "Maximum random delay of the runs of the daemon (e.g. 10m), to spread the runs across projects")
+  flags.StringVar(&config.LockGCS, "lock-gcs", config.LockGCS, "GCS object to lock, as gs://bucket/object, so only one run is in progress at a time")
+  flags.DurationVar(&config.LockTTL, "lock-ttl", config.LockTTL, "Duration after which a lock which wasn't refreshed, e.g. after a crash, can be taken over")
+  flags.StringVar(&config.Serve, "serve", config.Serve, "Address to listen on (e.g. :8080), to run the backup on POST /run instead of once")
+  flags.StringVar(&config.Backend, "backend", config.Backend, "Use the gcloud command (gcloud) or the Compute Engine API (api)")
+  flags.StringVar(&config.GcloudPath, "gcloud-path", config.GcloudPath, "Path of the gcloud command, searched in the PATH by default")
+  credentialsFlags(flags, &config.ImpersonateServiceAccount, &config.CredentialsFile, &config.BillingProject)
+  flags.BoolVar(&config.SkipPreflight, "skip-preflight", config.SkipPreflight, "Don't check that gcloud is installed and configured before starting")
+
+  return flags
+}
+
+// credentialsFlags adds the flags of the identity of the backend, shared by
+// the subcommands.
+func credentialsFlags(flags *flag.FlagSet, impersonate *string, credentialsFile *string, billingProject *string) {
+  flags.StringVar(impersonate, "impersonate-service-account", *impersonate, "Email of a service account to impersonate for the gcloud commands and API calls, instead of a key")
+  flags.StringVar(credentialsFile, "credentials-file", *credentialsFile, "Service account key file used instead of the gcloud account or the application default credentials")
+  flags.StringVar(billingProject, "billing-project", *billingProject, "Project billed for the quota of the gcloud commands and API calls")
+}
+
+// envProject returns the project of the GOOGLE_CLOUD_PROJECT or
+// CLOUDSDK_CORE_PROJECT environment variable, empty if none is set.
+func envProject() string {
+  project := os.Getenv("GOOGLE_CLOUD_PROJECT")
+  if project == "" {
+    project = os.Getenv("CLOUDSDK_CORE_PROJECT")
+  }
+  return project
+}
+
+// project returns the project of the run, from --project or the environment,
+// empty for the default one of the backend or with --projects or
+// --all-projects.
+func (config Config) project() string {
+  if len(config.Projects) > 0 || config.AllProjects {
+    return ""
+  }
+  if config.Project != "" {
+    return config.Project
+  }
+  return envProject()
+}
+
+// backsUp tells if the runs back up the disks, not only verifying or
+// drilling their snapshots.
+func (config Config) backsUp() bool {
+  return !config.VerifyOnly && !config.Drill
+}
+
+// credentials returns the identity of the backend.
+func (config Config) credentials() backups.Credentials {
+  return backups.Credentials{ImpersonateServiceAccount: config.ImpersonateServiceAccount, CredentialsFile: config.CredentialsFile, BillingProject: config.BillingProject}
+}
+
+// stringList is a flag of comma-separated values.
+type stringList []string
+
+func (list *stringList) String() string {
+  if list == nil {
+    return ""
+  }
+  return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+  *list = make([]string, 0)
+  values := strings.Split(value, ",")
+  for valueIndex := 0; valueIndex < len(values); valueIndex++ {
+    trimmed := strings.TrimSpace(values[valueIndex])
+    if trimmed != "" {
+      *list = append(*list, trimmed)
+    }
+  }
+  return nil
+}
+
+// headersFlag is a repeated flag of key:value HTTP headers.
+type headersFlag map[string]string
+
+func (headers *headersFlag) String() string {
+  if headers == nil || *headers == nil {
+    return ""
+  }
+  pairs := make([]string, 0, len(*headers))
+  for key, value := range *headers {
+    pairs = append(pairs, key + ":" + value)
+  }
+  sort.Strings(pairs)
+  return strings.Join(pairs, ",")
+}
+
+func (headers *headersFlag) Set(value string) error {
+  if *headers == nil {
+    *headers = make(map[string]string)
+  }
+  key, headerValue, found := strings.Cut(value, ":")
+  key = strings.TrimSpace(key)
+  if !found || key == "" {
+    return fmt.Errorf("Invalid header '%s', use key:value", value)
+  }
+  (*headers)[key] = strings.TrimSpace(headerValue)
+  return nil
+}
+
+// labelingFlag is --enforce-labeling, alone for LabelingError, or with the
+// mode like --enforce-labeling=warn.
+type labelingFlag string
+
+func (mode *labelingFlag) String() string {
+  if mode == nil {
+    return ""
+  }
+  return string(*mode)
+}
+
+func (mode *labelingFlag) Set(value string) error {
+  switch value {
+  case "true":
+    *mode = backups.LabelingError
+  case "false":
+    *mode = ""
+  default:
+    *mode = labelingFlag(value)
+  }
+  return nil
+}
+
+func (mode *labelingFlag) IsBoolFlag() bool {
+  return true
+}
+
+// repeatedFlag is a flag which can be repeated, each value adding to the
+// list. The values of the command line replace the ones of the config file.
+type repeatedFlag struct {
+  list *[]string
+  set  bool
+}
+
+func (repeated *repeatedFlag) String() string {
+  if repeated == nil || repeated.list == nil {
+    return ""
+  }
+  return strings.Join(*repeated.list, "; ")
+}
+
+func (repeated *repeatedFlag) Set(value string) error {
+  if !repeated.set {
+    *repeated.list = make([]string, 0)
+    repeated.set = true
+  }
+  *repeated.list = append(*repeated.list, value)
+  return nil
+}
+
+// labelsFlag is a flag of comma-separated key=value labels, added to the
+// labels of the config file.
+type labelsFlag map[string]string
+
+func (labels *labelsFlag) String() string {
+  if labels == nil || *labels == nil {
+    return ""
+  }
+  pairs := make([]string, 0, len(*labels))
+  for key, value := range *labels {
+    pairs = append(pairs, key + "=" + value)
+  }
+  sort.Strings(pairs)
+  return strings.Join(pairs, ",")
+}
+
+func (labels *labelsFlag) Set(value string) error {
+  if *labels == nil {
+    *labels = make(map[string]string)
+  }
+  pairs := strings.Split(value, ",")
+  for pairIndex := 0; pairIndex < len(pairs); pairIndex++ {
+    pair := strings.TrimSpace(pairs[pairIndex])
+    if pair == "" {
+      continue
+    }
+    key, labelValue, found := strings.Cut(pair, "=")
+    if !found || key == "" {
+      return fmt.Errorf("Invalid label '%s', use key=value", pair)
+    }
+    (*labels)[key] = labelValue
+  }
+  return nil
+}
+
+// parseConfig parses the flags a first time to find the config file, then
+// parses them again over the config file values.
+func parseConfig(args []string) (Config, cliFlags, error) {
+  config := defaultConfig()
+  var cli cliFlags
+  err := newFlagSet(&config, &cli).Parse(args)
+  if err != nil {
+    return config, cli, err
+  }
+  if cli.configFile == "" {
+    return config, cli, addWebhookFlags(&config, cli)
+  }
+
+  config = defaultConfig()
+  err = loadConfig(cli.configFile, &config)
+  if err != nil {
+    return config, cli, err
+  }
+  err = newFlagSet(&config, &cli).Parse(args)
+  if err != nil {
+    return config, cli, err
+  }
+
+  return config, cli, addWebhookFlags(&config, cli)
+}
+
+// addWebhookFlags adds the webhooks of --webhook-url to the config, with the
+// template and headers of the flags.
+func addWebhookFlags(config *Config, cli cliFlags) error {
+  if len(cli.webhookURLs) == 0 && (cli.webhookTemplate != "" || len(cli.webhookHeaders) > 0) {
+    return errors.New("--webhook-template and --webhook-header need --webhook-url")
+  }
+  for urlIndex := 0; urlIndex < len(cli.webhookURLs); urlIndex++ {
+    config.Notifications.Webhooks = append(config.Notifications.Webhooks, WebhookConfig{URL: cli.webhookURLs[urlIndex], Template: cli.webhookTemplate, Headers: cli.webhookHeaders})
+  }
+  return nil
+}
+
+// maxAge returns the max age of the retention, from MaxAge or MaxAgeDays.
+func maxAge(maxAge time.Duration, maxAgeDays int) (time.Duration, error) {
+  if maxAgeDays == 0 {
+    return maxAge, nil
+  }
+  if maxAge != 0 {
+    return 0, errors.New("Use either a max age or a max age in days")
+  }
+  return time.Duration(maxAgeDays) * 24 * time.Hour, nil
+}
+
+var locationRegexp = regexp.MustCompile(`^[a-z][-a-z0-9]*[a-z0-9]$`)
+
+var topicRegexp = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+var metricPrefixRegexp = regexp.MustCompile(`^custom\.googleapis\.com/[a-zA-Z0-9_/.]+$`)
+
+var metricLabelRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Validate checks the values which are not checked when running.
+func (config Config) Validate() error {
+  if config.Mode != backups.ModeFull && config.Mode != backups.ModeBackup && config.Mode != backups.ModePrune {
+    return fmt.Errorf("Unknown mode '%s', use '%s', '%s' or '%s'", config.Mode, backups.ModeFull, backups.ModeBackup, backups.ModePrune)
+  }
+  if config.DeletionGrace < 0 {
+    return errors.New("The deletion grace period must be positive, use --hard-delete to delete at once")
+  }
+  if config.MaxDeletionsPerRun < 0 || config.MaxDeletionPercent < 0 || config.MaxDeletionPercent > 100 {
+    return errors.New("The deletion limits must be positive, and the percentage at most 100")
+  }
+  if config.MaxCreations < 0 {
+    return errors.New("The max creations must be positive, or 0 for no limit")
+  }
+  if config.QuotaBehavior != backups.QuotaAbort && config.QuotaBehavior != backups.QuotaPartial && config.QuotaBehavior != backups.QuotaIgnore {
+    return fmt.Errorf("Unknown quota behavior '%s', use '%s', '%s' or '%s'", config.QuotaBehavior, backups.QuotaAbort, backups.QuotaPartial, backups.QuotaIgnore)
+  }
+  if config.EnforceLabeling != "" && config.EnforceLabeling != backups.LabelingError && config.EnforceLabeling != backups.LabelingWarn {
+    return fmt.Errorf("Unknown labeling enforcement '%s', use '%s' or '%s'", config.EnforceLabeling, backups.LabelingError, backups.LabelingWarn)
+  }
+  if config.Orphans != "" && config.Orphans != backups.OrphansReport && config.Orphans != backups.OrphansDelete {
+    return fmt.Errorf("Unknown orphans mode '%s', use '%s' or '%s'", config.Orphans, backups.OrphansReport, backups.OrphansDelete)
+  }
+  if config.OrphanMaxAge < 0 {
+    return errors.New("The maximum age of the orphaned snapshots must be positive")
+  }
+  if config.MinKeep < 0 {
+    return errors.New("The min keep must be positive, or 0 to disable it")
+  }
+  if config.Notifications.NotifyOn != backups.NotifyAlways && config.Notifications.NotifyOn != backups.NotifyFailure {
+    return fmt.Errorf("Unknown notify on '%s', use '%s' or '%s'", config.Notifications.NotifyOn, backups.NotifyAlways, backups.NotifyFailure)
+  }
+  if config.Backend != "gcloud" && config.Backend != "api" {
+    return fmt.Errorf("Unknown backend '%s', use 'gcloud' or 'api'", config.Backend)
+  }
+  if config.AllProjects && len(config.Projects) > 0 {
+    return errors.New("Use either a list of projects or all the projects")
+  }
+  if config.Project != "" && (config.AllProjects || len(config.Projects) > 0) {
+    return errors.New("Use either a project, a list of projects or all the projects")
+  }
+  err := backups.ValidateNameTemplate(config.NameTemplate)
+  if err != nil {
+    return err
+  }
+  if config.ChainNameTemplate != "" {
+    err = backups.ValidateChainNameTemplate(config.ChainNameTemplate)
+    if err != nil {
+      return err
+    }
+  }
+  err = backups.ValidateOrder(config.Order)
+  if err != nil {
+    return err
+  }
+  err = backups.ValidateDescriptionTemplate(config.DescriptionTemplate)
+  if err != nil {
+    return err
+  }
+  if config.Notifications.PubSub.Topic != "" && !topicRegexp.MatchString(config.Notifications.PubSub.Topic) {
+    return fmt.Errorf("Invalid Pub/Sub topic '%s', use projects/<project>/topics/<topic>", config.Notifications.PubSub.Topic)
+  }
+  if config.Notifications.BigQuery.Table != "" {
+    _, _, _, err = backups.ParseBigQueryTable(config.Notifications.BigQuery.Table)
+    if err != nil {
+      return err
+    }
+  }
+  err = backups.ValidateDiskNames(append(append([]string{}, config.DiskNames...), config.ExcludeDisks...))
+  if err != nil {
+    return err
+  }
+  _, err = backups.ValidateNameRegex("name regex", config.NameRegex)
+  if err != nil {
+    return err
+  }
+  _, err = backups.ValidateNameRegex("exclude name regex", config.NameRegexExclude)
+  if err != nil {
+    return err
+  }
+  if config.MinSizeGb < 0 || config.MaxSizeGb < 0 {
+    return errors.New("The disk sizes can't be negative")
+  }
+  if config.MaxSizeGb > 0 && config.MinSizeGb > config.MaxSizeGb {
+    return fmt.Errorf("The minimum disk size %d GB is more than the maximum %d GB", config.MinSizeGb, config.MaxSizeGb)
+  }
+  if config.ProgressFD != 0 && config.ProgressFile != "" {
+    return errors.New("Use --progress-fd or --progress-file, not both")
+  }
+  if config.ProgressFD < 0 || (config.ProgressFD > 0 && config.ProgressFD < 3) {
+    return fmt.Errorf("Invalid progress fd %d, use 3 or more, 0 to 2 are the standard streams", config.ProgressFD)
+  }
+  if config.Resume && config.StateFile == "" {
+    return errors.New("--resume needs --state-file")
+  }
+  if config.Resume && (config.Daemon || config.Serve != "" || config.ApplyPlan != "") {
+    return errors.New("--resume can't be used with --daemon, --serve or --apply-plan")
+  }
+  if config.RunID != "" {
+    err = backups.ValidateRunID(config.RunID)
+    if err != nil {
+      return err
+    }
+    // Each run of a daemon has its own id, a resumed run keeps the one of its
+    // state
+    if config.Daemon || config.Serve != "" || config.Resume {
+      return errors.New("--run-id can't be used with --daemon, --serve or --resume")
+    }
+  }
+  if strings.HasPrefix(config.StateFile, "gs://") {
+    _, _, err = backups.ParseGCSURI(config.StateFile)
+    if err != nil {
+      return err
+    }
+  }
+  if config.ReportGCS != "" {
+    _, _, err = backups.ParseGCSURI(strings.TrimSuffix(config.ReportGCS, "/") + "/report.json")
+    if err != nil {
+      return fmt.Errorf("Invalid --report-gcs '%s', use gs://<bucket>/<prefix>/", config.ReportGCS)
+    }
+  }
+  if config.LockGCS != "" {
+    _, _, err = backups.ParseGCSURI(config.LockGCS)
+    if err != nil {
+      return err
+    }
+    if config.LockTTL < 30 * time.Second {
+      return errors.New("The lock TTL must be at least 30s")
+    }
+  }
+  if config.Serve != "" && (config.Daemon || config.ApplyPlan != "") {
+    return errors.New("--serve can't be used with --daemon or --apply-plan")
+  }
+  // Nobody answers the confirmation of the deletions of their runs, which
+  // would delete nothing, or block on a terminal
+  if (config.Daemon || config.Serve != "") && !config.Yes && !config.DryRun {
+    return errors.New("--daemon and --serve need --yes (or --dry-run), the deletions can't be confirmed")
+  }
+  if config.Daemon {
+    if config.ApplyPlan != "" {
+      return errors.New("--apply-plan can't be used with --daemon")
+    }
+    _, err = newSchedule(config)
+    if err != nil {
+      return err
+    }
+    if config.Jitter < 0 {
+      return errors.New("The jitter can't be negative")
+    }
+  }
+  for webhookIndex := 0; webhookIndex < len(config.Notifications.Webhooks); webhookIndex++ {
+    webhook := config.Notifications.Webhooks[webhookIndex]
+    webhookURL, urlErr := url.Parse(webhook.URL)
+    if urlErr != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+      return fmt.Errorf("Invalid webhook URL '%s', use http:// or https://", webhook.URL)
+    }
+    err = backups.ValidateWebhookTemplate(webhook.Template)
+    if err != nil {
+      return fmt.Errorf("Webhook %s: %w", webhookURL.Host, err)
+    }
+  }
+  if config.OTLPEndpoint != "" {
+    otlpURL, urlErr := url.Parse(config.OTLPEndpoint)
+    if urlErr != nil || (otlpURL.Scheme != "http" && otlpURL.Scheme != "https") || otlpURL.Host == "" {
+      return fmt.Errorf("Invalid OTLP endpoint '%s', use http:// or https://", config.OTLPEndpoint)
+    }
+  }
+  alerting := config.Notifications.Alerting
+  err = backups.ValidateAlertConditions(alerting.On)
+  if err != nil {
+    return err
+  }
+  if alerting.OpsgenieURL != "" {
+    opsgenieURL, urlErr := url.Parse(alerting.OpsgenieURL)
+    if urlErr != nil || opsgenieURL.Scheme != "https" || opsgenieURL.Host == "" {
+      return fmt.Errorf("Invalid Opsgenie URL '%s', use https://", alerting.OpsgenieURL)
+    }
+  }
+  healthcheck := config.Notifications.Healthcheck
+  if healthcheck.URL == "" && (healthcheck.FailURL != "" || healthcheck.Post || healthcheck.Start) {
+    return errors.New("The healthcheck options need --healthcheck-url")
+  }
+  monitoring := config.Notifications.Monitoring
+  if monitoring.Enabled {
+    if !metricPrefixRegexp.MatchString(monitoring.MetricPrefix) {
+      return fmt.Errorf("Invalid metric prefix '%s', use custom.googleapis.com/<name>", monitoring.MetricPrefix)
+    }
+    for key := range monitoring.Labels {
+      if !metricLabelRegexp.MatchString(key) {
+        return fmt.Errorf("Invalid metric label '%s', use lowercase letters, digits and underscores", key)
+      }
+    }
+  }
+  email := config.Notifications.Email
+  if email.Host != "" {
+    if email.TLS != backups.SMTPStartTLS && email.TLS != backups.SMTPTLS && email.TLS != backups.SMTPNone {
+      return fmt.Errorf("Unknown SMTP TLS '%s', use '%s', '%s' or '%s'", email.TLS, backups.SMTPStartTLS, backups.SMTPTLS, backups.SMTPNone)
+    }
+    if email.From == "" || len(email.To) == 0 {
+      return errors.New("Sending emails needs a sender and recipients")
+    }
+  }
+  if config.StorageLocation != "" && !locationRegexp.MatchString(config.StorageLocation) {
+    return fmt.Errorf("Invalid storage location '%s', use a region or multi-region like europe-west1 or eu", config.StorageLocation)
+  }
+  if config.CopyToLocation != "" {
+    if !locationRegexp.MatchString(config.CopyToLocation) {
+      return fmt.Errorf("Invalid copy location '%s', use a region like europe-west1", config.CopyToLocation)
+    }
+    if !strings.Contains(config.CopyToLocation, "-") && config.CopyZone == "" {
+      return fmt.Errorf("The copies in the multi-region '%s' need a --copy-zone for their temporary disks", config.CopyToLocation)
+    }
+    if !config.Wait {
+      return errors.New("The copies of the snapshots need --wait, only the READY snapshots are copied")
+    }
+  }
+  if config.CopyLimit < 0 {
+    return fmt.Errorf("Invalid copy limit %d", config.CopyLimit)
+  }
+  if config.InstantSnapshots && config.InstantLimit < 1 {
+    return fmt.Errorf("Invalid instant limit %d, keep at least 1 instant snapshot by disk", config.InstantLimit)
+  }
+  if config.KmsKey != "" {
+    err = backups.ValidateKmsKey(config.KmsKey)
+    if err != nil {
+      return err
+    }
+  }
+  for alias, key := range config.KmsKeys {
+    err = backups.ValidateKmsKey(key)
+    if err != nil {
+      return fmt.Errorf("KMS key %s: %w", alias, err)
+    }
+  }
+  if config.PlanConcurrency < 1 {
+    return errors.New("The plan concurrency must be at least 1")
+  }
+  if config.PlanOut != "" && !config.DryRun {
+    return errors.New("--plan-out needs --dry-run")
+  }
+  if config.ApplyPlan != "" && config.DryRun {
+    return errors.New("--apply-plan can't be used with --dry-run")
+  }
+  if config.Output != outputAuto && config.Output != outputLog && config.Output != outputPretty {
+    return fmt.Errorf("Unknown output '%s', use '%s', '%s' or '%s'", config.Output, outputAuto, outputLog, outputPretty)
+  }
+  err = backups.ValidateFrequency(config.DefaultFrequency)
+  if err != nil {
+    return err
+  }
+  if config.GracePeriod < 0 {
+    return errors.New("The grace period must be positive")
+  }
+  if config.Verbose && config.Quiet {
+    return errors.New("--verbose can't be used with --quiet")
+  }
+  if config.VerifyOnly && (config.ApplyPlan != "" || config.Resume || config.PlanOut != "") {
+    return errors.New("--verify-only can't be used with --apply-plan, --resume or --plan-out")
+  }
+  if config.PricePerGbMonth < 0 || config.ArchivePricePerGbMonth < 0 {
+    return errors.New("The price per GB and month must be positive")
+  }
+  err = backups.ValidateSnapshotType(config.SnapshotType)
+  if err != nil {
+    return err
+  }
+  if config.MaxStaleness <= 0 {
+    return errors.New("The maximum staleness must be positive")
+  }
+  if config.Drill && (config.VerifyOnly || config.ApplyPlan != "" || config.Resume || config.PlanOut != "") {
+    return errors.New("The drill subcommand can't be used with --verify-only, --apply-plan, --resume or --plan-out")
+  }
+  if config.Drill && config.DrillZone == "" {
+    return errors.New("The drill subcommand needs the --scratch-zone of its temporary disks")
+  }
+  if config.DrillSample < 1 {
+    return errors.New("The drill sample must be at least 1 disk")
+  }
+
+  plans, err := config.Plans()
+  if err != nil {
+    return err
+  }
+  for planIndex := 0; planIndex < len(plans); planIndex++ {
+    options := plans[planIndex].Options
+    retentions := []backups.Retention{{
+      Mode: options.RetentionMode,
+      Limit: options.Limit,
+      MaxAge: options.MaxAge,
+      KeepDaily: options.KeepDaily,
+      KeepWeekly: options.KeepWeekly,
+      KeepMonthly: options.KeepMonthly,
+      MonthlyType: options.MonthlyType,
+    }}
+    for _, retention := range options.DiskRetentions {
+      retentions = append(retentions, retention)
+    }
+    for retentionIndex := 0; retentionIndex < len(retentions); retentionIndex++ {
+      err = retentions[retentionIndex].Validate()
+      if err != nil && plans[planIndex].Name != "" {
+        return fmt.Errorf("Plan %s: %w", plans[planIndex].Name, err)
+      }
+      if err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// Plan is a named set of options, run by its own runner.
+type Plan struct {
+  // Empty when the config has no plans
+  Name    string
+  Options backups.Options
+}
+
+// verbosity is the verbosity of the logs of --verbose and --quiet.
+func (config Config) verbosity() int {
+  if config.Verbose {
+    return backups.VerbosityVerbose
+  }
+  if config.Quiet {
+    return backups.VerbosityQuiet
+  }
+  return backups.VerbosityNormal
+}
+
+// pretty tells if the tables are logged, on a terminal with outputAuto.
+func (config Config) pretty() bool {
+  if config.Output == outputAuto {
+    return term.IsTerminal(int(os.Stderr.Fd()))
+  }
+  return config.Output == outputPretty
+}
+
+// color tells if the tables are colored, only on a terminal.
+func (config Config) color() bool {
+  if config.NoColor || os.Getenv("NO_COLOR") != "" {
+    return false
+  }
+  return config.pretty() && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// Plans returns the plans of the config, or a single unnamed plan with the
+// global values when there are none.
+func (config Config) Plans() ([]Plan, error) {
+  if len(config.PlanConfigs) == 0 {
+    options, err := config.options(PlanConfig{})
+    if err != nil {
+      return nil, err
+    }
+    return []Plan{{Options: options}}, nil
+  }
+
+  plans := make([]Plan, 0, len(config.PlanConfigs))
+  names := make(map[string]bool)
+  for planIndex := 0; planIndex < len(config.PlanConfigs); planIndex++ {
+    planConfig := config.PlanConfigs[planIndex]
+    if planConfig.Name == "" {
+      return nil, fmt.Errorf("Plan %d has no name", planIndex + 1)
+    }
+    if names[planConfig.Name] {
+      return nil, fmt.Errorf("Plan %s is defined twice", planConfig.Name)
+    }
+    names[planConfig.Name] = true
+    options, err := config.options(planConfig)
+    if err != nil {
+      return nil, fmt.Errorf("Plan %s: %w", planConfig.Name, err)
+    }
+    plans = append(plans, Plan{Name: planConfig.Name, Options: options})
+  }
+  return plans, nil
+}
+
+// options returns the options of the runner of the plan, without the backend
+// and logger.
+func (config Config) options(plan PlanConfig) (backups.Options, error) {
+  filter := config.Filter
+  if plan.Filter != nil {
+    filter = *plan.Filter
+  }
+  excludeFilter := config.ExcludeFilter
+  if plan.ExcludeFilter != nil {
+    excludeFilter = *plan.ExcludeFilter
+  }
+  instanceFilter := config.InstanceFilter
+  if plan.InstanceFilter != nil {
+    instanceFilter = *plan.InstanceFilter
+  }
+  planRetention := plan.Retention.apply(config.Retention)
+  planMaxAge, err := maxAge(planRetention.MaxAge, planRetention.MaxAgeDays)
+  if err != nil {
+    return backups.Options{}, err
+  }
+  // Compiled once for all the runs
+  nameRegex, err := backups.ValidateNameRegex("name regex", config.NameRegex)
+  if err != nil {
+    return backups.Options{}, err
+  }
+  nameRegexExclude, err := backups.ValidateNameRegex("exclude name regex", config.NameRegexExclude)
+  if err != nil {
+    return backups.Options{}, err
+  }
+
+  options := backups.Options{
+    Mode: config.Mode,
+    Filter: filter,
+    ExcludeFilter: excludeFilter,
+    Disks: config.DiskNames,
+    ExcludeDisks: config.ExcludeDisks,
+    StrictDisks: config.StrictDisks,
+    NameRegex: nameRegex,
+    NameRegexExclude: nameRegexExclude,
+    MinSizeGb: config.MinSizeGb,
+    MaxSizeGb: config.MaxSizeGb,
+    DiskTypes: backups.NormalizeDiskTypes(config.DiskTypes),
+    InstanceFilter: instanceFilter,
+    Zones: config.Zones,
+    Regions: config.Regions,
+    Limit: planRetention.Limit,
+    MaxAge: planMaxAge,
+    RetentionMode: planRetention.Mode,
+    KeepDaily: planRetention.KeepDaily,
+    KeepWeekly: planRetention.KeepWeekly,
+    KeepMonthly: planRetention.KeepMonthly,
+    MonthlyType: planRetention.MonthlyType,
+    NameTemplate: config.NameTemplate,
+    ChainNameTemplate: config.ChainNameTemplate,
+    DescriptionTemplate: config.DescriptionTemplate,
+    SnapshotType: config.SnapshotType,
+    StorageLocation: config.StorageLocation,
+    CopyLocation: config.CopyToLocation,
+    CopyZone: config.CopyZone,
+    CopyLimit: config.CopyLimit,
+    InstantSnapshots: config.InstantSnapshots,
+    InstantLimit: config.InstantLimit,
+    SkipScheduledDisks: config.SkipScheduledDisks,
+    GuestFlush: config.GuestFlush,
+    GuestFlushFallback: config.GuestFlushFallback,
+    GroupByInstance: config.GroupByInstance,
+    KmsKey: config.KmsKey,
+    KmsKeys: config.KmsKeys,
+    Labels: mergeLabels(config.Labels, plan.Labels),
+    OwnSnapshotsOnly: config.OwnSnapshotsOnly,
+    FailFast: config.FailFast,
+    Concurrency: config.Concurrency,
+    DryRun: config.DryRun,
+    DefaultFrequency: config.DefaultFrequency,
+    StampDisks: config.StampDisks,
+    Verbosity: config.verbosity(),
+    Pretty: config.pretty(),
+    Color: config.color(),
+    Timeout: config.Timeout,
+    OperationTimeout: config.OperationTimeout,
+    Wait: config.Wait,
+    WaitTimeout: config.WaitTimeout,
+    PruneOnCreateFailure: config.PruneOnCreateFailure,
+    QuotaBehavior: config.QuotaBehavior,
+    DeletionLimits: backups.DeletionLimits{MaxDeletions: config.MaxDeletionsPerRun, MaxPercent: config.MaxDeletionPercent},
+    Force: config.Force,
+    DeletionGrace: config.DeletionGrace,
+    ForceDeleteReferenced: config.ForceDeleteReferenced,
+    RespectTTLOnly: config.RespectTTLOnly,
+    CleanupFailed: config.CleanupFailed,
+    NoRefresh: config.NoRefresh,
+    Phased: config.Phased,
+    Stream: config.Stream,
+    MaxCreations: config.MaxCreations,
+    Order: config.Order,
+    Orphans: config.Orphans,
+    EnforceLabeling: config.EnforceLabeling,
+    OrphanMaxAge: config.OrphanMaxAge,
+    MinKeep: config.MinKeep,
+    MaxStaleness: config.MaxStaleness,
+    DrillSample: config.DrillSample,
+    DrillZone: config.DrillZone,
+    PricePerGbMonth: config.PricePerGbMonth,
+    ArchivePricePerGbMonth: config.ArchivePricePerGbMonth,
+    CostLabel: config.CostLabel,
+  }
+  if config.HardDelete {
+    options.DeletionGrace = 0
+  }
+
+  // The disks of the plan override the global ones
+  disks := make(map[string]DiskConfig)
+  for diskName, disk := range config.Disks {
+    disks[diskName] = disk
+  }
+  for diskName, disk := range plan.Disks {
+    disks[diskName] = disk
+  }
+  if len(disks) > 0 {
+    options.DiskRetentions = make(map[string]backups.Retention)
+  }
+  for diskName, disk := range disks {
+    retention := disk.Retention.apply(planRetention)
+    diskMaxAge, err := maxAge(retention.MaxAge, retention.MaxAgeDays)
+    if err != nil {
+      return options, fmt.Errorf("Disk %s: %w", diskName, err)
+    }
+    options.DiskRetentions[diskName] = backups.Retention{
+      Mode: retention.Mode,
+      Limit: retention.Limit,
+      MaxAge: diskMaxAge,
+      KeepDaily: retention.KeepDaily,
+      KeepWeekly: retention.KeepWeekly,
+      KeepMonthly: retention.KeepMonthly,
+      MonthlyType: retention.MonthlyType,
+    }
+  }
+
+  return options, nil
+}
+
+// apply returns the retention with the fields set in the override replaced.
+func (override RetentionOverride) apply(retention RetentionConfig) RetentionConfig {
+  if override.Mode != nil {
+    retention.Mode = *override.Mode
+  }
+  if override.Limit != nil {
+    retention.Limit = *override.Limit
+  }
+  if override.MaxAge != nil || override.MaxAgeDays != nil {
+    retention.MaxAge = 0
+    retention.MaxAgeDays = 0
+  }
+  if override.MaxAge != nil {
+    retention.MaxAge = *override.MaxAge
+  }
+  if override.MaxAgeDays != nil {
+    retention.MaxAgeDays = *override.MaxAgeDays
+  }
+  if override.KeepDaily != nil {
+    retention.KeepDaily = *override.KeepDaily
+  }
+  if override.KeepWeekly != nil {
+    retention.KeepWeekly = *override.KeepWeekly
+  }
+  if override.KeepMonthly != nil {
+    retention.KeepMonthly = *override.KeepMonthly
+  }
+  if override.MonthlyType != nil {
+    retention.MonthlyType = *override.MonthlyType
+  }
+  return retention
+}
+
+// mergeLabels returns the labels with the overrides, nil if there are none.
+func mergeLabels(labels map[string]string, overrides map[string]string) map[string]string {
+  if len(labels) == 0 && len(overrides) == 0 {
+    return nil
+  }
+  merged := make(map[string]string)
+  for key, value := range labels {
+    merged[key] = value
+  }
+  for key, value := range overrides {
+    merged[key] = value
+  }
+  return merged
+}
+
+// String returns the config as YAML, without the secrets.
+func (config Config) String() string {
+  if config.Notifications.SlackWebhookURL != "" {
+    config.Notifications.SlackWebhookURL = "********"
+  }
+  // The ping URLs allow anyone to ping
+  if config.Notifications.Healthcheck.URL != "" {
+    config.Notifications.Healthcheck.URL = "********"
+  }
+  if config.Notifications.Healthcheck.FailURL != "" {
+    config.Notifications.Healthcheck.FailURL = "********"
+  }
+  if config.Notifications.Alerting.PagerDutyRoutingKey != "" {
+    config.Notifications.Alerting.PagerDutyRoutingKey = "********"
+  }
+  if config.Notifications.Alerting.OpsgenieAPIKey != "" {
+    config.Notifications.Alerting.OpsgenieAPIKey = "********"
+  }
+  // The headers may authenticate, copied not to change the config
+  webhooks := make([]WebhookConfig, len(config.Notifications.Webhooks))
+  for webhookIndex := 0; webhookIndex < len(webhooks); webhookIndex++ {
+    webhooks[webhookIndex] = config.Notifications.Webhooks[webhookIndex]
+    if len(webhooks[webhookIndex].Headers) > 0 {
+      headers := make(map[string]string)
+      for key := range webhooks[webhookIndex].Headers {
+        headers[key] = "********"
+      }
+      webhooks[webhookIndex].Headers = headers
+    }
+  }
+  config.Notifications.Webhooks = webhooks
+  data, err := yaml.Marshal(config)
+  if err != nil {
+    return err.Error()
+  }
+  return string(data)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+  "context"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+func TestLoadExampleConfig(t *testing.T) {
+  config := defaultConfig()
+  err := loadConfig(filepath.Join("examples", "backup.yaml"), &config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = config.Validate()
+  if err != nil {
+    t.Fatalf("The example config is invalid: %s", err)
+  }
+  if config.Filter != "labels.env = production" || config.Retention.Limit != 7 || config.Retention.MaxAgeDays != 30 {
+    t.Errorf("Got the filter '%s' and the retention %+v", config.Filter, config.Retention)
+  }
+  if config.Concurrency != 10 || !config.Wait || config.WaitTimeout != 30 * time.Minute || !config.Yes {
+    t.Errorf("Got the concurrency %d, wait %t for %s, yes %t", config.Concurrency, config.Wait, config.WaitTimeout, config.Yes)
+  }
+  // The defaults are kept for the keys missing from the file
+  if config.Backend != "gcloud" {
+    t.Errorf("Got the backend '%s'", config.Backend)
+  }
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+  tests := []struct {
+    name     string
+    content  string
+    expected string
+  }{
+    {"unknown key", "filter: labels.env = production\nlimt: 3\n", "field limt not found"},
+    {"unknown nested key", "retention:\n  mode: both\n  keep: 3\n", "field keep not found"},
+    {"wrong type", "concurrency: many\n", "cannot unmarshal"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    path := filepath.Join(t.TempDir(), "backup.yaml")
+    err := os.WriteFile(path, []byte(test.content), 0600)
+    if err != nil {
+      t.Fatal(err)
+    }
+    config := defaultConfig()
+    err = loadConfig(path, &config)
+    if err == nil || !strings.Contains(err.Error(), test.expected) || !strings.Contains(err.Error(), "Invalid config file") {
+      t.Errorf("%s: got the error %v, expected %s", test.name, err, test.expected)
+    }
+  }
+}
+
+func TestLoadEmptyConfig(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "backup.yaml")
+  err := os.WriteFile(path, []byte("# Nothing yet\n"), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  config := defaultConfig()
+  err = loadConfig(path, &config)
+  if err != nil || config.Retention.Limit != defaultConfig().Retention.Limit {
+    t.Errorf("Got the error %v and the limit %d", err, config.Retention.Limit)
+  }
+}
+
+func TestFlagsOverrideConfig(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "backup.yaml")
+  err := os.WriteFile(path, []byte("filter: labels.env = staging\nconcurrency: 4\nretention:\n  limit: 5\n"), 0600)
+  if err != nil {
+    t.Fatal(err)
+  }
+  config, _, err := parseConfig([]string{"--limit", "9", "--config", path})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if config.Retention.Limit != 9 || config.Filter != "labels.env = staging" || config.Concurrency != 4 {
+    t.Errorf("Got the limit %d, the filter '%s' and the concurrency %d", config.Retention.Limit, config.Filter, config.Concurrency)
+  }
+}
+
+func TestDiskNamesFlags(t *testing.T) {
+  config, _, err := parseConfig([]string{"--disks", "db-data,shared-data:europe-west1", "--exclude-disks", "logs", "--strict-disks"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if strings.Join(config.DiskNames, " ") != "db-data shared-data:europe-west1" || strings.Join(config.ExcludeDisks, " ") != "logs" || !config.StrictDisks {
+    t.Errorf("Got the disks %v, excluded %v, strict %t", config.DiskNames, config.ExcludeDisks, config.StrictDisks)
+  }
+  err = config.Validate()
+  if err != nil {
+    t.Errorf("Got the error %v", err)
+  }
+
+  config, _, err = parseConfig([]string{"--exclude-disks", "db-data:europe-west1-b:extra"})
+  if err == nil {
+    err = config.Validate()
+  }
+  if err == nil || !strings.Contains(err.Error(), "Invalid disk name") {
+    t.Errorf("Got the error %v for an invalid disk name", err)
+  }
+}
+
+func TestUnattendedNeedsYes(t *testing.T) {
+  tests := []struct {
+    args  []string
+    valid bool
+  }{
+    {[]string{"--daemon"}, false},
+    {[]string{"--serve", ":8080"}, false},
+    {[]string{"--daemon", "--yes"}, true},
+    {[]string{"--serve", ":8080", "--yes"}, true},
+    {[]string{"--serve", ":8080", "--dry-run"}, true},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    config, _, err := parseConfig(test.args)
+    if err == nil {
+      err = config.Validate()
+    }
+    if (err == nil) != test.valid || (err != nil && !strings.Contains(err.Error(), "need --yes")) {
+      t.Errorf("%v: got the error %v", test.args, err)
+    }
+  }
+}
+
+func TestUsageExitCode(t *testing.T) {
+  missing := filepath.Join(t.TempDir(), "missing.yaml")
+  tests := []struct {
+    name string
+    run  func() int
+  }{
+    {"unknown flag", func() int { return run([]string{"--no-such-flag"}, false) }},
+    {"invalid config", func() int { return run([]string{"--mode", "everything"}, false) }},
+    {"missing config file", func() int { return run([]string{"--config", missing}, false) }},
+    {"list format", func() int { return runList([]string{"--format", "xml"}) }},
+    {"restore time", func() int { return runRestore([]string{"--disk", "db-data", "--at", "yesterday"}) }},
+    {"unknown report", func() int { return runReport([]string{"growth"}) }},
+    {"serve address", func() int { return runServer(context.Background(), Config{Serve: "localhost:-1"}, nil, nil) }},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    // Nothing listed, so not an outage of GCP
+    exitCode := test.run()
+    if exitCode != backups.ExitUsage {
+      t.Errorf("%s: got the exit code %d, expected %d", test.name, exitCode, backups.ExitUsage)
+    }
+  }
+}
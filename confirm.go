@@ -0,0 +1,37 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "log"
+  "os"
+  "strings"
+  "sync"
+
+  "golang.org/x/term"
+)
+
+var (
+  // The runs at the same time ask one after another
+  promptMutex sync.Mutex
+  stdin       = bufio.NewReader(os.Stdin)
+)
+
+// confirmDeletion returns the confirmation asked on the terminal before
+// deleting the snapshots. Without a terminal, nothing is deleted: it would
+// wait forever.
+func confirmDeletion(logger *log.Logger) func(snapshots int, disks int) bool {
+  return func(snapshots int, disks int) bool {
+    if !term.IsTerminal(int(os.Stdin.Fd())) {
+      logger.Printf("WARNING: %d snapshot(s) NOT deleted, there is no terminal to confirm: use --yes\n", snapshots)
+      return false
+    }
+
+    promptMutex.Lock()
+    defer promptMutex.Unlock()
+    fmt.Fprintf(os.Stderr, "%sDelete %d snapshots across %d disks? [y/N] ", logger.Prefix(), snapshots, disks)
+    answer, _ := stdin.ReadString('\n')
+    answer = strings.ToLower(strings.TrimSpace(answer))
+    return answer == "y" || answer == "yes"
+  }
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log"
+  "math/rand"
+  "strings"
+  "time"
+
+  "github.com/robfig/cron/v3"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// schedule returns the times of the runs of the daemon.
+type schedule interface {
+  // first returns the time of the first run, from now
+  first(now time.Time) time.Time
+  // next returns the time of the run after the one scheduled at previous
+  next(previous time.Time) time.Time
+  String() string
+}
+
+// newSchedule returns the schedule of the runs of the config: the cron
+// expressions if any, or every interval, at the local time of the day if any.
+func newSchedule(config Config) (schedule, error) {
+  if len(config.Schedules) > 0 {
+    if config.At != "" {
+      return nil, errors.New("Use either --schedule or --at")
+    }
+    return newCronSchedule(config.Schedules, config.ScheduleTZ)
+  }
+
+  interval := config.Interval
+  at := config.At
+  if interval <= 0 {
+    return nil, errors.New("The interval of the daemon must be positive")
+  }
+  if at == "" {
+    return intervalSchedule{interval: interval}, nil
+  }
+
+  clock, err := time.Parse("15:04", at)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid time of the day '%s', use HH:MM", at)
+  }
+  if interval % (24 * time.Hour) != 0 {
+    return nil, fmt.Errorf("The interval must be a number of days with --at, not %s", interval)
+  }
+  return dailySchedule{days: int(interval / (24 * time.Hour)), hour: clock.Hour(), minute: clock.Minute()}, nil
+}
+
+// intervalSchedule starts at once, then every interval.
+type intervalSchedule struct {
+  interval time.Duration
+}
+
+func (schedule intervalSchedule) first(now time.Time) time.Time {
+  return now
+}
+
+func (schedule intervalSchedule) next(previous time.Time) time.Time {
+  return previous.Add(schedule.interval)
+}
+
+func (schedule intervalSchedule) String() string {
+  return fmt.Sprintf("every %s", schedule.interval)
+}
+
+// dailySchedule runs at a local time of the day, every number of days. The
+// time of the day is kept across the daylight saving time changes.
+type dailySchedule struct {
+  days   int
+  hour   int
+  minute int
+}
+
+func (schedule dailySchedule) first(now time.Time) time.Time {
+  today := time.Date(now.Year(), now.Month(), now.Day(), schedule.hour, schedule.minute, 0, 0, now.Location())
+  if today.After(now) {
+    return today
+  }
+  return time.Date(now.Year(), now.Month(), now.Day() + 1, schedule.hour, schedule.minute, 0, 0, now.Location())
+}
+
+func (schedule dailySchedule) next(previous time.Time) time.Time {
+  return time.Date(previous.Year(), previous.Month(), previous.Day() + schedule.days, schedule.hour, schedule.minute, 0, 0, previous.Location())
+}
+
+func (schedule dailySchedule) String() string {
+  if schedule.days == 1 {
+    return fmt.Sprintf("every day at %02d:%02d", schedule.hour, schedule.minute)
+  }
+  return fmt.Sprintf("every %d days at %02d:%02d", schedule.days, schedule.hour, schedule.minute)
+}
+
+// cronSchedule runs at the times matching any of the 5-field cron
+// expressions, in a time zone.
+type cronSchedule struct {
+  expressions []string
+  schedules   []cron.Schedule
+  location    *time.Location
+}
+
+// newCronSchedule parses the cron expressions, in the time zone or the local
+// one if empty.
+func newCronSchedule(expressions []string, timezone string) (cronSchedule, error) {
+  schedule := cronSchedule{expressions: expressions, location: time.Local}
+  if timezone != "" {
+    location, err := time.LoadLocation(timezone)
+    if err != nil {
+      return schedule, fmt.Errorf("Unknown time zone '%s'", timezone)
+    }
+    schedule.location = location
+  }
+  for expressionIndex := 0; expressionIndex < len(expressions); expressionIndex++ {
+    parsed, err := cron.ParseStandard(expressions[expressionIndex])
+    if err != nil {
+      return schedule, fmt.Errorf("Invalid schedule '%s': %w", expressions[expressionIndex], err)
+    }
+    // Like February 30, the zero time would run at once, then forever
+    if parsed.Next(time.Now().In(schedule.location)).IsZero() {
+      return schedule, fmt.Errorf("Invalid schedule '%s': it never matches", expressions[expressionIndex])
+    }
+    schedule.schedules = append(schedule.schedules, parsed)
+  }
+  return schedule, nil
+}
+
+func (schedule cronSchedule) first(now time.Time) time.Time {
+  return schedule.next(now)
+}
+
+// next returns the earliest time of the expressions after previous.
+func (schedule cronSchedule) next(previous time.Time) time.Time {
+  var next time.Time
+  for scheduleIndex := 0; scheduleIndex < len(schedule.schedules); scheduleIndex++ {
+    fire := schedule.schedules[scheduleIndex].Next(previous.In(schedule.location))
+    if next.IsZero() || fire.Before(next) {
+      next = fire
+    }
+  }
+  return next
+}
+
+func (schedule cronSchedule) String() string {
+  return fmt.Sprintf("%s (%s)", strings.Join(schedule.expressions, ", "), schedule.location)
+}
+
+// runDaemon runs the backup on schedule until interrupted, one run at a time:
+// the runs which would start before the end of the previous one are skipped.
+// Interrupting stops the run in progress, see gracefulShutdown. It returns
+// the exit code of the last run.
+func runDaemon(ctx context.Context, config Config, backend backups.Backend, notifiers []backups.Notifier) int {
+  // Already checked by config.Validate()
+  schedule, _ := newSchedule(config)
+
+  exitCode := backups.ExitOK
+  scheduled := schedule.first(time.Now())
+  // The next fire times show the mistakes of the schedule
+  upcoming := make([]string, 0, 3)
+  for next, upcomingIndex := scheduled, 0; upcomingIndex < 3; upcomingIndex++ {
+    upcoming = append(upcoming, next.Format(time.RFC3339))
+    next = schedule.next(next)
+  }
+  log.Printf("Schedule: %s, next runs at %s\n", schedule, strings.Join(upcoming, ", "))
+  for {
+    start := scheduled
+    if config.Jitter > 0 {
+      start = start.Add(time.Duration(rand.Int63n(int64(config.Jitter))))
+    }
+    log.Printf("Next run at %s\n", start.Format(time.RFC3339))
+    timer := time.NewTimer(time.Until(start))
+    select {
+    case <-ctx.Done():
+      timer.Stop()
+      log.Println("Daemon stopped")
+      return exitCode
+    case <-stopping:
+      timer.Stop()
+      log.Println("Daemon stopped")
+      return exitCode
+    case <-timer.C:
+    }
+
+    exitCode = backup(ctx, config, backend, notifiers).ExitCode
+    if ctx.Err() != nil || isStopping() {
+      log.Println("Daemon stopped during a run")
+      return exitCode
+    }
+
+    scheduled = schedule.next(scheduled)
+    now := time.Now()
+    for !scheduled.After(now) {
+      log.Printf("WARNING: skipping the run of %s, the previous run was still in progress\n", scheduled.Format(time.RFC3339))
+      scheduled = schedule.next(scheduled)
+    }
+  }
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+  "strings"
+  "testing"
+  "time"
+  // The time zones of the schedules, whatever the system
+  _ "time/tzdata"
+)
+
+func TestCronSchedule(t *testing.T) {
+  utc := time.UTC
+  paris, err := time.LoadLocation("Europe/Paris")
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name        string
+    expressions []string
+    timezone    string
+    now         time.Time
+    // The next fire times
+    expected    []time.Time
+  }{
+    {"daily", []string{"30 2 * * *"}, "UTC", time.Date(2026, 10, 14, 9, 0, 0, 0, utc),
+      []time.Time{time.Date(2026, 10, 15, 2, 30, 0, 0, utc), time.Date(2026, 10, 16, 2, 30, 0, 0, utc)}},
+    // 2026-10-16 is a Friday
+    {"weekdays", []string{"0 3 * * 1-5"}, "UTC", time.Date(2026, 10, 16, 4, 0, 0, 0, utc),
+      []time.Time{time.Date(2026, 10, 19, 3, 0, 0, 0, utc), time.Date(2026, 10, 20, 3, 0, 0, 0, utc)}},
+    {"earliest of the expressions", []string{"0 22 * * *", "0 */6 * * *"}, "UTC", time.Date(2026, 10, 14, 17, 0, 0, 0, utc),
+      []time.Time{time.Date(2026, 10, 14, 18, 0, 0, 0, utc), time.Date(2026, 10, 14, 22, 0, 0, 0, utc), time.Date(2026, 10, 15, 0, 0, 0, 0, utc)}},
+    {"at the fire time", []string{"0 * * * *"}, "UTC", time.Date(2026, 10, 14, 9, 0, 0, 0, utc),
+      []time.Time{time.Date(2026, 10, 14, 10, 0, 0, 0, utc)}},
+    // 02:30 in Paris is 01:30 UTC in winter
+    {"time zone", []string{"30 2 * * *"}, "Europe/Paris", time.Date(2026, 11, 10, 1, 45, 0, 0, utc),
+      []time.Time{time.Date(2026, 11, 11, 1, 30, 0, 0, utc), time.Date(2026, 11, 12, 2, 30, 0, 0, paris)}},
+    {"month end", []string{"0 0 1 * *"}, "UTC", time.Date(2026, 12, 31, 12, 0, 0, 0, utc),
+      []time.Time{time.Date(2027, 1, 1, 0, 0, 0, 0, utc), time.Date(2027, 2, 1, 0, 0, 0, 0, utc)}},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    schedule, err := newCronSchedule(test.expressions, test.timezone)
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+    fire := schedule.first(test.now)
+    for expectedIndex := 0; expectedIndex < len(test.expected); expectedIndex++ {
+      if !fire.Equal(test.expected[expectedIndex]) {
+        t.Errorf("%s: got the run %d at %s, expected %s", test.name, expectedIndex, fire, test.expected[expectedIndex])
+      }
+      fire = schedule.next(fire)
+    }
+  }
+}
+
+func TestCronScheduleErrors(t *testing.T) {
+  tests := []struct {
+    expressions []string
+    timezone    string
+    expected    string
+  }{
+    {[]string{"30 2 * *"}, "", "Invalid schedule '30 2 * *'"},
+    {[]string{"0 3 * * *", "61 * * * *"}, "", "Invalid schedule '61 * * * *'"},
+    // Seconds aren't supported
+    {[]string{"0 30 2 * * *"}, "", "Invalid schedule"},
+    {[]string{"0 3 * * *", "0 0 30 2 *"}, "", "Invalid schedule '0 0 30 2 *': it never matches"},
+    {[]string{"0 3 * * *"}, "Mars/Olympus", "Unknown time zone 'Mars/Olympus'"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    _, err := newCronSchedule(test.expressions, test.timezone)
+    if err == nil || !strings.Contains(err.Error(), test.expected) {
+      t.Errorf("%v: got the error %v, expected %s", test.expressions, err, test.expected)
+    }
+  }
+}
+
+func TestNewSchedule(t *testing.T) {
+  tests := []struct {
+    name     string
+    change   func(config *Config)
+    expected string
+    err      string
+  }{
+    {"interval", func(config *Config) { config.Interval = 6 * time.Hour }, "every 6h0m0s", ""},
+    {"daily", func(config *Config) { config.At = "02:30" }, "every day at 02:30", ""},
+    {"cron", func(config *Config) { config.Schedules = []string{"30 2 * * *"}; config.ScheduleTZ = "UTC" }, "30 2 * * * (UTC)", ""},
+    {"cron and at", func(config *Config) { config.Schedules = []string{"30 2 * * *"}; config.At = "02:30" }, "", "Use either --schedule or --at"},
+    {"days with at", func(config *Config) { config.Interval = 36 * time.Hour; config.At = "02:30" }, "", "number of days"},
+  }
+  for testIndex := 0; testIndex < len(tests); testIndex++ {
+    test := tests[testIndex]
+    config := defaultConfig()
+    test.change(&config)
+    schedule, err := newSchedule(config)
+    if test.err != "" {
+      if err == nil || !strings.Contains(err.Error(), test.err) {
+        t.Errorf("%s: got the error %v, expected %s", test.name, err, test.err)
+      }
+      continue
+    }
+    if err != nil || schedule.String() != test.expected {
+      t.Errorf("%s: got %v, %v, expected %s", test.name, schedule, err, test.expected)
+    }
+  }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "os/signal"
+  "syscall"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// preflight checks that the gcloud backend is installed and configured. The
+// api backend already found its credentials when created, only its
+// permissions are checked.
+func preflight(ctx context.Context, backend backups.Backend, needsProject bool) error {
+  if api, ok := backend.(*backups.API); ok {
+    return backups.PreflightError([]backups.CheckResult{api.CheckPermissions(ctx)})
+  }
+  gcloud, ok := backend.(*backups.Gcloud)
+  if !ok {
+    return nil
+  }
+  return backups.PreflightError(gcloud.Preflight(ctx, needsProject))
+}
+
+// runDoctor prints the result of the preflight checks for the same flags and
+// config file as a backup, then of the checks of the projects and the clock,
+// and returns the exit code. Every check is read-only.
+func runDoctor(args []string) int {
+  config, _, err := parseConfig(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err == nil {
+    err = config.Validate()
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitUsage
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  backend, closeBackend, err := newBackend(ctx, config.Backend, config.GcloudPath, config.credentials(), config.MaxRetries, config.Verbose)
+  if err != nil {
+    fmt.Println(backups.CheckResult{Name: config.Backend + " backend", Status: backups.CheckFail, Message: err.Error()})
+    return backups.ExitListingFailure
+  }
+  defer closeBackend()
+  if config.project() != "" {
+    backend = backend.WithProject(config.project())
+  }
+
+  results := make([]backups.CheckResult, 0)
+  report := func(result backups.CheckResult) {
+    fmt.Println(result)
+    results = append(results, result)
+  }
+  if api, ok := backend.(*backups.API); ok {
+    report(backups.CheckResult{Name: config.Backend + " backend", Status: backups.CheckPass, Message: "credentials found"})
+    report(api.CheckPermissions(ctx))
+  } else if gcloud, ok := backend.(*backups.Gcloud); ok {
+    preflightResults := gcloud.Preflight(ctx, len(config.Projects) == 0 && !config.AllProjects)
+    for resultIndex := 0; resultIndex < len(preflightResults); resultIndex++ {
+      report(preflightResults[resultIndex])
+    }
+  }
+  // The projects can't be checked without a working backend
+  if backups.PreflightError(results) == nil {
+    projectBackends := doctorBackends(ctx, config, backend, report)
+    for backendIndex := 0; backendIndex < len(projectBackends); backendIndex++ {
+      doctorProject(ctx, config, projectBackends[backendIndex], report)
+    }
+  }
+  report(backups.CheckClock(ctx))
+
+  if backups.PreflightError(results) != nil {
+    return backups.ExitListingFailure
+  }
+  return backups.ExitOK
+}
+
+// doctorBackends returns the backend of each project of the config: the
+// --projects, the accessible ones with --all-projects, or the project of the
+// backend.
+func doctorBackends(ctx context.Context, config Config, backend backups.Backend, report func(backups.CheckResult)) []backups.Backend {
+  projects := config.Projects
+  if config.AllProjects {
+    var err error
+    projects, err = backend.ListProjects(ctx)
+    if err != nil {
+      report(backups.CheckResult{Name: "projects", Status: backups.CheckFail, Message: err.Error(), Hint: "grant the account resourcemanager.projects.list, or use --projects"})
+      return nil
+    }
+    report(backups.CheckResult{Name: "projects", Status: backups.CheckPass, Message: fmt.Sprintf("%d accessible project(s)", len(projects))})
+  }
+  if len(projects) == 0 {
+    return []backups.Backend{backend}
+  }
+  backends := make([]backups.Backend, 0, len(projects))
+  for projectIndex := 0; projectIndex < len(projects); projectIndex++ {
+    backends = append(backends, backend.WithProject(projects[projectIndex]))
+  }
+  return backends
+}
+
+// doctorProject reports the checks of the project of the backend. The disks
+// of --instance-filter may be the only ones, so a filter matching none is
+// then only a warning.
+func doctorProject(ctx context.Context, config Config, backend backups.Backend, report func(backups.CheckResult)) {
+  computeAPI := backups.CheckComputeAPI(ctx, backend)
+  report(computeAPI)
+  if computeAPI.Status == backups.CheckFail {
+    return
+  }
+  report(backups.CheckQuota(ctx, backend))
+  disks := backups.CheckFilter(ctx, backend, config.Filter)
+  if disks.Status == backups.CheckFail && config.InstanceFilter != "" {
+    disks.Status = backups.CheckWarn
+    disks.Message += ", only the disks of --instance-filter are backed up"
+  }
+  report(disks)
+}
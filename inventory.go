@@ -0,0 +1,210 @@
+package main
+
+import (
+  "context"
+  "encoding/csv"
+  "encoding/json"
+  "flag"
+  "io"
+  "log"
+  "os"
+  "os/signal"
+  "sort"
+  "strconv"
+  "syscall"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// inventorySnapshot is a snapshot of the inventory subcommand output.
+type inventorySnapshot struct {
+  Name              string            `json:"name"`
+  SourceDisk        string            `json:"sourceDisk"`
+  SourceDiskId      string            `json:"sourceDiskId"`
+  CreationTimestamp time.Time         `json:"creationTimestamp"`
+  Status            string            `json:"status"`
+  StorageBytes      int64             `json:"storageBytes"`
+  DiskSizeGb        int64             `json:"diskSizeGb"`
+  StorageLocation   string            `json:"storageLocation"`
+  // STANDARD or ARCHIVE, empty for the instant snapshots
+  SnapshotType      string            `json:"snapshotType"`
+  // Snapshot chain, empty out of any chain
+  ChainName         string            `json:"chainName"`
+  Labels            map[string]string `json:"labels"`
+  // Estimated from the storage, 0 if unknown
+  MonthlyCost       float64           `json:"monthlyCost"`
+  // Provenance written by this program, or any description of the snapshot
+  Description       string            `json:"description,omitempty"`
+  // inventorySnapshots or inventoryInstant, with --instant-snapshots
+  Kind              string            `json:"kind,omitempty"`
+}
+
+const (
+  // Kinds of the snapshots of the inventory
+  inventorySnapshots = "snapshot"
+  inventoryInstant = "instant"
+)
+
+// runInventory writes all the snapshots of the project, or the ones matching
+// the filter, as CSV or JSON, and returns the exit code.
+func runInventory(args []string) int {
+  flags := flag.NewFlagSet(os.Args[0] + " inventory", flag.ContinueOnError)
+  filter := flags.String("filter", "", "Filter of the snapshots to list, all of them if empty")
+  instant := flags.Bool("instant-snapshots", false, "List the instant snapshots too, in a kind column, with no storage cost")
+  ownOnly := flags.Bool("own-snapshots-only", false, "Only list the snapshots created by this program (with the " + backups.CreatedByLabel + "=" + backups.CreatedByValue + " label)")
+  format := flags.String("format", "csv", "Output format: csv or json")
+  out := flags.String("out", "", "Path of the file to write the inventory to, instead of the standard output")
+  price := flags.Float64("price-per-gb-month", backups.DefaultPricePerGbMonth, "Price of the snapshot storage by GB and month, for the estimated costs")
+  archivePrice := flags.Float64("archive-price-per-gb-month", backups.DefaultArchivePricePerGbMonth, "Price of the archive snapshot storage by GB and month, for the estimated costs")
+  costLabel := flags.String("cost-label", "", "Label of the snapshots grouping the total costs by value, like team")
+  project := flags.String("project", envProject(), "Project of the snapshots (default $GOOGLE_CLOUD_PROJECT, $CLOUDSDK_CORE_PROJECT or the configured one)")
+  backendName := flags.String("backend", "gcloud", "Use the gcloud command (gcloud) or the Compute Engine API (api)")
+  maxRetries := flags.Int("max-retries", 3, "Number of retries of the gcloud commands or API calls failing with a transient error")
+  gcloudPath := flags.String("gcloud-path", "gcloud", "Path of the gcloud command, searched in the PATH by default")
+  var credentials backups.Credentials
+  credentialsFlags(flags, &credentials.ImpersonateServiceAccount, &credentials.CredentialsFile, &credentials.BillingProject)
+  skipPreflight := flags.Bool("skip-preflight", false, "Don't check that gcloud is installed and configured before starting")
+  err := flags.Parse(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err != nil {
+    return backups.ExitUsage
+  }
+  if *format != "json" && *format != "csv" {
+    log.Printf("Unknown format '%s', use 'json' or 'csv'\n", *format)
+    return backups.ExitUsage
+  }
+  snapshotsFilter := *filter
+  if *ownOnly {
+    ownFilter := "labels." + backups.CreatedByLabel + " = " + backups.CreatedByValue
+    if snapshotsFilter != "" {
+      snapshotsFilter = "(" + snapshotsFilter + ") AND " + ownFilter
+    } else {
+      snapshotsFilter = ownFilter
+    }
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  backend, closeBackend, err := newBackend(ctx, *backendName, *gcloudPath, credentials, *maxRetries, false)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  defer closeBackend()
+  if !*skipPreflight {
+    err = preflight(ctx, backend, *project == "")
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+  }
+  if *project != "" {
+    backend = backend.WithProject(*project)
+  }
+
+  snapshots, err := backend.ListSnapshotInventory(ctx, snapshotsFilter)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  prices := backups.Prices{Standard: *price, Archive: *archivePrice}
+  inventory := make([]inventorySnapshot, 0, len(snapshots))
+  costsByLabel := make(map[string][]backups.Snapshot)
+  for snapshotIndex := 0; snapshotIndex < len(snapshots); snapshotIndex++ {
+    snapshot := snapshots[snapshotIndex]
+    inventory = append(inventory, inventorySnapshot{Name: snapshot.Name, SourceDisk: snapshot.SourceDisk, SourceDiskId: snapshot.SourceDiskId, CreationTimestamp: snapshot.CreationTimestamp, Status: snapshot.Status, StorageBytes: snapshot.StorageBytes, DiskSizeGb: snapshot.DiskSizeGb, StorageLocation: snapshot.StorageLocation, SnapshotType: snapshot.SnapshotType, ChainName: snapshot.ChainName, Labels: snapshot.Labels, Description: snapshot.Description, MonthlyCost: backups.SnapshotsCost(snapshots[snapshotIndex:snapshotIndex + 1], prices).MonthlyCost})
+    if *costLabel != "" {
+      costsByLabel[snapshot.Labels[*costLabel]] = append(costsByLabel[snapshot.Labels[*costLabel]], snapshot)
+    }
+  }
+  instantCount := 0
+  if *instant {
+    for snapshotIndex := 0; snapshotIndex < len(inventory); snapshotIndex++ {
+      inventory[snapshotIndex].Kind = inventorySnapshots
+    }
+    instantSnapshots, err := backend.ListInstantSnapshots(ctx, snapshotsFilter)
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+    instantCount = len(instantSnapshots)
+    for snapshotIndex := 0; snapshotIndex < len(instantSnapshots); snapshotIndex++ {
+      snapshot := instantSnapshots[snapshotIndex]
+      inventory = append(inventory, inventorySnapshot{Name: snapshot.Name, SourceDisk: snapshot.SourceDisk, SourceDiskId: snapshot.SourceDiskId, CreationTimestamp: snapshot.CreationTimestamp, Status: snapshot.Status, DiskSizeGb: snapshot.DiskSizeGb, StorageLocation: snapshot.Location(), Labels: snapshot.Labels, Kind: inventoryInstant})
+    }
+  }
+
+  var output io.Writer = os.Stdout
+  if *out != "" {
+    file, err := os.Create(*out)
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+    defer file.Close()
+    output = file
+  }
+  if *format == "json" {
+    err = printInventoryJSON(output, inventory)
+  } else {
+    err = printInventoryCSV(output, inventory, *instant)
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  // On the standard error, not to mix them with the inventory
+  log.Printf("Total: %d snapshot(s), %s\n", len(snapshots), backups.SnapshotsCost(snapshots, prices))
+  if *instant {
+    log.Printf("Instant snapshots: %d\n", instantCount)
+  }
+  values := make([]string, 0, len(costsByLabel))
+  for value := range costsByLabel {
+    values = append(values, value)
+  }
+  sort.Strings(values)
+  for valueIndex := 0; valueIndex < len(values); valueIndex++ {
+    value := values[valueIndex]
+    if value == "" {
+      log.Printf("  no %s: %d snapshot(s), %s\n", *costLabel, len(costsByLabel[value]), backups.SnapshotsCost(costsByLabel[value], prices))
+    } else {
+      log.Printf("  %s=%s: %d snapshot(s), %s\n", *costLabel, value, len(costsByLabel[value]), backups.SnapshotsCost(costsByLabel[value], prices))
+    }
+  }
+  return backups.ExitOK
+}
+
+func printInventoryJSON(output io.Writer, inventory []inventorySnapshot) error {
+  encoder := json.NewEncoder(output)
+  encoder.SetIndent("", "  ")
+  return encoder.Encode(inventory)
+}
+
+// printInventoryCSV prints a row by snapshot, with the labels as sorted
+// key=value pairs, and a last kind column with the instant snapshots.
+func printInventoryCSV(output io.Writer, inventory []inventorySnapshot, withKind bool) error {
+  writer := csv.NewWriter(output)
+  header := []string{"snapshot", "source_disk", "source_disk_id", "created", "status", "storage_bytes", "disk_size_gb", "storage_location", "labels", "monthly_cost", "snapshot_type", "description", "chain_name"}
+  if withKind {
+    header = append(header, "kind")
+  }
+  writer.Write(header)
+  for snapshotIndex := 0; snapshotIndex < len(inventory); snapshotIndex++ {
+    snapshot := inventory[snapshotIndex]
+    created := ""
+    if !snapshot.CreationTimestamp.IsZero() {
+      created = snapshot.CreationTimestamp.Format(time.RFC3339)
+    }
+    row := []string{snapshot.Name, snapshot.SourceDisk, snapshot.SourceDiskId, created, snapshot.Status, strconv.FormatInt(snapshot.StorageBytes, 10), strconv.FormatInt(snapshot.DiskSizeGb, 10), snapshot.StorageLocation, backups.FormatLabels(snapshot.Labels), strconv.FormatFloat(snapshot.MonthlyCost, 'f', 4, 64), snapshot.SnapshotType, snapshot.Description, snapshot.ChainName}
+    if withKind {
+      row = append(row, snapshot.Kind)
+    }
+    writer.Write(row)
+  }
+  writer.Flush()
+  return writer.Error()
+}
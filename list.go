@@ -0,0 +1,198 @@
+package main
+
+import (
+  "context"
+  "encoding/csv"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "os/signal"
+  "strconv"
+  "strings"
+  "syscall"
+  "text/tabwriter"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// listedDisk is a disk of the list subcommand output.
+type listedDisk struct {
+  Name                 string           `json:"name"`
+  Zone                 string           `json:"zone"`
+  Region               string           `json:"region,omitempty"`
+  Instances            []string         `json:"instances,omitempty"`
+  SizeGb               int64            `json:"sizeGb"`
+  SnapshotCount        int              `json:"snapshotCount"`
+  NewestSnapshotAge    string           `json:"newestSnapshotAge"`
+  OldestSnapshotAge    string           `json:"oldestSnapshotAge"`
+  Snapshots            []listedSnapshot `json:"snapshots,omitempty"`
+}
+
+type listedSnapshot struct {
+  Name              string    `json:"name"`
+  CreationTimestamp time.Time `json:"creationTimestamp"`
+  Age               string    `json:"age"`
+  Status            string    `json:"status"`
+  SnapshotType      string    `json:"snapshotType"`
+}
+
+// runList prints the disks matching the filter and their snapshots, and
+// returns the exit code. Nothing is created nor deleted.
+func runList(args []string) int {
+  config := defaultConfig()
+  flags := flag.NewFlagSet(os.Args[0] + " list", flag.ContinueOnError)
+  flags.StringVar(&config.Filter, "filter", config.Filter, "Filter to use for disks to list")
+  flags.StringVar(&config.ExcludeFilter, "exclude-filter", config.ExcludeFilter, "Filter to use for disks to never list")
+  flags.StringVar(&config.InstanceFilter, "instance-filter", config.InstanceFilter, "Filter of the instances whose attached disks are listed too")
+  flags.Var((*stringList)(&config.Zones), "zones", "Comma-separated zones of the disks to list, instead of all the zones and regions")
+  flags.Var((*stringList)(&config.Regions), "regions", "Comma-separated regions of the regional disks to list, instead of all the zones and regions")
+  format := flags.String("format", "table", "Output format: table, json or csv")
+  showSnapshots := flags.Bool("show-snapshots", false, "Also list every snapshot of each disk")
+  project := flags.String("project", envProject(), "Project of the disks (default $GOOGLE_CLOUD_PROJECT, $CLOUDSDK_CORE_PROJECT or the configured one)")
+  flags.StringVar(&config.Backend, "backend", config.Backend, "Use the gcloud command (gcloud) or the Compute Engine API (api)")
+  flags.IntVar(&config.MaxRetries, "max-retries", config.MaxRetries, "Number of retries of the gcloud commands or API calls failing with a transient error")
+  flags.StringVar(&config.GcloudPath, "gcloud-path", config.GcloudPath, "Path of the gcloud command, searched in the PATH by default")
+  credentialsFlags(flags, &config.ImpersonateServiceAccount, &config.CredentialsFile, &config.BillingProject)
+  flags.BoolVar(&config.SkipPreflight, "skip-preflight", config.SkipPreflight, "Don't check that gcloud is installed and configured before starting")
+  err := flags.Parse(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err != nil {
+    return backups.ExitUsage
+  }
+  if *format != "table" && *format != "json" && *format != "csv" {
+    log.Printf("Unknown format '%s', use 'table', 'json' or 'csv'\n", *format)
+    return backups.ExitUsage
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  backend, closeBackend, err := newBackend(ctx, config.Backend, config.GcloudPath, config.credentials(), config.MaxRetries, config.Verbose)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  defer closeBackend()
+  if !config.SkipPreflight {
+    err = preflight(ctx, backend, *project == "")
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+  }
+
+  // Same listing as the backups, without the progress logs
+  runner := backups.NewRunner(backups.Options{
+    Project: *project,
+    Filter: config.Filter,
+    ExcludeFilter: config.ExcludeFilter,
+    InstanceFilter: config.InstanceFilter,
+    Zones: config.Zones,
+    Regions: config.Regions,
+    Backend: backend,
+    Logger: log.New(io.Discard, "", 0),
+  })
+  result, err := runner.List(ctx)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+
+  disks := listedDisks(result.Disks, time.Now(), *showSnapshots)
+  switch *format {
+  case "json":
+    err = printListJSON(os.Stdout, disks)
+  case "csv":
+    err = printListCSV(os.Stdout, disks, *showSnapshots)
+  default:
+    err = printListTable(os.Stdout, disks)
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  return backups.ExitOK
+}
+
+// listedDisks summarizes the disks, whose snapshots are newest first.
+func listedDisks(disks []backups.Disk, now time.Time, showSnapshots bool) []listedDisk {
+  listed := make([]listedDisk, 0, len(disks))
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    listedDisk := listedDisk{Name: disk.Name, Zone: disk.Zone, Region: disk.Region, Instances: disk.Users, SizeGb: disk.SizeGb, SnapshotCount: len(disk.Snapshots)}
+    if len(disk.Snapshots) > 0 {
+      listedDisk.NewestSnapshotAge = backups.FormatAge(disk.Snapshots[0].CreationTimestamp, now)
+      listedDisk.OldestSnapshotAge = backups.FormatAge(disk.Snapshots[len(disk.Snapshots) - 1].CreationTimestamp, now)
+    }
+    if showSnapshots {
+      listedDisk.Snapshots = make([]listedSnapshot, 0, len(disk.Snapshots))
+      for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+        snapshot := disk.Snapshots[snapshotIndex]
+        listedDisk.Snapshots = append(listedDisk.Snapshots, listedSnapshot{Name: snapshot.Name, CreationTimestamp: snapshot.CreationTimestamp, Age: backups.FormatAge(snapshot.CreationTimestamp, now), Status: snapshot.Status, SnapshotType: snapshot.SnapshotType})
+      }
+    }
+    listed = append(listed, listedDisk)
+  }
+  return listed
+}
+
+func printListTable(output io.Writer, disks []listedDisk) error {
+  writer := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(writer, "DISK\tLOCATION\tINSTANCES\tSIZE (GB)\tSNAPSHOTS\tNEWEST\tOLDEST")
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    location := disk.Zone
+    if disk.Region != "" {
+      location = disk.Region
+    }
+    fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", disk.Name, location, strings.Join(disk.Instances, ","), disk.SizeGb, disk.SnapshotCount, disk.NewestSnapshotAge, disk.OldestSnapshotAge)
+    for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+      snapshot := disk.Snapshots[snapshotIndex]
+      fmt.Fprintf(writer, "  - %s\t%s\t%s\t\t\t%s\t\n", snapshot.Name, snapshot.Status, snapshot.SnapshotType, snapshot.Age)
+    }
+  }
+  return writer.Flush()
+}
+
+func printListJSON(output io.Writer, disks []listedDisk) error {
+  encoder := json.NewEncoder(output)
+  encoder.SetIndent("", "  ")
+  return encoder.Encode(disks)
+}
+
+// printListCSV prints a row by disk, or by snapshot when they are shown.
+func printListCSV(output io.Writer, disks []listedDisk, showSnapshots bool) error {
+  writer := csv.NewWriter(output)
+  header := []string{"disk", "zone", "region", "instances", "size_gb", "snapshots", "newest_snapshot_age", "oldest_snapshot_age"}
+  if showSnapshots {
+    header = append(header, "snapshot", "snapshot_created", "snapshot_status", "snapshot_type")
+  }
+  writer.Write(header)
+  for diskIndex := 0; diskIndex < len(disks); diskIndex++ {
+    disk := disks[diskIndex]
+    row := []string{disk.Name, disk.Zone, disk.Region, strings.Join(disk.Instances, ","), strconv.FormatInt(disk.SizeGb, 10), strconv.Itoa(disk.SnapshotCount), disk.NewestSnapshotAge, disk.OldestSnapshotAge}
+    if !showSnapshots {
+      writer.Write(row)
+      continue
+    }
+    if len(disk.Snapshots) == 0 {
+      writer.Write(append(row, "", "", "", ""))
+    }
+    for snapshotIndex := 0; snapshotIndex < len(disk.Snapshots); snapshotIndex++ {
+      snapshot := disk.Snapshots[snapshotIndex]
+      created := ""
+      if !snapshot.CreationTimestamp.IsZero() {
+        created = snapshot.CreationTimestamp.Format(time.RFC3339)
+      }
+      writer.Write(append(row[:len(row):len(row)], snapshot.Name, created, snapshot.Status, snapshot.SnapshotType))
+    }
+  }
+  writer.Flush()
+  return writer.Error()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+  "context"
+  "flag"
+  "log"
+  "os"
+  "os/signal"
+  "strings"
+  "syscall"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// runPolicy attaches the snapshot schedule resource policy to the disks, or
+// detaches it with --detach, and returns the exit code.
+func runPolicy(args []string) int {
+  flags := flag.NewFlagSet(os.Args[0] + " policy", flag.ContinueOnError)
+  name := flags.String("name", backups.DefaultPolicyName, "Name of the snapshot schedule resource policy, created in each region of the disks")
+  filter := flags.String("filter", "", "Filter of the disks the policy is attached to, all the disks if empty")
+  detach := flags.Bool("detach", false, "Detach the policy from the disks instead, to manage them with this program again")
+  limit := flags.Int("limit", 7, "Number of snapshots to keep, converted to the max retention days of the policy")
+  maxAge := flags.Duration("max-age", 0, "Age of the snapshots to delete (e.g. 720h), no age limit if 0")
+  retentionMode := flags.String("retention-mode", backups.RetentionBoth, "Keep the snapshots of the limit (count), younger than the max age (age) or both")
+  keepDaily := flags.Int("keep-daily", 0, "Number of daily snapshots to keep, replaces --limit (0 to disable)")
+  keepWeekly := flags.Int("keep-weekly", 0, "Number of weekly snapshots to keep, replaces --limit (0 to disable)")
+  keepMonthly := flags.Int("keep-monthly", 0, "Number of monthly snapshots to keep, replaces --limit (0 to disable)")
+  intervalHours := flags.Int("interval-hours", 0, "A snapshot every 1 to 23 hours, daily if 0")
+  startTime := flags.String("start-time", "04:00", "Start of the schedule in UTC, as HH:MM")
+  storageLocation := flags.String("storage-location", "", "Region or multi-region of the snapshots, chosen by GCE if empty")
+  var labels map[string]string
+  flags.Var((*labelsFlag)(&labels), "extra-labels", "Comma-separated key=value labels added to the snapshots of the policy")
+  project := flags.String("project", envProject(), "Project of the disks (default $GOOGLE_CLOUD_PROJECT, $CLOUDSDK_CORE_PROJECT or the configured one)")
+  dryRun := flags.Bool("dry-run", false, "Tell what would be created, attached or detached but change nothing")
+  backendName := flags.String("backend", "gcloud", "Use the gcloud command (gcloud) or the Compute Engine API (api)")
+  maxRetries := flags.Int("max-retries", 3, "Number of retries of the gcloud commands or API calls failing with a transient error")
+  gcloudPath := flags.String("gcloud-path", "gcloud", "Path of the gcloud command, searched in the PATH by default")
+  var credentials backups.Credentials
+  credentialsFlags(flags, &credentials.ImpersonateServiceAccount, &credentials.CredentialsFile, &credentials.BillingProject)
+  skipPreflight := flags.Bool("skip-preflight", false, "Don't check that gcloud is installed and configured before starting")
+  err := flags.Parse(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err != nil {
+    return backups.ExitUsage
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  backend, closeBackend, err := newBackend(ctx, *backendName, *gcloudPath, credentials, *maxRetries, false)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  defer closeBackend()
+  if !*skipPreflight {
+    err = preflight(ctx, backend, *project == "")
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+  }
+  if *project != "" {
+    backend = backend.WithProject(*project)
+  }
+
+  retention := backups.Retention{Mode: *retentionMode, Limit: *limit, MaxAge: *maxAge, KeepDaily: *keepDaily, KeepWeekly: *keepWeekly, KeepMonthly: *keepMonthly}
+  report, err := backups.RunPolicy(ctx, backups.PolicyOptions{Name: *name, Filter: *filter, Retention: retention, IntervalHours: *intervalHours, StartTime: *startTime, StorageLocation: *storageLocation, Labels: labels, Detach: *detach, DryRun: *dryRun, Backend: backend})
+  logPolicyReport(report)
+  if err != nil && len(report.Disks) == 0 {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitPartialFailure
+  }
+  if len(report.Failed()) > 0 {
+    return backups.ExitPartialFailure
+  }
+  return backups.ExitOK
+}
+
+// logPolicyReport prints the disks managed by the policy, and the ones left
+// to this program.
+func logPolicyReport(report backups.PolicyReport) {
+  policyManaged := make([]backups.PolicyDisk, 0)
+  toolManaged := make([]backups.PolicyDisk, 0)
+  for diskIndex := 0; diskIndex < len(report.Disks); diskIndex++ {
+    disk := report.Disks[diskIndex]
+    if len(disk.Policies) > 0 {
+      policyManaged = append(policyManaged, disk)
+    } else {
+      toolManaged = append(toolManaged, disk)
+    }
+  }
+  log.Println("")
+  log.Println("Summary:")
+  if report.DryRun {
+    log.Println("  [DRY-RUN] nothing was changed")
+  }
+  log.Printf("  Policy-managed:    %d\n", len(policyManaged))
+  for diskIndex := 0; diskIndex < len(policyManaged); diskIndex++ {
+    disk := policyManaged[diskIndex]
+    if disk.Status == backups.PolicyFailed {
+      log.Printf("    - %s: %s (%s %s)\n", disk.Disk, strings.Join(disk.Policies, ", "), disk.Status, disk.Error)
+    } else {
+      log.Printf("    - %s: %s (%s)\n", disk.Disk, strings.Join(disk.Policies, ", "), disk.Status)
+    }
+  }
+  log.Printf("  Tool-managed:      %d\n", len(toolManaged))
+  for diskIndex := 0; diskIndex < len(toolManaged); diskIndex++ {
+    disk := toolManaged[diskIndex]
+    if disk.Status == backups.PolicyFailed {
+      log.Printf("    - %s: %s %s\n", disk.Disk, disk.Status, disk.Error)
+    } else {
+      log.Printf("    - %s (%s)\n", disk.Disk, disk.Status)
+    }
+  }
+}
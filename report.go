@@ -0,0 +1,161 @@
+package main
+
+import (
+  "context"
+  "encoding/csv"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "os/signal"
+  "strconv"
+  "syscall"
+  "text/tabwriter"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// runReport writes the report named by the first argument, and returns the
+// exit code. Nothing is created nor deleted.
+func runReport(args []string) int {
+  if len(args) == 0 || args[0] != "churn" {
+    if len(args) == 0 {
+      log.Printf("Missing report, use '%s report churn'\n", os.Args[0])
+    } else {
+      log.Printf("Unknown report '%s', use 'churn'\n", args[0])
+    }
+    return backups.ExitUsage
+  }
+  return runChurnReport(args[1:])
+}
+
+// runChurnReport writes the change rate of each disk, from the storage of its
+// snapshots in the inventory, the fastest growing first.
+func runChurnReport(args []string) int {
+  flags := flag.NewFlagSet(os.Args[0] + " report churn", flag.ContinueOnError)
+  filter := flags.String("filter", "", "Filter of the snapshots to read, all of them if empty")
+  ownOnly := flags.Bool("own-snapshots-only", false, "Only read the snapshots created by this program (with the " + backups.CreatedByLabel + "=" + backups.CreatedByValue + " label)")
+  format := flags.String("format", "table", "Output format: table, csv or json")
+  out := flags.String("out", "", "Path of the file to write the report to, instead of the standard output")
+  project := flags.String("project", envProject(), "Project of the snapshots (default $GOOGLE_CLOUD_PROJECT, $CLOUDSDK_CORE_PROJECT or the configured one)")
+  backendName := flags.String("backend", "gcloud", "Use the gcloud command (gcloud) or the Compute Engine API (api)")
+  maxRetries := flags.Int("max-retries", 3, "Number of retries of the gcloud commands or API calls failing with a transient error")
+  gcloudPath := flags.String("gcloud-path", "gcloud", "Path of the gcloud command, searched in the PATH by default")
+  var credentials backups.Credentials
+  credentialsFlags(flags, &credentials.ImpersonateServiceAccount, &credentials.CredentialsFile, &credentials.BillingProject)
+  skipPreflight := flags.Bool("skip-preflight", false, "Don't check that gcloud is installed and configured before starting")
+  err := flags.Parse(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err != nil {
+    return backups.ExitUsage
+  }
+  if *format != "table" && *format != "json" && *format != "csv" {
+    log.Printf("Unknown format '%s', use 'table', 'json' or 'csv'\n", *format)
+    return backups.ExitUsage
+  }
+  snapshotsFilter := *filter
+  if *ownOnly {
+    ownFilter := "labels." + backups.CreatedByLabel + " = " + backups.CreatedByValue
+    if snapshotsFilter != "" {
+      snapshotsFilter = "(" + snapshotsFilter + ") AND " + ownFilter
+    } else {
+      snapshotsFilter = ownFilter
+    }
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  backend, closeBackend, err := newBackend(ctx, *backendName, *gcloudPath, credentials, *maxRetries, false)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  defer closeBackend()
+  if !*skipPreflight {
+    err = preflight(ctx, backend, *project == "")
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+  }
+  if *project != "" {
+    backend = backend.WithProject(*project)
+  }
+
+  snapshots, err := backend.ListSnapshotInventory(ctx, snapshotsFilter)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  churns := backups.Churn(snapshots)
+
+  var output io.Writer = os.Stdout
+  if *out != "" {
+    file, err := os.Create(*out)
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+    defer file.Close()
+    output = file
+  }
+  switch *format {
+  case "json":
+    err = printChurnJSON(output, churns)
+  case "csv":
+    err = printChurnCSV(output, churns)
+  default:
+    err = printChurnTable(output, churns)
+  }
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  // On the standard error, not to mix them with the report
+  log.Printf("Total: %d disk(s), %d snapshot(s)\n", len(churns), len(snapshots))
+  return backups.ExitOK
+}
+
+// printChurnTable prints a row by disk, with the sparkline of its recent
+// daily changes.
+func printChurnTable(output io.Writer, churns []backups.DiskChurn) error {
+  writer := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(writer, "DISK\tSIZE (GB)\tSNAPSHOTS\tSTORED (GB)\tGROWTH (GB/DAY)\tCHANGE (%/DAY)\tTREND")
+  for churnIndex := 0; churnIndex < len(churns); churnIndex++ {
+    churn := churns[churnIndex]
+    fmt.Fprintf(writer, "%s\t%d\t%d\t%.1f\t%.2f\t%.2f\t%s\n", churn.Disk, churn.DiskSizeGb, churn.Snapshots, float64(churn.StorageBytes) / 1e9, churn.DailyGrowthBytes / 1e9, churn.DailyChangePercent, churn.Sparkline())
+  }
+  return writer.Flush()
+}
+
+func printChurnJSON(output io.Writer, churns []backups.DiskChurn) error {
+  encoder := json.NewEncoder(output)
+  encoder.SetIndent("", "  ")
+  return encoder.Encode(churns)
+}
+
+// printChurnCSV prints a row by delta between two snapshots of a disk, or a
+// row with no delta for a disk with a single snapshot.
+func printChurnCSV(output io.Writer, churns []backups.DiskChurn) error {
+  writer := csv.NewWriter(output)
+  writer.Write([]string{"disk", "source_disk_id", "disk_size_gb", "snapshots", "storage_bytes", "daily_growth_bytes", "daily_change_percent", "snapshot", "snapshot_created", "snapshot_storage_bytes", "download_bytes_delta", "interval_hours", "bytes_per_day"})
+  for churnIndex := 0; churnIndex < len(churns); churnIndex++ {
+    churn := churns[churnIndex]
+    row := []string{churn.Disk, churn.SourceDiskId, strconv.FormatInt(churn.DiskSizeGb, 10), strconv.Itoa(churn.Snapshots), strconv.FormatInt(churn.StorageBytes, 10), strconv.FormatFloat(churn.DailyGrowthBytes, 'f', 0, 64), strconv.FormatFloat(churn.DailyChangePercent, 'f', 4, 64)}
+    if len(churn.Deltas) == 0 {
+      writer.Write(append(row, "", "", "", "", "", ""))
+    }
+    for deltaIndex := 0; deltaIndex < len(churn.Deltas); deltaIndex++ {
+      delta := churn.Deltas[deltaIndex]
+      writer.Write(append(row[:len(row):len(row)], delta.Snapshot, delta.CreationTimestamp.Format(time.RFC3339), strconv.FormatInt(delta.StorageBytes, 10), strconv.FormatInt(delta.DownloadBytesDelta, 10), strconv.FormatFloat(delta.IntervalHours, 'f', 2, 64), strconv.FormatFloat(delta.BytesPerDay, 'f', 0, 64)))
+    }
+  }
+  writer.Flush()
+  return writer.Error()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "log"
+  "os"
+  "os/signal"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// runRestore creates a disk from a snapshot and returns the exit code.
+func runRestore(args []string) int {
+  flags := flag.NewFlagSet(os.Args[0] + " restore", flag.ContinueOnError)
+  disk := flags.String("disk", "", "Disk whose newest snapshot created by this program is restored")
+  snapshot := flags.String("snapshot", "", "Snapshot to restore, instead of the newest one of --disk")
+  group := flags.String("group", "", "Restore all the snapshots of this " + backups.GroupLabel + ", created together with --group-by-instance, as new disks")
+  at := flags.String("at", "", "Restore the newest snapshot created at or before this RFC 3339 time (e.g. 2026-10-14T02:00:00+02:00)")
+  zone := flags.String("zone", "", "Zone of the new disk")
+  newDiskName := flags.String("new-disk-name", "", "Name of the new disk (default <disk>-restored-<time>)")
+  size := flags.String("size", "", "Size of the new disk, e.g. 200GB or 1TB (default the size of the snapshot)")
+  diskType := flags.String("disk-type", "", "Type of the new disk, e.g. pd-ssd or hyperdisk-balanced (default pd-standard)")
+  project := flags.String("project", envProject(), "Project of the snapshot and the new disk (default $GOOGLE_CLOUD_PROJECT, $CLOUDSDK_CORE_PROJECT or the configured one)")
+  dryRun := flags.Bool("dry-run", false, "Find the snapshot but don't create the disk")
+  backendName := flags.String("backend", "gcloud", "Use the gcloud command (gcloud) or the Compute Engine API (api)")
+  maxRetries := flags.Int("max-retries", 3, "Number of retries of the gcloud commands or API calls failing with a transient error")
+  gcloudPath := flags.String("gcloud-path", "gcloud", "Path of the gcloud command, searched in the PATH by default")
+  var credentials backups.Credentials
+  credentialsFlags(flags, &credentials.ImpersonateServiceAccount, &credentials.CredentialsFile, &credentials.BillingProject)
+  skipPreflight := flags.Bool("skip-preflight", false, "Don't check that gcloud is installed and configured before starting")
+  err := flags.Parse(args)
+  if err == flag.ErrHelp {
+    return backups.ExitOK
+  }
+  if err != nil {
+    return backups.ExitUsage
+  }
+
+  options := backups.RestoreOptions{Disk: *disk, Snapshot: *snapshot, Zone: *zone, NewDiskName: *newDiskName, DiskType: backups.NormalizeDiskType(*diskType), Group: *group, DryRun: *dryRun}
+  if *group != "" && (*disk != "" || *snapshot != "" || *at != "" || *newDiskName != "" || *size != "") {
+    log.Println("Use --group without --disk, --snapshot, --at, --new-disk-name and --size")
+    return backups.ExitUsage
+  }
+  if *at != "" {
+    options.At, err = time.Parse(time.RFC3339, *at)
+    if err != nil {
+      log.Printf("Invalid --at time: %s\n", err)
+      return backups.ExitUsage
+    }
+  }
+  if *size != "" {
+    options.SizeGb, err = parseSizeGb(*size)
+    if err != nil {
+      log.Println(err)
+      return backups.ExitUsage
+    }
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  backend, closeBackend, err := newBackend(ctx, *backendName, *gcloudPath, credentials, *maxRetries, false)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitListingFailure
+  }
+  defer closeBackend()
+  if !*skipPreflight {
+    err = preflight(ctx, backend, *project == "")
+    if err != nil {
+      log.Println(err)
+      return backups.ExitListingFailure
+    }
+  }
+  if *project != "" {
+    backend = backend.WithProject(*project)
+  }
+  options.Backend = backend
+  restoredProject, _ := backend.Project(ctx)
+
+  if *group != "" {
+    newDisks, err := backups.RestoreGroup(ctx, options)
+    if !*dryRun {
+      for diskIndex := 0; diskIndex < len(newDisks); diskIndex++ {
+        fmt.Println("projects/" + restoredProject + "/zones/" + newDisks[diskIndex].Zone + "/disks/" + newDisks[diskIndex].Name)
+      }
+    }
+    if err != nil {
+      log.Println(err)
+      return backups.ExitPartialFailure
+    }
+    return backups.ExitOK
+  }
+
+  newDisk, _, err := backups.Restore(ctx, options)
+  if err != nil {
+    log.Println(err)
+    return backups.ExitPartialFailure
+  }
+
+  resource := "projects/" + restoredProject + "/zones/" + newDisk.Zone + "/disks/" + newDisk.Name
+  if *dryRun {
+    log.Printf("Disk %s not created (dry run)\n", resource)
+    return backups.ExitOK
+  }
+  fmt.Println(resource)
+  return backups.ExitOK
+}
+
+// parseSizeGb parses a disk size in GB, like 200, 200GB or 2TB.
+func parseSizeGb(size string) (int64, error) {
+  unit := int64(1)
+  number := strings.TrimSuffix(strings.ToUpper(size), "GB")
+  if strings.HasSuffix(number, "TB") {
+    unit = 1024
+    number = strings.TrimSuffix(number, "TB")
+  }
+  value, err := strconv.ParseInt(number, 10, 64)
+  if err != nil || value <= 0 {
+    return 0, fmt.Errorf("Invalid size '%s', use e.g. 200GB or 1TB", size)
+  }
+  return value * unit, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+  "context"
+  "crypto/subtle"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "sync"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// Header of the shared secret of the HTTP triggers, if any
+const secretHeader = "X-Backup-Secret"
+
+// runRequest is the optional body of POST /run, overriding the config.
+type runRequest struct {
+  Filter *string `json:"filter"`
+  Limit  *int    `json:"limit"`
+  DryRun *bool   `json:"dryRun"`
+}
+
+// server runs the backups triggered over HTTP, one at a time.
+type server struct {
+  // Cancelled when the server stops, cancelling the run in progress
+  ctx       context.Context
+  config    Config
+  backend   backups.Backend
+  notifiers []backups.Notifier
+  running   sync.Mutex
+}
+
+// runServer serves POST /run and GET /healthz on the address until
+// interrupted.
+func runServer(ctx context.Context, config Config, backend backups.Backend, notifiers []backups.Notifier) int {
+  backupServer := &server{ctx: ctx, config: config, backend: backend, notifiers: notifiers}
+  mux := http.NewServeMux()
+  mux.HandleFunc("POST /run", backupServer.run)
+  mux.HandleFunc("GET /healthz", func(writer http.ResponseWriter, request *http.Request) {
+    fmt.Fprintln(writer, "ok")
+  })
+  httpServer := &http.Server{Addr: config.Serve, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+  // Ends the shutdown goroutine when the server fails to listen
+  served := make(chan struct{})
+  defer close(served)
+  stop := stopping
+  go func() {
+    select {
+    case <-ctx.Done():
+    case <-stop:
+    case <-served:
+      return
+    }
+    // The run in progress is stopped, its response is still sent
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    defer cancel()
+    httpServer.Shutdown(shutdownCtx)
+  }()
+
+  log.Printf("Listening on %s\n", config.Serve)
+  err := httpServer.ListenAndServe()
+  if err != nil && !errors.Is(err, http.ErrServerClosed) {
+    // E.g. an invalid address or one already in use, not a listing failure
+    log.Println(err)
+    return backups.ExitUsage
+  }
+  log.Println("Server stopped")
+  return backups.ExitOK
+}
+
+// run runs the backup and responds with its report, with the 500 status when
+// it failed.
+func (backupServer *server) run(writer http.ResponseWriter, request *http.Request) {
+  secret := backupServer.config.ServeSecret
+  if secret != "" && subtle.ConstantTimeCompare([]byte(request.Header.Get(secretHeader)), []byte(secret)) != 1 {
+    http.Error(writer, "Invalid " + secretHeader + " header", http.StatusUnauthorized)
+    return
+  }
+
+  config := backupServer.config
+  var overrides runRequest
+  decoder := json.NewDecoder(io.LimitReader(request.Body, 64 * 1024))
+  decoder.DisallowUnknownFields()
+  err := decoder.Decode(&overrides)
+  if err != nil && !errors.Is(err, io.EOF) {
+    http.Error(writer, "Invalid body: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  if overrides.Filter != nil {
+    config.Filter = *overrides.Filter
+  }
+  if overrides.Limit != nil {
+    config.Retention.Limit = *overrides.Limit
+  }
+  if overrides.DryRun != nil {
+    config.DryRun = *overrides.DryRun
+  }
+  err = config.Validate()
+  if err != nil {
+    http.Error(writer, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  if !backupServer.running.TryLock() {
+    http.Error(writer, "A backup is already in progress", http.StatusConflict)
+    return
+  }
+  defer backupServer.running.Unlock()
+
+  log.Printf("Backup triggered by %s\n", request.RemoteAddr)
+  report := backup(backups.ExtractTraceContext(backupServer.ctx, request.Header), config, backupServer.backend, backupServer.notifiers)
+  status := http.StatusOK
+  if report.ExitCode != backups.ExitOK {
+    status = http.StatusInternalServerError
+  }
+  writer.Header().Set("Content-Type", "application/json")
+  writer.WriteHeader(status)
+  json.NewEncoder(writer).Encode(report)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+  "context"
+  "log"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
+
+  "github.com/Mille-Volts/gcp-backups/backups"
+)
+
+// Closed on the first SIGINT or SIGTERM, no new operation is started then.
+// Never closed without gracefulShutdown.
+var stopping <-chan struct{}
+
+// isStopping tells if the first signal was received.
+func isStopping() bool {
+  select {
+  case <-stopping:
+    return true
+  default:
+    return false
+  }
+}
+
+// gracefulShutdown handles SIGINT and SIGTERM: the first one stops starting
+// new operations, and the returned context is cancelled after the grace
+// period, killing the operations in progress. The second one exits at once.
+// The function stops handling the signals.
+func gracefulShutdown(gracePeriod time.Duration) (context.Context, func()) {
+  ctx, cancel := context.WithCancel(context.Background())
+  stop := make(chan struct{})
+  stopping = stop
+
+  signals := make(chan os.Signal, 2)
+  signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+  go func() {
+    var received os.Signal
+    select {
+    case received = <-signals:
+    case <-ctx.Done():
+      return
+    }
+    log.Printf("Received %s: stopping, the operations in progress get %s to complete (send it again to exit now)\n", received, gracePeriod)
+    close(stop)
+    timer := time.NewTimer(gracePeriod)
+    defer timer.Stop()
+    select {
+    case received = <-signals:
+      log.Printf("Received %s again: exiting now\n", received)
+      os.Exit(backups.ExitInterrupted)
+    case <-timer.C:
+      log.Printf("WARNING: grace period of %s elapsed, cancelling the operations in progress\n", gracePeriod)
+      cancel()
+    case <-ctx.Done():
+      return
+    }
+    // The summary and the notifications can still be sent meanwhile
+    received = <-signals
+    log.Printf("Received %s again: exiting now\n", received)
+    os.Exit(backups.ExitInterrupted)
+  }()
+
+  return ctx, func() {
+    signal.Stop(signals)
+    cancel()
+  }
+}
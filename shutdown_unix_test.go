@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+  "syscall"
+  "testing"
+  "time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+  ctx, stop := gracefulShutdown(50 * time.Millisecond)
+  defer stop()
+  if isStopping() || ctx.Err() != nil {
+    t.Fatalf("Stopping before any signal")
+  }
+
+  err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+  if err != nil {
+    t.Fatal(err)
+  }
+  select {
+  case <-stopping:
+  case <-time.After(10 * time.Second):
+    t.Fatalf("Not stopping after SIGTERM")
+  }
+  // The operations in progress get the grace period
+  if ctx.Err() != nil {
+    t.Errorf("The context was cancelled at once")
+  }
+  select {
+  case <-ctx.Done():
+  case <-time.After(10 * time.Second):
+    t.Fatalf("The context wasn't cancelled after the grace period")
+  }
+}